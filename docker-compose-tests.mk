@@ -11,6 +11,12 @@ docker-compose-test-go: docker-compose-up
 		cd /tests && source ./env && \
 		go test -v .'
 
+# Longer pgbench compatibility runs only.
+docker-compose-test-pgbench: docker-compose-up
+	docker compose exec -T go_test /bin/bash -ec ' \
+		cd /tests && source ./env && \
+		PGBENCH_DURATION=30 go test -v -timeout 30m -run TestPgbenchCompatibility .'
+
 docker-compose-test-python: docker-compose-up
 	docker compose exec -T python_test /bin/bash -ec ' \
 		cd /tests && \
@@ -470,6 +470,38 @@ impl<M: Manager, W: From<Object<M>>> Pool<M, W> {
         Ok(Some(unready_obj.ready()))
     }
 
+    /// Creates a new object and puts it into this [`Pool`] as an idle one,
+    /// unless all the slots are taken. Returns whether an object was added.
+    ///
+    /// This is used to keep a minimum number of objects in the pool without
+    /// taking the idle ones away from the users waiting for them.
+    ///
+    /// # Errors
+    ///
+    /// See [`PoolError`] for details.
+    pub async fn grow(&self) -> Result<bool, PoolError<M::Error>> {
+        let permit = match self.inner.semaphore.try_acquire() {
+            Ok(permit) => permit,
+            Err(TryAcquireError::Closed) => return Err(PoolError::Closed),
+            Err(TryAcquireError::NoPermits) => return Ok(false),
+        };
+        let _ = self.inner.users.fetch_add(1, Ordering::Relaxed);
+        let users_guard = DropGuard(|| {
+            let _ = self.inner.users.fetch_sub(1, Ordering::Relaxed);
+        });
+
+        match self.try_create(&self.timeouts()).await? {
+            Some(inner_obj) => {
+                // The object is returned like a used one, giving back the permit.
+                users_guard.disarm();
+                permit.forget();
+                self.inner.return_object(inner_obj);
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
     /**
      * Resize the pool. This change the `max_size` of the pool dropping
      * excess objects and/or making space for new ones.
@@ -486,10 +518,13 @@ impl<M: Manager, W: From<Object<M>>> Pool<M, W> {
         slots.max_size = max_size;
         // shrink pool
         if max_size < old_max_size {
-            while slots.size > slots.max_size {
+            // Take away one permit per removed slot, closing an idle object
+            // with it while there are too many. The objects in use over the
+            // new size are closed when they are returned.
+            for _ in max_size..old_max_size {
                 if let Ok(permit) = self.inner.semaphore.try_acquire() {
                     permit.forget();
-                    if slots.vec.pop_front().is_some() {
+                    if slots.size > slots.max_size && slots.vec.pop_front().is_some() {
                         slots.size -= 1;
                     }
                 } else {
@@ -505,7 +540,7 @@ impl<M: Manager, W: From<Object<M>>> Pool<M, W> {
         }
         // grow pool
         if max_size > old_max_size {
-            let additional = slots.max_size - slots.size;
+            let additional = slots.max_size - old_max_size;
             slots.vec.reserve_exact(additional);
             self.inner.semaphore.add_permits(additional);
         }
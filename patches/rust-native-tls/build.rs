@@ -8,6 +8,10 @@ fn main() {
         if version >= 0x1_01_00_00_0 {
             println!("cargo:rustc-cfg=have_min_max_version");
         }
+
+        if version >= 0x1_01_01_00_0 {
+            println!("cargo:rustc-cfg=have_tls13");
+        }
     }
 
     if let Ok(version) = env::var("DEP_OPENSSL_LIBRESSL_VERSION_NUMBER") {
@@ -16,7 +20,12 @@ fn main() {
         if version >= 0x2_06_01_00_0 {
             println!("cargo:rustc-cfg=have_min_max_version");
         }
+
+        if version >= 0x3_04_00_00_0 {
+            println!("cargo:rustc-cfg=have_tls13");
+        }
     }
 
-    println!("cargo::rustc-check-cfg=cfg(have_min_max_version)")
+    println!("cargo::rustc-check-cfg=cfg(have_min_max_version)");
+    println!("cargo::rustc-check-cfg=cfg(have_tls13)")
 }
@@ -7,11 +7,12 @@ use self::openssl::nid::Nid;
 use self::openssl::pkcs12::Pkcs12;
 use self::openssl::pkey::{PKey, Private};
 use self::openssl::ssl::{
-    self, MidHandshakeSslStream, SslAcceptor, SslConnector, SslContextBuilder, SslMethod,
-    SslVerifyMode,
+    self, MidHandshakeSslStream, NameType, SniError, SslAcceptor, SslConnector, SslContext,
+    SslContextBuilder, SslMethod, SslVerifyMode,
 };
 use self::openssl::x509::{store::X509StoreBuilder, X509VerifyResult, X509};
 use self::openssl_probe::ProbeResult;
+use std::collections::HashMap;
 use std::error;
 use std::fmt;
 use std::io;
@@ -35,6 +36,10 @@ fn supported_protocols(
             Protocol::Tlsv10 => SslVersion::TLS1,
             Protocol::Tlsv11 => SslVersion::TLS1_1,
             Protocol::Tlsv12 => SslVersion::TLS1_2,
+            #[cfg(have_tls13)]
+            Protocol::Tlsv13 => SslVersion::TLS1_3,
+            #[cfg(not(have_tls13))]
+            Protocol::Tlsv13 => SslVersion::TLS1_2,
         }
     }
 
@@ -73,9 +78,16 @@ fn supported_protocols(
                 | SslOptions::NO_TLSV1
                 | SslOptions::NO_TLSV1_1
         }
+        Some(Protocol::Tlsv13) => {
+            SslOptions::NO_SSLV2
+                | SslOptions::NO_SSLV3
+                | SslOptions::NO_TLSV1
+                | SslOptions::NO_TLSV1_1
+                | SslOptions::NO_TLSV1_2
+        }
     };
     options |= match max {
-        None | Some(Protocol::Tlsv12) => SslOptions::empty(),
+        None | Some(Protocol::Tlsv12) | Some(Protocol::Tlsv13) => SslOptions::empty(),
         Some(Protocol::Tlsv11) => SslOptions::NO_TLSV1_2,
         Some(Protocol::Tlsv10) => SslOptions::NO_TLSV1_1 | SslOptions::NO_TLSV1_2,
         Some(Protocol::Sslv3) => {
@@ -113,6 +125,7 @@ pub enum Error {
     Ssl(ssl::Error, X509VerifyResult),
     EmptyChain,
     NotPkcs8,
+    Unsupported(&'static str),
 }
 
 impl error::Error for Error {
@@ -122,6 +135,7 @@ impl error::Error for Error {
             Error::Ssl(ref e, _) => error::Error::source(e),
             Error::EmptyChain => None,
             Error::NotPkcs8 => None,
+            Error::Unsupported(_) => None,
         }
     }
 }
@@ -137,6 +151,9 @@ impl fmt::Display for Error {
                 "at least one certificate must be provided to create an identity"
             ),
             Error::NotPkcs8 => write!(fmt, "expected PKCS#8 PEM"),
+            Error::Unsupported(what) => {
+                write!(fmt, "{} is not supported by this OpenSSL version", what)
+            }
         }
     }
 }
@@ -391,6 +408,45 @@ impl TlsAcceptor {
             acceptor.add_extra_chain_cert(cert.to_owned())?;
         }
         supported_protocols(builder.min_protocol, builder.max_protocol, &mut acceptor)?;
+        if let Some(cipher_list) = &builder.cipher_list {
+            acceptor.set_cipher_list(cipher_list)?;
+        }
+        if let Some(ciphersuites) = &builder.ciphersuites {
+            #[cfg(have_tls13)]
+            acceptor.set_ciphersuites(ciphersuites)?;
+            #[cfg(not(have_tls13))]
+            return Err(Error::Unsupported("TLS 1.3 ciphersuites"));
+        }
+        if let Some(groups_list) = &builder.groups_list {
+            #[cfg(have_tls13)]
+            acceptor.set_groups_list(groups_list)?;
+            #[cfg(not(have_tls13))]
+            return Err(Error::Unsupported("groups list"));
+        }
+
+        // The certificate is switched to the one of the server name the client sent, if any.
+        if !builder.sni_identities.is_empty() {
+            let mut contexts = HashMap::new();
+            for (server_name, identity) in builder.sni_identities.iter() {
+                let mut context = SslContextBuilder::new(SslMethod::tls())?;
+                context.set_private_key(&identity.0.pkey)?;
+                context.set_certificate(&identity.0.cert)?;
+                for cert in identity.0.chain.iter() {
+                    context.add_extra_chain_cert(cert.to_owned())?;
+                }
+                contexts.insert(server_name.to_ascii_lowercase(), context.build());
+            }
+            acceptor.set_servername_callback(move |ssl, _alert| {
+                let context: Option<&SslContext> = ssl
+                    .servername(NameType::HOST_NAME)
+                    .and_then(|name| contexts.get(&name.to_ascii_lowercase()));
+                if let Some(context) = context {
+                    ssl.set_ssl_context(context)
+                        .map_err(|_| SniError::ALERT_FATAL)?;
+                }
+                Ok(())
+            });
+        }
 
         Ok(TlsAcceptor(acceptor.build()))
     }
@@ -431,6 +487,13 @@ impl<S: io::Read + io::Write> TlsStream<S> {
         Ok(self.0.ssl().peer_certificate().map(Certificate))
     }
 
+    pub fn server_name(&self) -> Option<String> {
+        self.0
+            .ssl()
+            .servername(NameType::HOST_NAME)
+            .map(|name| name.to_string())
+    }
+
     #[cfg(feature = "alpn")]
     pub fn negotiated_alpn(&self) -> Result<Option<Vec<u8>>, Error> {
         Ok(self
@@ -321,6 +321,8 @@ pub enum Protocol {
     Tlsv11,
     /// The TLS 1.2 protocol.
     Tlsv12,
+    /// The TLS 1.3 protocol.
+    Tlsv13,
 }
 
 /// A builder for `TlsConnector`s.
@@ -523,7 +525,15 @@ pub struct TlsAcceptorBuilder {
     #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
     client_cert_verification: TlsClientCertificateVerification,
     #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
-    client_cert_verification_ca_cert: Option<Certificate>
+    client_cert_verification_ca_cert: Option<Certificate>,
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    sni_identities: Vec<(String, Identity)>,
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    cipher_list: Option<String>,
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    ciphersuites: Option<String>,
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    groups_list: Option<String>,
 }
 
 impl TlsAcceptorBuilder {
@@ -567,6 +577,41 @@ impl TlsAcceptorBuilder {
         self
     }
 
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    /// Adds an identity used instead of the default one for clients sending this
+    /// server name (SNI). Server names are matched case-insensitively.
+    pub fn sni_identity(&mut self, server_name: &str, identity: Identity) -> &mut TlsAcceptorBuilder {
+        self.sni_identities.push((server_name.to_string(), identity));
+        self
+    }
+
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    /// Sets the ciphers of TLS 1.2 and older, in the OpenSSL cipher list format.
+    ///
+    /// Defaults to `None`, the ciphers of the implementation.
+    pub fn cipher_list(&mut self, cipher_list: Option<&str>) -> &mut TlsAcceptorBuilder {
+        self.cipher_list = cipher_list.map(|list| list.to_string());
+        self
+    }
+
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    /// Sets the cipher suites of TLS 1.3, a colon-separated list.
+    ///
+    /// Defaults to `None`, the cipher suites of the implementation.
+    pub fn ciphersuites(&mut self, ciphersuites: Option<&str>) -> &mut TlsAcceptorBuilder {
+        self.ciphersuites = ciphersuites.map(|list| list.to_string());
+        self
+    }
+
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    /// Sets the key exchange groups (curves) in order of preference, a colon-separated list.
+    ///
+    /// Defaults to `None`, the groups of the implementation.
+    pub fn groups_list(&mut self, groups_list: Option<&str>) -> &mut TlsAcceptorBuilder {
+        self.groups_list = groups_list.map(|list| list.to_string());
+        self
+    }
+
     /// Creates a new `TlsAcceptor`.
     pub fn build(&self) -> Result<TlsAcceptor> {
         let acceptor = imp::TlsAcceptor::new(self)?;
@@ -635,6 +680,14 @@ impl TlsAcceptor {
             client_cert_verification: TlsClientCertificateVerification::DoNotRequestCertificate,
             #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
             client_cert_verification_ca_cert: None,
+            #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+            sni_identities: Vec::new(),
+            #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+            cipher_list: None,
+            #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+            ciphersuites: None,
+            #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+            groups_list: None,
         }
     }
 
@@ -688,6 +741,12 @@ impl<S: io::Read + io::Write> TlsStream<S> {
         Ok(self.0.peer_certificate()?.map(Certificate))
     }
 
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    /// Returns the server name (SNI) the client sent, on the server side.
+    pub fn server_name(&self) -> Option<String> {
+        self.0.server_name()
+    }
+
     /// Returns the tls-server-end-point channel binding data as defined in [RFC 5929].
     ///
     /// [RFC 5929]: https://tools.ietf.org/html/rfc5929
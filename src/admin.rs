@@ -1,38 +1,123 @@
 // Standard library imports
-use std::collections::HashMap;
+use std::collections::{HashMap, VecDeque};
+use std::net::SocketAddr;
 use std::sync::atomic::Ordering;
 
 // External crate imports
 use bytes::{Buf, BufMut, BytesMut};
-use log::{debug, error, info};
+use chrono::{DateTime, Local};
+use log::{debug, error, info, warn};
 use nix::sys::signal::{self, Signal};
 use nix::unistd::Pid;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::fs::OpenOptions;
+use tokio::io::AsyncWriteExt;
 use tokio::time::Instant;
 
 // Internal crate imports
 use crate::config::{get_config, reload_config, VERSION};
+use crate::dns_cache::dns_entries;
 use crate::errors::Error;
+use crate::log_rules::{add_log_rule, clear_log_rules, get_log_rules, LogRule, LogTarget};
 use crate::messages::protocol::{
     command_complete, data_row, error_response, notify, row_description,
 };
 use crate::messages::socket::write_all_half;
 use crate::messages::types::DataType;
-use crate::pool::{get_all_pools, ClientServerMap};
+use crate::pool::{
+    clear_injected_errors, get_all_pools, inject_error, is_paused, pause_databases,
+    pool_of_databases, resume_databases, ClientServerMap, ErrorInjectionTarget,
+    PASSTHROUGH_OVERRIDES, PAUSED_DATABASES,
+};
+use crate::profiler::{self, start_profiler, stop_profiler};
+use crate::quarantine::{get_protocol_violations, Violations};
+use crate::redact::redact;
+use crate::replica_status::replica_lags;
 use crate::stats::client::{CLIENT_STATE_ACTIVE, CLIENT_STATE_IDLE};
 #[cfg(target_os = "linux")]
 use crate::stats::get_socket_states_count;
+use crate::stats::history::{get_stats_history, StatsSnapshot};
+use crate::stats::hosts::{get_host_stats, host_stats};
 use crate::stats::pool::PoolStats;
+use crate::stats::prepared_transactions::{get_prepared_transactions, PreparedTransaction};
 use crate::stats::server::{SERVER_STATE_ACTIVE, SERVER_STATE_IDLE};
 use crate::stats::{
     get_client_stats, get_server_stats, CANCEL_CONNECTION_COUNTER, PLAIN_CONNECTION_COUNTER,
     TLS_CONNECTION_COUNTER, TOTAL_CONNECTION_COUNTER,
 };
+use crate::tls::configured_certificates_expiry;
+
+/// How long a LOG command applies if no duration is given (5 min).
+const DEFAULT_LOG_LEVEL_SECONDS: u64 = 300;
+
+/// A command run on the admin console.
+#[derive(Debug, Clone)]
+pub struct AdminHistoryEntry {
+    pub time: DateTime<Local>,
+    pub username: String,
+    pub addr: SocketAddr,
+    pub command: String,
+}
+
+impl std::fmt::Display for AdminHistoryEntry {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{} user={} addr={} command={:?}",
+            self.time.to_rfc3339(),
+            self.username,
+            self.addr,
+            self.command
+        )
+    }
+}
+
+/// Last admin console commands, shown by SHOW ADMIN_HISTORY.
+static ADMIN_HISTORY: Lazy<Mutex<VecDeque<AdminHistoryEntry>>> =
+    Lazy::new(|| Mutex::new(VecDeque::new()));
+
+/// Remember the admin command and append it to the audit file, if configured.
+async fn record_admin_command(username: &str, addr: SocketAddr, command: &str) {
+    let config = get_config();
+    let entry = AdminHistoryEntry {
+        time: Local::now(),
+        username: username.to_string(),
+        addr,
+        command: redact(command).into_owned(),
+    };
+
+    info!("Admin command from {username}@{addr}: {}", entry.command);
+
+    if let Some(ref path) = config.general.admin_audit_file {
+        let written = match OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await
+        {
+            Ok(mut file) => file.write_all(format!("{entry}\n").as_bytes()).await,
+            Err(err) => Err(err),
+        };
+        if let Err(err) = written {
+            error!("Failed to write admin audit file {path}: {err}");
+        }
+    }
+
+    let mut history = ADMIN_HISTORY.lock();
+    history.push_back(entry);
+    while history.len() > config.general.admin_history_size {
+        history.pop_front();
+    }
+}
 
 /// Handle admin client.
 pub async fn handle_admin<T>(
     stream: &mut T,
     mut query: BytesMut,
     client_server_map: ClientServerMap,
+    username: &str,
+    addr: SocketAddr,
 ) -> Result<(), Error>
 where
     T: tokio::io::AsyncWrite + std::marker::Unpin,
@@ -49,12 +134,30 @@ where
     let query = String::from_utf8_lossy(&query[..len - 5]).to_string();
 
     debug!("Admin query: {query}");
+    record_admin_command(username, addr, query.trim()).await;
 
     let query_parts: Vec<&str> = query.trim_end_matches(';').split_whitespace().collect();
 
     match query_parts[0].to_ascii_uppercase().as_str() {
         "RELOAD" => reload(stream, client_server_map).await,
         "SHUTDOWN" => shutdown(stream).await,
+        "INJECT" => inject(stream, &query_parts[1..]).await,
+        "LOG" => log_level(stream, &query_parts[1..]).await,
+        "PASSTHROUGH" => passthrough(stream, &query_parts[1..]).await,
+        "PROFILE" => profile(stream, &query_parts[1..]).await,
+        "PAUSE" => pause(stream, &query_parts[1..]).await,
+        "RESUME" => resume(stream, &query_parts[1..]).await,
+        "RESET" => reset(stream, &query_parts[1..]).await,
+        "SHOW"
+            if query_parts.len() == 3 && query_parts[1].eq_ignore_ascii_case("STATS_HISTORY") =>
+        {
+            match query_parts[2].parse::<u64>() {
+                Ok(minutes) => show_stats_history(stream, Some(minutes)).await,
+                Err(_) => {
+                    error_response(stream, "Usage: SHOW STATS_HISTORY [<minutes>]", "58000").await
+                }
+            }
+        }
         "SHOW" => {
             if query_parts.len() != 2 {
                 error!("unsupported admin subcommand for SHOW: {query_parts:?}");
@@ -74,10 +177,23 @@ where
                     "POOLS_EXTENDED" => show_pools_extended(stream).await,
                     "CLIENTS" => show_clients(stream).await,
                     "SERVERS" => show_servers(stream).await,
+                    "HOSTS" => show_hosts(stream).await,
+                    "DNS" => show_dns(stream).await,
+                    "ADVISORY_LOCKS" => show_advisory_locks(stream).await,
                     "CONNECTIONS" => show_connections(stream).await,
                     "STATS" => show_stats(stream).await,
+                    "STATS_TOTALS" => show_stats_totals(stream).await,
+                    "STATS_AVERAGES" => show_stats_averages(stream).await,
+                    "STATS_HISTORY" => show_stats_history(stream, None).await,
+                    "TOTALS" => show_totals(stream).await,
                     "VERSION" => show_version(stream).await,
                     "USERS" => show_users(stream).await,
+                    "TLS" => show_tls(stream).await,
+                    "ADMIN_HISTORY" => show_admin_history(stream).await,
+                    "PROTOCOL_VIOLATIONS" => show_protocol_violations(stream).await,
+                    "PREPARED_TRANSACTIONS" => show_prepared_transactions(stream).await,
+                    "LOG_LEVELS" => show_log_levels(stream).await,
+                    "PROFILE" => show_profile(stream).await,
                     #[cfg(target_os = "linux")]
                     "SOCKETS" => show_sockets(stream).await,
                     _ => {
@@ -283,23 +399,39 @@ where
 
     let detail_msg = [
         "",
-        "SHOW HELP|CONFIG|DATABASES|POOLS|POOLS_EXTENDED|CLIENTS|SERVERS|USERS|VERSION",
+        "SHOW HELP|CONFIG|DATABASES|POOLS|POOLS_EXTENDED|CLIENTS|SERVERS|USERS|VERSION|TLS",
+        "SHOW ADMIN_HISTORY",
+        "SHOW PROTOCOL_VIOLATIONS",
+        "SHOW PREPARED_TRANSACTIONS",
+        "SHOW ADVISORY_LOCKS",
+        "SHOW HOSTS",
+        "SHOW DNS",
         // "SHOW PEERS|PEER_POOLS", // missing PEERS|PEER_POOLS
         // "SHOW FDS|SOCKETS|ACTIVE_SOCKETS|LISTS|MEM|STATE", // missing FDS|SOCKETS|ACTIVE_SOCKETS|MEM|STATE
         "SHOW LISTS",
         "SHOW CONNECTIONS",
         // "SHOW DNS_HOSTS|DNS_ZONES", // missing DNS_HOSTS|DNS_ZONES
-        "SHOW STATS", // missing STATS_TOTALS|STATS_AVERAGES|TOTALS
+        "SHOW STATS|STATS_TOTALS|STATS_AVERAGES|TOTALS",
+        "SHOW STATS_HISTORY [<minutes>]",
         //"SET key = arg",
+        "RESET STATS",
         "RELOAD",
-        // "PAUSE [<db>, <user>]",
-        // "RESUME [<db>, <user>]",
+        "PAUSE [<db>]",
+        "RESUME [<db>]",
         // "DISABLE <db>", // missing
         // "ENABLE <db>", // missing
         // "RECONNECT [<db>]", missing
         // "KILL <db>",
         // "SUSPEND",
         "SHUTDOWN",
+        "INJECT ERROR <sqlstate> CLIENT <client_id>|POOL <db>",
+        "INJECT CLEAR",
+        "LOG <level> POOL <db>|USER <user>|CLIENT <client_id> [<seconds>]",
+        "LOG RESET",
+        "SHOW LOG_LEVELS",
+        "PASSTHROUGH <user> ON|OFF|DEFAULT",
+        "PROFILE ON [<sample_every>]|OFF",
+        "SHOW PROFILE",
     ];
 
     res.put(notify("Console usage", detail_msg.join("\n\t")));
@@ -331,6 +463,9 @@ where
         ("pool_mode", DataType::Text),
         ("max_connections", DataType::Int4),
         ("current_connections", DataType::Int4),
+        // pgbouncer compatibility, dashboards expect them.
+        ("paused", DataType::Int4),
+        ("disabled", DataType::Int4),
     ];
 
     let mut res = BytesMut::new();
@@ -351,10 +486,12 @@ where
             pool_config.user.username.to_string(),                   // force_user
             pool_config.user.pool_size.to_string(),                  // pool_size
             pool_config.user.min_pool_size.unwrap_or(0).to_string(), // min_pool_size
-            "0".to_string(),                                         // reserve_pool
+            pool_config.reserve_pool_size.to_string(),               // reserve_pool
             pool_config.pool_mode.to_string(),                       // pool_mode
             pool_config.user.pool_size.to_string(),                  // max_connections
             pool_state.size.to_string(),                             // current_connections
+            (is_paused(&address.pool_name) as i32).to_string(),      // paused
+            "0".to_string(),                                         // disabled
         ]));
     }
     res.put(command_complete("SHOW"));
@@ -421,7 +558,12 @@ where
             "yes".to_string()
         };
 
-        let row = vec![key, value, "-".to_string(), changeable];
+        let row = vec![
+            key,
+            redact(&value).into_owned(),
+            "-".to_string(),
+            changeable,
+        ];
 
         res.put(data_row(&row));
     }
@@ -458,6 +600,125 @@ where
     write_all_half(stream, &res).await
 }
 
+/// Show the statistics totals of each pool.
+async fn show_stats_totals<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let pool_lookup = PoolStats::construct_pool_lookup();
+    let mut res = BytesMut::new();
+    res.put(row_description(
+        &PoolStats::generate_show_stats_totals_header(),
+    ));
+    for pool_stats in pool_lookup.values() {
+        res.put(data_row(&pool_stats.generate_show_stats_totals_row()));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the statistics averages of each pool over the last stats period.
+async fn show_stats_averages<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let pool_lookup = PoolStats::construct_pool_lookup();
+    let mut res = BytesMut::new();
+    res.put(row_description(
+        &PoolStats::generate_show_stats_averages_header(),
+    ));
+    for pool_stats in pool_lookup.values() {
+        res.put(data_row(&pool_stats.generate_show_stats_averages_row()));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the per-minute statistics history of all pools, optionally for the last minutes only.
+async fn show_stats_history<T>(stream: &mut T, minutes: Option<u64>) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+    res.put(row_description(
+        &StatsSnapshot::generate_show_stats_history_header(),
+    ));
+    for snapshot in get_stats_history(minutes) {
+        res.put(data_row(&snapshot.generate_show_stats_history_row()));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the statistics totals of all pools together.
+async fn show_totals<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let pool_lookup = PoolStats::construct_pool_lookup();
+    let mut totals = [0u64; 7];
+    for pool_stats in pool_lookup.values() {
+        for (total, value) in totals.iter_mut().zip([
+            pool_stats.total_xact_count,
+            pool_stats.total_query_count,
+            pool_stats.bytes_received,
+            pool_stats.bytes_sent,
+            pool_stats.total_xact_time_microseconds,
+            pool_stats.total_query_time_microseconds,
+            pool_stats.wait_time,
+        ]) {
+            *total += value;
+        }
+    }
+
+    let mut res = BytesMut::new();
+    res.put(row_description(&vec![
+        ("total_xact_count", DataType::Numeric),
+        ("total_query_count", DataType::Numeric),
+        ("total_received", DataType::Numeric),
+        ("total_sent", DataType::Numeric),
+        ("total_xact_time", DataType::Numeric),
+        ("total_query_time", DataType::Numeric),
+        ("total_wait_time", DataType::Numeric),
+    ]));
+    res.put(data_row(
+        &totals
+            .iter()
+            .map(|total| total.to_string())
+            .collect::<Vec<String>>(),
+    ));
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
 /// Show currently connected clients
 async fn show_clients<T>(stream: &mut T) -> Result<(), Error>
 where
@@ -624,6 +885,163 @@ where
     write_all_half(stream, &res).await
 }
 
+/// Show the backend hosts with their health, latency and connections.
+async fn show_hosts<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let columns = vec![
+        ("host", DataType::Text),
+        ("port", DataType::Numeric),
+        ("pools", DataType::Text),
+        ("state", DataType::Text),
+        ("sv_active", DataType::Numeric),
+        ("sv_idle", DataType::Numeric),
+        ("sv_login", DataType::Numeric),
+        ("connect_ewma_ms", DataType::Numeric),
+        ("query_ewma_ms", DataType::Numeric),
+        ("connects", DataType::Numeric),
+        ("connect_errors", DataType::Numeric),
+        ("consecutive_failures", DataType::Numeric),
+        ("last_error", DataType::Text),
+        ("last_error_age_seconds", DataType::Numeric),
+        ("replica_lag_ms", DataType::Numeric),
+    ];
+
+    // Pools by host, configured hosts are shown even before the first connect.
+    let mut pools: HashMap<(String, u16), Vec<String>> = HashMap::new();
+    for (_, pool) in get_all_pools() {
+        let address = pool.address();
+        for (host, port) in pool.balancer.hosts() {
+            host_stats(host, port);
+            let names = pools.entry((host.to_string(), port)).or_default();
+            if !names.contains(&address.pool_name) {
+                names.push(address.pool_name.clone());
+            }
+        }
+    }
+
+    // Server connections by host and state: active, idle, login.
+    let mut servers: HashMap<(String, u16), [u64; 3]> = HashMap::new();
+    for (_, server) in get_server_stats() {
+        let counts = servers.entry(server.host_port()).or_default();
+        match server.state.load(Ordering::Relaxed) {
+            SERVER_STATE_ACTIVE => counts[0] += 1,
+            SERVER_STATE_IDLE => counts[1] += 1,
+            _ => counts[2] += 1,
+        }
+    }
+
+    let lags = replica_lags();
+    let now = Local::now();
+    let mut res = BytesMut::new();
+    res.put(row_description(&columns));
+    for (host, stats) in get_host_stats() {
+        let mut names = pools.remove(&host).unwrap_or_default();
+        names.sort();
+        let counts = servers.get(&host).copied().unwrap_or_default();
+        // Only the replicas polled for read_your_writes or max_replica_lag have one.
+        let lag = lags.get(&host).copied().flatten();
+        let mut row = vec![host.0, host.1.to_string(), names.join(",")];
+        let mut health = stats.generate_show_hosts_columns(now);
+        row.push(health.remove(0));
+        row.extend(counts.iter().map(|count| count.to_string()));
+        row.extend(health);
+        row.push(lag.map(|lag| lag.to_string()).unwrap_or_default());
+        res.put(data_row(&row));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the cached addresses of the server host names.
+async fn show_dns<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(&vec![
+        ("host", DataType::Text),
+        ("addresses", DataType::Text),
+        ("age_seconds", DataType::Numeric),
+        ("lookups", DataType::Numeric),
+        ("last_error", DataType::Text),
+    ]));
+
+    for (host, entry) in dns_entries() {
+        let addrs: Vec<String> = entry.addrs.iter().map(|ip| ip.to_string()).collect();
+        res.put(data_row(&vec![
+            host,
+            addrs.join(","),
+            entry.resolved_at.elapsed().as_secs().to_string(),
+            entry.lookups.to_string(),
+            entry.last_error.unwrap_or_default(),
+        ]));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show servers that may hold session-level advisory locks taken through the pooler.
+async fn show_advisory_locks<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let columns = vec![
+        ("server_id", DataType::Text),
+        ("server_process_id", DataType::Text),
+        ("database_name", DataType::Text),
+        ("user", DataType::Text),
+        ("application_name", DataType::Text),
+        ("state", DataType::Text),
+    ];
+
+    let new_map = get_server_stats();
+    let mut res = BytesMut::new();
+    res.put(row_description(&columns));
+
+    for (_, server) in new_map {
+        if !server.advisory_locks.load(Ordering::Relaxed) {
+            continue;
+        }
+        let application_name = server.application_name.read();
+        let row = vec![
+            format!("{:#010X}", server.server_id()),
+            server.process_id().to_string(),
+            server.pool_name(),
+            server.username(),
+            application_name.clone(),
+            server.state_to_string(),
+        ];
+
+        res.put(data_row(&row));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
 /// Send response packets for shutdown.
 async fn shutdown<T>(stream: &mut T) -> Result<(), Error>
 where
@@ -652,6 +1070,533 @@ where
     write_all_half(stream, &res).await
 }
 
+/// Inject an error to be sent to a client on its next server checkout.
+async fn inject<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    if !get_config().general.error_injection {
+        return error_response(
+            stream,
+            "Error injection is disabled, set error_injection = true in the general section",
+            "58000",
+        )
+        .await;
+    }
+
+    match args
+        .iter()
+        .map(|arg| arg.to_ascii_uppercase())
+        .collect::<Vec<String>>()
+        .as_slice()
+    {
+        [clear] if clear == "CLEAR" => {
+            clear_injected_errors();
+            info!("All injected errors are cleared");
+        }
+        [error, code, kind, _] if error == "ERROR" => {
+            if code.len() != 5 || !code.chars().all(|c| c.is_ascii_alphanumeric()) {
+                return error_response(stream, &format!("Invalid SQLSTATE: {code}"), "58000").await;
+            }
+            let target = match kind.as_str() {
+                "CLIENT" => match parse_client_id(args[3]) {
+                    Some(client_id) => ErrorInjectionTarget::Client(client_id),
+                    None => {
+                        return error_response(
+                            stream,
+                            &format!("Invalid client_id: {}", args[3]),
+                            "58000",
+                        )
+                        .await;
+                    }
+                },
+                "POOL" => ErrorInjectionTarget::Pool(args[3].to_string()),
+                _ => {
+                    return error_response(
+                        stream,
+                        "Usage: INJECT ERROR <sqlstate> CLIENT <client_id>|POOL <db>",
+                        "58000",
+                    )
+                    .await;
+                }
+            };
+            warn!("Injecting error {code} for {target:?}");
+            inject_error(target, code.clone());
+        }
+        _ => {
+            return error_response(
+                stream,
+                "Usage: INJECT ERROR <sqlstate> CLIENT <client_id>|POOL <db> or INJECT CLEAR",
+                "58000",
+            )
+            .await;
+        }
+    }
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("INJECT"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Hold back new transactions of the database (all databases without an argument)
+/// and wait until its server connections are released, then close them.
+async fn pause<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let databases: Vec<String> = match args {
+        [] => get_config().pools.keys().cloned().collect(),
+        [db] => {
+            if !get_config().pools.contains_key(*db) {
+                return error_response(stream, &format!("Unknown database: {db}"), "58000").await;
+            }
+            vec![db.to_string()]
+        }
+        _ => return error_response(stream, "Usage: PAUSE [<db>]", "58000").await,
+    };
+    pause_databases(&databases);
+    warn!("Pausing databases: {}", databases.join(", "));
+
+    // Clients finish their transactions, new ones wait for RESUME. The partitions
+    // and replicas of the databases are drained too.
+    loop {
+        let mut in_use = 0;
+        for (identifier, pool) in get_all_pools() {
+            if pool_of_databases(&identifier.db, &databases) {
+                pool.close_idle_connections();
+                in_use += pool.servers_in_use();
+            }
+        }
+        if in_use == 0 {
+            break;
+        }
+        tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+    }
+    info!("Databases are paused: {}", databases.join(", "));
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("PAUSE"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Let the clients waiting for a paused database (all databases without an argument) go on.
+async fn resume<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    match args {
+        [] => {
+            resume_databases(None);
+            info!("All databases are resumed");
+        }
+        [db] => {
+            if !PAUSED_DATABASES.lock().contains(*db) {
+                return error_response(stream, &format!("Database is not paused: {db}"), "58000")
+                    .await;
+            }
+            resume_databases(Some(db));
+            info!("Database {db} is resumed");
+        }
+        _ => return error_response(stream, "Usage: RESUME [<db>]", "58000").await,
+    }
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("RESUME"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Reset the statistics of all pools: the totals and averages of SHOW STATS start over.
+async fn reset<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    match args {
+        [target] if target.eq_ignore_ascii_case("STATS") => {
+            for pool in get_all_pools().values() {
+                pool.address().stats.reset();
+            }
+            info!("Statistics are reset");
+        }
+        _ => return error_response(stream, "Usage: RESET STATS", "58000").await,
+    }
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("RESET"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Switch the passthrough mode of a user for its new clients, DEFAULT goes back to the config.
+async fn passthrough<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let (user, mode) = match args {
+        [user, mode] => (user.to_string(), mode.to_ascii_uppercase()),
+        _ => {
+            return error_response(stream, "Usage: PASSTHROUGH <user> ON|OFF|DEFAULT", "58000")
+                .await
+        }
+    };
+    if !get_all_pools().keys().any(|pool| pool.user == user) {
+        return error_response(stream, &format!("Unknown user: {user}"), "58000").await;
+    }
+    match mode.as_str() {
+        "ON" | "OFF" => {
+            warn!("Passthrough mode of user {user} is {mode} for new clients");
+            PASSTHROUGH_OVERRIDES.lock().insert(user, mode == "ON");
+        }
+        "DEFAULT" => {
+            info!("Passthrough mode of user {user} is back to the config");
+            PASSTHROUGH_OVERRIDES.lock().remove(&user);
+        }
+        _ => {
+            return error_response(stream, "Usage: PASSTHROUGH <user> ON|OFF|DEFAULT", "58000")
+                .await
+        }
+    }
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("PASSTHROUGH"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Turn the hot path profiler on or off.
+async fn profile<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    const USAGE: &str = "Usage: PROFILE ON [<sample_every>]|OFF";
+
+    match args {
+        [mode] if mode.eq_ignore_ascii_case("OFF") => {
+            stop_profiler();
+            info!("Profiler is off");
+        }
+        [mode, rest @ ..] if mode.eq_ignore_ascii_case("ON") && rest.len() <= 1 => {
+            let sample_every = match rest.first().map(|value| value.parse::<u64>()) {
+                None => 1,
+                Some(Ok(sample_every)) if sample_every > 0 => sample_every,
+                Some(_) => return error_response(stream, USAGE, "58000").await,
+            };
+            start_profiler(sample_every);
+            warn!("Profiler is on, timing one in {sample_every} events");
+        }
+        _ => return error_response(stream, USAGE, "58000").await,
+    }
+
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("PROFILE"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the samples of the hot path profiler by section.
+async fn show_profile<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let columns = vec![
+        ("section", DataType::Text),
+        ("events", DataType::Numeric),
+        ("samples", DataType::Numeric),
+        ("avg_us", DataType::Numeric),
+        ("p50_us", DataType::Numeric),
+        ("p99_us", DataType::Numeric),
+        ("max_us", DataType::Numeric),
+        ("avg_bytes", DataType::Numeric),
+    ];
+
+    let mut res = BytesMut::new();
+    res.put(row_description(&columns));
+    for section in profiler::profile() {
+        res.put(data_row(&vec![
+            section.section.name().to_string(),
+            section.events.to_string(),
+            section.samples.to_string(),
+            format!("{:.3}", section.avg_us),
+            format!("{:.3}", section.p50_us),
+            format!("{:.3}", section.p99_us),
+            format!("{:.3}", section.max_us),
+            section.avg_bytes.to_string(),
+        ]));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Change the log level of a pool, user or client for a while.
+async fn log_level<T>(stream: &mut T, args: &[&str]) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    const USAGE: &str =
+        "Usage: LOG <level> POOL <db>|USER <user>|CLIENT <client_id> [<seconds>] or LOG RESET";
+
+    if let [reset] = args {
+        if reset.eq_ignore_ascii_case("RESET") {
+            clear_log_rules();
+            info!("All log level overrides are cleared");
+            return log_level_complete(stream).await;
+        }
+    }
+
+    let (level, kind, value, seconds) = match args {
+        [level, kind, value] => (level, kind, value, None),
+        [level, kind, value, seconds] => (level, kind, value, Some(seconds)),
+        _ => return error_response(stream, USAGE, "58000").await,
+    };
+    let level = match level.parse::<log::LevelFilter>() {
+        Ok(level) => level,
+        Err(_) => {
+            return error_response(stream, &format!("Invalid log level: {level}"), "58000").await;
+        }
+    };
+    let target = match kind.to_ascii_uppercase().as_str() {
+        "POOL" => LogTarget::Pool(value.to_string()),
+        "USER" => LogTarget::User(value.to_string()),
+        "CLIENT" => match parse_client_id(value) {
+            Some(client_id) => LogTarget::Client(client_id),
+            None => {
+                return error_response(stream, &format!("Invalid client_id: {value}"), "58000")
+                    .await;
+            }
+        },
+        _ => return error_response(stream, USAGE, "58000").await,
+    };
+    let seconds = match seconds.map(|seconds| seconds.parse::<u64>()) {
+        None => DEFAULT_LOG_LEVEL_SECONDS,
+        Some(Ok(seconds)) if seconds > 0 => seconds,
+        Some(_) => return error_response(stream, USAGE, "58000").await,
+    };
+
+    warn!("Log level of {target} is {level} for {seconds}s");
+    add_log_rule(target, level, std::time::Duration::from_secs(seconds));
+
+    log_level_complete(stream).await
+}
+
+async fn log_level_complete<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(command_complete("LOG"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the log level overrides of pools, users and clients.
+async fn show_log_levels<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(&LogRule::generate_show_log_levels_header()));
+    for rule in get_log_rules() {
+        res.put(data_row(&rule.generate_show_log_levels_row()));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Parse client_id as shown in SHOW CLIENTS (0x-prefixed hex) or as a decimal number.
+fn parse_client_id(value: &str) -> Option<i32> {
+    match value
+        .strip_prefix("0x")
+        .or_else(|| value.strip_prefix("0X"))
+    {
+        Some(hex) => u32::from_str_radix(hex, 16).ok().map(|id| id as i32),
+        None => value.parse::<i32>().ok(),
+    }
+}
+
+/// Show expiry of the configured TLS certificates.
+async fn show_tls<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(&vec![
+        ("type", DataType::Text),
+        ("path", DataType::Text),
+        ("subject", DataType::Text),
+        ("not_after", DataType::Text),
+        ("expires_in_days", DataType::Numeric),
+    ]));
+
+    for cert in configured_certificates_expiry(&get_config()) {
+        let not_after = match chrono::DateTime::from_timestamp(cert.not_after, 0) {
+            Some(not_after) => not_after.to_rfc3339(),
+            None => cert.not_after.to_string(),
+        };
+        res.put(data_row(&vec![
+            cert.kind.to_string(),
+            cert.path.clone(),
+            cert.subject.clone(),
+            not_after,
+            (cert.seconds_left() / 86400).to_string(),
+        ]));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show the last admin console commands, oldest first.
+async fn show_admin_history<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(&vec![
+        ("time", DataType::Text),
+        ("user", DataType::Text),
+        ("addr", DataType::Text),
+        ("command", DataType::Text),
+    ]));
+
+    let history: Vec<AdminHistoryEntry> = ADMIN_HISTORY.lock().iter().cloned().collect();
+    for entry in history {
+        res.put(data_row(&vec![
+            entry.time.to_rfc3339(),
+            entry.username,
+            entry.addr.to_string(),
+            entry.command,
+        ]));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show client addresses with recent protocol violations.
+async fn show_protocol_violations<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(
+        &Violations::generate_show_protocol_violations_header(),
+    ));
+    for (addr, violations) in get_protocol_violations() {
+        res.put(data_row(
+            &violations.generate_show_protocol_violations_row(&addr),
+        ));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
+/// Show prepared transactions created through the pooler and not finished yet.
+async fn show_prepared_transactions<T>(stream: &mut T) -> Result<(), Error>
+where
+    T: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut res = BytesMut::new();
+
+    res.put(row_description(
+        &PreparedTransaction::generate_show_prepared_transactions_header(),
+    ));
+    for transaction in get_prepared_transactions() {
+        res.put(data_row(
+            &transaction.generate_show_prepared_transactions_row(),
+        ));
+    }
+
+    res.put(command_complete("SHOW"));
+
+    // ReadyForQuery
+    res.put_u8(b'Z');
+    res.put_i32(5);
+    res.put_u8(b'I');
+
+    write_all_half(stream, &res).await
+}
+
 /// Show Users.
 async fn show_users<T>(stream: &mut T) -> Result<(), Error>
 where
@@ -743,3 +1688,29 @@ where
 
     write_all_half(stream, &res).await
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_client_id() {
+        assert_eq!(parse_client_id("0x0000002A"), Some(42));
+        assert_eq!(parse_client_id("0XFFFFFFFF"), Some(-1));
+        assert_eq!(parse_client_id("-7"), Some(-7));
+        assert_eq!(parse_client_id("client"), None);
+    }
+
+    #[test]
+    fn test_admin_history_entry_format() {
+        let entry = AdminHistoryEntry {
+            time: Local::now(),
+            username: "admin".to_string(),
+            addr: "127.0.0.1:5432".parse().unwrap(),
+            command: "SHOW POOLS".to_string(),
+        };
+        assert!(entry
+            .to_string()
+            .ends_with(" user=admin addr=127.0.0.1:5432 command=\"SHOW POOLS\""));
+    }
+}
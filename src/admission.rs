@@ -0,0 +1,203 @@
+// Admission control based on the load of the servers.
+//
+// For pools with load_check_query the query is run every load_check_interval on
+// a server connection of the database. While its result is at load_threshold or
+// above, clients get a server only while fewer than overload_pool_size_percent of
+// the pool size are in use, the others wait in the queue. A struggling server
+// gets fewer concurrent queries instead of more of them piling up.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Duration;
+
+// External crate imports
+use log::{info, warn};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::time::Instant;
+
+// Internal crate imports
+use crate::config::{get_config, PARTITION_SEPARATOR};
+use crate::errors::Error;
+use crate::pool::{get_all_pools, ConnectionPool};
+
+/// Last load check of a database.
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct BackendLoad {
+    load: f64,
+    overloaded: bool,
+    /// overload_pool_size_percent of the database.
+    percent: u32,
+}
+
+/// Last load of the databases with load_check_query.
+static BACKEND_LOAD: Lazy<Mutex<HashMap<String, BackendLoad>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Checkouts held back while the server was overloaded.
+pub static THROTTLED_CHECKOUTS_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Last load of each database with load_check_query.
+pub fn backend_loads() -> HashMap<String, f64> {
+    BACKEND_LOAD
+        .lock()
+        .iter()
+        .map(|(database, backend)| (database.clone(), backend.load))
+        .collect()
+}
+
+/// Share of the pool size (%) left to the pool while its server is overloaded, if it is.
+/// Partitions share the load of their database.
+pub fn overload_percent(pool_name: &str) -> Option<u32> {
+    let loads = BACKEND_LOAD.lock();
+    if loads.is_empty() {
+        return None;
+    }
+    let database = pool_name
+        .rsplit_once(PARTITION_SEPARATOR)
+        .map_or(pool_name, |(database, _)| database);
+    loads
+        .get(database)
+        .filter(|backend| backend.overloaded)
+        .map(|backend| backend.percent)
+}
+
+/// Servers the pool may use while the server is overloaded, at least one.
+fn throttled_size(pool: &ConnectionPool, percent: u32) -> usize {
+    (pool.pool_state().max_size * percent as usize / 100).max(1)
+}
+
+/// Wait until the pool uses less than its throttled size or the overload is over.
+pub async fn wait_for_admission(pool_name: &str, pool: &ConnectionPool, percent: u32) {
+    let size = throttled_size(pool, percent);
+    if pool.servers_in_use() < size {
+        return;
+    }
+    THROTTLED_CHECKOUTS_COUNTER.fetch_add(1, Ordering::Relaxed);
+    while overload_percent(pool_name).is_some() && pool.servers_in_use() >= size {
+        tokio::time::sleep(Duration::from_millis(10)).await;
+    }
+}
+
+/// Run the load query on a server of the database and read the number in its first column.
+async fn check_load(pool: &ConnectionPool, query: &str, timeout: Duration) -> Result<f64, Error> {
+    let check = async {
+        let mut server = match pool.database.get().await {
+            Ok(server) => server,
+            Err(err) => {
+                return Err(Error::QueryError(format!(
+                    "no server connection for load_check_query: {err:?}"
+                )))
+            }
+        };
+        server.checkin_cleanup().await?;
+        let rows = server.simple_query_rows(query).await?;
+        match rows
+            .into_iter()
+            .next()
+            .and_then(|row| row.into_iter().next())
+        {
+            Some(Some(value)) => value.trim().parse::<f64>().map_err(|_| {
+                Error::QueryError(format!("load_check_query returned a non-number: {value}"))
+            }),
+            _ => Err(Error::QueryError(
+                "load_check_query returned no value".to_string(),
+            )),
+        }
+    };
+    match tokio::time::timeout(timeout, check).await {
+        Ok(result) => result,
+        Err(_) => Err(Error::QueryError("load_check_query timed out".to_string())),
+    }
+}
+
+/// Check the load of the databases with load_check_query at their intervals.
+pub async fn watch_backend_load() {
+    let mut next_checks: HashMap<String, Instant> = HashMap::new();
+    let mut interval = tokio::time::interval(Duration::from_millis(100));
+    loop {
+        interval.tick().await;
+        let config = get_config();
+        BACKEND_LOAD.lock().retain(|database, _| {
+            config
+                .pools
+                .get(database)
+                .is_some_and(|pool| pool.load_check_query.is_some())
+        });
+
+        let pools = get_all_pools();
+        for (database, pool_config) in &config.pools {
+            let query = match pool_config.load_check_query {
+                Some(ref query) => query,
+                None => continue,
+            };
+            let now = Instant::now();
+            if next_checks.get(database).is_some_and(|next| *next > now) {
+                continue;
+            }
+            let check_interval = Duration::from_millis(pool_config.load_check_interval);
+            next_checks.insert(database.clone(), now + check_interval);
+
+            let pool = match pools
+                .iter()
+                .find(|(identifier, _)| identifier.db == *database)
+            {
+                Some((_, pool)) => pool,
+                None => continue,
+            };
+            let load = match check_load(pool, query, check_interval).await {
+                Ok(load) => load,
+                Err(err) => {
+                    warn!("[pool: {database}] Load check failed: {err}");
+                    continue;
+                }
+            };
+            let overloaded = load >= pool_config.load_threshold as f64;
+            let was_overloaded = overload_percent(database).is_some();
+            if overloaded && !was_overloaded {
+                warn!(
+                    "[pool: {database}] Server is overloaded ({load} >= {}), throttling to {}% of the pool size",
+                    pool_config.load_threshold, pool_config.overload_pool_size_percent
+                );
+            } else if !overloaded && was_overloaded {
+                info!("[pool: {database}] Server load is back to {load}, throttling is over");
+            }
+            let backend = BackendLoad {
+                load,
+                overloaded,
+                percent: pool_config.overload_pool_size_percent,
+            };
+            BACKEND_LOAD.lock().insert(database.clone(), backend);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_overload_percent() {
+        assert_eq!(overload_percent("admission_test"), None);
+        let mut backend = BackendLoad {
+            load: 12.0,
+            overloaded: true,
+            percent: 25,
+        };
+        BACKEND_LOAD
+            .lock()
+            .insert("admission_test".to_string(), backend);
+        assert_eq!(overload_percent("admission_test"), Some(25));
+        // Partitions of the database are throttled too.
+        assert_eq!(overload_percent("admission_test/batch"), Some(25));
+        assert_eq!(backend_loads().get("admission_test"), Some(&12.0));
+
+        backend.overloaded = false;
+        BACKEND_LOAD
+            .lock()
+            .insert("admission_test".to_string(), backend);
+        assert_eq!(overload_percent("admission_test"), None);
+        BACKEND_LOAD.lock().remove("admission_test");
+    }
+}
@@ -0,0 +1,437 @@
+// Migration advisor for transaction pooling.
+//
+// `pg_doorman analyze` serves the traffic as usual for a while and watches it
+// for what breaks when a server connection is shared between transactions of
+// different clients: session-level SET, temporary tables, LISTEN, session
+// advisory locks, SQL PREPARE, WITH HOLD cursors and transactions left idle.
+// When the time is up it writes a report with the findings and a suggested
+// pool mode for each pool, then shuts the pooler down gracefully.
+
+// Standard library imports
+use std::collections::BTreeMap;
+use std::fmt;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::time::Duration;
+
+// External crate imports
+use log::{error, info};
+use nix::sys::signal::{self, Signal};
+use nix::unistd::Pid;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+// Internal crate imports
+use crate::config::{get_config, PoolMode};
+use crate::messages::acquires_advisory_lock;
+use crate::messages::fingerprint::{normalize_statement, statement_text};
+
+/// Longest sample statement kept in the report.
+const MAX_SAMPLE_LEN: usize = 200;
+
+static ANALYZE_ENABLED: AtomicBool = AtomicBool::new(false);
+
+static IDLE_IN_TRANSACTION_THRESHOLD_MS: AtomicU64 = AtomicU64::new(1000);
+
+/// Observations by pool name.
+static OBSERVATIONS: Lazy<Mutex<BTreeMap<String, PoolObservations>>> =
+    Lazy::new(|| Mutex::new(BTreeMap::new()));
+
+/// Something that doesn't work as expected in transaction pooling mode.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Hazard {
+    SessionSet,
+    TempTable,
+    Listen,
+    AdvisoryLock,
+    SqlPrepare,
+    HoldCursor,
+    IdleInTransaction,
+}
+
+impl Hazard {
+    fn name(&self) -> &'static str {
+        match self {
+            Hazard::SessionSet => "session SET",
+            Hazard::TempTable => "temporary tables",
+            Hazard::Listen => "LISTEN",
+            Hazard::AdvisoryLock => "session advisory locks",
+            Hazard::SqlPrepare => "SQL PREPARE",
+            Hazard::HoldCursor => "WITH HOLD cursors",
+            Hazard::IdleInTransaction => "long idle in transaction",
+        }
+    }
+
+    fn advice(&self) -> &'static str {
+        match self {
+            Hazard::SessionSet => {
+                "use SET LOCAL inside transactions or startup parameters, the setting leaks to other clients"
+            }
+            Hazard::TempTable => {
+                "create temporary tables with ON COMMIT DROP, other transactions may run on another server"
+            }
+            Hazard::Listen => "notifications only reach a client in session mode",
+            Hazard::AdvisoryLock => {
+                "use pg_advisory_xact_lock, the server is pinned while release_advisory_locks keeps track of them"
+            }
+            Hazard::SqlPrepare => {
+                "use protocol-level prepared statements, the SQL ones stay on one server"
+            }
+            Hazard::HoldCursor => "close the cursor in the same transaction",
+            Hazard::IdleInTransaction => {
+                "the server stays assigned to an idle client in both modes, finish transactions promptly"
+            }
+        }
+    }
+
+    /// The hazard only matters when servers are shared, i.e. in transaction mode.
+    fn needs_session_mode(&self) -> bool {
+        *self != Hazard::IdleInTransaction
+    }
+}
+
+#[derive(Debug, Default, Clone)]
+struct HazardStats {
+    count: u64,
+    sample: String,
+}
+
+#[derive(Debug, Default, Clone)]
+struct PoolObservations {
+    statements: u64,
+    hazards: BTreeMap<Hazard, HazardStats>,
+    longest_idle_in_transaction: Duration,
+}
+
+impl PoolObservations {
+    fn record(&mut self, hazard: Hazard, sample: &str) {
+        let stats = self.hazards.entry(hazard).or_default();
+        stats.count += 1;
+        if stats.sample.is_empty() {
+            stats.sample = sample.chars().take(MAX_SAMPLE_LEN).collect();
+        }
+    }
+}
+
+/// Hazards of the statements of a normalized query (see normalize_statement).
+pub fn statement_hazards(normalized: &str) -> Vec<Hazard> {
+    let mut hazards = Vec::new();
+    for statement in normalized.split(" ; ") {
+        let statement = statement.trim();
+        let hazard = if statement.starts_with("set ")
+            && !statement.starts_with("set local ")
+            && !statement.starts_with("set transaction ")
+            && !statement.starts_with("set constraints ")
+        {
+            Some(Hazard::SessionSet)
+        } else if [
+            "create temp ",
+            "create temporary ",
+            "create local temp",
+            "create global temp",
+        ]
+        .iter()
+        .any(|prefix| statement.starts_with(prefix))
+            && !statement.contains(" on commit drop")
+        {
+            Some(Hazard::TempTable)
+        } else if statement.starts_with("listen ") {
+            Some(Hazard::Listen)
+        } else if statement.starts_with("prepare ")
+            && !statement.starts_with("prepare transaction ")
+        {
+            Some(Hazard::SqlPrepare)
+        } else if statement.starts_with("declare ") && statement.contains(" with hold ") {
+            Some(Hazard::HoldCursor)
+        } else {
+            None
+        };
+        if let Some(hazard) = hazard {
+            if !hazards.contains(&hazard) {
+                hazards.push(hazard);
+            }
+        }
+    }
+    hazards
+}
+
+/// Start collecting observations, transactions idle longer than `idle_threshold` are reported.
+pub fn start_analyze(idle_threshold: Duration) {
+    IDLE_IN_TRANSACTION_THRESHOLD_MS.store(idle_threshold.as_millis() as u64, Ordering::Relaxed);
+    ANALYZE_ENABLED.store(true, Ordering::Relaxed);
+}
+
+pub fn analyze_enabled() -> bool {
+    ANALYZE_ENABLED.load(Ordering::Relaxed)
+}
+
+/// Look for hazards in a Query or Parse message of a client of the pool.
+pub fn observe_statement(pool_name: &str, message: &[u8]) {
+    if !analyze_enabled() {
+        return;
+    }
+    let normalized = match statement_text(message) {
+        Some(query) => normalize_statement(query),
+        None => return,
+    };
+    let mut hazards = statement_hazards(&normalized);
+    if acquires_advisory_lock(message) {
+        hazards.push(Hazard::AdvisoryLock);
+    }
+
+    let mut observations = OBSERVATIONS.lock();
+    let pool = observations.entry(pool_name.to_string()).or_default();
+    pool.statements += 1;
+    for hazard in hazards {
+        pool.record(hazard, &normalized);
+    }
+}
+
+/// A client of the pool kept its transaction open for `idle` without sending anything.
+pub fn observe_idle_in_transaction(pool_name: &str, idle: Duration) {
+    if !analyze_enabled()
+        || idle.as_millis() < IDLE_IN_TRANSACTION_THRESHOLD_MS.load(Ordering::Relaxed) as u128
+    {
+        return;
+    }
+    let mut observations = OBSERVATIONS.lock();
+    let pool = observations.entry(pool_name.to_string()).or_default();
+    pool.record(
+        Hazard::IdleInTransaction,
+        &format!("idle for {}ms", idle.as_millis()),
+    );
+    pool.longest_idle_in_transaction = pool.longest_idle_in_transaction.max(idle);
+}
+
+/// Findings for one pool.
+#[derive(Debug, Clone)]
+pub struct PoolReport {
+    pub pool_name: String,
+    pub pool_mode: Option<PoolMode>,
+    observations: PoolObservations,
+}
+
+impl PoolReport {
+    /// Suggested pool mode for the observed traffic.
+    pub fn suggested_mode(&self) -> PoolMode {
+        if self
+            .observations
+            .hazards
+            .keys()
+            .any(|hazard| hazard.needs_session_mode())
+        {
+            PoolMode::Session
+        } else {
+            PoolMode::Transaction
+        }
+    }
+}
+
+/// Report of `pg_doorman analyze`.
+#[derive(Debug, Clone)]
+pub struct AnalyzeReport {
+    pub duration: Duration,
+    pub pools: Vec<PoolReport>,
+}
+
+impl AnalyzeReport {
+    fn build(
+        duration: Duration,
+        observations: &BTreeMap<String, PoolObservations>,
+        pool_modes: &BTreeMap<String, PoolMode>,
+    ) -> AnalyzeReport {
+        let mut pools: BTreeMap<String, PoolReport> = pool_modes
+            .iter()
+            .map(|(name, mode)| {
+                (
+                    name.clone(),
+                    PoolReport {
+                        pool_name: name.clone(),
+                        pool_mode: Some(*mode),
+                        observations: PoolObservations::default(),
+                    },
+                )
+            })
+            .collect();
+        for (name, observed) in observations {
+            pools
+                .entry(name.clone())
+                .or_insert_with(|| PoolReport {
+                    pool_name: name.clone(),
+                    pool_mode: None,
+                    observations: PoolObservations::default(),
+                })
+                .observations = observed.clone();
+        }
+        AnalyzeReport {
+            duration,
+            pools: pools.into_values().collect(),
+        }
+    }
+}
+
+impl fmt::Display for AnalyzeReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(
+            f,
+            "pg_doorman analyze: {} pools observed for {}s",
+            self.pools.len(),
+            self.duration.as_secs()
+        )?;
+        for pool in &self.pools {
+            let observations = &pool.observations;
+            let current = match pool.pool_mode {
+                Some(mode) => mode.to_string(),
+                None => "unknown".to_string(),
+            };
+            writeln!(f)?;
+            writeln!(
+                f,
+                "pool {}: {} statements, pool_mode {}, suggested {}",
+                pool.pool_name,
+                observations.statements,
+                current,
+                pool.suggested_mode()
+            )?;
+            if observations.statements == 0 {
+                writeln!(f, "  no traffic, nothing to suggest from")?;
+                continue;
+            }
+            if observations.hazards.is_empty() {
+                writeln!(f, "  no hazards found")?;
+            }
+            for (hazard, stats) in &observations.hazards {
+                writeln!(
+                    f,
+                    "  {}: {} times, e.g. {}",
+                    hazard.name(),
+                    stats.count,
+                    stats.sample
+                )?;
+                writeln!(f, "    {}", hazard.advice())?;
+            }
+            if !observations.longest_idle_in_transaction.is_zero() {
+                writeln!(
+                    f,
+                    "  longest idle in transaction: {}ms",
+                    observations.longest_idle_in_transaction.as_millis()
+                )?;
+            }
+            if pool.pool_mode == Some(PoolMode::Transaction)
+                && pool.suggested_mode() == PoolMode::Session
+            {
+                writeln!(
+                    f,
+                    "  WARNING: the pool already runs in transaction mode, the statements above may misbehave"
+                )?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Report of the observations so far.
+pub fn analyze_report(duration: Duration) -> AnalyzeReport {
+    let pool_modes = get_config()
+        .pools
+        .iter()
+        .map(|(name, pool)| (name.clone(), pool.pool_mode))
+        .collect();
+    AnalyzeReport::build(duration, &OBSERVATIONS.lock(), &pool_modes)
+}
+
+/// Wait for `duration`, write the report to `output` (stdout if None) and shut the pooler down.
+pub async fn run_analyze(duration: Duration, output: Option<String>) {
+    info!(
+        "Analyzing the traffic for {}s before writing the report",
+        duration.as_secs()
+    );
+    tokio::time::sleep(duration).await;
+
+    let report = analyze_report(duration).to_string();
+    match output {
+        Some(ref path) => match std::fs::write(path, &report) {
+            Ok(()) => info!("Analyze report written to {path}"),
+            Err(err) => {
+                error!("Failed to write analyze report {path}: {err}");
+                println!("{report}");
+            }
+        },
+        None => println!("{report}"),
+    }
+
+    if signal::kill(Pid::this(), Signal::SIGINT).is_err() {
+        error!("Unable to send SIGINT to finish analyze");
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn hazards(query: &str) -> Vec<Hazard> {
+        statement_hazards(&normalize_statement(query))
+    }
+
+    #[test]
+    fn test_statement_hazards() {
+        assert_eq!(hazards("SET search_path = app"), vec![Hazard::SessionSet]);
+        assert!(hazards("SET LOCAL statement_timeout = 1000").is_empty());
+        assert!(hazards("set transaction isolation level serializable").is_empty());
+        assert_eq!(
+            hazards("CREATE TEMP TABLE t (id int)"),
+            vec![Hazard::TempTable]
+        );
+        assert!(hazards("CREATE TEMPORARY TABLE t (id int) ON COMMIT DROP").is_empty());
+        assert_eq!(hazards("LISTEN jobs"), vec![Hazard::Listen]);
+        assert_eq!(
+            hazards("PREPARE q AS SELECT 1; EXECUTE q"),
+            vec![Hazard::SqlPrepare]
+        );
+        assert!(hazards("PREPARE TRANSACTION 'tx1'").is_empty());
+        assert_eq!(
+            hazards("DECLARE c CURSOR WITH HOLD FOR SELECT 1"),
+            vec![Hazard::HoldCursor]
+        );
+        assert_eq!(
+            hazards("BEGIN; SET timezone = 'UTC'; LISTEN jobs; COMMIT"),
+            vec![Hazard::SessionSet, Hazard::Listen]
+        );
+        assert!(hazards("SELECT * FROM settings WHERE name = 'set x'").is_empty());
+    }
+
+    #[test]
+    fn test_analyze_report() {
+        let mut observations = BTreeMap::new();
+        let mut app = PoolObservations {
+            statements: 10,
+            ..Default::default()
+        };
+        app.record(Hazard::IdleInTransaction, "idle for 5000ms");
+        app.longest_idle_in_transaction = Duration::from_millis(5000);
+        observations.insert("app".to_string(), app);
+        let mut legacy = PoolObservations {
+            statements: 3,
+            ..Default::default()
+        };
+        legacy.record(Hazard::SessionSet, "set search_path = ?");
+        legacy.record(Hazard::SessionSet, "set timezone = ?");
+        observations.insert("legacy".to_string(), legacy);
+
+        let pool_modes = BTreeMap::from([
+            ("app".to_string(), PoolMode::Session),
+            ("legacy".to_string(), PoolMode::Transaction),
+            ("idle".to_string(), PoolMode::Session),
+        ]);
+        let report = AnalyzeReport::build(Duration::from_secs(60), &observations, &pool_modes);
+        assert_eq!(report.pools.len(), 3);
+        assert_eq!(report.pools[0].suggested_mode(), PoolMode::Transaction);
+        assert_eq!(report.pools[2].suggested_mode(), PoolMode::Session);
+
+        let text = report.to_string();
+        assert!(text.contains("pool app: 10 statements, pool_mode session, suggested transaction"));
+        assert!(text.contains("longest idle in transaction: 5000ms"));
+        assert!(text.contains("pool idle: 0 statements"));
+        assert!(text.contains("session SET: 2 times, e.g. set search_path = ?"));
+        assert!(text.contains("WARNING: the pool already runs in transaction mode"));
+    }
+}
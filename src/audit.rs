@@ -0,0 +1,182 @@
+// Audit log of the statements of privileged accounts.
+//
+// Clients of the users and pools with `audit` enabled have every statement they
+// run written as a JSON line to `audit_log`: the statement text, a hash of its
+// parameters, its duration and the rows it affected. The audit log is separate
+// from the pooler log and the event stream and is written the same way as the
+// events, by a background task that never makes the clients wait.
+
+// Standard library imports
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+// External crate imports
+use chrono::{SecondsFormat, Utc};
+use once_cell::sync::{Lazy, OnceCell};
+use parking_lot::Mutex;
+use serde_derive::Serialize;
+use tokio::sync::mpsc;
+
+// Internal crate imports
+use crate::errors::Error;
+use crate::events::{validate_sink, write_lines};
+
+/// Records waiting to be written to the audit log.
+const AUDIT_QUEUE_SIZE: usize = 10_000;
+
+/// Number of records dropped because the queue was full.
+pub static AUDIT_RECORDS_DROPPED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Number of records written to the audit log.
+pub static AUDIT_RECORDS_WRITTEN_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+static AUDIT_LOG_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// `audit_log` of the current config.
+static AUDIT_LOG: Lazy<Mutex<Option<String>>> = Lazy::new(|| Mutex::new(None));
+
+static AUDIT_SENDER: OnceCell<mpsc::Sender<String>> = OnceCell::new();
+
+/// A statement run by an audited client.
+#[derive(Serialize, Debug, Clone, PartialEq)]
+pub struct AuditRecord {
+    pub client: String,
+    pub pool: String,
+    pub user: String,
+    pub statement: String,
+    /// Hash of the Bind parameters, extended protocol only.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub parameters_hash: Option<String>,
+    /// Duration of the round trip the statement was sent in.
+    pub duration_us: u64,
+    /// None when the statement failed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub command_tag: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rows: Option<u64>,
+}
+
+#[derive(Serialize)]
+struct TimedRecord<'a> {
+    time: String,
+    #[serde(flatten)]
+    record: &'a AuditRecord,
+}
+
+fn audit_line(record: &AuditRecord) -> String {
+    let record = TimedRecord {
+        time: Utc::now().to_rfc3339_opts(SecondsFormat::Micros, true),
+        record,
+    };
+    match serde_json::to_string(&record) {
+        Ok(mut line) => {
+            line.push('\n');
+            line
+        }
+        Err(err) => format!("{{\"error\":\"{err}\"}}\n"),
+    }
+}
+
+/// Rows affected or returned according to the CommandComplete tag, e.g. `INSERT 0 5`.
+pub fn rows_affected(command_tag: &str) -> Option<u64> {
+    let mut words = command_tag.split_whitespace();
+    match words.next()? {
+        "INSERT" | "UPDATE" | "DELETE" | "MERGE" | "SELECT" | "COPY" | "FETCH" | "MOVE" => {
+            words.last()?.parse().ok()
+        }
+        _ => None,
+    }
+}
+
+/// Set the audit log, `file:<path>` or `unix:<path>`, None disables it.
+pub fn set_audit_log(sink: Option<String>) {
+    AUDIT_LOG_ENABLED.store(sink.is_some(), Ordering::Relaxed);
+    *AUDIT_LOG.lock() = sink;
+}
+
+/// Check the `audit_log` setting.
+pub fn validate_audit_log(sink: &str) -> Result<(), Error> {
+    validate_sink("audit_log", sink)
+}
+
+pub fn audit_log_enabled() -> bool {
+    AUDIT_LOG_ENABLED.load(Ordering::Relaxed)
+}
+
+/// Queue the record if the audit log is enabled.
+pub fn audit(record: &AuditRecord) {
+    if !audit_log_enabled() {
+        return;
+    }
+    let sender = match AUDIT_SENDER.get() {
+        Some(sender) => sender,
+        None => return,
+    };
+    if sender.try_send(audit_line(record)).is_err() {
+        AUDIT_RECORDS_DROPPED_COUNTER.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+/// Write the queued records to the audit log, runs for the lifetime of the process.
+pub async fn run_audit_log() {
+    let (sender, receiver) = mpsc::channel::<String>(AUDIT_QUEUE_SIZE);
+    if AUDIT_SENDER.set(sender).is_err() {
+        return;
+    }
+    write_lines(
+        "audit log",
+        &AUDIT_LOG,
+        receiver,
+        &AUDIT_RECORDS_WRITTEN_COUNTER,
+    )
+    .await;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rows_affected() {
+        assert_eq!(rows_affected("INSERT 0 5"), Some(5));
+        assert_eq!(rows_affected("UPDATE 12"), Some(12));
+        assert_eq!(rows_affected("SELECT 1"), Some(1));
+        assert_eq!(rows_affected("COPY 100"), Some(100));
+        assert_eq!(rows_affected("CREATE TABLE"), None);
+        assert_eq!(rows_affected("BEGIN"), None);
+        assert_eq!(rows_affected(""), None);
+    }
+
+    #[test]
+    fn test_audit_line() {
+        let line = audit_line(&AuditRecord {
+            client: "10.0.0.5:51234".to_string(),
+            pool: "exampledb".to_string(),
+            user: "admin_ops".to_string(),
+            statement: "UPDATE accounts SET limit = $1 WHERE id = $2".to_string(),
+            parameters_hash: Some("3f1c0e2a9b7d6c55".to_string()),
+            duration_us: 830,
+            command_tag: Some("UPDATE 1".to_string()),
+            rows: Some(1),
+        });
+        assert!(line.ends_with('\n'));
+        let record: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(record["user"], "admin_ops");
+        assert_eq!(record["rows"], 1);
+        assert_eq!(record["parameters_hash"], "3f1c0e2a9b7d6c55");
+        assert!(record["time"].as_str().unwrap().ends_with('Z'));
+
+        let line = audit_line(&AuditRecord {
+            client: "10.0.0.5:51234".to_string(),
+            pool: "exampledb".to_string(),
+            user: "admin_ops".to_string(),
+            statement: "SELEC 1".to_string(),
+            parameters_hash: None,
+            duration_us: 120,
+            command_tag: None,
+            rows: None,
+        });
+        let record: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert!(record.get("parameters_hash").is_none());
+        assert!(record.get("rows").is_none());
+    }
+}
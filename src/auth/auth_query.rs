@@ -0,0 +1,119 @@
+// Lookup of user passwords on the server with auth_query.
+//
+// Users of a pool with `auth_query` may be configured without a password:
+// on login the query runs on a server connection of `auth_user` and returns
+// the current md5 or SCRAM verifier of the user, e.g. from pg_shadow, so
+// rotated passwords work without changing the config. With
+// `auth_query_template_user` users that aren't listed at all are let in too,
+// their pools created on their first login with the settings of the template.
+
+// External crate imports
+use log::{debug, warn};
+
+// Internal crate imports
+use crate::config::get_config;
+use crate::errors::Error;
+use crate::pool::{get_pool, PendingPools};
+
+/// Default query, reading the verifiers from pg_shadow (requires a superuser as auth_user).
+pub const DEFAULT_AUTH_QUERY: &str = "SELECT usename, passwd FROM pg_shadow WHERE usename = $1";
+
+/// Quote a string as an SQL literal, like quote_literal() of PostgreSQL.
+fn quote_literal(value: &str) -> String {
+    let escaped = value.replace('\'', "''");
+    if escaped.contains('\\') {
+        format!("E'{}'", escaped.replace('\\', "\\\\"))
+    } else {
+        format!("'{escaped}'")
+    }
+}
+
+/// auth_query of the pool with the user name in place of `$1`.
+fn user_auth_query(auth_query: &str, username: &str) -> String {
+    auth_query.replace("$1", &quote_literal(username))
+}
+
+/// Password of `username` returned by auth_query of the pool, None if the pool
+/// has no auth_user or the user is not found. `pending_pools` are the pools
+/// created for the client, not added yet.
+pub async fn fetch_auth_query_password(
+    pool_name: &str,
+    username: &str,
+    pending_pools: Option<&PendingPools>,
+) -> Result<Option<String>, Error> {
+    let config = get_config();
+    let (auth_query, auth_user) = match config.pool_config(pool_name) {
+        Some(pool_config) => match pool_config.auth_user {
+            Some(ref auth_user) => (
+                pool_config
+                    .auth_query
+                    .clone()
+                    .unwrap_or_else(|| DEFAULT_AUTH_QUERY.to_string()),
+                auth_user.clone(),
+            ),
+            None => return Ok(None),
+        },
+        None => return Ok(None),
+    };
+
+    let pool = match get_pool(pool_name, &auth_user, 0)
+        .or_else(|| pending_pools.and_then(|pools| pools.pool(&auth_user)))
+    {
+        Some(pool) => pool,
+        None => {
+            return Err(Error::AuthError(format!(
+                "auth_user {auth_user} has no pool in {pool_name}"
+            )))
+        }
+    };
+    let mut server = match pool.database.get().await {
+        Ok(server) => server,
+        Err(err) => {
+            return Err(Error::AuthError(format!(
+                "No server connection for auth_query of {pool_name}: {err:?}"
+            )))
+        }
+    };
+    server.checkin_cleanup().await?;
+
+    let rows = match server
+        .simple_query_rows(&user_auth_query(&auth_query, username))
+        .await
+    {
+        Ok(rows) => rows,
+        Err(err) => {
+            warn!("auth_query for user {username} in {pool_name} failed: {err:?}");
+            return Err(err);
+        }
+    };
+
+    // The first row, with the password in the second column.
+    match rows.into_iter().next() {
+        Some(row) => match row.into_iter().nth(1) {
+            Some(Some(password)) => Ok(Some(password)),
+            _ => {
+                debug!("auth_query returned no password for user {username} in {pool_name}");
+                Ok(None)
+            }
+        },
+        None => Ok(None),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_user_auth_query() {
+        assert_eq!(
+            user_auth_query(DEFAULT_AUTH_QUERY, "alice"),
+            "SELECT usename, passwd FROM pg_shadow WHERE usename = 'alice'"
+        );
+        assert_eq!(
+            user_auth_query("SELECT * FROM auth.lookup($1)", "o'neil"),
+            "SELECT * FROM auth.lookup('o''neil')"
+        );
+        assert_eq!(quote_literal("a\\'b"), "E'a\\\\''b'");
+    }
+}
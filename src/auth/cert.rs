@@ -0,0 +1,276 @@
+// Authentication of clients by their TLS certificate.
+//
+// With tls_mode = "verify-full" the TLS handshake already checks the client
+// certificate against tls_ca_cert. Users with `auth_cert_map` are then let in
+// without a password if one of the names of the certificate (subject CN, DNS
+// and email subject alternative names) is mapped to the user by the map in
+// tls_cert_ident_file. The file has the format of pg_ident.conf:
+//
+//   # MAPNAME   CERTIFICATE-NAME       POOLER-USER
+//   clients     app.example.com        app
+//   clients     /^(.*)@example\.com$   \1
+//
+// A certificate name starting with `/` is a regular expression and `\1` in the
+// user is replaced with its first capture group.
+
+// Standard library imports
+use std::collections::HashMap;
+
+// External crate imports
+use log::debug;
+use once_cell::sync::Lazy;
+use openssl::nid::Nid;
+use openssl::x509::X509;
+use parking_lot::RwLock;
+use regex::Regex;
+
+// Internal crate imports
+use crate::errors::Error;
+
+/// TLS details of a client connection used by authentication and routing.
+#[derive(Debug, Default, Clone)]
+pub struct ClientTls {
+    /// Hash of the pooler certificate, for SCRAM channel binding.
+    pub server_end_point: Option<Vec<u8>>,
+    /// Names of the verified client certificate, empty if the client sent none.
+    pub certificate_names: Vec<String>,
+    /// Server name (SNI) sent by the client.
+    pub server_name: Option<String>,
+}
+
+/// Certificate name of a map line.
+#[derive(Debug)]
+enum CertificateName {
+    Exact(String),
+    Regex(Regex),
+}
+
+/// A line of the ident file.
+#[derive(Debug)]
+struct IdentMapping {
+    certificate_name: CertificateName,
+    user: String,
+}
+
+impl IdentMapping {
+    /// True if the line maps the certificate name to the user.
+    fn maps(&self, certificate_name: &str, user: &str) -> bool {
+        match self.certificate_name {
+            CertificateName::Exact(ref name) => name == certificate_name && self.user == user,
+            CertificateName::Regex(ref regex) => match regex.captures(certificate_name) {
+                Some(captures) => {
+                    let capture = captures.get(1).map_or("", |capture| capture.as_str());
+                    self.user.replace("\\1", capture) == user
+                }
+                None => false,
+            },
+        }
+    }
+}
+
+/// Maps by name.
+type IdentMaps = HashMap<String, Vec<IdentMapping>>;
+
+static IDENT_MAPS: Lazy<RwLock<IdentMaps>> = Lazy::new(|| RwLock::new(HashMap::new()));
+
+/// Split a line into tokens, double quotes keep spaces and `#` in a token.
+/// Also used for hba_file, which has the same syntax.
+pub(crate) fn tokens(line: &str) -> Vec<String> {
+    let mut tokens = Vec::new();
+    let mut token = String::new();
+    let mut quoted = false;
+    let mut in_token = false;
+    for c in line.chars() {
+        match c {
+            '"' => {
+                quoted = !quoted;
+                in_token = true;
+            }
+            '#' if !quoted => break,
+            c if c.is_whitespace() && !quoted => {
+                if in_token {
+                    tokens.push(std::mem::take(&mut token));
+                    in_token = false;
+                }
+            }
+            c => {
+                token.push(c);
+                in_token = true;
+            }
+        }
+    }
+    if in_token {
+        tokens.push(token);
+    }
+    tokens
+}
+
+fn parse_ident_maps(contents: &str, path: &str) -> Result<IdentMaps, Error> {
+    let mut maps = IdentMaps::new();
+    for (number, line) in contents.lines().enumerate() {
+        let tokens = tokens(line);
+        if tokens.is_empty() {
+            continue;
+        }
+        let [map, certificate_name, user] = match <[String; 3]>::try_from(tokens) {
+            Ok(tokens) => tokens,
+            Err(_) => {
+                return Err(Error::BadConfig(format!(
+                    "{path}:{}: expected map name, certificate name and user",
+                    number + 1
+                )))
+            }
+        };
+        let certificate_name = match certificate_name.strip_prefix('/') {
+            Some(pattern) => match Regex::new(pattern) {
+                Ok(regex) => CertificateName::Regex(regex),
+                Err(err) => {
+                    return Err(Error::BadConfig(format!(
+                        "{path}:{}: invalid regular expression {pattern}: {err}",
+                        number + 1
+                    )))
+                }
+            },
+            None => CertificateName::Exact(certificate_name),
+        };
+        maps.entry(map).or_default().push(IdentMapping {
+            certificate_name,
+            user,
+        });
+    }
+    Ok(maps)
+}
+
+/// Maps of tls_cert_ident_file loaded with load_cert_ident_maps, used once set
+/// with set_cert_ident_maps.
+pub struct CertIdentMaps(IdentMaps);
+
+impl CertIdentMaps {
+    /// Names of the maps.
+    pub fn names(&self) -> Vec<String> {
+        self.0.keys().cloned().collect()
+    }
+}
+
+/// Load the maps of tls_cert_ident_file.
+pub fn load_cert_ident_maps(path: Option<&str>) -> Result<CertIdentMaps, Error> {
+    let maps = match path {
+        Some(path) => match std::fs::read_to_string(path) {
+            Ok(contents) => parse_ident_maps(&contents, path)?,
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Failed to read tls_cert_ident_file {path}: {err}"
+                )))
+            }
+        },
+        None => IdentMaps::new(),
+    };
+    Ok(CertIdentMaps(maps))
+}
+
+/// Use the loaded maps, replacing the current ones.
+pub fn set_cert_ident_maps(maps: CertIdentMaps) {
+    *IDENT_MAPS.write() = maps.0;
+}
+
+/// Subject CN and the DNS and email subject alternative names of a DER certificate.
+pub fn certificate_names(der: &[u8]) -> Result<Vec<String>, Error> {
+    let certificate = match X509::from_der(der) {
+        Ok(certificate) => certificate,
+        Err(err) => {
+            return Err(Error::AuthError(format!(
+                "Failed to parse the client certificate: {err}"
+            )))
+        }
+    };
+    let mut names: Vec<String> = certificate
+        .subject_name()
+        .entries_by_nid(Nid::COMMONNAME)
+        .filter_map(|entry| entry.data().as_utf8().ok())
+        .map(|name| name.to_string())
+        .collect();
+    if let Some(alt_names) = certificate.subject_alt_names() {
+        for alt_name in alt_names.iter() {
+            if let Some(name) = alt_name.dnsname().or(alt_name.email()) {
+                names.push(name.to_string());
+            }
+        }
+    }
+    Ok(names)
+}
+
+/// True if the map maps one of the certificate names to the user.
+pub fn cert_map_allows(map: &str, certificate_names: &[String], user: &str) -> bool {
+    let maps = IDENT_MAPS.read();
+    let mappings = match maps.get(map) {
+        Some(mappings) => mappings,
+        None => return false,
+    };
+    for name in certificate_names {
+        if mappings.iter().any(|mapping| mapping.maps(name, user)) {
+            debug!("Certificate name {name} is mapped to user {user} by map {map}");
+            return true;
+        }
+    }
+    false
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_tokens() {
+        assert_eq!(
+            tokens("  map  cn   user # comment"),
+            vec!["map", "cn", "user"]
+        );
+        assert_eq!(
+            tokens(r#"map "CN with spaces #1" user"#),
+            vec!["map", "CN with spaces #1", "user"]
+        );
+        assert!(tokens("# only a comment").is_empty());
+    }
+
+    #[test]
+    fn test_ident_maps() {
+        let maps = parse_ident_maps(
+            r#"
+            # MAPNAME  CERTIFICATE-NAME      POOLER-USER
+            clients    app.example.com       app
+            clients    /^(.*)@example\.com$  \1
+            admins     root.example.com      postgres
+            "#,
+            "pg_ident.conf",
+        )
+        .unwrap();
+        let maps_user = |map: &str, name: &str, user: &str| {
+            maps[map].iter().any(|mapping| mapping.maps(name, user))
+        };
+        assert!(maps_user("clients", "app.example.com", "app"));
+        assert!(!maps_user("clients", "app.example.com", "postgres"));
+        assert!(maps_user("clients", "alice@example.com", "alice"));
+        assert!(!maps_user("clients", "alice@example.org", "alice"));
+        assert!(!maps_user("clients", "alice@example.com", "bob"));
+        assert!(maps_user("admins", "root.example.com", "postgres"));
+
+        assert!(parse_ident_maps("clients app.example.com", "pg_ident.conf").is_err());
+        assert!(parse_ident_maps("clients /(unclosed app", "pg_ident.conf").is_err());
+    }
+
+    #[test]
+    fn test_certificate_names() {
+        let pem = std::fs::read("./tests/data/ssl/client.crt").unwrap();
+        let der = X509::from_pem(&pem).unwrap().to_der().unwrap();
+        let names = certificate_names(&der).unwrap();
+        assert_eq!(names, vec!["172.17.0.2"]);
+
+        let path = "./tests/data/ssl/pg_ident.conf";
+        let maps = parse_ident_maps(&std::fs::read_to_string(path).unwrap(), path).unwrap();
+        assert!(maps["clients"]
+            .iter()
+            .any(|mapping| mapping.maps(&names[0], "example_user_1")));
+
+        assert!(certificate_names(b"not a certificate").is_err());
+    }
+}
@@ -0,0 +1,804 @@
+// Validation of JWTs issued by configured identity providers.
+//
+// Unlike `jwt-pkey-fpath:`, which trusts a single key, a user with a
+// `jwt-issuers:<name>,<name>` password accepts tokens from any of the listed
+// issuers, e.g. a legacy and a new identity provider during a migration.
+// The token must be issued for the user the client connects as, by its user
+// name claim or by one of its roles mapped to the user with role_map, and with
+// database_claim it must list the database.
+//
+// The keys of an issuer with jwks_url are fetched from its JWKS endpoint and
+// fetched again every jwks_refresh_interval, or sooner when a token names a
+// key (kid) the issuer doesn't have yet, so a key rotation at the identity
+// provider needs no restart. When a fetch fails the last keys stay. The
+// config is checked without fetching, so a config is accepted and pg_doorman
+// starts while the identity provider is down; its tokens are rejected until
+// the first fetch succeeds.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::fs;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+// External crate imports
+use base64::prelude::*;
+use jwt::{Header, PKeyWithDigest, Token, VerifyWithKey};
+use log::{info, warn};
+use once_cell::sync::Lazy;
+use openssl::bn::BigNum;
+use openssl::hash::MessageDigest;
+use openssl::pkey::{PKey, Public};
+use openssl::rsa::Rsa;
+use parking_lot::Mutex;
+use serde_derive::Deserialize;
+use serde_json::{Map, Value};
+use tokio::sync::RwLock;
+
+// Internal crate imports
+use crate::config::{get_config, JwtIssuer};
+use crate::constants::JWT_ISSUERS_PASSWORD_PREFIX;
+use crate::errors::Error;
+use crate::http_client::http_get;
+
+type Claims = Map<String, Value>;
+
+struct IssuerKey {
+    /// Key ID from the JWKS, matched against the `kid` header of the token.
+    kid: Option<String>,
+    key: PKeyWithDigest<Public>,
+}
+
+struct TrustedIssuer {
+    config: JwtIssuer,
+    keys: Vec<IssuerKey>,
+}
+
+static JWT_ISSUERS: Lazy<RwLock<HashMap<String, TrustedIssuer>>> =
+    Lazy::new(|| RwLock::new(HashMap::new()));
+
+/// Wait at most this long for a JWKS endpoint.
+const JWKS_FETCH_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// After a failed fetch the JWKS is fetched again this soon.
+const JWKS_RETRY_INTERVAL: Duration = Duration::from_secs(10);
+
+/// A token with an unknown kid makes the JWKS be fetched again at most this often.
+const JWKS_UNKNOWN_KID_INTERVAL: Duration = Duration::from_secs(30);
+
+/// The last JWKS fetched from a jwks_url.
+#[derive(Debug, Clone)]
+struct FetchedJwks {
+    data: String,
+    /// When the endpoint was last asked, successfully or not.
+    checked_at: Instant,
+    last_error: Option<String>,
+}
+
+static FETCHED_JWKS: Lazy<Mutex<HashMap<String, FetchedJwks>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+#[derive(Deserialize)]
+struct Jwks {
+    keys: Vec<Jwk>,
+}
+
+#[derive(Deserialize)]
+struct Jwk {
+    kty: String,
+    kid: Option<String>,
+    alg: Option<String>,
+    n: Option<String>,
+    e: Option<String>,
+}
+
+/// Names of the issuers of a `jwt-issuers:` password, None for other passwords.
+pub fn jwt_issuer_names(password: &str) -> Option<Vec<String>> {
+    let names = password.strip_prefix(JWT_ISSUERS_PASSWORD_PREFIX)?;
+    Some(
+        names
+            .split(',')
+            .map(str::trim)
+            .filter(|name| !name.is_empty())
+            .map(str::to_string)
+            .collect(),
+    )
+}
+
+fn rs256_key(key: PKey<Public>) -> PKeyWithDigest<Public> {
+    PKeyWithDigest {
+        digest: MessageDigest::sha256(),
+        key,
+    }
+}
+
+fn load_pem_key(key_filename: &str) -> Result<IssuerKey, Error> {
+    let pub_key_data = fs::read_to_string(key_filename)
+        .map_err(|err| Error::JWTPubKey(format!("{key_filename}: {err}")))?;
+    let pub_key = PKey::public_key_from_pem(pub_key_data.as_ref())
+        .map_err(|err| Error::JWTPubKey(format!("{key_filename}: {err}")))?;
+    Ok(IssuerKey {
+        kid: None,
+        key: rs256_key(pub_key),
+    })
+}
+
+fn decode_jwk_number(value: &Option<String>) -> Result<BigNum, Error> {
+    let value = value
+        .as_ref()
+        .ok_or_else(|| Error::JWTPubKey("RSA key without n or e".to_string()))?;
+    let bytes = BASE64_URL_SAFE_NO_PAD
+        .decode(value.trim_end_matches('='))
+        .map_err(|err| Error::JWTPubKey(format!("invalid base64 in RSA key: {err}")))?;
+    BigNum::from_slice(&bytes).map_err(|err| Error::JWTPubKey(err.to_string()))
+}
+
+fn parse_jwks(data: &str) -> Result<Vec<IssuerKey>, Error> {
+    let jwks: Jwks = serde_json::from_str(data)
+        .map_err(|err| Error::JWTPubKey(format!("invalid JWKS: {err}")))?;
+    let mut keys = Vec::with_capacity(jwks.keys.len());
+    for jwk in jwks.keys {
+        // Only RS256 is supported, like for the other JWT keys.
+        if jwk.kty != "RSA" || jwk.alg.as_deref().is_some_and(|alg| alg != "RS256") {
+            continue;
+        }
+        let rsa =
+            Rsa::from_public_components(decode_jwk_number(&jwk.n)?, decode_jwk_number(&jwk.e)?)
+                .map_err(|err| Error::JWTPubKey(err.to_string()))?;
+        let key = PKey::from_rsa(rsa).map_err(|err| Error::JWTPubKey(err.to_string()))?;
+        keys.push(IssuerKey {
+            kid: jwk.kid,
+            key: rs256_key(key),
+        });
+    }
+    Ok(keys)
+}
+
+fn load_jwks(jwks_filename: &str) -> Result<Vec<IssuerKey>, Error> {
+    let data = fs::read_to_string(jwks_filename)
+        .map_err(|err| Error::JWTPubKey(format!("{jwks_filename}: {err}")))?;
+    parse_jwks(&data).map_err(|err| Error::JWTPubKey(format!("{jwks_filename}: {err}")))
+}
+
+/// Fetch the JWKS from the URL and keep it for the issuers using it.
+/// On error the JWKS fetched before, if any, stays.
+async fn fetch_jwks(jwks_url: &str) -> Result<(), Error> {
+    let fetched = http_get(jwks_url, &[], JWKS_FETCH_TIMEOUT)
+        .await
+        .and_then(|data| {
+            if parse_jwks(&data)?.is_empty() {
+                return Err(Error::JWTPubKey("no RS256 keys".to_string()));
+            }
+            Ok(data)
+        })
+        .map_err(|err| Error::JWTPubKey(format!("{jwks_url}: {err}")));
+    let mut jwks = FETCHED_JWKS.lock();
+    match fetched {
+        Ok(data) => {
+            jwks.insert(
+                jwks_url.to_string(),
+                FetchedJwks {
+                    data,
+                    checked_at: Instant::now(),
+                    last_error: None,
+                },
+            );
+            Ok(())
+        }
+        Err(err) => {
+            if let Some(previous) = jwks.get_mut(jwks_url) {
+                previous.checked_at = Instant::now();
+                previous.last_error = Some(err.to_string());
+            }
+            Err(err)
+        }
+    }
+}
+
+/// Keys of the JWKS fetched from the URL, none if it wasn't fetched yet.
+fn fetched_jwks(jwks_url: &str) -> Result<Vec<IssuerKey>, Error> {
+    let data = match FETCHED_JWKS.lock().get(jwks_url) {
+        Some(jwks) => jwks.data.clone(),
+        None => return Ok(Vec::new()),
+    };
+    parse_jwks(&data).map_err(|err| Error::JWTPubKey(format!("{jwks_url}: {err}")))
+}
+
+/// Keys of the issuer from its key files and jwks_file.
+fn load_key_files(config: &JwtIssuer) -> Result<Vec<IssuerKey>, Error> {
+    let mut keys = Vec::new();
+    for key_filename in config.keys.iter() {
+        keys.push(load_pem_key(key_filename)?);
+    }
+    if let Some(ref jwks_filename) = config.jwks_file {
+        keys.extend(load_jwks(jwks_filename)?);
+    }
+    Ok(keys)
+}
+
+/// Check that the key files and jwks_file of the issuer can be loaded.
+/// The jwks_url isn't fetched, the keys are loaded after the config is accepted.
+pub fn check_jwt_issuer_keys(name: &str, config: &JwtIssuer) -> Result<(), Error> {
+    load_key_files(config)
+        .map(|_| ())
+        .map_err(|err| Error::BadConfig(format!("jwt_issuers.{name}: {err}")))
+}
+
+impl TrustedIssuer {
+    fn load(name: &str, config: &JwtIssuer) -> Result<TrustedIssuer, Error> {
+        let mut keys = load_key_files(config)?;
+        if let Some(ref jwks_url) = config.jwks_url {
+            keys.extend(fetched_jwks(jwks_url)?);
+        }
+        if keys.is_empty() {
+            return Err(Error::JWTPubKey(format!(
+                "no RS256 keys found for JWT issuer {name}"
+            )));
+        }
+        Ok(TrustedIssuer {
+            config: config.clone(),
+            keys,
+        })
+    }
+
+    fn has_kid(&self, kid: &str) -> bool {
+        self.keys.iter().any(|key| key.kid.as_deref() == Some(kid))
+    }
+
+    /// Check the signature with the key named by `kid`, or with every key if there is none.
+    fn verify(&self, input_token: &str, kid: Option<&str>) -> Result<Claims, Error> {
+        let by_kid: Vec<&IssuerKey> = self
+            .keys
+            .iter()
+            .filter(|key| kid.is_some() && key.kid.as_deref() == kid)
+            .collect();
+        let candidates: Vec<&IssuerKey> = if by_kid.is_empty() {
+            self.keys.iter().collect()
+        } else {
+            by_kid
+        };
+
+        let mut last_error = Error::JWTValidate("no keys to verify the token".to_string());
+        for key in candidates {
+            let token: Result<Token<Header, Claims, _>, _> =
+                VerifyWithKey::verify_with_key(input_token, &key.key);
+            match token {
+                Ok(token) => {
+                    let (_, claims) = token.into();
+                    return Ok(claims);
+                }
+                Err(err) => last_error = Error::JWTValidate(err.to_string()),
+            }
+        }
+        Err(last_error)
+    }
+
+    /// Check the time claims and the audience of a verified token.
+    fn validate_claims(&self, claims: &Claims, now: u64) -> Result<(), Error> {
+        let skew = self.config.clock_skew;
+        if let Some(not_before) = claims.get("nbf").and_then(Value::as_u64) {
+            if now.saturating_add(skew) < not_before {
+                return Err(Error::JWTValidate(format!(
+                    "Token not yet valid. Current time: {now}, valid from: {not_before}"
+                )));
+            }
+        }
+        match claims.get("exp").and_then(Value::as_u64) {
+            Some(expiration) => {
+                if now > expiration.saturating_add(skew) {
+                    return Err(Error::JWTValidate(format!(
+                        "Token has expired. Current time: {now}, expired at: {expiration}"
+                    )));
+                }
+            }
+            None => {
+                return Err(Error::JWTValidate(
+                    "Token missing required expiration claim".to_string(),
+                ))
+            }
+        }
+        if let Some(ref audience) = self.config.audience {
+            let matches = match claims.get("aud") {
+                Some(Value::String(aud)) => aud == audience,
+                Some(Value::Array(auds)) => auds
+                    .iter()
+                    .any(|aud| aud.as_str() == Some(audience.as_str())),
+                _ => false,
+            };
+            if !matches {
+                return Err(Error::JWTValidate(format!(
+                    "Token is not issued for audience {audience}"
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    /// Check that a verified token lets the client connect as `user` to `database`.
+    fn authorize(&self, claims: &Claims, user: &str, database: &str) -> Result<(), Error> {
+        let user_name = self.user_name(claims);
+        if user_name.as_deref().ok() != Some(user) {
+            let roles = match self.config.role_claim {
+                Some(ref role_claim) => claim_values(claims, role_claim),
+                None => Vec::new(),
+            };
+            let mapped = roles.iter().any(|role| {
+                self.config
+                    .role_map
+                    .get(*role)
+                    .is_some_and(|users| users.iter().any(|mapped| mapped == user))
+            });
+            if !mapped {
+                return Err(match (user_name, &self.config.role_claim) {
+                    (user_name, Some(role_claim)) => Error::JWTValidate(format!(
+                        "Token is issued for user '{}' with {role_claim} {roles:?}, none of them allows user '{user}'",
+                        user_name.unwrap_or_default()
+                    )),
+                    (Ok(user_name), None) => Error::JWTValidate(format!(
+                        "Token is issued for user '{user_name}', not '{user}'"
+                    )),
+                    (Err(err), None) => err,
+                });
+            }
+        }
+        if let Some(ref database_claim) = self.config.database_claim {
+            let databases = claim_values(claims, database_claim);
+            if !databases
+                .iter()
+                .any(|allowed| *allowed == "*" || *allowed == database)
+            {
+                return Err(Error::JWTValidate(format!(
+                    "Token doesn't allow database '{database}', its {database_claim} are {databases:?}"
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    /// User name of a verified token, mapped by the issuer rules.
+    fn user_name(&self, claims: &Claims) -> Result<String, Error> {
+        let username = claims
+            .get(&self.config.username_claim)
+            .and_then(Value::as_str)
+            .ok_or_else(|| {
+                Error::JWTValidate(format!(
+                    "Token missing user name claim {}",
+                    self.config.username_claim
+                ))
+            })?;
+        let username = match self.config.username_strip_suffix {
+            Some(ref suffix) => username.strip_suffix(suffix.as_str()).unwrap_or(username),
+            None => username,
+        };
+        Ok(username.to_string())
+    }
+}
+
+/// Values of a claim that is a string or an array of strings.
+fn claim_values<'a>(claims: &'a Claims, claim: &str) -> Vec<&'a str> {
+    match claims.get(claim) {
+        Some(Value::String(value)) => vec![value.as_str()],
+        Some(Value::Array(values)) => values.iter().filter_map(Value::as_str).collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// Load the keys of the configured issuers once the config is accepted. The
+/// JWKS URLs are not fetched here, refresh_jwks fetches the new ones right away.
+/// An issuer whose keys can't be loaded keeps the keys it had, issuers no longer
+/// configured are dropped.
+pub async fn load_jwt_issuers(issuers: &HashMap<String, JwtIssuer>) {
+    let mut trusted = JWT_ISSUERS.write().await;
+    let mut previous = std::mem::take(&mut *trusted);
+    for (name, config) in issuers.iter() {
+        match TrustedIssuer::load(name, config) {
+            Ok(issuer) => {
+                trusted.insert(name.clone(), issuer);
+            }
+            Err(err) => match previous.remove(name) {
+                Some(issuer) => {
+                    warn!("Can't load the keys of JWT issuer {name}, keeping its last keys: {err}");
+                    trusted.insert(
+                        name.clone(),
+                        TrustedIssuer {
+                            config: config.clone(),
+                            keys: issuer.keys,
+                        },
+                    );
+                }
+                None if config.jwks_url.is_some() => {
+                    info!("JWT issuer {name} has no keys until its JWKS is fetched: {err}");
+                }
+                None => warn!("Can't load the keys of JWT issuer {name}: {err}"),
+            },
+        }
+    }
+}
+
+/// Fetch the JWKS of the issuer again and swap its keys.
+async fn refresh_issuer(name: &str, config: &JwtIssuer) -> Result<(), Error> {
+    let jwks_url = match config.jwks_url {
+        Some(ref jwks_url) => jwks_url,
+        None => return Ok(()),
+    };
+    let previous = FETCHED_JWKS
+        .lock()
+        .get(jwks_url)
+        .map(|jwks| jwks.data.clone());
+    fetch_jwks(jwks_url).await?;
+    let issuer = TrustedIssuer::load(name, config)?;
+    if previous.is_none() {
+        info!(
+            "JWKS of JWT issuer {name} fetched, {} keys",
+            issuer.keys.len()
+        );
+    }
+    if previous.as_ref() != FETCHED_JWKS.lock().get(jwks_url).map(|jwks| &jwks.data) {
+        info!(
+            "JWKS of JWT issuer {name} changed, {} keys now",
+            issuer.keys.len()
+        );
+    }
+    JWT_ISSUERS.write().await.insert(name.to_string(), issuer);
+    Ok(())
+}
+
+/// Whether the JWKS of the URL is due to be fetched again.
+fn jwks_due(jwks_url: &str, refresh_interval: Duration) -> bool {
+    match FETCHED_JWKS.lock().get(jwks_url) {
+        Some(jwks) if jwks.last_error.is_some() => {
+            jwks.checked_at.elapsed() >= refresh_interval.min(JWKS_RETRY_INTERVAL)
+        }
+        Some(jwks) => jwks.checked_at.elapsed() >= refresh_interval,
+        None => true,
+    }
+}
+
+/// Fetch the JWKS of the issuers with jwks_url every jwks_refresh_interval.
+pub async fn refresh_jwks() {
+    let mut interval = tokio::time::interval(Duration::from_secs(1));
+    loop {
+        interval.tick().await;
+        let issuers = get_config().jwt_issuers;
+        for (name, issuer) in issuers.iter() {
+            let due = match issuer.jwks_url {
+                Some(ref jwks_url) => jwks_due(
+                    jwks_url,
+                    Duration::from_millis(issuer.jwks_refresh_interval),
+                ),
+                None => false,
+            };
+            if !due {
+                continue;
+            }
+            if let Err(err) = refresh_issuer(name, issuer).await {
+                warn!("Can't refresh the JWKS of JWT issuer {name}, keeping its keys: {err}");
+            }
+        }
+    }
+}
+
+/// The issuer of the token among `issuer_names`.
+fn token_issuer<'a>(
+    issuers: &'a HashMap<String, TrustedIssuer>,
+    issuer_names: &[String],
+    iss: &str,
+) -> Option<(&'a String, &'a TrustedIssuer)> {
+    issuer_names
+        .iter()
+        .filter_map(|name| issuers.get_key_value(name))
+        .find(|(_, issuer)| issuer.config.issuer == iss)
+}
+
+/// The issuer with jwks_url that doesn't have the key the token is signed with,
+/// if its JWKS wasn't fetched in the last JWKS_UNKNOWN_KID_INTERVAL.
+fn issuer_missing_kid(
+    issuers: &HashMap<String, TrustedIssuer>,
+    issuer_names: &[String],
+    input_token: &str,
+) -> Option<(String, JwtIssuer)> {
+    let unverified: Token<Header, Claims, _> = Token::parse_unverified(input_token).ok()?;
+    let kid = unverified.header().key_id.as_deref()?;
+    let iss = unverified.claims().get("iss").and_then(Value::as_str)?;
+    let (name, issuer) = token_issuer(issuers, issuer_names, iss)?;
+    let jwks_url = issuer.config.jwks_url.as_ref()?;
+    if issuer.has_kid(kid) || !jwks_due(jwks_url, JWKS_UNKNOWN_KID_INTERVAL) {
+        return None;
+    }
+    Some((name.clone(), issuer.config.clone()))
+}
+
+fn validate_token(
+    issuers: &HashMap<String, TrustedIssuer>,
+    issuer_names: &[String],
+    input_token: &str,
+    user: &str,
+    database: &str,
+    now: u64,
+) -> Result<(), Error> {
+    let unverified: Token<Header, Claims, _> =
+        Token::parse_unverified(input_token).map_err(|err| Error::JWTValidate(err.to_string()))?;
+    let iss = unverified
+        .claims()
+        .get("iss")
+        .and_then(Value::as_str)
+        .ok_or_else(|| Error::JWTValidate("Token missing issuer claim".to_string()))?;
+
+    let (_, issuer) = token_issuer(issuers, issuer_names, iss)
+        .ok_or_else(|| Error::JWTValidate(format!("Issuer {iss} is not trusted")))?;
+
+    let claims = issuer.verify(input_token, unverified.header().key_id.as_deref())?;
+    issuer.validate_claims(&claims, now)?;
+    issuer.authorize(&claims, user, database)
+}
+
+/// Validate a token issued by one of `issuer_names` for the client connecting as `user` to `database`.
+pub async fn validate_jwt_issuers_token(
+    issuer_names: &[String],
+    input_token: &str,
+    user: &str,
+    database: &str,
+) -> Result<(), Error> {
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_err(|e| Error::JWTValidate(format!("Failed to get current time: {e}")))?
+        .as_secs();
+    // A key rotated in at the identity provider: fetch its JWKS now rather than at the next refresh.
+    let missing_kid = issuer_missing_kid(&*JWT_ISSUERS.read().await, issuer_names, input_token);
+    if let Some((name, config)) = missing_kid {
+        if let Err(err) = refresh_issuer(&name, &config).await {
+            warn!("Can't refresh the JWKS of JWT issuer {name} for an unknown key: {err}");
+        }
+    }
+    let issuers = JWT_ISSUERS.read().await;
+    validate_token(&issuers, issuer_names, input_token, user, database, now)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use jwt::{AlgorithmType, SignWithKey};
+    use openssl::pkey::Private;
+    use serde_json::json;
+    use std::collections::BTreeMap;
+
+    fn issuer_config(issuer: &str) -> JwtIssuer {
+        JwtIssuer {
+            issuer: issuer.to_string(),
+            keys: vec![],
+            jwks_file: None,
+            jwks_url: None,
+            jwks_refresh_interval: JwtIssuer::default_jwks_refresh_interval(),
+            audience: None,
+            clock_skew: 0,
+            username_claim: JwtIssuer::default_username_claim(),
+            username_strip_suffix: None,
+            database_claim: None,
+            role_claim: None,
+            role_map: BTreeMap::new(),
+        }
+    }
+
+    fn load_issuers(
+        issuers: &HashMap<String, JwtIssuer>,
+    ) -> Result<HashMap<String, TrustedIssuer>, Error> {
+        let mut loaded = HashMap::with_capacity(issuers.len());
+        for (name, config) in issuers.iter() {
+            loaded.insert(name.clone(), TrustedIssuer::load(name, config)?);
+        }
+        Ok(loaded)
+    }
+
+    fn private_key() -> PKeyWithDigest<Private> {
+        let private_pem = fs::read_to_string("./tests/data/jwt/private.pem").unwrap();
+        PKeyWithDigest {
+            digest: MessageDigest::sha256(),
+            key: PKey::private_key_from_pem(private_pem.as_ref()).unwrap(),
+        }
+    }
+
+    fn sign(claims: Value, kid: Option<&str>) -> String {
+        let header = Header {
+            algorithm: AlgorithmType::Rs256,
+            key_id: kid.map(str::to_string),
+            ..Default::default()
+        };
+        let claims: Claims = claims.as_object().unwrap().clone();
+        Token::new(header, claims)
+            .sign_with_key(&private_key())
+            .unwrap()
+            .as_str()
+            .to_string()
+    }
+
+    fn now() -> u64 {
+        SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap()
+            .as_secs()
+    }
+
+    #[test]
+    fn test_jwt_issuer_names() {
+        assert_eq!(
+            jwt_issuer_names("jwt-issuers:legacy, new"),
+            Some(vec!["legacy".to_string(), "new".to_string()])
+        );
+        assert_eq!(jwt_issuer_names("jwt-issuers:"), Some(vec![]));
+        assert_eq!(jwt_issuer_names("md5abcdef"), None);
+    }
+
+    #[test]
+    fn test_parse_jwks() {
+        let data = fs::read_to_string("./tests/data/jwt/jwks.json").unwrap();
+        let keys = parse_jwks(&data).unwrap();
+        assert_eq!(keys.len(), 1);
+        assert_eq!(keys[0].kid.as_deref(), Some("test-key"));
+
+        let keys = parse_jwks(r#"{"keys": [{"kty": "EC", "crv": "P-256"}]}"#).unwrap();
+        assert!(keys.is_empty());
+    }
+
+    #[test]
+    fn test_validate_claims() {
+        let mut config = issuer_config("https://idp.example.com");
+        config.audience = Some("pg_doorman".to_string());
+        config.clock_skew = 30;
+        let issuer = TrustedIssuer {
+            config,
+            keys: vec![],
+        };
+        let now = now();
+        let claims = |value: Value| -> Claims { value.as_object().unwrap().clone() };
+
+        assert!(issuer
+            .validate_claims(&claims(json!({"exp": now + 60, "aud": "pg_doorman"})), now)
+            .is_ok());
+        assert!(issuer
+            .validate_claims(
+                &claims(json!({"exp": now - 10, "aud": ["other", "pg_doorman"]})),
+                now
+            )
+            .is_ok());
+        assert!(issuer
+            .validate_claims(&claims(json!({"exp": now - 60, "aud": "pg_doorman"})), now)
+            .is_err());
+        assert!(issuer
+            .validate_claims(
+                &claims(json!({"exp": now + 60, "nbf": now + 60, "aud": "pg_doorman"})),
+                now
+            )
+            .is_err());
+        assert!(issuer
+            .validate_claims(&claims(json!({"exp": now + 60, "aud": "other"})), now)
+            .is_err());
+        assert!(issuer
+            .validate_claims(&claims(json!({"aud": "pg_doorman"})), now)
+            .is_err());
+    }
+
+    #[test]
+    fn test_jwks_url() {
+        let jwks_url = "https://idp.example.com/.well-known/jwks.json";
+        let mut config = issuer_config("https://idp.example.com");
+        config.jwks_url = Some(jwks_url.to_string());
+        // The config is accepted before the JWKS is fetched, the issuer has no keys until then.
+        check_jwt_issuer_keys("idp", &config).unwrap();
+        assert!(load_issuers(&HashMap::from([("idp".to_string(), config.clone())])).is_err());
+
+        FETCHED_JWKS.lock().insert(
+            jwks_url.to_string(),
+            FetchedJwks {
+                data: fs::read_to_string("./tests/data/jwt/jwks.json").unwrap(),
+                checked_at: Instant::now(),
+                last_error: None,
+            },
+        );
+        let issuers = load_issuers(&HashMap::from([("idp".to_string(), config)])).unwrap();
+        let names = vec!["idp".to_string()];
+        let now = now();
+        let token = sign(
+            json!({"iss": "https://idp.example.com", "exp": now + 60, "preferred_username": "alice"}),
+            Some("test-key"),
+        );
+        validate_token(&issuers, &names, &token, "alice", "app", now).unwrap();
+        assert!(issuer_missing_kid(&issuers, &names, &token).is_none());
+
+        // A rotated key: fetched again, but not more often than JWKS_UNKNOWN_KID_INTERVAL.
+        let token = sign(
+            json!({"iss": "https://idp.example.com", "exp": now + 60, "preferred_username": "alice"}),
+            Some("rotated-key"),
+        );
+        assert!(issuer_missing_kid(&issuers, &names, &token).is_none());
+        FETCHED_JWKS.lock().get_mut(jwks_url).unwrap().checked_at =
+            Instant::now() - JWKS_UNKNOWN_KID_INTERVAL;
+        assert_eq!(
+            issuer_missing_kid(&issuers, &names, &token).unwrap().0,
+            "idp"
+        );
+    }
+
+    #[test]
+    fn test_validate_token() {
+        let mut legacy = issuer_config("https://legacy.example.com");
+        legacy.keys = vec!["./tests/data/jwt/public.pem".to_string()];
+        let mut new = issuer_config("https://idp.example.com");
+        new.jwks_file = Some("./tests/data/jwt/jwks.json".to_string());
+        new.audience = Some("pg_doorman".to_string());
+        new.username_claim = "email".to_string();
+        new.username_strip_suffix = Some("@example.com".to_string());
+        let issuers = load_issuers(&HashMap::from([
+            ("legacy".to_string(), legacy),
+            ("new".to_string(), new),
+        ]))
+        .unwrap();
+        let both = vec!["legacy".to_string(), "new".to_string()];
+        let now = now();
+        let exp = now + 60;
+
+        let token = sign(
+            json!({"iss": "https://legacy.example.com", "exp": exp, "preferred_username": "alice"}),
+            None,
+        );
+        validate_token(&issuers, &both, &token, "alice", "app", now).unwrap();
+        assert!(validate_token(&issuers, &both, &token, "bob", "app", now).is_err());
+
+        let token = sign(
+            json!({"iss": "https://idp.example.com", "exp": exp, "aud": "pg_doorman", "email": "alice@example.com"}),
+            Some("test-key"),
+        );
+        validate_token(&issuers, &both, &token, "alice", "app", now).unwrap();
+        assert!(validate_token(&issuers, &both, &token, "bob", "app", now).is_err());
+        // The user doesn't trust the new issuer.
+        assert!(validate_token(
+            &issuers,
+            &["legacy".to_string()],
+            &token,
+            "alice",
+            "app",
+            now
+        )
+        .is_err());
+
+        let token = sign(
+            json!({"iss": "https://unknown.example.com", "exp": exp, "preferred_username": "alice"}),
+            None,
+        );
+        assert!(validate_token(&issuers, &both, &token, "alice", "app", now).is_err());
+    }
+
+    #[test]
+    fn test_authorize() {
+        let mut config = issuer_config("https://idp.example.com");
+        config.username_claim = "sub".to_string();
+        config.database_claim = Some("databases".to_string());
+        config.role_claim = Some("groups".to_string());
+        config.role_map = BTreeMap::from([
+            ("analysts".to_string(), vec!["reporting".to_string()]),
+            (
+                "admins".to_string(),
+                vec!["app".to_string(), "reporting".to_string()],
+            ),
+        ]);
+        let issuer = TrustedIssuer {
+            config,
+            keys: vec![],
+        };
+        let claims = |value: Value| -> Claims { value.as_object().unwrap().clone() };
+
+        let alice = claims(json!({"sub": "alice", "databases": ["app", "billing"]}));
+        assert!(issuer.authorize(&alice, "alice", "app").is_ok());
+        assert!(issuer.authorize(&alice, "alice", "billing").is_ok());
+        let err = issuer.authorize(&alice, "alice", "hr").unwrap_err();
+        assert!(err.to_string().contains("database 'hr'"));
+        assert!(issuer.authorize(&alice, "reporting", "app").is_err());
+
+        // Users allowed by the roles of the token.
+        let analyst = claims(json!({"sub": "bob", "groups": ["analysts"], "databases": "*"}));
+        assert!(issuer.authorize(&analyst, "reporting", "hr").is_ok());
+        let err = issuer.authorize(&analyst, "app", "hr").unwrap_err();
+        assert!(err.to_string().contains("none of them allows user 'app'"));
+        let admin = claims(json!({"groups": "admins", "databases": ["app"]}));
+        assert!(issuer.authorize(&admin, "app", "app").is_ok());
+        assert!(issuer.authorize(&admin, "admin", "app").is_err());
+    }
+}
@@ -0,0 +1,612 @@
+// Authentication of clients against an LDAP directory, e.g. Active Directory.
+//
+// Two modes, like PostgreSQL: simple bind, where the DN of the user is built
+// from a prefix and a suffix, and search+bind, where the DN is first found by
+// searching the directory (as `bind_dn` or anonymously). The password is then
+// checked by binding as the user. Only the few LDAPv3 operations needed for
+// this are implemented; connections are reused through a small pool per server.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::time::Duration;
+
+// External crate imports
+use log::{debug, warn};
+use native_tls::Certificate;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+// Internal crate imports
+use crate::config::{get_config, LdapServer};
+use crate::errors::Error;
+
+/// Largest response accepted from the directory.
+const MAX_RESPONSE_SIZE: usize = 1024 * 1024;
+
+/// OID of the StartTLS extended operation.
+const STARTTLS_OID: &[u8] = b"1.3.6.1.4.1.1466.20037";
+
+// LDAP result codes.
+const RESULT_SUCCESS: i64 = 0;
+const RESULT_SIZE_LIMIT_EXCEEDED: i64 = 4;
+const RESULT_INVALID_CREDENTIALS: i64 = 49;
+
+// BER tags.
+const TAG_BOOLEAN: u8 = 0x01;
+const TAG_INTEGER: u8 = 0x02;
+const TAG_OCTET_STRING: u8 = 0x04;
+const TAG_ENUMERATED: u8 = 0x0a;
+const TAG_SEQUENCE: u8 = 0x30;
+const TAG_BIND_REQUEST: u8 = 0x60;
+const TAG_BIND_RESPONSE: u8 = 0x61;
+const TAG_SEARCH_REQUEST: u8 = 0x63;
+const TAG_SEARCH_RESULT_ENTRY: u8 = 0x64;
+const TAG_SEARCH_RESULT_DONE: u8 = 0x65;
+const TAG_EXTENDED_REQUEST: u8 = 0x77;
+const TAG_EXTENDED_RESPONSE: u8 = 0x78;
+const TAG_SIMPLE_AUTHENTICATION: u8 = 0x80;
+const TAG_EXTENDED_REQUEST_NAME: u8 = 0x80;
+const TAG_EQUALITY_MATCH: u8 = 0xa3;
+
+/// Characters that would change the meaning of a DN built from the user name.
+const DN_SPECIAL_CHARACTERS: &[char] = &[',', '+', '"', '\\', '<', '>', ';', '=', '#'];
+
+fn ldap_error(message: String) -> Error {
+    Error::AuthError(format!("LDAP: {message}"))
+}
+
+/// BER element: tag, definite length and content.
+fn ber(tag: u8, content: &[u8]) -> Vec<u8> {
+    let mut element = vec![tag];
+    let len = content.len();
+    if len < 0x80 {
+        element.push(len as u8);
+    } else {
+        let bytes = len.to_be_bytes();
+        let skip = bytes.iter().take_while(|byte| **byte == 0).count();
+        element.push(0x80 | (bytes.len() - skip) as u8);
+        element.extend_from_slice(&bytes[skip..]);
+    }
+    element.extend_from_slice(content);
+    element
+}
+
+/// BER integer (or enumerated) in the minimal two's complement form.
+fn ber_integer(tag: u8, value: i64) -> Vec<u8> {
+    let bytes = value.to_be_bytes();
+    let mut skip = 0;
+    while skip < bytes.len() - 1 {
+        let redundant = (bytes[skip] == 0x00 && bytes[skip + 1] & 0x80 == 0)
+            || (bytes[skip] == 0xff && bytes[skip + 1] & 0x80 != 0);
+        if !redundant {
+            break;
+        }
+        skip += 1;
+    }
+    ber(tag, &bytes[skip..])
+}
+
+/// Reads BER elements from a buffer.
+struct BerReader<'a> {
+    data: &'a [u8],
+}
+
+impl<'a> BerReader<'a> {
+    fn new(data: &'a [u8]) -> Self {
+        BerReader { data }
+    }
+
+    /// The next element: its tag and content.
+    fn read(&mut self) -> Result<(u8, &'a [u8]), Error> {
+        let truncated = || ldap_error("truncated response".to_string());
+        let (&tag, rest) = self.data.split_first().ok_or_else(truncated)?;
+        let (&first, mut rest) = rest.split_first().ok_or_else(truncated)?;
+        let len = if first < 0x80 {
+            first as usize
+        } else {
+            let count = (first & 0x7f) as usize;
+            if count == 0 || count > 4 || rest.len() < count {
+                return Err(truncated());
+            }
+            let len = rest[..count]
+                .iter()
+                .fold(0usize, |len, byte| (len << 8) | *byte as usize);
+            rest = &rest[count..];
+            len
+        };
+        if rest.len() < len {
+            return Err(truncated());
+        }
+        let (content, rest) = rest.split_at(len);
+        self.data = rest;
+        Ok((tag, content))
+    }
+
+    /// The next element, which must have the tag.
+    fn expect(&mut self, expected: u8) -> Result<&'a [u8], Error> {
+        match self.read()? {
+            (tag, content) if tag == expected => Ok(content),
+            (tag, _) => Err(ldap_error(format!(
+                "unexpected element {tag:#04x}, expected {expected:#04x}"
+            ))),
+        }
+    }
+
+    fn integer(&mut self, tag: u8) -> Result<i64, Error> {
+        let content = self.expect(tag)?;
+        if content.is_empty() || content.len() > 8 {
+            return Err(ldap_error("bad integer".to_string()));
+        }
+        let negative = content[0] & 0x80 != 0;
+        Ok(content
+            .iter()
+            .fold(if negative { -1 } else { 0 }, |value, byte| {
+                (value << 8) | *byte as i64
+            }))
+    }
+}
+
+/// Result of an operation: the result code and the diagnostic message.
+fn parse_result(content: &[u8]) -> Result<(i64, String), Error> {
+    let mut reader = BerReader::new(content);
+    let code = reader.integer(TAG_ENUMERATED)?;
+    reader.expect(TAG_OCTET_STRING)?; // matchedDN
+    let message = reader.expect(TAG_OCTET_STRING)?;
+    Ok((code, String::from_utf8_lossy(message).to_string()))
+}
+
+/// Scheme, host and port of an LDAP URL.
+pub fn parse_ldap_url(url: &str) -> Result<(bool, String, u16), Error> {
+    let (tls, address) = if let Some(address) = url.strip_prefix("ldaps://") {
+        (true, address)
+    } else if let Some(address) = url.strip_prefix("ldap://") {
+        (false, address)
+    } else {
+        return Err(Error::BadConfig(format!(
+            "LDAP url {url} must start with ldap:// or ldaps://"
+        )));
+    };
+    let address = address.trim_end_matches('/');
+    let default_port = if tls { 636 } else { 389 };
+    // IPv6 addresses are in brackets.
+    let (host, port) = match address.strip_prefix('[') {
+        Some(address) => match address.split_once(']') {
+            Some((host, "")) => (host, None),
+            Some((host, port)) => (host, Some(port.strip_prefix(':').unwrap_or(port))),
+            None => (address, Some("")),
+        },
+        None => match address.rsplit_once(':') {
+            Some((host, port)) => (host, Some(port)),
+            None => (address, None),
+        },
+    };
+    let port = match port {
+        Some(port) => match port.parse::<u16>() {
+            Ok(port) => port,
+            Err(_) => {
+                return Err(Error::BadConfig(format!(
+                    "LDAP url {url} has an invalid port"
+                )))
+            }
+        },
+        None => default_port,
+    };
+    if host.is_empty() || host.contains('/') {
+        return Err(Error::BadConfig(format!("LDAP url {url} has no host")));
+    }
+    Ok((tls, host.to_string(), port))
+}
+
+trait LdapStream: AsyncRead + AsyncWrite + Unpin + Send {}
+
+impl<T: AsyncRead + AsyncWrite + Unpin + Send> LdapStream for T {}
+
+/// A connection to a directory server.
+struct LdapConnection {
+    /// URL it was opened for, connections of a changed server are not reused.
+    url: String,
+    stream: Box<dyn LdapStream>,
+    message_id: i64,
+}
+
+impl LdapConnection {
+    async fn connect(server: &LdapServer) -> Result<LdapConnection, Error> {
+        let (tls, host, port) = parse_ldap_url(&server.url)?;
+        let stream = match TcpStream::connect((host.as_str(), port)).await {
+            Ok(stream) => stream,
+            Err(err) => {
+                return Err(ldap_error(format!(
+                    "failed to connect to {}: {err}",
+                    server.url
+                )))
+            }
+        };
+
+        let mut connection = LdapConnection {
+            url: server.url.clone(),
+            stream: Box::new(stream),
+            message_id: 0,
+        };
+        if !tls && !server.starttls {
+            return Ok(connection);
+        }
+
+        // StartTLS upgrades the plain connection, nothing is left unread after its response.
+        if !tls {
+            let (tag, content) = connection
+                .request(
+                    TAG_EXTENDED_REQUEST,
+                    &ber(TAG_EXTENDED_REQUEST_NAME, STARTTLS_OID),
+                )
+                .await?;
+            if tag != TAG_EXTENDED_RESPONSE {
+                return Err(ldap_error(format!(
+                    "unexpected StartTLS response {tag:#04x}"
+                )));
+            }
+            let (code, message) = parse_result(&content)?;
+            if code != RESULT_SUCCESS {
+                return Err(ldap_error(format!("StartTLS failed ({code}): {message}")));
+            }
+        }
+
+        let mut builder = native_tls::TlsConnector::builder();
+        if let Some(ref ca_cert) = server.tls_ca_cert {
+            let pem = match std::fs::read(ca_cert) {
+                Ok(pem) => pem,
+                Err(err) => {
+                    return Err(ldap_error(format!(
+                        "failed to read tls_ca_cert {ca_cert}: {err}"
+                    )))
+                }
+            };
+            match Certificate::from_pem(&pem) {
+                Ok(certificate) => {
+                    builder.add_root_certificate(certificate);
+                }
+                Err(err) => return Err(ldap_error(format!("bad tls_ca_cert {ca_cert}: {err}"))),
+            }
+        }
+        let connector = match builder.build() {
+            Ok(connector) => tokio_native_tls::TlsConnector::from(connector),
+            Err(err) => return Err(ldap_error(format!("TLS setup failed: {err}"))),
+        };
+        match connector.connect(&host, connection.stream).await {
+            Ok(stream) => Ok(LdapConnection {
+                url: server.url.clone(),
+                stream: Box::new(stream),
+                message_id: connection.message_id,
+            }),
+            Err(err) => Err(ldap_error(format!(
+                "TLS handshake with {} failed: {err}",
+                server.url
+            ))),
+        }
+    }
+
+    /// Send a request and read the response with the same message id.
+    async fn request(&mut self, tag: u8, content: &[u8]) -> Result<(u8, Vec<u8>), Error> {
+        let message_id = self.send(tag, content).await?;
+        self.receive(message_id).await
+    }
+
+    async fn send(&mut self, tag: u8, content: &[u8]) -> Result<i64, Error> {
+        self.message_id += 1;
+        let mut message = ber_integer(TAG_INTEGER, self.message_id);
+        message.extend(ber(tag, content));
+        if let Err(err) = self.stream.write_all(&ber(TAG_SEQUENCE, &message)).await {
+            return Err(ldap_error(format!("failed to send a request: {err}")));
+        }
+        if let Err(err) = self.stream.flush().await {
+            return Err(ldap_error(format!("failed to send a request: {err}")));
+        }
+        Ok(self.message_id)
+    }
+
+    /// The protocol operation of the next message, which must answer `message_id`.
+    async fn receive(&mut self, message_id: i64) -> Result<(u8, Vec<u8>), Error> {
+        let read_error =
+            |err: std::io::Error| ldap_error(format!("failed to read a response: {err}"));
+        let tag = self.stream.read_u8().await.map_err(read_error)?;
+        if tag != TAG_SEQUENCE {
+            return Err(ldap_error(format!("unexpected message {tag:#04x}")));
+        }
+        let first = self.stream.read_u8().await.map_err(read_error)?;
+        let len = if first < 0x80 {
+            first as usize
+        } else {
+            let count = (first & 0x7f) as usize;
+            if count == 0 || count > 4 {
+                return Err(ldap_error("bad message length".to_string()));
+            }
+            let mut len = 0usize;
+            for _ in 0..count {
+                len = (len << 8) | self.stream.read_u8().await.map_err(read_error)? as usize;
+            }
+            len
+        };
+        if len > MAX_RESPONSE_SIZE {
+            return Err(ldap_error(format!("response of {len} bytes is too large")));
+        }
+        let mut message = vec![0u8; len];
+        self.stream
+            .read_exact(&mut message)
+            .await
+            .map_err(read_error)?;
+
+        let mut reader = BerReader::new(&message);
+        let id = reader.integer(TAG_INTEGER)?;
+        if id != message_id {
+            return Err(ldap_error(format!(
+                "response to message {id}, expected {message_id}"
+            )));
+        }
+        let (tag, content) = reader.read()?;
+        Ok((tag, content.to_vec()))
+    }
+
+    /// Simple bind, false if the credentials are invalid.
+    async fn bind(&mut self, dn: &str, password: &str) -> Result<bool, Error> {
+        let mut request = ber_integer(TAG_INTEGER, 3);
+        request.extend(ber(TAG_OCTET_STRING, dn.as_bytes()));
+        request.extend(ber(TAG_SIMPLE_AUTHENTICATION, password.as_bytes()));
+        let (tag, content) = self.request(TAG_BIND_REQUEST, &request).await?;
+        if tag != TAG_BIND_RESPONSE {
+            return Err(ldap_error(format!("unexpected bind response {tag:#04x}")));
+        }
+        match parse_result(&content)? {
+            (RESULT_SUCCESS, _) => Ok(true),
+            (RESULT_INVALID_CREDENTIALS, _) => Ok(false),
+            (code, message) => Err(ldap_error(format!(
+                "bind as {dn} failed ({code}): {message}"
+            ))),
+        }
+    }
+
+    /// DNs of the entries under `base_dn` with `attribute` equal to `value`.
+    async fn search(
+        &mut self,
+        base_dn: &str,
+        attribute: &str,
+        value: &str,
+        time_limit: u64,
+    ) -> Result<Vec<String>, Error> {
+        let mut filter = ber(TAG_OCTET_STRING, attribute.as_bytes());
+        filter.extend(ber(TAG_OCTET_STRING, value.as_bytes()));
+
+        let mut request = ber(TAG_OCTET_STRING, base_dn.as_bytes());
+        request.extend(ber_integer(TAG_ENUMERATED, 2)); // wholeSubtree
+        request.extend(ber_integer(TAG_ENUMERATED, 0)); // neverDerefAliases
+        request.extend(ber_integer(TAG_INTEGER, 2)); // two entries are enough to see ambiguity
+        request.extend(ber_integer(TAG_INTEGER, time_limit as i64));
+        request.extend(ber(TAG_BOOLEAN, &[0x00])); // typesOnly
+        request.extend(ber(TAG_EQUALITY_MATCH, &filter));
+        request.extend(ber(TAG_SEQUENCE, &ber(TAG_OCTET_STRING, b"1.1"))); // no attributes
+
+        let message_id = self.send(TAG_SEARCH_REQUEST, &request).await?;
+        let mut dns = Vec::new();
+        loop {
+            let (tag, content) = self.receive(message_id).await?;
+            match tag {
+                TAG_SEARCH_RESULT_ENTRY => {
+                    let dn = BerReader::new(&content).expect(TAG_OCTET_STRING)?;
+                    dns.push(String::from_utf8_lossy(dn).to_string());
+                }
+                TAG_SEARCH_RESULT_DONE => {
+                    return match parse_result(&content)? {
+                        (RESULT_SUCCESS, _) => Ok(dns),
+                        // More than one entry matched.
+                        (RESULT_SIZE_LIMIT_EXCEEDED, _) => Ok(dns),
+                        (code, message) => Err(ldap_error(format!(
+                            "search under {base_dn} failed ({code}): {message}"
+                        ))),
+                    };
+                }
+                // Search result references are not followed.
+                _ => (),
+            }
+        }
+    }
+}
+
+/// Idle connections by server name.
+static LDAP_CONNECTIONS: Lazy<Mutex<HashMap<String, Vec<LdapConnection>>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+async fn take_connection(name: &str, server: &LdapServer) -> Result<LdapConnection, Error> {
+    let idle = LDAP_CONNECTIONS
+        .lock()
+        .get_mut(name)
+        .and_then(|connections| connections.pop());
+    match idle {
+        Some(connection) if connection.url == server.url => Ok(connection),
+        _ => LdapConnection::connect(server).await,
+    }
+}
+
+fn return_connection(name: &str, server: &LdapServer, connection: LdapConnection) {
+    let mut connections = LDAP_CONNECTIONS.lock();
+    let idle = connections.entry(name.to_string()).or_default();
+    if idle.len() < server.pool_size {
+        idle.push(connection);
+    }
+}
+
+/// DN of the user in simple bind mode, None if the user name can't be part of a DN.
+fn simple_bind_dn(server: &LdapServer, username: &str) -> Option<String> {
+    if username.contains(DN_SPECIAL_CHARACTERS) {
+        return None;
+    }
+    Some(format!("{}{}{}", server.prefix, username, server.suffix))
+}
+
+/// Check the password of the user against the directory. Ok(false) if the credentials are wrong.
+async fn check_password(
+    connection: &mut LdapConnection,
+    server: &LdapServer,
+    username: &str,
+    password: &str,
+) -> Result<bool, Error> {
+    let dn = match server.base_dn {
+        Some(ref base_dn) => {
+            let bind_dn = server.bind_dn.as_deref().unwrap_or_default();
+            let bind_password = server.bind_password.as_deref().unwrap_or_default();
+            if !connection.bind(bind_dn, bind_password).await? {
+                return Err(ldap_error(format!(
+                    "invalid credentials of bind_dn {bind_dn:?} for the search"
+                )));
+            }
+            let time_limit = Duration::from_millis(server.timeout).as_secs().max(1);
+            let mut dns = connection
+                .search(base_dn, &server.search_attribute, username, time_limit)
+                .await?;
+            match dns.len() {
+                0 => {
+                    debug!("LDAP: user {username} not found under {base_dn}");
+                    return Ok(false);
+                }
+                1 => dns.remove(0),
+                _ => {
+                    warn!("LDAP: user {username} is not unique under {base_dn}");
+                    return Ok(false);
+                }
+            }
+        }
+        None => match simple_bind_dn(server, username) {
+            Some(dn) => dn,
+            None => return Ok(false),
+        },
+    };
+    connection.bind(&dn, password).await
+}
+
+/// Authenticate a user with the LDAP server `name` of the config.
+pub async fn ldap_auth(name: &str, username: &str, password: &str) -> Result<(), Error> {
+    // An empty password would be an unauthenticated bind, which always succeeds.
+    if password.is_empty() {
+        return Err(Error::AuthError(format!(
+            "Empty password for LDAP user: {username}"
+        )));
+    }
+    let server = match get_config().ldap_servers.get(name) {
+        Some(server) => server.clone(),
+        None => return Err(ldap_error(format!("unknown LDAP server {name}"))),
+    };
+
+    let authentication = async {
+        let mut connection = take_connection(name, &server).await?;
+        let result = check_password(&mut connection, &server, username, password).await;
+        // Connections that failed are dropped.
+        if result.is_ok() {
+            return_connection(name, &server, connection);
+        }
+        result
+    };
+    match tokio::time::timeout(Duration::from_millis(server.timeout), authentication).await {
+        Ok(Ok(true)) => Ok(()),
+        Ok(Ok(false)) => Err(Error::AuthError(format!(
+            "LDAP authentication failed for user: {username}"
+        ))),
+        Ok(Err(err)) => Err(err),
+        Err(_) => Err(ldap_error(format!(
+            "server {name} did not answer in {}ms",
+            server.timeout
+        ))),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_ber_encoding() {
+        assert_eq!(
+            ber(TAG_OCTET_STRING, b"abc"),
+            vec![0x04, 0x03, b'a', b'b', b'c']
+        );
+        let long = ber(TAG_OCTET_STRING, &[0u8; 300]);
+        assert_eq!(&long[..4], &[0x04, 0x82, 0x01, 0x2c]);
+        assert_eq!(long.len(), 304);
+
+        assert_eq!(ber_integer(TAG_INTEGER, 0), vec![0x02, 0x01, 0x00]);
+        assert_eq!(ber_integer(TAG_INTEGER, 3), vec![0x02, 0x01, 0x03]);
+        assert_eq!(ber_integer(TAG_INTEGER, 128), vec![0x02, 0x02, 0x00, 0x80]);
+        assert_eq!(ber_integer(TAG_INTEGER, -1), vec![0x02, 0x01, 0xff]);
+        assert_eq!(ber_integer(TAG_ENUMERATED, 2), vec![0x0a, 0x01, 0x02]);
+    }
+
+    #[test]
+    fn test_ber_decoding() {
+        for value in [0, 3, 127, 128, 65535, -1, -129] {
+            let encoded = ber_integer(TAG_INTEGER, value);
+            assert_eq!(
+                BerReader::new(&encoded).integer(TAG_INTEGER).unwrap(),
+                value
+            );
+        }
+        let long = ber(TAG_OCTET_STRING, &[7u8; 300]);
+        let mut reader = BerReader::new(&long);
+        assert_eq!(reader.expect(TAG_OCTET_STRING).unwrap(), &[7u8; 300][..]);
+        assert!(reader.data.is_empty());
+
+        assert!(BerReader::new(&long[..100]).read().is_err());
+        assert!(BerReader::new(&[0x04]).read().is_err());
+        assert!(BerReader::new(&ber(TAG_INTEGER, &[1]))
+            .expect(TAG_OCTET_STRING)
+            .is_err());
+
+        // BindResponse: invalidCredentials with a diagnostic message.
+        let mut result = ber_integer(TAG_ENUMERATED, 49);
+        result.extend(ber(TAG_OCTET_STRING, b""));
+        result.extend(ber(TAG_OCTET_STRING, b"bad password"));
+        assert_eq!(
+            parse_result(&result).unwrap(),
+            (49, "bad password".to_string())
+        );
+    }
+
+    #[test]
+    fn test_parse_ldap_url() {
+        assert_eq!(
+            parse_ldap_url("ldap://ldap.example.com").unwrap(),
+            (false, "ldap.example.com".to_string(), 389)
+        );
+        assert_eq!(
+            parse_ldap_url("ldaps://ldap.example.com/").unwrap(),
+            (true, "ldap.example.com".to_string(), 636)
+        );
+        assert_eq!(
+            parse_ldap_url("ldap://10.0.0.1:3389").unwrap(),
+            (false, "10.0.0.1".to_string(), 3389)
+        );
+        assert_eq!(
+            parse_ldap_url("ldaps://[::1]:1636").unwrap(),
+            (true, "::1".to_string(), 1636)
+        );
+        assert_eq!(
+            parse_ldap_url("ldap://[::1]").unwrap(),
+            (false, "::1".to_string(), 389)
+        );
+        assert!(parse_ldap_url("http://ldap.example.com").is_err());
+        assert!(parse_ldap_url("ldap://ldap.example.com:port").is_err());
+        assert!(parse_ldap_url("ldap://").is_err());
+    }
+
+    #[test]
+    fn test_simple_bind_dn() {
+        let server = LdapServer {
+            prefix: "uid=".to_string(),
+            suffix: ",ou=people,dc=example,dc=com".to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            simple_bind_dn(&server, "alice").unwrap(),
+            "uid=alice,ou=people,dc=example,dc=com"
+        );
+        assert!(simple_bind_dn(&server, "alice,ou=admins").is_none());
+        assert!(simple_bind_dn(&server, "a=b").is_none());
+    }
+}
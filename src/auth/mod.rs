@@ -1,4 +1,8 @@
+pub mod auth_query;
+pub mod cert;
 pub mod jwt;
+pub mod jwt_issuer;
+pub mod ldap;
 pub mod pam;
 pub mod scram;
 pub mod talos;
@@ -11,33 +15,42 @@ use log::{error, warn};
 use tokio::io::{AsyncReadExt, AsyncWriteExt};
 
 // Internal crate imports
+use crate::auth::auth_query::fetch_auth_query_password;
+use crate::auth::cert::{cert_map_allows, ClientTls};
 use crate::auth::jwt::get_user_name_from_jwt;
+use crate::auth::jwt_issuer::{jwt_issuer_names, validate_jwt_issuers_token};
+use crate::auth::ldap::ldap_auth;
 use crate::auth::pam::pam_auth;
 use crate::auth::scram::{
     parse_client_final_message, parse_client_first_message, parse_server_secret,
     prepare_server_final_message, prepare_server_first_response,
 };
-use crate::config::{get_config, PoolMode};
+use crate::config::{get_config, PoolMode, PARTITION_SEPARATOR};
 use crate::constants::{
     JWT_PUB_KEY_PASSWORD_PREFIX, MD5_PASSWORD_PREFIX, SASL_CONTINUE, SASL_FINAL, SCRAM_SHA_256,
 };
 use crate::errors::{ClientIdentifier, Error};
+use crate::hba::HbaMethod;
 use crate::messages::{
     error_response, error_response_terminal, md5_challenge, md5_hash_password,
     md5_hash_second_pass, plain_password_challenge, read_password, scram_server_response,
     scram_start_challenge, vec_to_string, wrong_password,
 };
-use crate::pool::{get_pool, ConnectionPool};
+use crate::pool::{get_pool, ConnectionPool, PendingPools};
 use crate::server::ServerParameters;
 
-/// Authenticate a user based on the provided parameters
+/// Authenticate a user based on the provided parameters. `pending_pools` are the
+/// pools created for the client, added once the user is authenticated.
 pub async fn authenticate<S, T>(
     read: &mut S,
     write: &mut T,
     admin: bool,
     client_identifier: &ClientIdentifier,
     pool_name: &str,
+    pending_pools: Option<&PendingPools>,
     username_from_parameters: &str,
+    client_tls: Option<&ClientTls>,
+    hba_method: Option<HbaMethod>,
 ) -> Result<(bool, ServerParameters, bool), Error>
 where
     S: AsyncReadExt + Unpin,
@@ -45,7 +58,7 @@ where
 {
     let mut prepared_statements_enabled = false;
 
-    // Authenticate admin user.
+    // Authenticate admin user, always with admin_password whatever the hba_file method.
     let (transaction_mode, server_parameters) = if admin {
         authenticate_admin(read, write, username_from_parameters).await?
     }
@@ -56,8 +69,11 @@ where
             write,
             client_identifier,
             pool_name,
+            pending_pools,
             username_from_parameters,
             &mut prepared_statements_enabled,
+            client_tls,
+            hba_method,
         )
         .await?
     };
@@ -111,8 +127,11 @@ async fn authenticate_normal_user<S, T>(
     write: &mut T,
     client_identifier: &ClientIdentifier,
     pool_name: &str,
+    pending_pools: Option<&PendingPools>,
     username_from_parameters: &str,
     prepared_statements_enabled: &mut bool,
+    client_tls: Option<&ClientTls>,
+    hba_method: Option<HbaMethod>,
 ) -> Result<(bool, ServerParameters), Error>
 where
     S: AsyncReadExt + Unpin,
@@ -123,7 +142,9 @@ where
         pool_name,
         client_identifier.username.as_str(),
         virtual_pool_id,
-    ) {
+    )
+    .or_else(|| pending_pools.and_then(|pools| pools.pool(&client_identifier.username)))
+    {
         Some(pool) => pool,
         None => {
             error_response(
@@ -139,18 +160,105 @@ where
         }
     };
 
-    let pool_password = pool.settings.user.password.clone();
+    let mut pool_password = pool.settings.user.password.clone();
+    let (auth_query_enabled, ldap_server, cert_map) = match get_config().pool_config(pool_name) {
+        Some(pool_config) => (
+            pool_config.auth_user.is_some(),
+            pool_config
+                .auth_ldap_server(&pool.settings.user)
+                .map(|name| name.to_string()),
+            pool_config
+                .auth_cert_map(&pool.settings.user)
+                .map(|name| name.to_string()),
+        ),
+        None => (false, None, None),
+    };
+    if pool_password.is_empty()
+        && auth_query_enabled
+        && ldap_server.is_none()
+        && cert_map.is_none()
+        && !client_identifier.is_talos
+        && hba_method != Some(HbaMethod::Trust)
+    {
+        match fetch_auth_query_password(
+            pool_name,
+            client_identifier.username.as_str(),
+            pending_pools,
+        )
+        .await
+        {
+            Ok(Some(password)) => pool_password = password,
+            Ok(None) => {
+                let error = Error::AuthError(format!(
+                    "No password found by auth_query for user: {username_from_parameters}"
+                ));
+                warn!("{error}");
+                wrong_password(write, username_from_parameters).await?;
+                return Err(error);
+            }
+            Err(err) => {
+                error!("Failed to look up the password of user {username_from_parameters} with auth_query: {err:?}");
+                error_response_terminal(
+                    write,
+                    "Unable to verify the password now. Please try again later or contact your database administrator.",
+                    "08006",
+                )
+                .await?;
+                return Err(err);
+            }
+        }
+    }
+
+    // The method required by hba_file must be the one configured for the user.
+    if let Some(required) = hba_method.filter(|_| !client_identifier.is_talos) {
+        let configured = if cert_map.is_some() {
+            Some(HbaMethod::Cert)
+        } else if pool.settings.user.auth_pam_service.is_some() {
+            Some(HbaMethod::Pam)
+        } else if ldap_server.is_some() {
+            Some(HbaMethod::Ldap)
+        } else if pool_password.starts_with(SCRAM_SHA_256) {
+            Some(HbaMethod::ScramSha256)
+        } else if pool_password.starts_with(MD5_PASSWORD_PREFIX) {
+            Some(HbaMethod::Md5)
+        } else if pool_password.starts_with(JWT_PUB_KEY_PASSWORD_PREFIX)
+            || jwt_issuer_names(&pool_password).is_some()
+        {
+            Some(HbaMethod::Jwt)
+        } else {
+            None
+        };
+        if let Some(configured) = configured.filter(|configured| !required.allows(*configured)) {
+            warn!("hba_file requires {required} for user {username_from_parameters}, configured with {configured}");
+            error_response_terminal(
+                write,
+                &format!("Authentication method {required} required by hba_file is not configured for user {username_from_parameters}."),
+                "28000",
+            )
+            .await?;
+            return Err(Error::HbaForbiddenError(format!(
+                "hba_file requires {required} for user {username_from_parameters}, configured with {configured}"
+            )));
+        }
+    }
 
     if client_identifier.is_talos {
         // pass, client already authenticated.
+    } else if hba_method == Some(HbaMethod::Trust) {
+        // pass, trusted by hba_file.
+    } else if let Some(ref cert_map) = cert_map {
+        authenticate_with_cert(write, cert_map, client_tls, username_from_parameters).await?;
     } else if pool.settings.user.auth_pam_service.is_some() {
         authenticate_with_pam(read, write, &pool, username_from_parameters).await?;
+    } else if let Some(ref ldap_server) = ldap_server {
+        authenticate_with_ldap(read, write, ldap_server, username_from_parameters).await?;
     } else if pool_password.starts_with(SCRAM_SHA_256) {
         authenticate_with_scram(
             read,
             write,
             pool_password.as_str(),
             username_from_parameters,
+            client_tls.and_then(|tls| tls.server_end_point.as_deref()),
         )
         .await?;
     } else if pool_password.starts_with(MD5_PASSWORD_PREFIX) {
@@ -173,8 +281,17 @@ where
             username_from_parameters,
         )
         .await?;
+    } else if let Some(issuer_names) = jwt_issuer_names(&pool_password) {
+        authenticate_with_jwt_issuers(
+            read,
+            write,
+            &issuer_names,
+            username_from_parameters,
+            pool_name,
+        )
+        .await?;
     } else {
-        warn!("Unsupported password type for user {username_from_parameters}: {pool_password}");
+        warn!("Unsupported password type for user {username_from_parameters}");
         error_response_terminal(
             write,
             "Authentication method not supported. Please contact your database administrator.",
@@ -182,7 +299,7 @@ where
         )
         .await?;
         return Err(Error::AuthError(format!(
-            "Unsupported authentication method for user: {username_from_parameters}. Only MD5, SCRAM-SHA-256, JWT, and PAM are supported."
+            "Unsupported authentication method for user: {username_from_parameters}. Only MD5, SCRAM-SHA-256, JWT, PAM, LDAP, and certificates are supported."
         )));
     }
 
@@ -261,12 +378,106 @@ where
     Ok(())
 }
 
-/// Authenticate a user with SCRAM-SHA-256
+/// Authenticate a user by the verified TLS client certificate
+async fn authenticate_with_cert<T>(
+    write: &mut T,
+    cert_map: &str,
+    client_tls: Option<&ClientTls>,
+    username_from_parameters: &str,
+) -> Result<(), Error>
+where
+    T: AsyncWriteExt + Unpin,
+{
+    let certificate_names = match client_tls {
+        Some(tls) if !tls.certificate_names.is_empty() => &tls.certificate_names,
+        _ => {
+            error_response_terminal(
+                write,
+                "Connection requires a valid client certificate.",
+                "28000",
+            )
+            .await?;
+            return Err(Error::AuthError(format!(
+                "No client certificate for user: {username_from_parameters}"
+            )));
+        }
+    };
+    if !cert_map_allows(cert_map, certificate_names, username_from_parameters) {
+        error!(
+            "Client certificate of {certificate_names:?} is not mapped to user {username_from_parameters} by map {cert_map}"
+        );
+        error_response_terminal(
+            write,
+            "Certificate authentication failed. The certificate does not match the user.",
+            "28000",
+        )
+        .await?;
+        return Err(Error::AuthError(format!(
+            "Certificate authentication failed for user: {username_from_parameters} with map: {cert_map}"
+        )));
+    }
+
+    Ok(())
+}
+
+/// Authenticate a user with LDAP
+async fn authenticate_with_ldap<S, T>(
+    read: &mut S,
+    write: &mut T,
+    ldap_server: &str,
+    username_from_parameters: &str,
+) -> Result<(), Error>
+where
+    S: AsyncReadExt + Unpin,
+    T: AsyncWriteExt + Unpin,
+{
+    plain_password_challenge(write).await?;
+    let password_response = read_password(read).await?;
+    let password_response = match vec_to_string(password_response) {
+        Ok(p) => p,
+        Err(err) => {
+            error!("Failed to read LDAP password for user {username_from_parameters}: {err}");
+            error_response_terminal(
+                write,
+                "Invalid password format. Password must be valid UTF-8 text.",
+                "28P01",
+            )
+            .await?;
+            return Err(err);
+        }
+    };
+    if let Err(err) = ldap_auth(
+        ldap_server,
+        username_from_parameters,
+        password_response.as_str(),
+    )
+    .await
+    {
+        error!(
+            "Failed to authenticate user {username_from_parameters} via LDAP server {ldap_server}: {err}"
+        );
+        error_response_terminal(
+            write,
+            "Authentication failed. Please check your username and password.",
+            "28P01",
+        )
+        .await?;
+        return Err(Error::AuthError(format!(
+            "LDAP authentication failed for user: {username_from_parameters} with server: {ldap_server}"
+        )));
+    }
+
+    Ok(())
+}
+
+/// Authenticate a user with SCRAM-SHA-256, or SCRAM-SHA-256-PLUS if the TLS connection
+/// provides the server certificate hash for channel binding.
 async fn authenticate_with_scram<S, T>(
     read: &mut S,
     write: &mut T,
     pool_password: &str,
     username_from_parameters: &str,
+    tls_server_end_point: Option<&[u8]>,
 ) -> Result<(), Error>
 where
     S: AsyncReadExt + Unpin,
@@ -287,7 +498,7 @@ where
         }
     };
     // scram auth.
-    scram_start_challenge(write).await?;
+    scram_start_challenge(write, tls_server_end_point.is_some()).await?;
     let first_message = read_password(read).await?;
     let client_first_message = match parse_client_first_message(String::from_utf8_lossy(
         &first_message,
@@ -305,6 +516,20 @@ where
             )));
         }
     };
+    if let Err(err) = client_first_message.check_channel_binding(tls_server_end_point) {
+        warn!(
+            "SCRAM channel binding negotiation failed for user {username_from_parameters}: {err}"
+        );
+        error_response_terminal(
+            write,
+            "SCRAM channel binding negotiation error. Your client may not support channel binding properly.",
+            "08P01",
+        )
+        .await?;
+        return Err(Error::ScramClientError(format!(
+            "SCRAM channel binding negotiation failed for user: {username_from_parameters}"
+        )));
+    }
     let server_first_response = prepare_server_first_response(
         client_first_message.nonce.as_str(),
         client_first_message.client_first_bare.as_str(),
@@ -343,6 +568,7 @@ where
         server_first_response,
         server_secret.server_key,
         server_secret.stored_key,
+        tls_server_end_point,
     ) {
         Ok(server_final_message) => server_final_message,
         Err(err) => {
@@ -407,6 +633,60 @@ async fn authenticate_with_jwt<S, T>(
     jwt_pub_key: String,
     username_from_parameters: &str,
 ) -> Result<(), Error>
+where
+    S: AsyncReadExt + Unpin,
+    T: AsyncWriteExt + Unpin,
+{
+    let jwt_token = read_jwt_token(read, write, username_from_parameters).await?;
+    let jwt_user_name = get_user_name_from_jwt(jwt_pub_key, jwt_token).await;
+    check_jwt_user_name(write, jwt_user_name, username_from_parameters).await
+}
+
+/// Authenticate a user with JWT issued by one of the configured issuers
+async fn authenticate_with_jwt_issuers<S, T>(
+    read: &mut S,
+    write: &mut T,
+    issuer_names: &[String],
+    username_from_parameters: &str,
+    pool_name: &str,
+) -> Result<(), Error>
+where
+    S: AsyncReadExt + Unpin,
+    T: AsyncWriteExt + Unpin,
+{
+    let jwt_token = read_jwt_token(read, write, username_from_parameters).await?;
+    let database = pool_name
+        .rsplit_once(PARTITION_SEPARATOR)
+        .map_or(pool_name, |(database, _)| database);
+    match validate_jwt_issuers_token(issuer_names, &jwt_token, username_from_parameters, database)
+        .await
+    {
+        Ok(()) => Ok(()),
+        Err(err) => {
+            let reason = match err {
+                Error::JWTValidate(reason) => reason,
+                err => err.to_string(),
+            };
+            error!("JWT token of user {username_from_parameters} rejected: {reason}");
+            error_response_terminal(
+                write,
+                format!("JWT token validation failed: {reason}").as_str(),
+                "28P01",
+            )
+            .await?;
+            Err(Error::JWTValidate(format!(
+                "JWT token validation failed for user {username_from_parameters}: {reason}"
+            )))
+        }
+    }
+}
+
+/// Ask the client for a JWT, sent as a clear text password.
+async fn read_jwt_token<S, T>(
+    read: &mut S,
+    write: &mut T,
+    username_from_parameters: &str,
+) -> Result<String, Error>
 where
     S: AsyncReadExt + Unpin,
     T: AsyncWriteExt + Unpin,
@@ -414,8 +694,8 @@ where
     // jwt.
     plain_password_challenge(write).await?;
     let jwt_token_response = read_password(read).await?;
-    let jwt_token = match vec_to_string(jwt_token_response) {
-        Ok(p) => p,
+    match vec_to_string(jwt_token_response) {
+        Ok(p) => Ok(p),
         Err(err) => {
             error!("Failed to parse JWT token for user {username_from_parameters}: {err}");
             error_response_terminal(
@@ -424,12 +704,23 @@ where
                 "28P01",
             )
             .await?;
-            return Err(Error::JWTValidate(format!(
+            Err(Error::JWTValidate(format!(
                 "Failed to parse JWT token as UTF-8 for user: {username_from_parameters}"
-            )));
+            )))
         }
-    };
-    let jwt_user_name = match get_user_name_from_jwt(jwt_pub_key, jwt_token).await {
+    }
+}
+
+/// Check that the validated token was issued for the user the client connects as.
+async fn check_jwt_user_name<T>(
+    write: &mut T,
+    jwt_user_name: Result<String, Error>,
+    username_from_parameters: &str,
+) -> Result<(), Error>
+where
+    T: AsyncWriteExt + Unpin,
+{
+    let jwt_user_name = match jwt_user_name {
         Ok(u) => u,
         Err(err) => {
             error!("Failed to validate JWT token for user {username_from_parameters}: {err:?}");
@@ -635,9 +926,14 @@ mod tests {
 
             let server_secret = format!("{SCRAM_SHA_256}$4096:salt$storedkey:serverkey");
 
-            let result =
-                authenticate_with_scram(&mut reader, &mut writer, &server_secret, "test_user")
-                    .await;
+            let result = authenticate_with_scram(
+                &mut reader,
+                &mut writer,
+                &server_secret,
+                "test_user",
+                None,
+            )
+            .await;
             assert!(result.is_ok());
         });
     }
@@ -32,10 +32,16 @@ pub struct ClientFinalMessage {
 
 #[derive(Debug)]
 pub struct ClientFirstMessage {
+    /// SCRAM-SHA-256 or SCRAM-SHA-256-PLUS.
+    pub mechanism: String,
     authcid: String,
     authzid: Option<String>,
     pub nonce: String,
     gs2_flag: char,
+    /// Channel binding type requested by the client (gs2 flag 'p').
+    channel_binding: Option<String>,
+    /// gs2-header, repeated by the client in the final message.
+    gs2_header: String,
     pub client_first_bare: String,
 }
 
@@ -60,38 +66,47 @@ macro_rules! parse_part {
 }
 
 pub fn parse_client_first_message(password: Cow<str>) -> Result<ClientFirstMessage, Error> {
-    let data: &str;
-    if let Some(sub_password) = password.get(constants::SCRAM_SHA_256.len() + 4 + 1..password.len())
-    {
-        data = sub_password;
-    } else {
-        return Err(Error::ScramClientError("password length".to_string()));
+    // SASLInitialResponse: mechanism name, length of the client-first-message (i32), message.
+    let (mechanism, data) = match password.split_once('\0') {
+        Some((mechanism, rest)) => match rest.get(4..) {
+            Some(data) => (mechanism, data),
+            None => return Err(Error::ScramClientError("password length".to_string())),
+        },
+        None => return Err(Error::ScramClientError("password length".to_string())),
+    };
+    if mechanism != constants::SCRAM_SHA_256 && mechanism != constants::SCRAM_SHA_256_PLUS {
+        return Err(Error::ScramClientError(format!(
+            "unsupported mechanism {mechanism:?}"
+        )));
     }
 
     let gs2_flag: char;
+    let mut channel_binding = None;
     let mut parts = data.split(',');
 
     // Channel binding
     if let Some(part) = parts.next() {
-        if let Some(cb) = part.chars().next() {
-            if cb == 'p' {
-                /* Client requires channel binding.  We don't support it. */
-                return Err(Error::ScramServerError(
-                    "unsupported channel binding".to_string(),
-                ));
-            }
+        match part.chars().next() {
+            /* p=<type> - Client requires channel binding */
+            Some('p') => match part.strip_prefix("p=") {
+                Some(cb_name) if !cb_name.is_empty() => {
+                    gs2_flag = 'p';
+                    channel_binding = Some(cb_name.to_string());
+                }
+                _ => {
+                    return Err(Error::ScramClientError(
+                        "malformed channel binding".to_string(),
+                    ));
+                }
+            },
             /* n - Client does not support channel binding */
-            /* y - Client supports channel binding, but we're not doing it today */
-            if cb != 'n' && cb != 'y' || part.len() > 1 {
+            /* y - Client supports channel binding, but thinks the server does not */
+            Some(cb @ ('n' | 'y')) if part.len() == 1 => gs2_flag = cb,
+            _ => {
                 return Err(Error::ScramServerError(
                     "unsupported channel binding".to_string(),
                 ));
             }
-            gs2_flag = cb;
-        } else {
-            return Err(Error::ScramServerError(
-                "unsupported channel binding".to_string(),
-            ));
         }
     } else {
         return Err(Error::ScramServerError(
@@ -123,19 +138,24 @@ pub fn parse_client_first_message(password: Cow<str>) -> Result<ClientFirstMessa
         }
     };
 
+    let mut gs2_parts = Vec::new();
     let mut c1b_parts = Vec::new();
     for (i, c1b_part) in data.split(',').enumerate() {
         if i == 0 || i == 1 {
+            gs2_parts.push(c1b_part);
             continue;
         }
         c1b_parts.push(c1b_part);
     }
 
     let mut result = ClientFirstMessage {
+        mechanism: String::from(mechanism),
         authcid: String::from(authcid),
         authzid: None,
         nonce: String::from(nonce),
         gs2_flag,
+        channel_binding,
+        gs2_header: gs2_parts.join(",") + ",",
         client_first_bare: c1b_parts.join(","),
     };
     if authzid.is_some() {
@@ -144,6 +164,39 @@ pub fn parse_client_first_message(password: Cow<str>) -> Result<ClientFirstMessa
     Ok(result)
 }
 
+impl ClientFirstMessage {
+    /// Check the channel binding negotiation. `tls_server_end_point` is known if
+    /// the connection supports channel binding, then SCRAM-SHA-256-PLUS was offered.
+    pub fn check_channel_binding(&self, tls_server_end_point: Option<&[u8]>) -> Result<(), Error> {
+        let plus = self.mechanism == constants::SCRAM_SHA_256_PLUS;
+        match self.gs2_flag {
+            'p' => {
+                if !plus || tls_server_end_point.is_none() {
+                    return Err(Error::ScramClientError(
+                        "channel binding is not supported by this connection".to_string(),
+                    ));
+                }
+                if self.channel_binding.as_deref() != Some(constants::TLS_SERVER_END_POINT) {
+                    return Err(Error::ScramClientError(format!(
+                        "unsupported channel binding type {:?}",
+                        self.channel_binding.as_deref().unwrap_or_default()
+                    )));
+                }
+                Ok(())
+            }
+            _ if plus => Err(Error::ScramClientError(
+                "SCRAM-SHA-256-PLUS requires channel binding".to_string(),
+            )),
+            // The client supports channel binding and thinks we don't, but it was offered:
+            // someone in the middle may have removed SCRAM-SHA-256-PLUS.
+            'y' if tls_server_end_point.is_some() => Err(Error::ScramClientError(
+                "channel binding was offered, but the client didn't use it".to_string(),
+            )),
+            _ => Ok(()),
+        }
+    }
+}
+
 // Parses server secret,
 // example: SCRAM-SHA-256
 //          $4096: // iterations i32
@@ -369,14 +422,22 @@ pub fn prepare_server_final_message(
     server_first: ServerFirstMessage,
     server_secret_server_key: Vec<u8>,
     server_secret_stored_key: Vec<u8>,
+    tls_server_end_point: Option<&[u8]>,
 ) -> Result<String, Error> {
     // checks.
-    let mut gs_2_header = client_first.gs2_flag.to_string() + ",,";
-    if client_first.authzid.is_some() {
-        gs_2_header =
-            client_first.gs2_flag.to_string() + "," + client_first.authzid.unwrap().as_str() + ",";
+    // c = base64(gs2-header [ cbind-data ]), cbind-data is the hash of the server certificate.
+    let mut cbind_input = client_first.gs2_header.as_bytes().to_vec();
+    if client_first.gs2_flag == 'p' {
+        match tls_server_end_point {
+            Some(end_point) => cbind_input.extend_from_slice(end_point),
+            None => {
+                return Err(Error::ScramClientError(
+                    "e=channel-binding-not-supported".to_string(),
+                ))
+            }
+        }
     }
-    if String::from_utf8_lossy(&client_final.channel_binding) != gs_2_header {
+    if client_final.channel_binding != cbind_input {
         return Err(Error::ScramClientError(
             "e=channel-bindings-dont-match".to_string(),
         ));
@@ -441,8 +502,8 @@ impl std::fmt::Display for ClientFirstMessage {
     fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
         write!(
             f,
-            "{{ authzid: {:?}, authcid: {:?}, client_first_bare: {} }}",
-            self.authzid, self.authcid, self.client_first_bare
+            "{{ mechanism: {}, authzid: {:?}, authcid: {:?}, client_first_bare: {} }}",
+            self.mechanism, self.authzid, self.authcid, self.client_first_bare
         )
     }
 }
@@ -495,6 +556,100 @@ mod tests {
         );
     }
 
+    #[test]
+    fn check_channel_binding() {
+        let end_point: &[u8] = b"certificate hash";
+        let first = |message: &str| parse_client_first_message(Cow::from(message)).unwrap();
+
+        let plus = first("SCRAM-SHA-256-PLUS\0\0\0\0 p=tls-server-end-point,,n=,r=abc");
+        assert_eq!("p=tls-server-end-point,,", plus.gs2_header);
+        assert_eq!("n=,r=abc", plus.client_first_bare);
+        assert!(plus.check_channel_binding(Some(end_point)).is_ok());
+        assert!(plus.check_channel_binding(None).is_err());
+
+        let unique = first("SCRAM-SHA-256-PLUS\0\0\0\0 p=tls-unique,,n=,r=abc");
+        assert!(unique.check_channel_binding(Some(end_point)).is_err());
+
+        // -PLUS without channel binding.
+        let plus_without = first("SCRAM-SHA-256-PLUS\0\0\0\0 n,,n=,r=abc");
+        assert!(plus_without.check_channel_binding(Some(end_point)).is_err());
+
+        // The client thinks the server doesn't support channel binding.
+        let downgraded = first("SCRAM-SHA-256\0\0\0\0 y,,n=,r=abc");
+        assert!(downgraded.check_channel_binding(Some(end_point)).is_err());
+        assert!(downgraded.check_channel_binding(None).is_ok());
+
+        let plain = first("SCRAM-SHA-256\0\0\0\0 n,,n=,r=abc");
+        assert!(plain.check_channel_binding(Some(end_point)).is_ok());
+
+        assert!(parse_client_first_message(Cow::from("SCRAM-SHA-1\0\0\0\0 n,,n=,r=abc")).is_err());
+        assert!(
+            parse_client_first_message(Cow::from("SCRAM-SHA-256\0\0\0\0 p,,n=,r=abc")).is_err()
+        );
+    }
+
+    #[test]
+    fn channel_binding_exchange() {
+        let hmac = |key: &[u8], data: &[u8]| {
+            let mut mac = HmacSha::new_from_slice(key).unwrap();
+            mac.update(data);
+            mac.finalize().into_bytes().to_vec()
+        };
+        let salted_password = [7u8; 32];
+        let client_key = hmac(&salted_password, b"Client Key");
+        let stored_key = Sha256::digest(&client_key).to_vec();
+        let server_key = hmac(&salted_password, b"Server Key");
+
+        let exchange = |client_end_point: &[u8], server_end_point: Option<&[u8]>| {
+            let first = parse_client_first_message(Cow::from(
+                "SCRAM-SHA-256-PLUS\0\0\0\0 p=tls-server-end-point,,n=,r=abc",
+            ))
+            .unwrap();
+            let server_first = prepare_server_first_response(
+                &first.nonce,
+                &first.client_first_bare,
+                "c2FsdA==",
+                4096,
+            );
+
+            let mut cbind_input = b"p=tls-server-end-point,,".to_vec();
+            cbind_input.extend_from_slice(client_end_point);
+            let client_final_without_proof = format!(
+                "c={},r={}",
+                general_purpose::STANDARD.encode(cbind_input),
+                server_first.nonce
+            );
+            let auth_msg = format!(
+                "{},{},{}",
+                first.client_first_bare, server_first.server_first_bare, client_final_without_proof
+            );
+            let proof: Vec<u8> = client_key
+                .iter()
+                .zip(hmac(&stored_key, auth_msg.as_bytes()))
+                .map(|(x, y)| x ^ y)
+                .collect();
+            let client_final = parse_client_final_message(Cow::from(format!(
+                "{client_final_without_proof},p={}",
+                general_purpose::STANDARD.encode(proof)
+            )))
+            .unwrap();
+
+            prepare_server_final_message(
+                first,
+                client_final,
+                server_first,
+                server_key.clone(),
+                stored_key.clone(),
+                server_end_point,
+            )
+        };
+
+        assert!(exchange(b"certificate hash", Some(b"certificate hash")).is_ok());
+        // The client sees another certificate, e.g. of a proxy in the middle.
+        assert!(exchange(b"other certificate", Some(b"certificate hash")).is_err());
+        assert!(exchange(b"certificate hash", None).is_err());
+    }
+
     // #[test]
     // fn full_test() {
     //     let server_secrets = parse_server_secret(
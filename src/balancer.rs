@@ -0,0 +1,277 @@
+// Balancing of server connections across the hosts of a database.
+//
+// A database with server_hosts is served by several identical hosts, e.g. read
+// nodes, without an external load balancer: each new server connection of its
+// pools picks one of the hosts with the load_balancing strategy. Connections
+// live on the host they were opened to, so the spread follows the pool churn.
+//
+// A host failing a connect or a health check is left out for failover_cooldown,
+// the next healthy host of the list takes its connections meanwhile.
+
+// Standard library imports
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::{info, warn};
+use parking_lot::Mutex;
+
+// Internal crate imports
+use crate::config::LoadBalancing;
+use crate::stats::hosts::{host_stats, HostStats};
+
+#[derive(Debug)]
+struct BalancedHost {
+    host: String,
+    port: u16,
+    weight: u32,
+    stats: Arc<HostStats>,
+    /// The host failed, no new connections until then.
+    down_until: Mutex<Option<Instant>>,
+}
+
+impl BalancedHost {
+    fn healthy(&self, now: Instant) -> bool {
+        self.down_until.lock().is_none_or(|until| now >= until)
+    }
+}
+
+/// Hosts of a database, shared by the pools of its users and partitions.
+#[derive(Debug)]
+pub struct HostBalancer {
+    hosts: Vec<BalancedHost>,
+    strategy: LoadBalancing,
+    /// How long a failed host is left out.
+    cooldown: Duration,
+    /// Connections opened so far, the turn of round_robin and weighted.
+    next: AtomicUsize,
+}
+
+impl HostBalancer {
+    /// Balancer of the hosts given as (host, port, weight), the first one is the main host.
+    pub fn new(
+        hosts: Vec<(String, u16, u32)>,
+        strategy: LoadBalancing,
+        cooldown: Duration,
+    ) -> HostBalancer {
+        HostBalancer {
+            hosts: hosts
+                .into_iter()
+                .map(|(host, port, weight)| BalancedHost {
+                    stats: host_stats(&host, port),
+                    host,
+                    port,
+                    weight: weight.max(1),
+                    down_until: Mutex::new(None),
+                })
+                .collect(),
+            strategy,
+            cooldown,
+            next: AtomicUsize::new(0),
+        }
+    }
+
+    /// Balancer of a single host.
+    pub fn single(host: String, port: u16) -> HostBalancer {
+        HostBalancer::new(
+            vec![(host, port, 1)],
+            LoadBalancing::RoundRobin,
+            Duration::ZERO,
+        )
+    }
+
+    /// Host and port of the main host.
+    pub fn main_host(&self) -> (&str, u16) {
+        (self.hosts[0].host.as_str(), self.hosts[0].port)
+    }
+
+    /// Host and port of the hosts, the main host first.
+    pub fn hosts(&self) -> impl Iterator<Item = (&str, u16)> {
+        self.hosts
+            .iter()
+            .map(|host| (host.host.as_str(), host.port))
+    }
+
+    /// Host and port for a new server connection, among the healthy hosts.
+    /// While none is healthy all of them are tried.
+    pub fn next_host(&self) -> (&str, u16) {
+        if self.hosts.len() == 1 {
+            return self.main_host();
+        }
+        let now = Instant::now();
+        let mut hosts: Vec<&BalancedHost> =
+            self.hosts.iter().filter(|host| host.healthy(now)).collect();
+        if hosts.is_empty() {
+            hosts = self.hosts.iter().collect();
+        }
+        let count = hosts.len();
+        let turn = self.next.fetch_add(1, Ordering::Relaxed);
+        let host = match self.strategy {
+            LoadBalancing::RoundRobin => hosts[turn % count],
+            // Ties are broken by the turn, so the hosts take turns while they're even.
+            LoadBalancing::LeastConnections => (0..count)
+                .map(|offset| hosts[(turn + offset) % count])
+                .min_by_key(|host| host.stats.connections())
+                .unwrap(),
+            LoadBalancing::Weighted => {
+                let total: usize = hosts.iter().map(|host| host.weight as usize).sum();
+                let mut slot = turn % total;
+                hosts
+                    .iter()
+                    .copied()
+                    .find(|host| {
+                        if slot < host.weight as usize {
+                            return true;
+                        }
+                        slot -= host.weight as usize;
+                        false
+                    })
+                    .unwrap()
+            }
+            LoadBalancing::Failover => hosts[0],
+        };
+        (host.host.as_str(), host.port)
+    }
+
+    fn find(&self, host: &str, port: u16) -> Option<&BalancedHost> {
+        self.hosts
+            .iter()
+            .find(|balanced| balanced.host == host && balanced.port == port)
+    }
+
+    /// The host failed a connect or a health check: leave it out for the cooldown.
+    pub fn mark_down(&self, host: &str, port: u16) {
+        if self.hosts.len() == 1 {
+            return;
+        }
+        if let Some(balanced) = self.find(host, port) {
+            let mut down_until = balanced.down_until.lock();
+            if down_until.is_none() {
+                warn!(
+                    "Host {host}:{port} failed, no new server connections for {}ms",
+                    self.cooldown.as_millis()
+                );
+            }
+            *down_until = Some(Instant::now() + self.cooldown);
+        }
+    }
+
+    /// The host passed a health check.
+    pub fn mark_up(&self, host: &str, port: u16) {
+        if let Some(balanced) = self.find(host, port) {
+            if balanced.down_until.lock().take().is_some() {
+                info!("Host {host}:{port} is healthy again");
+            }
+        }
+    }
+
+    /// Hosts to health check: the ones not waiting for the end of their cooldown.
+    pub fn hosts_to_check(&self) -> Vec<(String, u16)> {
+        let now = Instant::now();
+        self.hosts
+            .iter()
+            .filter(|host| host.healthy(now))
+            .map(|host| (host.host.clone(), host.port))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const COOLDOWN: Duration = Duration::from_secs(60);
+
+    fn hosts(weights: &[u32]) -> Vec<(String, u16, u32)> {
+        weights
+            .iter()
+            .enumerate()
+            .map(|(index, weight)| (format!("balancer-test-{index}"), 5432, *weight))
+            .collect()
+    }
+
+    fn picks(balancer: &HostBalancer, count: usize) -> Vec<String> {
+        (0..count)
+            .map(|_| balancer.next_host().0.to_string())
+            .collect()
+    }
+
+    #[test]
+    fn test_round_robin() {
+        let balancer = HostBalancer::new(hosts(&[1, 1, 1]), LoadBalancing::RoundRobin, COOLDOWN);
+        assert_eq!(
+            picks(&balancer, 4),
+            [
+                "balancer-test-0",
+                "balancer-test-1",
+                "balancer-test-2",
+                "balancer-test-0"
+            ]
+        );
+        assert_eq!(balancer.hosts().count(), 3);
+    }
+
+    #[test]
+    fn test_weighted() {
+        let balancer = HostBalancer::new(hosts(&[3, 1]), LoadBalancing::Weighted, COOLDOWN);
+        let picks = picks(&balancer, 8);
+        let first = picks
+            .iter()
+            .filter(|host| *host == "balancer-test-0")
+            .count();
+        assert_eq!(first, 6);
+    }
+
+    #[test]
+    fn test_least_connections() {
+        let mut hosts = hosts(&[1, 1]);
+        for host in hosts.iter_mut() {
+            host.0 = host.0.replace("test", "least-test");
+        }
+        let balancer = HostBalancer::new(hosts, LoadBalancing::LeastConnections, COOLDOWN);
+        let busy = host_stats("balancer-least-test-0", 5432);
+        busy.opened();
+        busy.opened();
+        assert_eq!(picks(&balancer, 2), ["balancer-least-test-1"; 2]);
+        busy.closed();
+        busy.closed();
+    }
+
+    #[test]
+    fn test_failover() {
+        let balancer = HostBalancer::new(hosts(&[1, 1, 1]), LoadBalancing::Failover, COOLDOWN);
+        assert_eq!(picks(&balancer, 2), ["balancer-test-0"; 2]);
+
+        balancer.mark_down("balancer-test-0", 5432);
+        assert_eq!(picks(&balancer, 2), ["balancer-test-1"; 2]);
+        assert_eq!(balancer.hosts_to_check().len(), 2);
+
+        // Nothing healthy left: all hosts are tried.
+        balancer.mark_down("balancer-test-1", 5432);
+        balancer.mark_down("balancer-test-2", 5432);
+        assert_eq!(picks(&balancer, 1), ["balancer-test-0"]);
+
+        balancer.mark_up("balancer-test-1", 5432);
+        assert_eq!(picks(&balancer, 1), ["balancer-test-1"]);
+
+        // Round robin skips the failed hosts too.
+        let balancer = HostBalancer::new(hosts(&[1, 1, 1]), LoadBalancing::RoundRobin, COOLDOWN);
+        balancer.mark_down("balancer-test-1", 5432);
+        assert_eq!(
+            picks(&balancer, 4),
+            [
+                "balancer-test-0",
+                "balancer-test-2",
+                "balancer-test-0",
+                "balancer-test-2"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_single() {
+        let balancer = HostBalancer::single("/var/run/postgresql".to_string(), 5432);
+        assert_eq!(balancer.next_host(), ("/var/run/postgresql", 5432));
+    }
+}
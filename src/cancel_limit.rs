@@ -0,0 +1,78 @@
+// Limits on the handling of cancel requests.
+//
+// Every cancel request arrives on its own client connection and opens another
+// connection to the server. A crashing client fleet can send thousands of them at
+// once: they are capped by max_cancel_connections (extra ones are dropped without
+// contacting the server), bounded by cancel_timeout, and don't count against
+// max_connections, so regular clients are still accepted during the flood.
+
+// Standard library imports
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+/// Cancel requests being handled right now.
+pub static CANCEL_HANDLERS_COUNT: AtomicUsize = AtomicUsize::new(0);
+
+/// Cancel requests dropped because max_cancel_connections were already being handled.
+pub static CANCEL_SHED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Cancel requests that didn't reach the server within cancel_timeout.
+pub static CANCEL_TIMEOUT_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// A slot for handling one cancel request, freed on drop.
+#[derive(Debug)]
+pub struct CancelPermit {
+    _private: (),
+}
+
+impl Drop for CancelPermit {
+    fn drop(&mut self) {
+        CANCEL_HANDLERS_COUNT.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Take a slot if fewer than `max` (0 means unlimited) cancel requests are being handled,
+/// otherwise count the request as shed.
+pub fn try_acquire_cancel_permit(max: usize) -> Option<CancelPermit> {
+    let acquired =
+        CANCEL_HANDLERS_COUNT.fetch_update(Ordering::Relaxed, Ordering::Relaxed, |count| {
+            (max == 0 || count < max).then_some(count + 1)
+        });
+    match acquired {
+        Ok(_) => Some(CancelPermit { _private: () }),
+        Err(_) => {
+            CANCEL_SHED_COUNTER.fetch_add(1, Ordering::Relaxed);
+            None
+        }
+    }
+}
+
+/// Cancel requests in flight, to be left out of the max_connections check.
+pub fn cancel_handlers_count() -> usize {
+    CANCEL_HANDLERS_COUNT.load(Ordering::Relaxed)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cancel_permits() {
+        let before = cancel_handlers_count();
+        let shed = CANCEL_SHED_COUNTER.load(Ordering::Relaxed);
+
+        let first = try_acquire_cancel_permit(before + 2).unwrap();
+        let second = try_acquire_cancel_permit(before + 2).unwrap();
+        assert!(try_acquire_cancel_permit(before + 2).is_none());
+        assert_eq!(CANCEL_SHED_COUNTER.load(Ordering::Relaxed), shed + 1);
+
+        drop(first);
+        let third = try_acquire_cancel_permit(before + 2).unwrap();
+        drop(second);
+        drop(third);
+        assert_eq!(cancel_handlers_count(), before);
+
+        // Unlimited.
+        let unlimited = try_acquire_cancel_permit(0).unwrap();
+        drop(unlimited);
+    }
+}
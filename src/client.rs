@@ -1,39 +1,78 @@
 use crate::errors::{ClientIdentifier, Error};
 /// Handle clients by pretending to be a PostgreSQL server.
 use bytes::{Buf, BufMut, BytesMut};
+use deadpool::managed::{PoolError, TimeoutType};
 use log::{debug, error, info, warn};
 use once_cell::sync::Lazy;
-use std::collections::{HashMap, VecDeque};
+use std::collections::{BTreeMap, HashMap, VecDeque};
 use std::ffi::CStr;
 use std::ops::DerefMut;
 use std::str;
 use std::sync::atomic::Ordering;
 use std::sync::{atomic::AtomicUsize, Arc};
 use std::time::{Duration, Instant};
-use tokio::io::{split, AsyncReadExt, BufReader, ReadHalf, WriteHalf};
+use tokio::io::{split, AsyncBufReadExt, AsyncReadExt, BufReader, ReadHalf, WriteHalf};
 use tokio::net::TcpStream;
 use tokio::sync::broadcast::Receiver;
 use tokio::sync::mpsc::Sender;
 
+use crate::address_family;
 use crate::admin::handle_admin;
+use crate::admission::{overload_percent, wait_for_admission};
+use crate::analyze::{analyze_enabled, observe_idle_in_transaction, observe_statement};
+use crate::audit::{audit, rows_affected, AuditRecord};
 use crate::auth::authenticate;
+use crate::auth::cert::{certificate_names, ClientTls};
 use crate::auth::talos::{extract_talos_token, talos_role_to_string};
-use crate::config::{addr_in_hba, get_config};
+use crate::cancel_limit::{try_acquire_cancel_permit, CANCEL_TIMEOUT_COUNTER};
+use crate::config::{
+    addr_in_hba, get_config, partition_pool_name, replica_pool_name, ListenerOptions,
+    PARTITION_SEPARATOR,
+};
 use crate::constants::*;
+use crate::db_client_limit::{try_acquire_db_client_permit, DbClientPermit};
+use crate::events::{emit_event, Event};
+use crate::hba::check_hba;
+use crate::log_rules::{set_log_context, LogContext};
+use crate::login_limit::{auth_failure_delay, record_auth_failure, reset_auth_failures};
+use crate::messages::fingerprint::statement_text;
 use crate::messages::*;
-use crate::pool::{get_pool, ClientServerMap, ConnectionPool, CANCELED_PIDS};
+use crate::mirror::Mirror;
+use crate::peering::{cancel_peer, new_process_id, CANCEL_FORWARDED_COUNTER};
+use crate::pool::{
+    get_pool, is_paused, passthrough_enabled, take_injected_error, wait_while_paused,
+    ClientServerMap, ConnectionPool, CANCELED_PIDS,
+};
+use crate::profiler::{record, sample, ProfiledStream, Section};
+use crate::query_routes::{has_query_routes, query_route_pool};
 use crate::rate_limit::RateLimiter;
-use crate::server::{Server, ServerParameters};
+use crate::replica_status::{current_lsn, replica_usable};
+use crate::replication::{replication_requested, try_acquire_replication_permit};
+use crate::result_cache::{
+    cached_result, has_result_cache, result_cache_key, session_key, store_result, ResultCacheKey,
+    RESULT_SERVER_PARAMETERS,
+};
+use crate::server::{ParameterStatusOverrides, Server, ServerParameters};
+use crate::slow_query::log_slow_query;
+use crate::startup_pacing::acquire_startup_slot;
+use crate::statement_allowlist::check_statement;
+use crate::stats::prepared_transactions::track_two_phase_command;
 use crate::stats::{
     ClientStats, ServerStats, CANCEL_CONNECTION_COUNTER, PLAIN_CONNECTION_COUNTER,
     TLS_CONNECTION_COUNTER,
 };
+use crate::tls::sni_database;
+use crate::transaction_limit::TransactionLimit;
 
 /// Incrementally count prepared statements
 /// to avoid random conflicts in places where the random number generator is weak.
 pub static PREPARED_STATEMENT_COUNTER: Lazy<Arc<AtomicUsize>> =
     Lazy::new(|| Arc::new(AtomicUsize::new(0)));
 pub static CLIENT_COUNTER: Lazy<Arc<AtomicUsize>> = Lazy::new(|| Arc::new(AtomicUsize::new(0)));
+/// Extended protocol batches aborted by sync_response_timeout, batch_timeout and batch_message_timeout.
+pub static SYNC_RESPONSE_TIMEOUT_COUNTER: AtomicUsize = AtomicUsize::new(0);
+pub static BATCH_TIMEOUT_COUNTER: AtomicUsize = AtomicUsize::new(0);
+pub static BATCH_MESSAGE_TIMEOUT_COUNTER: AtomicUsize = AtomicUsize::new(0);
 // Ignore deallocate queries from pgx.
 static QUERY_DEALLOCATE: &[u8] = "deallocate ".as_bytes();
 
@@ -123,23 +162,108 @@ pub struct Client<S, T> {
 
     created_at: Instant,
     virtual_pool_count: u16,
+
+    /// Track session-level advisory locks taken by the client, so they are released at checkin.
+    release_advisory_locks: bool,
+
+    /// Keep track of the prepared transactions (two-phase commit) created by the client.
+    track_prepared_transactions: bool,
+
+    /// Session parameters of the client set on every server it gets: the allowed
+    /// startup parameters, and what it SETs when the pool has track_session_parameters.
+    session_parameters: BTreeMap<String, String>,
+    track_session_parameters: bool,
+
+    /// Write the statements of the client to the audit log.
+    audit: bool,
+
+    /// Statement texts of the prepared statements of the client by name, and the
+    /// statements sent since the last Sync with the hash of their parameters.
+    audit_statements: HashMap<String, String>,
+    audit_pending: Vec<(String, Option<String>)>,
+
+    /// Reject SET ROLE and SET SESSION AUTHORIZATION in transaction mode.
+    reject_role_changes: bool,
+
+    /// client_encoding of the pool, the session can't be switched to another encoding.
+    client_encoding: Option<String>,
+
+    /// The client changed the role before getting a server, it's reset at checkin.
+    role_change_pending: bool,
+
+    /// The client came through a read_only listener: its transactions are read-only.
+    read_only: bool,
+
+    /// Two-phase commit command sent to the server and waiting for its result.
+    pending_two_phase: Option<TwoPhaseCommand>,
+
+    /// Notify the client once it waits for a server longer than this (ms), 0 disables.
+    queue_notice_threshold: u64,
+
+    /// Queries running longer than this are logged (0 disables), at most
+    /// slow_query_log_rate per second.
+    slow_query_threshold: Duration,
+    slow_query_log_rate: u32,
+
+    /// Send a no-op message to the client when it is idle this long (ms), 0 disables.
+    client_keepalive_interval: u64,
+
+    /// Extended protocol batch timeouts (ms), 0 disables.
+    sync_response_timeout: u64,
+    batch_timeout: u64,
+    batch_message_timeout: u64,
+
+    /// First message of the extended protocol batch not finished by Sync yet.
+    batch_started_at: Option<Instant>,
+
+    /// Session mode with the messages relayed as they are, for debugging.
+    passthrough: bool,
+
+    /// Logical replication connection, relayed to a server connection of its own.
+    replication: bool,
+
+    /// The client counts against max_db_client_connections of its database while it lives.
+    _db_client_permit: Option<DbClientPermit>,
+
+    /// Pools of the replicas the read-only transactions are sent to, in transaction mode.
+    replica_pools: Vec<String>,
+
+    /// Read-only transactions only go to the replicas that replayed the last write of the client.
+    read_your_writes: bool,
+
+    /// Replicas lagging more than this (ms) get no read-only transactions, 0 for any lag.
+    max_replica_lag: u64,
+
+    /// WAL position of the primary after the last transaction of the client on it, with read_your_writes.
+    written_lsn: Option<u64>,
+
+    /// Pools of the partitions of the database by partition name, for the
+    /// transactions with a `shard=` hint, in transaction mode.
+    partition_pools: HashMap<String, String>,
+
+    /// Database whose query_routes decide the pool of the transactions, in transaction mode.
+    query_routes_database: Option<String>,
+
+    /// Replays the requests of the client on the mirror_host of the database.
+    mirror: Option<Mirror>,
+
+    /// Database whose result cache serves the read-only statements, in transaction mode.
+    result_cache_database: Option<String>,
+
+    /// Statement of the request whose result is captured for the cache.
+    result_cache_key: Option<ResultCacheKey>,
+
+    /// Responses to the request captured for the cache.
+    result_cache_response: BytesMut,
 }
 
 pub async fn client_entrypoint_too_many_clients_already(
     mut stream: TcpStream,
+    addr: std::net::SocketAddr,
     client_server_map: ClientServerMap,
     shutdown: Receiver<()>,
     drain: Sender<i32>,
 ) -> Result<(), Error> {
-    let addr = match stream.peer_addr() {
-        Ok(addr) => addr,
-        Err(err) => {
-            return Err(Error::SocketError(format!(
-                "Failed to get peer address: {err:?}"
-            )));
-        }
-    };
-
     match get_startup::<TcpStream>(&mut stream).await {
         Ok((ClientConnectionType::Tls, _)) => {
             let mut no = BytesMut::new();
@@ -184,10 +308,12 @@ pub async fn client_entrypoint_too_many_clients_already(
 #[allow(clippy::too_many_arguments)]
 pub async fn client_entrypoint(
     mut stream: TcpStream,
+    addr: std::net::SocketAddr,
     client_server_map: ClientServerMap,
     shutdown: Receiver<()>,
     drain: Sender<i32>,
     admin_only: bool,
+    listener: ListenerOptions,
     tls_acceptor: Option<tokio_native_tls::TlsAcceptor>,
     tls_rate_limiter: Option<RateLimiter>,
 ) -> Result<(), Error> {
@@ -196,15 +322,6 @@ pub async fn client_entrypoint(
     let tls_mode = config.general.tls_mode.clone();
 
     // Figure out if the client wants TLS or not.
-    let addr = match stream.peer_addr() {
-        Ok(addr) => addr,
-        Err(err) => {
-            return Err(Error::SocketError(format!(
-                "Failed to get peer address: {err:?}"
-            )));
-        }
-    };
-
     match get_startup::<TcpStream>(&mut stream).await {
         // Client requested a TLS connection.
         Ok((ClientConnectionType::Tls, _)) => {
@@ -222,16 +339,18 @@ pub async fn client_entrypoint(
                 // Negotiate TLS.
                 match startup_tls(
                     stream,
+                    addr,
                     client_server_map,
                     shutdown,
                     admin_only,
+                    listener,
                     tls_acceptor.unwrap(),
                 )
                 .await
                 {
                     Ok(mut client) => {
                         if log_client_connections {
-                            info!("Client {addr:?} connected (TLS)");
+                            info!("Client {addr:?} connected (TLS, {})", address_family(&addr));
                         }
 
                         if !client.is_admin() {
@@ -277,13 +396,18 @@ pub async fn client_entrypoint(
                             client_server_map,
                             shutdown,
                             admin_only,
+                            listener,
                             false,
+                            None,
                         )
                         .await
                         {
                             Ok(mut client) => {
                                 if log_client_connections {
-                                    info!("Client {addr:?} connected (plain)");
+                                    info!(
+                                        "Client {addr:?} connected (plain, {})",
+                                        address_family(&addr)
+                                    );
                                 }
                                 if !client.is_admin() {
                                     let _ = drain.send(1).await;
@@ -318,6 +442,15 @@ pub async fn client_entrypoint(
 
         // Client wants to use plain connection without encryption.
         Ok((ClientConnectionType::Startup, bytes)) => {
+            if listener.tls_required {
+                error_response_terminal(
+                    &mut stream,
+                    "Connection without SSL is not allowed on this address.",
+                    "28000",
+                )
+                .await?;
+                return Err(Error::ProtocolSyncError("ssl is required".to_string()));
+            }
             if tls_mode.is_some() && config.general.only_ssl_connections() {
                 error_response_terminal(
                     &mut stream,
@@ -339,13 +472,18 @@ pub async fn client_entrypoint(
                 client_server_map,
                 shutdown,
                 admin_only,
+                listener,
                 false,
+                None,
             )
             .await
             {
                 Ok(mut client) => {
                     if log_client_connections {
-                        info!("Client {addr:?} connected (plain)");
+                        info!(
+                            "Client {addr:?} connected (plain, {})",
+                            address_family(&addr)
+                        );
                     }
                     if !client.is_admin() {
                         let _ = drain.send(1).await;
@@ -407,72 +545,71 @@ async fn get_startup<S>(stream: &mut S) -> Result<(ClientConnectionType, BytesMu
 where
     S: tokio::io::AsyncRead + std::marker::Unpin + tokio::io::AsyncWrite,
 {
-    // Get startup message length.
-    let len = match stream.read_i32().await {
-        Ok(len) => len,
-        Err(_) => return Err(Error::ClientBadStartup),
-    };
+    let mut gssenc_declined = false;
+    loop {
+        // Get startup message length.
+        let len = match stream.read_i32().await {
+            Ok(len) => len,
+            Err(_) => return Err(Error::ClientBadStartup),
+        };
 
-    // Get the rest of the message.
-    let mut startup = vec![0u8; len as usize - 4];
-    match stream.read_exact(&mut startup).await {
-        Ok(_) => (),
-        Err(_) => return Err(Error::ClientBadStartup),
-    };
+        // Get the rest of the message.
+        let mut startup = vec![0u8; len as usize - 4];
+        match stream.read_exact(&mut startup).await {
+            Ok(_) => (),
+            Err(_) => return Err(Error::ClientBadStartup),
+        };
 
-    let mut bytes = BytesMut::from(&startup[..]);
-    let code = bytes.get_i32();
+        let mut bytes = BytesMut::from(&startup[..]);
+        let code = bytes.get_i32();
 
-    match code {
-        // Client is requesting SSL (TLS).
-        SSL_REQUEST_CODE => Ok((ClientConnectionType::Tls, bytes)),
+        return match code {
+            // Client is requesting SSL (TLS).
+            SSL_REQUEST_CODE => Ok((ClientConnectionType::Tls, bytes)),
 
-        // Client wants to use plain text, requesting regular startup.
-        PROTOCOL_VERSION_NUMBER => Ok((ClientConnectionType::Startup, bytes)),
+            // Client wants to use plain text, requesting regular startup.
+            PROTOCOL_VERSION_NUMBER => Ok((ClientConnectionType::Startup, bytes)),
 
-        // Client is requesting to cancel a running query (plain text connection).
-        CANCEL_REQUEST_CODE => Ok((ClientConnectionType::CancelQuery, bytes)),
+            // Client is requesting to cancel a running query (plain text connection).
+            CANCEL_REQUEST_CODE => Ok((ClientConnectionType::CancelQuery, bytes)),
 
-        REQUEST_GSSENCMODE_CODE => {
-            // Rejecting client request for GSSENCMODE.
-            let mut no = BytesMut::new();
-            no.put_u8(b'G');
-            write_all_flush(stream, &no).await?;
-            Err(Error::AuthError("GSSENCMODE is unsupported".to_string()))
-        }
+            // Client is requesting GSSAPI encryption (gssencmode=prefer is the libpq default
+            // with Kerberos credentials). It's not supported: like PostgreSQL without GSSAPI
+            // we answer 'N' and the client goes on with SSLRequest or the startup message.
+            REQUEST_GSSENCMODE_CODE if !gssenc_declined => {
+                let mut no = BytesMut::new();
+                no.put_u8(b'N');
+                write_all_flush(stream, &no).await?;
+                gssenc_declined = true;
+                continue;
+            }
 
-        // Something else, probably something is wrong, and it's not our fault,
-        // e.g. badly implemented Postgres client.
-        _ => Err(Error::ProtocolSyncError(format!(
-            "Unexpected startup code: {code}"
-        ))),
+            // Something else, probably something is wrong, and it's not our fault,
+            // e.g. badly implemented Postgres client.
+            _ => Err(Error::ProtocolSyncError(format!(
+                "Unexpected startup code: {code}"
+            ))),
+        };
     }
 }
 
 /// Handle TLS connection negotiation.
 pub async fn startup_tls(
     stream: TcpStream,
+    addr: std::net::SocketAddr,
     client_server_map: ClientServerMap,
     shutdown: Receiver<()>,
     admin_only: bool,
+    listener: ListenerOptions,
     tls_acceptor: tokio_native_tls::TlsAcceptor,
 ) -> Result<
     Client<
-        ReadHalf<tokio_native_tls::TlsStream<TcpStream>>,
-        WriteHalf<tokio_native_tls::TlsStream<TcpStream>>,
+        ReadHalf<ProfiledStream<tokio_native_tls::TlsStream<TcpStream>>>,
+        WriteHalf<ProfiledStream<tokio_native_tls::TlsStream<TcpStream>>>,
     >,
     Error,
 > {
     // Negotiate TLS.
-    let addr = match stream.peer_addr() {
-        Ok(addr) => addr,
-        Err(err) => {
-            return Err(Error::SocketError(format!(
-                "Failed to get peer address: {err:?}"
-            )));
-        }
-    };
-
     let mut stream = match tls_acceptor.accept(stream).await {
         Ok(stream) => stream,
 
@@ -483,13 +620,50 @@ pub async fn startup_tls(
         }
     };
 
+    // Hash of our certificate for SCRAM channel binding.
+    let server_end_point = match stream.get_ref().tls_server_end_point() {
+        Ok(end_point) => end_point,
+        Err(err) => {
+            warn!("Failed to get the certificate hash for channel binding: {err}");
+            None
+        }
+    };
+    // Names of the client certificate (verified with tls_mode verify-full) for certificate authentication.
+    let certificate_names = match stream.get_ref().peer_certificate() {
+        Ok(Some(certificate)) => match certificate.to_der() {
+            Ok(der) => certificate_names(&der).unwrap_or_else(|err| {
+                warn!("{err}");
+                Vec::new()
+            }),
+            Err(err) => {
+                warn!("Failed to read the client certificate: {err}");
+                Vec::new()
+            }
+        },
+        Ok(None) => Vec::new(),
+        Err(err) => {
+            warn!("Failed to get the client certificate: {err}");
+            Vec::new()
+        }
+    };
+    // Server name the client sent, for the tls_sni routes.
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    let server_name = stream.get_ref().server_name();
+    #[cfg(any(target_os = "macos", target_os = "windows", target_os = "ios"))]
+    let server_name = None;
+    let client_tls = ClientTls {
+        server_end_point,
+        certificate_names,
+        server_name,
+    };
+
     // TLS negotiation successful.
     // Continue with regular startup using encrypted connection.
     match get_startup::<tokio_native_tls::TlsStream<TcpStream>>(&mut stream).await {
         // Got good startup message, proceeding like normal except we
         // are encrypted now.
         Ok((ClientConnectionType::Startup, bytes)) => {
-            let (read, write) = split(stream);
+            let (read, write) = split(ProfiledStream::new(stream));
 
             Client::startup(
                 read,
@@ -499,14 +673,16 @@ pub async fn startup_tls(
                 client_server_map,
                 shutdown,
                 admin_only,
+                listener,
                 true,
+                Some(client_tls),
             )
             .await
         }
 
         Ok((ClientConnectionType::CancelQuery, bytes)) => {
             CANCEL_CONNECTION_COUNTER.fetch_add(1, Ordering::Relaxed);
-            let (read, write) = split(stream);
+            let (read, write) = split(ProfiledStream::new(stream));
             Client::cancel(read, write, addr, bytes, client_server_map, shutdown).await
         }
 
@@ -539,10 +715,36 @@ where
         client_server_map: ClientServerMap,
         shutdown: Receiver<()>,
         admin_only: bool,
+        listener: ListenerOptions,
         use_tls: bool,
+        client_tls: Option<ClientTls>,
     ) -> Result<Client<S, T>, Error> {
         let parameters = parse_startup(bytes.clone())?;
 
+        // Reconnect storms: identical startups from the address wait for their turn.
+        let general = get_config().general;
+        let _startup_slot = acquire_startup_slot(
+            addr.ip(),
+            &bytes,
+            general.startup_burst_limit,
+            Duration::from_millis(general.startup_pacing_jitter),
+        )
+        .await;
+
+        // Repeated auth failures of the address slow its next logins down.
+        let delay = auth_failure_delay(
+            addr.ip(),
+            general.auth_failure_delay,
+            general.auth_failure_max_delay,
+        );
+        if !delay.is_zero() {
+            debug!(
+                "Client {addr}: login delayed {}ms after auth failures",
+                delay.as_millis()
+            );
+            tokio::time::sleep(delay).await;
+        }
+
         // This parameter is mandatory by the protocol.
         let username_from_parameters = match parameters.get("user") {
             Some(user) => user,
@@ -553,10 +755,27 @@ where
             }
         };
 
-        let pool_name = parameters
+        let requested_database = parameters
             .get("database")
             .unwrap_or(username_from_parameters);
 
+        // Clients sending a server name of tls_sni go to its database.
+        let pool_name = match client_tls
+            .as_ref()
+            .and_then(|tls| tls.server_name.as_ref())
+            .and_then(|server_name| sni_database(&general, server_name))
+        {
+            Some(database) => {
+                if database != requested_database {
+                    debug!(
+                        "Client {addr}: database {requested_database} replaced with {database} of its TLS server name"
+                    );
+                }
+                database
+            }
+            None => requested_database,
+        };
+
         let application_name = match parameters.get("application_name") {
             Some(application_name) => application_name,
             None => "pg_doorman",
@@ -627,6 +846,18 @@ where
             return Err(Error::ShuttingDown);
         }
 
+        if !admin && listener.admin_only {
+            error_response_terminal(
+                &mut write,
+                "Only the admin console is served on this address.",
+                "28000",
+            )
+            .await?;
+            return Err(Error::ClientError(format!(
+                "Client {client_identifier} connected to an admin only listener"
+            )));
+        }
+
         if !addr_in_hba(addr.ip()) {
             error_response_terminal(
                 &mut write,
@@ -635,14 +866,111 @@ where
             )
                 .await?;
             return Err(Error::HbaForbiddenError(format!(
-                "Connection rejected by HBA configuration for client: {} from address: {:?}",
+                "Connection rejected by HBA configuration for client: {} from address: {:?} ({})",
                 client_identifier,
-                addr.ip()
+                addr.ip(),
+                address_family(&addr)
             )));
         }
 
+        // Access rules of hba_file, the admin console is subject to them too.
+        let hba_method = match check_hba(addr.ip(), use_tls, pool_name, &client_identifier.username)
+        {
+            Ok(method) => method,
+            Err(reason) => {
+                error_response_terminal(
+                    &mut write,
+                    format!("Connection rejected: {reason}").as_str(),
+                    "28000",
+                )
+                .await?;
+                return Err(Error::HbaForbiddenError(format!(
+                    "Client {client_identifier} ({}): {reason}",
+                    address_family(&addr)
+                )));
+            }
+        };
+
+        // Clients of a pool with a fixed client_encoding can't request another one.
+        let mut client_encoding_override = None;
+        if !admin {
+            if let Some(pool_config) = get_config().pool_config(pool_name) {
+                if let (Some(requested), Some(encoding)) = (
+                    parameters.get("client_encoding"),
+                    pool_config.client_encoding.as_ref(),
+                ) {
+                    if !pool_config.allows_client_encoding(requested) {
+                        if !pool_config.normalize_client_encoding {
+                            error_response_terminal(
+                                &mut write,
+                                format!("client_encoding \"{requested}\" is not allowed for database \"{pool_name}\", use \"{encoding}\"").as_str(),
+                                "22023",
+                            )
+                            .await?;
+                            return Err(Error::ClientError(format!(
+                                "Client {client_identifier} requested client_encoding {requested}, pool requires {encoding}"
+                            )));
+                        }
+                        info!(
+                            "Client {client_identifier} requested client_encoding {requested}, switched to {encoding}"
+                        );
+                        client_encoding_override = Some(encoding.clone());
+                    }
+                }
+            }
+        }
+
+        // Clients select a partition of the database pool with pool_hint.
+        let pool_name = &match startup_pool_hint(&parameters) {
+            Some(hint) if !admin => {
+                let partitioned = get_config()
+                    .pools
+                    .get(pool_name.as_str())
+                    .is_some_and(|pool_config| pool_config.partitions.contains_key(&hint));
+                if !partitioned {
+                    error_response_terminal(
+                        &mut write,
+                        format!(
+                            "pool_hint \"{hint}\" is not configured for database \"{pool_name}\""
+                        )
+                        .as_str(),
+                        "3D000",
+                    )
+                    .await?;
+                    return Err(Error::ClientError(format!(
+                        "Client {client_identifier} requested unknown pool_hint {hint}"
+                    )));
+                }
+                let partition_pool = partition_pool_name(pool_name, &hint);
+                client_identifier.pool_name = partition_pool.clone();
+                partition_pool
+            }
+            _ => pool_name.clone(),
+        };
+
+        // A database that isn't configured gets its pools from the `*` entry, a user
+        // that isn't listed from auth_query_template_user, added once the client is
+        // authenticated.
+        let pending_pools =
+            if !admin && get_pool(pool_name, &client_identifier.username, 0).is_none() {
+                match ConnectionPool::wildcard_pools(
+                    pool_name,
+                    &client_identifier.username,
+                    &client_server_map,
+                )? {
+                    Some(pending_pools) => Some(pending_pools),
+                    None => ConnectionPool::auth_query_user_pools(
+                        pool_name,
+                        &client_identifier.username,
+                        &client_server_map,
+                    )?,
+                }
+            } else {
+                None
+            };
+
         // Generate random backend ID and secret key
-        let process_id: i32 = rand::random();
+        let process_id = new_process_id(general.peer_id);
         let secret_key: i32 = rand::random();
 
         // Authenticate user
@@ -652,9 +980,107 @@ where
             admin,
             &client_identifier,
             pool_name,
+            pending_pools.as_ref(),
             username_from_parameters,
+            client_tls.as_ref(),
+            hba_method,
         )
-        .await?;
+        .await
+        .inspect_err(|err| {
+            if err.is_auth_failure() {
+                record_auth_failure(addr.ip());
+            }
+            if !admin && err.is_auth_failure() {
+                if let Some(pool) = get_pool(pool_name, username_from_parameters, 0) {
+                    pool.address.stats.auth_failure();
+                }
+            }
+        })?;
+        reset_auth_failures(addr.ip());
+        if let Some(pending_pools) = pending_pools {
+            ConnectionPool::add_pending_pools(pending_pools);
+        }
+
+        // Cap on the clients of the database, its partitions included.
+        let db_client_permit = if admin {
+            None
+        } else {
+            let database = pool_name
+                .rsplit_once(PARTITION_SEPARATOR)
+                .map_or(pool_name.as_str(), |(database, _)| database);
+            let max = get_config()
+                .pool_config(database)
+                .map_or(0, |pool| pool.max_db_client_connections);
+            match try_acquire_db_client_permit(database, max) {
+                Some(permit) => Some(permit),
+                None => {
+                    warn!(
+                        "Client {client_identifier}: too many connections for database {database}"
+                    );
+                    error_response_terminal(
+                        &mut write,
+                        &format!("too many connections for database {database}"),
+                        "53300",
+                    )
+                    .await?;
+                    return Err(Error::ClientError(format!(
+                        "max_db_client_connections reached for {database}"
+                    )));
+                }
+            }
+        };
+
+        // Passthrough: a dedicated server and the messages relayed as they are, to tell
+        // whether an application bug is caused by the pooler.
+        let passthrough = !admin
+            && get_pool(pool_name, username_from_parameters, 0).is_some_and(|pool| {
+                passthrough_enabled(
+                    username_from_parameters,
+                    pool.settings.user.passthrough.unwrap_or(false),
+                )
+            });
+        let (transaction_mode, prepared_statements_enabled) = if passthrough {
+            info!("Client {client_identifier} runs in passthrough mode");
+            (false, false)
+        } else {
+            (transaction_mode, prepared_statements_enabled)
+        };
+
+        // Logical replication: a server connection of its own, started in replication mode.
+        let replication = match replication_requested(&parameters) {
+            Ok(replication) => replication,
+            Err(err) => {
+                error_response_terminal(&mut write, &err.to_string(), "0A000").await?;
+                return Err(err);
+            }
+        };
+        if replication
+            && (admin
+                || get_config()
+                    .pool_config(pool_name)
+                    .is_none_or(|pool| pool.max_replication_connections == 0))
+        {
+            error_response_terminal(
+                &mut write,
+                &format!("replication connections are not allowed for database {pool_name}"),
+                "28000",
+            )
+            .await?;
+            return Err(Error::ClientError(format!(
+                "replication connection refused for database {pool_name}"
+            )));
+        }
+        let (transaction_mode, prepared_statements_enabled) = if replication {
+            info!("Client {client_identifier} opens a logical replication connection");
+            (false, false)
+        } else {
+            (transaction_mode, prepared_statements_enabled)
+        };
+
+        let mut parameters = parameters.clone();
+        if let Some(encoding) = client_encoding_override {
+            parameters.insert("client_encoding".to_string(), encoding);
+        }
 
         // Update the parameters to merge what the application sent and what's originally on the server
         server_parameters.set_from_hashmap(parameters.clone(), false);
@@ -665,13 +1091,27 @@ where
             auth_ok.put_i32(8);
             auth_ok.put_i32(0);
             buf.put(auth_ok);
-            let server_params_buf: BytesMut = (&server_parameters).into();
+            let config = get_config();
+            let pool_config = config.pool_config(pool_name);
+            let overrides = pool_config
+                .filter(|_| !passthrough && !admin)
+                .and_then(ParameterStatusOverrides::from_pool);
+            let server_params_buf = server_parameters.client_messages(overrides.as_ref());
             buf.put(server_params_buf);
             let mut key_data = BytesMut::from(&b"K"[..]);
             key_data.put_i32(12);
             key_data.put_i32(process_id);
             key_data.put_i32(secret_key);
             buf.put(key_data);
+            // Announcement for the clients of the database or the user, e.g. a move of the endpoint.
+            if let (Some(pool_config), Some(pool)) = (
+                pool_config.filter(|_| !admin),
+                get_pool(pool_name, username_from_parameters, 0),
+            ) {
+                if let Some(notice) = pool_config.login_notice(&pool.settings.user) {
+                    buf.put(notice_message(notice));
+                }
+            }
             buf.put(ready_for_query(false));
         }
         write_all_flush(&mut write, &buf).await?;
@@ -686,7 +1126,29 @@ where
             use_tls,
         ));
 
+        emit_event(|| Event::ClientConnect {
+            client: addr.to_string(),
+            pool: pool_name.clone(),
+            user: client_identifier.username.clone(),
+            application_name: client_identifier.application_name.clone(),
+            tls: use_tls,
+            admin,
+        });
+
         let config = get_config();
+        // The database of a partition pool, for the partitions and query_routes.
+        let database = pool_name
+            .rsplit_once(PARTITION_SEPARATOR)
+            .filter(|(database, _)| config.pools.contains_key(*database))
+            .map_or(pool_name.as_str(), |(database, _)| database);
+        let mirror = match get_pool(pool_name, username_from_parameters, 0) {
+            // Passthrough and replication clients keep a server connection of their own,
+            // their session isn't replayed.
+            Some(pool) if !admin && !replication && !passthrough => {
+                Mirror::start(&pool, client_server_map.clone())
+            }
+            _ => None,
+        };
         Ok(Client {
             read: BufReader::new(read),
             write,
@@ -718,6 +1180,91 @@ where
                 .general
                 .clone()
                 .poller_check_query_request_bytes_vec(),
+            release_advisory_locks: config.general.release_advisory_locks,
+            track_prepared_transactions: config
+                .pool_config(pool_name)
+                .is_some_and(|pool| pool.track_prepared_transactions),
+            session_parameters: match config.pool_config(pool_name) {
+                Some(pool) if !admin && !replication => {
+                    let mut session_parameters =
+                        allowed_startup_parameters(&parameters, &pool.startup_parameters);
+                    if let Some(application_name) = pool.server_application_name(
+                        &client_identifier.application_name,
+                        &client_identifier.username,
+                        pool_name,
+                    ) {
+                        session_parameters.insert("application_name".to_string(), application_name);
+                    }
+                    session_parameters
+                }
+                _ => BTreeMap::new(),
+            },
+            track_session_parameters: transaction_mode
+                && config
+                    .pool_config(pool_name)
+                    .is_some_and(|pool| pool.track_session_parameters),
+            audit: !admin
+                && !replication
+                && match (
+                    config.pool_config(pool_name),
+                    get_pool(pool_name, username_from_parameters, 0),
+                ) {
+                    (Some(pool_config), Some(pool)) => pool_config.audit(&pool.settings.user),
+                    _ => false,
+                },
+            audit_statements: HashMap::new(),
+            audit_pending: Vec::new(),
+            reject_role_changes: config
+                .pool_config(pool_name)
+                .is_some_and(|pool| pool.reject_role_changes),
+            client_encoding: config
+                .pool_config(pool_name)
+                .and_then(|pool| pool.client_encoding.clone()),
+            role_change_pending: false,
+            read_only: listener.read_only,
+            pending_two_phase: None,
+            queue_notice_threshold: config.general.queue_notice_threshold,
+            slow_query_threshold: Duration::from_millis(config.general.slow_query_threshold),
+            slow_query_log_rate: config.general.slow_query_log_rate,
+            client_keepalive_interval: config.general.client_keepalive_interval,
+            sync_response_timeout: config.general.sync_response_timeout,
+            batch_timeout: config.general.batch_timeout,
+            batch_message_timeout: config.general.batch_message_timeout,
+            batch_started_at: None,
+            passthrough,
+            replication,
+            _db_client_permit: db_client_permit,
+            replica_pools: match config.pools.get(pool_name) {
+                Some(pool) if transaction_mode => (1..=pool.replica_hosts.len())
+                    .map(|index| replica_pool_name(pool_name, index))
+                    .collect(),
+                _ => Vec::new(),
+            },
+            read_your_writes: transaction_mode
+                && config
+                    .pools
+                    .get(pool_name)
+                    .is_some_and(|pool| pool.read_your_writes),
+            max_replica_lag: match config.pools.get(pool_name) {
+                Some(pool) if transaction_mode => pool.max_replica_lag,
+                _ => 0,
+            },
+            written_lsn: None,
+            partition_pools: match config.pool_config(pool_name) {
+                Some(pool) if transaction_mode && !admin => pool
+                    .partitions
+                    .keys()
+                    .map(|partition| (partition.clone(), partition_pool_name(database, partition)))
+                    .collect(),
+                _ => HashMap::new(),
+            },
+            query_routes_database: (transaction_mode && !admin && has_query_routes(database))
+                .then(|| database.to_string()),
+            mirror,
+            result_cache_database: (transaction_mode && !admin && has_result_cache(database))
+                .then(|| database.to_string()),
+            result_cache_key: None,
+            result_cache_response: BytesMut::new(),
         })
     }
 
@@ -760,6 +1307,39 @@ where
             created_at: Instant::now(),
             max_memory_usage: 128 * 1024 * 1024,
             pooler_check_query_request_vec: Vec::new(),
+            release_advisory_locks: false,
+            track_prepared_transactions: false,
+            session_parameters: BTreeMap::new(),
+            track_session_parameters: false,
+            audit: false,
+            audit_statements: HashMap::new(),
+            audit_pending: Vec::new(),
+            reject_role_changes: false,
+            client_encoding: None,
+            role_change_pending: false,
+            read_only: false,
+            pending_two_phase: None,
+            queue_notice_threshold: 0,
+            slow_query_threshold: Duration::ZERO,
+            slow_query_log_rate: 0,
+            client_keepalive_interval: 0,
+            sync_response_timeout: 0,
+            batch_timeout: 0,
+            batch_message_timeout: 0,
+            batch_started_at: None,
+            passthrough: false,
+            replication: false,
+            _db_client_permit: None,
+            replica_pools: Vec::new(),
+            read_your_writes: false,
+            max_replica_lag: 0,
+            written_lsn: None,
+            partition_pools: HashMap::new(),
+            query_routes_database: None,
+            mirror: None,
+            result_cache_database: None,
+            result_cache_key: None,
+            result_cache_response: BytesMut::new(),
         })
     }
 
@@ -767,6 +1347,18 @@ where
     pub async fn handle(&mut self) -> Result<(), Error> {
         // The client wants to cancel a query it has issued previously.
         if self.cancel_mode {
+            let general = get_config().general;
+            // Held until the request is forwarded, a flood of them is shed here.
+            let _permit = match try_acquire_cancel_permit(general.max_cancel_connections) {
+                Some(permit) => permit,
+                None => {
+                    debug!(
+                        "Client {} cancel request dropped, {} cancel requests are being handled",
+                        self.addr, general.max_cancel_connections
+                    );
+                    return Ok(());
+                }
+            };
             let (process_id, secret_key, address, port) = {
                 let guard = self.client_server_map.lock();
 
@@ -782,18 +1374,57 @@ where
                         (*process_id, *secret_key, address.clone(), *port)
                     }
 
-                    // The client doesn't know / got the wrong server,
-                    // we're closing the connection for security reasons.
-                    None => return Ok(()),
+                    // The key may belong to the client of a peer behind the same load balancer.
+                    None => match cancel_peer(&general, self.process_id) {
+                        Some(peer) => {
+                            debug!(
+                                "Client {} cancel request forwarded to peer {}",
+                                self.addr, peer.peer_id
+                            );
+                            CANCEL_FORWARDED_COUNTER.fetch_add(1, Ordering::Relaxed);
+                            (
+                                self.process_id,
+                                self.secret_key,
+                                peer.host.clone(),
+                                peer.port,
+                            )
+                        }
+                        // The client doesn't know / got the wrong server,
+                        // we're closing the connection for security reasons.
+                        None => return Ok(()),
+                    },
                 }
             };
 
             // Opens a new separate connection to the server, sends the backend_id
             // and secret_key and then closes it for security reasons. No other interactions
             // take place.
-            return Server::cancel(&address, port, process_id, secret_key).await;
+            let cancel_timeout = Duration::from_millis(general.cancel_timeout);
+            return match tokio::time::timeout(
+                cancel_timeout,
+                Server::cancel(&address, port, process_id, secret_key),
+            )
+            .await
+            {
+                Ok(result) => result,
+                Err(_) => {
+                    CANCEL_TIMEOUT_COUNTER.fetch_add(1, Ordering::Relaxed);
+                    Err(Error::SocketError(format!(
+                        "cancel request to {address}:{port} timed out after {}ms",
+                        general.cancel_timeout
+                    )))
+                }
+            };
         }
+        set_log_context(LogContext {
+            pool: self.pool_name.clone(),
+            user: self.username.clone(),
+            client_id: self.process_id,
+        });
         self.stats.register(self.stats.clone());
+        if self.replication {
+            return self.relay_replication().await;
+        }
         let client_counter = CLIENT_COUNTER.fetch_add(1, Ordering::Relaxed);
         // Get a pool instance referenced by the most up-to-date
         // pointer. This ensures we always read the latest config
@@ -810,7 +1441,7 @@ where
             // Read a complete message from the client, which normally would be
             // either a `Q` (query) or `P` (prepare, extended protocol).
             self.stats.idle_read();
-            let message = match read_message(&mut self.read, self.max_memory_usage).await {
+            let message = match self.read_client_message(true).await {
                 Ok(message) => message,
                 Err(err) => return self.process_error(err).await,
             };
@@ -835,7 +1466,15 @@ where
             }
             // Handle admin database queries.
             if self.admin {
-                match handle_admin(&mut self.write, message, self.client_server_map.clone()).await {
+                match handle_admin(
+                    &mut self.write,
+                    message,
+                    self.client_server_map.clone(),
+                    &self.username,
+                    self.addr,
+                )
+                .await
+                {
                     Ok(_) => (),
                     Err(err) => {
                         self.stats.disconnect();
@@ -849,6 +1488,12 @@ where
             let current_pool = pool.as_ref().unwrap();
 
             match message[0] as char {
+                'Q' if self.passthrough => {
+                    self.check_statement_allowlist(&message, current_pool)
+                        .await?;
+                    self.check_role_change(&message).await?;
+                    self.check_client_encoding_change(&message).await?;
+                }
                 'Q' => {
                     if self.pooler_check_query_request_vec.eq(&message.to_vec()) {
                         // This is the first message in the transaction, since we are responding with 'IZ',
@@ -864,6 +1509,10 @@ where
                             continue;
                         }
                     }
+                    self.check_statement_allowlist(&message, current_pool)
+                        .await?;
+                    self.check_role_change(&message).await?;
+                    self.check_client_encoding_change(&message).await?;
                 }
                 // Buffer extended protocol messages even if we do not have
                 // a server connection yet. Hopefully, when we get the S message
@@ -874,6 +1523,12 @@ where
                 // to when we get the S message
                 // Parse
                 'P' => {
+                    self.check_statement_allowlist(&message, current_pool)
+                        .await?;
+                    self.check_role_change(&message).await?;
+                    self.check_client_encoding_change(&message).await?;
+                    observe_statement(&self.pool_name, &message);
+                    self.track_two_phase(&message);
                     self.buffer_parse(message, current_pool)?;
                     continue;
                 }
@@ -907,13 +1562,71 @@ where
                 _ => (),
             }
 
+            // Error injected by the admin INJECT command.
+            if let Some(code) = take_injected_error(self.process_id, &self.pool_name) {
+                self.stats.checkout_error();
+                if message[0] as char == 'S' {
+                    self.reset_buffered_state();
+                }
+                warn!(
+                    "Sending injected error {code} to client {} {{ pool_name: {:?}, username: {:?} }}",
+                    self.addr, self.pool_name, self.username
+                );
+                error_response(
+                    &mut self.write,
+                    format!("Error {code} injected by pg_doorman").as_str(),
+                    &code,
+                )
+                .await?;
+                // Connection exceptions and operator interventions terminate the session.
+                if code.starts_with("08") || code.starts_with("57") {
+                    return Err(Error::InjectedError(code));
+                }
+                continue;
+            }
+
+            // Read-only statements answered from the result cache, without a server.
+            if self.serve_cached_result(&message).await? {
+                continue;
+            }
+
             {
                 // start server.
                 // Grab a server from the pool.
                 let connecting_at = Instant::now();
                 self.stats.waiting();
+                // The database is paused with the admin PAUSE command, hold the transaction until RESUME.
+                if is_paused(&self.pool_name) {
+                    wait_while_paused(&self.pool_name).await;
+                }
+                // The server is overloaded, only a share of the pool is handed out.
+                if let Some(percent) = overload_percent(&self.pool_name) {
+                    wait_for_admission(&self.pool_name, current_pool, percent).await;
+                }
+                // Read-only transactions go to a replica and hinted ones to their partition,
+                // the pool of the client takes over if it fails.
+                let routed_pool =
+                    self.routed_pool(&message, current_pool, client_counter + tx_counter);
+                let mut checkout_pool = routed_pool.as_ref().unwrap_or(current_pool);
+                let mut queue_notice_sent = false;
                 let mut conn = loop {
-                    match current_pool.database.get().await {
+                    let checkout = checkout_pool.checkout();
+                    tokio::pin!(checkout);
+                    let checkout_result = if self.queue_notice_threshold > 0 && !queue_notice_sent {
+                        let notice_at = Duration::from_millis(self.queue_notice_threshold)
+                            .saturating_sub(connecting_at.elapsed());
+                        tokio::select! {
+                            result = &mut checkout => result,
+                            _ = tokio::time::sleep(notice_at) => {
+                                queue_notice_sent = true;
+                                self.send_queue_notice(checkout_pool, connecting_at).await?;
+                                checkout.await
+                            }
+                        }
+                    } else {
+                        checkout.await
+                    };
+                    match checkout_result {
                         Ok(mut conn) => {
                             // check server candidate in canceled pids.
                             {
@@ -937,6 +1650,15 @@ where
                                 }
                             };
                         }
+                        Err(err) if !std::ptr::eq(checkout_pool, current_pool) => {
+                            checkout_pool.address.stats.error();
+                            warn!(
+                                "Pool {} is unavailable, sending the transaction to {}: {err}",
+                                checkout_pool.address, current_pool.address
+                            );
+                            checkout_pool = current_pool;
+                            continue;
+                        }
                         Err(err) => {
                             // Client is attempting to get results from the server,
                             // but we were unable to grab a connection from the pool
@@ -950,6 +1672,31 @@ where
                                 self.reset_buffered_state();
                             }
 
+                            // All servers of the pool stayed busy for query_wait_timeout.
+                            if let PoolError::Timeout(TimeoutType::Wait) = err {
+                                current_pool.address.stats.query_wait_timeout();
+                                let wait =
+                                    current_pool.database.timeouts().wait.unwrap_or_default();
+                                error_response(
+                                    &mut self.write,
+                                    &format!(
+                                        "query_wait_timeout: no server connection of pool {} was available within {}ms",
+                                        self.pool_name,
+                                        wait.as_millis()
+                                    ),
+                                    "57014",
+                                )
+                                .await?;
+                                warn!(
+                                    "Client {} {{ pool_name: {:?}, username: {:?} }} waited {}ms for a server connection",
+                                    self.addr,
+                                    self.pool_name,
+                                    self.username,
+                                    wait.as_millis()
+                                );
+                                return Err(Error::QueryWaitTimeout);
+                            }
+
                             error_response(
                                 &mut self.write,
                                 format!("Could not get a database connection from the pool. All servers may be busy or down. Error details: {err}. Please try again later.").as_str(),
@@ -967,16 +1714,26 @@ where
                 };
                 let server = conn.deref_mut();
                 server.stats.active(self.stats.application_name());
-                server.stats.checkout_time(
-                    connecting_at.elapsed().as_micros() as u64,
-                    self.stats.application_name(),
-                );
+                record(Section::PoolCheckout, connecting_at.elapsed(), 0);
+                let wait_us = connecting_at.elapsed().as_micros() as u64;
+                server
+                    .stats
+                    .checkout_time(wait_us, self.stats.application_name());
                 let server_active_at = Instant::now();
+                emit_event(|| Event::Checkout {
+                    client: self.addr.to_string(),
+                    pool: self.pool_name.clone(),
+                    user: self.username.clone(),
+                    server: server.address_to_string(),
+                    server_pid: server.get_process_id(),
+                    wait_us,
+                });
 
                 // Server is assigned to the client in case the client wants to
                 // cancel a query later.
                 server.claim(self.process_id, self.secret_key);
                 self.connected_to_server = true;
+                self.track_role_change(server);
 
                 // Update statistics
                 self.stats.active_idle();
@@ -987,9 +1744,32 @@ where
                 if current_pool.settings.sync_server_parameters {
                     server.sync_parameters(&self.server_parameters).await?;
                 }
-                server.set_flush_wait_code(' ');
+                server.set_read_only(self.read_only).await?;
+                server
+                    .replay_session_parameters(&self.session_parameters)
+                    .await?;
+                server
+                    .set_session_timeouts(
+                        current_pool.settings.statement_timeout_ms,
+                        current_pool.settings.idle_in_transaction_session_timeout_ms,
+                    )
+                    .await?;
+
+                // A transaction on the primary that may write: its WAL position is noted after it,
+                // the next reads of the client wait for the replicas to replay it.
+                let note_written_lsn = self.read_your_writes
+                    && !self
+                        .replica_pools
+                        .contains(&checkout_pool.address.pool_name)
+                    && self
+                        .transaction_query(&message)
+                        .is_none_or(|query| query_route(query) != Route::Replica);
 
                 let mut initial_message = Some(message);
+                let mut transaction_limit = TransactionLimit::new(
+                    current_pool.settings.transaction_duration_warning_ms,
+                    current_pool.settings.transaction_duration_limit_ms,
+                );
 
                 // Transaction loop. Multiple queries can be issued by the client here.
                 // The connection belongs to the client until the transaction is over,
@@ -998,10 +1778,32 @@ where
                 // If the client is in session mode, no more custom protocol
                 // commands will be accepted.
                 loop {
+                    // Between transactions: nothing runs on the server and no batch is buffered,
+                    // a pipeline sent with Flush (e.g. a suspended portal) waits for its Sync.
+                    let between_transactions =
+                        !server.in_transaction() && !server.is_async() && self.buffer.is_empty();
+                    // Time the client keeps the transaction open without sending anything.
+                    let idle_in_transaction_since =
+                        (initial_message.is_none() && server.in_transaction() && analyze_enabled())
+                            .then(Instant::now);
                     let message = match initial_message {
                         None => {
                             self.stats.active_read();
-                            match read_message(&mut self.read, self.max_memory_usage).await {
+                            if between_transactions {
+                                transaction_limit.finish();
+                            }
+                            let read = match transaction_limit.remaining() {
+                                Some(remaining) => {
+                                    tokio::time::timeout(remaining, self.read_client_message(true))
+                                        .await
+                                        .unwrap_or(Err(Error::TransactionDurationLimit))
+                                }
+                                None if between_transactions && server.is_listening() => {
+                                    self.read_client_message_with_notifications(server).await
+                                }
+                                None => self.read_client_message(true).await,
+                            };
+                            match read {
                                 Ok(message) => message,
                                 Err(err) => {
                                     self.stats.disconnect();
@@ -1016,8 +1818,17 @@ where
                             message
                         }
                     };
+                    if let Some(since) = idle_in_transaction_since {
+                        observe_idle_in_transaction(&self.pool_name, since.elapsed());
+                    }
                     self.stats.active_idle();
 
+                    if between_transactions {
+                        transaction_limit.start(server);
+                    } else if let Some(warning) = transaction_limit.take_warning() {
+                        write_all_flush(&mut self.write, &notice_message(&warning)).await?;
+                    }
+
                     // The message will be forwarded to the server intact. We still would like to
                     // parse it below to figure out what to do with it.
 
@@ -1027,8 +1838,33 @@ where
 
                     match code {
                         // Query
-                        'Q' => {
+                        // FunctionCall (fastpath) is relayed the same way: the server replies with
+                        // FunctionCallResponse and ReadyForQuery. It's used by some older drivers and
+                        // lo_* large object APIs. Large object descriptors are closed at the end of their
+                        // transaction, which keeps the server anyway.
+                        'Q' | 'F' => {
+                            self.check_statement_allowlist(&message, current_pool)
+                                .await?;
+                            self.check_role_change(&message).await?;
+                            self.check_client_encoding_change(&message).await?;
+                            observe_statement(&self.pool_name, &message);
+                            self.track_two_phase(&message);
+                            self.track_advisory_locks(&message, server);
+                            self.track_role_change(server);
+                            let audit_started_at = self.audit_query(&message, server);
+                            self.mirror_begin(server);
+                            let sent_at = Instant::now();
                             self.send_and_receive_loop(Some(&message), server).await?;
+                            let command_tags = server.take_command_tags();
+                            self.mirror_request(&message, Vec::new(), &command_tags, true, server);
+                            self.write_audit_records(audit_started_at, command_tags);
+                            self.log_slow_query(sent_at, wait_us, || {
+                                statement_text(&message)
+                                    .map(str::to_string)
+                                    .into_iter()
+                                    .collect()
+                            });
+                            self.finish_two_phase(server);
                             self.stats.query();
                             server.stats.query(
                                 query_start_at.elapsed().as_micros() as u64,
@@ -1044,7 +1880,10 @@ where
 
                                 // Release server back to the pool if we are in transaction mode.
                                 // If we are in session mode, we keep the server until the client disconnects.
-                                if self.transaction_mode && !server.in_copy_mode() {
+                                if self.transaction_mode
+                                    && !server.in_copy_mode()
+                                    && !server.is_listening()
+                                {
                                     self.stats.idle_read();
                                     break;
                                 }
@@ -1063,11 +1902,21 @@ where
                         // Parse
                         // The query with placeholders is here, e.g. `SELECT * FROM users WHERE email = $1 AND active = $2`.
                         'P' => {
+                            self.check_statement_allowlist(&message, current_pool)
+                                .await?;
+                            self.check_role_change(&message).await?;
+                            self.check_client_encoding_change(&message).await?;
+                            observe_statement(&self.pool_name, &message);
+                            self.track_two_phase(&message);
+                            self.track_advisory_locks(&message, server);
+                            self.track_role_change(server);
+                            self.audit_parse(&message);
                             self.buffer_parse(message, current_pool)?;
                         }
 
                         // Bind
                         'B' => {
+                            self.audit_bind(&message)?;
                             self.buffer_bind(message).await?;
                         }
 
@@ -1119,16 +1968,23 @@ where
                             //              RowDescription
                             //              ReadyForQuery
                             // Iterate over our extended protocol data that we've buffered
-                            let mut async_wait_code = ' ';
+                            let batch_statements = self.batch_statements();
+                            let mut mirror_statements = Vec::new();
+                            // Responses the messages sent to the server owe, for Flush.
+                            let mut flush_pending = 0;
                             while let Some(protocol_data) =
                                 self.extended_protocol_data_buffer.pop_front()
                             {
                                 match protocol_data {
                                     ExtendedProtocolData::Parse { data, metadata } => {
-                                        async_wait_code = '1';
                                         debug!("Have parse in extended buffer");
                                         let (parse, hash) = match metadata {
-                                            Some(metadata) => metadata,
+                                            Some(metadata) => {
+                                                if self.mirror.is_some() {
+                                                    mirror_statements.push(metadata.0.clone());
+                                                }
+                                                metadata
+                                            }
                                             None => {
                                                 let first_char_in_name = *data.get(5).unwrap_or(&0);
                                                 if first_char_in_name != 0 {
@@ -1138,6 +1994,7 @@ where
                                                 }
                                                 // Not a prepared statement
                                                 self.buffer.put(&data[..]);
+                                                flush_pending += 1;
                                                 continue;
                                             }
                                         };
@@ -1167,26 +2024,42 @@ where
 
                                             // Add parse message to buffer
                                             self.buffer.put(&data[..]);
+                                            flush_pending += 1;
                                         }
                                     }
                                     ExtendedProtocolData::Bind { data, metadata } => {
-                                        async_wait_code = '2';
                                         // This is using a prepared statement
                                         if let Some(client_given_name) = metadata {
+                                            self.mirror_statement(
+                                                &client_given_name,
+                                                &mut mirror_statements,
+                                            );
                                             self.ensure_prepared_statement_is_on_server(
                                                 client_given_name,
                                                 current_pool,
                                                 server,
                                             )
                                             .await?;
+                                            // Its statement stays on the server while the portal is open.
+                                            server.bind_portal(
+                                                Bind::get_portal(&data)?,
+                                                Bind::get_name(&data)?,
+                                            );
+                                        } else if self.prepared_statements_enabled {
+                                            // The unnamed portal is replaced.
+                                            server.close_portal(&Bind::get_portal(&data)?);
                                         }
 
                                         self.buffer.put(&data[..]);
+                                        flush_pending += 1;
                                     }
                                     ExtendedProtocolData::Describe { data, metadata } => {
-                                        async_wait_code = 'T';
                                         // This is using a prepared statement
                                         if let Some(client_given_name) = metadata {
+                                            self.mirror_statement(
+                                                &client_given_name,
+                                                &mut mirror_statements,
+                                            );
                                             self.ensure_prepared_statement_is_on_server(
                                                 client_given_name,
                                                 current_pool,
@@ -1196,10 +2069,11 @@ where
                                         }
 
                                         self.buffer.put(&data[..]);
+                                        flush_pending += 1;
                                     }
                                     ExtendedProtocolData::Execute { data } => {
-                                        async_wait_code = 'C';
-                                        self.buffer.put(&data[..])
+                                        self.buffer.put(&data[..]);
+                                        flush_pending += 1;
                                     }
                                     ExtendedProtocolData::Close { data, close } => {
                                         // We don't send the close message to the server if prepared statements are enabled,
@@ -1213,7 +2087,11 @@ where
                                             self.response_message_queue_buffer
                                                 .put(close_complete());
                                         } else {
+                                            if close.is_portal() {
+                                                server.close_portal(&close.name);
+                                            }
                                             self.buffer.put(&data[..]);
+                                            flush_pending += 1;
                                         }
                                     }
                                 }
@@ -1222,14 +2100,37 @@ where
                             // Add the sync message
                             self.buffer.put(&message[..]);
 
-                            if code == 'H' {
-                                server.set_flush_wait_code(async_wait_code);
+                            // The responses of the server come without ReadyForQuery after Flush,
+                            // the server stays with the client until the Sync.
+                            if code == 'H' && flush_pending > 0 {
+                                server.set_flush_pending(flush_pending);
                                 debug!("Client requested flush, going async");
-                            } else {
-                                server.set_flush_wait_code(' ')
                             }
 
-                            self.send_and_receive_loop(None, server).await?;
+                            let audit_started_at = self.audit_begin(server);
+                            self.mirror_begin(server);
+                            let sent_at = Instant::now();
+                            // Nothing to flush on the server, e.g. the responses to a Parse
+                            // of a prepared statement it has are queued for the client.
+                            if code == 'S' || flush_pending > 0 {
+                                self.send_and_receive_loop(None, server).await?;
+                            }
+                            let command_tags = server.take_command_tags();
+                            let messages = std::mem::take(&mut self.buffer);
+                            self.mirror_request(
+                                &messages,
+                                mirror_statements,
+                                &command_tags,
+                                code == 'S',
+                                server,
+                            );
+                            self.buffer = messages;
+                            self.write_audit_records(audit_started_at, command_tags);
+                            self.log_slow_query(sent_at, wait_us, || batch_statements);
+                            if code == 'S' {
+                                self.batch_started_at = None;
+                            }
+                            self.finish_two_phase(server);
                             self.stats.query();
                             server.stats.query(
                                 query_start_at.elapsed().as_micros() as u64,
@@ -1238,7 +2139,8 @@ where
 
                             self.buffer.clear();
 
-                            if !server.in_transaction() {
+                            // After Flush the Sync is still owed, the server stays with the client.
+                            if code == 'S' && !server.in_transaction() && !server.is_async() {
                                 self.stats.transaction();
                                 server
                                     .stats
@@ -1246,7 +2148,10 @@ where
 
                                 // Release server back to the pool if we are in transaction mode.
                                 // If we are in session mode, we keep the server until the client disconnects.
-                                if self.transaction_mode && !server.in_copy_mode() {
+                                if self.transaction_mode
+                                    && !server.in_copy_mode()
+                                    && !server.is_listening()
+                                {
                                     if !self.response_message_queue_buffer.is_empty() {
                                         self.client_last_messages_in_tx
                                             .put(&self.response_message_queue_buffer[..]);
@@ -1286,7 +2191,13 @@ where
                             if !server.in_copy_mode() {
                                 self.stats.disconnect();
                                 server.mark_bad("client expects COPY mode, but server are not in");
-                                return Err(Error::ProtocolSyncError(
+                                error_response_terminal(
+                                    &mut self.write,
+                                    "unexpected COPY message, server is not in COPY mode",
+                                    "08P01",
+                                )
+                                .await?;
+                                return Err(Error::ProtocolViolation(
                                     "server not in copy mode".to_string(),
                                 ));
                             }
@@ -1306,7 +2217,13 @@ where
                             if !server.in_copy_mode() {
                                 self.stats.disconnect();
                                 server.mark_bad("client expects COPY mode, but server are not in");
-                                return Err(Error::ProtocolSyncError(
+                                error_response_terminal(
+                                    &mut self.write,
+                                    "unexpected COPY message, server is not in COPY mode",
+                                    "08P01",
+                                )
+                                .await?;
+                                return Err(Error::ProtocolViolation(
                                     "server not in copy mode".to_string(),
                                 ));
                             }
@@ -1338,7 +2255,8 @@ where
                                 }
                             };
 
-                            if !server.in_transaction() {
+                            // A COPY of a flushed Execute leaves the Sync owed.
+                            if !server.in_transaction() && !server.is_async() {
                                 self.stats.transaction();
                                 server
                                     .stats
@@ -1346,7 +2264,7 @@ where
 
                                 // Release server back to the pool if we are in transaction mode.
                                 // If we are in session mode, we keep the server until the client disconnects.
-                                if self.transaction_mode {
+                                if self.transaction_mode && !server.is_listening() {
                                     break;
                                 }
                             }
@@ -1359,22 +2277,75 @@ where
                         }
                     }
                 }
-                if !server.is_async() {
-                    server.checkin_cleanup().await?;
+                // The server goes back to the pool, its transaction can't be cancelled anymore.
+                drop(transaction_limit);
+                // Record what the client SET, before the reset discards it.
+                if self.track_session_parameters {
+                    self.session_parameters = server.session_parameters().await?;
                 }
-                server
-                    .stats
-                    .add_xact_time_and_idle(server_active_at.elapsed().as_micros() as u64);
+                if note_written_lsn {
+                    self.written_lsn = match current_lsn(server).await {
+                        Ok(lsn) => Some(lsn),
+                        Err(err) => {
+                            // Unknown, the reads of the client stay on the primary until its next write.
+                            warn!(
+                                "Client {} {{ pool_name: {:?}, username: {:?} }} didn't get the WAL position of the primary: {err}",
+                                self.addr, self.pool_name, self.username
+                            );
+                            Some(u64::MAX)
+                        }
+                    };
+                }
+                // With server_reset_in_background the reset runs after the client moved on.
+                let reset_in_background = server.resets_in_background();
+                if !reset_in_background {
+                    match server.checkin_cleanup().await {
+                        // The server is closed, the client goes on with another one.
+                        Err(Error::ServerResetTimeout(msg)) => {
+                            warn!("Client {} released server: {msg}", self.addr)
+                        }
+                        result => result?,
+                    }
+                }
+                let xact_us = server_active_at.elapsed().as_micros() as u64;
+                server.stats.add_xact_time_and_idle(xact_us);
+                emit_event(|| Event::Release {
+                    client: self.addr.to_string(),
+                    pool: self.pool_name.clone(),
+                    user: self.username.clone(),
+                    server_pid: server.get_process_id(),
+                    xact_us,
+                });
                 // The server is no longer bound to us, we can't cancel it's queries anymore.
                 self.release();
                 server.stats.wait_idle();
+                if reset_in_background {
+                    // The server goes back to the pool once it's reset.
+                    tokio::task::spawn(async move {
+                        if let Err(err) = conn.checkin_cleanup().await {
+                            warn!(
+                                "Server {} background reset error: {err:?}",
+                                conn.address_to_string()
+                            );
+                        }
+                    });
+                }
             } // release server.
 
             if !self.client_last_messages_in_tx.is_empty() {
                 self.stats.idle_write(); // go to idle_read if success.
                 write_all_flush(&mut self.write, &self.client_last_messages_in_tx).await?;
+                if self.result_cache_key.is_some() {
+                    let response = std::mem::take(&mut self.client_last_messages_in_tx);
+                    self.capture_result(&response);
+                    self.client_last_messages_in_tx = response;
+                }
                 self.client_last_messages_in_tx.clear();
             }
+            if let Some(key) = self.result_cache_key.take() {
+                store_result(key, &self.result_cache_response);
+                self.result_cache_response = BytesMut::new();
+            }
             self.connected_to_server = false;
             // change pool.
             if tx_counter % 10 == 0 && self.transaction_mode {
@@ -1469,6 +2440,7 @@ where
             return Ok(());
         }
 
+        let _sample = sample(Section::MessageParse, message.len());
         let client_given_name = Parse::get_name(&message)?;
         let parse: Parse = (&message).try_into()?;
 
@@ -1513,6 +2485,7 @@ where
             return Ok(());
         }
 
+        let _sample = sample(Section::MessageParse, message.len());
         let client_given_name = Bind::get_name(&message)?;
 
         match self.prepared_statements.get(&client_given_name) {
@@ -1533,15 +2506,15 @@ where
             None => {
                 debug!("Got bind for unknown prepared statement {client_given_name:?}");
 
-                error_response(
+                error_response_terminal(
                     &mut self.write,
                     &format!("prepared statement \"{client_given_name}\" does not exist"),
-                    "58000",
+                    "26000",
                 )
                 .await?;
 
-                Err(Error::ClientError(format!(
-                    "Prepared statement `{client_given_name}` doesn't exist"
+                Err(Error::ProtocolViolation(format!(
+                    "prepared statement `{client_given_name}` doesn't exist"
                 )))
             }
         }
@@ -1592,21 +2565,22 @@ where
             None => {
                 debug!("Got describe for unknown prepared statement {describe:?}");
 
-                error_response(
+                error_response_terminal(
                     &mut self.write,
                     &format!("prepared statement \"{client_given_name}\" does not exist"),
-                    "58000",
+                    "26000",
                 )
                 .await?;
 
-                Err(Error::ClientError(format!(
-                    "Prepared statement `{client_given_name}` doesn't exist"
+                Err(Error::ProtocolViolation(format!(
+                    "prepared statement `{client_given_name}` doesn't exist"
                 )))
             }
         }
     }
 
     fn reset_buffered_state(&mut self) {
+        self.batch_started_at = None;
         self.buffer.clear();
         self.extended_protocol_data_buffer.clear();
         self.response_message_queue_buffer.clear();
@@ -1617,6 +2591,91 @@ where
         (counter % self.virtual_pool_count as u64) as u16
     }
 
+    /// Pool of the transaction starting with the message: the partition named by its
+    /// hint, the pool of the matching query_routes rule or a replica if it is read-only,
+    /// None for the pool of the client.
+    /// The first statement decides, a bound prepared statement counts as its query.
+    fn routed_pool(
+        &self,
+        message: &BytesMut,
+        current_pool: &ConnectionPool,
+        counter: usize,
+    ) -> Option<ConnectionPool> {
+        if self.replica_pools.is_empty()
+            && self.partition_pools.is_empty()
+            && self.query_routes_database.is_none()
+        {
+            return None;
+        }
+        let query = self.transaction_query(message)?;
+        let hint = routing_hint(query);
+        if let Some(RoutingHint::Partition(partition)) = hint {
+            return match self.partition_pools.get(&partition) {
+                Some(pool_name) => get_pool(
+                    pool_name,
+                    &self.username,
+                    current_pool.address.virtual_pool_id,
+                ),
+                None => {
+                    warn!(
+                        "Client {} {{ pool_name: {:?} }}: partition {partition:?} of the routing hint is not configured",
+                        self.addr, self.pool_name
+                    );
+                    None
+                }
+            };
+        }
+        if let (None, Some(database)) = (&hint, &self.query_routes_database) {
+            if let Some(pool_name) = query_route_pool(database, query) {
+                if pool_name == self.pool_name {
+                    return None;
+                }
+                return get_pool(
+                    &pool_name,
+                    &self.username,
+                    current_pool.address.virtual_pool_id,
+                );
+            }
+        }
+        if self.replica_pools.is_empty() || query_route(query) != Route::Replica {
+            return None;
+        }
+        // Only the replicas within max_replica_lag that replayed the last write of the client.
+        let replicas: Vec<&String> = self
+            .replica_pools
+            .iter()
+            .filter(|replica| replica_usable(replica, self.max_replica_lag, self.written_lsn))
+            .collect();
+        if replicas.is_empty() {
+            return None;
+        }
+        let replica = replicas[counter % replicas.len()];
+        get_pool(
+            replica,
+            &self.username,
+            current_pool.address.virtual_pool_id,
+        )
+    }
+
+    /// Text of the first statement of the transaction starting with the message,
+    /// a bound prepared statement counts as its query.
+    fn transaction_query<'a>(&'a self, message: &'a BytesMut) -> Option<&'a str> {
+        match message[0] as char {
+            'Q' => statement_text(message),
+            _ => match self.extended_protocol_data_buffer.front() {
+                Some(ExtendedProtocolData::Parse { data, .. }) => statement_text(data),
+                Some(ExtendedProtocolData::Bind {
+                    metadata: Some(name),
+                    ..
+                }) => self
+                    .prepared_statements
+                    .get(name)
+                    .map(|(parse, _)| parse.query()),
+                _ => None,
+            },
+        }
+    }
+
     /// Retrieve connection pool, if it exists.
     /// Return an error to the client otherwise.
     async fn get_pool(&mut self, client_counter: usize) -> Result<ConnectionPool, Error> {
@@ -1644,30 +2703,703 @@ where
         }
     }
 
+    /// Statement texts of the buffered extended protocol batch for the slow query log,
+    /// one for each Bind.
+    fn batch_statements(&self) -> Vec<String> {
+        let mut statements = Vec::new();
+        if self.slow_query_threshold.is_zero() {
+            return statements;
+        }
+        let mut parsed = None;
+        for protocol_data in &self.extended_protocol_data_buffer {
+            match protocol_data {
+                ExtendedProtocolData::Parse { data, .. } => parsed = statement_text(data),
+                ExtendedProtocolData::Bind {
+                    metadata: Some(client_given_name),
+                    ..
+                } => {
+                    if let Some((parse, _)) = self.prepared_statements.get(client_given_name) {
+                        statements.push(parse.query().to_string());
+                    }
+                }
+                ExtendedProtocolData::Bind { metadata: None, .. } => {
+                    statements.extend(parsed.map(str::to_string));
+                }
+                _ => (),
+            }
+        }
+        statements
+    }
+
+    /// Log the statements of a round trip started at `sent_at` if it was slow,
+    /// `wait_us` is the time the client waited for its server.
+    fn log_slow_query(
+        &self,
+        sent_at: Instant,
+        wait_us: u64,
+        statements: impl FnOnce() -> Vec<String>,
+    ) {
+        let duration = sent_at.elapsed();
+        if self.slow_query_threshold.is_zero() || duration < self.slow_query_threshold {
+            return;
+        }
+        log_slow_query(
+            &self.pool_name,
+            &self.username,
+            &statements(),
+            duration,
+            Duration::from_micros(wait_us),
+            self.slow_query_threshold,
+            self.slow_query_log_rate,
+        );
+    }
+
+    /// Start collecting the CommandComplete tags of the statements sent to the server
+    /// if the client is audited.
+    fn audit_begin(&self, server: &mut Server) -> Option<Instant> {
+        if !self.audit {
+            return None;
+        }
+        server.collect_command_tags();
+        Some(Instant::now())
+    }
+
+    /// audit_begin for a Query message.
+    fn audit_query(&mut self, message: &BytesMut, server: &mut Server) -> Option<Instant> {
+        if !self.audit {
+            return None;
+        }
+        if let Some(query) = statement_text(message) {
+            self.audit_pending.push((query.to_string(), None));
+        }
+        self.audit_begin(server)
+    }
+
+    /// Remember the statement text of a Parse message for the Binds of the statement.
+    fn audit_parse(&mut self, message: &BytesMut) {
+        if !self.audit {
+            return;
+        }
+        if let (Ok(name), Some(query)) = (Parse::get_name(message), statement_text(message)) {
+            self.audit_statements.insert(name, query.to_string());
+        }
+    }
+
+    fn audit_bind(&mut self, message: &BytesMut) -> Result<(), Error> {
+        if !self.audit {
+            return Ok(());
+        }
+        let bind: Bind = message.try_into()?;
+        let statement = self
+            .audit_statements
+            .get(&bind.prepared_statement)
+            .cloned()
+            .unwrap_or_default();
+        self.audit_pending
+            .push((statement, Some(bind.parameters_hash())));
+        Ok(())
+    }
+
+    /// Write the statements sent since audit_begin to the audit log. Each statement
+    /// gets the next CommandComplete tag, the last one all that remain (a Query
+    /// may hold several statements), a failed statement none.
+    fn write_audit_records(&mut self, started_at: Option<Instant>, command_tags: Vec<String>) {
+        let started_at = match started_at {
+            Some(started_at) => started_at,
+            None => return,
+        };
+        let duration_us = started_at.elapsed().as_micros() as u64;
+        let mut command_tags = command_tags.into_iter();
+        let count = self.audit_pending.len();
+        for (index, (statement, parameters_hash)) in self.audit_pending.drain(..).enumerate() {
+            let tags: Vec<String> = if index + 1 < count {
+                command_tags.next().into_iter().collect()
+            } else {
+                command_tags.by_ref().collect()
+            };
+            let rows = tags
+                .iter()
+                .filter_map(|tag| rows_affected(tag))
+                .reduce(|total, rows| total + rows);
+            audit(&AuditRecord {
+                client: self.addr.to_string(),
+                pool: self.pool_name.clone(),
+                user: self.username.clone(),
+                statement,
+                parameters_hash,
+                duration_us,
+                command_tag: (!tags.is_empty()).then(|| tags.join("; ")),
+                rows,
+            });
+        }
+    }
+
+    /// Session state of the client the cached results depend on: the server
+    /// parameters changing them and the session parameters.
+    fn result_cache_session(&self) -> Vec<u8> {
+        session_key(
+            RESULT_SERVER_PARAMETERS
+                .iter()
+                .filter_map(|&name| {
+                    self.server_parameters
+                        .get(name)
+                        .map(|value| (name, value.as_str()))
+                })
+                .chain(
+                    self.session_parameters
+                        .iter()
+                        .map(|(name, value)| (name.as_str(), value.as_str())),
+                ),
+        )
+    }
+
+    /// Key of the statement of the request in the result cache: a Query, or a Sync
+    /// after a single Bind and Execute of the unnamed portal.
+    fn result_cache_key(&self, message: &BytesMut) -> Option<ResultCacheKey> {
+        let database = self.result_cache_database.as_ref()?;
+        let session = self.result_cache_session();
+        match message[0] as char {
+            'Q' => {
+                let query = statement_text(message)?;
+                result_cache_key(
+                    database,
+                    &self.username,
+                    &session,
+                    b"Q",
+                    query,
+                    query.as_bytes(),
+                )
+            }
+            'S' => {
+                let mut messages = Vec::new();
+                let mut parsed = None;
+                let mut query = None;
+                let mut parameters = None;
+                for protocol_data in &self.extended_protocol_data_buffer {
+                    match protocol_data {
+                        // A named statement the server keeps, it must get the Parse.
+                        ExtendedProtocolData::Parse {
+                            data,
+                            metadata: None,
+                        } if data.get(5) != Some(&0) => {
+                            return None;
+                        }
+                        ExtendedProtocolData::Parse { data, .. } => {
+                            messages.push(b'P');
+                            parsed = statement_text(data);
+                        }
+                        ExtendedProtocolData::Bind { data, metadata } => {
+                            if parameters.is_some() {
+                                return None;
+                            }
+                            messages.push(b'B');
+                            query = match metadata {
+                                Some(name) => self
+                                    .prepared_statements
+                                    .get(name)
+                                    .map(|(parse, _)| parse.query()),
+                                None => parsed,
+                            };
+                            parameters = Some(Bind::unnamed_portal_parameters(data)?);
+                        }
+                        ExtendedProtocolData::Describe { data, .. } => {
+                            messages.push(b'D');
+                            messages.push(*data.get(5)?);
+                        }
+                        // All rows of the unnamed portal, once.
+                        ExtendedProtocolData::Execute { data }
+                            if parameters.is_some()
+                                && !messages.contains(&b'E')
+                                && data.get(5..) == Some(&[0; 5][..]) =>
+                        {
+                            messages.push(b'E');
+                        }
+                        _ => return None,
+                    }
+                }
+                if messages.last() != Some(&b'E') {
+                    return None;
+                }
+                result_cache_key(
+                    database,
+                    &self.username,
+                    &session,
+                    &messages,
+                    query?,
+                    parameters?,
+                )
+            }
+            _ => None,
+        }
+    }
+
+    /// Send the cached result of the statement of the request. On a miss, start
+    /// capturing the responses to it for the cache.
+    async fn serve_cached_result(&mut self, message: &BytesMut) -> Result<bool, Error> {
+        self.result_cache_key = None;
+        self.result_cache_response.clear();
+        let key = match self.result_cache_key(message) {
+            Some(key) => key,
+            None => return Ok(false),
+        };
+        match cached_result(&key) {
+            Some(response) => {
+                if message[0] as char == 'S' {
+                    self.reset_buffered_state();
+                }
+                write_all_flush(&mut self.write, &response).await?;
+                self.stats.query();
+                self.stats.transaction();
+                Ok(true)
+            }
+            None => {
+                self.result_cache_key = Some(key);
+                Ok(false)
+            }
+        }
+    }
+
+    /// Add the responses sent to the client to the result captured for the cache.
+    fn capture_result(&mut self, response: &[u8]) {
+        let key = match self.result_cache_key.as_ref() {
+            Some(key) => key,
+            None => return,
+        };
+        if self.result_cache_response.len() + response.len() > key.max_result_size {
+            self.result_cache_key = None;
+            self.result_cache_response = BytesMut::new();
+            return;
+        }
+        self.result_cache_response.put(response);
+    }
+
+    /// Start collecting the CommandComplete tags of the server for the mirror diffs.
+    fn mirror_begin(&self, server: &mut Server) {
+        if self.mirror.as_ref().is_some_and(Mirror::log_diffs) {
+            server.collect_command_tags();
+        }
+    }
+
+    /// Remember the prepared statement of a Bind or Describe for the mirror.
+    fn mirror_statement(&self, client_given_name: &str, statements: &mut Vec<Arc<Parse>>) {
+        if self.mirror.is_none() {
+            return;
+        }
+        if let Some((parse, _)) = self.prepared_statements.get(client_given_name) {
+            statements.push(parse.clone());
+        }
+    }
+
+    /// Queue the messages sent to the server for the mirror, `complete` at the end of a
+    /// request. COPY isn't mirrored: the data of the client doesn't go through here.
+    fn mirror_request(
+        &mut self,
+        messages: &[u8],
+        statements: Vec<Arc<Parse>>,
+        command_tags: &[String],
+        complete: bool,
+        server: &Server,
+    ) {
+        let mirror = match self.mirror.as_mut() {
+            Some(mirror) => mirror,
+            None => return,
+        };
+        if server.in_copy_mode() {
+            mirror.discard();
+            return;
+        }
+        mirror.add(messages, statements, command_tags.to_vec(), complete);
+    }
+
+    /// Reject a statement missing from the statement_allowlist of the user, the client
+    /// gets an error and is disconnected. In record mode the statement is added instead.
+    async fn check_statement_allowlist(
+        &mut self,
+        message: &BytesMut,
+        pool: &ConnectionPool,
+    ) -> Result<(), Error> {
+        let user = &pool.settings.user;
+        let path = match user.statement_allowlist {
+            Some(ref path) => path,
+            None => return Ok(()),
+        };
+        let mode = user.statement_allowlist_mode.unwrap_or_default();
+        let fingerprint = match check_statement(path, mode, message) {
+            Ok(()) => return Ok(()),
+            Err(fingerprint) => fingerprint,
+        };
+        warn!(
+            "Client {} {{ pool_name: {:?}, username: {:?} }} ran statement {fingerprint} missing from statement_allowlist {path}",
+            self.addr, self.pool_name, self.username
+        );
+        self.stats.checkout_error();
+        error_response(
+            &mut self.write,
+            &format!(
+                "statement {fingerprint} is not in the statement allowlist of user {}",
+                self.username
+            ),
+            "42501",
+        )
+        .await?;
+        Err(Error::StatementNotAllowed(fingerprint))
+    }
+
+    /// Remember a SET ROLE or SET SESSION AUTHORIZATION of the client, so the server
+    /// is reset at checkin. With reject_role_changes it's refused in transaction mode.
+    async fn check_role_change(&mut self, message: &BytesMut) -> Result<(), Error> {
+        if !role_change(message) {
+            return Ok(());
+        }
+        if !(self.reject_role_changes && self.transaction_mode) {
+            self.role_change_pending = true;
+            return Ok(());
+        }
+        warn!(
+            "Client {} {{ pool_name: {:?}, username: {:?} }} tried to change the role in transaction mode",
+            self.addr, self.pool_name, self.username
+        );
+        self.stats.checkout_error();
+        error_response(
+            &mut self.write,
+            "SET ROLE and SET SESSION AUTHORIZATION are not allowed in transaction pooling mode, use SET LOCAL ROLE inside a transaction",
+            "42501",
+        )
+        .await?;
+        Err(Error::RoleChangeNotAllowed)
+    }
+
+    /// Refuse SET client_encoding, SET NAMES and set_config() switching the session to
+    /// another encoding than the client_encoding of the pool.
+    async fn check_client_encoding_change(&mut self, message: &BytesMut) -> Result<(), Error> {
+        let encoding = match self.client_encoding {
+            Some(ref encoding) => encoding.clone(),
+            None => return Ok(()),
+        };
+        let changes = client_encoding_changes(message);
+        if changes.is_empty() {
+            return Ok(());
+        }
+        let config = get_config();
+        let requested = match config.pool_config(&self.pool_name).and_then(|pool_config| {
+            changes
+                .into_iter()
+                .find(|requested| !pool_config.allows_client_encoding(requested))
+        }) {
+            Some(requested) => requested,
+            None => return Ok(()),
+        };
+        warn!(
+            "Client {} {{ pool_name: {:?}, username: {:?} }} tried to switch client_encoding to {requested}",
+            self.addr, self.pool_name, self.username
+        );
+        self.stats.checkout_error();
+        error_response(
+            &mut self.write,
+            &format!(
+                "client_encoding \"{requested}\" is not allowed for database \"{}\", use \"{encoding}\"",
+                self.pool_name
+            ),
+            "22023",
+        )
+        .await?;
+        Err(Error::ClientEncodingNotAllowed(requested))
+    }
+
+    /// Let the server know the client changed the role.
+    fn track_role_change(&mut self, server: &mut Server) {
+        if std::mem::take(&mut self.role_change_pending) {
+            server.mark_role_changed();
+        }
+    }
+
+    /// Let the server know the message takes session-level advisory locks.
+    fn track_advisory_locks(&self, message: &BytesMut, server: &mut Server) {
+        if self.release_advisory_locks && acquires_advisory_lock(message) {
+            server.set_advisory_locks(true);
+        }
+    }
+
+    /// Remember a two-phase commit command sent by the client, if the pool tracks them.
+    fn track_two_phase(&mut self, message: &BytesMut) {
+        if !self.track_prepared_transactions {
+            return;
+        }
+        if let Some(command) = two_phase_command(message) {
+            self.pending_two_phase = Some(command);
+        }
+    }
+
+    /// Record the pending two-phase commit command once the server completed it.
+    fn finish_two_phase(&mut self, server: &mut Server) {
+        let completed = server.take_two_phase_completed();
+        if let Some(command) = self.pending_two_phase.take() {
+            if completed {
+                track_two_phase_command(&self.pool_name, &self.username, &command);
+            }
+        }
+    }
+
+    /// Read the next client message of a session that ran LISTEN, meanwhile forwarding
+    /// the notifications the server sends between transactions.
+    async fn read_client_message_with_notifications(
+        &mut self,
+        server: &mut Server,
+    ) -> Result<BytesMut, Error> {
+        let interval = Duration::from_millis(self.client_keepalive_interval);
+        loop {
+            tokio::select! {
+                // fill_buf is cancel safe: the data stays buffered for read_message.
+                _ = self.read.fill_buf() => break,
+                readable = server.wait_readable() => {
+                    readable?;
+                    let message = server.recv_notification().await?;
+                    write_all_flush(&mut self.write, &message).await?;
+                }
+                _ = tokio::time::sleep(interval), if self.client_keepalive_interval > 0 => {
+                    self.send_keepalive().await?;
+                }
+            }
+        }
+        self.read_client_message(false).await
+    }
+
+    /// Wait until the client sends something, meanwhile sending it a no-op ParameterStatus
+    /// every client_keepalive_interval, so load balancers don't drop the idle connection.
+    async fn wait_with_keepalive(&mut self) -> Result<(), Error> {
+        let interval = Duration::from_millis(self.client_keepalive_interval);
+        loop {
+            tokio::select! {
+                // fill_buf is cancel safe: the data stays buffered for read_message.
+                _ = self.read.fill_buf() => return Ok(()),
+                _ = tokio::time::sleep(interval) => self.send_keepalive().await?,
+            }
+        }
+    }
+
+    /// The no-op ParameterStatus (the current application_name) of client_keepalive_interval.
+    async fn send_keepalive(&mut self) -> Result<(), Error> {
+        let keepalive = server_parameter_message(
+            "application_name",
+            self.server_parameters.get_application_name(),
+        );
+        write_all_flush(&mut self.write, &keepalive).await
+    }
+
+    /// Read the next client message. While an extended protocol batch is unfinished the
+    /// wait is limited by batch_message_timeout and what is left of batch_timeout.
+    async fn read_client_message(&mut self, keepalive: bool) -> Result<BytesMut, Error> {
+        let timeout =
+            self.batch_phase_timeout(self.batch_message_timeout, Error::BatchMessageTimeout);
+        let message = with_batch_timeout(timeout, async {
+            if keepalive && self.client_keepalive_interval > 0 {
+                self.wait_with_keepalive().await?;
+            }
+            read_message(&mut self.read, self.max_memory_usage).await
+        })
+        .await?;
+        if self.batch_started_at.is_none() && matches!(message[0], b'P' | b'B' | b'D' | b'E' | b'C')
+        {
+            self.batch_started_at = Some(Instant::now());
+        }
+        Ok(message)
+    }
+
+    /// Timeout of a phase of the unfinished extended protocol batch: `phase_timeout` (ms, 0
+    /// disables) or what is left of batch_timeout, whichever is shorter, with its error.
+    fn batch_phase_timeout(
+        &self,
+        phase_timeout: u64,
+        phase_error: Error,
+    ) -> Option<(Duration, Error)> {
+        let started_at = self.batch_started_at?;
+        let mut timeout = None;
+        if phase_timeout > 0 {
+            timeout = Some((Duration::from_millis(phase_timeout), phase_error));
+        }
+        if self.batch_timeout > 0 {
+            let remaining =
+                Duration::from_millis(self.batch_timeout).saturating_sub(started_at.elapsed());
+            if timeout
+                .as_ref()
+                .is_none_or(|(duration, _)| remaining < *duration)
+            {
+                timeout = Some((remaining, Error::BatchTimeout));
+            }
+        }
+        timeout
+    }
+
+    /// Tell the client that its query waits in the checkout queue and for how long.
+    async fn send_queue_notice(
+        &mut self,
+        pool: &ConnectionPool,
+        waiting_since: Instant,
+    ) -> Result<(), Error> {
+        // The pool counts this client among the waiting ones.
+        let ahead = pool.pool_state().waiting.saturating_sub(1);
+        let message = format!(
+            "waiting for a server connection for {:.1}s, queued behind {} clients",
+            waiting_since.elapsed().as_secs_f64(),
+            ahead
+        );
+        debug!(
+            "Client {} {{ pool_name: {:?}, username: {:?} }} {}",
+            self.addr, self.pool_name, self.username, message
+        );
+        write_all_flush(&mut self.write, &notice_message(&message)).await
+    }
+
     /// Release the server from the client: it can't cancel its queries anymore.
     pub fn release(&self) {
         let mut guard = self.client_server_map.lock();
         guard.remove(&(self.process_id, self.secret_key));
     }
 
+    /// Relay a logical replication client to a server connection of its own, opened
+    /// to the main host of the database, until one of them disconnects.
+    async fn relay_replication(&mut self) -> Result<(), Error> {
+        let config = get_config();
+        let database = self
+            .pool_name
+            .rsplit_once(PARTITION_SEPARATOR)
+            .map_or(self.pool_name.as_str(), |(database, _)| database)
+            .to_string();
+        let (pool_config, pool) = match (
+            config.pool_config(&database),
+            get_pool(&database, &self.username, 0),
+        ) {
+            (Some(pool_config), Some(pool)) => (pool_config, pool),
+            _ => {
+                error_response_terminal(
+                    &mut self.write,
+                    &format!("no pool for database {database}"),
+                    "3D000",
+                )
+                .await?;
+                return Err(Error::ClientError(format!(
+                    "no pool for the replication connection to {database}"
+                )));
+            }
+        };
+
+        let _permit = match try_acquire_replication_permit(
+            &database,
+            pool_config.max_replication_connections,
+        ) {
+            Some(permit) => permit,
+            None => {
+                error_response_terminal(
+                    &mut self.write,
+                    &format!("too many replication connections for database {database}"),
+                    "53300",
+                )
+                .await?;
+                return Err(Error::ClientError(format!(
+                    "max_replication_connections reached for {database}"
+                )));
+            }
+        };
+
+        let server_database = pool_config
+            .server_database
+            .clone()
+            .unwrap_or(pool.address.database.clone());
+        let stats = Arc::new(ServerStats::new(
+            pool.address.clone(),
+            tokio::time::Instant::now(),
+        ));
+        stats.register(stats.clone());
+        let connect_timeout = Duration::from_millis(
+            pool_config
+                .connect_timeout
+                .unwrap_or(config.general.connect_timeout),
+        );
+        let connect = Server::startup_replication(
+            &pool.address,
+            &pool.settings.user,
+            &server_database,
+            self.client_server_map.clone(),
+            stats,
+            self.server_parameters.get_application_name().clone(),
+        );
+        let mut server = match tokio::time::timeout(connect_timeout, connect).await {
+            Ok(Ok(server)) => server,
+            Ok(Err(err)) => {
+                error_response_terminal(
+                    &mut self.write,
+                    &format!("replication connection to the server failed: {err}"),
+                    "08006",
+                )
+                .await?;
+                return Err(err);
+            }
+            Err(_) => {
+                error_response_terminal(
+                    &mut self.write,
+                    "replication connection to the server timed out",
+                    "08006",
+                )
+                .await?;
+                return Err(Error::SocketError(format!(
+                    "replication connection to {} timed out",
+                    pool.address
+                )));
+            }
+        };
+        info!(
+            "Client {} relayed to the replication connection {}",
+            self.addr, server
+        );
+
+        server.claim(self.process_id, self.secret_key);
+        let result = server.relay(&mut self.read, &mut self.write).await;
+        self.release();
+        result?;
+        self.stats.disconnect();
+        Ok(())
+    }
+
     async fn send_and_receive_loop(
         &mut self,
         message: Option<&BytesMut>,
         server: &mut Server,
     ) -> Result<(), Error> {
+        // Batch timeouts apply to the extended protocol, sent from the buffer.
+        let batch = message.is_none();
         let message = message.unwrap_or(&self.buffer);
         server
             .send_and_flush_timeout(message, Duration::from_secs(5))
             .await?;
+        let mut first_response = true;
         // Read all data the server has to offer, which can be multiple messages
         // buffered in 8196 bytes chunks.
         loop {
             self.stats.active_idle();
-            let mut response = match server
-                .recv(&mut self.write, Some(&mut self.server_parameters))
-                .await
+            let timeout = match (batch, first_response) {
+                (false, _) => None,
+                (true, true) => {
+                    self.batch_phase_timeout(self.sync_response_timeout, Error::SyncResponseTimeout)
+                }
+                (true, false) => self.batch_phase_timeout(0, Error::BatchTimeout),
+            };
+            first_response = false;
+            let mut response = match with_batch_timeout(
+                timeout,
+                server.recv(&mut self.write, Some(&mut self.server_parameters)),
+            )
+            .await
             {
                 Ok(msg) => msg,
+                Err(
+                    err @ (Error::SyncResponseTimeout
+                    | Error::BatchTimeout
+                    | Error::BatchMessageTimeout),
+                ) => {
+                    // The response was cut off mid-way, the server can't be reused.
+                    server.mark_bad(format!("loop with client {}: {}", self.addr, err).as_str());
+                    return self.process_error(err).await;
+                }
                 Err(err) => {
                     server.wait_available().await;
                     server.mark_bad(format!("loop with client {}: {:?}", self.addr, err).as_str());
@@ -1691,6 +3423,12 @@ where
                 self.response_message_queue_buffer.clear();
             }
 
+            // A large message went to the client as it came, the result is incomplete.
+            if response.is_empty() && server.is_data_available() {
+                self.result_cache_key = None;
+            }
+            self.capture_result(&response);
+
             self.stats.active_write();
             match write_all_flush(&mut self.write, &response).await {
                 Ok(_) => self.stats.active_idle(),
@@ -1707,6 +3445,10 @@ where
                 break;
             }
         }
+        // Only results of statements outside a transaction are cached.
+        if server.in_transaction() || server.in_copy_mode() {
+            self.result_cache_key = None;
+        }
 
         Ok(())
     }
@@ -1787,11 +3529,70 @@ where
                 .await?;
                 Err(err)
             }
+            Error::SyncResponseTimeout => {
+                error_response(
+                    &mut self.write,
+                    "canceling statement due to sync_response_timeout: the server did not answer the batch in time",
+                    "57014",
+                )
+                .await?;
+                Err(err)
+            }
+            Error::BatchTimeout => {
+                error_response(
+                    &mut self.write,
+                    "canceling batch due to batch_timeout: the extended protocol batch took too long",
+                    "57014",
+                )
+                .await?;
+                Err(err)
+            }
+            Error::BatchMessageTimeout => {
+                error_response(
+                    &mut self.write,
+                    "terminating connection due to batch_message_timeout: the client stopped sending its unfinished batch",
+                    "25P03",
+                )
+                .await?;
+                Err(err)
+            }
+            Error::TransactionDurationLimit => {
+                error_response(
+                    &mut self.write,
+                    "terminating connection due to transaction_duration_limit: the transaction took too long",
+                    "25P04",
+                )
+                .await?;
+                Err(err)
+            }
             _ => Err(err),
         }
     }
 }
 
+/// Run `future` within the batch timeout, if any, counting the timeouts by kind.
+async fn with_batch_timeout<F, R>(timeout: Option<(Duration, Error)>, future: F) -> Result<R, Error>
+where
+    F: std::future::Future<Output = Result<R, Error>>,
+{
+    let (duration, err) = match timeout {
+        Some(timeout) => timeout,
+        None => return future.await,
+    };
+    match tokio::time::timeout(duration, future).await {
+        Ok(result) => result,
+        Err(_) => {
+            let counter = match err {
+                Error::SyncResponseTimeout => &SYNC_RESPONSE_TIMEOUT_COUNTER,
+                Error::BatchTimeout => &BATCH_TIMEOUT_COUNTER,
+                _ => &BATCH_MESSAGE_TIMEOUT_COUNTER,
+            };
+            counter.fetch_add(1, Ordering::Relaxed);
+            Err(err)
+        }
+    }
+}
+
 impl<S, T> Drop for Client<S, T> {
     fn drop(&mut self) {
         let mut guard = self.client_server_map.lock();
@@ -1803,5 +3604,14 @@ impl<S, T> Drop for Client<S, T> {
                 stats.idle(0);
             }
         }
+
+        if !self.cancel_mode {
+            emit_event(|| Event::ClientDisconnect {
+                client: self.addr.to_string(),
+                pool: self.pool_name.clone(),
+                user: self.username.clone(),
+                duration_ms: self.created_at.elapsed().as_millis() as u64,
+            });
+        }
     }
 }
@@ -0,0 +1,128 @@
+// Configuration shared by a fleet of instances.
+//
+// With cluster.url set, every instance fetches a TOML document from the shared
+// store (a Consul key with ?raw, an object storage URL, any HTTP server) and
+// merges it over its config file. The document is polled on ticks aligned to
+// the wall clock, so all instances see a new version at the same tick, and it
+// is validated the same way everywhere: either the whole fleet switches to the
+// version or it all stays on the previous one.
+
+// Standard library imports
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+// External crate imports
+use log::{error, info};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use sha2::{Digest, Sha256};
+
+// Internal crate imports
+use crate::config::{get_config, reload_config, Cluster};
+use crate::errors::Error;
+use crate::http_client::http_get;
+use crate::pool::ClientServerMap;
+
+/// A version of the shared document.
+#[derive(Debug, Clone, PartialEq)]
+struct RemoteConfig {
+    version: String,
+    contents: String,
+}
+
+/// The shared document the config is built from.
+static REMOTE_CONFIG: Lazy<Mutex<Option<RemoteConfig>>> = Lazy::new(|| Mutex::new(None));
+
+/// Version (hash) of the shared document in use, if any.
+pub fn config_version() -> Option<String> {
+    REMOTE_CONFIG
+        .lock()
+        .as_ref()
+        .map(|remote| remote.version.clone())
+}
+
+fn version_of(contents: &str) -> String {
+    let digest = Sha256::digest(contents.as_bytes());
+    digest[..8].iter().map(|b| format!("{b:02x}")).collect()
+}
+
+async fn fetch(cluster: &Cluster) -> Result<String, Error> {
+    http_get(
+        &cluster.url,
+        &cluster.headers,
+        Duration::from_millis(cluster.timeout),
+    )
+    .await
+}
+
+/// The shared document to build the config from: the version in use,
+/// or a freshly fetched one on start.
+pub async fn remote_config(cluster: &Cluster) -> Result<String, Error> {
+    if let Some(remote) = REMOTE_CONFIG.lock().as_ref() {
+        return Ok(remote.contents.clone());
+    }
+    let contents = fetch(cluster).await?;
+    let version = version_of(&contents);
+    info!("Using config version {version} from {}", cluster.url);
+    *REMOTE_CONFIG.lock() = Some(RemoteConfig {
+        version,
+        contents: contents.clone(),
+    });
+    Ok(contents)
+}
+
+/// Time until the next tick of the interval, counted from the Unix epoch.
+fn until_next_tick(interval: u64) -> Duration {
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_millis() as u64;
+    Duration::from_millis(interval - now % interval)
+}
+
+/// Poll the shared document and switch to its new versions.
+pub async fn watch_cluster_config(client_server_map: ClientServerMap) {
+    loop {
+        let cluster = get_config().cluster;
+        if cluster.is_empty() {
+            return;
+        }
+        tokio::time::sleep(until_next_tick(cluster.interval)).await;
+
+        let contents = match fetch(&cluster).await {
+            Ok(contents) => contents,
+            Err(err) => {
+                error!("Config version check failed: {err}");
+                continue;
+            }
+        };
+        let version = version_of(&contents);
+        let previous = REMOTE_CONFIG.lock().clone();
+        if previous.as_ref().map(|remote| &remote.version) == Some(&version) {
+            continue;
+        }
+
+        info!("Switching to config version {version} from {}", cluster.url);
+        *REMOTE_CONFIG.lock() = Some(RemoteConfig {
+            version: version.clone(),
+            contents,
+        });
+        if reload_config(client_server_map.clone()).await.is_err() {
+            // Stay on the version in use, the next tick checks again.
+            error!("Config version {version} rejected");
+            *REMOTE_CONFIG.lock() = previous;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_until_next_tick() {
+        let wait = until_next_tick(10_000);
+        assert!(wait > Duration::ZERO && wait <= Duration::from_millis(10_000));
+        assert_eq!(version_of("a"), version_of("a"));
+        assert_ne!(version_of("a"), version_of("b"));
+    }
+}
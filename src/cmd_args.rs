@@ -28,6 +28,13 @@ pub struct Args {
 
     #[arg(short, long, default_value_t = false, env, help = "run as daemon")]
     pub daemon: bool,
+
+    #[arg(
+        long,
+        default_value_t = false,
+        help = "parse and validate the configuration, report its problems and exit"
+    )]
+    pub check_config: bool,
 }
 
 #[derive(Subcommand, Debug)]
@@ -37,6 +44,21 @@ pub enum Commands {
         #[clap(flatten)]
         config: GenerateConfig,
     },
+    /// Check the configuration end-to-end (listeners, TLS, backends) and print a report
+    Selftest,
+    /// Serve the traffic for a while, then report what would break in transaction pooling mode and exit
+    Analyze {
+        /// How long to observe the traffic, in seconds.
+        #[arg(long, default_value_t = 3600)]
+        duration: u64,
+        /// Report transactions idle for longer than this, in milliseconds.
+        #[arg(long, default_value_t = 1000)]
+        idle_in_transaction_ms: u64,
+        /// Output file for the report.
+        /// If not specified, uses stdout.
+        #[arg(short, long)]
+        output: Option<String>,
+    },
 }
 
 #[derive(Debug, Clone, Parser)]
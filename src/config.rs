@@ -1,30 +1,49 @@
-use crate::constants::JWT_PUB_KEY_PASSWORD_PREFIX;
+use crate::constants::{JWT_PUB_KEY_PASSWORD_PREFIX, POOL_HINT_PARAMETER};
 use arc_swap::ArcSwap;
 use bytes::{BufMut, BytesMut};
 use ipnet::IpNet;
-use log::{error, info};
+use log::{error, info, warn};
 use once_cell::sync::Lazy;
 use serde_derive::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
 use std::cmp::PartialEq;
 use std::collections::hash_map::DefaultHasher;
-use std::collections::{BTreeMap, HashMap};
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fmt::Display;
 use std::hash::{Hash, Hasher};
 use std::mem;
-use std::net::IpAddr;
+use std::net::{IpAddr, SocketAddr};
 use std::path::Path;
 use std::sync::atomic::{AtomicU64, Ordering};
 use std::sync::Arc;
 use tokio::fs::File;
 use tokio::io::AsyncReadExt;
 
+use crate::audit::{set_audit_log, validate_audit_log};
+use crate::auth::auth_query::DEFAULT_AUTH_QUERY;
+use crate::auth::cert::{load_cert_ident_maps, set_cert_ident_maps, CertIdentMaps};
 use crate::auth::jwt::load_jwt_pub_key;
+use crate::auth::jwt_issuer::{check_jwt_issuer_keys, jwt_issuer_names, load_jwt_issuers};
+use crate::auth::ldap::parse_ldap_url;
 use crate::auth::talos::load_talos_pub_key;
+use crate::cluster_config::{config_version, remote_config};
+use crate::config_env::apply_env;
+use crate::config_migration::migrate_config;
+use crate::config_watch::set_config_files;
 use crate::errors::Error;
+use crate::events::{emit_event, set_event_sink, validate_event_sink, Event};
+use crate::format_host_port;
+use crate::hba::{load_hba_file, set_hba_rules, HbaRules};
 use crate::pool::{ClientServerMap, ConnectionPool};
+use crate::query_routes::{load_query_routes, set_query_routes, QueryRoutes, PRIMARY_TARGET};
+use crate::redact::set_redact_query_literals;
+use crate::result_cache::{load_result_caches, set_result_caches, ResultCaches};
+use crate::statement_allowlist::{
+    load_statement_allowlists, set_statement_allowlists, StatementAllowlists,
+};
 use crate::stats::AddressStats;
 use crate::tls;
-use crate::tls::{load_identity, TLSMode};
+use crate::tls::{build_server_connector, load_identity, TLSMode};
 
 pub const VERSION: &str = env!("CARGO_PKG_VERSION");
 
@@ -145,10 +164,90 @@ impl Display for PoolMode {
     }
 }
 
+/// Statement allowlist mode:
+/// - enforce: statements not in the allowlist are rejected,
+/// - record: all statements run and new ones are added to the allowlist.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Copy, Hash, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum StatementAllowlistMode {
+    #[default]
+    Enforce,
+    Record,
+}
+
+/// How new server connections of a pool pick one of its hosts:
+/// - round_robin: the hosts take turns,
+/// - least_connections: the host with the fewest open server connections,
+/// - weighted: the hosts take turns in proportion to their server_weights,
+/// - failover: all go to the first healthy host, server_host while it's up.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Copy, Hash, Default)]
+#[serde(rename_all = "snake_case")]
+pub enum LoadBalancing {
+    #[default]
+    RoundRobin,
+    LeastConnections,
+    Weighted,
+    Failover,
+}
+
+/// TLS of the server connections, as sslmode of libpq:
+/// - disable: plain connections,
+/// - prefer: TLS if the server supports it, the certificate isn't verified,
+/// - require: TLS, the certificate isn't verified,
+/// - verify-ca: TLS with a certificate signed by server_tls_ca_cert (the system roots by default),
+/// - verify-full: verify-ca and the certificate issued for the host (or server_tls_server_name).
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Copy, Hash)]
+#[serde(rename_all = "kebab-case")]
+pub enum ServerTlsMode {
+    Disable,
+    Prefer,
+    Require,
+    VerifyCa,
+    VerifyFull,
+}
+
+impl std::fmt::Display for ServerTlsMode {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            ServerTlsMode::Disable => write!(f, "disable"),
+            ServerTlsMode::Prefer => write!(f, "prefer"),
+            ServerTlsMode::Require => write!(f, "require"),
+            ServerTlsMode::VerifyCa => write!(f, "verify-ca"),
+            ServerTlsMode::VerifyFull => write!(f, "verify-full"),
+        }
+    }
+}
+
+/// TLS protocol version of the client connections.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Copy, Hash)]
+pub enum TlsVersion {
+    #[serde(rename = "1.0")]
+    V1_0,
+    #[serde(rename = "1.1")]
+    V1_1,
+    #[serde(rename = "1.2")]
+    V1_2,
+    #[serde(rename = "1.3")]
+    V1_3,
+}
+
+impl std::fmt::Display for TlsVersion {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            TlsVersion::V1_0 => write!(f, "1.0"),
+            TlsVersion::V1_1 => write!(f, "1.1"),
+            TlsVersion::V1_2 => write!(f, "1.2"),
+            TlsVersion::V1_3 => write!(f, "1.3"),
+        }
+    }
+}
+
 /// PostgreSQL user.
 #[derive(Clone, PartialEq, Hash, Eq, Serialize, Deserialize, Debug)]
 pub struct User {
     pub username: String,
+    // Empty in pools with auth_query: the password is looked up on the server.
+    #[serde(default)]
     pub password: String,
     pub pool_size: u32,
     pub min_pool_size: Option<u32>,
@@ -161,6 +260,29 @@ pub struct User {
     pub server_password: Option<String>,
     // Pam auth
     pub auth_pam_service: Option<String>,
+    // LDAP auth: name of a server in ldap_servers, overrides the pool setting.
+    pub auth_ldap_server: Option<String>,
+    // Certificate auth: name of a map in tls_cert_ident_file, overrides the pool setting.
+    pub auth_cert_map: Option<String>,
+    // Server-side prepared statement cache size for this user, overrides the pool setting.
+    #[serde(alias = "max_prepared_statements")]
+    pub prepared_statements_cache_size: Option<usize>,
+    // File with the fingerprints of the statements the user may run.
+    pub statement_allowlist: Option<String>,
+    pub statement_allowlist_mode: Option<StatementAllowlistMode>,
+    // Debugging: session mode without prepared statement rewriting and other interceptions,
+    // can be switched at runtime with the PASSTHROUGH admin command.
+    pub passthrough: Option<bool>,
+    // Transaction duration thresholds (ms) of the user, override the pool settings.
+    pub transaction_duration_warning: Option<u64>,
+    pub transaction_duration_limit: Option<u64>,
+    // Session timeouts (ms) set on the servers of the user, override the pool settings.
+    pub statement_timeout: Option<u64>,
+    pub idle_in_transaction_session_timeout: Option<u64>,
+    // Notice sent to the clients of the user at login, overrides the pool one.
+    pub login_notice: Option<String>,
+    // Write the statements of the user to the audit_log, overrides the pool setting.
+    pub audit: Option<bool>,
 }
 
 impl Default for User {
@@ -175,6 +297,18 @@ impl Default for User {
             server_username: None,
             server_password: None,
             auth_pam_service: None,
+            auth_ldap_server: None,
+            auth_cert_map: None,
+            prepared_statements_cache_size: None,
+            statement_allowlist: None,
+            statement_allowlist_mode: None,
+            passthrough: None,
+            transaction_duration_warning: None,
+            transaction_duration_limit: None,
+            statement_timeout: None,
+            idle_in_transaction_session_timeout: None,
+            login_notice: None,
+            audit: None,
         }
     }
 }
@@ -205,6 +339,18 @@ impl User {
                 )));
             }
         };
+        if self.prepared_statements_cache_size == Some(0) {
+            return Err(Error::BadConfig(format!(
+                "prepared_statements_cache_size of user {} should be greater than 0",
+                self.username
+            )));
+        }
+        if self.statement_allowlist_mode.is_some() && self.statement_allowlist.is_none() {
+            return Err(Error::BadConfig(format!(
+                "statement_allowlist_mode of user {} requires statement_allowlist",
+                self.username
+            )));
+        }
 
         Ok(())
     }
@@ -219,6 +365,18 @@ pub struct General {
     #[serde(default = "General::default_port")]
     pub port: u16,
 
+    /// Accept only IPv6 connections when listening on an IPv6 address.
+    /// When disabled, listening on "::" accepts both IPv4 and IPv6 clients.
+    #[serde(default)] // False
+    pub ipv6_only: bool,
+
+    /// Serve HTTP health checks and metrics (/metrics, with the exporter enabled) on the PostgreSQL listener too.
+    #[serde(default)] // False
+    pub http_on_main_port: bool,
+
+    /// Address (ip:port) of the HTTP server answering /livez and /readyz.
+    pub health_listen: Option<String>,
+
     #[serde(default = "General::default_virtual_pool_count")]
     pub virtual_pool_count: u16,
 
@@ -231,10 +389,58 @@ pub struct General {
     #[serde(default = "General::default_connect_timeout")]
     pub connect_timeout: u64,
 
+    // How long the addresses of a server host name are reused before it is resolved again (ms), 0 disables the cache.
+    #[serde(default = "General::default_dns_max_ttl")]
+    pub dns_max_ttl: u64,
+
+    // Close the server connection if the reset queries don't complete in time (ms), 0 disables.
+    #[serde(default = "General::default_server_reset_timeout")]
+    pub server_reset_timeout: u64,
+
     #[serde(default = "General::default_query_wait_timeout")]
     pub query_wait_timeout: u64,
 
-    #[serde(default = "General::default_idle_timeout")]
+    // Server connections a pool may open over pool_size for clients waiting
+    // longer than reserve_pool_timeout (ms), 0 disables.
+    #[serde(default)] // 0
+    pub reserve_pool_size: u32,
+    #[serde(default = "General::default_reserve_pool_timeout")]
+    pub reserve_pool_timeout: u64,
+
+    // Wait for min_pool_size server connections before accepting clients (ms), 0 disables.
+    #[serde(default)] // 0
+    pub pools_ready_timeout: u64,
+
+    // Send a notice to clients waiting for a server longer than this (ms), 0 disables.
+    #[serde(default)] // 0
+    pub queue_notice_threshold: u64,
+
+    // Log queries running longer than this (ms), 0 disables; at most slow_query_log_rate per second.
+    #[serde(default)] // 0
+    pub slow_query_threshold: u64,
+    #[serde(default = "General::default_slow_query_log_rate")] // 10
+    pub slow_query_log_rate: u32,
+
+    // Extended protocol batch timeouts (ms), 0 disables: the first backend response
+    // after Sync, the whole batch and the gap between client messages of the batch.
+    #[serde(default)] // 0
+    pub sync_response_timeout: u64,
+    #[serde(default)] // 0
+    pub batch_timeout: u64,
+    #[serde(default)] // 0
+    pub batch_message_timeout: u64,
+
+    // Identical startup packets from one address authenticated at once, 0 disables the pacing.
+    #[serde(default)] // 0
+    pub startup_burst_limit: usize,
+    // Random delay of the queued startups (ms), spreading out reconnect storms.
+    #[serde(default = "General::default_startup_pacing_jitter")]
+    pub startup_pacing_jitter: u64,
+
+    #[serde(
+        default = "General::default_idle_timeout",
+        alias = "server_idle_timeout"
+    )]
     pub idle_timeout: u64,
 
     #[serde(default = "General::default_tcp_keepalives_idle")]
@@ -248,6 +454,10 @@ pub struct General {
     #[serde(default = "General::default_tcp_no_delay")]
     pub tcp_no_delay: bool,
 
+    // Send a no-op ParameterStatus to idle clients this often (ms), 0 disables.
+    #[serde(default)] // 0
+    pub client_keepalive_interval: u64,
+
     #[serde(default = "General::default_unix_socket_buffer_size")]
     pub unix_socket_buffer_size: usize,
 
@@ -257,6 +467,16 @@ pub struct General {
     #[serde(default)] // True
     pub log_client_disconnections: bool,
 
+    /// Replace SQL string literals in logs and admin output.
+    #[serde(default)] // false
+    pub log_redact_query_literals: bool,
+
+    /// Write client, checkout and config events as JSON lines to `file:<path>` or `unix:<path>`.
+    pub event_sink: Option<String>,
+
+    /// Write the statements of the audited users and pools as JSON lines to `file:<path>` or `unix:<path>`.
+    pub audit_log: Option<String>,
+
     #[serde(default = "General::default_shutdown_timeout")] // 10_000
     pub shutdown_timeout: u64,
 
@@ -269,6 +489,18 @@ pub struct General {
     #[serde(default = "General::default_max_connections")]
     pub max_connections: u64,
 
+    // Cancel requests handled at the same time, extra ones are dropped (0 - unlimited).
+    #[serde(default = "General::default_max_cancel_connections")]
+    pub max_cancel_connections: usize,
+
+    // Databases served from the `*` pool entry, clients of others are refused (0 - unlimited).
+    #[serde(default = "General::default_max_wildcard_databases")]
+    pub max_wildcard_databases: usize,
+
+    // Time to forward a cancel request to the server (ms).
+    #[serde(default = "General::default_cancel_timeout")]
+    pub cancel_timeout: u64,
+
     #[serde(default = "General::default_server_lifetime")]
     pub server_lifetime: u64,
 
@@ -278,6 +510,10 @@ pub struct General {
     #[serde(default = "General::default_sync_server_parameters")] // False
     pub sync_server_parameters: bool,
 
+    // Track session-level advisory locks and release them before the server goes back to the pool.
+    #[serde(default = "General::default_release_advisory_locks")] // True
+    pub release_advisory_locks: bool,
+
     #[serde(default = "General::default_worker_threads")]
     pub worker_threads: usize,
 
@@ -303,6 +539,40 @@ pub struct General {
     pub tls_private_key: Option<String>,
     pub tls_ca_cert: Option<String>,
     pub tls_mode: Option<String>,
+
+    /// File with the maps (pg_ident.conf format) of client certificate names to users, for `auth_cert_map`.
+    pub tls_cert_ident_file: Option<String>,
+
+    /// Oldest TLS version accepted from the clients.
+    #[serde(default = "General::default_tls_min_version")]
+    pub tls_min_version: TlsVersion,
+
+    /// Newest TLS version accepted from the clients, the newest supported if not set.
+    pub tls_max_version: Option<TlsVersion>,
+
+    /// Ciphers of TLS 1.2 and older accepted from the clients, in the OpenSSL cipher list format.
+    pub tls_ciphers: Option<String>,
+
+    /// Cipher suites of TLS 1.3 accepted from the clients, colon-separated.
+    pub tls_ciphersuites: Option<String>,
+
+    /// Key exchange groups (curves) of the client connections in order of preference, colon-separated.
+    pub tls_curves: Option<String>,
+
+    /// Warn when the TLS certificates expire within this many days (0 disables warnings).
+    #[serde(default = "General::default_tls_certificate_expiry_warning_days")]
+    pub tls_certificate_expiry_warning_days: u64,
+
+    /// Check the client TLS certificate files this often (ms) and load them again
+    /// when they change, 0 disables it: they're loaded again on reload only.
+    #[serde(default = "General::default_tls_certificate_check_interval")]
+    pub tls_certificate_check_interval: u64,
+
+    /// Check the config file and its include files this often (ms) and reload
+    /// the config when they change, 0 disables it.
+    #[serde(default)] // 0
+    pub config_check_interval: u64,
+
     #[serde(default = "General::default_tls_rate_limit_per_second")]
     pub tls_rate_limit_per_second: usize,
 
@@ -312,9 +582,45 @@ pub struct General {
     #[serde(default)] // false
     pub verify_server_certificate: bool,
 
+    /// Block a client address after this many protocol violations (0 disables blocking).
+    #[serde(default)] // 0
+    pub protocol_violation_limit: u64,
+
+    /// Window for counting protocol violations and duration of the block, in milliseconds.
+    #[serde(default = "General::default_protocol_violation_block_time")]
+    pub protocol_violation_block_time: u64,
+
+    /// New client connections per second from all addresses (0 disables the limit).
+    #[serde(default)] // 0
+    pub login_rate_limit: u32,
+
+    /// New client connections per second from one address (0 disables the limit).
+    #[serde(default)] // 0
+    pub login_rate_limit_per_ip: u32,
+
+    /// Delay of the next login of an address after an auth failure, doubled with each
+    /// further failure, in milliseconds (0 disables it).
+    #[serde(default)] // 0
+    pub auth_failure_delay: u64,
+
+    /// Maximum delay after auth failures, in milliseconds.
+    #[serde(default = "General::default_auth_failure_max_delay")]
+    pub auth_failure_max_delay: u64,
+
     pub admin_username: String,
     pub admin_password: String,
 
+    /// Append every admin console command to this file.
+    pub admin_audit_file: Option<String>,
+
+    /// Number of admin console commands kept for SHOW ADMIN_HISTORY.
+    #[serde(default = "General::default_admin_history_size")]
+    pub admin_history_size: usize,
+
+    /// Minutes of per-minute pool statistics kept for SHOW STATS_HISTORY (0 disables).
+    #[serde(default = "General::default_stats_history_minutes")]
+    pub stats_history_minutes: u64,
+
     #[serde(default = "General::default_prepared_statements")]
     pub prepared_statements: bool,
 
@@ -326,11 +632,100 @@ pub struct General {
 
     pub syslog_prog_name: Option<String>,
 
+    /// Allow the admin INJECT ERROR command (for testing client retry logic in staging).
+    #[serde(default)] // False
+    pub error_injection: bool,
+
     #[serde(
         default = "General::default_hba",
         skip_serializing_if = "<[_]>::is_empty"
     )]
     pub hba: Vec<IpNet>,
+
+    /// File with access rules in the pg_hba.conf format, checked before authentication.
+    pub hba_file: Option<String>,
+
+    /// Addresses to accept clients on besides host:port, each with its own options.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub listeners: Vec<Listener>,
+
+    /// Id of the instance among its peers, put in the process ids of its clients, 0 disables peering.
+    #[serde(default)] // 0
+    pub peer_id: u16,
+
+    /// The instances cancel requests with the keys of other peers are forwarded to.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub peers: Vec<Peer>,
+
+    /// Routes of the TLS clients by the server name (SNI) they send.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tls_sni: Vec<TlsSniRoute>,
+}
+
+/// Where the TLS clients sending a server name go, e.g. one tenant of a shared port.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct TlsSniRoute {
+    /// Server name sent by the client, matched case-insensitively.
+    pub server_name: String,
+
+    /// Database entry the clients are connected to, whatever database they ask for.
+    pub database: Option<String>,
+
+    /// Certificate and key shown to the clients instead of tls_certificate and tls_private_key.
+    pub tls_certificate: Option<String>,
+    pub tls_private_key: Option<String>,
+}
+
+/// Another pg_doorman instance serving the same clients, e.g. behind a load balancer.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct Peer {
+    pub peer_id: u16,
+    pub host: String,
+    pub port: u16,
+}
+
+/// An additional address clients connect to.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct Listener {
+    pub host: String,
+    pub port: u16,
+
+    /// Reject clients not using TLS, whatever tls_mode says.
+    #[serde(default)] // False
+    pub tls_required: bool,
+
+    /// Serve only the admin console.
+    #[serde(default)] // False
+    pub admin_only: bool,
+
+    /// Run the transactions of the clients read-only.
+    #[serde(default)] // False
+    pub read_only: bool,
+
+    /// Clients come through a balancer sending a PROXY protocol header (v1 or v2).
+    #[serde(default)] // False
+    pub proxy_protocol: bool,
+}
+
+impl Listener {
+    pub fn options(&self) -> ListenerOptions {
+        ListenerOptions {
+            tls_required: self.tls_required,
+            admin_only: self.admin_only,
+            read_only: self.read_only,
+            proxy_protocol: self.proxy_protocol,
+        }
+    }
+}
+
+/// What the clients of a listener are allowed to do and how they connect.
+/// The main listener has none of the restrictions.
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+pub struct ListenerOptions {
+    pub tls_required: bool,
+    pub admin_only: bool,
+    pub read_only: bool,
+    pub proxy_protocol: bool,
 }
 
 #[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
@@ -362,6 +757,127 @@ impl Prometheus {
     }
 }
 
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct Statsd {
+    #[serde(default)] // false
+    pub enabled: bool,
+    #[serde(default = "Statsd::default_host")]
+    pub host: String,
+    #[serde(default = "Statsd::default_port")]
+    pub port: u16,
+    // Prepended to the metric names with a dot.
+    #[serde(default = "Statsd::default_prefix")]
+    pub prefix: String,
+    // Tags added to every metric, e.g. "env:prod". Pool metrics are tagged with
+    // their user and database, plain StatsD gets them in the metric name instead.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+    #[serde(default = "Statsd::default_dogstatsd")]
+    pub dogstatsd: bool,
+    // Push interval (ms).
+    #[serde(default = "Statsd::default_interval")]
+    pub interval: u64,
+}
+
+impl Statsd {
+    pub fn empty() -> Statsd {
+        Statsd {
+            enabled: false,
+            host: Self::default_host(),
+            port: Self::default_port(),
+            prefix: Self::default_prefix(),
+            tags: Vec::new(),
+            dogstatsd: Self::default_dogstatsd(),
+            interval: Self::default_interval(),
+        }
+    }
+    pub fn default_host() -> String {
+        "127.0.0.1".to_string()
+    }
+    pub fn default_port() -> u16 {
+        8125
+    }
+    pub fn default_prefix() -> String {
+        "pg_doorman".to_string()
+    }
+    pub fn default_dogstatsd() -> bool {
+        true
+    }
+    pub fn default_interval() -> u64 {
+        10_000
+    }
+
+    pub fn validate(&self) -> Result<(), Error> {
+        if self.enabled && self.interval == 0 {
+            return Err(Error::BadConfig(
+                "statsd.interval must be greater than 0".to_string(),
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Configuration shared by a fleet of instances, fetched from an HTTP(S) URL.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct Cluster {
+    // URL of a TOML document merged over the config file, e.g. a Consul key
+    // (http://consul:8500/v1/kv/pg_doorman/config?raw) or an object storage URL.
+    #[serde(default)] // ""
+    pub url: String,
+    // Request headers, e.g. "X-Consul-Token: secret".
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub headers: Vec<String>,
+    // Poll interval (ms), aligned to the wall clock so that all instances poll at the same time.
+    #[serde(default = "Cluster::default_interval")]
+    pub interval: u64,
+    // Fetch timeout (ms).
+    #[serde(default = "Cluster::default_timeout")]
+    pub timeout: u64,
+}
+
+impl Cluster {
+    pub fn empty() -> Cluster {
+        Cluster {
+            url: String::new(),
+            headers: Vec::new(),
+            interval: Self::default_interval(),
+            timeout: Self::default_timeout(),
+        }
+    }
+    pub fn default_interval() -> u64 {
+        10_000
+    }
+    pub fn default_timeout() -> u64 {
+        5_000
+    }
+    pub fn is_empty(&self) -> bool {
+        self.url.is_empty()
+    }
+
+    pub fn validate(&self) -> Result<(), Error> {
+        if self.is_empty() {
+            return Ok(());
+        }
+        if !self.url.starts_with("http://") && !self.url.starts_with("https://") {
+            return Err(Error::BadConfig(format!(
+                "cluster.url must be an http:// or https:// URL: {}",
+                self.url
+            )));
+        }
+        if self.interval == 0 || self.timeout == 0 {
+            return Err(Error::BadConfig(
+                "cluster.interval and cluster.timeout must be greater than 0".to_string(),
+            ));
+        }
+        if let Some(header) = self.headers.iter().find(|header| !header.contains(':')) {
+            return Err(Error::BadConfig(format!(
+                "cluster.headers must be \"Name: value\": {header}"
+            )));
+        }
+        Ok(())
+    }
+}
+
 impl General {
     pub fn default_host() -> String {
         "0.0.0.0".into()
@@ -386,6 +902,44 @@ impl General {
     pub fn default_tls_rate_limit_per_second() -> usize {
         0
     }
+
+    pub fn default_tls_min_version() -> TlsVersion {
+        TlsVersion::V1_2
+    }
+
+    pub fn default_tls_certificate_expiry_warning_days() -> u64 {
+        30
+    }
+
+    pub fn default_tls_certificate_check_interval() -> u64 {
+        60_000 // 1 min
+    }
+
+    pub fn default_protocol_violation_block_time() -> u64 {
+        60_000 // 1 min
+    }
+
+    /// TLS of the server connections as server_tls and verify_server_certificate say.
+    pub fn server_tls_mode(&self) -> ServerTlsMode {
+        match (self.server_tls, self.verify_server_certificate) {
+            (false, _) => ServerTlsMode::Disable,
+            (true, false) => ServerTlsMode::Prefer,
+            (true, true) => ServerTlsMode::VerifyFull,
+        }
+    }
+
+    pub fn default_auth_failure_max_delay() -> u64 {
+        10_000 // 10 sec
+    }
+
+    pub fn default_admin_history_size() -> usize {
+        100
+    }
+
+    pub fn default_stats_history_minutes() -> u64 {
+        60
+    }
+
     pub fn default_server_lifetime() -> u64 {
         1000 * 60 * 5 // 5 min
     }
@@ -394,10 +948,22 @@ impl General {
         3_000
     }
 
+    pub fn default_dns_max_ttl() -> u64 {
+        15_000
+    }
+
+    pub fn default_server_reset_timeout() -> u64 {
+        5_000
+    }
+
     pub fn default_query_wait_timeout() -> u64 {
         5000
     }
 
+    pub fn default_reserve_pool_timeout() -> u64 {
+        3000
+    }
+
     pub fn default_tcp_so_linger() -> u64 {
         0 // 0 seconds
     }
@@ -422,6 +988,18 @@ impl General {
         8 * 1024
     }
 
+    pub fn default_max_cancel_connections() -> usize {
+        256
+    }
+
+    pub fn default_max_wildcard_databases() -> usize {
+        1000
+    }
+
+    pub fn default_cancel_timeout() -> u64 {
+        5_000
+    }
+
     pub fn default_backlog() -> u32 {
         0
     }
@@ -434,6 +1012,10 @@ impl General {
         false
     }
 
+    pub fn default_release_advisory_locks() -> bool {
+        true
+    }
+
     // These keepalive defaults should detect a dead connection within 30 seconds.
     // Tokio defaults to disabling keepalives which keeps dead connections around indefinitely.
     // This can lead to permanent server pool exhaustion
@@ -457,6 +1039,14 @@ impl General {
         10_000
     }
 
+    pub fn default_slow_query_log_rate() -> u32 {
+        10
+    }
+
+    pub fn default_startup_pacing_jitter() -> u64 {
+        50
+    }
+
     pub fn default_proxy_copy_data_timeout() -> u64 {
         15_000
     }
@@ -535,45 +1125,94 @@ impl Default for General {
         General {
             host: Self::default_host(),
             port: Self::default_port(),
+            ipv6_only: false,
+            http_on_main_port: false,
+            health_listen: None,
             virtual_pool_count: Self::default_virtual_pool_count(),
             tokio_global_queue_interval: Self::default_tokio_global_queue_interval(),
             tokio_event_interval: Self::default_tokio_event_interval(),
             connect_timeout: General::default_connect_timeout(),
+            dns_max_ttl: General::default_dns_max_ttl(),
+            server_reset_timeout: General::default_server_reset_timeout(),
             query_wait_timeout: General::default_query_wait_timeout(),
+            reserve_pool_size: 0,
+            reserve_pool_timeout: General::default_reserve_pool_timeout(),
+            pools_ready_timeout: 0,
+            queue_notice_threshold: 0,
+            slow_query_threshold: 0,
+            slow_query_log_rate: General::default_slow_query_log_rate(),
+            sync_response_timeout: 0,
+            batch_timeout: 0,
+            batch_message_timeout: 0,
+            startup_burst_limit: 0,
+            startup_pacing_jitter: Self::default_startup_pacing_jitter(),
             idle_timeout: General::default_idle_timeout(),
             shutdown_timeout: Self::default_shutdown_timeout(),
             proxy_copy_data_timeout: Self::default_proxy_copy_data_timeout(),
             message_size_to_be_stream: Self::default_message_size_to_be_stream(),
             max_memory_usage: Self::default_max_memory_usage(),
             max_connections: Self::default_max_connections(),
+            max_cancel_connections: Self::default_max_cancel_connections(),
+            max_wildcard_databases: Self::default_max_wildcard_databases(),
+            cancel_timeout: Self::default_cancel_timeout(),
             worker_threads: Self::default_worker_threads(),
             worker_cpu_affinity_pinning: Self::default_worker_cpu_affinity_pinning(),
             worker_stack_size: Self::default_worker_stack_size(),
             tcp_keepalives_idle: Self::default_tcp_keepalives_idle(),
             tcp_keepalives_count: Self::default_tcp_keepalives_count(),
             tcp_keepalives_interval: Self::default_tcp_keepalives_interval(),
+            client_keepalive_interval: 0,
             tcp_so_linger: Self::default_tcp_so_linger(),
             tcp_no_delay: Self::default_tcp_no_delay(),
             unix_socket_buffer_size: Self::default_unix_socket_buffer_size(),
             log_client_connections: true,
             log_client_disconnections: true,
+            log_redact_query_literals: false,
+            event_sink: None,
+            audit_log: None,
             sync_server_parameters: Self::default_sync_server_parameters(),
             tls_certificate: None,
             tls_private_key: None,
             tls_ca_cert: None,
             tls_mode: None,
+            tls_cert_ident_file: None,
+            tls_min_version: Self::default_tls_min_version(),
+            tls_max_version: None,
+            tls_ciphers: None,
+            tls_ciphersuites: None,
+            tls_curves: None,
+            tls_certificate_expiry_warning_days: Self::default_tls_certificate_expiry_warning_days(
+            ),
+            tls_certificate_check_interval: Self::default_tls_certificate_check_interval(),
+            config_check_interval: 0,
             tls_rate_limit_per_second: Self::default_tls_rate_limit_per_second(),
             server_tls: false,
             verify_server_certificate: false,
+            protocol_violation_limit: 0,
+            protocol_violation_block_time: Self::default_protocol_violation_block_time(),
+            login_rate_limit: 0,
+            login_rate_limit_per_ip: 0,
+            auth_failure_delay: 0,
+            auth_failure_max_delay: Self::default_auth_failure_max_delay(),
             admin_username: String::from("admin"),
             admin_password: String::from("admin"),
+            admin_audit_file: None,
+            admin_history_size: Self::default_admin_history_size(),
+            stats_history_minutes: Self::default_stats_history_minutes(),
             server_lifetime: Self::default_server_lifetime(),
             server_round_robin: Self::default_server_round_robin(),
+            release_advisory_locks: Self::default_release_advisory_locks(),
             prepared_statements: Self::default_prepared_statements(),
             prepared_statements_cache_size: Self::default_prepared_statements_cache_size(),
             hba: Self::default_hba(),
+            hba_file: None,
+            listeners: Vec::new(),
+            peer_id: 0,
+            peers: Vec::new(),
+            tls_sni: Vec::new(),
             daemon_pid_file: Self::default_daemon_pid_file(),
             syslog_prog_name: None,
+            error_injection: false,
             pooler_check_query: Self::default_pooler_check_query(),
             pooler_check_query_request_bytes: None,
             backlog: Self::default_backlog(),
@@ -589,7 +1228,26 @@ pub struct Pool {
     /// Maximum time to allow for establishing a new server connection.
     pub connect_timeout: Option<u64>,
 
+    /// Maximum time a client waits for a server connection of the pool, overrides the general setting.
+    pub query_wait_timeout: Option<u64>,
+
+    /// Reserve pool of every user of the pool and the wait that opens it, override the general settings.
+    pub reserve_pool_size: Option<u32>,
+    pub reserve_pool_timeout: Option<u64>,
+
+    /// Maximum time to wait for the reset queries when a server is returned to the pool.
+    pub server_reset_timeout: Option<u64>,
+
+    /// Query run on a server returned with its session state altered, instead of
+    /// resetting what was altered (RESET ALL, DEALLOCATE ALL, CLOSE ALL). Empty runs nothing.
+    pub server_reset_query: Option<String>,
+
+    /// Run the reset queries in the background: the client goes on without waiting for them.
+    #[serde(default)] // false
+    pub server_reset_in_background: bool,
+
     /// Close idle connections that have been opened for longer than this.
+    #[serde(alias = "server_idle_timeout")]
     pub idle_timeout: Option<u64>,
 
     /// Close server connections that have been opened for longer than this.
@@ -597,67 +1255,924 @@ pub struct Pool {
     /// longer than this period, the pool will not interrupt it.
     pub server_lifetime: Option<u64>,
 
+    /// Server connections opened at startup and kept open for every user of the pool,
+    /// unless the user sets its own min_pool_size.
+    pub min_pool_size: Option<u32>,
+
+    /// Send a warning to the client when its transaction runs longer than this (ms).
+    pub transaction_duration_warning: Option<u64>,
+
+    /// Cancel the transaction and terminate the client when it runs longer than this (ms).
+    pub transaction_duration_limit: Option<u64>,
+
+    /// statement_timeout set on the server connections at checkout (ms), unless the
+    /// client set its own.
+    pub statement_timeout: Option<u64>,
+
+    /// idle_in_transaction_session_timeout set on the server connections at checkout (ms).
+    pub idle_in_transaction_session_timeout: Option<u64>,
+
     #[serde(default = "Pool::default_cleanup_server_connections")]
     pub cleanup_server_connections: bool,
 
+    /// Reject SET ROLE and SET SESSION AUTHORIZATION in transaction mode.
+    #[serde(default)] // False
+    pub reject_role_changes: bool,
+
     #[serde(default)] // False
     pub log_client_parameter_status_changes: bool,
 
     pub application_name: Option<String>,
 
+    /// application_name set on the server for each client, with {client_application_name},
+    /// {user} and {database} filled in.
+    pub application_name_template: Option<String>,
+
+    /// Set the application_name of the client on the server unchanged.
+    #[serde(default)] // False
+    pub application_name_passthrough: bool,
+
+    /// Notice sent to the clients at login, e.g. to announce a move of the endpoint.
+    pub login_notice: Option<String>,
+
     #[serde(default = "Pool::default_server_host")]
     pub server_host: String,
 
     #[serde(default = "Pool::default_server_port")]
     pub server_port: u16,
 
+    /// More hosts with the same data as server_host, "host" or "host:port"
+    /// (server_port by default). The server connections are spread across all of them.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub server_hosts: Vec<String>,
+
+    #[serde(default)] // round_robin
+    pub load_balancing: LoadBalancing,
+
+    /// Weights of server_host and server_hosts, in this order, with load_balancing = "weighted".
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub server_weights: Vec<u32>,
+
+    /// Check the hosts with a new connection running `select 1` this often (ms), 0 disables.
+    #[serde(default)] // 0
+    pub health_check_interval: u64,
+
+    /// How long a host failing a connect or a health check gets no new server connections (ms).
+    #[serde(default = "Pool::default_failover_cooldown")]
+    pub failover_cooldown: u64,
+
+    /// Replicas the read-only transactions are sent to, "host" or "host:port"
+    /// (server_port by default). server_host is the primary.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub replica_hosts: Vec<String>,
+
+    /// Send the reads of a client after its writes only to the replicas that replayed them.
+    #[serde(default)] // false
+    pub read_your_writes: bool,
+
+    /// Replicas lagging more than this (ms) get no read-only transactions until they catch up, 0 disables.
+    #[serde(default)] // 0
+    pub max_replica_lag: u64,
+
+    /// Poll the replay position and the lag of the replicas this often (ms),
+    /// with read_your_writes or max_replica_lag.
+    #[serde(default = "Pool::default_replica_poll_interval")]
+    pub replica_poll_interval: u64,
+
+    /// Shadow server the traffic of the clients is replayed on, "host" or "host:port"
+    /// (server_port by default), e.g. a new major version to validate.
+    pub mirror_host: Option<String>,
+
+    /// Log the statements whose CommandComplete tags differ on the shadow server.
+    #[serde(default)] // false
+    pub mirror_log_diffs: bool,
+
+    /// Connections to the shadow server of each user, shared by its clients.
+    #[serde(default = "Pool::default_mirror_pool_size")]
+    pub mirror_pool_size: u32,
+
     // The real name of the database on the server. If it is not specified, the pool name is used.
     pub server_database: Option<String>,
 
+    /// Server-side prepared statement cache size, overrides the general setting.
+    #[serde(alias = "max_prepared_statements")]
     pub prepared_statements_cache_size: Option<usize>,
 
-    #[serde(default = "Pool::default_users")]
-    pub users: BTreeMap<String, User>,
-    // Note, don't put simple fields below these configs. There's a compatibility issue with TOML that makes it
-    // incompatible to have simple fields in TOML after complex objects. See
-    // https://users.rust-lang.org/t/why-toml-to-string-get-error-valueaftertable/85903
-}
+    /// Local address to bind outgoing server connections to.
+    /// Useful when the server is reachable only through a specific interface.
+    pub server_bind_address: Option<IpAddr>,
 
-impl Pool {
-    pub fn hash_value(&self) -> u64 {
-        let mut s = DefaultHasher::new();
-        self.hash(&mut s);
-        s.finish()
-    }
+    /// Host name sent as SNI and used for certificate verification
+    /// when connecting to the server over TLS. Defaults to server_host.
+    pub server_tls_server_name: Option<String>,
 
-    pub fn default_pool_mode() -> PoolMode {
-        PoolMode::Transaction
-    }
+    /// TLS of the server connections, overrides server_tls and verify_server_certificate.
+    pub server_tls_mode: Option<ServerTlsMode>,
 
-    pub fn default_server_port() -> u16 {
-        5432
-    }
+    /// CA bundle (PEM) the server certificates are verified with, instead of the system roots.
+    pub server_tls_ca_cert: Option<String>,
 
-    pub fn default_users() -> BTreeMap<String, User> {
-        BTreeMap::default()
-    }
-    pub fn default_server_host() -> String {
-        String::from("127.0.0.1")
-    }
+    /// Client certificate and key (PEM) presented to the server.
+    pub server_tls_certificate: Option<String>,
+    pub server_tls_private_key: Option<String>,
 
-    pub fn default_cleanup_server_connections() -> bool {
-        true
-    }
+    /// TCP keepalive overrides for server connections of this pool.
+    /// If not specified, the values from the general section are used.
+    pub server_tcp_keepalives_idle: Option<u64>,
+    pub server_tcp_keepalives_count: Option<u32>,
+    pub server_tcp_keepalives_interval: Option<u64>,
 
-    pub async fn validate(&mut self) -> Result<(), Error> {
-        for user in self.users.values() {
-            user.validate().await?;
+    /// Encoding the clients of this pool must use, e.g. "UTF8".
+    pub client_encoding: Option<String>,
+
+    /// Switch clients requesting another client_encoding to the pool encoding
+    /// instead of rejecting them.
+    #[serde(default)] // False
+    pub normalize_client_encoding: bool,
+
+    /// Track transactions prepared for two-phase commit through this pool.
+    #[serde(default)] // False
+    pub track_prepared_transactions: bool,
+
+    /// Record the session parameters clients SET in transaction mode and set them
+    /// again on the next servers of the client.
+    #[serde(default)] // False
+    pub track_session_parameters: bool,
+
+    /// Write the statements of the clients to the audit_log.
+    #[serde(default)] // False
+    pub audit: bool,
+
+    /// Startup parameters of the clients (or `-c` settings in options) set on the
+    /// server after checkout, e.g. search_path, TimeZone. The others are ignored.
+    #[serde(default)]
+    pub startup_parameters: Vec<String>,
+
+    /// Warn about tracked prepared transactions older than this, in milliseconds (0 disables).
+    #[serde(default = "Pool::default_prepared_transaction_age_warning")]
+    pub prepared_transaction_age_warning: u64,
+
+    /// Logical replication connections (replication=database) passed through to server_host, 0 refuses them.
+    #[serde(default)] // 0
+    pub max_replication_connections: u32,
+
+    /// Client connections to this database, its partitions included, 0 means unlimited.
+    #[serde(default)] // 0
+    pub max_db_client_connections: u32,
+
+    /// Query returning the load of the server as a number, e.g. the count of active backends.
+    /// While it is at load_threshold or above, the clients of the pool get only
+    /// overload_pool_size_percent of the pool size.
+    pub load_check_query: Option<String>,
+
+    /// How often load_check_query is run, in milliseconds.
+    #[serde(default = "Pool::default_load_check_interval")]
+    pub load_check_interval: u64,
+
+    #[serde(default)] // 0
+    pub load_threshold: u64,
+
+    #[serde(default = "Pool::default_overload_pool_size_percent")]
+    pub overload_pool_size_percent: u32,
+
+    /// ParameterStatus messages never reported to the clients of this pool.
+    #[serde(default)]
+    pub parameter_status_suppress: Vec<String>,
+
+    /// Regular expression on the normalized statement, the results of the read-only
+    /// statements matching it are cached.
+    pub result_cache_pattern: Option<String>,
+
+    /// How long a result is served from the cache, in milliseconds.
+    #[serde(default = "Pool::default_result_cache_ttl")]
+    pub result_cache_ttl: u64,
+
+    /// Bytes of results cached for the database, the oldest are evicted over it.
+    #[serde(default = "Pool::default_result_cache_size")]
+    pub result_cache_size: u64,
+
+    /// Results larger than this many bytes aren't cached.
+    #[serde(default = "Pool::default_result_cache_max_result_size")]
+    pub result_cache_max_result_size: u64,
+
+    /// Query returning the user name and the password (md5 or SCRAM verifier) of a user,
+    /// for users of this pool without a password. `$1` is replaced with the user name.
+    /// Reads pg_shadow by default.
+    pub auth_query: Option<String>,
+
+    /// User of this pool whose server connections run auth_query, enables the lookups.
+    pub auth_user: Option<String>,
+
+    /// User of this pool whose settings serve the users that aren't listed in it,
+    /// authenticated with auth_query. Without it those users are rejected.
+    pub auth_query_template_user: Option<String>,
+
+    /// Name of a server in ldap_servers authenticating the users of this pool.
+    pub auth_ldap_server: Option<String>,
+
+    /// Name of a map in tls_cert_ident_file authenticating the users of this pool
+    /// by their TLS client certificate.
+    pub auth_cert_map: Option<String>,
+
+    #[serde(default = "Pool::default_users")]
+    pub users: BTreeMap<String, User>,
+
+    /// Sub-pools selected by the `pool_hint` startup parameter of a client,
+    /// e.g. to keep batch jobs from starving interactive traffic.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub partitions: BTreeMap<String, PoolPartition>,
+
+    /// Equivalent backend clusters the databases of the `*` entry are spread across by name.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub tenant_clusters: BTreeMap<String, TenantCluster>,
+
+    /// Cluster of tenant_clusters serving a database of the `*` entry, instead of the hashed one.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub tenant_cluster_overrides: BTreeMap<String, String>,
+
+    /// ParameterStatus values reported to the clients of this pool instead of the server ones,
+    /// e.g. a fixed server_version across servers of different versions.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub parameter_status_overrides: BTreeMap<String, String>,
+
+    /// Rules sending transactions to another pool of the database by their first statement,
+    /// in transaction mode.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub query_routes: Vec<QueryRoute>,
+    // Note, don't put simple fields below these configs. There's a compatibility issue with TOML that makes it
+    // incompatible to have simple fields in TOML after complex objects. See
+    // https://users.rust-lang.org/t/why-toml-to-string-get-error-valueaftertable/85903
+}
+
+impl Pool {
+    /// Settings of a user not listed in the pool, from auth_query_template_user,
+    /// None without it or if the user is listed. The password is looked up with auth_query.
+    pub fn auth_query_user(&self, username: &str) -> Option<User> {
+        let template = self.auth_query_template_user.as_ref()?;
+        if self.users.values().any(|user| user.username == username) {
+            return None;
+        }
+        let mut user = self
+            .users
+            .values()
+            .find(|user| user.username == *template)?
+            .clone();
+        user.username = username.to_string();
+        user.password = String::new();
+        Some(user)
+    }
+
+    /// Settings of `user` in the pools of the database: min_pool_size of the pool by default.
+    pub fn user(&self, user: &User) -> User {
+        let mut user = user.clone();
+        user.min_pool_size = user.min_pool_size.or(self.min_pool_size);
+        user
+    }
+
+    /// Size of the reserve pool of every user and the wait (ms) after which clients get it.
+    pub fn reserve_pool(&self, general: &General) -> (u32, u64) {
+        (
+            self.reserve_pool_size.unwrap_or(general.reserve_pool_size),
+            self.reserve_pool_timeout
+                .unwrap_or(general.reserve_pool_timeout),
+        )
+    }
+
+    /// application_name set on the server for a client: application_name_template
+    /// filled in, or the one of the client with application_name_passthrough.
+    pub fn server_application_name(
+        &self,
+        client_application_name: &str,
+        user: &str,
+        database: &str,
+    ) -> Option<String> {
+        if self.application_name_passthrough {
+            return Some(client_application_name.to_string());
+        }
+        let template = self.application_name_template.as_deref()?;
+        let mut result = String::new();
+        let mut rest = template;
+        while let Some(start) = rest.find('{') {
+            result.push_str(&rest[..start]);
+            rest = &rest[start..];
+            let end = match rest.find('}') {
+                Some(end) => end,
+                None => break,
+            };
+            match &rest[1..end] {
+                "client_application_name" => result.push_str(client_application_name),
+                "user" => result.push_str(user),
+                "database" => result.push_str(database),
+                _ => result.push_str(&rest[..=end]),
+            }
+            rest = &rest[end + 1..];
+        }
+        result.push_str(rest);
+        Some(result)
+    }
+
+    /// TLS of the server connections: server_tls_mode or the general setting.
+    pub fn server_tls_mode(&self, general: &General) -> ServerTlsMode {
+        self.server_tls_mode
+            .unwrap_or_else(|| general.server_tls_mode())
+    }
+
+    /// Hash of the pool config and the general settings its pools are built with:
+    /// a change of either recreates the pools on RELOAD.
+    pub fn hash_value(&self, general: &General) -> u64 {
+        let mut s = DefaultHasher::new();
+        self.hash(&mut s);
+        (
+            general.virtual_pool_count,
+            general.connect_timeout,
+            general.query_wait_timeout,
+            general.reserve_pool_size,
+            general.reserve_pool_timeout,
+            general.idle_timeout,
+            general.server_lifetime,
+            general.server_round_robin,
+            general.sync_server_parameters,
+            general.prepared_statements,
+            general.prepared_statements_cache_size,
+        )
+            .hash(&mut s);
+        s.finish()
+    }
+
+    pub fn default_pool_mode() -> PoolMode {
+        PoolMode::Transaction
+    }
+
+    pub fn default_server_port() -> u16 {
+        5432
+    }
+
+    /// Server-side prepared statement cache size for the connections of `user`,
+    /// 0 if prepared statements are disabled.
+    pub fn prepared_statements_cache_size(&self, user: &User, general: &General) -> usize {
+        if !general.prepared_statements {
+            return 0;
+        }
+        user.prepared_statements_cache_size
+            .or(self.prepared_statements_cache_size)
+            .unwrap_or(general.prepared_statements_cache_size)
+    }
+
+    /// LDAP server authenticating the user, the user setting overrides the pool one.
+    pub fn auth_ldap_server<'a>(&'a self, user: &'a User) -> Option<&'a str> {
+        user.auth_ldap_server
+            .as_deref()
+            .or(self.auth_ldap_server.as_deref())
+    }
+
+    /// Certificate map authenticating the user, the user setting overrides the pool one.
+    pub fn auth_cert_map<'a>(&'a self, user: &'a User) -> Option<&'a str> {
+        user.auth_cert_map
+            .as_deref()
+            .or(self.auth_cert_map.as_deref())
+    }
+
+    /// Transaction duration warning and limit of `user` (ms, 0 disables),
+    /// the user settings override the pool ones.
+    pub fn transaction_duration_thresholds(&self, user: &User) -> (u64, u64) {
+        (
+            user.transaction_duration_warning
+                .or(self.transaction_duration_warning)
+                .unwrap_or(0),
+            user.transaction_duration_limit
+                .or(self.transaction_duration_limit)
+                .unwrap_or(0),
+        )
+    }
+
+    /// statement_timeout and idle_in_transaction_session_timeout of `user` (ms, 0
+    /// leaves the server default), the user settings override the pool ones.
+    pub fn session_timeouts(&self, user: &User) -> (u64, u64) {
+        (
+            user.statement_timeout
+                .or(self.statement_timeout)
+                .unwrap_or(0),
+            user.idle_in_transaction_session_timeout
+                .or(self.idle_in_transaction_session_timeout)
+                .unwrap_or(0),
+        )
+    }
+
+    /// The partition name is the one of the pool of a replica, see replica_pool_name.
+    fn is_replica(&self, partition: &str) -> bool {
+        (1..=self.replica_hosts.len()).any(|index| partition == format!("replica{index}"))
+    }
+
+    /// Host, port and weight of server_host and server_hosts.
+    pub fn server_addresses(&self) -> Result<Vec<(String, u16, u32)>, Error> {
+        let mut addresses = vec![(self.server_host.clone(), self.server_port)];
+        for host in &self.server_hosts {
+            addresses.push(parse_host_port(host, self.server_port)?);
+        }
+        Ok(addresses
+            .into_iter()
+            .enumerate()
+            .map(|(index, (host, port))| {
+                let weight = self.server_weights.get(index).copied().unwrap_or(1);
+                (host, port, weight)
+            })
+            .collect())
+    }
+
+    /// Host and port of the replicas.
+    pub fn replica_addresses(&self) -> Result<Vec<(String, u16)>, Error> {
+        self.replica_hosts
+            .iter()
+            .map(|replica| parse_host_port(replica, self.server_port))
+            .collect()
+    }
+
+    /// Cluster of tenant_clusters serving the database of this `*` entry: its
+    /// override, otherwise the one the name hashes to. None without clusters.
+    pub fn tenant_cluster(&self, database: &str) -> Option<&str> {
+        if let Some((name, _)) = self
+            .tenant_cluster_overrides
+            .get(database)
+            .and_then(|cluster| self.tenant_clusters.get_key_value(cluster))
+        {
+            return Some(name);
+        }
+        self.tenant_clusters
+            .iter()
+            .map(|(name, cluster)| (name, rendezvous_score(name, database, cluster.weight)))
+            .max_by(|a, b| a.1.total_cmp(&b.1))
+            .map(|(name, _)| name.as_str())
+    }
+
+    /// Settings of a database served from this `*` entry: the ones of the entry,
+    /// on the host of its tenant cluster if there are clusters.
+    pub fn tenant_pool(&self, database: &str) -> Result<Pool, Error> {
+        let mut pool = self.clone();
+        if let Some(name) = self.tenant_cluster(database) {
+            let (host, port) = parse_host_port(&self.tenant_clusters[name].host, self.server_port)?;
+            pool.server_host = host;
+            pool.server_port = port;
+        }
+        Ok(pool)
+    }
+
+    /// The replicas are polled for their replay position and lag.
+    pub fn polls_replicas(&self) -> bool {
+        self.read_your_writes || self.max_replica_lag > 0
+    }
+
+    /// Host and port of mirror_host.
+    pub fn mirror_address(&self) -> Result<Option<(String, u16)>, Error> {
+        self.mirror_host
+            .as_ref()
+            .map(|host| parse_host_port(host, self.server_port))
+            .transpose()
+    }
+
+    /// Notice sent to the clients of `user` at login, the user one overrides the pool one.
+    pub fn login_notice<'a>(&'a self, user: &'a User) -> Option<&'a str> {
+        user.login_notice
+            .as_deref()
+            .or(self.login_notice.as_deref())
+    }
+
+    /// Whether the statements of `user` are audited, the user setting overrides the pool one.
+    pub fn audit(&self, user: &User) -> bool {
+        user.audit.unwrap_or(self.audit)
+    }
+
+    pub fn default_prepared_transaction_age_warning() -> u64 {
+        60_000 // 1 min
+    }
+
+    pub fn default_load_check_interval() -> u64 {
+        1_000
+    }
+
+    pub fn default_overload_pool_size_percent() -> u32 {
+        50
+    }
+
+    pub fn default_result_cache_ttl() -> u64 {
+        1_000
+    }
+
+    pub fn default_mirror_pool_size() -> u32 {
+        10
+    }
+
+    pub fn default_result_cache_size() -> u64 {
+        64 * 1024 * 1024
+    }
+
+    pub fn default_result_cache_max_result_size() -> u64 {
+        1024 * 1024
+    }
+
+    pub fn default_failover_cooldown() -> u64 {
+        30_000
+    }
+
+    pub fn default_replica_poll_interval() -> u64 {
+        1000
+    }
+
+    pub fn default_users() -> BTreeMap<String, User> {
+        BTreeMap::default()
+    }
+    pub fn default_server_host() -> String {
+        String::from("127.0.0.1")
+    }
+
+    pub fn default_cleanup_server_connections() -> bool {
+        true
+    }
+
+    /// Check the client_encoding requested by a client against the pool encoding.
+    /// Names are compared like PostgreSQL does: ignoring case and punctuation.
+    pub fn allows_client_encoding(&self, requested: &str) -> bool {
+        let clean = |name: &str| -> String {
+            let name: String = name
+                .chars()
+                .filter(char::is_ascii_alphanumeric)
+                .map(|c| c.to_ascii_uppercase())
+                .collect();
+            // UNICODE is an alias of UTF8.
+            if name == "UNICODE" {
+                "UTF8".to_string()
+            } else {
+                name
+            }
+        };
+        match self.client_encoding {
+            Some(ref encoding) => clean(encoding) == clean(requested),
+            None => true,
+        }
+    }
+
+    pub async fn validate(&mut self) -> Result<(), Error> {
+        if let Some(ref encoding) = self.client_encoding {
+            if encoding.trim().is_empty() {
+                return Err(Error::BadConfig(
+                    "client_encoding can't be empty".to_string(),
+                ));
+            }
+        }
+
+        if self.server_host.starts_with('/')
+            && (self.server_bind_address.is_some() || self.server_tls_server_name.is_some())
+        {
+            return Err(Error::BadConfig(format!(
+                "server_bind_address and server_tls_server_name can't be used with unix socket server_host {}",
+                self.server_host
+            )));
+        }
+
+        if self.server_tls_certificate.is_some() != self.server_tls_private_key.is_some() {
+            return Err(Error::BadConfig(
+                "server_tls_certificate and server_tls_private_key should be set together"
+                    .to_string(),
+            ));
+        }
+        // Unreadable certificates are reported now rather than at the first connection.
+        if let Some(mode) = self.server_tls_mode {
+            if mode != ServerTlsMode::Disable {
+                build_server_connector(
+                    mode,
+                    self.server_tls_ca_cert.as_deref(),
+                    self.server_tls_certificate.as_deref(),
+                    self.server_tls_private_key.as_deref(),
+                )?;
+            }
+        }
+
+        if self.prepared_statements_cache_size == Some(0) {
+            return Err(Error::BadConfig(
+                "prepared_statements_cache_size of a pool should be greater than 0".to_string(),
+            ));
+        }
+
+        if self.load_check_query.is_some() {
+            if self.load_threshold == 0 || self.load_check_interval == 0 {
+                return Err(Error::BadConfig(
+                    "load_check_query requires load_threshold and load_check_interval greater than 0"
+                        .to_string(),
+                ));
+            }
+            if self.overload_pool_size_percent == 0 || self.overload_pool_size_percent > 100 {
+                return Err(Error::BadConfig(format!(
+                    "overload_pool_size_percent should be between 1 and 100, got {}",
+                    self.overload_pool_size_percent
+                )));
+            }
+        }
+
+        for user in self.users.values() {
+            let (warning, limit) = self.transaction_duration_thresholds(user);
+            if warning > 0 && limit > 0 && warning >= limit {
+                return Err(Error::BadConfig(format!(
+                    "transaction_duration_warning of user {} should be less than transaction_duration_limit",
+                    user.username
+                )));
+            }
+        }
+
+        for name in self
+            .parameter_status_suppress
+            .iter()
+            .chain(self.parameter_status_overrides.keys())
+        {
+            if name.trim().is_empty() {
+                return Err(Error::BadConfig(
+                    "parameter_status_suppress and parameter_status_overrides can't contain empty parameter names".to_string(),
+                ));
+            }
+        }
+
+        match (&self.auth_query, &self.auth_user) {
+            (_, Some(auth_user)) => {
+                if !self.users.values().any(|user| user.username == *auth_user) {
+                    return Err(Error::BadConfig(format!(
+                        "auth_user {auth_user} is not a user of the pool"
+                    )));
+                }
+            }
+            (Some(_), None) => {
+                return Err(Error::BadConfig(
+                    "auth_query requires auth_user".to_string(),
+                ));
+            }
+            (None, _) => (),
+        }
+        if let Some(ref template) = self.auth_query_template_user {
+            if self.auth_user.is_none() {
+                return Err(Error::BadConfig(
+                    "auth_query_template_user requires auth_user".to_string(),
+                ));
+            }
+            if !self.users.values().any(|user| user.username == *template) {
+                return Err(Error::BadConfig(format!(
+                    "auth_query_template_user {template} is not a user of the pool"
+                )));
+            }
+        }
+
+        if self.result_cache_pattern.is_some()
+            && (self.result_cache_ttl == 0
+                || self.result_cache_max_result_size == 0
+                || self.result_cache_max_result_size > self.result_cache_size)
+        {
+            return Err(Error::BadConfig(
+                "result_cache_pattern requires result_cache_ttl greater than 0 and result_cache_max_result_size between 1 and result_cache_size"
+                    .to_string(),
+            ));
+        }
+
+        for route in &self.query_routes {
+            if route.pool != PRIMARY_TARGET
+                && !self.partitions.contains_key(&route.pool)
+                && !self.is_replica(&route.pool)
+            {
+                return Err(Error::BadConfig(format!(
+                    "query_routes pool {} is not {PRIMARY_TARGET}, a replica or a partition of the database",
+                    route.pool
+                )));
+            }
+        }
+
+        for user in self.users.values() {
+            user.validate().await?;
+        }
+
+        let servers = self.server_addresses()?;
+        match self.load_balancing {
+            LoadBalancing::Weighted => {
+                if self.server_weights.len() != servers.len() || self.server_weights.contains(&0) {
+                    return Err(Error::BadConfig(format!(
+                        "load_balancing = \"weighted\" requires {} server_weights greater than 0, one for server_host and each of server_hosts",
+                        servers.len()
+                    )));
+                }
+            }
+            _ if !self.server_weights.is_empty() => {
+                return Err(Error::BadConfig(
+                    "server_weights requires load_balancing = \"weighted\"".to_string(),
+                ));
+            }
+            _ => (),
+        }
+        self.replica_addresses()?;
+        if self.polls_replicas()
+            && (self.replica_hosts.is_empty() || self.replica_poll_interval == 0)
+        {
+            return Err(Error::BadConfig(
+                "read_your_writes and max_replica_lag require replica_hosts and replica_poll_interval greater than 0"
+                    .to_string(),
+            ));
+        }
+        if self.mirror_address()?.is_some() && self.mirror_pool_size == 0 {
+            return Err(Error::BadConfig(
+                "mirror_host requires mirror_pool_size greater than 0".to_string(),
+            ));
+        }
+
+        if self.application_name_passthrough && self.application_name_template.is_some() {
+            return Err(Error::BadConfig(
+                "application_name_template and application_name_passthrough can't be used together"
+                    .to_string(),
+            ));
+        }
+
+        for name in &self.startup_parameters {
+            if [
+                "user",
+                "database",
+                "options",
+                "replication",
+                POOL_HINT_PARAMETER,
+            ]
+            .iter()
+            .any(|reserved| name.eq_ignore_ascii_case(reserved))
+            {
+                return Err(Error::BadConfig(format!(
+                    "startup_parameters can't include {name}"
+                )));
+            }
+        }
+
+        if let Some(min_pool_size) = self.min_pool_size {
+            for user in self.users.values() {
+                if user.min_pool_size.is_none() && min_pool_size > user.pool_size {
+                    return Err(Error::BadConfig(format!(
+                        "min_pool_size of {} cannot be larger than pool_size of {} of user {}",
+                        min_pool_size, user.pool_size, user.username
+                    )));
+                }
+            }
+        }
+
+        for (name, cluster) in &self.tenant_clusters {
+            parse_host_port(&cluster.host, self.server_port)?;
+            if cluster.weight == 0 {
+                return Err(Error::BadConfig(format!(
+                    "weight of tenant cluster {name} must be greater than 0"
+                )));
+            }
+        }
+        if !self.tenant_clusters.is_empty() && !self.server_hosts.is_empty() {
+            return Err(Error::BadConfig(
+                "tenant_clusters and server_hosts can't be used together".to_string(),
+            ));
+        }
+        for (database, cluster) in &self.tenant_cluster_overrides {
+            if !self.tenant_clusters.contains_key(cluster) {
+                return Err(Error::BadConfig(format!(
+                    "tenant_cluster_overrides sends database {database} to unknown tenant cluster {cluster}"
+                )));
+            }
+        }
+
+        for (name, partition) in self.partitions.iter() {
+            if name.is_empty() || name.contains(PARTITION_SEPARATOR) {
+                return Err(Error::BadConfig(format!(
+                    "invalid partition name {name:?}, it can't be empty or contain '{PARTITION_SEPARATOR}'"
+                )));
+            }
+            if self.is_replica(name) {
+                return Err(Error::BadConfig(format!(
+                    "partition name {name:?} is taken by the pool of a replica"
+                )));
+            }
+            if partition.pool_size == Some(0) {
+                return Err(Error::BadConfig(format!(
+                    "pool_size of partition {name} must be greater than 0"
+                )));
+            }
+            if let (Some(min_pool_size), Some(pool_size)) =
+                (partition.min_pool_size, partition.pool_size)
+            {
+                if min_pool_size > pool_size {
+                    return Err(Error::BadConfig(format!(
+                        "min_pool_size of {min_pool_size} cannot be larger than pool_size of {pool_size} in partition {name}"
+                    )));
+                }
+            }
         }
 
         Ok(())
     }
 }
 
+/// Name of the database entry serving the databases that aren't configured.
+pub const WILDCARD_DATABASE: &str = "*";
+
+/// Separates the database and the partition in the name of a partition pool.
+pub const PARTITION_SEPARATOR: char = '/';
+
+/// Name of the pool serving clients of `database` with `pool_hint` set to `partition`.
+pub fn partition_pool_name(database: &str, partition: &str) -> String {
+    format!("{database}{PARTITION_SEPARATOR}{partition}")
+}
+
+/// Name of the pool of the replica `index` (from 1) of `database`.
+pub fn replica_pool_name(database: &str, index: usize) -> String {
+    partition_pool_name(database, &format!("replica{index}"))
+}
+
+/// Host and port of "host", "host:port" or "[ipv6]:port".
+pub fn parse_host_port(value: &str, default_port: u16) -> Result<(String, u16), Error> {
+    let bad_address = || Error::BadConfig(format!("invalid address {value:?}"));
+    let (host, port) = match value.strip_prefix('[') {
+        Some(rest) => {
+            let (host, port) = rest.split_once(']').ok_or_else(bad_address)?;
+            match port {
+                "" => (host, None),
+                port => (host, Some(port.strip_prefix(':').ok_or_else(bad_address)?)),
+            }
+        }
+        // More than one colon: an IPv6 address without port.
+        None => match value.split_once(':') {
+            Some((host, port)) if !port.contains(':') => (host, Some(port)),
+            _ => (value, None),
+        },
+    };
+    let port = match port {
+        Some(port) => port.parse().map_err(|_| bad_address())?,
+        None => default_port,
+    };
+    if host.is_empty() || port == 0 {
+        return Err(bad_address());
+    }
+    Ok((host.to_string(), port))
+}
+
+/// A rule of query_routes: transactions whose first statement matches the pattern
+/// run in the pool of the rule.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Hash)]
+pub struct QueryRoute {
+    /// Regular expression matched against the normalized statement.
+    pub pattern: String,
+
+    /// `primary`, a replica (`replica<N>`) or a partition of the database.
+    pub pool: String,
+}
+
+/// A backend cluster of the `*` entry, serving a share of its databases.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Hash)]
+pub struct TenantCluster {
+    /// "host" or "host:port" (server_port of the entry by default).
+    pub host: String,
+
+    /// Share of the databases of the cluster, relative to the weights of the others.
+    #[serde(default = "TenantCluster::default_weight")]
+    pub weight: u32,
+}
+
+impl TenantCluster {
+    pub fn default_weight() -> u32 {
+        1
+    }
+}
+
+/// Score of the database on a cluster for weighted rendezvous hashing: each
+/// database goes to the cluster of the highest score. It only depends on the
+/// names, so every instance assigns a database the same way, and a cluster added
+/// only takes the databases it wins from the others.
+fn rendezvous_score(cluster: &str, database: &str, weight: u32) -> f64 {
+    let digest = Sha256::new()
+        .chain_update(cluster)
+        .chain_update([0])
+        .chain_update(database)
+        .finalize();
+    let hash = u64::from_be_bytes(digest[..8].try_into().unwrap());
+    // Uniform in (0, 1).
+    let unit = ((hash >> 11) as f64 + 0.5) / (1u64 << 53) as f64;
+    weight as f64 / -unit.ln()
+}
+
+/// A sub-pool of a database with its own size and mode.
+/// Every user of the database gets a separate pool in each partition.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq, Eq, Hash, Default)]
+pub struct PoolPartition {
+    /// Size of the partition pool of each user, pool_size of the user by default.
+    pub pool_size: Option<u32>,
+    pub min_pool_size: Option<u32>,
+
+    /// Pool mode of the partition, the mode of the user or the database by default.
+    pub pool_mode: Option<PoolMode>,
+}
+
+impl PoolPartition {
+    /// Settings of `user` in this partition.
+    pub fn user(&self, user: &User) -> User {
+        let mut user = user.clone();
+        user.pool_size = self.pool_size.unwrap_or(user.pool_size);
+        user.min_pool_size = self.min_pool_size;
+        user.pool_mode = self.pool_mode.or(user.pool_mode);
+        user
+    }
+}
+
 impl Default for Pool {
     fn default() -> Pool {
         Pool {
@@ -665,14 +2180,78 @@ impl Default for Pool {
             users: BTreeMap::default(),
             server_port: 5432,
             server_host: String::from("127.0.0.1"),
+            server_hosts: Vec::new(),
+            load_balancing: LoadBalancing::default(),
+            server_weights: Vec::new(),
+            health_check_interval: 0,
+            failover_cooldown: Self::default_failover_cooldown(),
+            replica_hosts: Vec::new(),
+            read_your_writes: false,
+            max_replica_lag: 0,
+            replica_poll_interval: Self::default_replica_poll_interval(),
+            mirror_host: None,
+            mirror_log_diffs: false,
+            mirror_pool_size: Self::default_mirror_pool_size(),
             server_database: None,
             connect_timeout: None,
+            query_wait_timeout: None,
+            reserve_pool_size: None,
+            reserve_pool_timeout: None,
+            server_reset_timeout: None,
+            server_reset_query: None,
+            server_reset_in_background: false,
             idle_timeout: None,
             server_lifetime: None,
+            min_pool_size: None,
+            transaction_duration_warning: None,
+            transaction_duration_limit: None,
+            statement_timeout: None,
+            idle_in_transaction_session_timeout: None,
             cleanup_server_connections: true,
+            reject_role_changes: false,
             log_client_parameter_status_changes: false,
             application_name: None,
+            application_name_template: None,
+            application_name_passthrough: false,
+            login_notice: None,
             prepared_statements_cache_size: None,
+            server_bind_address: None,
+            server_tls_server_name: None,
+            server_tls_mode: None,
+            server_tls_ca_cert: None,
+            server_tls_certificate: None,
+            server_tls_private_key: None,
+            server_tcp_keepalives_idle: None,
+            server_tcp_keepalives_count: None,
+            server_tcp_keepalives_interval: None,
+            client_encoding: None,
+            normalize_client_encoding: false,
+            track_prepared_transactions: false,
+            track_session_parameters: false,
+            audit: false,
+            startup_parameters: Vec::new(),
+            max_replication_connections: 0,
+            max_db_client_connections: 0,
+            prepared_transaction_age_warning: Self::default_prepared_transaction_age_warning(),
+            load_check_query: None,
+            load_check_interval: Self::default_load_check_interval(),
+            load_threshold: 0,
+            overload_pool_size_percent: Self::default_overload_pool_size_percent(),
+            parameter_status_suppress: Vec::new(),
+            result_cache_pattern: None,
+            result_cache_ttl: Self::default_result_cache_ttl(),
+            result_cache_size: Self::default_result_cache_size(),
+            result_cache_max_result_size: Self::default_result_cache_max_result_size(),
+            auth_query: None,
+            auth_user: None,
+            auth_query_template_user: None,
+            auth_ldap_server: None,
+            auth_cert_map: None,
+            partitions: BTreeMap::default(),
+            tenant_clusters: BTreeMap::default(),
+            tenant_cluster_overrides: BTreeMap::default(),
+            parameter_status_overrides: BTreeMap::default(),
+            query_routes: Vec::new(),
         }
     }
 }
@@ -697,8 +2276,204 @@ impl Talos {
         }
     }
 
-    pub fn is_empty(&self) -> bool {
-        self.keys.is_empty() && self.databases.is_empty()
+    pub fn is_empty(&self) -> bool {
+        self.keys.is_empty() && self.databases.is_empty()
+    }
+}
+
+/// A trusted JWT issuer, referenced by users with a `jwt-issuers:` password.
+#[derive(Clone, PartialEq, Serialize, Deserialize, Debug, Hash, Eq)]
+pub struct JwtIssuer {
+    /// Expected `iss` claim of the tokens.
+    pub issuer: String,
+
+    /// Files with PEM public keys.
+    #[serde(default)]
+    pub keys: Vec<String>,
+
+    /// File with a JSON Web Key Set.
+    pub jwks_file: Option<String>,
+
+    /// URL of the JSON Web Key Set of the issuer, fetched again every jwks_refresh_interval.
+    pub jwks_url: Option<String>,
+
+    /// Fetch the JWKS from jwks_url this often (ms).
+    #[serde(default = "JwtIssuer::default_jwks_refresh_interval")]
+    pub jwks_refresh_interval: u64,
+
+    /// Required `aud` claim.
+    pub audience: Option<String>,
+
+    /// Tolerated clock difference when checking `exp` and `nbf`, in seconds.
+    #[serde(default)] // 0
+    pub clock_skew: u64,
+
+    /// Claim holding the user name.
+    #[serde(default = "JwtIssuer::default_username_claim")]
+    pub username_claim: String,
+
+    /// Suffix removed from the user name, e.g. `@example.com`.
+    pub username_strip_suffix: Option<String>,
+
+    /// Claim listing the databases the token allows ("*" for all), not checked if not set.
+    pub database_claim: Option<String>,
+
+    /// Claim listing the roles (groups) of the token at the identity provider.
+    pub role_claim: Option<String>,
+
+    /// Users each role of role_claim may connect as, besides the one of username_claim.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub role_map: BTreeMap<String, Vec<String>>,
+}
+
+impl JwtIssuer {
+    pub fn default_username_claim() -> String {
+        "preferred_username".to_string()
+    }
+
+    pub fn default_jwks_refresh_interval() -> u64 {
+        300_000
+    }
+
+    fn validate(&self, name: &str) -> Result<(), Error> {
+        if self.issuer.is_empty() {
+            return Err(Error::BadConfig(format!(
+                "jwt_issuers.{name}: issuer can't be empty"
+            )));
+        }
+        if self.keys.is_empty() && self.jwks_file.is_none() && self.jwks_url.is_none() {
+            return Err(Error::BadConfig(format!(
+                "jwt_issuers.{name}: keys, jwks_file or jwks_url must be specified"
+            )));
+        }
+        if let Some(ref jwks_url) = self.jwks_url {
+            if !jwks_url.starts_with("http://") && !jwks_url.starts_with("https://") {
+                return Err(Error::BadConfig(format!(
+                    "jwt_issuers.{name}: jwks_url must be an http:// or https:// URL: {jwks_url}"
+                )));
+            }
+            if self.jwks_refresh_interval == 0 {
+                return Err(Error::BadConfig(format!(
+                    "jwt_issuers.{name}: jwks_refresh_interval must be greater than 0"
+                )));
+            }
+        }
+        if !self.role_map.is_empty() && self.role_claim.is_none() {
+            return Err(Error::BadConfig(format!(
+                "jwt_issuers.{name}: role_map requires role_claim"
+            )));
+        }
+        Ok(())
+    }
+}
+
+/// An LDAP server, referenced by users and pools with `auth_ldap_server`.
+///
+/// Without `base_dn` the user binds as `prefix` + user name + `suffix` (simple bind),
+/// with it the DN is first searched for by `search_attribute` (search+bind).
+#[derive(Clone, PartialEq, Serialize, Deserialize, Debug, Hash, Eq)]
+pub struct LdapServer {
+    /// ldap://host[:port] or ldaps://host[:port].
+    pub url: String,
+
+    /// Upgrade ldap:// connections to TLS with StartTLS.
+    #[serde(default)] // false
+    pub starttls: bool,
+
+    /// CA certificate (PEM) of the server, in addition to the system ones.
+    pub tls_ca_cert: Option<String>,
+
+    /// Simple bind: DN of the user is prefix + user name + suffix.
+    #[serde(default)]
+    pub prefix: String,
+    #[serde(default)]
+    pub suffix: String,
+
+    /// Search+bind: root of the search for the user.
+    pub base_dn: Option<String>,
+
+    /// Search+bind: attribute matched against the user name.
+    #[serde(default = "LdapServer::default_search_attribute")]
+    pub search_attribute: String,
+
+    /// Search+bind: DN and password to bind as for the search, anonymous if not set.
+    pub bind_dn: Option<String>,
+    pub bind_password: Option<String>,
+
+    /// Timeout of an authentication, in milliseconds.
+    #[serde(default = "LdapServer::default_timeout")]
+    pub timeout: u64,
+
+    /// Maximum number of idle connections kept to the server.
+    #[serde(default = "LdapServer::default_pool_size")]
+    pub pool_size: usize,
+}
+
+impl LdapServer {
+    pub fn default_search_attribute() -> String {
+        "uid".to_string()
+    }
+
+    pub fn default_timeout() -> u64 {
+        5000
+    }
+
+    pub fn default_pool_size() -> usize {
+        4
+    }
+
+    fn validate(&self, name: &str) -> Result<(), Error> {
+        let tls = match parse_ldap_url(&self.url) {
+            Ok((tls, _, _)) => tls,
+            Err(Error::BadConfig(err)) => {
+                return Err(Error::BadConfig(format!("ldap_servers.{name}: {err}")))
+            }
+            Err(err) => return Err(err),
+        };
+        if tls && self.starttls {
+            return Err(Error::BadConfig(format!(
+                "ldap_servers.{name}: starttls can't be used with ldaps://"
+            )));
+        }
+        if self.base_dn.is_none() && (self.bind_dn.is_some() || self.bind_password.is_some()) {
+            return Err(Error::BadConfig(format!(
+                "ldap_servers.{name}: bind_dn and bind_password require base_dn"
+            )));
+        }
+        if self.base_dn.is_some() && (!self.prefix.is_empty() || !self.suffix.is_empty()) {
+            return Err(Error::BadConfig(format!(
+                "ldap_servers.{name}: prefix and suffix can't be used with base_dn"
+            )));
+        }
+        if self.bind_password.is_some() && self.bind_dn.is_none() {
+            return Err(Error::BadConfig(format!(
+                "ldap_servers.{name}: bind_password requires bind_dn"
+            )));
+        }
+        if self.timeout == 0 {
+            return Err(Error::BadConfig(format!(
+                "ldap_servers.{name}: timeout must be greater than 0"
+            )));
+        }
+        Ok(())
+    }
+}
+
+impl Default for LdapServer {
+    fn default() -> LdapServer {
+        LdapServer {
+            url: "ldap://localhost".to_string(),
+            starttls: false,
+            tls_ca_cert: None,
+            prefix: String::new(),
+            suffix: String::new(),
+            base_dn: None,
+            search_attribute: Self::default_search_attribute(),
+            bind_dn: None,
+            bind_password: None,
+            timeout: Self::default_timeout(),
+            pool_size: Self::default_pool_size(),
+        }
     }
 }
 
@@ -724,6 +2499,8 @@ impl Include {
 pub struct GeneralWithInclude {
     #[serde(default = "General::default_include")]
     pub include: Include,
+    #[serde(default = "Cluster::empty")]
+    pub cluster: Cluster,
 }
 
 /// Configuration wrapper.
@@ -753,10 +2530,22 @@ pub struct Config {
     #[serde(default = "Prometheus::empty")]
     pub prometheus: Prometheus,
 
+    // StatsD settings.
+    #[serde(default = "Statsd::empty")]
+    pub statsd: Statsd,
+
     // Talos settings.
     #[serde(default = "Talos::empty", skip_serializing_if = "Talos::is_empty")]
     pub talos: Talos,
 
+    // Trusted JWT issuers.
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub jwt_issuers: HashMap<String, JwtIssuer>,
+
+    // LDAP servers for client authentication.
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub ldap_servers: HashMap<String, LdapServer>,
+
     // Connection pools.
     pub pools: HashMap<String, Pool>,
 
@@ -766,6 +2555,10 @@ pub struct Config {
         skip_serializing_if = "Include::is_empty"
     )]
     pub include: Include,
+
+    // Shared configuration of a fleet.
+    #[serde(default = "Cluster::empty", skip_serializing_if = "Cluster::is_empty")]
+    pub cluster: Cluster,
 }
 
 impl Config {
@@ -780,12 +2573,16 @@ impl Default for Config {
             path: Self::default_path(),
             general: General::default(),
             prometheus: Prometheus::empty(),
+            statsd: Statsd::empty(),
             pools: HashMap::default(),
             talos: Talos {
                 keys: vec![],
                 databases: vec![],
             },
+            jwt_issuers: HashMap::new(),
+            ldap_servers: HashMap::new(),
             include: Include { files: Vec::new() },
+            cluster: Cluster::empty(),
         }
     }
 }
@@ -817,6 +2614,10 @@ impl From<&Config> for std::collections::HashMap<String, String> {
         let mut static_settings = vec![
             ("host".to_string(), config.general.host.to_string()),
             ("port".to_string(), config.general.port.to_string()),
+            (
+                "ipv6_only".to_string(),
+                config.general.ipv6_only.to_string(),
+            ),
             (
                 "connect_timeout".to_string(),
                 config.general.connect_timeout.to_string(),
@@ -830,6 +2631,9 @@ impl From<&Config> for std::collections::HashMap<String, String> {
                 config.general.shutdown_timeout.to_string(),
             ),
         ];
+        if let Some(version) = config_version() {
+            static_settings.push(("cluster_config_version".to_string(), version));
+        }
 
         r.append(&mut static_settings);
         r.iter().cloned().collect()
@@ -837,10 +2641,38 @@ impl From<&Config> for std::collections::HashMap<String, String> {
 }
 
 impl Config {
+    /// Configuration of a pool by its name. Partition and replica pools share the
+    /// configuration of their database, the databases that aren't configured the
+    /// one of the `*` entry.
+    pub fn pool_config(&self, pool_name: &str) -> Option<&Pool> {
+        self.configured_pool(pool_name)
+            .or_else(|| self.pools.get(WILDCARD_DATABASE))
+    }
+
+    fn configured_pool(&self, pool_name: &str) -> Option<&Pool> {
+        if let Some(pool) = self.pools.get(pool_name) {
+            return Some(pool);
+        }
+        let (database, partition) = pool_name.rsplit_once(PARTITION_SEPARATOR)?;
+        self.pools
+            .get(database)
+            .filter(|pool| pool.partitions.contains_key(partition) || pool.is_replica(partition))
+    }
+
+    /// The `*` entry the pools of the database are created from, None if the
+    /// database is configured.
+    pub fn wildcard_pool(&self, database: &str) -> Option<&Pool> {
+        if self.configured_pool(database).is_some() {
+            return None;
+        }
+        self.pools.get(WILDCARD_DATABASE)
+    }
+
     /// Print current configuration.
     pub fn show(&self) {
         info!("Worker threads: {}", self.general.worker_threads);
         info!("Connection timeout: {}ms", self.general.connect_timeout);
+        info!("DNS max TTL: {}ms", self.general.dns_max_ttl);
         info!("Idle timeout: {}ms", self.general.idle_timeout);
         info!(
             "Log client connections: {}",
@@ -850,7 +2682,32 @@ impl Config {
             "Log client disconnections: {}",
             self.general.log_client_disconnections
         );
+        info!(
+            "Redact query literals in logs: {}",
+            self.general.log_redact_query_literals
+        );
+        if let Some(ref event_sink) = self.general.event_sink {
+            info!("Event sink: {event_sink}");
+        }
+        if let Some(ref audit_log) = self.general.audit_log {
+            info!("Audit log: {audit_log}");
+        }
+        if let Some(ref health_listen) = self.general.health_listen {
+            info!("Health endpoints: {health_listen}");
+        }
+        if self.general.config_check_interval > 0 {
+            info!(
+                "Config files checked for changes every {}ms",
+                self.general.config_check_interval
+            );
+        }
         info!("Shutdown timeout: {}ms", self.general.shutdown_timeout);
+        if self.general.slow_query_threshold > 0 {
+            info!(
+                "Slow query threshold: {}ms, logged per second: {}",
+                self.general.slow_query_threshold, self.general.slow_query_log_rate
+            );
+        }
         info!(
             "Message size to be steam: {}",
             self.general.message_size_to_be_stream
@@ -867,6 +2724,55 @@ impl Config {
         info!("Max connections: {}", self.general.max_connections);
         info!("Sever round robin: {}", self.general.server_round_robin);
         info!("HBA config: {:?}", self.general.hba);
+        for listener in &self.general.listeners {
+            info!(
+                "Listener {}: tls required: {}, admin only: {}, read only: {}, proxy protocol: {}",
+                format_host_port(&listener.host, listener.port),
+                listener.tls_required,
+                listener.admin_only,
+                listener.read_only,
+                listener.proxy_protocol
+            );
+        }
+        if self.general.login_rate_limit != 0 || self.general.login_rate_limit_per_ip != 0 {
+            info!(
+                "Login rate limit: {}/s, per address: {}/s",
+                self.general.login_rate_limit, self.general.login_rate_limit_per_ip
+            );
+        }
+        if self.general.auth_failure_delay != 0 {
+            info!(
+                "Auth failure delay: {}ms, up to {}ms",
+                self.general.auth_failure_delay, self.general.auth_failure_max_delay
+            );
+        }
+        if self.general.peer_id != 0 {
+            info!("Peer id: {}", self.general.peer_id);
+        }
+        for peer in &self.general.peers {
+            info!(
+                "Peer {}: {}",
+                peer.peer_id,
+                format_host_port(&peer.host, peer.port)
+            );
+        }
+        for route in &self.general.tls_sni {
+            info!(
+                "TLS server name {}: database {}, certificate {}",
+                route.server_name,
+                route
+                    .database
+                    .as_deref()
+                    .unwrap_or("requested by the client"),
+                route
+                    .tls_certificate
+                    .as_deref()
+                    .unwrap_or("of tls_certificate")
+            );
+        }
+        if self.general.error_injection {
+            warn!("Error injection is enabled");
+        }
         match self.general.tls_certificate.clone() {
             Some(tls_certificate) => {
                 info!("TLS certificate: {tls_certificate}");
@@ -875,6 +2781,22 @@ impl Config {
                     info!("TLS private key: {tls_private_key}");
                     info!("TLS support is enabled");
                 }
+                info!(
+                    "TLS versions: {} to {}",
+                    self.general.tls_min_version,
+                    self.general
+                        .tls_max_version
+                        .map_or("newest".to_string(), |version| version.to_string())
+                );
+                if let Some(tls_ciphers) = &self.general.tls_ciphers {
+                    info!("TLS ciphers: {tls_ciphers}");
+                }
+                if let Some(tls_ciphersuites) = &self.general.tls_ciphersuites {
+                    info!("TLS 1.3 ciphersuites: {tls_ciphersuites}");
+                }
+                if let Some(tls_curves) = &self.general.tls_curves {
+                    info!("TLS curves: {tls_curves}");
+                }
             }
             None => {
                 info!("TLS support is disabled");
@@ -910,6 +2832,26 @@ impl Config {
                 .connect_timeout
                 .unwrap_or(self.general.connect_timeout);
             info!("[pool: {pool_name}] Connection timeout: {connect_timeout}ms");
+            let query_wait_timeout = pool_config
+                .query_wait_timeout
+                .unwrap_or(self.general.query_wait_timeout);
+            info!("[pool: {pool_name}] Query wait timeout: {query_wait_timeout}ms");
+            let (reserve_pool_size, reserve_pool_timeout) = pool_config.reserve_pool(&self.general);
+            if reserve_pool_size > 0 {
+                info!(
+                    "[pool: {pool_name}] Reserve pool size: {reserve_pool_size}, timeout: {reserve_pool_timeout}ms"
+                );
+            }
+            let server_reset_timeout = pool_config
+                .server_reset_timeout
+                .unwrap_or(self.general.server_reset_timeout);
+            info!("[pool: {pool_name}] Server reset timeout: {server_reset_timeout}ms");
+            if let Some(ref server_reset_query) = pool_config.server_reset_query {
+                info!("[pool: {pool_name}] Server reset query: {server_reset_query:?}");
+            }
+            if pool_config.server_reset_in_background {
+                info!("[pool: {pool_name}] Server reset in background");
+            }
             let idle_timeout = pool_config
                 .idle_timeout
                 .unwrap_or(self.general.idle_timeout);
@@ -927,14 +2869,125 @@ impl Config {
                     None => "default".to_string(),
                 }
             );
+            if let Some(min_pool_size) = pool_config.min_pool_size {
+                info!("[pool: {pool_name}] Minimum pool size: {min_pool_size}");
+            }
             info!(
                 "[pool: {}] Cleanup server connections: {}",
                 pool_name, pool_config.cleanup_server_connections
             );
+            if pool_config.reject_role_changes {
+                info!("[pool: {pool_name}] Reject role changes in transaction mode");
+            }
             info!(
                 "[pool: {}] Log client parameter status changes: {}",
                 pool_name, pool_config.log_client_parameter_status_changes
             );
+            if let Some(bind_address) = pool_config.server_bind_address {
+                info!("[pool: {pool_name}] Server bind address: {bind_address}");
+            }
+            let server_tls_mode = pool_config.server_tls_mode(&self.general);
+            if server_tls_mode != ServerTlsMode::Disable {
+                info!("[pool: {pool_name}] Server TLS mode: {server_tls_mode}");
+            }
+            if let Some(ref server_name) = pool_config.server_tls_server_name {
+                info!("[pool: {pool_name}] Server TLS server name: {server_name}");
+            }
+            info!(
+                "[pool: {}] Server TCP keepalives: idle {}s, count {}, interval {}s",
+                pool_name,
+                pool_config
+                    .server_tcp_keepalives_idle
+                    .unwrap_or(self.general.tcp_keepalives_idle),
+                pool_config
+                    .server_tcp_keepalives_count
+                    .unwrap_or(self.general.tcp_keepalives_count),
+                pool_config
+                    .server_tcp_keepalives_interval
+                    .unwrap_or(self.general.tcp_keepalives_interval)
+            );
+            if let Some(ref encoding) = pool_config.client_encoding {
+                info!(
+                    "[pool: {}] Client encoding: {} ({})",
+                    pool_name,
+                    encoding,
+                    if pool_config.normalize_client_encoding {
+                        "normalize"
+                    } else {
+                        "reject others"
+                    }
+                );
+            }
+            if pool_config.track_prepared_transactions {
+                info!(
+                    "[pool: {}] Track prepared transactions, warn after {}ms",
+                    pool_name, pool_config.prepared_transaction_age_warning
+                );
+            }
+            if pool_config.track_session_parameters {
+                info!("[pool: {pool_name}] Track session parameters");
+            }
+            if let Some(ref template) = pool_config.application_name_template {
+                info!("[pool: {pool_name}] Application name template: {template:?}");
+            }
+            if pool_config.application_name_passthrough {
+                info!("[pool: {pool_name}] Application name passthrough");
+            }
+            if pool_config.audit {
+                info!("[pool: {pool_name}] Audit");
+            }
+            if !pool_config.startup_parameters.is_empty() {
+                info!(
+                    "[pool: {}] Startup parameters: {}",
+                    pool_name,
+                    pool_config.startup_parameters.join(", ")
+                );
+            }
+            if let Some(ref auth_user) = pool_config.auth_user {
+                info!(
+                    "[pool: {}] Auth query: {:?} as {}",
+                    pool_name,
+                    pool_config
+                        .auth_query
+                        .as_deref()
+                        .unwrap_or(DEFAULT_AUTH_QUERY),
+                    auth_user
+                );
+            }
+            if let Some(ref template) = pool_config.auth_query_template_user {
+                info!("[pool: {pool_name}] Users not listed are served with the settings of {template}");
+            }
+            if let Some(ref ldap_server) = pool_config.auth_ldap_server {
+                info!("[pool: {pool_name}] LDAP authentication with {ldap_server}");
+            }
+            if let Some(ref cert_map) = pool_config.auth_cert_map {
+                info!("[pool: {pool_name}] Certificate authentication with map {cert_map}");
+            }
+            for (name, value) in &pool_config.parameter_status_overrides {
+                info!("[pool: {pool_name}] Report parameter {name} to clients as {value:?}");
+            }
+            if !pool_config.parameter_status_suppress.is_empty() {
+                info!(
+                    "[pool: {}] Don't report parameters to clients: {}",
+                    pool_name,
+                    pool_config.parameter_status_suppress.join(", ")
+                );
+            }
+            for (partition_name, partition) in &pool_config.partitions {
+                info!(
+                    "[pool: {}] Partition {}: pool size {}, pool mode {}",
+                    pool_name,
+                    partition_name,
+                    match partition.pool_size {
+                        Some(pool_size) => pool_size.to_string(),
+                        None => "default".to_string(),
+                    },
+                    match partition.pool_mode {
+                        Some(pool_mode) => pool_mode.to_string(),
+                        None => "default".to_string(),
+                    }
+                );
+            }
 
             for user in &pool_config.users {
                 info!(
@@ -945,7 +2998,10 @@ impl Config {
                     "[pool: {}][user: {}] Minimum pool size: {}",
                     pool_name,
                     user.1.username,
-                    user.1.min_pool_size.unwrap_or(0)
+                    user.1
+                        .min_pool_size
+                        .or(pool_config.min_pool_size)
+                        .unwrap_or(0)
                 );
                 info!(
                     "[pool: {}][user: {}] Pool mode: {}",
@@ -965,13 +3021,103 @@ impl Config {
                         None => "default".to_string(),
                     }
                 );
+                if self.general.prepared_statements {
+                    info!(
+                        "[pool: {}][user: {}] Prepared statements server cache size: {}",
+                        pool_name,
+                        user.1.username,
+                        pool_config.prepared_statements_cache_size(user.1, &self.general)
+                    );
+                }
             }
         }
     }
 
-    pub async fn validate(&mut self) -> Result<(), Error> {
+    /// Check the config and load the files and patterns it refers to. What is
+    /// loaded takes effect with LoadedConfig::publish once the config is accepted.
+    pub async fn validate(&mut self) -> Result<LoadedConfig, Error> {
         self.talos.validate().await?;
+        self.statsd.validate()?;
+        self.cluster.validate()?;
+        for (name, issuer) in self.jwt_issuers.iter() {
+            issuer.validate(name)?;
+            check_jwt_issuer_keys(name, issuer)?;
+        }
+        for (name, server) in self.ldap_servers.iter() {
+            server.validate(name)?;
+        }
+        let cert_ident_maps = load_cert_ident_maps(self.general.tls_cert_ident_file.as_deref())?;
+        let cert_maps = cert_ident_maps.names();
+        let hba_rules = load_hba_file(self.general.hba_file.as_deref())?;
+        let mut allowlists: Vec<(String, StatementAllowlistMode)> = Vec::new();
+        for user in self.pools.values().flat_map(|pool| pool.users.values()) {
+            if let Some(ref path) = user.statement_allowlist {
+                let mode = user.statement_allowlist_mode.unwrap_or_default();
+                match allowlists.iter_mut().find(|(other, _)| other == path) {
+                    // A file recorded by one user and enforced for another must exist.
+                    Some((_, other_mode)) if mode == StatementAllowlistMode::Enforce => {
+                        *other_mode = mode
+                    }
+                    Some(_) => (),
+                    None => allowlists.push((path.clone(), mode)),
+                }
+            }
+        }
+        let statement_allowlists = load_statement_allowlists(&allowlists)?;
+        let query_routes = load_query_routes(&self.pools)?;
+        let result_caches = load_result_caches(&self.pools)?;
         for (name, pool) in self.pools.iter() {
+            for cert_map in pool
+                .users
+                .values()
+                .filter_map(|user| pool.auth_cert_map(user))
+            {
+                if self.general.tls_mode.as_deref() != Some("verify-full") {
+                    return Err(Error::BadConfig(format!(
+                        "Error in pool {{ {name} }}. auth_cert_map requires tls_mode verify-full."
+                    )));
+                }
+                if !cert_maps.iter().any(|map| map == cert_map) {
+                    return Err(Error::BadConfig(format!(
+                        "Error in pool {{ {name} }}. auth_cert_map refers to unknown map {cert_map} of tls_cert_ident_file."
+                    )));
+                }
+            }
+            if name == WILDCARD_DATABASE
+                && (pool.server_database.is_some()
+                    || !pool.partitions.is_empty()
+                    || !pool.replica_hosts.is_empty())
+            {
+                return Err(Error::BadConfig(format!(
+                    "Error in pool {{ {name} }}. The {WILDCARD_DATABASE} entry forwards the database names as they are, it can't set server_database, partitions or replica_hosts."
+                )));
+            }
+            if name != WILDCARD_DATABASE
+                && (!pool.tenant_clusters.is_empty() || !pool.tenant_cluster_overrides.is_empty())
+            {
+                return Err(Error::BadConfig(format!(
+                    "Error in pool {{ {name} }}. tenant_clusters and tenant_cluster_overrides are only for the {WILDCARD_DATABASE} entry."
+                )));
+            }
+            let (reserve_pool_size, reserve_pool_timeout) = pool.reserve_pool(&self.general);
+            let query_wait_timeout = pool
+                .query_wait_timeout
+                .unwrap_or(self.general.query_wait_timeout);
+            if reserve_pool_size > 0
+                && reserve_pool_timeout > 0
+                && reserve_pool_timeout >= query_wait_timeout
+            {
+                return Err(Error::BadConfig(format!(
+                    "Error in pool {{ {name} }}. reserve_pool_timeout of {reserve_pool_timeout}ms must be less than query_wait_timeout of {query_wait_timeout}ms."
+                )));
+            }
+            if let Some(ref ldap_server) = pool.auth_ldap_server {
+                if !self.ldap_servers.contains_key(ldap_server) {
+                    return Err(Error::BadConfig(format!(
+                        "Error in pool {{ {name} }}. auth_ldap_server refers to unknown LDAP server {ldap_server}."
+                    )));
+                }
+            }
             for (_name, user_data) in pool.users.iter() {
                 if self.general.virtual_pool_count > user_data.pool_size as u16 {
                     return Err(Error::BadConfig(format!(
@@ -979,6 +3125,46 @@ impl Config {
                     Please set virtual_pool_count less then pool_size."
                     )));
                 }
+                if let Some(ref ldap_server) = user_data.auth_ldap_server {
+                    if !self.ldap_servers.contains_key(ldap_server) {
+                        return Err(Error::BadConfig(format!(
+                            "Error in pool {{ {name} }}. User {} refers to unknown LDAP server {ldap_server}.",
+                            user_data.username
+                        )));
+                    }
+                }
+                if let Some(issuers) = jwt_issuer_names(&user_data.password) {
+                    if issuers.is_empty() {
+                        return Err(Error::BadConfig(format!(
+                            "Error in pool {{ {name} }}. User {} has no JWT issuers.",
+                            user_data.username
+                        )));
+                    }
+                    for issuer in issuers {
+                        if !self.jwt_issuers.contains_key(&issuer) {
+                            return Err(Error::BadConfig(format!(
+                                "Error in pool {{ {name} }}. User {} refers to unknown JWT issuer {issuer}.",
+                                user_data.username
+                            )));
+                        }
+                    }
+                }
+            }
+            for (partition_name, partition) in pool.partitions.iter() {
+                let partition_pool = partition_pool_name(name, partition_name);
+                if self.pools.contains_key(&partition_pool) {
+                    return Err(Error::BadConfig(format!(
+                        "Error in pool {{ {name} }}. Partition {partition_name} conflicts with pool {partition_pool}."
+                    )));
+                }
+                if let Some(pool_size) = partition.pool_size {
+                    if self.general.virtual_pool_count > pool_size as u16 {
+                        return Err(Error::BadConfig(format!(
+                            "Error in pool {{ {name} }}. \
+                    Please set virtual_pool_count less then pool_size of partition {partition_name}."
+                        )));
+                    }
+                }
             }
         }
 
@@ -995,11 +3181,60 @@ impl Config {
             ));
         }
 
+        if let Some(ref event_sink) = self.general.event_sink {
+            validate_event_sink(event_sink)?;
+        }
+        if let Some(ref audit_log) = self.general.audit_log {
+            validate_audit_log(audit_log)?;
+        }
+        if let Some(ref health_listen) = self.general.health_listen {
+            if health_listen.parse::<SocketAddr>().is_err() {
+                return Err(Error::BadConfig(format!(
+                    "health_listen {health_listen} must be an ip:port address"
+                )));
+            }
+        }
+
         // Validate prepared_statements
         if self.general.prepared_statements && self.general.prepared_statements_cache_size == 0 {
             return Err(Error::BadConfig("The value of prepared_statements_cache should be greater than 0 if prepared_statements are enabled".to_string()));
         }
 
+        let mut addresses = vec![(self.general.host.as_str(), self.general.port)];
+        for listener in &self.general.listeners {
+            let address = format_host_port(&listener.host, listener.port);
+            if listener.port == 0 {
+                return Err(Error::BadConfig(format!(
+                    "port of listener {address} must be greater than 0"
+                )));
+            }
+            if addresses.contains(&(listener.host.as_str(), listener.port)) {
+                return Err(Error::BadConfig(format!(
+                    "listener {address} is configured twice"
+                )));
+            }
+            addresses.push((listener.host.as_str(), listener.port));
+            if listener.tls_required && self.general.tls_certificate.is_none() {
+                return Err(Error::BadConfig(format!(
+                    "listener {address} requires TLS but tls_certificate is not set"
+                )));
+            }
+        }
+
+        // The peers list is the same on all peers, each one skips itself.
+        if !self.general.peers.is_empty() && self.general.peer_id == 0 {
+            return Err(Error::BadConfig("peers requires peer_id".to_string()));
+        }
+        let mut peer_ids = HashSet::new();
+        for peer in &self.general.peers {
+            if peer.peer_id == 0 || !peer_ids.insert(peer.peer_id) {
+                return Err(Error::BadConfig(format!(
+                    "peer {} needs a peer_id greater than 0 and not used by another peer",
+                    format_host_port(&peer.host, peer.port)
+                )));
+            }
+        }
+
         // Validate TLS
         {
             if self.general.tls_certificate.is_none() && self.general.tls_private_key.is_some() {
@@ -1049,13 +3284,132 @@ impl Config {
                     }
                 }
             };
+
+            if let Some(tls_max_version) = self.general.tls_max_version {
+                if tls_max_version < self.general.tls_min_version {
+                    return Err(Error::BadConfig(format!(
+                        "tls_max_version {tls_max_version} is older than tls_min_version {}",
+                        self.general.tls_min_version
+                    )));
+                }
+            }
+            // Unknown ciphers or curves are only found building the acceptor.
+            if self.general.tls_ciphers.is_some()
+                || self.general.tls_ciphersuites.is_some()
+                || self.general.tls_curves.is_some()
+            {
+                if let (Some(tls_certificate), Some(tls_private_key)) =
+                    (&self.general.tls_certificate, &self.general.tls_private_key)
+                {
+                    if let Err(err) = tls::build_acceptor(
+                        Path::new(tls_certificate),
+                        Path::new(tls_private_key),
+                        None::<&Path>,
+                        None,
+                        &[],
+                        &tls::TlsProtocols::from_general(&self.general),
+                    ) {
+                        return Err(Error::BadConfig(format!(
+                            "tls_ciphers, tls_ciphersuites or tls_curves is incorrect: {err}"
+                        )));
+                    }
+                }
+            }
+        }
+
+        let mut server_names = HashSet::new();
+        for route in &self.general.tls_sni {
+            if self.general.tls_certificate.is_none() {
+                return Err(Error::BadConfig(format!(
+                    "tls_sni {} requires tls_certificate",
+                    route.server_name
+                )));
+            }
+            if route.server_name.is_empty()
+                || !server_names.insert(route.server_name.to_ascii_lowercase())
+            {
+                return Err(Error::BadConfig(format!(
+                    "tls_sni server_name \"{}\" is empty or used by another route",
+                    route.server_name
+                )));
+            }
+            if let Some(database) = &route.database {
+                if !self.pools.contains_key(database) {
+                    return Err(Error::BadConfig(format!(
+                        "tls_sni {} routes to database {database} which is not configured",
+                        route.server_name
+                    )));
+                }
+            }
+            match (&route.tls_certificate, &route.tls_private_key) {
+                (Some(certificate), Some(private_key)) => {
+                    if let Err(err) = load_identity(Path::new(certificate), Path::new(private_key))
+                    {
+                        return Err(Error::BadConfig(format!(
+                            "tls_sni {} is incorrectly configured: {err:?}",
+                            route.server_name
+                        )));
+                    }
+                }
+                (None, None) => (),
+                _ => {
+                    return Err(Error::BadConfig(format!(
+                        "tls_sni {} needs both tls_certificate and tls_private_key",
+                        route.server_name
+                    )))
+                }
+            }
         }
 
-        for pool in self.pools.values_mut() {
+        for (name, pool) in self.pools.iter_mut() {
             pool.validate().await?;
+            // Spread over the virtual pools, the ones after the first min_pool_size keep none.
+            let virtual_pool_count = self.general.virtual_pool_count as u32;
+            let (reserve_pool_size, _) = pool.reserve_pool(&self.general);
+            if reserve_pool_size > 0 && reserve_pool_size < virtual_pool_count {
+                warn!(
+                    "reserve_pool_size of {reserve_pool_size} in pool {name} is less than virtual_pool_count of {virtual_pool_count}, some virtual pools have no reserve"
+                );
+            }
+            for user in pool.users.values() {
+                let min_pool_size = user.min_pool_size.or(pool.min_pool_size).unwrap_or(0);
+                if min_pool_size > 0 && min_pool_size < virtual_pool_count {
+                    warn!(
+                        "min_pool_size of {min_pool_size} of user {} in pool {name} is less than virtual_pool_count of {virtual_pool_count}, some virtual pools keep no connections",
+                        user.username
+                    );
+                }
+            }
         }
 
-        Ok(())
+        Ok(LoadedConfig {
+            cert_ident_maps,
+            hba_rules,
+            statement_allowlists,
+            query_routes,
+            result_caches,
+        })
+    }
+}
+
+/// Files and patterns of a config loaded by Config::validate, they replace the
+/// current ones only once the whole config is valid.
+pub struct LoadedConfig {
+    cert_ident_maps: CertIdentMaps,
+    hba_rules: HbaRules,
+    statement_allowlists: StatementAllowlists,
+    query_routes: QueryRoutes,
+    result_caches: ResultCaches,
+}
+
+impl LoadedConfig {
+    /// Put the loaded files and patterns in use.
+    pub fn publish(self) {
+        set_cert_ident_maps(self.cert_ident_maps);
+        set_hba_rules(self.hba_rules);
+        set_statement_allowlists(self.statement_allowlists);
+        set_query_routes(self.query_routes);
+        set_result_caches(self.result_caches);
     }
 }
 
@@ -1085,6 +3439,89 @@ async fn load_file(path: &str) -> Result<String, Error> {
     Ok(contents)
 }
 
+/// `*` matches any characters of the name, `?` one character.
+fn wildcard_match(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+    // Position after the last `*` and the name position it matched up to.
+    let (mut p, mut n) = (0, 0);
+    let mut star: Option<(usize, usize)> = None;
+    while n < name.len() {
+        if p < pattern.len() && (pattern[p] == '?' || pattern[p] == name[n]) {
+            p += 1;
+            n += 1;
+        } else if p < pattern.len() && pattern[p] == '*' {
+            p += 1;
+            star = Some((p, n));
+        } else if let Some((star_p, star_n)) = star {
+            p = star_p;
+            n = star_n + 1;
+            star = Some((star_p, n));
+        } else {
+            return false;
+        }
+    }
+    pattern[p..].iter().all(|c| *c == '*')
+}
+
+/// Directory and file name pattern of an include entry naming a directory
+/// or a wildcard, None for a single file.
+fn include_dir(include: &str) -> Option<(&Path, &str)> {
+    let path = Path::new(include);
+    match path.file_name().and_then(|name| name.to_str()) {
+        Some(name) if name.contains(['*', '?']) => {
+            let dir = match path.parent() {
+                Some(dir) if !dir.as_os_str().is_empty() => dir,
+                _ => Path::new("."),
+            };
+            Some((dir, name))
+        }
+        _ if path.is_dir() => Some((path, "*.toml")),
+        _ => None,
+    }
+}
+
+/// Files of an include entry in the order they are merged: the file itself,
+/// the `*.toml` files of a directory or the files matching a wildcard in the
+/// file name, sorted by name.
+async fn include_files(include: &str) -> Result<Vec<String>, Error> {
+    let (dir, pattern) = match include_dir(include) {
+        Some(dir) => dir,
+        None => return Ok(vec![include.to_string()]),
+    };
+    let mut entries = match tokio::fs::read_dir(dir).await {
+        Ok(entries) => entries,
+        Err(err) => {
+            return Err(Error::BadConfig(format!(
+                "Could not read include directory {}: {err}",
+                dir.display()
+            )));
+        }
+    };
+    let mut files = Vec::new();
+    loop {
+        let entry = match entries.next_entry().await {
+            Ok(Some(entry)) => entry,
+            Ok(None) => break,
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Could not read include directory {}: {err}",
+                    dir.display()
+                )));
+            }
+        };
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !name.starts_with('.') && wildcard_match(pattern, &name) && entry.path().is_file() {
+            files.push(entry.path().to_string_lossy().to_string());
+        }
+    }
+    files.sort();
+    if files.is_empty() {
+        info!("No config files match include {include}");
+    }
+    Ok(files)
+}
+
 /// Parse the configuration file located at the path.
 pub async fn parse(path: &str) -> Result<(), Error> {
     // parse only include.files = ["./path/to/file",...]
@@ -1103,18 +3540,28 @@ pub async fn parse(path: &str) -> Result<(), Error> {
         Ok(value) => value,
         Err(err) => {
             return Err(Error::BadConfig(format!(
-                "Could not toml parse file {path}: {err:?}"
+                "Could not toml parse file {path}: {err}"
             )));
         }
     };
-    for file in include_config.include.files {
+    let mut files = Vec::new();
+    // The directories of the include entries too, for the files added to them.
+    let mut watched_files = vec![path.to_string()];
+    for include in &include_config.include.files {
+        if let Some((dir, _)) = include_dir(include) {
+            watched_files.push(dir.to_string_lossy().to_string());
+        }
+        files.extend(include_files(include).await?);
+    }
+    watched_files.extend(files.iter().cloned());
+    for file in files {
         info!("Merge config with include file: {file}");
         let include_file_content = load_file(file.as_str()).await?;
         let include_file_value = match include_file_content.parse() {
             Ok(value) => value,
             Err(err) => {
                 return Err(Error::BadConfig(format!(
-                    "Could not toml parse file {file}: {err:?}"
+                    "Could not toml parse file {file}: {err}"
                 )));
             }
         };
@@ -1128,20 +3575,56 @@ pub async fn parse(path: &str) -> Result<(), Error> {
         };
     }
 
-    let table = config_merged.as_table().unwrap();
+    // The shared document of the fleet goes over the local files.
+    if !include_config.cluster.is_empty() {
+        let contents = remote_config(&include_config.cluster).await?;
+        let remote_value = match contents.parse() {
+            Ok(value) => value,
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Could not toml parse {}: {err}",
+                    include_config.cluster.url
+                )));
+            }
+        };
+        config_merged = match serde_toml_merge::merge(config_merged, remote_value) {
+            Ok(value) => value,
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Could merge config from {}: {err:?}",
+                    include_config.cluster.url
+                )));
+            }
+        };
+    }
+
+    let table = config_merged.as_table_mut().unwrap();
+    for option in apply_env(table, std::env::vars())? {
+        info!("Config option {option} set from the environment");
+    }
+    for warning in migrate_config(table) {
+        warn!("Config {path}: {warning}");
+    }
     let mut config: Config = match toml::from_str(&table.to_string()) {
         Ok(config) => config,
         Err(err) => {
-            return Err(Error::BadConfig(format!("Could not merge config: {err:?}")));
+            return Err(Error::BadConfig(format!("Could not merge config: {err}")));
         }
     };
 
-    config.validate().await?;
+    let loaded = config.validate().await?;
 
     config.path = path.to_string();
 
+    set_redact_query_literals(config.general.log_redact_query_literals);
+    set_event_sink(config.general.event_sink.clone());
+    set_audit_log(config.general.audit_log.clone());
+    set_config_files(watched_files);
+
     // Update the configuration globally.
     CONFIG.store(Arc::new(config.clone()));
+    loaded.publish();
+    load_jwt_issuers(&config.jwt_issuers).await;
 
     Ok(())
 }
@@ -1153,13 +3636,28 @@ pub async fn reload_config(client_server_map: ClientServerMap) -> Result<bool, E
         Ok(()) => (),
         Err(err) => {
             error!("Config reload error: {err:?}");
+            emit_event(|| Event::Error {
+                client: None,
+                error: format!("Config reload error: {err}"),
+            });
             return Err(Error::BadConfig(format!("Config reload error: {err:?}")));
         }
     };
 
     let new_config = get_config();
+    let changed = old_config != new_config;
+    // The certificate files may have changed without the config.
+    match tls::reload_tls_acceptor(&new_config.general) {
+        Ok(true) => info!("TLS certificate reloaded"),
+        Ok(false) => (),
+        Err(err) => error!("Can't reload the TLS certificate, keeping the current one: {err}"),
+    }
+    emit_event(|| Event::ConfigReload {
+        path: new_config.path.clone(),
+        changed,
+    });
 
-    if old_config != new_config {
+    if changed {
         info!("Config changed, reloading");
         ConnectionPool::from_config(client_server_map).await?;
         Ok(true)
@@ -1173,6 +3671,8 @@ pub fn addr_in_hba(addr: IpAddr) -> bool {
     if config.general.hba.is_empty() {
         return true;
     }
+    // Clients from a dual-stack listener come as IPv4-mapped IPv6 addresses.
+    let addr = addr.to_canonical();
     config.general.hba.iter().any(|net| net.contains(&addr))
 }
 
@@ -1190,7 +3690,7 @@ mod test {
         parse(file.as_os_str().to_str().unwrap()).await.unwrap();
 
         assert_eq!(get_config().general.idle_timeout, 300000000);
-        assert_eq!(get_config().pools.len(), 4);
+        assert_eq!(get_config().pools.len(), 5);
         assert_eq!(get_config().pools["example_db"].idle_timeout, Some(40000));
         assert_eq!(get_config().pools["example_db"].users.len(), 4);
         assert_eq!(
@@ -1214,6 +3714,56 @@ mod test {
         assert!(addr_in_hba(IpAddr::V4(Ipv4Addr::new(10, 0, 0, 1))));
         assert!(!addr_in_hba(IpAddr::V4(Ipv4Addr::new(1, 1, 1, 1))));
         assert!(addr_in_hba(IpAddr::V4(Ipv4Addr::new(192, 168, 0, 1))));
+        // IPv4-mapped addresses from a dual-stack listener match IPv4 rules.
+        assert!(addr_in_hba("::ffff:10.0.0.1".parse().unwrap()));
+        assert!(!addr_in_hba("::ffff:1.1.1.1".parse().unwrap()));
+    }
+
+    #[test]
+    fn test_wildcard_match() {
+        assert!(wildcard_match("*.toml", "orders.toml"));
+        assert!(wildcard_match("*.toml", ".toml"));
+        assert!(wildcard_match("db_?.toml", "db_1.toml"));
+        assert!(wildcard_match("*_users*.toml", "10_users_billing.toml"));
+        assert!(!wildcard_match("*.toml", "orders.toml.bak"));
+        assert!(!wildcard_match("db_?.toml", "db_10.toml"));
+    }
+
+    #[tokio::test]
+    async fn test_include_files() {
+        let dir = std::env::temp_dir().join(format!("pg_doorman_conf_d_{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        for name in [
+            "20_orders.toml",
+            "10_billing.toml",
+            "README",
+            ".hidden.toml",
+        ] {
+            std::fs::write(dir.join(name), "").unwrap();
+        }
+        let dir_str = dir.to_str().unwrap();
+
+        let expected = vec![
+            dir.join("10_billing.toml").to_string_lossy().to_string(),
+            dir.join("20_orders.toml").to_string_lossy().to_string(),
+        ];
+        assert_eq!(include_files(dir_str).await.unwrap(), expected);
+        assert_eq!(
+            include_files(&format!("{dir_str}/*.toml")).await.unwrap(),
+            expected
+        );
+        assert_eq!(
+            include_files(&format!("{dir_str}/2*")).await.unwrap(),
+            expected[1..].to_vec()
+        );
+        assert_eq!(
+            include_files("/etc/pg_doorman/extra.toml").await.unwrap(),
+            vec!["/etc/pg_doorman/extra.toml".to_string()]
+        );
+        assert!(include_files(&format!("{dir_str}/missing/*.toml"))
+            .await
+            .is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
     }
 
     #[tokio::test]
@@ -1283,6 +3833,824 @@ mod test {
         }
     }
 
+    // Test server_bind_address with unix socket server_host
+    #[tokio::test]
+    async fn test_validate_server_bind_address_with_unix_socket() {
+        let mut config = Config::default();
+
+        let pool = Pool {
+            server_host: "/var/run/postgresql".to_string(),
+            server_bind_address: Some("127.0.0.1".parse().unwrap()),
+            ..Pool::default()
+        };
+        config.pools.insert("test_pool".to_string(), pool);
+
+        // Validate should fail
+        let result = config.validate().await;
+        assert!(result.is_err());
+        if let Err(Error::BadConfig(msg)) = result {
+            assert!(msg.contains("server_bind_address"));
+        } else {
+            panic!("Expected BadConfig error about server_bind_address");
+        }
+    }
+
+    #[test]
+    fn test_allows_client_encoding() {
+        let mut pool = Pool::default();
+        assert!(pool.allows_client_encoding("LATIN1"));
+
+        pool.client_encoding = Some("UTF8".to_string());
+        assert!(pool.allows_client_encoding("UTF8"));
+        assert!(pool.allows_client_encoding("utf-8"));
+        assert!(pool.allows_client_encoding("unicode"));
+        assert!(!pool.allows_client_encoding("LATIN1"));
+        assert!(!pool.allows_client_encoding("SQL_ASCII"));
+    }
+
+    #[tokio::test]
+    async fn test_server_application_name() {
+        let mut pool = Pool::default();
+        assert_eq!(pool.server_application_name("billing", "app", "db"), None);
+
+        pool.application_name_template = Some("{client_application_name}@{user}".to_string());
+        assert_eq!(
+            pool.server_application_name("billing", "app", "db"),
+            Some("billing@app".to_string())
+        );
+        pool.application_name_template = Some("{database}/{unknown}/{user".to_string());
+        assert_eq!(
+            pool.server_application_name("billing", "app", "db"),
+            Some("db/{unknown}/{user".to_string())
+        );
+
+        pool.application_name_passthrough = true;
+        assert!(pool.validate().await.is_err());
+        pool.application_name_template = None;
+        pool.validate().await.unwrap();
+        assert_eq!(
+            pool.server_application_name("billing", "app", "db"),
+            Some("billing".to_string())
+        );
+    }
+
+    #[test]
+    fn test_login_notice() {
+        let mut pool = Pool::default();
+        let mut user = User::default();
+        assert_eq!(pool.login_notice(&user), None);
+
+        pool.login_notice = Some("moving to db-new".to_string());
+        assert_eq!(pool.login_notice(&user), Some("moving to db-new"));
+        user.login_notice = Some("use the reporting replica".to_string());
+        assert_eq!(pool.login_notice(&user), Some("use the reporting replica"));
+    }
+
+    #[test]
+    fn test_audit() {
+        let mut pool = Pool::default();
+        let mut user = User::default();
+        assert!(!pool.audit(&user));
+        pool.audit = true;
+        assert!(pool.audit(&user));
+        user.audit = Some(false);
+        assert!(!pool.audit(&user));
+    }
+
+    #[tokio::test]
+    async fn test_pool_min_pool_size() {
+        let mut pool = Pool::default();
+        let mut user = User {
+            username: "app".to_string(),
+            pool_size: 10,
+            ..User::default()
+        };
+        pool.users.insert("0".to_string(), user.clone());
+        assert_eq!(pool.user(&user).min_pool_size, None);
+
+        pool.min_pool_size = Some(4);
+        assert_eq!(pool.user(&user).min_pool_size, Some(4));
+        user.min_pool_size = Some(2);
+        assert_eq!(pool.user(&user).min_pool_size, Some(2));
+        pool.validate().await.unwrap();
+
+        pool.min_pool_size = Some(20);
+        assert!(pool.validate().await.is_err());
+        pool.users.insert("0".to_string(), user);
+        pool.validate().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_validate_reserve_pool() {
+        let mut config = Config::default();
+        let mut pool = Pool::default();
+        assert_eq!(pool.reserve_pool(&config.general), (0, 3000));
+
+        config.general.reserve_pool_size = 5;
+        pool.reserve_pool_timeout = Some(1000);
+        assert_eq!(pool.reserve_pool(&config.general), (5, 1000));
+        pool.reserve_pool_size = Some(2);
+        assert_eq!(pool.reserve_pool(&config.general), (2, 1000));
+        config.pools.insert("example_db".to_string(), pool.clone());
+        config.validate().await.unwrap();
+
+        // Clients would give up before the reserve pool is used.
+        pool.reserve_pool_timeout = Some(5000);
+        config.pools.insert("example_db".to_string(), pool);
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_pool_partitions() {
+        let mut config = Config::default();
+        let mut pool = Pool::default();
+        pool.partitions.insert(
+            "batch".to_string(),
+            PoolPartition {
+                pool_size: Some(5),
+                min_pool_size: None,
+                pool_mode: Some(PoolMode::Session),
+            },
+        );
+        config.pools.insert("example_db".to_string(), pool);
+        config.validate().await.unwrap();
+
+        assert!(config.pool_config("example_db").is_some());
+        assert!(config.pool_config("example_db/batch").is_some());
+        assert!(config.pool_config("example_db/interactive").is_none());
+        assert!(config.pool_config("other/batch").is_none());
+
+        let user = User {
+            pool_size: 40,
+            min_pool_size: Some(10),
+            ..User::default()
+        };
+        let partition_user = config.pools["example_db"].partitions["batch"].user(&user);
+        assert_eq!(partition_user.pool_size, 5);
+        assert_eq!(partition_user.min_pool_size, None);
+        assert_eq!(partition_user.pool_mode, Some(PoolMode::Session));
+
+        // Partition names end up in pool names.
+        config
+            .pools
+            .get_mut("example_db")
+            .unwrap()
+            .partitions
+            .insert("a/b".to_string(), PoolPartition::default());
+        assert!(config.validate().await.is_err());
+    }
+
+    #[test]
+    fn test_wildcard_pool() {
+        let mut config = Config::default();
+        let mut orders = Pool::default();
+        orders.partitions.insert(
+            "reporting".to_string(),
+            PoolPartition {
+                pool_size: Some(5),
+                min_pool_size: None,
+                pool_mode: None,
+            },
+        );
+        config.pools.insert("orders".to_string(), orders);
+        assert!(config.pool_config("tenant_42").is_none());
+        assert!(config.wildcard_pool("tenant_42").is_none());
+
+        let mut wildcard = Pool::default();
+        wildcard.pool_mode = PoolMode::Session;
+        config.pools.insert(WILDCARD_DATABASE.to_string(), wildcard);
+        assert_eq!(
+            config.pool_config("tenant_42").unwrap().pool_mode,
+            PoolMode::Session
+        );
+        assert!(config.wildcard_pool("tenant_42").is_some());
+        assert!(config.wildcard_pool("orders").is_none());
+        assert!(config.wildcard_pool("orders/reporting").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_tenant_clusters() {
+        let mut wildcard: Pool = toml::from_str(
+            r#"
+            server_port = 6000
+            [tenant_clusters.a]
+            host = "10.0.1.1"
+            [tenant_clusters.b]
+            host = "10.0.2.1:5433"
+            weight = 3
+            [tenant_cluster_overrides]
+            tenant_vip = "a"
+            "#,
+        )
+        .unwrap();
+        wildcard.validate().await.unwrap();
+        assert_eq!(wildcard.tenant_clusters["a"].weight, 1);
+
+        let tenants: Vec<String> = (0..1000).map(|index| format!("tenant_{index}")).collect();
+        let assigned: Vec<&str> = tenants
+            .iter()
+            .map(|tenant| wildcard.tenant_cluster(tenant).unwrap())
+            .collect();
+        // The same on every call, and close to the weights.
+        for (tenant, cluster) in tenants.iter().zip(&assigned) {
+            assert_eq!(wildcard.tenant_cluster(tenant), Some(*cluster));
+        }
+        let on_b = assigned.iter().filter(|cluster| **cluster == "b").count();
+        assert!((650..=850).contains(&on_b), "{on_b}");
+        assert_eq!(wildcard.tenant_cluster("tenant_vip"), Some("a"));
+
+        let pool = wildcard.tenant_pool("tenant_vip").unwrap();
+        assert_eq!(
+            (pool.server_host.as_str(), pool.server_port),
+            ("10.0.1.1", 6000)
+        );
+        let tenant_b =
+            tenants[assigned.iter().position(|cluster| *cluster == "b").unwrap()].clone();
+        let pool = wildcard.tenant_pool(&tenant_b).unwrap();
+        assert_eq!(
+            (pool.server_host.as_str(), pool.server_port),
+            ("10.0.2.1", 5433)
+        );
+
+        // A new cluster only takes databases, the others stay where they are.
+        let mut grown = wildcard.clone();
+        grown.tenant_clusters.insert(
+            "c".to_string(),
+            TenantCluster {
+                host: "10.0.3.1".to_string(),
+                weight: 1,
+            },
+        );
+        for (tenant, cluster) in tenants.iter().zip(&assigned) {
+            let now = grown.tenant_cluster(tenant).unwrap();
+            assert!(now == *cluster || now == "c");
+        }
+
+        // Without clusters the entry's host serves them all.
+        assert_eq!(Pool::default().tenant_cluster("tenant_1"), None);
+        assert_eq!(
+            Pool::default().tenant_pool("tenant_1").unwrap().server_host,
+            "127.0.0.1"
+        );
+
+        wildcard
+            .tenant_cluster_overrides
+            .insert("tenant_lost".to_string(), "z".to_string());
+        assert!(wildcard.validate().await.is_err());
+        wildcard.tenant_cluster_overrides.remove("tenant_lost");
+        wildcard.tenant_clusters.get_mut("a").unwrap().weight = 0;
+        assert!(wildcard.validate().await.is_err());
+        wildcard.tenant_clusters.get_mut("a").unwrap().weight = 1;
+
+        // Only the `*` entry spreads databases.
+        let mut config = Config::default();
+        config.pools.insert("orders".to_string(), wildcard.clone());
+        assert!(config.validate().await.is_err());
+        config.pools.clear();
+        config.pools.insert(WILDCARD_DATABASE.to_string(), wildcard);
+        config.validate().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_server_hosts() {
+        let mut config = Config::default();
+        let mut pool = Pool {
+            server_host: "10.0.0.11".to_string(),
+            server_hosts: vec!["10.0.0.12".to_string(), "10.0.0.13:5433".to_string()],
+            ..Pool::default()
+        };
+        assert_eq!(
+            pool.server_addresses().unwrap(),
+            vec![
+                ("10.0.0.11".to_string(), 5432, 1),
+                ("10.0.0.12".to_string(), 5432, 1),
+                ("10.0.0.13".to_string(), 5433, 1),
+            ]
+        );
+        config.pools.insert("example_db".to_string(), pool.clone());
+        config.validate().await.unwrap();
+
+        // Weights only with the weighted strategy, one per host.
+        pool.server_weights = vec![2, 1, 1];
+        config.pools.insert("example_db".to_string(), pool.clone());
+        assert!(config.validate().await.is_err());
+        pool.load_balancing = LoadBalancing::Weighted;
+        config.pools.insert("example_db".to_string(), pool.clone());
+        config.validate().await.unwrap();
+        assert_eq!(pool.server_addresses().unwrap()[0].2, 2);
+        for weights in [vec![2, 1], vec![2, 0, 1]] {
+            pool.server_weights = weights;
+            config.pools.insert("example_db".to_string(), pool.clone());
+            assert!(config.validate().await.is_err());
+        }
+
+        let pool: Pool = toml::from_str(
+            r#"
+            server_hosts = ["10.0.0.12"]
+            load_balancing = "least_connections"
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.load_balancing, LoadBalancing::LeastConnections);
+        assert_eq!(pool.health_check_interval, 0);
+        assert_eq!(pool.failover_cooldown, 30_000);
+
+        let pool: Pool = toml::from_str(
+            r#"
+            server_hosts = ["10.0.0.12"]
+            load_balancing = "failover"
+            health_check_interval = 5000
+            failover_cooldown = 60000
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.load_balancing, LoadBalancing::Failover);
+        assert_eq!(pool.health_check_interval, 5000);
+        assert_eq!(pool.failover_cooldown, 60_000);
+    }
+
+    #[tokio::test]
+    async fn test_replica_hosts() {
+        let mut config = Config::default();
+        let mut pool = Pool {
+            server_port: 6000,
+            replica_hosts: vec![
+                "10.0.0.2".to_string(),
+                "replica.example.com:5433".to_string(),
+                "[2001:db8::3]:5434".to_string(),
+                "2001:db8::4".to_string(),
+            ],
+            ..Pool::default()
+        };
+        assert_eq!(
+            pool.replica_addresses().unwrap(),
+            vec![
+                ("10.0.0.2".to_string(), 6000),
+                ("replica.example.com".to_string(), 5433),
+                ("2001:db8::3".to_string(), 5434),
+                ("2001:db8::4".to_string(), 6000),
+            ]
+        );
+        config.pools.insert("example_db".to_string(), pool.clone());
+        config.validate().await.unwrap();
+        assert_eq!(replica_pool_name("example_db", 2), "example_db/replica2");
+        assert!(config.pool_config("example_db/replica4").is_some());
+        assert!(config.pool_config("example_db/replica5").is_none());
+
+        // Reads after writes wait for the replicas, there have to be some.
+        pool.read_your_writes = true;
+        assert!(pool.validate().await.is_ok());
+        pool.replica_poll_interval = 0;
+        assert!(pool.validate().await.is_err());
+        pool.replica_poll_interval = 1000;
+        let replicas = std::mem::take(&mut pool.replica_hosts);
+        assert!(pool.validate().await.is_err());
+        pool.replica_hosts = replicas;
+        pool.read_your_writes = false;
+        pool.max_replica_lag = 5000;
+        assert!(pool.polls_replicas());
+        assert!(pool.validate().await.is_ok());
+        pool.replica_hosts.clear();
+        assert!(pool.validate().await.is_err());
+
+        // The partition would share the name of a replica pool.
+        pool.partitions
+            .insert("replica1".to_string(), PoolPartition::default());
+        config.pools.insert("example_db".to_string(), pool.clone());
+        assert!(config.validate().await.is_err());
+
+        for replica in ["", "10.0.0.2:", "10.0.0.2:0", "[::1", "[::1]5432"] {
+            pool.partitions.clear();
+            pool.replica_hosts = vec![replica.to_string()];
+            config.pools.insert("example_db".to_string(), pool.clone());
+            assert!(config.validate().await.is_err(), "{replica:?}");
+        }
+    }
+
+    #[tokio::test]
+    async fn test_mirror_host() {
+        let mut pool: Pool = toml::from_str(
+            r#"
+            server_port = 6000
+            mirror_host = "pg18.example.com"
+            mirror_log_diffs = true
+            "#,
+        )
+        .unwrap();
+        assert!(pool.validate().await.is_ok());
+        assert_eq!(
+            pool.mirror_address().unwrap(),
+            Some(("pg18.example.com".to_string(), 6000))
+        );
+        assert!(pool.mirror_log_diffs);
+        assert_eq!(pool.mirror_pool_size, 10);
+
+        pool.mirror_pool_size = 0;
+        assert!(pool.validate().await.is_err());
+        pool.mirror_pool_size = 10;
+
+        pool.mirror_host = Some("pg18.example.com:".to_string());
+        assert!(pool.validate().await.is_err());
+        assert_eq!(Pool::default().mirror_address().unwrap(), None);
+    }
+
+    #[tokio::test]
+    async fn test_prepared_statements_cache_size_overrides() {
+        let mut config = Config::default();
+        config.general.prepared_statements_cache_size = 8192;
+        let mut pool: Pool = toml::from_str(
+            r#"
+            max_prepared_statements = 100
+
+            [users.0]
+            username = "orm"
+            password = "secret"
+            pool_size = 10
+            max_prepared_statements = 500
+
+            [users.1]
+            username = "app"
+            password = "secret"
+            pool_size = 10
+            "#,
+        )
+        .unwrap();
+        let orm = pool.users["0"].clone();
+        let app = pool.users["1"].clone();
+        assert_eq!(
+            pool.prepared_statements_cache_size(&orm, &config.general),
+            500
+        );
+        assert_eq!(
+            pool.prepared_statements_cache_size(&app, &config.general),
+            100
+        );
+
+        pool.prepared_statements_cache_size = None;
+        assert_eq!(
+            pool.prepared_statements_cache_size(&app, &config.general),
+            8192
+        );
+
+        config.general.prepared_statements = false;
+        assert_eq!(
+            pool.prepared_statements_cache_size(&orm, &config.general),
+            0
+        );
+
+        pool.users
+            .get_mut("0")
+            .unwrap()
+            .prepared_statements_cache_size = Some(0);
+        config.pools.insert("example_db".to_string(), pool);
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_parameter_status_overrides() {
+        use crate::server::ParameterStatusOverrides;
+
+        let mut pool: Pool = toml::from_str(
+            r#"
+            parameter_status_suppress = ["is_superuser"]
+
+            [users.0]
+            username = "app"
+            password = "secret"
+            pool_size = 10
+
+            [parameter_status_overrides]
+            server_version = "16.4"
+            "#,
+        )
+        .unwrap();
+        assert!(pool.validate().await.is_ok());
+
+        let overrides = ParameterStatusOverrides::from_pool(&pool).unwrap();
+        assert!(overrides.applies_to("Server_Version"));
+        assert!(!overrides.applies_to("TimeZone"));
+        assert_eq!(overrides.reported("server_version", "17.2"), Some("16.4"));
+        assert_eq!(overrides.reported("is_superuser", "off"), None);
+        assert_eq!(overrides.reported("TimeZone", "UTC"), Some("UTC"));
+        assert!(ParameterStatusOverrides::from_pool(&Pool::default()).is_none());
+
+        pool.parameter_status_suppress.push(" ".to_string());
+        assert!(pool.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_query_routes() {
+        let mut pool: Pool = toml::from_str(
+            r#"
+            replica_hosts = ["10.0.0.2", "10.0.0.3"]
+
+            [users.0]
+            username = "app"
+            password = "secret"
+            pool_size = 10
+
+            [partitions.batch]
+            pool_size = 2
+
+            [[query_routes]]
+            pattern = "^select .* from analytics_"
+            pool = "replica2"
+
+            [[query_routes]]
+            pattern = "^insert into events "
+            pool = "batch"
+
+            [[query_routes]]
+            pattern = "for update$"
+            pool = "primary"
+            "#,
+        )
+        .unwrap();
+        assert!(pool.validate().await.is_ok());
+
+        pool.query_routes[0].pool = "replica3".to_string();
+        assert!(pool.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_result_cache() {
+        let mut pool: Pool = toml::from_str(
+            r#"
+            result_cache_pattern = "^select .* from dashboard_"
+            result_cache_ttl = 5000
+            "#,
+        )
+        .unwrap();
+        assert!(pool.validate().await.is_ok());
+        assert_eq!(pool.result_cache_size, 64 * 1024 * 1024);
+
+        pool.result_cache_max_result_size = pool.result_cache_size + 1;
+        assert!(pool.validate().await.is_err());
+        pool.result_cache_max_result_size = 1024;
+        pool.result_cache_ttl = 0;
+        assert!(pool.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_auth_query() {
+        let mut pool: Pool = toml::from_str(
+            r#"
+            auth_user = "pgdoorman_auth"
+
+            [users.0]
+            username = "pgdoorman_auth"
+            password = "md5dd9a0f26a4302744db881776a09bbfad"
+            pool_size = 1
+
+            [users.1]
+            username = "app"
+            pool_size = 10
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.users["1"].password, "");
+        assert!(pool.validate().await.is_ok());
+
+        // Users not listed get the settings of the template, without its password.
+        assert!(pool.auth_query_user("reporting").is_none());
+        pool.auth_query_template_user = Some("app".to_string());
+        assert!(pool.validate().await.is_ok());
+        let user = pool.auth_query_user("reporting").unwrap();
+        assert_eq!((user.username.as_str(), user.pool_size), ("reporting", 10));
+        assert!(pool.auth_query_user("app").is_none());
+        pool.auth_query_template_user = Some("unknown".to_string());
+        assert!(pool.validate().await.is_err());
+        pool.auth_query_template_user = Some("app".to_string());
+
+        pool.auth_user = Some("unknown".to_string());
+        assert!(pool.validate().await.is_err());
+
+        pool.auth_user = None;
+        assert!(pool.validate().await.is_err());
+        pool.auth_query_template_user = None;
+        pool.auth_query = Some("SELECT usename, passwd FROM auth.lookup($1)".to_string());
+        assert!(pool.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_ldap_servers() {
+        let mut config = Config::default();
+        let server: LdapServer = toml::from_str(
+            r#"
+            url = "ldaps://ldap.example.com"
+            base_dn = "ou=people,dc=example,dc=com"
+            bind_dn = "cn=pg_doorman,dc=example,dc=com"
+            bind_password = "secret"
+            "#,
+        )
+        .unwrap();
+        config.ldap_servers.insert("corp".to_string(), server);
+        let pool: Pool = toml::from_str(
+            r#"
+            auth_ldap_server = "corp"
+
+            [users.0]
+            username = "alice"
+            pool_size = 10
+            "#,
+        )
+        .unwrap();
+        config.pools.insert("example_db".to_string(), pool);
+        let server = &config.ldap_servers["corp"];
+        assert_eq!(server.search_attribute, "uid");
+        assert_eq!(server.timeout, 5000);
+        assert!(config.validate().await.is_ok());
+
+        let pool = config.pools.get_mut("example_db").unwrap();
+        pool.users.get_mut("0").unwrap().auth_ldap_server = Some("unknown".to_string());
+        assert!(config.validate().await.is_err());
+
+        let pool = config.pools.get_mut("example_db").unwrap();
+        pool.users.get_mut("0").unwrap().auth_ldap_server = None;
+        pool.auth_ldap_server = Some("unknown".to_string());
+        assert!(config.validate().await.is_err());
+
+        let server = LdapServer {
+            url: "ldaps://ldap.example.com".to_string(),
+            starttls: true,
+            ..Default::default()
+        };
+        assert!(server.validate("corp").is_err());
+        let server = LdapServer {
+            url: "ldap.example.com".to_string(),
+            ..Default::default()
+        };
+        assert!(server.validate("corp").is_err());
+        let server = LdapServer {
+            bind_dn: Some("cn=pg_doorman,dc=example,dc=com".to_string()),
+            ..Default::default()
+        };
+        assert!(server.validate("corp").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_auth_cert_map() {
+        let mut config = Config::default();
+        let pool: Pool = toml::from_str(
+            r#"
+            [users.0]
+            username = "example_user_1"
+            auth_cert_map = "clients"
+            pool_size = 10
+            "#,
+        )
+        .unwrap();
+        config.pools.insert("example_db".to_string(), pool);
+        let result = config.validate().await;
+        if let Err(Error::BadConfig(msg)) = result {
+            assert!(msg.contains("auth_cert_map requires tls_mode verify-full"));
+        } else {
+            panic!("Expected BadConfig error about tls_mode");
+        }
+
+        config.general.tls_cert_ident_file = Some("./tests/data/ssl/missing.conf".to_string());
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_statement_allowlist() {
+        let mut config = Config::default();
+        let pool: Pool = toml::from_str(
+            r#"
+            [users.0]
+            username = "example_user_1"
+            statement_allowlist_mode = "record"
+            pool_size = 10
+            "#,
+        )
+        .unwrap();
+        config.pools.insert("example_db".to_string(), pool);
+        if let Err(Error::BadConfig(msg)) = config.validate().await {
+            assert!(msg.contains("requires statement_allowlist"));
+        } else {
+            panic!("Expected BadConfig error about statement_allowlist");
+        }
+
+        // Enforcing a missing allowlist is an error, recording creates it.
+        let user = config
+            .pools
+            .get_mut("example_db")
+            .unwrap()
+            .users
+            .get_mut("0")
+            .unwrap();
+        user.statement_allowlist = Some("./tests/data/missing.allowlist".to_string());
+        user.statement_allowlist_mode = Some(StatementAllowlistMode::Enforce);
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_listeners() {
+        let mut config = Config::default();
+        let general: General = toml::from_str(
+            r#"
+            admin_username = "admin"
+            admin_password = "admin"
+
+            [[listeners]]
+            host = "127.0.0.1"
+            port = 6433
+            admin_only = true
+            "#,
+        )
+        .unwrap();
+        assert_eq!(
+            general.listeners[0].options(),
+            ListenerOptions {
+                admin_only: true,
+                ..Default::default()
+            }
+        );
+        config.general = general;
+        assert!(config.validate().await.is_ok());
+
+        config.general.listeners[0].tls_required = true;
+        if let Err(Error::BadConfig(msg)) = config.validate().await {
+            assert!(msg.contains("requires TLS"));
+        } else {
+            panic!("Expected BadConfig error about tls_certificate");
+        }
+
+        config.general.listeners[0].tls_required = false;
+        config.general.listeners[0].host = config.general.host.clone();
+        config.general.listeners[0].port = config.general.port;
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_peers() {
+        let mut config = Config::default();
+        let general: General = toml::from_str(
+            r#"
+            admin_username = "admin"
+            admin_password = "admin"
+            peer_id = 1
+
+            [[peers]]
+            peer_id = 1
+            host = "10.0.0.5"
+            port = 6432
+
+            [[peers]]
+            peer_id = 2
+            host = "10.0.0.6"
+            port = 6432
+            "#,
+        )
+        .unwrap();
+        assert_eq!(general.peers[1].host, "10.0.0.6");
+        config.general = general;
+        assert!(config.validate().await.is_ok());
+
+        config.general.peers[1].peer_id = 1;
+        assert!(config.validate().await.is_err());
+        config.general.peers[1].peer_id = 2;
+        config.general.peer_id = 0;
+        assert!(config.validate().await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_validate_tls_sni() {
+        let mut config = Config::default();
+        config.pools.insert("tenant1".to_string(), Pool::default());
+        let general: General = toml::from_str(
+            r#"
+            admin_username = "admin"
+            admin_password = "admin"
+            tls_certificate = "tests/data/ssl/server.crt"
+            tls_private_key = "tests/data/ssl/server.key"
+
+            [[tls_sni]]
+            server_name = "tenant1.db.example.com"
+            database = "tenant1"
+            tls_certificate = "tests/data/ssl/server.crt"
+            tls_private_key = "tests/data/ssl/server.key"
+            "#,
+        )
+        .unwrap();
+        assert_eq!(general.tls_sni[0].database.as_deref(), Some("tenant1"));
+        config.general = general;
+        assert!(config.validate().await.is_ok());
+
+        config.general.tls_sni[0].database = Some("tenant2".to_string());
+        assert!(config.validate().await.is_err());
+        config.general.tls_sni[0].database = None;
+        config.general.tls_sni[0].tls_private_key = None;
+        assert!(config.validate().await.is_err());
+        config.general.tls_sni[0].tls_certificate = None;
+        assert!(config.validate().await.is_ok());
+
+        let mut duplicate = config.general.tls_sni[0].clone();
+        duplicate.server_name = "TENANT1.db.example.com".to_string();
+        config.general.tls_sni.push(duplicate);
+        assert!(config.validate().await.is_err());
+    }
+
     // Test tls_rate_limit_per_second < 100 and not 0
     #[tokio::test]
     async fn test_validate_tls_rate_limit_too_small() {
@@ -1452,4 +4820,99 @@ mod test {
             "Validation should pass for 'disable' mode without certificates"
         );
     }
+
+    #[test]
+    fn test_pool_hash_value() {
+        let pool = Pool::default();
+        let mut general = General::default();
+        let hash = pool.hash_value(&general);
+        assert_eq!(hash, pool.hash_value(&general));
+
+        // Timeouts of the general section are applied on RELOAD too.
+        general.query_wait_timeout += 1;
+        assert_ne!(hash, pool.hash_value(&general));
+        general = General::default();
+        general.admin_password = "changed".to_string();
+        assert_eq!(hash, pool.hash_value(&general));
+
+        let mut pool = Pool::default();
+        pool.server_port += 1;
+        assert_ne!(hash, pool.hash_value(&General::default()));
+    }
+
+    #[tokio::test]
+    async fn test_server_tls_mode() {
+        let mut pool: Pool = toml::from_str(
+            r#"
+            server_tls_mode = "verify-ca"
+            "#,
+        )
+        .unwrap();
+        let mut general = General::default();
+        assert_eq!(pool.server_tls_mode(&general), ServerTlsMode::VerifyCa);
+        assert!(pool.validate().await.is_ok());
+
+        pool.server_tls_mode = None;
+        assert_eq!(pool.server_tls_mode(&general), ServerTlsMode::Disable);
+        general.server_tls = true;
+        assert_eq!(pool.server_tls_mode(&general), ServerTlsMode::Prefer);
+        general.verify_server_certificate = true;
+        assert_eq!(pool.server_tls_mode(&general), ServerTlsMode::VerifyFull);
+
+        pool.server_tls_certificate = Some("/etc/pg_doorman/doorman.crt".to_string());
+        assert!(pool.validate().await.is_err());
+        pool.server_tls_mode = Some(ServerTlsMode::Require);
+        pool.server_tls_certificate = None;
+        pool.server_tls_ca_cert = Some("/nonexistent/ca.pem".to_string());
+        assert!(pool.validate().await.is_err());
+    }
+
+    #[test]
+    fn test_server_reset_query() {
+        let pool: Pool = toml::from_str(
+            r#"
+            server_reset_query = "DISCARD ALL"
+            server_reset_in_background = true
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.server_reset_query.as_deref(), Some("DISCARD ALL"));
+        assert!(pool.server_reset_in_background);
+
+        let pool: Pool = toml::from_str("").unwrap();
+        assert_eq!(pool.server_reset_query, None);
+        assert!(!pool.server_reset_in_background);
+    }
+
+    #[test]
+    fn test_server_idle_timeout_alias() {
+        let pool: Pool = toml::from_str(
+            r#"
+            server_idle_timeout = 60000
+            server_lifetime = 3600000
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.idle_timeout, Some(60_000));
+        assert_eq!(pool.server_lifetime, Some(3_600_000));
+    }
+
+    #[test]
+    fn test_session_timeouts() {
+        let pool: Pool = toml::from_str(
+            r#"
+            statement_timeout = 30000
+            idle_in_transaction_session_timeout = 60000
+            "#,
+        )
+        .unwrap();
+        assert_eq!(pool.session_timeouts(&User::default()), (30_000, 60_000));
+
+        let user = User {
+            statement_timeout: Some(0),
+            ..Default::default()
+        };
+        assert_eq!(pool.session_timeouts(&user), (0, 60_000));
+        assert_eq!(Pool::default().session_timeouts(&user), (0, 0));
+    }
 }
@@ -0,0 +1,269 @@
+// Configuration from the environment, for containers that can't template files.
+//
+// String values of the config may reference environment variables as `${VAR}`
+// or `${VAR:-default}`, which keeps secrets out of the file. Any option can
+// also be set with a `PG_DOORMAN__<SECTION>__<KEY>` variable, the double
+// underscore separating the levels: PG_DOORMAN__GENERAL__PORT=6433 or
+// PG_DOORMAN__POOLS__EXAMPLE_DB__USERS__0__PASSWORD=secret. The overrides go
+// over the config files.
+
+// External crate imports
+use toml::value::Table;
+use toml::Value;
+
+// Internal crate imports
+use crate::errors::Error;
+
+/// Prefix of the variables overriding options.
+pub const ENV_OVERRIDE_PREFIX: &str = "PG_DOORMAN__";
+
+/// Replace the `${VAR}` and `${VAR:-default}` references in the string,
+/// `$${` is a literal `${`.
+fn interpolate_str(
+    value: &str,
+    lookup: &impl Fn(&str) -> Option<String>,
+) -> Result<String, String> {
+    let mut result = String::with_capacity(value.len());
+    let mut rest = value;
+    while let Some(start) = rest.find("${") {
+        if rest[..start].ends_with('$') {
+            result.push_str(&rest[..start - 1]);
+            result.push_str("${");
+            rest = &rest[start + 2..];
+            continue;
+        }
+        result.push_str(&rest[..start]);
+        let end = match rest[start..].find('}') {
+            Some(end) => start + end,
+            None => return Err(format!("unterminated ${{ in {value:?}")),
+        };
+        let reference = &rest[start + 2..end];
+        let (name, default) = match reference.split_once(":-") {
+            Some((name, default)) => (name, Some(default)),
+            None => (reference, None),
+        };
+        match (lookup(name), default) {
+            (Some(found), _) => result.push_str(&found),
+            (None, Some(default)) => result.push_str(default),
+            (None, None) => return Err(format!("environment variable {name} is not set")),
+        }
+        rest = &rest[end + 1..];
+    }
+    result.push_str(rest);
+    Ok(result)
+}
+
+fn interpolate_value(
+    path: &str,
+    value: &mut Value,
+    lookup: &impl Fn(&str) -> Option<String>,
+) -> Result<(), Error> {
+    match value {
+        Value::String(string) if string.contains("${") => {
+            *string = interpolate_str(string, lookup)
+                .map_err(|err| Error::BadConfig(format!("{path}: {err}")))?;
+        }
+        Value::Array(array) => {
+            for (index, item) in array.iter_mut().enumerate() {
+                interpolate_value(&format!("{path}[{index}]"), item, lookup)?;
+            }
+        }
+        Value::Table(table) => interpolate_table(path, table, lookup)?,
+        _ => (),
+    }
+    Ok(())
+}
+
+fn interpolate_table(
+    path: &str,
+    table: &mut Table,
+    lookup: &impl Fn(&str) -> Option<String>,
+) -> Result<(), Error> {
+    for (key, value) in table.iter_mut() {
+        let path = if path.is_empty() {
+            key.clone()
+        } else {
+            format!("{path}.{key}")
+        };
+        interpolate_value(&path, value, lookup)?;
+    }
+    Ok(())
+}
+
+/// The variable's value as a TOML value: numbers, booleans and arrays as
+/// such, anything else as a string.
+fn parse_env_value(value: &str) -> Value {
+    match toml::from_str::<Table>(&format!("value = {value}")) {
+        Ok(mut table) => table
+            .remove("value")
+            .unwrap_or(Value::String(value.to_string())),
+        Err(_) => Value::String(value.to_string()),
+    }
+}
+
+/// Set the option named by the variable, keys are matched case-insensitively
+/// with the ones of the config and lowercased when new. An option that is a
+/// string in the config stays one, e.g. a password made of digits.
+fn apply_override(config: &mut Table, variable: &str, value: &str) -> Result<String, Error> {
+    let keys: Vec<&str> = variable[ENV_OVERRIDE_PREFIX.len()..].split("__").collect();
+    if keys.iter().any(|key| key.is_empty()) {
+        return Err(Error::BadConfig(format!(
+            "{variable}: empty option name in the variable"
+        )));
+    }
+    let mut table = config;
+    let mut path = Vec::with_capacity(keys.len());
+    for (index, key) in keys.iter().enumerate() {
+        let key = table
+            .keys()
+            .find(|existing| existing.eq_ignore_ascii_case(key))
+            .cloned()
+            .unwrap_or_else(|| key.to_lowercase());
+        path.push(key.clone());
+        if index == keys.len() - 1 {
+            let value = match table.get(&key) {
+                Some(Value::String(_)) => Value::String(value.to_string()),
+                _ => parse_env_value(value),
+            };
+            table.insert(key, value);
+            break;
+        }
+        table = match table
+            .entry(key)
+            .or_insert_with(|| Value::Table(Table::new()))
+        {
+            Value::Table(next) => next,
+            _ => {
+                return Err(Error::BadConfig(format!(
+                    "{variable}: {} is not a section",
+                    path.join(".")
+                )))
+            }
+        };
+    }
+    Ok(path.join("."))
+}
+
+/// Interpolate the `${VAR}` references and apply the `PG_DOORMAN__` overrides.
+/// Returns the options set by the overrides.
+pub fn apply_env(
+    config: &mut Table,
+    vars: impl IntoIterator<Item = (String, String)>,
+) -> Result<Vec<String>, Error> {
+    let vars: Vec<(String, String)> = vars.into_iter().collect();
+    let lookup = |name: &str| {
+        vars.iter()
+            .find(|(variable, _)| variable == name)
+            .map(|(_, value)| value.clone())
+    };
+    interpolate_table("", config, &lookup)?;
+
+    let mut overrides: Vec<&(String, String)> = vars
+        .iter()
+        .filter(|(variable, _)| variable.starts_with(ENV_OVERRIDE_PREFIX))
+        .collect();
+    // The same order whatever the order of the environment.
+    overrides.sort();
+    let mut options = Vec::with_capacity(overrides.len());
+    for (variable, value) in overrides {
+        options.push(apply_override(config, variable, value)?);
+    }
+    Ok(options)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn env(vars: &[(&str, &str)]) -> Vec<(String, String)> {
+        vars.iter()
+            .map(|(name, value)| (name.to_string(), value.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn test_interpolate_str() {
+        let lookup = |name: &str| (name == "DB_PASSWORD").then(|| "s3cret".to_string());
+        assert_eq!(
+            interpolate_str("${DB_PASSWORD}", &lookup).unwrap(),
+            "s3cret"
+        );
+        assert_eq!(
+            interpolate_str("md5${DB_PASSWORD}!", &lookup).unwrap(),
+            "md5s3cret!"
+        );
+        assert_eq!(
+            interpolate_str("${DB_HOST:-127.0.0.1}", &lookup).unwrap(),
+            "127.0.0.1"
+        );
+        assert_eq!(interpolate_str("$${HOME}", &lookup).unwrap(), "${HOME}");
+        assert_eq!(
+            interpolate_str("SCRAM-SHA-256$4096:salt$key", &lookup).unwrap(),
+            "SCRAM-SHA-256$4096:salt$key"
+        );
+        assert!(interpolate_str("${DB_HOST}", &lookup).is_err());
+        assert!(interpolate_str("${DB_PASSWORD", &lookup).is_err());
+    }
+
+    #[test]
+    fn test_apply_env() {
+        let mut config: Table = toml::from_str(
+            r#"
+[general]
+host = "127.0.0.1"
+port = 6432
+
+[pools.Example_DB.users.0]
+username = "app"
+password = "${APP_PASSWORD}"
+"#,
+        )
+        .unwrap();
+        let options = apply_env(
+            &mut config,
+            env(&[
+                ("APP_PASSWORD", "s3cret"),
+                ("PG_DOORMAN__GENERAL__PORT", "6433"),
+                ("PG_DOORMAN__GENERAL__ADMIN_PASSWORD", "admin pass"),
+                ("PG_DOORMAN__GENERAL__HOST", "0"),
+                ("PG_DOORMAN__POOLS__EXAMPLE_DB__POOL_MODE", "session"),
+                ("PG_DOORMAN__POOLS__EXAMPLE_DB__USERS__0__POOL_SIZE", "40"),
+            ]),
+        )
+        .unwrap();
+
+        assert_eq!(
+            options,
+            vec![
+                "general.admin_password",
+                "general.host",
+                "general.port",
+                "pools.Example_DB.pool_mode",
+                "pools.Example_DB.users.0.pool_size",
+            ]
+        );
+        assert_eq!(config["general"]["port"].as_integer(), Some(6433));
+        assert_eq!(config["general"]["host"].as_str(), Some("0"));
+        assert_eq!(
+            config["general"]["admin_password"].as_str(),
+            Some("admin pass")
+        );
+        let user = &config["pools"]["Example_DB"]["users"]["0"];
+        assert_eq!(user["password"].as_str(), Some("s3cret"));
+        assert_eq!(user["pool_size"].as_integer(), Some(40));
+        assert_eq!(
+            config["pools"]["Example_DB"]["pool_mode"].as_str(),
+            Some("session")
+        );
+    }
+
+    #[test]
+    fn test_apply_env_errors() {
+        let mut config: Table = toml::from_str("[general]\nport = 6432\n").unwrap();
+        assert!(apply_env(&mut config, env(&[("PG_DOORMAN__GENERAL__PORT__X", "1")])).is_err());
+        assert!(apply_env(&mut config, env(&[("PG_DOORMAN__GENERAL____PORT", "1")])).is_err());
+
+        let mut config: Table = toml::from_str("[general]\nhost = \"${MISSING}\"\n").unwrap();
+        assert!(apply_env(&mut config, Vec::new()).is_err());
+    }
+}
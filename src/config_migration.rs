@@ -0,0 +1,274 @@
+// Detection and migration of deprecated configuration options.
+//
+// Unknown options are silently ignored by the config parser, so an option that
+// was renamed or removed between versions would otherwise just stop working.
+
+// Standard library imports
+use std::fmt;
+
+// External crate imports
+use toml::value::Table;
+use toml::Value;
+
+/// Version of the configuration schema understood by this build.
+/// A config file may declare the version it was written for with a top-level `version = N`.
+pub const CONFIG_SCHEMA_VERSION: i64 = 1;
+
+/// An option that has been renamed or removed.
+struct DeprecatedOption {
+    /// Path of the old option, `*` matches every pool.
+    from: &'static str,
+    /// Path of the new option, `*` is the same pool as in `from`.
+    /// None if the option can't be migrated automatically.
+    to: Option<&'static str>,
+    /// What to do instead, for options that can't be migrated.
+    hint: &'static str,
+}
+
+const DEPRECATED_OPTIONS: &[DeprecatedOption] = &[
+    DeprecatedOption {
+        from: "general.tls_ca_file",
+        to: Some("general.tls_ca_cert"),
+        hint: "",
+    },
+    DeprecatedOption {
+        from: "general.enable_prometheus_exporter",
+        to: Some("prometheus.enabled"),
+        hint: "",
+    },
+    DeprecatedOption {
+        from: "general.prometheus_exporter_port",
+        to: Some("prometheus.port"),
+        hint: "",
+    },
+    DeprecatedOption {
+        from: "general.healthcheck_timeout",
+        to: None,
+        hint: "server connections are checked with pooler_check_query, the hosts with health_check_interval of the pool",
+    },
+    DeprecatedOption {
+        from: "general.healthcheck_delay",
+        to: None,
+        hint: "server connections are checked with pooler_check_query, the hosts with health_check_interval of the pool",
+    },
+    DeprecatedOption {
+        from: "general.ban_time",
+        to: None,
+        hint: "a host failing a connect or a health check is left out for failover_cooldown of the pool",
+    },
+    DeprecatedOption {
+        from: "general.autoreload",
+        to: None,
+        hint: "set config_check_interval to reload the config when its files change",
+    },
+    DeprecatedOption {
+        from: "pools.*.shards",
+        to: None,
+        hint: "use server_host and server_hosts of a pool per shard, or tenant_clusters of the \"*\" entry",
+    },
+    DeprecatedOption {
+        from: "pools.*.query_parser_enabled",
+        to: None,
+        hint: "transactions are routed by their first statement to replica_hosts and with query_routes of the pool, without a setting to enable it",
+    },
+    DeprecatedOption {
+        from: "pools.*.primary_reads_enabled",
+        to: None,
+        hint: "reads go to the replicas of replica_hosts of the pool, the primary is server_host; use a doorman: primary comment to keep a read on it",
+    },
+    DeprecatedOption {
+        from: "pools.*.sharding_function",
+        to: None,
+        hint: "sharding by key is not supported; send transactions to partitions with a doorman: shard=<name> comment, or spread databases with tenant_clusters",
+    },
+];
+
+/// A problem found in the configuration while migrating it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ConfigWarning {
+    /// Path of the option, e.g. `general.tls_ca_file`.
+    pub option: String,
+    pub message: String,
+}
+
+impl fmt::Display for ConfigWarning {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.option, self.message)
+    }
+}
+
+/// Rewrite deprecated options of the parsed config in place.
+/// Returns a warning for every deprecated option found.
+pub fn migrate_config(config: &mut Table) -> Vec<ConfigWarning> {
+    let mut warnings = Vec::new();
+
+    if let Some(version) = config.get("version").and_then(Value::as_integer) {
+        if version > CONFIG_SCHEMA_VERSION {
+            warnings.push(ConfigWarning {
+                option: "version".to_string(),
+                message: format!(
+                    "config is written for schema version {version}, this build supports {CONFIG_SCHEMA_VERSION}; unknown options are ignored"
+                ),
+            });
+        }
+    }
+
+    for option in DEPRECATED_OPTIONS {
+        for (from, to) in expand_paths(config, option) {
+            let value = match take(config, &from) {
+                Some(value) => value,
+                None => continue,
+            };
+            let message = match to {
+                Some(to) if contains(config, &to) => format!(
+                    "deprecated, replaced by {0}; ignored because {0} is also set",
+                    to.join(".")
+                ),
+                Some(to) => {
+                    let message = format!(
+                        "deprecated, replaced by {}; migrated automatically",
+                        to.join(".")
+                    );
+                    insert(config, &to, value);
+                    message
+                }
+                None => format!("no longer supported and ignored: {}", option.hint),
+            };
+            warnings.push(ConfigWarning {
+                option: from.join("."),
+                message,
+            });
+        }
+    }
+
+    warnings
+}
+
+type KeyPath = Vec<String>;
+
+/// Concrete (from, to) paths of the option, with `*` replaced by every pool name.
+fn expand_paths(config: &Table, option: &DeprecatedOption) -> Vec<(KeyPath, Option<KeyPath>)> {
+    let split = |path: &str, pool: &str| -> KeyPath {
+        path.split('.')
+            .map(|part| if part == "*" { pool } else { part }.to_string())
+            .collect()
+    };
+
+    if !option.from.contains('*') {
+        return vec![(split(option.from, ""), option.to.map(|to| split(to, "")))];
+    }
+
+    let pools = match config.get("pools").and_then(Value::as_table) {
+        Some(pools) => pools,
+        None => return Vec::new(),
+    };
+    pools
+        .keys()
+        .map(|pool| {
+            (
+                split(option.from, pool),
+                option.to.map(|to| split(to, pool)),
+            )
+        })
+        .collect()
+}
+
+fn parent_mut<'a>(config: &'a mut Table, path: &[String], create: bool) -> Option<&'a mut Table> {
+    let mut table = config;
+    for key in &path[..path.len() - 1] {
+        if create && !table.contains_key(key) {
+            table.insert(key.clone(), Value::Table(Table::new()));
+        }
+        table = table.get_mut(key)?.as_table_mut()?;
+    }
+    Some(table)
+}
+
+fn contains(config: &Table, path: &[String]) -> bool {
+    let mut table = config;
+    for key in &path[..path.len() - 1] {
+        match table.get(key).and_then(Value::as_table) {
+            Some(next) => table = next,
+            None => return false,
+        }
+    }
+    table.contains_key(&path[path.len() - 1])
+}
+
+fn take(config: &mut Table, path: &[String]) -> Option<Value> {
+    parent_mut(config, path, false)?.remove(&path[path.len() - 1])
+}
+
+fn insert(config: &mut Table, path: &[String], value: Value) {
+    if let Some(table) = parent_mut(config, path, true) {
+        table.insert(path[path.len() - 1].clone(), value);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(config: &str) -> Table {
+        toml::from_str(config).unwrap()
+    }
+
+    #[test]
+    fn test_migrate_renamed_options() {
+        let mut config = parse(
+            r#"
+[general]
+tls_ca_file = "/etc/ssl/ca.pem"
+enable_prometheus_exporter = true
+"#,
+        );
+        let warnings = migrate_config(&mut config);
+
+        assert_eq!(warnings.len(), 2);
+        assert_eq!(warnings[0].option, "general.tls_ca_file");
+        assert!(warnings[0].message.contains("general.tls_ca_cert"));
+        assert_eq!(
+            config["general"]["tls_ca_cert"].as_str(),
+            Some("/etc/ssl/ca.pem")
+        );
+        assert!(config["general"].get("tls_ca_file").is_none());
+        assert_eq!(config["prometheus"]["enabled"].as_bool(), Some(true));
+    }
+
+    #[test]
+    fn test_migrate_keeps_new_option() {
+        let mut config = parse(
+            r#"
+[general]
+tls_ca_file = "/old.pem"
+tls_ca_cert = "/new.pem"
+"#,
+        );
+        let warnings = migrate_config(&mut config);
+
+        assert_eq!(warnings.len(), 1);
+        assert!(warnings[0].message.contains("ignored"));
+        assert_eq!(config["general"]["tls_ca_cert"].as_str(), Some("/new.pem"));
+    }
+
+    #[test]
+    fn test_migrate_removed_pool_options() {
+        let mut config = parse(
+            r#"
+version = 2
+
+[pools.example_db]
+server_host = "127.0.0.1"
+primary_reads_enabled = true
+"#,
+        );
+        let warnings = migrate_config(&mut config);
+
+        assert_eq!(warnings.len(), 2);
+        assert_eq!(warnings[0].option, "version");
+        assert_eq!(warnings[1].option, "pools.example_db.primary_reads_enabled");
+        assert!(config["pools"]["example_db"]
+            .get("primary_reads_enabled")
+            .is_none());
+    }
+}
@@ -0,0 +1,116 @@
+// Reload of the config when its files change.
+//
+// With config_check_interval set, the config file, its include files and the
+// directories of the include entries are checked for changes and the config is
+// reloaded as on SIGHUP when they do: credentials rotated by a pipeline writing
+// a drop-in file apply without access to the pooler process. A config that
+// doesn't validate is rejected as on SIGHUP and checked again on its next change.
+
+// Standard library imports
+use std::time::SystemTime;
+
+// External crate imports
+use log::info;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::time::{Duration, Instant};
+
+// Internal crate imports
+use crate::config::{get_config, reload_config};
+use crate::pool::ClientServerMap;
+
+/// Files the config in use was built from.
+static CONFIG_FILES: Lazy<Mutex<Vec<String>>> = Lazy::new(|| Mutex::new(Vec::new()));
+
+pub fn set_config_files(files: Vec<String>) {
+    *CONFIG_FILES.lock() = files;
+}
+
+/// Modification time and size of each file, None for a missing one.
+type FilesVersion = Vec<(String, Option<(SystemTime, u64)>)>;
+
+fn files_version(files: &[String]) -> FilesVersion {
+    files
+        .iter()
+        .map(|file| {
+            let version = std::fs::metadata(file)
+                .ok()
+                .and_then(|metadata| Some((metadata.modified().ok()?, metadata.len())));
+            (file.clone(), version)
+        })
+        .collect()
+}
+
+/// Whether the files changed, false if the config is now built from other files.
+fn files_changed(previous: &FilesVersion, current: &FilesVersion) -> bool {
+    previous.len() == current.len()
+        && previous
+            .iter()
+            .zip(current)
+            .all(|(previous, current)| previous.0 == current.0)
+        && previous != current
+}
+
+/// Check the config files every config_check_interval and reload the config
+/// once they change.
+pub async fn watch_config_files(client_server_map: ClientServerMap) {
+    let mut interval = tokio::time::interval(Duration::from_millis(1000));
+    let mut next_check = Instant::now();
+    let mut previous: Option<FilesVersion> = None;
+    loop {
+        interval.tick().await;
+        let check_interval = get_config().general.config_check_interval;
+        if check_interval == 0 {
+            previous = None;
+            continue;
+        }
+        if Instant::now() < next_check {
+            continue;
+        }
+        next_check = Instant::now() + Duration::from_millis(check_interval);
+
+        let files = CONFIG_FILES.lock().clone();
+        let current = files_version(&files);
+        let changed = previous
+            .as_ref()
+            .is_some_and(|previous| files_changed(previous, &current));
+        previous = Some(current);
+        if changed {
+            info!("Config files changed, reloading config");
+            // Errors are logged by the reload, the current config stays.
+            if let Ok(true) = reload_config(client_server_map.clone()).await {
+                get_config().show();
+            }
+            // The reload may add or remove include files.
+            previous = Some(files_version(&CONFIG_FILES.lock().clone()));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_files_changed() {
+        let dir = std::env::temp_dir().join(format!("pg_doorman_watch_{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let users = dir.join("users.toml").to_string_lossy().to_string();
+        std::fs::write(&users, "[pools.orders.users.0]\n").unwrap();
+        let files = vec![dir.to_string_lossy().to_string(), users.clone()];
+
+        let first = files_version(&files);
+        assert!(!files_changed(&first, &files_version(&files)));
+
+        std::fs::write(&users, "[pools.orders.users.0]\npassword = \"rotated\"\n").unwrap();
+        assert!(files_changed(&first, &files_version(&files)));
+
+        // Other files, after a reload adding an include file.
+        let more = vec![files[0].clone(), users.clone(), users.clone()];
+        assert!(!files_changed(&first, &files_version(&more)));
+
+        std::fs::remove_file(&users).unwrap();
+        assert!(files_changed(&first, &files_version(&files)));
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
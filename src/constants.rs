@@ -6,13 +6,19 @@ pub const SASL: i32 = 10;
 pub const SASL_CONTINUE: i32 = 11;
 pub const SASL_FINAL: i32 = 12;
 pub const SCRAM_SHA_256: &str = "SCRAM-SHA-256";
+pub const SCRAM_SHA_256_PLUS: &str = "SCRAM-SHA-256-PLUS";
+pub const TLS_SERVER_END_POINT: &str = "tls-server-end-point";
 pub const MD5_PASSWORD_PREFIX: &str = "md5";
 pub const JWT_PUB_KEY_PASSWORD_PREFIX: &str = "jwt-pkey-fpath:";
 pub const JWT_PRIV_KEY_PASSWORD_PREFIX: &str = "jwt-priv-key-fpath:";
+pub const JWT_ISSUERS_PASSWORD_PREFIX: &str = "jwt-issuers:";
 pub const NONCE_LENGTH: usize = 24;
 
 pub const TALOS_USERNAME: &str = "talos";
 
+// Startup parameter selecting a partition of the database pool.
+pub const POOL_HINT_PARAMETER: &str = "pool_hint";
+
 // ErrorResponse: A code identifying the field type; if zero, this is the message terminator and no string follows.
 pub const MESSAGE_TERMINATOR: u8 = 0;
 
@@ -0,0 +1,79 @@
+// Limit on the client connections of a database.
+//
+// max_connections caps the clients of the whole pooler, so a single database
+// with a runaway application can take all of them. max_db_client_connections
+// caps the clients of one database entry, its partitions included, whatever
+// its pool size: the extra clients get "too many connections for database".
+
+// Standard library imports
+use std::collections::HashMap;
+
+// External crate imports
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+/// Clients connected right now, by database.
+static DB_CLIENT_CONNECTIONS: Lazy<Mutex<HashMap<String, u32>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// A client connection of a database, released on drop.
+#[derive(Debug)]
+pub struct DbClientPermit {
+    database: String,
+}
+
+impl Drop for DbClientPermit {
+    fn drop(&mut self) {
+        let mut connections = DB_CLIENT_CONNECTIONS.lock();
+        if let Some(count) = connections.get_mut(&self.database) {
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                connections.remove(&self.database);
+            }
+        }
+    }
+}
+
+/// Take a client connection of the database if fewer than `max` (0 means unlimited) are open.
+pub fn try_acquire_db_client_permit(database: &str, max: u32) -> Option<DbClientPermit> {
+    let mut connections = DB_CLIENT_CONNECTIONS.lock();
+    let count = connections.entry(database.to_string()).or_insert(0);
+    if max != 0 && *count >= max {
+        return None;
+    }
+    *count += 1;
+    Some(DbClientPermit {
+        database: database.to_string(),
+    })
+}
+
+/// Client connections of the database open right now.
+pub fn db_client_connections(database: &str) -> u32 {
+    DB_CLIENT_CONNECTIONS
+        .lock()
+        .get(database)
+        .copied()
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_db_client_permits() {
+        let first = try_acquire_db_client_permit("db_client_limit_test", 2).unwrap();
+        let second = try_acquire_db_client_permit("db_client_limit_test", 2).unwrap();
+        assert!(try_acquire_db_client_permit("db_client_limit_test", 2).is_none());
+        assert_eq!(db_client_connections("db_client_limit_test"), 2);
+
+        // Unlimited, still counted.
+        let third = try_acquire_db_client_permit("db_client_limit_test", 0).unwrap();
+        assert_eq!(db_client_connections("db_client_limit_test"), 3);
+
+        drop(first);
+        drop(second);
+        drop(third);
+        assert_eq!(db_client_connections("db_client_limit_test"), 0);
+    }
+}
@@ -0,0 +1,170 @@
+// Cache of the addresses of the server host names.
+//
+// New server connections resolve their host through the cache: the addresses of
+// a name are reused for dns_max_ttl and resolved again after that, so when a
+// database moves behind the same name (e.g. the failover of a managed database)
+// the connections opened after the TTL go to the new address. While the name
+// can't be resolved the last addresses are kept. SHOW DNS lists the cache.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::{info, warn};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::net::lookup_host;
+
+// Internal crate imports
+use crate::config::get_config;
+use crate::errors::Error;
+
+/// Last resolution of a host name.
+#[derive(Debug, Clone, PartialEq)]
+pub struct DnsEntry {
+    pub addrs: Vec<IpAddr>,
+    /// When the addresses were resolved or, after a failure, kept.
+    pub resolved_at: Instant,
+    /// Resolutions since start, the failed ones included.
+    pub lookups: u64,
+    /// Error of the last resolution, if it failed.
+    pub last_error: Option<String>,
+}
+
+static DNS_CACHE: Lazy<Mutex<HashMap<String, DnsEntry>>> = Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// The cached host names with their last resolution, by name.
+pub fn dns_entries() -> Vec<(String, DnsEntry)> {
+    let mut entries: Vec<(String, DnsEntry)> = DNS_CACHE
+        .lock()
+        .iter()
+        .map(|(host, entry)| (host.clone(), entry.clone()))
+        .collect();
+    entries.sort_by(|a, b| a.0.cmp(&b.0));
+    entries
+}
+
+fn with_port(addrs: &[IpAddr], port: u16) -> Vec<SocketAddr> {
+    addrs.iter().map(|ip| SocketAddr::new(*ip, port)).collect()
+}
+
+/// Addresses of the server host, from the cache while they are younger than dns_max_ttl.
+pub async fn resolve_host(host: &str, port: u16) -> Result<Vec<SocketAddr>, Error> {
+    let ttl = Duration::from_millis(get_config().general.dns_max_ttl);
+    resolve_with_ttl(host, port, ttl).await
+}
+
+async fn resolve_with_ttl(host: &str, port: u16, ttl: Duration) -> Result<Vec<SocketAddr>, Error> {
+    if let Ok(ip) = host.parse::<IpAddr>() {
+        return Ok(vec![SocketAddr::new(ip, port)]);
+    }
+    if let Some(entry) = DNS_CACHE.lock().get(host) {
+        if entry.resolved_at.elapsed() < ttl {
+            return Ok(with_port(&entry.addrs, port));
+        }
+    }
+
+    let resolved = match lookup_host((host, port)).await {
+        Ok(addrs) => {
+            let addrs: Vec<IpAddr> = addrs.map(|addr| addr.ip()).collect();
+            if addrs.is_empty() {
+                Err("no addresses".to_string())
+            } else {
+                Ok(addrs)
+            }
+        }
+        Err(err) => Err(err.to_string()),
+    };
+
+    let mut cache = DNS_CACHE.lock();
+    let lookups = cache.get(host).map_or(0, |entry| entry.lookups) + 1;
+    match resolved {
+        Ok(addrs) => {
+            if let Some(entry) = cache.get(host) {
+                if entry.addrs != addrs {
+                    info!(
+                        "Server host {host} resolves to {addrs:?} now, was {:?}",
+                        entry.addrs
+                    );
+                }
+            }
+            let socket_addrs = with_port(&addrs, port);
+            let entry = DnsEntry {
+                addrs,
+                resolved_at: Instant::now(),
+                lookups,
+                last_error: None,
+            };
+            cache.insert(host.to_string(), entry);
+            Ok(socket_addrs)
+        }
+        Err(err) => match cache.get_mut(host) {
+            // Keep the last addresses for another TTL rather than failing every connect.
+            Some(entry) => {
+                warn!(
+                    "Can't resolve server host {host}, keeping {:?}: {err}",
+                    entry.addrs
+                );
+                entry.resolved_at = Instant::now();
+                entry.lookups = lookups;
+                entry.last_error = Some(err);
+                Ok(with_port(&entry.addrs, port))
+            }
+            None => Err(Error::DNSCachedError(format!("{host}: {err}"))),
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_resolve_with_ttl() {
+        let addrs = resolve_with_ttl("10.0.0.11", 5432, Duration::from_secs(60))
+            .await
+            .unwrap();
+        assert_eq!(addrs, vec!["10.0.0.11:5432".parse().unwrap()]);
+        assert!(!DNS_CACHE.lock().contains_key("10.0.0.11"));
+
+        let addrs = resolve_with_ttl("localhost", 5432, Duration::from_secs(60))
+            .await
+            .unwrap();
+        assert!(addrs.iter().all(|addr| addr.ip().is_loopback()));
+        // Within the TTL the cache answers.
+        let addrs = resolve_with_ttl("localhost", 6432, Duration::from_secs(60))
+            .await
+            .unwrap();
+        assert!(addrs.iter().all(|addr| addr.port() == 6432));
+        assert_eq!(DNS_CACHE.lock()["localhost"].lookups, 1);
+
+        // Unresolvable names keep their last addresses.
+        assert!(
+            resolve_with_ttl("dns-cache-test.invalid", 5432, Duration::ZERO)
+                .await
+                .is_err()
+        );
+        DNS_CACHE.lock().insert(
+            "dns-cache-test.invalid".to_string(),
+            DnsEntry {
+                addrs: vec!["10.0.0.12".parse().unwrap()],
+                resolved_at: Instant::now(),
+                lookups: 1,
+                last_error: None,
+            },
+        );
+        let addrs = resolve_with_ttl("dns-cache-test.invalid", 5432, Duration::ZERO)
+            .await
+            .unwrap();
+        assert_eq!(addrs, vec!["10.0.0.12:5432".parse().unwrap()]);
+        let entry = dns_entries()
+            .into_iter()
+            .find(|(host, _)| host == "dns-cache-test.invalid")
+            .unwrap()
+            .1;
+        assert_eq!(entry.lookups, 2);
+        assert!(entry.last_error.is_some());
+    }
+}
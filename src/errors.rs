@@ -37,6 +37,30 @@ pub enum Error {
     JWTValidate(String),
     ProxyTimeout,
     ConvertError(String),
+    InjectedError(String),
+    ProtocolViolation(String),
+    ServerResetTimeout(String),
+    StatementNotAllowed(String),
+    RoleChangeNotAllowed,
+    ClientEncodingNotAllowed(String),
+    SyncResponseTimeout,
+    BatchTimeout,
+    BatchMessageTimeout,
+    TransactionDurationLimit,
+}
+
+impl Error {
+    /// The client was refused by authentication, not by a network or protocol problem.
+    pub fn is_auth_failure(&self) -> bool {
+        matches!(
+            self,
+            Error::AuthError(_)
+                | Error::HbaForbiddenError(_)
+                | Error::ScramClientError(_)
+                | Error::ScramServerError(_)
+                | Error::JWTValidate(_)
+        )
+    }
 }
 
 #[derive(Clone, PartialEq, Debug)]
@@ -145,7 +169,33 @@ impl std::fmt::Display for Error {
             Error::JWTPrivKey(msg) => write!(f, "JWT private key error: {msg}"),
             Error::JWTValidate(msg) => write!(f, "JWT validation error: {msg}"),
             Error::ProxyTimeout => write!(f, "Proxy operation timed out"),
+            Error::SyncResponseTimeout => {
+                write!(f, "No server response to Sync within sync_response_timeout")
+            }
+            Error::BatchTimeout => write!(f, "Extended protocol batch exceeded batch_timeout"),
+            Error::BatchMessageTimeout => write!(
+                f,
+                "Client sent no message of the unfinished batch within batch_message_timeout"
+            ),
+            Error::TransactionDurationLimit => {
+                write!(f, "Transaction exceeded transaction_duration_limit")
+            }
             Error::ConvertError(msg) => write!(f, "Data conversion error: {msg}"),
+            Error::InjectedError(code) => write!(f, "Injected error {code}"),
+            Error::ProtocolViolation(msg) => write!(f, "Protocol violation: {msg}"),
+            Error::ServerResetTimeout(msg) => write!(f, "Server reset timed out: {msg}"),
+            Error::StatementNotAllowed(fingerprint) => {
+                write!(
+                    f,
+                    "Statement {fingerprint} is not in the statement allowlist"
+                )
+            }
+            Error::RoleChangeNotAllowed => {
+                write!(f, "Role changes are not allowed in transaction mode")
+            }
+            Error::ClientEncodingNotAllowed(encoding) => {
+                write!(f, "client_encoding {encoding} is not allowed for the pool")
+            }
         }
     }
 }
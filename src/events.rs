@@ -0,0 +1,277 @@
+// Structured event stream for external consumers (billing, auditing).
+//
+// With `event_sink` set, significant events (client connect/disconnect, server
+// checkout/release, errors, config reloads) are written as JSON lines to a file
+// or a Unix socket, so consumers don't have to poll the SHOW commands. Events
+// are queued and written by a background task: while the sink is unavailable
+// they wait in the queue, and when the queue is full new events are dropped
+// and counted, the pooler never waits for the consumer.
+
+// Standard library imports
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::time::Duration;
+
+// External crate imports
+use chrono::{SecondsFormat, Utc};
+use log::{error, info};
+use once_cell::sync::{Lazy, OnceCell};
+use parking_lot::Mutex;
+use serde_derive::Serialize;
+use tokio::fs::OpenOptions;
+use tokio::io::{AsyncWrite, AsyncWriteExt};
+use tokio::net::UnixStream;
+use tokio::sync::mpsc;
+
+// Internal crate imports
+use crate::errors::Error;
+
+/// Events waiting to be written to the sink.
+const EVENT_QUEUE_SIZE: usize = 10_000;
+
+/// Pause before opening the sink again after a failure.
+const RETRY_DELAY: Duration = Duration::from_secs(1);
+
+/// Number of events dropped because the queue was full.
+pub static EVENTS_DROPPED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Number of events written to the sink.
+pub static EVENTS_WRITTEN_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+static EVENT_SINK_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// `event_sink` of the current config.
+static EVENT_SINK: Lazy<Mutex<Option<String>>> = Lazy::new(|| Mutex::new(None));
+
+static EVENT_SENDER: OnceCell<mpsc::Sender<String>> = OnceCell::new();
+
+/// An event, serialized with its name in the `event` field.
+#[derive(Serialize, Debug, Clone, PartialEq)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum Event {
+    ClientConnect {
+        client: String,
+        pool: String,
+        user: String,
+        application_name: String,
+        tls: bool,
+        admin: bool,
+    },
+    ClientDisconnect {
+        client: String,
+        pool: String,
+        user: String,
+        duration_ms: u64,
+    },
+    /// A server connection was assigned to the client.
+    Checkout {
+        client: String,
+        pool: String,
+        user: String,
+        server: String,
+        server_pid: i32,
+        wait_us: u64,
+    },
+    /// The server connection went back to the pool.
+    Release {
+        client: String,
+        pool: String,
+        user: String,
+        server_pid: i32,
+        xact_us: u64,
+    },
+    Error {
+        #[serde(skip_serializing_if = "Option::is_none")]
+        client: Option<String>,
+        error: String,
+    },
+    ConfigReload {
+        path: String,
+        changed: bool,
+    },
+}
+
+#[derive(Serialize)]
+struct EventRecord<'a> {
+    time: String,
+    #[serde(flatten)]
+    event: &'a Event,
+}
+
+/// JSON line of the event.
+fn event_line(event: &Event) -> String {
+    let record = EventRecord {
+        time: Utc::now().to_rfc3339_opts(SecondsFormat::Micros, true),
+        event,
+    };
+    match serde_json::to_string(&record) {
+        Ok(mut line) => {
+            line.push('\n');
+            line
+        }
+        Err(err) => format!("{{\"event\":\"error\",\"error\":\"{err}\"}}\n"),
+    }
+}
+
+/// Set the sink of the events, `file:<path>` or `unix:<path>`, None disables the stream.
+pub fn set_event_sink(sink: Option<String>) {
+    EVENT_SINK_ENABLED.store(sink.is_some(), Ordering::Relaxed);
+    *EVENT_SINK.lock() = sink;
+}
+
+/// Check the `event_sink` setting.
+pub fn validate_event_sink(sink: &str) -> Result<(), Error> {
+    validate_sink("event_sink", sink)
+}
+
+/// Check a sink setting, `file:<path>` or `unix:<path>`.
+pub(crate) fn validate_sink(setting: &str, sink: &str) -> Result<(), Error> {
+    match sink.split_once(':') {
+        Some(("file", path)) | Some(("unix", path)) if !path.is_empty() => Ok(()),
+        Some(("kafka", _)) => Err(Error::BadConfig(format!(
+            "{setting} {sink}: Kafka is not supported, forward the file or the Unix socket stream"
+        ))),
+        _ => Err(Error::BadConfig(format!(
+            "{setting} {sink} must be file:<path> or unix:<path>"
+        ))),
+    }
+}
+
+/// Queue the event built by `event` if the event stream is enabled.
+pub fn emit_event(event: impl FnOnce() -> Event) {
+    if !EVENT_SINK_ENABLED.load(Ordering::Relaxed) {
+        return;
+    }
+    let sender = match EVENT_SENDER.get() {
+        Some(sender) => sender,
+        None => return,
+    };
+    if sender.try_send(event_line(&event())).is_err() {
+        EVENTS_DROPPED_COUNTER.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+async fn open_sink(sink: &str) -> std::io::Result<Box<dyn AsyncWrite + Unpin + Send>> {
+    match sink.split_once(':') {
+        Some(("file", path)) => {
+            let file = OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(path)
+                .await?;
+            Ok(Box::new(file))
+        }
+        Some(("unix", path)) => Ok(Box::new(UnixStream::connect(path).await?)),
+        _ => Err(std::io::Error::other(format!("invalid sink {sink}"))),
+    }
+}
+
+/// Write the queued events to the sink, runs for the lifetime of the process.
+pub async fn run_event_sink() {
+    let (sender, receiver) = mpsc::channel::<String>(EVENT_QUEUE_SIZE);
+    if EVENT_SENDER.set(sender).is_err() {
+        return;
+    }
+    write_lines("event sink", &EVENT_SINK, receiver, &EVENTS_WRITTEN_COUNTER).await;
+}
+
+/// Write the received lines to the current sink, `file:<path>` or `unix:<path>`,
+/// retrying each line until it is written or the sink is disabled.
+pub(crate) async fn write_lines(
+    name: &str,
+    current_sink: &Mutex<Option<String>>,
+    mut receiver: mpsc::Receiver<String>,
+    written_counter: &AtomicUsize,
+) {
+    let mut opened: Option<(String, Box<dyn AsyncWrite + Unpin + Send>)> = None;
+    let mut failing = false;
+    while let Some(line) = receiver.recv().await {
+        loop {
+            let sink = current_sink.lock().clone();
+            let sink = match sink {
+                Some(sink) => sink,
+                None => {
+                    opened = None;
+                    break;
+                }
+            };
+            if opened.as_ref().is_none_or(|(current, _)| *current != sink) {
+                opened = match open_sink(&sink).await {
+                    Ok(writer) => {
+                        if failing {
+                            info!("The {name} {sink} is available again");
+                            failing = false;
+                        }
+                        Some((sink.clone(), writer))
+                    }
+                    Err(err) => {
+                        if !failing {
+                            error!("Failed to open {name} {sink}: {err}, retrying");
+                            failing = true;
+                        }
+                        tokio::time::sleep(RETRY_DELAY).await;
+                        continue;
+                    }
+                };
+            }
+            let writer = &mut opened.as_mut().unwrap().1;
+            let written = match writer.write_all(line.as_bytes()).await {
+                Ok(()) if receiver.is_empty() => writer.flush().await,
+                result => result,
+            };
+            match written {
+                Ok(()) => {
+                    written_counter.fetch_add(1, Ordering::Relaxed);
+                    break;
+                }
+                Err(err) => {
+                    if !failing {
+                        error!("Failed to write to {name} {sink}: {err}, retrying");
+                        failing = true;
+                    }
+                    opened = None;
+                    tokio::time::sleep(RETRY_DELAY).await;
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_event_line() {
+        let line = event_line(&Event::ClientConnect {
+            client: "127.0.0.1:51234".to_string(),
+            pool: "example_db".to_string(),
+            user: "example_user_1".to_string(),
+            application_name: "psql".to_string(),
+            tls: true,
+            admin: false,
+        });
+        assert!(line.ends_with('\n'));
+        let record: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(record["event"], "client_connect");
+        assert_eq!(record["pool"], "example_db");
+        assert_eq!(record["tls"], true);
+        assert!(record["time"].as_str().unwrap().ends_with('Z'));
+
+        let line = event_line(&Event::Error {
+            client: None,
+            error: "Config reload error".to_string(),
+        });
+        let record: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(record["event"], "error");
+        assert!(record.get("client").is_none());
+    }
+
+    #[test]
+    fn test_validate_event_sink() {
+        assert!(validate_event_sink("file:/var/log/pg_doorman/events.jsonl").is_ok());
+        assert!(validate_event_sink("unix:/run/billing.sock").is_ok());
+        assert!(validate_event_sink("file:").is_err());
+        assert!(validate_event_sink("kafka:broker:9092").is_err());
+        assert!(validate_event_sink("/var/log/events.jsonl").is_err());
+    }
+}
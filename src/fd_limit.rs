@@ -0,0 +1,118 @@
+// Handling of file descriptor exhaustion (EMFILE/ENFILE).
+//
+// When the process or the system runs out of file descriptors, accept() fails
+// right away and keeps failing while the listener stays readable, so the accept
+// loop would spin and flood the log. The acceptor backs off instead, leaving the
+// descriptors that get freed to the existing connections, and the failures are
+// counted for monitoring.
+
+// Standard library imports
+use std::io;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::error;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+/// First and maximum pause of the acceptor after a failed accept().
+const MIN_ACCEPT_BACKOFF: Duration = Duration::from_millis(10);
+const MAX_ACCEPT_BACKOFF: Duration = Duration::from_secs(1);
+
+/// Log at most one message per operation in this period.
+const LOG_PERIOD: Duration = Duration::from_secs(10);
+
+/// Number of accept() calls that failed because no file descriptor was available.
+pub static ACCEPT_FD_EXHAUSTED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Number of server connections that failed because no file descriptor was available.
+pub static CONNECT_FD_EXHAUSTED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// When the last message was logged and how many failures were not logged since.
+static LAST_LOGGED: Lazy<Mutex<Option<(Instant, usize)>>> = Lazy::new(|| Mutex::new(None));
+
+/// True if the error means the process (EMFILE) or the system (ENFILE) is out of file descriptors.
+pub fn is_fd_exhausted(err: &io::Error) -> bool {
+    matches!(err.raw_os_error(), Some(libc::EMFILE) | Some(libc::ENFILE))
+}
+
+/// Count a failure of `operation` ("accept" or "connect") caused by file descriptor exhaustion.
+pub fn record_fd_exhaustion(operation: &str, err: &io::Error) {
+    match operation {
+        "accept" => ACCEPT_FD_EXHAUSTED_COUNTER.fetch_add(1, Ordering::Relaxed),
+        _ => CONNECT_FD_EXHAUSTED_COUNTER.fetch_add(1, Ordering::Relaxed),
+    };
+
+    let now = Instant::now();
+    let mut last_logged = LAST_LOGGED.lock();
+    match *last_logged {
+        Some((at, ref mut suppressed)) if now.duration_since(at) < LOG_PERIOD => {
+            *suppressed += 1;
+        }
+        Some((_, suppressed)) => {
+            error!(
+                "Out of file descriptors, {operation} failed: {err} ({suppressed} more failures since the last message), raise the open files limit (ulimit -n)"
+            );
+            *last_logged = Some((now, 0));
+        }
+        None => {
+            error!(
+                "Out of file descriptors, {operation} failed: {err}, raise the open files limit (ulimit -n)"
+            );
+            *last_logged = Some((now, 0));
+        }
+    }
+}
+
+/// Exponential pause of the acceptor while accept() keeps failing.
+#[derive(Debug, Default)]
+pub struct AcceptBackoff {
+    delay: Option<Duration>,
+}
+
+impl AcceptBackoff {
+    /// Pause before the next accept().
+    pub fn next_delay(&mut self) -> Duration {
+        let delay = match self.delay {
+            Some(delay) => (delay * 2).min(MAX_ACCEPT_BACKOFF),
+            None => MIN_ACCEPT_BACKOFF,
+        };
+        self.delay = Some(delay);
+        delay
+    }
+
+    /// accept() succeeded.
+    pub fn reset(&mut self) {
+        self.delay = None;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_is_fd_exhausted() {
+        assert!(is_fd_exhausted(&io::Error::from_raw_os_error(libc::EMFILE)));
+        assert!(is_fd_exhausted(&io::Error::from_raw_os_error(libc::ENFILE)));
+        assert!(!is_fd_exhausted(&io::Error::from_raw_os_error(
+            libc::ECONNREFUSED
+        )));
+        assert!(!is_fd_exhausted(&io::Error::other("EMFILE")));
+    }
+
+    #[test]
+    fn test_accept_backoff() {
+        let mut backoff = AcceptBackoff::default();
+        assert_eq!(backoff.next_delay(), Duration::from_millis(10));
+        assert_eq!(backoff.next_delay(), Duration::from_millis(20));
+        for _ in 0..10 {
+            backoff.next_delay();
+        }
+        assert_eq!(backoff.next_delay(), MAX_ACCEPT_BACKOFF);
+
+        backoff.reset();
+        assert_eq!(backoff.next_delay(), Duration::from_millis(10));
+    }
+}
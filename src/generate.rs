@@ -1,5 +1,5 @@
 use crate::cmd_args::GenerateConfig;
-use crate::config::{Config, PoolMode};
+use crate::config::{Config, LoadBalancing, PoolMode};
 use std::collections::BTreeMap;
 use std::error::Error;
 
@@ -98,6 +98,18 @@ pub fn generate_config_with_client(
                 server_username: None,
                 server_password: None,
                 auth_pam_service: None,
+                auth_ldap_server: None,
+                auth_cert_map: None,
+                prepared_statements_cache_size: None,
+                statement_allowlist: None,
+                statement_allowlist_mode: None,
+                passthrough: None,
+                transaction_duration_warning: None,
+                transaction_duration_limit: None,
+                statement_timeout: None,
+                idle_in_transaction_session_timeout: None,
+                login_notice: None,
+                audit: None,
             };
             users.insert(usename, user);
         }
@@ -123,16 +135,87 @@ pub fn generate_config_with_client(
                 crate::config::Pool {
                     pool_mode,
                     connect_timeout: None,
+                    query_wait_timeout: None,
+                    reserve_pool_size: None,
+                    reserve_pool_timeout: None,
+                    server_reset_timeout: None,
+                    server_reset_query: None,
+                    server_reset_in_background: false,
                     idle_timeout: None,
                     server_lifetime: None,
+                    min_pool_size: None,
+                    transaction_duration_warning: None,
+                    transaction_duration_limit: None,
+                    statement_timeout: None,
+                    idle_in_transaction_session_timeout: None,
                     cleanup_server_connections: false,
+                    reject_role_changes: false,
                     log_client_parameter_status_changes: false,
                     application_name: None,
-                    server_host: config.server_host.as_deref().unwrap_or(config.host.as_deref().unwrap_or("localhost")).to_string(),
+                    application_name_template: None,
+                    application_name_passthrough: false,
+                    login_notice: None,
+                    server_host: config
+                        .server_host
+                        .as_deref()
+                        .unwrap_or(config.host.as_deref().unwrap_or("localhost"))
+                        .to_string(),
                     server_port: config.port,
+                    server_hosts: Vec::new(),
+                    load_balancing: LoadBalancing::default(),
+                    server_weights: Vec::new(),
+                    health_check_interval: 0,
+                    failover_cooldown: crate::config::Pool::default_failover_cooldown(),
+                    replica_hosts: Vec::new(),
+                    read_your_writes: false,
+                    max_replica_lag: 0,
+                    replica_poll_interval: crate::config::Pool::default_replica_poll_interval(),
+                    mirror_host: None,
+                    mirror_log_diffs: false,
+                    mirror_pool_size: crate::config::Pool::default_mirror_pool_size(),
                     server_database: Some(datname.to_string()),
                     prepared_statements_cache_size: None,
+                    server_bind_address: None,
+                    server_tls_server_name: None,
+                    server_tls_mode: None,
+                    server_tls_ca_cert: None,
+                    server_tls_certificate: None,
+                    server_tls_private_key: None,
+                    server_tcp_keepalives_idle: None,
+                    server_tcp_keepalives_count: None,
+                    server_tcp_keepalives_interval: None,
+                    client_encoding: None,
+                    normalize_client_encoding: false,
+                    track_prepared_transactions: false,
+                    track_session_parameters: false,
+                    audit: false,
+                    startup_parameters: Vec::new(),
+                    max_replication_connections: 0,
+                    max_db_client_connections: 0,
+                    prepared_transaction_age_warning:
+                        crate::config::Pool::default_prepared_transaction_age_warning(),
+                    load_check_query: None,
+                    load_check_interval: crate::config::Pool::default_load_check_interval(),
+                    load_threshold: 0,
+                    overload_pool_size_percent:
+                        crate::config::Pool::default_overload_pool_size_percent(),
                     users: users.clone(),
+                    parameter_status_suppress: Vec::new(),
+                    result_cache_pattern: None,
+                    result_cache_ttl: crate::config::Pool::default_result_cache_ttl(),
+                    result_cache_size: crate::config::Pool::default_result_cache_size(),
+                    result_cache_max_result_size:
+                        crate::config::Pool::default_result_cache_max_result_size(),
+                    auth_query: None,
+                    auth_user: None,
+                    auth_query_template_user: None,
+                    auth_ldap_server: None,
+                    auth_cert_map: None,
+                    partitions: BTreeMap::new(),
+                    tenant_clusters: BTreeMap::new(),
+                    tenant_cluster_overrides: BTreeMap::new(),
+                    parameter_status_overrides: BTreeMap::new(),
+                    query_routes: Vec::new(),
                 },
             );
         }
@@ -179,6 +262,18 @@ mod tests {
                         server_username: None,
                         server_password: None,
                         auth_pam_service: None,
+                        auth_ldap_server: None,
+                        auth_cert_map: None,
+                        prepared_statements_cache_size: None,
+                        statement_allowlist: None,
+                        statement_allowlist_mode: None,
+                        passthrough: None,
+                        transaction_duration_warning: None,
+                        transaction_duration_limit: None,
+                        statement_timeout: None,
+                        idle_in_transaction_session_timeout: None,
+                        login_notice: None,
+                        audit: None,
                     };
                     users_map.insert(username, user);
                 }
@@ -203,16 +298,88 @@ mod tests {
                         crate::config::Pool {
                             pool_mode,
                             connect_timeout: None,
+                            query_wait_timeout: None,
+                            reserve_pool_size: None,
+                            reserve_pool_timeout: None,
+                            server_reset_timeout: None,
+                            server_reset_query: None,
+                            server_reset_in_background: false,
                             idle_timeout: None,
                             server_lifetime: None,
+                            min_pool_size: None,
+                            transaction_duration_warning: None,
+                            transaction_duration_limit: None,
+                            statement_timeout: None,
+                            idle_in_transaction_session_timeout: None,
                             cleanup_server_connections: false,
+                            reject_role_changes: false,
                             log_client_parameter_status_changes: false,
                             application_name: None,
-                            server_host: config.server_host.as_deref().unwrap_or(config.host.as_deref().unwrap_or("localhost")).to_string(),
+                            application_name_template: None,
+                            application_name_passthrough: false,
+                            login_notice: None,
+                            server_host: config
+                                .server_host
+                                .as_deref()
+                                .unwrap_or(config.host.as_deref().unwrap_or("localhost"))
+                                .to_string(),
                             server_port: config.port,
+                            server_hosts: Vec::new(),
+                            load_balancing: LoadBalancing::default(),
+                            server_weights: Vec::new(),
+                            health_check_interval: 0,
+                            failover_cooldown: crate::config::Pool::default_failover_cooldown(),
+                            replica_hosts: Vec::new(),
+                            read_your_writes: false,
+                            max_replica_lag: 0,
+                            replica_poll_interval:
+                                crate::config::Pool::default_replica_poll_interval(),
+                            mirror_host: None,
+                            mirror_log_diffs: false,
+                            mirror_pool_size: crate::config::Pool::default_mirror_pool_size(),
                             server_database: Some(db_name.to_string()),
                             prepared_statements_cache_size: None,
+                            server_bind_address: None,
+                            server_tls_server_name: None,
+                            server_tls_mode: None,
+                            server_tls_ca_cert: None,
+                            server_tls_certificate: None,
+                            server_tls_private_key: None,
+                            server_tcp_keepalives_idle: None,
+                            server_tcp_keepalives_count: None,
+                            server_tcp_keepalives_interval: None,
+                            client_encoding: None,
+                            normalize_client_encoding: false,
+                            track_prepared_transactions: false,
+                            track_session_parameters: false,
+                            audit: false,
+                            startup_parameters: Vec::new(),
+                            max_replication_connections: 0,
+                            max_db_client_connections: 0,
+                            prepared_transaction_age_warning:
+                                crate::config::Pool::default_prepared_transaction_age_warning(),
+                            load_check_query: None,
+                            load_check_interval: crate::config::Pool::default_load_check_interval(),
+                            load_threshold: 0,
+                            overload_pool_size_percent:
+                                crate::config::Pool::default_overload_pool_size_percent(),
                             users: users_map.clone(),
+                            parameter_status_suppress: Vec::new(),
+                            result_cache_pattern: None,
+                            result_cache_ttl: crate::config::Pool::default_result_cache_ttl(),
+                            result_cache_size: crate::config::Pool::default_result_cache_size(),
+                            result_cache_max_result_size:
+                                crate::config::Pool::default_result_cache_max_result_size(),
+                            auth_query: None,
+                            auth_user: None,
+                            auth_query_template_user: None,
+                            auth_ldap_server: None,
+                            auth_cert_map: None,
+                            partitions: BTreeMap::new(),
+                            tenant_clusters: BTreeMap::new(),
+                            tenant_cluster_overrides: BTreeMap::new(),
+                            parameter_status_overrides: BTreeMap::new(),
+                            query_routes: Vec::new(),
                         },
                     );
                 }
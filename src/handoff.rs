@@ -0,0 +1,88 @@
+// Handoff of the listening socket on binary upgrade.
+//
+// The old process lets the new one inherit its listening socket: the fd number
+// is passed in PG_DOORMAN_LISTEN_FD. Both processes share one socket and one
+// accept queue, so the connections queued while the processes switch are
+// accepted by the new one instead of being reset with the old socket.
+
+// Standard library imports
+use std::io;
+use std::net::{SocketAddr, TcpListener};
+use std::os::fd::{FromRawFd, RawFd};
+
+// External crate imports
+use log::{info, warn};
+
+/// Environment variable with the fd of the listening socket of the previous process.
+pub const LISTEN_FD_ENV: &str = "PG_DOORMAN_LISTEN_FD";
+
+/// Let a child process inherit the socket: sockets are opened with close-on-exec.
+pub fn share_listener(fd: RawFd) -> io::Result<()> {
+    let flags = unsafe { libc::fcntl(fd, libc::F_GETFD) };
+    if flags < 0 || unsafe { libc::fcntl(fd, libc::F_SETFD, flags & !libc::FD_CLOEXEC) } < 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+/// The listening socket left by the previous process, if it listens on `addr`.
+/// The variable is removed, so it isn't passed on to other children.
+pub fn inherited_listener(addr: SocketAddr) -> Option<TcpListener> {
+    let value = std::env::var(LISTEN_FD_ENV).ok()?;
+    std::env::remove_var(LISTEN_FD_ENV);
+    let fd: RawFd = match value.parse() {
+        Ok(fd) if fd > 2 => fd,
+        _ => {
+            warn!("Ignoring {LISTEN_FD_ENV}={value}: not a socket fd");
+            return None;
+        }
+    };
+    let mut stat: libc::stat = unsafe { std::mem::zeroed() };
+    if unsafe { libc::fstat(fd, &mut stat) } < 0 || stat.st_mode & libc::S_IFMT != libc::S_IFSOCK {
+        warn!("Ignoring {LISTEN_FD_ENV}={value}: not a socket fd");
+        return None;
+    }
+    // The fd is ours from now on, it's closed with the listener.
+    let listener = unsafe { TcpListener::from_raw_fd(fd) };
+    match listener.local_addr() {
+        Ok(local_addr) if local_addr == addr => (),
+        Ok(local_addr) => {
+            info!("Inherited listener is on {local_addr}, binding {addr} instead");
+            return None;
+        }
+        Err(err) => {
+            warn!("Ignoring inherited listener: {err}");
+            return None;
+        }
+    }
+    if let Err(err) = listener.set_nonblocking(true) {
+        warn!("Ignoring inherited listener: {err}");
+        return None;
+    }
+    info!("Took over the listening socket {addr} of the previous process");
+    Some(listener)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::fd::IntoRawFd;
+
+    #[test]
+    fn test_inherited_listener() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let fd = listener.into_raw_fd();
+        share_listener(fd).unwrap();
+
+        std::env::set_var(LISTEN_FD_ENV, fd.to_string());
+        let inherited = inherited_listener(addr).unwrap();
+        assert_eq!(inherited.local_addr().unwrap(), addr);
+        assert!(std::env::var(LISTEN_FD_ENV).is_err());
+        // Only once.
+        assert!(inherited_listener(addr).is_none());
+
+        std::env::set_var(LISTEN_FD_ENV, "not a number");
+        assert!(inherited_listener(addr).is_none());
+    }
+}
@@ -0,0 +1,408 @@
+// Client access rules in the format of pg_hba.conf.
+//
+// With `hba_file` set, every client connection is checked against the rules
+// before authentication, the first rule matching the connection type, database,
+// user and client address decides:
+//
+//   # TYPE     DATABASE   USER         ADDRESS          METHOD
+//   hostssl    all        all          10.0.0.0/8       scram-sha-256
+//   host       reports    analyst      192.168.1.0/24   md5
+//   host       all        all          0.0.0.0/0        reject
+//
+// `reject` refuses the connection, `trust` lets the client in without a password
+// and any other method requires the user to be configured with that method.
+// A connection no rule matches is refused, as in PostgreSQL. `local` rules are
+// ignored since clients always connect over TCP.
+
+// Standard library imports
+use std::fmt;
+use std::net::IpAddr;
+
+// External crate imports
+use ipnet::IpNet;
+use once_cell::sync::Lazy;
+use parking_lot::RwLock;
+
+// Internal crate imports
+use crate::auth::cert::tokens;
+use crate::errors::Error;
+
+/// Connection type of a rule.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ConnectionType {
+    Local,
+    Host,
+    HostSsl,
+    HostNoSsl,
+}
+
+/// Authentication method of a rule.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HbaMethod {
+    Trust,
+    Reject,
+    /// Any method asking the client for a password.
+    Password,
+    /// MD5 or SCRAM-SHA-256 password, as in PostgreSQL.
+    Md5,
+    ScramSha256,
+    Cert,
+    Ldap,
+    Pam,
+    Jwt,
+}
+
+impl HbaMethod {
+    fn parse(method: &str) -> Option<HbaMethod> {
+        match method {
+            "trust" => Some(HbaMethod::Trust),
+            "reject" => Some(HbaMethod::Reject),
+            "password" => Some(HbaMethod::Password),
+            "md5" => Some(HbaMethod::Md5),
+            "scram-sha-256" => Some(HbaMethod::ScramSha256),
+            "cert" => Some(HbaMethod::Cert),
+            "ldap" => Some(HbaMethod::Ldap),
+            "pam" => Some(HbaMethod::Pam),
+            "jwt" => Some(HbaMethod::Jwt),
+            _ => None,
+        }
+    }
+
+    /// True if a client authenticated by the `configured` method of the user satisfies the rule.
+    pub fn allows(&self, configured: HbaMethod) -> bool {
+        match self {
+            HbaMethod::Trust => true,
+            HbaMethod::Reject => false,
+            HbaMethod::Password => !matches!(configured, HbaMethod::Cert | HbaMethod::Trust),
+            HbaMethod::Md5 => matches!(configured, HbaMethod::Md5 | HbaMethod::ScramSha256),
+            method => *method == configured,
+        }
+    }
+}
+
+impl fmt::Display for HbaMethod {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name = match self {
+            HbaMethod::Trust => "trust",
+            HbaMethod::Reject => "reject",
+            HbaMethod::Password => "password",
+            HbaMethod::Md5 => "md5",
+            HbaMethod::ScramSha256 => "scram-sha-256",
+            HbaMethod::Cert => "cert",
+            HbaMethod::Ldap => "ldap",
+            HbaMethod::Pam => "pam",
+            HbaMethod::Jwt => "jwt",
+        };
+        write!(f, "{name}")
+    }
+}
+
+/// Databases or users of a rule.
+#[derive(Debug)]
+enum Names {
+    All,
+    /// `sameuser` in the database column.
+    SameUser,
+    List(Vec<String>),
+}
+
+#[derive(Debug)]
+struct HbaRule {
+    line: usize,
+    connection_type: ConnectionType,
+    databases: Names,
+    users: Names,
+    /// None matches all addresses.
+    address: Option<IpNet>,
+    method: HbaMethod,
+}
+
+impl HbaRule {
+    fn matches(&self, addr: IpAddr, tls: bool, database: &str, user: &str) -> bool {
+        let type_matches = match self.connection_type {
+            ConnectionType::Local => false,
+            ConnectionType::Host => true,
+            ConnectionType::HostSsl => tls,
+            ConnectionType::HostNoSsl => !tls,
+        };
+        let database_matches = match self.databases {
+            Names::All => true,
+            Names::SameUser => database == user,
+            Names::List(ref names) => names.iter().any(|name| name == database),
+        };
+        let user_matches = match self.users {
+            Names::All | Names::SameUser => true,
+            Names::List(ref names) => names.iter().any(|name| name == user),
+        };
+        let address_matches = self
+            .address
+            .is_none_or(|net| net.contains(&addr.to_canonical()));
+        type_matches && database_matches && user_matches && address_matches
+    }
+}
+
+/// Rules of the hba_file, empty if it is not set.
+static HBA_RULES: Lazy<RwLock<Option<Vec<HbaRule>>>> = Lazy::new(|| RwLock::new(None));
+
+fn parse_names(value: &str, database: bool) -> Result<Names, String> {
+    let mut names = Vec::new();
+    for name in value.split(',') {
+        match name {
+            "all" => return Ok(Names::All),
+            "sameuser" if database => return Ok(Names::SameUser),
+            "" => return Err("empty name".to_string()),
+            name if name.starts_with('@') || name.starts_with('+') => {
+                return Err(format!(
+                    "{name}: groups and included files are not supported"
+                ))
+            }
+            name => names.push(name.to_string()),
+        }
+    }
+    Ok(Names::List(names))
+}
+
+fn parse_address(address: &str, mask: Option<&str>) -> Result<Option<IpNet>, String> {
+    if address == "all" {
+        return Ok(None);
+    }
+    if let Ok(net) = address.parse::<IpNet>() {
+        return Ok(Some(net));
+    }
+    let ip: IpAddr = match address.parse() {
+        Ok(ip) => ip,
+        Err(_) => {
+            return Err(format!(
+                "{address}: only IP addresses and CIDR ranges are supported"
+            ))
+        }
+    };
+    let net = match mask {
+        Some(mask) => mask
+            .parse::<IpAddr>()
+            .ok()
+            .and_then(|mask| IpNet::with_netmask(ip, mask).ok()),
+        None => None,
+    };
+    match net {
+        Some(net) => Ok(Some(net)),
+        None => Err(format!(
+            "{address}: a CIDR range or an IP address with a mask is expected"
+        )),
+    }
+}
+
+fn parse_rule(line: usize, tokens: &[String]) -> Result<HbaRule, String> {
+    let connection_type = match tokens[0].as_str() {
+        "local" => ConnectionType::Local,
+        "host" => ConnectionType::Host,
+        "hostssl" => ConnectionType::HostSsl,
+        "hostnossl" => ConnectionType::HostNoSsl,
+        other => return Err(format!("unknown connection type {other}")),
+    };
+    let fields = if connection_type == ConnectionType::Local {
+        4
+    } else {
+        5
+    };
+    if tokens.len() < fields {
+        return Err("expected type, database, user, address and method".to_string());
+    }
+    let databases = parse_names(&tokens[1], true)?;
+    let users = parse_names(&tokens[2], false)?;
+    let (address, method_index) = if connection_type == ConnectionType::Local {
+        (None, 3)
+    } else if tokens[3].contains('/') || tokens[3] == "all" {
+        (parse_address(&tokens[3], None)?, 4)
+    } else {
+        (
+            parse_address(&tokens[3], tokens.get(4).map(|mask| mask.as_str()))?,
+            5,
+        )
+    };
+    let method = match tokens.get(method_index) {
+        Some(method) => match HbaMethod::parse(method) {
+            Some(method) => method,
+            None => return Err(format!("unsupported authentication method {method}")),
+        },
+        None => return Err("missing authentication method".to_string()),
+    };
+    // Options of the method (ldapserver=... and so on) are configured in the pooler itself.
+    if let Some(option) = tokens[method_index + 1..]
+        .iter()
+        .find(|option| !option.contains('='))
+    {
+        return Err(format!(
+            "unexpected {option} after the authentication method"
+        ));
+    }
+    Ok(HbaRule {
+        line,
+        connection_type,
+        databases,
+        users,
+        address,
+        method,
+    })
+}
+
+fn parse_hba(contents: &str, path: &str) -> Result<Vec<HbaRule>, Error> {
+    let mut rules = Vec::new();
+    for (number, line) in contents.lines().enumerate() {
+        let tokens = tokens(line);
+        if tokens.is_empty() {
+            continue;
+        }
+        match parse_rule(number + 1, &tokens) {
+            Ok(rule) => rules.push(rule),
+            Err(err) => {
+                return Err(Error::BadConfig(format!("{path}:{}: {err}", number + 1)));
+            }
+        }
+    }
+    Ok(rules)
+}
+
+/// Rules of hba_file loaded with load_hba_file, enforced once set with set_hba_rules.
+pub struct HbaRules(Option<Vec<HbaRule>>);
+
+/// Load the rules of hba_file, None disables the rules.
+pub fn load_hba_file(path: Option<&str>) -> Result<HbaRules, Error> {
+    let rules = match path {
+        Some(path) => match std::fs::read_to_string(path) {
+            Ok(contents) => Some(parse_hba(&contents, path)?),
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Failed to read hba_file {path}: {err}"
+                )))
+            }
+        },
+        None => None,
+    };
+    Ok(HbaRules(rules))
+}
+
+/// Enforce the loaded rules, replacing the current ones.
+pub fn set_hba_rules(rules: HbaRules) {
+    *HBA_RULES.write() = rules.0;
+}
+
+fn check_rules(
+    rules: &[HbaRule],
+    addr: IpAddr,
+    tls: bool,
+    database: &str,
+    user: &str,
+) -> Result<HbaMethod, String> {
+    let tls_state = if tls { "on" } else { "off" };
+    match rules
+        .iter()
+        .find(|rule| rule.matches(addr, tls, database, user))
+    {
+        Some(rule) if rule.method == HbaMethod::Reject => Err(format!(
+            "hba_file line {} rejects host \"{addr}\", user \"{user}\", database \"{database}\", SSL {tls_state}",
+            rule.line
+        )),
+        Some(rule) => Ok(rule.method),
+        None => Err(format!(
+            "no hba_file entry for host \"{addr}\", user \"{user}\", database \"{database}\", SSL {tls_state}"
+        )),
+    }
+}
+
+/// Authentication method the hba_file requires for the connection, None without hba_file.
+/// Returns the reason if the connection is rejected.
+pub fn check_hba(
+    addr: IpAddr,
+    tls: bool,
+    database: &str,
+    user: &str,
+) -> Result<Option<HbaMethod>, String> {
+    match *HBA_RULES.read() {
+        Some(ref rules) => check_rules(rules, addr, tls, database, user).map(Some),
+        None => Ok(None),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HBA: &str = r#"
+        # TYPE     DATABASE         USER            ADDRESS                  METHOD
+        local      all              all                                      trust
+        hostssl    all              all             10.0.0.0/8               scram-sha-256
+        host       reports,archive  analyst         192.168.1.0 255.255.255.0 md5
+        host       sameuser         all             ::1/128                  trust
+        hostnossl  all              "batch user"    172.16.0.0/12            password
+        host       all              all             all                      reject
+    "#;
+
+    fn check(addr: &str, tls: bool, database: &str, user: &str) -> Result<HbaMethod, String> {
+        let rules = parse_hba(HBA, "pg_hba.conf").unwrap();
+        check_rules(&rules, addr.parse().unwrap(), tls, database, user)
+    }
+
+    #[test]
+    fn test_hba_rules() {
+        assert_eq!(
+            check("10.1.2.3", true, "app", "app"),
+            Ok(HbaMethod::ScramSha256)
+        );
+        assert!(check("10.1.2.3", false, "app", "app").is_err());
+        assert_eq!(
+            check("192.168.1.20", false, "archive", "analyst"),
+            Ok(HbaMethod::Md5)
+        );
+        assert!(check("192.168.1.20", false, "app", "analyst").is_err());
+        assert!(check("192.168.2.20", false, "reports", "analyst").is_err());
+        assert_eq!(check("::1", false, "alice", "alice"), Ok(HbaMethod::Trust));
+        assert!(check("::1", false, "app", "alice").is_err());
+        assert_eq!(
+            check("172.16.5.5", false, "app", "batch user"),
+            Ok(HbaMethod::Password)
+        );
+        assert!(check("172.16.5.5", true, "app", "batch user").is_err());
+        // IPv4 clients of a dual-stack listener.
+        assert_eq!(
+            check("::ffff:10.0.0.1", true, "app", "app"),
+            Ok(HbaMethod::ScramSha256)
+        );
+
+        let err = check("8.8.8.8", true, "app", "app").unwrap_err();
+        assert!(err.contains("line 8 rejects host \"8.8.8.8\""), "{err}");
+        let rules = parse_hba("hostssl all all 10.0.0.0/8 md5", "pg_hba.conf").unwrap();
+        let err = check_rules(&rules, "8.8.8.8".parse().unwrap(), false, "app", "app").unwrap_err();
+        assert!(err.starts_with("no hba_file entry"), "{err}");
+    }
+
+    #[test]
+    fn test_hba_parse_errors() {
+        for line in [
+            "host all all 10.0.0.0/8",
+            "host all all 10.0.0.0/8 gss",
+            "host all all example.com md5",
+            "host all all 10.0.0.0 md5",
+            "host all +admins 10.0.0.0/8 md5",
+            "hostgssenc all all 10.0.0.0/8 md5",
+            "host all all 10.0.0.0/8 md5 extra",
+        ] {
+            assert!(parse_hba(line, "pg_hba.conf").is_err(), "{line}");
+        }
+        assert!(parse_hba(
+            "host all all 10.0.0.0/8 ldap ldapserver=ldap.example.com",
+            "pg_hba.conf"
+        )
+        .is_ok());
+    }
+
+    #[test]
+    fn test_hba_method_allows() {
+        assert!(HbaMethod::Md5.allows(HbaMethod::ScramSha256));
+        assert!(!HbaMethod::ScramSha256.allows(HbaMethod::Md5));
+        assert!(HbaMethod::Password.allows(HbaMethod::Ldap));
+        assert!(!HbaMethod::Password.allows(HbaMethod::Cert));
+        assert!(HbaMethod::Cert.allows(HbaMethod::Cert));
+        assert!(!HbaMethod::Reject.allows(HbaMethod::Md5));
+    }
+}
@@ -0,0 +1,142 @@
+// Health checks of the hosts of a database.
+//
+// For pools with health_check_interval every host of server_host and
+// server_hosts gets a new connection running `select 1` at that interval. A host
+// failing it is left out of the balancing for failover_cooldown and its idle
+// server connections are closed, so the clients move to the next healthy host
+// before they run into the failure. After the cooldown the host is checked again
+// and takes connections back once it passes.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::Duration;
+
+// External crate imports
+use log::warn;
+use tokio::time::Instant;
+
+// Internal crate imports
+use crate::config::{get_config, Address, Pool};
+use crate::errors::Error;
+use crate::pool::{get_all_pools, ClientServerMap, ConnectionPool};
+use crate::server::Server;
+use crate::stats::ServerStats;
+
+/// Connect to the host as the user of the pool and run `select 1`.
+async fn check_host(
+    pool: &ConnectionPool,
+    pool_config: &Pool,
+    host: &str,
+    port: u16,
+    client_server_map: ClientServerMap,
+    timeout: Duration,
+) -> Result<(), Error> {
+    let address = Address {
+        host: host.to_string(),
+        port,
+        ..pool.address.clone()
+    };
+    let server_database = pool_config
+        .server_database
+        .clone()
+        .unwrap_or(pool.address.database.clone());
+    let application_name = pool_config
+        .application_name
+        .clone()
+        .unwrap_or_else(|| "pg_doorman".to_string());
+    let stats = Arc::new(ServerStats::new(address.clone(), Instant::now()));
+    let check = async {
+        let connect_start = Instant::now();
+        let mut server = match Server::startup(
+            &address,
+            &pool.settings.user,
+            &server_database,
+            client_server_map,
+            stats.clone(),
+            true,
+            false,
+            0,
+            application_name,
+        )
+        .await
+        {
+            Ok(server) => server,
+            Err(err) => {
+                stats.host().connect_failed(&err);
+                return Err(err);
+            }
+        };
+        stats.host().connect_succeeded(connect_start.elapsed());
+        server.simple_query_rows("select 1").await?;
+        Ok(())
+    };
+    match tokio::time::timeout(timeout, check).await {
+        Ok(result) => result,
+        Err(_) => Err(Error::SocketError("health check timed out".to_string())),
+    }
+}
+
+/// Check the hosts of the databases with health_check_interval at their intervals.
+pub async fn watch_backend_health(client_server_map: ClientServerMap) {
+    let mut next_checks: HashMap<String, Instant> = HashMap::new();
+    let mut interval = tokio::time::interval(Duration::from_millis(100));
+    loop {
+        interval.tick().await;
+        let config = get_config();
+        let pools = get_all_pools();
+        for (database, pool_config) in &config.pools {
+            if pool_config.health_check_interval == 0 {
+                continue;
+            }
+            let now = Instant::now();
+            if next_checks.get(database).is_some_and(|next| *next > now) {
+                continue;
+            }
+            next_checks.insert(
+                database.clone(),
+                now + Duration::from_millis(pool_config.health_check_interval),
+            );
+
+            let pool = match pools
+                .iter()
+                .find(|(identifier, _)| identifier.db == *database)
+            {
+                Some((_, pool)) => pool,
+                None => continue,
+            };
+            let timeout = Duration::from_millis(
+                pool_config
+                    .connect_timeout
+                    .unwrap_or(config.general.connect_timeout),
+            );
+            for (host, port) in pool.balancer.hosts_to_check() {
+                match check_host(
+                    pool,
+                    pool_config,
+                    &host,
+                    port,
+                    client_server_map.clone(),
+                    timeout,
+                )
+                .await
+                {
+                    Ok(()) => pool.balancer.mark_up(&host, port),
+                    Err(err) => {
+                        warn!("[pool: {database}] Health check of {host}:{port} failed: {err}");
+                        pool.balancer.mark_down(&host, port);
+                        if pool.balancer.hosts().count() == 1 {
+                            continue;
+                        }
+                        // Partitions share the hosts of the database.
+                        for (_, other) in pools.iter() {
+                            if Arc::ptr_eq(&other.balancer, &pool.balancer) {
+                                other.close_idle_connections_to(&host, port);
+                            }
+                        }
+                    }
+                }
+            }
+        }
+    }
+}
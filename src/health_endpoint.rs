@@ -0,0 +1,249 @@
+// HTTP liveness and readiness endpoints for Kubernetes probes and load balancers.
+//
+// With `health_listen` set, a small HTTP server answers `GET /livez` while the
+// process serves requests at all and `GET /readyz` while it should get clients:
+// the listeners are bound, no graceful shutdown has started, not every database
+// is paused and at least one backend host is reachable. Both return JSON with
+// the details, the status code tells the probe the outcome. `/health` and
+// `/healthz` are aliases of `/readyz`. The same answers are given on the main
+// port with `http_on_main_port`.
+
+// Standard library imports
+use std::net::SocketAddr;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Instant;
+
+// External crate imports
+use log::{error, info};
+use once_cell::sync::Lazy;
+use serde_derive::Serialize;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+// Internal crate imports
+use crate::config::get_config;
+use crate::listener::listen_socket;
+use crate::pool::PAUSED_DATABASES;
+use crate::stats::hosts::get_host_stats;
+
+static STARTED_AT: Lazy<Instant> = Lazy::new(Instant::now);
+
+/// The client listeners are bound and accepting.
+static LISTENING: AtomicBool = AtomicBool::new(false);
+
+/// A graceful shutdown has started.
+static SHUTTING_DOWN: AtomicBool = AtomicBool::new(false);
+
+pub fn set_listening() {
+    Lazy::force(&STARTED_AT);
+    LISTENING.store(true, Ordering::Relaxed);
+}
+
+pub fn set_shutting_down() {
+    SHUTTING_DOWN.store(true, Ordering::Relaxed);
+}
+
+pub fn is_shutting_down() -> bool {
+    SHUTTING_DOWN.load(Ordering::Relaxed)
+}
+
+#[derive(Serialize, Debug, PartialEq)]
+struct Backend {
+    host: String,
+    port: u16,
+    state: &'static str,
+}
+
+#[derive(Serialize, Debug, PartialEq)]
+struct Readiness {
+    ready: bool,
+    listening: bool,
+    shutting_down: bool,
+    paused_databases: Vec<String>,
+    backends: Vec<Backend>,
+}
+
+/// Hosts not connected to yet count as reachable, so an instance without
+/// min_pool_size connections gets its first clients.
+fn readiness(
+    listening: bool,
+    shutting_down: bool,
+    databases: &[String],
+    mut paused_databases: Vec<String>,
+    backends: Vec<Backend>,
+) -> Readiness {
+    paused_databases.sort();
+    let all_paused = !databases.is_empty()
+        && databases
+            .iter()
+            .all(|database| paused_databases.contains(database));
+    let reachable = backends.is_empty() || backends.iter().any(|backend| backend.state != "down");
+    Readiness {
+        ready: listening && !shutting_down && !all_paused && reachable,
+        listening,
+        shutting_down,
+        paused_databases,
+        backends,
+    }
+}
+
+fn current_readiness() -> Readiness {
+    let databases: Vec<String> = get_config().pools.keys().cloned().collect();
+    let paused_databases = PAUSED_DATABASES.lock().iter().cloned().collect();
+    let backends = get_host_stats()
+        .into_iter()
+        .map(|((host, port), stats)| Backend {
+            host,
+            port,
+            state: stats.state(),
+        })
+        .collect();
+    readiness(
+        LISTENING.load(Ordering::Relaxed),
+        SHUTTING_DOWN.load(Ordering::Relaxed),
+        &databases,
+        paused_databases,
+        backends,
+    )
+}
+
+/// Status line and JSON body answering the request line.
+fn response(request_line: &str) -> (&'static str, String) {
+    let mut parts = request_line.split_whitespace();
+    let method = parts.next().unwrap_or_default();
+    let path = parts.next().unwrap_or_default().split('?').next();
+    if method != "GET" && method != "HEAD" {
+        return (
+            "405 Method Not Allowed",
+            "{\"error\":\"method not allowed\"}".to_string(),
+        );
+    }
+    match path {
+        Some("/livez") => (
+            "200 OK",
+            serde_json::json!({
+                "status": "alive",
+                "uptime_seconds": STARTED_AT.elapsed().as_secs(),
+            })
+            .to_string(),
+        ),
+        Some("/readyz" | "/health" | "/healthz") => {
+            let readiness = current_readiness();
+            let status = if readiness.ready {
+                "200 OK"
+            } else {
+                "503 Service Unavailable"
+            };
+            let body = serde_json::to_string(&readiness).unwrap_or_default();
+            (status, body)
+        }
+        _ => ("404 Not Found", "{\"error\":\"not found\"}".to_string()),
+    }
+}
+
+/// The HTTP response to a health request, by its request line.
+pub fn health_http_response(request_line: &str) -> String {
+    let (status, body) = response(request_line);
+    format!(
+        "HTTP/1.1 {status}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{body}",
+        body.len()
+    )
+}
+
+async fn handle_request(mut stream: TcpStream) {
+    let mut request = [0; 1024];
+    let n = match stream.read(&mut request).await {
+        Ok(n) => n,
+        Err(err) => {
+            error!("Failed to read health request: {err}");
+            return;
+        }
+    };
+    let request = String::from_utf8_lossy(&request[..n]);
+    let response = health_http_response(request.lines().next().unwrap_or_default());
+    if let Err(err) = stream.write_all(response.as_bytes()).await {
+        error!("Failed to write health response: {err}");
+    }
+}
+
+/// Serve /livez and /readyz on `addr`, runs for the lifetime of the process.
+pub async fn start_health_server(addr: SocketAddr) {
+    let socket = listen_socket(addr, false);
+    let listener = match socket.bind(addr).and_then(|()| socket.listen(128)) {
+        Ok(listener) => listener,
+        Err(err) => {
+            error!("Failed to listen for health requests on {addr}: {err}");
+            return;
+        }
+    };
+    info!("Health endpoints listening on {addr}");
+    loop {
+        match listener.accept().await {
+            Ok((stream, _)) => {
+                tokio::spawn(async move {
+                    handle_request(stream).await;
+                });
+            }
+            Err(err) => error!("Failed to accept health request: {err}"),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn backend(state: &'static str) -> Backend {
+        Backend {
+            host: "10.0.0.1".to_string(),
+            port: 5432,
+            state,
+        }
+    }
+
+    #[test]
+    fn test_readiness() {
+        let databases = vec!["billing".to_string(), "orders".to_string()];
+        assert!(readiness(true, false, &databases, vec![], vec![]).ready);
+        assert!(readiness(true, false, &databases, vec![], vec![backend("unknown")]).ready);
+        assert!(
+            readiness(
+                true,
+                false,
+                &databases,
+                vec!["orders".to_string()],
+                vec![backend("down"), backend("up")]
+            )
+            .ready
+        );
+
+        assert!(!readiness(false, false, &databases, vec![], vec![]).ready);
+        assert!(!readiness(true, true, &databases, vec![], vec![]).ready);
+        assert!(!readiness(true, false, &databases, vec![], vec![backend("down")]).ready);
+        assert!(
+            !readiness(
+                true,
+                false,
+                &databases,
+                vec!["orders".to_string(), "billing".to_string()],
+                vec![]
+            )
+            .ready
+        );
+    }
+
+    #[test]
+    fn test_response() {
+        let (status, body) = response("GET /livez HTTP/1.1");
+        assert_eq!(status, "200 OK");
+        let body: serde_json::Value = serde_json::from_str(&body).unwrap();
+        assert_eq!(body["status"], "alive");
+
+        assert_eq!(
+            response("GET /healthz HTTP/1.1").1,
+            response("GET /readyz HTTP/1.1").1
+        );
+        assert_eq!(response("GET /metrics HTTP/1.1").0, "404 Not Found");
+        assert_eq!(response("POST /livez HTTP/1.1").0, "405 Method Not Allowed");
+    }
+}
@@ -0,0 +1,175 @@
+// A minimal HTTP client for fetching documents: the shared config of the
+// cluster, the JSON Web Key Sets of the JWT issuers.
+//
+// GET only, over HTTP/1.0 so that the body is neither chunked nor kept alive,
+// with https:// served by native-tls.
+
+// Standard library imports
+use std::time::Duration;
+
+// External crate imports
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+// Internal crate imports
+use crate::errors::Error;
+
+#[derive(Debug, PartialEq)]
+struct Url {
+    tls: bool,
+    host: String,
+    port: u16,
+    path: String,
+}
+
+fn parse_url(url: &str) -> Result<Url, Error> {
+    let (tls, rest) = if let Some(rest) = url.strip_prefix("https://") {
+        (true, rest)
+    } else if let Some(rest) = url.strip_prefix("http://") {
+        (false, rest)
+    } else {
+        return Err(Error::BadConfig(format!("Unsupported URL: {url}")));
+    };
+    let (authority, path) = match rest.find('/') {
+        Some(index) => (&rest[..index], &rest[index..]),
+        None => (rest, "/"),
+    };
+    let default_port = if tls { 443 } else { 80 };
+    let (host, port) = match authority.rsplit_once(':') {
+        // An IPv6 address without a port: [::1]
+        Some((host, port)) if !port.ends_with(']') => match port.parse() {
+            Ok(port) => (host, port),
+            Err(_) => return Err(Error::BadConfig(format!("Bad port in URL: {url}"))),
+        },
+        _ => (authority, default_port),
+    };
+    let host = host.trim_start_matches('[').trim_end_matches(']');
+    if host.is_empty() {
+        return Err(Error::BadConfig(format!("No host in URL: {url}")));
+    }
+    Ok(Url {
+        tls,
+        host: host.to_string(),
+        port,
+        path: path.to_string(),
+    })
+}
+
+/// Body of a successful response.
+fn parse_response(url: &str, response: &[u8]) -> Result<String, Error> {
+    let response = String::from_utf8_lossy(response);
+    let (head, body) = match response.split_once("\r\n\r\n") {
+        Some(parts) => parts,
+        None => return Err(Error::BadConfig(format!("Bad HTTP response from {url}"))),
+    };
+    let status = head.lines().next().unwrap_or_default();
+    match status.split_whitespace().nth(1) {
+        Some("200") => Ok(body.to_string()),
+        _ => Err(Error::BadConfig(format!("Fetching {url} failed: {status}"))),
+    }
+}
+
+async fn exchange<S>(mut stream: S, request: &str) -> std::io::Result<Vec<u8>>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+{
+    stream.write_all(request.as_bytes()).await?;
+    let mut response = Vec::new();
+    stream.read_to_end(&mut response).await?;
+    Ok(response)
+}
+
+async fn request(url_str: &str, headers: &[String]) -> Result<String, Error> {
+    let url = parse_url(url_str)?;
+    let mut request = format!("GET {} HTTP/1.0\r\nHost: {}\r\n", url.path, url.host);
+    for header in headers {
+        request.push_str(header.trim());
+        request.push_str("\r\n");
+    }
+    request.push_str("\r\n");
+
+    let stream = match TcpStream::connect((url.host.as_str(), url.port)).await {
+        Ok(stream) => stream,
+        Err(err) => {
+            return Err(Error::BadConfig(format!(
+                "Could not connect to {url_str}: {err}"
+            )))
+        }
+    };
+    let response = if url.tls {
+        let connector = match native_tls::TlsConnector::new() {
+            Ok(connector) => tokio_native_tls::TlsConnector::from(connector),
+            Err(err) => return Err(Error::BadConfig(format!("TLS setup failed: {err}"))),
+        };
+        match connector.connect(&url.host, stream).await {
+            Ok(stream) => exchange(stream, &request).await,
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "TLS handshake with {url_str} failed: {err}"
+                )))
+            }
+        }
+    } else {
+        exchange(stream, &request).await
+    };
+    match response {
+        Ok(response) => parse_response(url_str, &response),
+        Err(err) => Err(Error::BadConfig(format!(
+            "Fetching {url_str} failed: {err}"
+        ))),
+    }
+}
+
+/// Fetch the document at the URL, sending the extra headers ("Name: value").
+pub async fn http_get(url: &str, headers: &[String], timeout: Duration) -> Result<String, Error> {
+    match tokio::time::timeout(timeout, request(url, headers)).await {
+        Ok(result) => result,
+        Err(_) => Err(Error::BadConfig(format!("Fetching {url} timed out"))),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_url() {
+        assert_eq!(
+            parse_url("http://consul:8500/v1/kv/pg_doorman?raw").unwrap(),
+            Url {
+                tls: false,
+                host: "consul".to_string(),
+                port: 8500,
+                path: "/v1/kv/pg_doorman?raw".to_string(),
+            }
+        );
+        assert_eq!(
+            parse_url("https://bucket.s3.amazonaws.com").unwrap(),
+            Url {
+                tls: true,
+                host: "bucket.s3.amazonaws.com".to_string(),
+                port: 443,
+                path: "/".to_string(),
+            }
+        );
+        assert_eq!(parse_url("http://[::1]:8080/config").unwrap().host, "::1");
+        assert_eq!(parse_url("http://[::1]/config").unwrap().port, 80);
+        assert!(parse_url("ftp://host/config").is_err());
+        assert!(parse_url("http://host:port/config").is_err());
+    }
+
+    #[test]
+    fn test_parse_response() {
+        let url = "http://consul:8500/v1/kv/pg_doorman?raw";
+        assert_eq!(
+            parse_response(
+                url,
+                b"HTTP/1.0 200 OK\r\nContent-Length: 8\r\n\r\n[pools]\n"
+            )
+            .unwrap(),
+            "[pools]\n"
+        );
+        assert!(parse_response(url, b"HTTP/1.1 404 Not Found\r\n\r\n").is_err());
+        assert!(parse_response(url, b"garbage").is_err());
+    }
+}
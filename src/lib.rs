@@ -1,24 +1,62 @@
 pub mod admin;
+pub mod admission;
+pub mod analyze;
+pub mod audit;
 pub mod auth;
+pub mod balancer;
+pub mod cancel_limit;
 pub mod client;
+pub mod cluster_config;
 pub mod cmd_args;
 pub mod config;
+pub mod config_env;
+pub mod config_migration;
+pub mod config_watch;
 pub mod constants;
 pub mod core_affinity;
 pub mod daemon;
+pub mod db_client_limit;
+pub mod dns_cache;
 pub mod errors;
+pub mod events;
+pub mod fd_limit;
 pub mod generate;
+pub mod handoff;
+pub mod hba;
+pub mod health_check;
+pub mod health_endpoint;
+pub mod http_client;
+pub mod listener;
+pub mod log_rules;
 pub mod logger;
+pub mod login_limit;
 pub mod messages;
+pub mod mirror;
+pub mod peering;
 pub mod pool;
+pub mod profiler;
 pub mod prometheus_exporter;
+pub mod proxy_protocol;
+pub mod quarantine;
+pub mod query_routes;
 #[cfg(test)]
 mod prometheus_exporter_test;
 pub mod rate_limit;
+pub mod redact;
+pub mod replica_status;
+pub mod replication;
+pub mod result_cache;
 mod scram_client;
+pub mod sd_notify;
+pub mod selftest;
 pub mod server;
+pub mod slow_query;
+pub mod startup_pacing;
+pub mod statement_allowlist;
 pub mod stats;
+pub mod statsd_exporter;
 pub mod tls;
+pub mod transaction_limit;
 
 /// Format chrono::Duration to be more human-friendly.
 ///
@@ -38,3 +76,21 @@ pub fn format_duration(duration: &chrono::Duration) -> String {
 
     format!("{days}d {hours}:{minutes}:{seconds}.{milliseconds}")
 }
+
+/// Format host and port as a socket address, wrapping IPv6 literals in brackets.
+pub fn format_host_port(host: &str, port: u16) -> String {
+    if host.contains(':') && !host.starts_with('[') {
+        format!("[{host}]:{port}")
+    } else {
+        format!("{host}:{port}")
+    }
+}
+
+/// Address family name of the socket address, used in logs.
+pub fn address_family(addr: &std::net::SocketAddr) -> &'static str {
+    match addr {
+        std::net::SocketAddr::V4(_) => "ipv4",
+        std::net::SocketAddr::V6(v6) if v6.ip().to_ipv4_mapped().is_some() => "ipv4-mapped",
+        std::net::SocketAddr::V6(_) => "ipv6",
+    }
+}
@@ -0,0 +1,90 @@
+// Listening sockets for the clients.
+//
+// Besides general.host:port, clients can be accepted on the addresses of
+// general.listeners, each with its own options: e.g. the internal network on
+// the main port and a TLS-only address for the external one.
+
+// Standard library imports
+use std::future::poll_fn;
+use std::io;
+use std::net::SocketAddr;
+use std::task::Poll;
+use std::time::Duration;
+
+// External crate imports
+use log::warn;
+use socket2::SockRef;
+use tokio::net::{TcpListener, TcpSocket, TcpStream};
+
+// Internal crate imports
+use crate::config::ListenerOptions;
+
+/// A socket to listen on `addr`, not bound yet.
+pub fn listen_socket(addr: SocketAddr, ipv6_only: bool) -> TcpSocket {
+    let listen_socket = if addr.is_ipv4() {
+        TcpSocket::new_v4().unwrap()
+    } else {
+        let socket = TcpSocket::new_v6().unwrap();
+        SockRef::from(&socket)
+            .set_only_v6(ipv6_only)
+            .expect("can't set ipv6_only");
+        socket
+    };
+    listen_socket
+        .set_reuseaddr(true)
+        .expect("can't set reuseaddr");
+    listen_socket
+        .set_reuseport(true)
+        .expect("can't set reuseport");
+    listen_socket.set_nodelay(true).expect("can't set nodelay");
+    listen_socket
+        .set_linger(Some(Duration::from_secs(0)))
+        .expect("can't set linger 0");
+    // IPTOS_LOWDELAY: u8 = 0x10;
+    if addr.is_ipv4() {
+        if let Err(err) = listen_socket.set_tos(0x10) {
+            warn!("Can't set IPTOS_LOWDELAY: {err:?}");
+        }
+    }
+    listen_socket
+}
+
+/// Accept the next client on any of the listeners, with the options of its listener.
+pub async fn accept_client(
+    listeners: &[(TcpListener, ListenerOptions)],
+) -> (io::Result<(TcpStream, SocketAddr)>, ListenerOptions) {
+    poll_fn(|cx| {
+        for (listener, options) in listeners {
+            if let Poll::Ready(result) = listener.poll_accept(cx) {
+                return Poll::Ready((result, *options));
+            }
+        }
+        Poll::Pending
+    })
+    .await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_accept_client() {
+        let mut listeners = Vec::new();
+        for read_only in [false, true] {
+            let socket = listen_socket("127.0.0.1:0".parse().unwrap(), false);
+            socket.bind("127.0.0.1:0".parse().unwrap()).unwrap();
+            let options = ListenerOptions {
+                read_only,
+                ..Default::default()
+            };
+            listeners.push((socket.listen(16).unwrap(), options));
+        }
+
+        let addr = listeners[1].0.local_addr().unwrap();
+        let _client = TcpStream::connect(addr).await.unwrap();
+        let (result, options) = accept_client(&listeners).await;
+        assert!(result.is_ok());
+        assert!(options.read_only);
+    }
+}
@@ -0,0 +1,320 @@
+// Log level overrides for a single pool, user or client connection.
+//
+// The admin console can raise (or lower) the log level of one pool, user or client
+// for a limited time, so deep debugging doesn't need debug logging of the whole
+// instance. Every client task carries the pool, user and id of its client; log
+// records are matched against the client the current task serves.
+
+// Standard library imports
+use std::cell::RefCell;
+use std::fmt;
+use std::future::Future;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::{info, LevelFilter, Log, Metadata, Record};
+use once_cell::sync::Lazy;
+use parking_lot::RwLock;
+
+// Internal crate imports
+use crate::messages::DataType;
+
+/// How often expired rules are removed.
+const EXPIRE_PERIOD: Duration = Duration::from_secs(1);
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+/// Clients a log level override applies to.
+pub enum LogTarget {
+    /// Clients of a pool (database).
+    Pool(String),
+    /// Clients connected as a user.
+    User(String),
+    /// A single client, by its process id (client_id in SHOW CLIENTS).
+    Client(i32),
+}
+
+impl LogTarget {
+    /// Rules for narrower targets win over broader ones.
+    fn specificity(&self) -> u8 {
+        match self {
+            LogTarget::Pool(_) => 0,
+            LogTarget::User(_) => 1,
+            LogTarget::Client(_) => 2,
+        }
+    }
+
+    fn matches(&self, context: &LogContext) -> bool {
+        match self {
+            LogTarget::Pool(pool) => *pool == context.pool,
+            LogTarget::User(user) => *user == context.user,
+            LogTarget::Client(client_id) => *client_id == context.client_id,
+        }
+    }
+}
+
+impl fmt::Display for LogTarget {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LogTarget::Pool(pool) => write!(f, "pool {pool}"),
+            LogTarget::User(user) => write!(f, "user {user}"),
+            LogTarget::Client(client_id) => write!(f, "client {client_id:#010X}"),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+/// Log level of the clients of a target until the rule expires.
+pub struct LogRule {
+    pub target: LogTarget,
+    pub level: LevelFilter,
+    pub expires_at: Instant,
+}
+
+impl LogRule {
+    pub fn generate_show_log_levels_header() -> Vec<(&'static str, DataType)> {
+        vec![
+            ("target", DataType::Text),
+            ("level", DataType::Text),
+            ("expires_in_seconds", DataType::Numeric),
+        ]
+    }
+
+    pub fn generate_show_log_levels_row(&self) -> Vec<String> {
+        vec![
+            self.target.to_string(),
+            self.level.to_string(),
+            self.expires_at
+                .saturating_duration_since(Instant::now())
+                .as_secs()
+                .to_string(),
+        ]
+    }
+}
+
+#[derive(Debug, Clone, Default)]
+/// The client a task serves.
+pub struct LogContext {
+    pub pool: String,
+    pub user: String,
+    pub client_id: i32,
+}
+
+#[derive(Debug)]
+struct LogRules {
+    /// Log level of the instance.
+    base: LevelFilter,
+    rules: Vec<LogRule>,
+}
+
+impl LogRules {
+    /// Level of the most specific unexpired rule matching the client.
+    fn level_for(&self, context: &LogContext, now: Instant) -> Option<LevelFilter> {
+        self.rules
+            .iter()
+            .filter(|rule| rule.expires_at > now && rule.target.matches(context))
+            .max_by_key(|rule| rule.target.specificity())
+            .map(|rule| rule.level)
+    }
+
+    /// Records up to this level can reach the logger.
+    fn max_level(&self) -> LevelFilter {
+        self.rules
+            .iter()
+            .map(|rule| rule.level)
+            .fold(self.base, LevelFilter::max)
+    }
+}
+
+static LOG_RULES: Lazy<RwLock<LogRules>> = Lazy::new(|| {
+    RwLock::new(LogRules {
+        base: LevelFilter::Info,
+        rules: Vec::new(),
+    })
+});
+
+/// Set while there are rules, so logging doesn't pay for them otherwise.
+static HAS_RULES: AtomicBool = AtomicBool::new(false);
+
+tokio::task_local! {
+    static LOG_CONTEXT: RefCell<Option<LogContext>>;
+}
+
+/// Apply the rule changes to the log crate and the fast path flag.
+fn apply(rules: &LogRules) {
+    HAS_RULES.store(!rules.rules.is_empty(), Ordering::Relaxed);
+    log::set_max_level(rules.max_level());
+}
+
+/// Set the log level of the instance, called once the logger is initialized.
+pub fn set_base_level(level: LevelFilter) {
+    let mut rules = LOG_RULES.write();
+    rules.base = level;
+    apply(&rules);
+}
+
+/// Log the clients of `target` at `level` for `duration`, replacing a previous rule of the target.
+pub fn add_log_rule(target: LogTarget, level: LevelFilter, duration: Duration) {
+    let mut rules = LOG_RULES.write();
+    rules.rules.retain(|rule| rule.target != target);
+    rules.rules.push(LogRule {
+        target,
+        level,
+        expires_at: Instant::now() + duration,
+    });
+    apply(&rules);
+}
+
+/// Remove all rules.
+pub fn clear_log_rules() {
+    let mut rules = LOG_RULES.write();
+    rules.rules.clear();
+    apply(&rules);
+}
+
+/// Unexpired rules.
+pub fn get_log_rules() -> Vec<LogRule> {
+    let now = Instant::now();
+    LOG_RULES
+        .read()
+        .rules
+        .iter()
+        .filter(|rule| rule.expires_at > now)
+        .cloned()
+        .collect()
+}
+
+/// Removes expired rules, restoring the log level of the instance.
+///
+/// Runs forever.
+pub async fn expire_log_rules() {
+    let mut interval = tokio::time::interval(EXPIRE_PERIOD);
+    loop {
+        interval.tick().await;
+
+        if !HAS_RULES.load(Ordering::Relaxed) {
+            continue;
+        }
+        let now = Instant::now();
+        let mut rules = LOG_RULES.write();
+        let before = rules.rules.len();
+        rules.rules.retain(|rule| rule.expires_at > now);
+        if rules.rules.len() != before {
+            apply(&rules);
+            drop(rules);
+            info!("Log level overrides expired");
+        }
+    }
+}
+
+/// Run a client task, whose log records can be matched against the rules.
+pub async fn with_log_context<F: Future>(future: F) -> F::Output {
+    LOG_CONTEXT.scope(RefCell::new(None), future).await
+}
+
+/// Set the client served by the current task.
+pub fn set_log_context(context: LogContext) {
+    let _ = LOG_CONTEXT.try_with(|current| *current.borrow_mut() = Some(context));
+}
+
+/// Level override for the client served by the current task, if any rule matches it.
+pub fn context_level() -> Option<LevelFilter> {
+    if !HAS_RULES.load(Ordering::Relaxed) {
+        return None;
+    }
+    LOG_CONTEXT
+        .try_with(|current| {
+            let current = current.borrow();
+            LOG_RULES
+                .read()
+                .level_for(current.as_ref()?, Instant::now())
+        })
+        .ok()
+        .flatten()
+}
+
+/// Decide on a record of `level`: Some(enabled) if a rule matches the current client,
+/// None if the instance log level applies.
+pub fn context_enabled(level: log::Level) -> Option<bool> {
+    context_level().map(|max_level| level <= max_level)
+}
+
+/// A logger that applies the rules before passing records to `inner`.
+pub struct LogRulesFilter<L> {
+    inner: L,
+}
+
+impl<L> LogRulesFilter<L> {
+    pub fn new(inner: L) -> Self {
+        LogRulesFilter { inner }
+    }
+}
+
+impl<L: Log> Log for LogRulesFilter<L> {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        let enabled = match context_enabled(metadata.level()) {
+            Some(enabled) => enabled,
+            None => metadata.level() <= LOG_RULES.read().base,
+        };
+        enabled && self.inner.enabled(metadata)
+    }
+
+    fn log(&self, record: &Record) {
+        if self.enabled(record.metadata()) {
+            self.inner.log(record);
+        }
+    }
+
+    fn flush(&self) {
+        self.inner.flush()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_log_rules_level_for() {
+        let now = Instant::now();
+        let context = LogContext {
+            pool: "db".to_string(),
+            user: "alice".to_string(),
+            client_id: 42,
+        };
+        let rule = |target: LogTarget, level: LevelFilter, expires_at: Instant| LogRule {
+            target,
+            level,
+            expires_at,
+        };
+        let mut rules = LogRules {
+            base: LevelFilter::Info,
+            rules: Vec::new(),
+        };
+        assert_eq!(rules.level_for(&context, now), None);
+        assert_eq!(rules.max_level(), LevelFilter::Info);
+
+        let later = now + Duration::from_secs(60);
+        rules.rules.push(rule(
+            LogTarget::Pool("db".to_string()),
+            LevelFilter::Debug,
+            later,
+        ));
+        rules.rules.push(rule(
+            LogTarget::User("bob".to_string()),
+            LevelFilter::Trace,
+            later,
+        ));
+        assert_eq!(rules.level_for(&context, now), Some(LevelFilter::Debug));
+        assert_eq!(rules.max_level(), LevelFilter::Trace);
+
+        // A client rule wins over the pool rule, even if it lowers the level.
+        rules
+            .rules
+            .push(rule(LogTarget::Client(42), LevelFilter::Warn, later));
+        assert_eq!(rules.level_for(&context, now), Some(LevelFilter::Warn));
+
+        // Expired rules don't apply.
+        assert_eq!(rules.level_for(&context, later), None);
+    }
+}
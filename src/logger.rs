@@ -1,10 +1,15 @@
 extern crate log;
 use crate::cmd_args::{Args, LogFormat};
+use crate::log_rules::{context_enabled, set_base_level, LogRulesFilter};
+use crate::redact::{RedactingLogger, RedactingWriter};
 use log::LevelFilter;
 use std::process;
 use syslog::{BasicLogger, Facility, Formatter3164};
 use tracing_subscriber;
-use tracing_subscriber::EnvFilter;
+use tracing_subscriber::filter::{filter_fn, FilterExt};
+use tracing_subscriber::layer::SubscriberExt;
+use tracing_subscriber::util::SubscriberInitExt;
+use tracing_subscriber::{EnvFilter, Layer};
 
 pub fn init(args: &Args, syslog_name: Option<String>) {
     if syslog_name.is_some() {
@@ -16,22 +21,50 @@ pub fn init(args: &Args, syslog_name: Option<String>) {
         };
         let syslog_logger = syslog::unix(formatter).unwrap();
         // max level in syslog mode is INFO (performance penalty for DEBUG).
-        log::set_boxed_logger(Box::new(BasicLogger::new(syslog_logger)))
-            .map(|()| log::set_max_level(LevelFilter::Info))
+        let logger = LogRulesFilter::new(RedactingLogger::new(BasicLogger::new(syslog_logger)));
+        log::set_boxed_logger(Box::new(logger))
+            .map(|()| set_base_level(LevelFilter::Info))
             .unwrap();
     } else {
         // Iniitalize a default filter, and then override the builtin default "warning" with our
         // commandline, (default: "info")
         let filter = EnvFilter::from_default_env().add_directive(args.log_level.into());
+        let base_level = match filter.max_level_hint() {
+            Some(hint) => hint.into_level().map_or(LevelFilter::Off, |level| {
+                as_log_level(&level).to_level_filter()
+            }),
+            None => LevelFilter::Trace,
+        };
+        // Log level overrides of the admin console (LOG command) apply on top of it.
+        let filter = filter
+            .or(filter_fn(|metadata| {
+                context_enabled(as_log_level(metadata.level())) == Some(true)
+            }))
+            .and(filter_fn(|metadata| {
+                context_enabled(as_log_level(metadata.level())) != Some(false)
+            }));
 
-        let trace_sub = tracing_subscriber::fmt()
-            .with_env_filter(filter)
+        let layer = tracing_subscriber::fmt::layer()
+            .with_writer(|| RedactingWriter::new(std::io::stdout()))
             .with_ansi(!args.no_color);
 
+        let registry = tracing_subscriber::registry();
         match args.log_format {
-            LogFormat::Structured => trace_sub.json().init(),
-            LogFormat::Debug => trace_sub.pretty().init(),
-            _ => trace_sub.init(),
+            LogFormat::Structured => registry.with(layer.json().with_filter(filter)).init(),
+            LogFormat::Debug => registry.with(layer.pretty().with_filter(filter)).init(),
+            _ => registry.with(layer.with_filter(filter)).init(),
         };
+        // Only records the filter or the overrides may need are passed from the log crate.
+        set_base_level(base_level);
+    }
+}
+
+fn as_log_level(level: &tracing::Level) -> log::Level {
+    match *level {
+        tracing::Level::ERROR => log::Level::Error,
+        tracing::Level::WARN => log::Level::Warn,
+        tracing::Level::INFO => log::Level::Info,
+        tracing::Level::DEBUG => log::Level::Debug,
+        tracing::Level::TRACE => log::Level::Trace,
     }
 }
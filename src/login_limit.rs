@@ -0,0 +1,182 @@
+// Limits on login attempts.
+//
+// A credential-stuffing bot or an application crash-looping on a wrong password
+// opens connections as fast as it can. New connections are capped per second,
+// by login_rate_limit for all addresses and login_rate_limit_per_ip for each
+// address: the extra ones are closed right after accept, before any work is
+// spent on them. An address failing authentication waits auth_failure_delay
+// before its next attempt, doubled with each further failure up to
+// auth_failure_max_delay, until it authenticates or stays quiet for a while.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+/// Connections closed because of login_rate_limit or login_rate_limit_per_ip.
+pub static LOGIN_RATE_LIMITED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Logins delayed after auth failures of their address.
+pub static AUTH_FAILURE_DELAYED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Auth failures of an address are forgotten after this long without another one.
+const AUTH_FAILURE_MEMORY: Duration = Duration::from_secs(600);
+
+#[derive(Debug)]
+struct LoginWindow {
+    /// Start of the current second.
+    started_at: Instant,
+    total: u32,
+    by_addr: HashMap<IpAddr, u32>,
+}
+
+impl LoginWindow {
+    /// Count a login of `addr`, false if it is over one of the limits (0 disables them).
+    fn allow(&mut self, addr: IpAddr, now: Instant, limit: u32, limit_per_ip: u32) -> bool {
+        if now.saturating_duration_since(self.started_at) >= Duration::from_secs(1) {
+            self.started_at = now;
+            self.total = 0;
+            self.by_addr.clear();
+        }
+        if limit != 0 && self.total >= limit {
+            return false;
+        }
+        if limit_per_ip != 0 {
+            let count = self.by_addr.entry(addr).or_insert(0);
+            if *count >= limit_per_ip {
+                return false;
+            }
+            *count += 1;
+        }
+        self.total += 1;
+        true
+    }
+}
+
+static LOGIN_WINDOW: Lazy<Mutex<LoginWindow>> = Lazy::new(|| {
+    Mutex::new(LoginWindow {
+        started_at: Instant::now(),
+        total: 0,
+        by_addr: HashMap::new(),
+    })
+});
+
+#[derive(Debug, Clone, Copy)]
+struct AuthFailures {
+    count: u32,
+    last_at: Instant,
+}
+
+static AUTH_FAILURES: Lazy<Mutex<HashMap<IpAddr, AuthFailures>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Count a new connection of `addr`, false if it is over login_rate_limit or
+/// login_rate_limit_per_ip and must be closed.
+pub fn allow_login(addr: IpAddr, limit: u32, limit_per_ip: u32) -> bool {
+    if limit == 0 && limit_per_ip == 0 {
+        return true;
+    }
+    let allowed =
+        LOGIN_WINDOW
+            .lock()
+            .allow(addr.to_canonical(), Instant::now(), limit, limit_per_ip);
+    if !allowed {
+        LOGIN_RATE_LIMITED_COUNTER.fetch_add(1, Ordering::Relaxed);
+    }
+    allowed
+}
+
+/// Delay after `count` failures: `base` doubled with each failure after the first, up to `max`.
+fn failure_delay(count: u32, base: u64, max: u64) -> Duration {
+    if count == 0 || base == 0 {
+        return Duration::ZERO;
+    }
+    let delay = base.saturating_mul(1u64 << (count - 1).min(32));
+    Duration::from_millis(delay.min(max))
+}
+
+/// How long the next login of `addr` waits because of its auth failures, with
+/// auth_failure_delay and auth_failure_max_delay (ms).
+pub fn auth_failure_delay(addr: IpAddr, delay: u64, max_delay: u64) -> Duration {
+    if delay == 0 {
+        return Duration::ZERO;
+    }
+    let count = match AUTH_FAILURES.lock().get(&addr.to_canonical()) {
+        Some(failures) if failures.last_at.elapsed() < AUTH_FAILURE_MEMORY => failures.count,
+        _ => 0,
+    };
+    let delay = failure_delay(count, delay, max_delay);
+    if !delay.is_zero() {
+        AUTH_FAILURE_DELAYED_COUNTER.fetch_add(1, Ordering::Relaxed);
+    }
+    delay
+}
+
+/// Count an auth failure of `addr`.
+pub fn record_auth_failure(addr: IpAddr) {
+    let now = Instant::now();
+    let mut failures = AUTH_FAILURES.lock();
+    failures.retain(|_, entry| now.saturating_duration_since(entry.last_at) < AUTH_FAILURE_MEMORY);
+    let failures = failures.entry(addr.to_canonical()).or_insert(AuthFailures {
+        count: 0,
+        last_at: now,
+    });
+    failures.count = failures.count.saturating_add(1);
+    failures.last_at = now;
+}
+
+/// `addr` authenticated: forget its failures.
+pub fn reset_auth_failures(addr: IpAddr) {
+    AUTH_FAILURES.lock().remove(&addr.to_canonical());
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_login_window() {
+        let addr: IpAddr = "10.0.0.1".parse().unwrap();
+        let other: IpAddr = "10.0.0.2".parse().unwrap();
+        let start = Instant::now();
+        let mut window = LoginWindow {
+            started_at: start,
+            total: 0,
+            by_addr: HashMap::new(),
+        };
+
+        assert!(window.allow(addr, start, 3, 2));
+        assert!(window.allow(addr, start, 3, 2));
+        assert!(!window.allow(addr, start, 3, 2));
+        assert!(window.allow(other, start, 3, 2));
+        // The global limit is reached.
+        assert!(!window.allow(other, start, 3, 2));
+
+        // A new second starts over.
+        let later = start + Duration::from_secs(1);
+        assert!(window.allow(addr, later, 3, 2));
+
+        // Disabled limits.
+        for _ in 0..10 {
+            assert!(window.allow(addr, later, 0, 0));
+        }
+    }
+
+    #[test]
+    fn test_failure_delay() {
+        assert_eq!(failure_delay(0, 100, 1000), Duration::ZERO);
+        assert_eq!(failure_delay(1, 100, 1000), Duration::from_millis(100));
+        assert_eq!(failure_delay(3, 100, 1000), Duration::from_millis(400));
+        assert_eq!(failure_delay(5, 100, 1000), Duration::from_millis(1000));
+        assert_eq!(
+            failure_delay(u32::MAX, 100, 1000),
+            Duration::from_millis(1000)
+        );
+        assert_eq!(failure_delay(3, 0, 1000), Duration::ZERO);
+    }
+}
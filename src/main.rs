@@ -31,7 +31,6 @@ use std::io::{self, IsTerminal, Write};
 use std::net::ToSocketAddrs;
 use std::os::fd::AsRawFd;
 use std::os::unix::process::CommandExt;
-use std::path::Path;
 use std::process;
 use std::sync::atomic::{AtomicI64, AtomicUsize, Ordering};
 use std::sync::Arc;
@@ -39,7 +38,6 @@ use std::time::Duration;
 
 use parking_lot::Mutex;
 use tokio::io::AsyncWriteExt;
-use tokio::net::TcpSocket;
 #[cfg(not(windows))]
 use tokio::signal::unix::{signal as unix_signal, SignalKind};
 #[cfg(windows)]
@@ -49,18 +47,42 @@ use tokio::{runtime::Builder, sync::mpsc};
 
 extern crate exitcode;
 
+use pg_doorman::analyze::{run_analyze, start_analyze};
+use pg_doorman::cancel_limit::cancel_handlers_count;
+use pg_doorman::admission::watch_backend_load;
+use pg_doorman::auth::jwt_issuer::refresh_jwks;
+use pg_doorman::cluster_config::watch_cluster_config;
 use pg_doorman::cmd_args::Commands;
-use pg_doorman::config::{get_config, reload_config, VERSION};
+use pg_doorman::config::{get_config, reload_config, ListenerOptions, VERSION};
+use pg_doorman::config_watch::watch_config_files;
 use pg_doorman::core_affinity;
 use pg_doorman::daemon;
+use pg_doorman::audit::run_audit_log;
+use pg_doorman::events::{emit_event, run_event_sink, Event};
 use pg_doorman::format_duration;
+use pg_doorman::format_host_port;
+use pg_doorman::fd_limit::{is_fd_exhausted, record_fd_exhaustion, AcceptBackoff};
 use pg_doorman::generate::generate_config;
+use pg_doorman::handoff::{inherited_listener, share_listener, LISTEN_FD_ENV};
+use pg_doorman::health_check::watch_backend_health;
+use pg_doorman::health_endpoint::{set_listening, set_shutting_down, start_health_server};
+use pg_doorman::listener::{accept_client, listen_socket};
+use pg_doorman::log_rules::{expire_log_rules, with_log_context};
+use pg_doorman::login_limit::allow_login;
 use pg_doorman::messages::configure_tcp_socket;
-use pg_doorman::pool::{retain_connections, ClientServerMap, ConnectionPool};
-use pg_doorman::prometheus_exporter::start_prometheus_server;
+use pg_doorman::pool::{maintain_min_connections, retain_connections, warm_up_pools, ClientServerMap, ConnectionPool};
+use pg_doorman::prometheus_exporter::{handle_main_port_http_request, is_http_connection, start_prometheus_server};
+use pg_doorman::proxy_protocol::read_proxy_header;
 use pg_doorman::rate_limit::RateLimiter;
+use pg_doorman::replica_status::watch_replica_status;
+use pg_doorman::sd_notify::{run_sd_notify, sd_notify_ready, sd_notify_stopping};
+use pg_doorman::selftest::{run_config_check, run_selftest};
+use pg_doorman::statement_allowlist::run_statement_allowlist_writer;
+use pg_doorman::statsd_exporter::start_statsd_exporter;
+use pg_doorman::stats::history::collect_stats_history;
+use pg_doorman::stats::prepared_transactions::watch_prepared_transactions;
 use pg_doorman::stats::{Collector, Reporter, REPORTER, TOTAL_CONNECTION_COUNTER};
-use pg_doorman::tls::build_acceptor;
+use pg_doorman::tls::{monitor_certificate_expiry, reload_tls_acceptor, tls_acceptor, watch_tls_certificates};
 use pg_doorman::{cmd_args, logger};
 
 pub static CURRENT_CLIENT_COUNT: Lazy<Arc<AtomicI64>> = Lazy::new(|| Arc::new(AtomicI64::new(0)));
@@ -68,6 +90,23 @@ pub static CURRENT_CLIENT_COUNT: Lazy<Arc<AtomicI64>> = Lazy::new(|| Arc::new(At
 fn main() -> Result<(), Box<dyn std::error::Error>> {
     let cli = cmd_args::parse();
 
+    if cli.check_config {
+        let runtime = Builder::new_multi_thread().enable_all().build()?;
+        let passed = runtime.block_on(async {
+            if let Err(err) = pg_doorman::config::parse(cli.config_file.as_str()).await {
+                eprintln!("{}: {err}", cli.config_file);
+                return false;
+            }
+            let report = run_config_check(&get_config()).await;
+            println!("{report}");
+            report.is_ok()
+        });
+        if !passed {
+            std::process::exit(exitcode::CONFIG);
+        }
+        return Ok(());
+    }
+
     match &cli.command {
         Some(Commands::Generate { config }) => {
             let pg_doorman_config = generate_config(config)?;
@@ -80,6 +119,29 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
             }
             return Ok(());
         }
+        Some(Commands::Selftest) => {
+            let runtime = Builder::new_multi_thread().enable_all().build()?;
+            let passed = runtime.block_on(async {
+                if let Err(err) = pg_doorman::config::parse(cli.config_file.as_str()).await {
+                    eprintln!("Config parse error: {err}");
+                    std::process::exit(exitcode::CONFIG);
+                }
+                let report = run_selftest(&get_config()).await;
+                println!("{report}");
+                report.is_ok()
+            });
+            if !passed {
+                std::process::exit(exitcode::UNAVAILABLE);
+            }
+            return Ok(());
+        }
+        Some(Commands::Analyze { idle_in_transaction_ms, .. }) => {
+            if cli.daemon {
+                eprintln!("analyze writes its report when it finishes, run it without --daemon");
+                std::process::exit(exitcode::USAGE);
+            }
+            start_analyze(Duration::from_millis(*idle_in_transaction_ms));
+        }
         None => (),
     }
 
@@ -91,7 +153,7 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
 
     // Create a transient runtime for loading the config for the first time.
     {
-        let runtime = Builder::new_multi_thread().worker_threads(1).build()?;
+        let runtime = Builder::new_multi_thread().worker_threads(1).enable_all().build()?;
 
         runtime.block_on(async {
             match pg_doorman::config::parse(cli.config_file.as_str()).await {
@@ -166,41 +228,15 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
     runtime.block_on(async move {
 
         // starting listener.
-        let addr = format!("{}:{}", config.general.host, config.general.port).to_socket_addrs().
+        let addr = (config.general.host.as_str(), config.general.port).to_socket_addrs().
             unwrap().next().unwrap();
-        let listen_socket = if addr.is_ipv4() {
-            TcpSocket::new_v4().unwrap()
-        } else {
-            TcpSocket::new_v6().unwrap()
-        };
-        listen_socket.set_reuseaddr(true).expect("can't set reuseaddr");
-        listen_socket.set_reuseport(true).expect("can't set reuseport");
-        listen_socket.set_nodelay(true).expect("can't set nodelay");
-        listen_socket.set_linger(Some(Duration::from_secs(0))).expect("can't set linger 0");
-        // IPTOS_LOWDELAY: u8 = 0x10;
-        if addr.is_ipv4() {
-            match listen_socket.set_tos(0x10) {
-                Ok(_) => (),
-                Err(err) => {
-                    warn!("Can't set IPTOS_LOWDELAY: {err:?}");
-                }
-            };
-        };
-        listen_socket.bind(addr).expect("can't bind");
+        // On binary upgrade the socket of the previous process is taken over.
+        let inherited_listener = inherited_listener(addr);
+        let listen_socket = listen_socket(addr, config.general.ipv6_only);
+        if inherited_listener.is_none() {
+            listen_socket.bind(addr).expect("can't bind");
+        }
         // end configure listener.
-        let backlog = if config.general.backlog > 0 {
-            config.general.backlog
-        } else {
-            config.general.max_connections as u32
-        };
-        let listener = match listen_socket.listen(backlog) {
-            Ok(sock) => sock,
-            Err(err) => {
-                error!("Listener socket error: {err:?}");
-                std::process::exit(exitcode::CONFIG);
-            }
-        };
-        info!("Running on {addr}");
 
         config.show();
 
@@ -219,6 +255,56 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
             }
         };
 
+        // Don't let clients (and load balancer health checks) in until the pools are warm.
+        if config.general.pools_ready_timeout > 0 {
+            info!("Waiting for min_pool_size server connections before accepting clients");
+            let not_ready = warm_up_pools(Duration::from_millis(config.general.pools_ready_timeout)).await;
+            if not_ready.is_empty() {
+                info!("All pools are ready");
+            } else {
+                warn!("Pools not ready after {}ms, accepting clients anyway: {}", config.general.pools_ready_timeout, not_ready.join(", "));
+            }
+        }
+
+        let backlog = if config.general.backlog > 0 {
+            config.general.backlog
+        } else {
+            config.general.max_connections as u32
+        };
+        let listener = match inherited_listener {
+            Some(listener) => tokio::net::TcpListener::from_std(listener),
+            None => listen_socket.listen(backlog),
+        };
+        let listener = match listener {
+            Ok(sock) => sock,
+            Err(err) => {
+                error!("Listener socket error: {err:?}");
+                std::process::exit(exitcode::CONFIG);
+            }
+        };
+        info!("Running on {addr} ({})", if addr.is_ipv4() {
+            "ipv4"
+        } else if config.general.ipv6_only {
+            "ipv6 only"
+        } else {
+            "dual-stack"
+        });
+        let mut listeners = vec![(listener, ListenerOptions::default())];
+        for extra_listener in &config.general.listeners {
+            let addr = (extra_listener.host.as_str(), extra_listener.port).to_socket_addrs().
+                unwrap().next().unwrap();
+            let socket = listen_socket(addr, config.general.ipv6_only);
+            let listener = match socket.bind(addr).and_then(|()| socket.listen(backlog)) {
+                Ok(sock) => sock,
+                Err(err) => {
+                    error!("Listener socket {addr} error: {err:?}");
+                    std::process::exit(exitcode::CONFIG);
+                }
+            };
+            info!("Running on {addr} too ({:?})", extra_listener.options());
+            listeners.push((listener, extra_listener.options()));
+        }
+
         tokio::task::spawn(async move {
             let mut stats_collector = Collector::default();
             stats_collector.collect().await;
@@ -228,10 +314,96 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
             retain_connections().await;
         });
 
+        tokio::task::spawn(async move {
+            maintain_min_connections().await;
+        });
+
+        tokio::task::spawn(async move {
+            monitor_certificate_expiry().await;
+        });
+
+        tokio::task::spawn(async move {
+            watch_tls_certificates().await;
+        });
+
+        tokio::task::spawn(async move {
+            refresh_jwks().await;
+        });
+
+        tokio::task::spawn(async move {
+            collect_stats_history().await;
+        });
+
+        tokio::task::spawn(async move {
+            watch_prepared_transactions().await;
+        });
+
+        tokio::task::spawn(async move {
+            expire_log_rules().await;
+        });
+
+        tokio::task::spawn(async move {
+            run_event_sink().await;
+        });
+
+        tokio::task::spawn(async move {
+            run_audit_log().await;
+        });
+
+        tokio::task::spawn(async move {
+            run_statement_allowlist_writer().await;
+        });
+
+        tokio::task::spawn(async move {
+            watch_backend_load().await;
+        });
+
+        let health_check_map = client_server_map.clone();
+        tokio::task::spawn(async move {
+            watch_backend_health(health_check_map).await;
+        });
+
+        tokio::task::spawn(async move {
+            watch_replica_status().await;
+        });
+
+        let config_watch_map = client_server_map.clone();
+        tokio::task::spawn(async move {
+            watch_config_files(config_watch_map).await;
+        });
+
+        if !config.cluster.is_empty() {
+            let client_server_map = client_server_map.clone();
+            tokio::task::spawn(async move {
+                watch_cluster_config(client_server_map).await;
+            });
+        }
+
+        if let Some(Commands::Analyze { duration, output, .. }) = &cli.command {
+            let (duration, output) = (Duration::from_secs(*duration), output.clone());
+            tokio::task::spawn(async move {
+                run_analyze(duration, output).await;
+            });
+        }
+
+        // StatsD metrics exporter
+        if config.statsd.enabled {
+            tokio::task::spawn(async move {
+                start_statsd_exporter().await;
+            });
+        }
+
+        // Liveness and readiness endpoints
+        if let Some(addr) = config.general.health_listen.as_ref().and_then(|addr| addr.parse().ok()) {
+            tokio::task::spawn(async move {
+                start_health_server(addr).await;
+            });
+        }
+
         // Prometheus metrics exporter
         if config.prometheus.enabled {
             tokio::task::spawn(async move {
-                start_prometheus_server(format!("{}:{}", config.prometheus.host, config.prometheus.port).as_str()).await;
+                start_prometheus_server(format_host_port(&config.prometheus.host, config.prometheus.port).as_str()).await;
             });
         }
 
@@ -252,6 +424,9 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
         let (exit_tx, mut exit_rx) = mpsc::channel::<()>(1);
         let mut admin_only = false;
         let mut total_clients = 0;
+        let mut accept_backoff = AcceptBackoff::default();
+        // accept() is paused until then after running out of file descriptors, the other branches go on.
+        let mut accept_paused_until: Option<tokio::time::Instant> = None;
 
         // It is not updated by 'HUP'.
         let tls_rate_limiter: Option<RateLimiter> = if config.general.tls_rate_limit_per_second > 0 {
@@ -262,23 +437,17 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
             None
         };
 
-        // It is not updated by 'HUP'.
-        let tls_acceptor: Option<tokio_native_tls::TlsAcceptor> = if config.general.tls_certificate.is_some() {
-            match build_acceptor(
-                Path::new(&config.general.tls_certificate.unwrap()),
-                Path::new(&config.general.tls_private_key.unwrap()),
-                config.general.tls_ca_cert,
-                config.general.tls_mode) {
-                Ok(acceptor) => Some(acceptor),
-                Err(err) => {
-                    error!("Failed to build TLS acceptor: {err}");
-                    std::process::exit(exitcode::CONFIG);
-                }
-            }
-        } else {
-            None
-        };
+        // Loaded again on 'HUP' and when the files change.
+        if let Err(err) = reload_tls_acceptor(&config.general) {
+            error!("Failed to build TLS acceptor: {err}");
+            std::process::exit(exitcode::CONFIG);
+        }
 
+        set_listening();
+        sd_notify_ready();
+        tokio::task::spawn(async move {
+            run_sd_notify().await;
+        });
         info!("Waiting for dear clients");
         loop {
             tokio::select! {
@@ -302,7 +471,18 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                         let exe_path = &full_exe_args[0];
                         let exe_args = full_exe_args.iter().skip(1);
                         core_affinity::clear_for_current();
-                        let mut child = process::Command::new(exe_path)
+                        // The new process takes over the socket with the connections queued on it.
+                        let mut command = process::Command::new(exe_path);
+                        let listen_fd = listeners[0].0.as_raw_fd();
+                        match share_listener(listen_fd) {
+                            Ok(()) => {
+                                command.env(LISTEN_FD_ENV, listen_fd.to_string());
+                            }
+                            Err(err) => warn!("Can't pass the listening socket to the new process: {err}"),
+                        }
+                        // The new process becomes the main one and answers the systemd watchdog.
+                        command.env_remove("WATCHDOG_PID");
+                        let mut child = command
                             .args(exe_args)
                             .stderr(process::Stdio::null())
                             .stdout(process::Stdio::null())
@@ -311,7 +491,11 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                             .spawn().unwrap();
                         child.wait().unwrap();
                         tokio::time::sleep(tokio::time::Duration::from_secs(1)).await;
-                        unsafe { libc::close(listener.as_raw_fd()); }
+                        for (listener, _) in &listeners {
+                            unsafe { libc::close(listener.as_raw_fd()); }
+                        }
+                    } else if !admin_only {
+                        sd_notify_stopping();
                     }
 
                     // Don't want this to happen more than once
@@ -320,6 +504,7 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                     }
 
                     admin_only = true;
+                    set_shutting_down();
 
                     // Broadcast that client tasks need to finish
                     let _ = shutdown_tx.send(());
@@ -346,25 +531,58 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
 
                 _ = term_signal.recv() => {
                     info!("Got SIGTERM, closing with {total_clients} clients active");
+                    sd_notify_stopping();
                     break;
                 },
 
+                // The accept() pause is over.
+                _ = tokio::time::sleep_until(accept_paused_until.unwrap_or_else(tokio::time::Instant::now)), if accept_paused_until.is_some() => {
+                    accept_paused_until = None;
+                },
+
                 // new client.
-                new_client = listener.accept() => {
+                (new_client, listener_options) = accept_client(&listeners), if accept_paused_until.is_none() => {
                     let (mut socket, addr) = match new_client {
-                        Ok((socket, addr)) => (socket, addr),
+                        Ok((socket, addr)) => {
+                            accept_backoff.reset();
+                            (socket, addr)
+                        }
+                        Err(err) if is_fd_exhausted(&err) => {
+                            // Don't spin on the listener, let existing connections use the descriptors that get freed.
+                            record_fd_exhaustion("accept", &err);
+                            accept_paused_until = Some(tokio::time::Instant::now() + accept_backoff.next_delay());
+                            continue;
+                        }
                         Err(err) => {
                             error!("accept error: {err:?}");
                             continue;
                         }
                     };
                     if admin_only {
+                        if get_config().general.http_on_main_port {
+                            // Health checks get a 503 instead of a dropped connection.
+                            tokio::task::spawn(async move {
+                                if is_http_connection(&socket).await {
+                                    handle_main_port_http_request(socket).await;
+                                } else {
+                                    error!("Accepting new client {addr} after shutdown");
+                                    let _ = socket.shutdown().await;
+                                }
+                            });
+                            continue;
+                        }
                         error!("Accepting new client {addr} after shutdown");
                         let _ = socket.shutdown().await;
                         continue;
                     }
+                    // Behind a balancer the address of the client is known after its PROXY header.
+                    if !listener_options.proxy_protocol && pg_doorman::quarantine::is_quarantined(addr.ip()) {
+                        warn!("Client {addr}: address is blocked after protocol violations");
+                        let _ = socket.shutdown().await;
+                        continue;
+                    }
                     let tls_rate_limiter = tls_rate_limiter.clone();
-                    let tls_acceptor = tls_acceptor.clone();
+                    let tls_acceptor = tls_acceptor();
                     let shutdown_rx = shutdown_tx.subscribe();
                     let drain_tx = drain_tx.clone();
                     let client_server_map = client_server_map.clone();
@@ -372,16 +590,50 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
 
                     let log_client_disconnections = config.general.log_client_connections;
                     let max_connections = config.general.max_connections;
+                    let login_rate_limit = config.general.login_rate_limit;
+                    let login_rate_limit_per_ip = config.general.login_rate_limit_per_ip;
+                    if !listener_options.proxy_protocol && !allow_login(addr.ip(), login_rate_limit, login_rate_limit_per_ip) {
+                        debug!("Client {addr}: over the login rate limit");
+                        let _ = socket.shutdown().await;
+                        continue;
+                    }
+                    let http_on_main_port = config.general.http_on_main_port;
 
                     configure_tcp_socket(&socket);
                     tokio::task::spawn(async move {
+                        let addr = if listener_options.proxy_protocol {
+                            let addr = match read_proxy_header(&mut socket).await {
+                                Ok(client_addr) => client_addr.unwrap_or(addr),
+                                Err(err) => {
+                                    warn!("Client {addr}: {err}");
+                                    return;
+                                }
+                            };
+                            if pg_doorman::quarantine::is_quarantined(addr.ip()) {
+                                warn!("Client {addr}: address is blocked after protocol violations");
+                                let _ = socket.shutdown().await;
+                                return;
+                            }
+                            if !allow_login(addr.ip(), login_rate_limit, login_rate_limit_per_ip) {
+                                debug!("Client {addr}: over the login rate limit");
+                                let _ = socket.shutdown().await;
+                                return;
+                            }
+                            addr
+                        } else {
+                            addr
+                        };
+                        if http_on_main_port && is_http_connection(&socket).await {
+                            handle_main_port_http_request(socket).await;
+                            return;
+                        }
                         TOTAL_CONNECTION_COUNTER.fetch_add(1, Ordering::Relaxed);
                         let current_clients = CURRENT_CLIENT_COUNT.fetch_add(1, Ordering::SeqCst);
-                        // max clients.
-                        if current_clients as u64 > max_connections {
+                        // max clients, cancel requests being handled don't take their slots.
+                        if (current_clients as u64).saturating_sub(cancel_handlers_count() as u64) > max_connections {
                             warn!("Client {addr:?}: too many clients already");
                            match pg_doorman::client::client_entrypoint_too_many_clients_already(
-                                socket, client_server_map, shutdown_rx, drain_tx).await {
+                                socket, addr, client_server_map, shutdown_rx, drain_tx).await {
                                 Ok(()) => (),
                                 Err(err) => {
                                     error!("Client {addr:?}: disconnected with error: {err}");
@@ -392,15 +644,17 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                         }
                         let start = chrono::offset::Utc::now().naive_utc();
 
-                        match pg_doorman::client::client_entrypoint(
+                        match with_log_context(pg_doorman::client::client_entrypoint(
                             socket,
+                            addr,
                             client_server_map,
                             shutdown_rx,
                             drain_tx,
                             admin_only,
+                            listener_options,
                             tls_acceptor,
                             tls_rate_limiter,
-                        )
+                        ))
                         .await
                         {
                             Ok(()) => {
@@ -424,6 +678,8 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                             Err(err) => {
                                 let duration = chrono::offset::Utc::now().naive_utc() - start;
                                 warn!("Client {:?} disconnected with error {:?}, duration: {}", addr, err, format_duration(&duration));
+                                emit_event(|| Event::Error { client: Some(addr.to_string()), error: err.to_string() });
+                                pg_doorman::quarantine::record_protocol_violation(addr.ip(), &err);
                             }
                         };
                         CURRENT_CLIENT_COUNT.fetch_add(-1, Ordering::SeqCst);
@@ -0,0 +1,44 @@
+// Detection of session-level advisory lock calls in client messages.
+//
+// Session-level advisory locks survive the end of the transaction and belong to
+// the backend, so a server returned to the pool while holding them would hand
+// them over to the next client.
+
+// Standard library imports
+use std::mem;
+
+/// Functions taking a session-level lock. Transaction-level locks
+/// (pg_advisory_xact_lock and friends) are released by the server itself.
+const ACQUIRE: [&[u8]; 4] = [
+    b"pg_advisory_lock(",
+    b"pg_advisory_lock_shared(",
+    b"pg_try_advisory_lock(",
+    b"pg_try_advisory_lock_shared(",
+];
+
+/// Whether a Query ('Q') or Parse ('P') message calls a function taking a
+/// session-level advisory lock. The locks actually held can't be told from the
+/// messages (a statement may run many times or lock once per row), so a server
+/// that got one may hold locks until they are all released by the pooler.
+pub fn acquires_advisory_lock(message: &[u8]) -> bool {
+    let header = mem::size_of::<u8>() + mem::size_of::<i32>();
+    if message.len() < header {
+        return false;
+    }
+
+    match message[0] as char {
+        'Q' | 'P' => {
+            let body = &message[header..];
+            ACQUIRE
+                .iter()
+                .any(|needle| contains_ignore_ascii_case(body, needle))
+        }
+        _ => false,
+    }
+}
+
+fn contains_ignore_ascii_case(haystack: &[u8], needle: &[u8]) -> bool {
+    haystack
+        .windows(needle.len())
+        .any(|window| window.eq_ignore_ascii_case(needle))
+}
@@ -0,0 +1,83 @@
+// Detection of client_encoding changes in client messages.
+//
+// Pools with a fixed client_encoding share their server connections between
+// clients relying on that encoding, so a client switching the encoding of the
+// session with SET client_encoding, SET NAMES or set_config() would hand the
+// next client a server sending text in another encoding.
+
+// Internal crate imports
+use super::fingerprint::statement_text;
+use super::role_change::skip_comments;
+
+/// The value of a setting: without quotes and DEFAULT as None.
+fn setting_value(value: &str) -> Option<String> {
+    let value = value.trim().trim_matches(|c| c == '\'' || c == '"').trim();
+    if value.is_empty() || value == "default" {
+        return None;
+    }
+    Some(value.to_string())
+}
+
+/// Encoding set by SET [SESSION] client_encoding or SET NAMES, for the rest of the session.
+/// SET LOCAL only lasts until the end of the transaction.
+fn set_client_encoding(statement: &str) -> Option<String> {
+    let statement = skip_comments(statement).to_ascii_lowercase();
+    let rest = statement.strip_prefix("set")?;
+    if !rest.starts_with(char::is_whitespace) {
+        return None;
+    }
+    let mut rest = rest.trim_start();
+    if let Some(after) = rest.strip_prefix("session") {
+        if after.starts_with(char::is_whitespace) {
+            rest = after.trim_start();
+        }
+    }
+    if let Some(after) = rest.strip_prefix("client_encoding") {
+        let after = after.trim_start();
+        let value = after.strip_prefix('=').or_else(|| {
+            after
+                .strip_prefix("to")
+                .filter(|value| value.starts_with(|c: char| c.is_whitespace() || c == '\''))
+        })?;
+        return setting_value(value);
+    }
+    let value = rest.strip_prefix("names")?;
+    if !value.starts_with(|c: char| c.is_whitespace() || c == '\'') {
+        return None;
+    }
+    setting_value(value)
+}
+
+/// Encodings set with set_config('client_encoding', value, false). A value that
+/// isn't a literal is returned as is.
+fn set_config_client_encodings(query: &str) -> Vec<String> {
+    let compact: String = query.to_ascii_lowercase().split_whitespace().collect();
+    compact
+        .match_indices("set_config('client_encoding',")
+        .filter_map(|(start, call)| {
+            let args = &compact[start + call.len()..];
+            let mut args = args.splitn(2, [',', ')']);
+            let value = args.next()?;
+            let is_local = args.next().is_some_and(|rest| rest.starts_with("true"));
+            if is_local {
+                return None;
+            }
+            setting_value(value)
+        })
+        .collect()
+}
+
+/// Encodings a Query ('Q') or Parse ('P') message switches the session to: SET
+/// client_encoding, SET NAMES or set_config() of client_encoding. Changes made by
+/// functions or DO blocks are not seen.
+pub fn client_encoding_changes(message: &[u8]) -> Vec<String> {
+    let query = match statement_text(message) {
+        Some(query) => query,
+        None => return Vec::new(),
+    };
+    let mut encodings: Vec<String> = query.split(';').filter_map(set_client_encoding).collect();
+    if query.to_ascii_lowercase().contains("set_config") {
+        encodings.extend(set_config_client_encodings(query));
+    }
+    encodings
+}
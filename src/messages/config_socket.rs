@@ -43,13 +43,25 @@ pub fn configure_tcp_socket(stream: &TcpStream) {
         Err(err) => error!("Could not configure no delay for socket: {err}"),
     }
 
+    configure_tcp_keepalive(
+        stream,
+        conf.general.tcp_keepalives_idle,
+        conf.general.tcp_keepalives_count,
+        conf.general.tcp_keepalives_interval,
+    );
+}
+
+/// Enable TCP keepalive with the given idle time (seconds), probe count and interval (seconds).
+pub fn configure_tcp_keepalive(stream: &TcpStream, idle: u64, count: u32, interval: u64) {
+    let sock_ref = SockRef::from(stream);
+
     match sock_ref.set_keepalive(true) {
         Ok(_) => {
             match sock_ref.set_tcp_keepalive(
                 &TcpKeepalive::new()
-                    .with_interval(Duration::from_secs(conf.general.tcp_keepalives_interval))
-                    .with_retries(conf.general.tcp_keepalives_count)
-                    .with_time(Duration::from_secs(conf.general.tcp_keepalives_idle)),
+                    .with_interval(Duration::from_secs(interval))
+                    .with_retries(count)
+                    .with_time(Duration::from_secs(idle)),
             ) {
                 Ok(_) => (),
                 Err(err) => error!("Could not configure tcp_keepalive for socket: {err}"),
@@ -8,6 +8,7 @@ use std::sync::Arc;
 
 // External crate imports
 use bytes::{Buf, BufMut, BytesMut};
+use sha2::{Digest, Sha256};
 
 // Internal crate imports
 use crate::client::PREPARED_STATEMENT_COUNTER;
@@ -181,6 +182,10 @@ impl Parse {
     pub fn anonymous(&self) -> bool {
         self.name.is_empty()
     }
+
+    pub fn query(&self) -> &str {
+        &self.query
+    }
 }
 
 /// Bind (B) message.
@@ -302,6 +307,14 @@ impl TryFrom<Bind> for BytesMut {
 }
 
 impl Bind {
+    /// Gets the name of the portal from the buffer, empty for the unnamed portal
+    pub fn get_portal(buf: &BytesMut) -> Result<String, Error> {
+        let mut cursor = std::io::Cursor::new(buf);
+        // Skip the code and length
+        cursor.advance(mem::size_of::<u8>() + mem::size_of::<i32>());
+        cursor.read_string()
+    }
+
     /// Gets the name of the prepared statement from the buffer
     pub fn get_name(buf: &BytesMut) -> Result<String, Error> {
         let mut cursor = std::io::Cursor::new(buf);
@@ -343,6 +356,32 @@ impl Bind {
     pub fn anonymous(&self) -> bool {
         self.prepared_statement.is_empty()
     }
+
+    /// The formats and values of the parameters and the result formats of a Bind
+    /// of the unnamed portal, None for a named portal.
+    pub fn unnamed_portal_parameters(buf: &[u8]) -> Option<&[u8]> {
+        let header = mem::size_of::<u8>() + mem::size_of::<i32>();
+        if *buf.get(header)? != 0 {
+            return None;
+        }
+        let statement = &buf[header + 1..];
+        let end = statement.iter().position(|byte| *byte == 0)?;
+        Some(&statement[end + 1..])
+    }
+
+    /// Hash of the parameter values, tells whether two executions had the same
+    /// parameters without keeping them.
+    pub fn parameters_hash(&self) -> String {
+        let mut hasher = Sha256::new();
+        for (param_len, param) in &self.param_values {
+            hasher.update(param_len.to_be_bytes());
+            hasher.update(param);
+        }
+        hasher.finalize()[..8]
+            .iter()
+            .map(|byte| format!("{byte:02x}"))
+            .collect()
+    }
 }
 
 #[derive(Debug, Clone)]
@@ -476,6 +515,10 @@ impl Close {
         self.close_type == 'S'
     }
 
+    pub fn is_portal(&self) -> bool {
+        self.close_type == 'P'
+    }
+
     pub fn anonymous(&self) -> bool {
         self.name.is_empty()
     }
@@ -0,0 +1,192 @@
+// Fingerprints of the statements in client messages.
+//
+// Statements that differ only in their constants, parameters, letter case,
+// whitespace and comments get the same fingerprint, so a statement allowlist
+// recorded from an application matches the statements it runs later.
+
+// Standard library imports
+use std::mem;
+
+// External crate imports
+use sha2::{Digest, Sha256};
+
+/// Statement text of a Query ('Q') or Parse ('P') message.
+pub fn statement_text(message: &[u8]) -> Option<&str> {
+    let header = mem::size_of::<u8>() + mem::size_of::<i32>();
+    if message.len() <= header {
+        return None;
+    }
+
+    let body = &message[header..];
+    let query = match message[0] as char {
+        'Q' => body,
+        // Skip the statement name.
+        'P' => &body[body.iter().position(|byte| *byte == 0)? + 1..],
+        _ => return None,
+    };
+    let query = &query[..query.iter().position(|byte| *byte == 0)?];
+    std::str::from_utf8(query).ok()
+}
+
+fn is_word(c: char) -> bool {
+    c.is_alphanumeric() || c == '_' || c == '$'
+}
+
+fn is_operator(c: char) -> bool {
+    "+-*/<>=~!@#%^&|`?:".contains(c)
+}
+
+/// Statement with literals, numbers and parameters replaced by `?`, lists of them
+/// collapsed to one `?`, comments removed, keywords and identifiers lowercased and
+/// tokens separated by a single space.
+pub fn normalize_statement(query: &str) -> String {
+    let chars: Vec<char> = query.chars().collect();
+    let mut tokens: Vec<String> = Vec::new();
+    let mut i = 0;
+
+    // Push a constant, `?, ?` becomes `?`.
+    let push_constant = |tokens: &mut Vec<String>| {
+        let len = tokens.len();
+        if len >= 2 && tokens[len - 1] == "," && tokens[len - 2] == "?" {
+            tokens.pop();
+        } else {
+            tokens.push("?".to_string());
+        }
+    };
+
+    while i < chars.len() {
+        let c = chars[i];
+        if c.is_whitespace() {
+            i += 1;
+        } else if c == '-' && chars.get(i + 1) == Some(&'-') {
+            while i < chars.len() && chars[i] != '\n' {
+                i += 1;
+            }
+        } else if c == '/' && chars.get(i + 1) == Some(&'*') {
+            let mut depth = 0;
+            while i < chars.len() {
+                if chars[i] == '/' && chars.get(i + 1) == Some(&'*') {
+                    depth += 1;
+                    i += 2;
+                } else if chars[i] == '*' && chars.get(i + 1) == Some(&'/') {
+                    depth -= 1;
+                    i += 2;
+                    if depth == 0 {
+                        break;
+                    }
+                } else {
+                    i += 1;
+                }
+            }
+        } else if c == '\''
+            || (matches!(c, 'e' | 'E' | 'b' | 'B' | 'x' | 'X' | 'n' | 'N')
+                && chars.get(i + 1) == Some(&'\''))
+        {
+            // String literal, doubled quotes and backslash escapes don't end it.
+            let escapes = c != '\'';
+            i += if c == '\'' { 1 } else { 2 };
+            while i < chars.len() {
+                if escapes && chars[i] == '\\' {
+                    i += 2;
+                } else if chars[i] == '\'' {
+                    if chars.get(i + 1) == Some(&'\'') {
+                        i += 2;
+                    } else {
+                        i += 1;
+                        break;
+                    }
+                } else {
+                    i += 1;
+                }
+            }
+            push_constant(&mut tokens);
+        } else if c == '"' {
+            // Quoted identifier, kept as written.
+            let start = i;
+            i += 1;
+            while i < chars.len() {
+                if chars[i] == '"' {
+                    if chars.get(i + 1) == Some(&'"') {
+                        i += 2;
+                    } else {
+                        i += 1;
+                        break;
+                    }
+                } else {
+                    i += 1;
+                }
+            }
+            tokens.push(chars[start..i].iter().collect());
+        } else if c == '$' {
+            let tag_end = chars[i + 1..]
+                .iter()
+                .position(|c| !(c.is_alphanumeric() || *c == '_'))
+                .map(|len| i + 1 + len);
+            if chars.get(i + 1).is_some_and(|c| c.is_ascii_digit()) {
+                // Parameter $1.
+                i += 1;
+                while i < chars.len() && chars[i].is_ascii_digit() {
+                    i += 1;
+                }
+                push_constant(&mut tokens);
+            } else if let Some(tag_end) = tag_end.filter(|end| chars[*end] == '$') {
+                // Dollar-quoted string $tag$...$tag$.
+                let tag: Vec<char> = chars[i..=tag_end].to_vec();
+                i = tag_end + 1;
+                while i < chars.len() && !chars[i..].starts_with(&tag) {
+                    i += 1;
+                }
+                i = (i + tag.len()).min(chars.len());
+                push_constant(&mut tokens);
+            } else {
+                tokens.push("$".to_string());
+                i += 1;
+            }
+        } else if c.is_ascii_digit()
+            || (c == '.' && chars.get(i + 1).is_some_and(|c| c.is_ascii_digit()))
+        {
+            while i < chars.len()
+                && (chars[i].is_ascii_alphanumeric()
+                    || chars[i] == '.'
+                    || chars[i] == '_'
+                    || (matches!(chars[i], '+' | '-') && matches!(chars[i - 1], 'e' | 'E')))
+            {
+                i += 1;
+            }
+            push_constant(&mut tokens);
+        } else if is_word(c) {
+            let start = i;
+            while i < chars.len() && is_word(chars[i]) {
+                i += 1;
+            }
+            tokens.push(chars[start..i].iter().collect::<String>().to_lowercase());
+        } else if is_operator(c) {
+            let start = i;
+            while i < chars.len()
+                && is_operator(chars[i])
+                && !(chars[i] == '-' && chars.get(i + 1) == Some(&'-'))
+                && !(chars[i] == '/' && chars.get(i + 1) == Some(&'*'))
+            {
+                i += 1;
+            }
+            tokens.push(chars[start..i].iter().collect());
+        } else {
+            tokens.push(c.to_string());
+            i += 1;
+        }
+    }
+
+    while tokens.last().is_some_and(|token| token == ";") {
+        tokens.pop();
+    }
+    tokens.join(" ")
+}
+
+/// Fingerprint of a normalized statement: the first 16 hex digits of its SHA-256.
+pub fn statement_fingerprint(normalized: &str) -> String {
+    let digest = Sha256::digest(normalized.as_bytes());
+    digest[..8]
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect()
+}
@@ -8,29 +8,41 @@ use std::sync::Arc;
 use once_cell::sync::Lazy;
 
 // Declare submodules
+pub mod advisory_lock;
+pub mod client_encoding;
 pub mod config_socket;
 pub mod error;
 pub mod extended;
+pub mod fingerprint;
 pub mod protocol;
+pub mod role_change;
+pub mod route;
 pub mod socket;
+pub mod two_phase;
 pub mod types;
 
 // Re-export public items
-pub use config_socket::{configure_tcp_socket, configure_unix_socket};
+pub use advisory_lock::acquires_advisory_lock;
+pub use client_encoding::client_encoding_changes;
+pub use config_socket::{configure_tcp_keepalive, configure_tcp_socket, configure_unix_socket};
 pub use error::{set_messages_right_place, PgErrorMsg};
 pub use extended::{close_complete, Bind, Close, Describe, ExtendedProtocolData, Parse};
 pub use protocol::{
-    check_query_response, command_complete, data_row, data_row_nullable, deallocate_response,
-    error_message, error_response, error_response_terminal, flush, md5_challenge,
-    md5_hash_password, md5_hash_second_pass, md5_password, md5_password_with_hash, notify,
-    parse_complete, parse_params, parse_startup, plain_password_challenge, read_password,
-    ready_for_query, scram_server_response, scram_start_challenge, server_parameter_message,
-    simple_query, ssl_request, startup, sync, wrong_password,
+    allowed_startup_parameters, check_query_response, command_complete, data_row,
+    data_row_nullable, deallocate_response, error_message, error_response, error_response_terminal,
+    flush, md5_challenge, md5_hash_password, md5_hash_second_pass, md5_password,
+    md5_password_with_hash, notice_message, notify, parse_complete, parse_data_rows, parse_params,
+    parse_startup, plain_password_challenge, read_password, ready_for_query, scram_server_response,
+    scram_start_challenge, server_parameter_message, simple_query, ssl_request, startup,
+    startup_options, startup_pool_hint, sync, wrong_password,
 };
+pub use role_change::role_change;
+pub use route::{query_route, routing_hint, Route, RoutingHint};
 pub use socket::{
     proxy_copy_data, proxy_copy_data_with_timeout, read_message, read_message_data,
     read_message_header, write_all, write_all_flush, write_all_half,
 };
+pub use two_phase::{two_phase_command, TwoPhaseCommand};
 pub use types::{vec_to_string, BytesMutReader, DataType};
 
 // Re-export constants
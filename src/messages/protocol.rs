@@ -1,13 +1,14 @@
 // Standard library imports
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use std::mem;
 // External crate imports
-use crate::constants::SCRAM_SHA_256;
+use crate::constants::{POOL_HINT_PARAMETER, SASL, SCRAM_SHA_256, SCRAM_SHA_256_PLUS};
 use bytes::{Buf, BufMut, BytesMut};
 use md5::{Digest, Md5};
 use tokio::io::{AsyncReadExt, AsyncWriteExt};
 // Internal crate imports
 use crate::errors::Error;
+use crate::messages::error::PgErrorMsg;
 use crate::messages::socket::{write_all, write_all_flush};
 use crate::messages::types::DataType;
 
@@ -57,16 +58,26 @@ where
 }
 
 /// Generate SCRAM-SHA-256 challenge.
-pub async fn scram_start_challenge<S>(stream: &mut S) -> Result<(), Error>
+/// SCRAM-SHA-256-PLUS is offered too if the connection supports channel binding.
+pub async fn scram_start_challenge<S>(stream: &mut S, channel_binding: bool) -> Result<(), Error>
 where
     S: tokio::io::AsyncWrite + std::marker::Unpin,
 {
+    let mechanisms: &[&str] = if channel_binding {
+        &[SCRAM_SHA_256_PLUS, SCRAM_SHA_256]
+    } else {
+        &[SCRAM_SHA_256]
+    };
+    let len: usize = mechanisms.iter().map(|mechanism| mechanism.len() + 1).sum();
+
     let mut res = BytesMut::new();
     res.put_u8(b'R');
-    res.put_i32(23);
-    res.put_i32(10); // SCRAM-SHA-256
-    res.put_slice(SCRAM_SHA_256.as_bytes());
-    res.put_u8(0);
+    res.put_i32(4 + 4 + len as i32 + 1);
+    res.put_i32(SASL);
+    for mechanism in mechanisms {
+        res.put_slice(mechanism.as_bytes());
+        res.put_u8(0);
+    }
     res.put_u8(0);
 
     match stream.write_all(&res).await {
@@ -152,12 +163,13 @@ pub fn simple_query(query: &str) -> BytesMut {
     bytes
 }
 
-/// Send startup message to the server.
+/// Send startup message to the server, for a logical replication connection if `replication`.
 pub async fn startup<S>(
     stream: &mut S,
     user: String,
     database: &str,
     application_name: String,
+    replication: bool,
 ) -> Result<(), Error>
 where
     S: tokio::io::AsyncWrite + std::marker::Unpin,
@@ -181,6 +193,10 @@ where
     bytes.put(&b"database\0"[..]);
     bytes.put_slice(database.as_bytes());
     bytes.put_u8(0);
+
+    if replication {
+        bytes.put(&b"replication\0database\0"[..]);
+    }
     bytes.put_u8(0); // Null terminator
 
     let len = bytes.len() as i32 + 4i32;
@@ -268,6 +284,88 @@ pub fn parse_startup(bytes: BytesMut) -> Result<HashMap<String, String>, Error>
     Ok(result)
 }
 
+/// Find the pool partition requested by the client: the `pool_hint` startup parameter,
+/// or `-c pool_hint=...` in `options` for drivers that can't send custom parameters (libpq).
+pub fn startup_pool_hint(parameters: &HashMap<String, String>) -> Option<String> {
+    if let Some(hint) = parameters.get(POOL_HINT_PARAMETER) {
+        return Some(hint.clone());
+    }
+    startup_options(parameters.get("options")?)
+        .into_iter()
+        .find(|(name, _)| name == POOL_HINT_PARAMETER)
+        .map(|(_, value)| value)
+}
+
+/// Settings in the `options` startup parameter: `-c name=value` or `--name=value`,
+/// separated by whitespace, with `\` escaping a space or a backslash in a value.
+pub fn startup_options(options: &str) -> Vec<(String, String)> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    let mut chars = options.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => word.extend(chars.next()),
+            c if c.is_ascii_whitespace() => {
+                if !word.is_empty() {
+                    words.push(mem::take(&mut word));
+                }
+            }
+            c => word.push(c),
+        }
+    }
+    if !word.is_empty() {
+        words.push(word);
+    }
+
+    let mut settings = Vec::new();
+    let mut words = words.into_iter();
+    while let Some(word) = words.next() {
+        let setting = match word.as_str() {
+            "-c" => match words.next() {
+                Some(setting) => setting,
+                None => break,
+            },
+            _ => match word.strip_prefix("-c").or_else(|| word.strip_prefix("--")) {
+                Some(setting) => setting.to_string(),
+                None => continue,
+            },
+        };
+        if let Some((name, value)) = setting.split_once('=') {
+            // The server takes dashes in the names for underscores.
+            settings.push((name.replace('-', "_"), value.to_string()));
+        }
+    }
+    settings
+}
+
+/// Startup parameters of the client that are in the `allowed` list, by lowercase name,
+/// sent as parameters or in `options`. They are set on the server after checkout.
+pub fn allowed_startup_parameters(
+    parameters: &HashMap<String, String>,
+    allowed: &[String],
+) -> BTreeMap<String, String> {
+    let is_allowed = |name: &str| {
+        allowed
+            .iter()
+            .any(|allowed| allowed.eq_ignore_ascii_case(name))
+    };
+    let mut result = BTreeMap::new();
+    if let Some(options) = parameters.get("options") {
+        for (name, value) in startup_options(options) {
+            if is_allowed(&name) {
+                result.insert(name.to_ascii_lowercase(), value);
+            }
+        }
+    }
+    // A parameter of its own wins over the same one in options, like on the server.
+    for (name, value) in parameters {
+        if is_allowed(name) {
+            result.insert(name.to_ascii_lowercase(), value.clone());
+        }
+    }
+    result
+}
+
 /// Create md5 password hash given a salt.
 pub fn md5_hash_password(user: &str, password: &str, salt: &[u8]) -> Vec<u8> {
     let mut md5 = Md5::new();
@@ -371,6 +469,34 @@ pub fn error_message(message: &str, code: &str) -> BytesMut {
     res
 }
 
+/// Create a notice response message.
+pub fn notice_message(message: &str) -> BytesMut {
+    let mut notice = BytesMut::new();
+    // Notice level
+    notice.put_u8(b'S');
+    notice.put_slice(&b"NOTICE\0"[..]);
+    // Notice level (non-translatable)
+    notice.put_u8(b'V');
+    notice.put_slice(&b"NOTICE\0"[..]);
+
+    // Notice code: successful completion.
+    notice.put_u8(b'C');
+    notice.put_slice(&b"00000\0"[..]);
+
+    // The notice message.
+    notice.put_u8(b'M');
+    notice.put_slice(format!("{message}\0").as_bytes());
+
+    // No more fields follow.
+    notice.put_u8(0);
+
+    let mut res = BytesMut::with_capacity(notice.len() + 5);
+    res.put_u8(b'N');
+    res.put_i32(notice.len() as i32 + 4);
+    res.put(notice);
+    res
+}
+
 pub async fn error_response_terminal<S>(
     stream: &mut S,
     message: &str,
@@ -516,6 +642,63 @@ pub fn data_row_nullable(row: &Vec<Option<String>>) -> BytesMut {
     res
 }
 
+/// Rows of the DataRow messages in a server response, as text (NULL is None).
+/// An ErrorResponse in the response is returned as an error.
+pub fn parse_data_rows(response: &[u8]) -> Result<Vec<Vec<Option<String>>>, Error> {
+    let truncated = || Error::ServerMessageParserError("truncated message".to_string());
+    let mut response = response;
+    let mut rows = Vec::new();
+
+    while response.has_remaining() {
+        if response.remaining() < 5 {
+            return Err(truncated());
+        }
+        let code = response.get_u8();
+        let len = response.get_i32();
+        if len < 4 || response.remaining() < len as usize - 4 {
+            return Err(truncated());
+        }
+        let (mut message, rest) = response.split_at(len as usize - 4);
+        response = rest;
+
+        match code {
+            b'D' => {
+                if message.remaining() < 2 {
+                    return Err(truncated());
+                }
+                let columns = message.get_i16();
+                let mut row = Vec::with_capacity(columns.max(0) as usize);
+                for _ in 0..columns {
+                    if message.remaining() < 4 {
+                        return Err(truncated());
+                    }
+                    let value_len = message.get_i32();
+                    if value_len < 0 {
+                        row.push(None);
+                        continue;
+                    }
+                    if message.remaining() < value_len as usize {
+                        return Err(truncated());
+                    }
+                    let (value, rest) = message.split_at(value_len as usize);
+                    message = rest;
+                    row.push(Some(String::from_utf8_lossy(value).to_string()));
+                }
+                rows.push(row);
+            }
+            b'E' => {
+                return Err(match PgErrorMsg::parse(message) {
+                    Ok(err) => Error::QueryError(format!("{}: {}", err.code, err.message)),
+                    Err(_) => Error::QueryError("unknown error".to_string()),
+                });
+            }
+            _ => (),
+        }
+    }
+
+    Ok(rows)
+}
+
 /// Create a command complete message.
 pub fn command_complete(command: &str) -> BytesMut {
     let mut res = BytesMut::new();
@@ -0,0 +1,64 @@
+// Detection of role changes in client messages.
+//
+// SET ROLE and SET SESSION AUTHORIZATION switch the privileges of the backend
+// until they are reset, so a server returned to the pool after one of them
+// would run the queries of the next client as another role.
+
+// Internal crate imports
+use super::fingerprint::statement_text;
+
+/// Parameters switching the role when changed with set_config().
+const ROLE_PARAMETERS: [&str; 2] = ["set_config('role'", "set_config('session_authorization'"];
+
+/// Skip the whitespace and comments at the start of a statement.
+pub(super) fn skip_comments(mut statement: &str) -> &str {
+    loop {
+        statement = statement.trim_start();
+        if let Some(rest) = statement.strip_prefix("--") {
+            statement = rest.split_once('\n').map_or("", |(_, rest)| rest);
+        } else if let Some(rest) = statement.strip_prefix("/*") {
+            statement = rest.split_once("*/").map_or("", |(_, rest)| rest);
+        } else {
+            return statement;
+        }
+    }
+}
+
+/// The statement is SET [SESSION] ROLE or SET [SESSION] SESSION AUTHORIZATION.
+/// SET LOCAL only lasts until the end of the transaction.
+fn is_role_set(statement: &str) -> bool {
+    let words: Vec<String> = skip_comments(statement)
+        .split_whitespace()
+        .take(4)
+        .map(|word| word.to_ascii_lowercase())
+        .collect();
+    let words: Vec<&str> = words.iter().map(String::as_str).collect();
+    matches!(
+        words.as_slice(),
+        ["set", "role", ..]
+            | ["set", "session", "role", ..]
+            | ["set", "session", "authorization", ..]
+            | ["set", "session", "session", "authorization", ..]
+    )
+}
+
+/// A Query ('Q') or Parse ('P') message changes the role of the session: SET ROLE,
+/// SET SESSION AUTHORIZATION or set_config() of one of them. Role changes made by
+/// functions or DO blocks are not seen.
+pub fn role_change(message: &[u8]) -> bool {
+    let query = match statement_text(message) {
+        Some(query) => query,
+        None => return false,
+    };
+    if query.split(';').any(is_role_set) {
+        return true;
+    }
+    let lowercase = query.to_ascii_lowercase();
+    if !lowercase.contains("set_config") {
+        return false;
+    }
+    let compact: String = lowercase.split_whitespace().collect();
+    ROLE_PARAMETERS
+        .iter()
+        .any(|parameter| compact.contains(parameter))
+}
@@ -0,0 +1,112 @@
+// Routing of transactions between the primary and the replicas.
+//
+// In databases with replica_hosts the first statement of a transaction decides
+// where the whole transaction runs: read-only ones go to a replica, everything
+// else to the primary. A leading comment with a hint overrides the guess, e.g.
+// for a SELECT calling a function that writes, or sends the transaction to a
+// partition of the database: `/* doorman: replica */`, `/* doorman: shard=7 */`.
+
+// Internal crate imports
+use super::role_change::skip_comments;
+
+/// Starts a hint in a leading comment, `pg_doorman:` works too.
+const HINT_PREFIX: &str = "doorman:";
+
+/// Routing directive of a leading comment.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum RoutingHint {
+    Primary,
+    Replica,
+    /// A partition of the database, `shard=<name>` or `partition=<name>`.
+    Partition(String),
+}
+
+/// The first hint of the leading comments of the query, if any.
+pub fn routing_hint(query: &str) -> Option<RoutingHint> {
+    let statement = skip_comments(query);
+    let mut comments = &query[..query.len() - statement.len()];
+    while let Some(index) = comments.find(HINT_PREFIX) {
+        comments = &comments[index + HINT_PREFIX.len()..];
+        let directive: String = comments
+            .trim_start()
+            .chars()
+            .take_while(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '='))
+            .collect();
+        let hint = match directive.split_once('=') {
+            Some((key, name)) if !name.is_empty() => match key.to_ascii_lowercase().as_str() {
+                "shard" | "partition" => Some(RoutingHint::Partition(name.to_string())),
+                _ => None,
+            },
+            Some(_) => None,
+            None => match directive.to_ascii_lowercase().as_str() {
+                "primary" => Some(RoutingHint::Primary),
+                "replica" => Some(RoutingHint::Replica),
+                _ => None,
+            },
+        };
+        if hint.is_some() {
+            return hint;
+        }
+    }
+    None
+}
+
+/// Clauses turning a SELECT into a write or a lock.
+const WRITE_CLAUSES: [&str; 7] = [
+    " for update",
+    " for no key update",
+    " for share",
+    " for key share",
+    " into ",
+    "nextval(",
+    "setval(",
+];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Route {
+    Primary,
+    Replica,
+}
+
+/// The statement only reads: SELECT without locking or write clauses, VALUES,
+/// TABLE, SHOW, the start of a READ ONLY transaction or its end.
+fn read_only_statement(statement: &str) -> bool {
+    let statement: Vec<String> = skip_comments(statement)
+        .split_whitespace()
+        .map(|word| word.to_ascii_lowercase())
+        .collect();
+    let statement = format!(" {} ", statement.join(" "));
+    let command = statement
+        .trim_start()
+        .split(|c: char| !c.is_ascii_alphabetic())
+        .next()
+        .unwrap_or_default();
+    match command {
+        "select" | "values" | "table" => !WRITE_CLAUSES
+            .iter()
+            .any(|clause| statement.contains(clause)),
+        "show" => true,
+        "begin" | "start" => statement.contains(" read only"),
+        "commit" | "end" | "rollback" => true,
+        _ => false,
+    }
+}
+
+/// Where the transaction starting with the query runs. Statements of a query
+/// string all have to be read-only for a replica.
+pub fn query_route(query: &str) -> Route {
+    match routing_hint(query) {
+        Some(RoutingHint::Primary) => return Route::Primary,
+        Some(RoutingHint::Replica) => return Route::Replica,
+        _ => (),
+    }
+    let mut statements = query
+        .split(';')
+        .filter(|statement| !skip_comments(statement).is_empty())
+        .peekable();
+    if statements.peek().is_some() && statements.all(read_only_statement) {
+        Route::Replica
+    } else {
+        Route::Primary
+    }
+}
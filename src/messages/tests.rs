@@ -15,9 +15,13 @@ use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
 use crate::errors::Error;
 use crate::messages::protocol::row_description;
 use crate::messages::{
-    data_row, data_row_nullable, error_message, parse_startup, ready_for_query,
-    set_messages_right_place, DataType, PgErrorMsg,
+    acquires_advisory_lock, allowed_startup_parameters, client_encoding_changes, command_complete,
+    data_row, data_row_nullable, error_message, notice_message, parse_data_rows, parse_startup,
+    query_route, ready_for_query, role_change, routing_hint, set_messages_right_place,
+    simple_query, startup_options, startup_pool_hint, two_phase_command, DataType, PgErrorMsg,
+    Route, RoutingHint, TwoPhaseCommand,
 };
+use std::collections::HashMap;
 
 // Mock implementation for AsyncReadExt
 struct MockReader {
@@ -122,6 +126,71 @@ fn test_parse_startup_missing_user() {
     }
 }
 
+#[test]
+fn test_startup_pool_hint() {
+    let params = |pairs: &[(&str, &str)]| -> HashMap<String, String> {
+        pairs
+            .iter()
+            .map(|(key, value)| (key.to_string(), value.to_string()))
+            .collect()
+    };
+
+    assert_eq!(startup_pool_hint(&params(&[("user", "u")])), None);
+    assert_eq!(
+        startup_pool_hint(&params(&[("pool_hint", "batch")])),
+        Some("batch".to_string())
+    );
+    assert_eq!(
+        startup_pool_hint(&params(&[(
+            "options",
+            "-c statement_timeout=0 -c pool_hint=batch"
+        )])),
+        Some("batch".to_string())
+    );
+    assert_eq!(
+        startup_pool_hint(&params(&[("options", "-cpool_hint=batch")])),
+        Some("batch".to_string())
+    );
+    assert_eq!(
+        startup_pool_hint(&params(&[("options", "--pool_hint=batch")])),
+        Some("batch".to_string())
+    );
+    assert_eq!(
+        startup_pool_hint(&params(&[("options", "-c search_path=public")])),
+        None
+    );
+}
+
+#[test]
+fn test_startup_parameters() {
+    assert_eq!(
+        startup_options("-c search_path=app,\\ public  --statement-timeout=5s -x -c"),
+        vec![
+            ("search_path".to_string(), "app, public".to_string()),
+            ("statement_timeout".to_string(), "5s".to_string()),
+        ]
+    );
+
+    let parameters: HashMap<String, String> = [
+        ("user", "app"),
+        ("TimeZone", "Europe/Berlin"),
+        (
+            "options",
+            "-c search_path=app -c work_mem=1GB -c timezone=UTC",
+        ),
+    ]
+    .iter()
+    .map(|(key, value)| (key.to_string(), value.to_string()))
+    .collect();
+    let allowed = vec!["search_path".to_string(), "timezone".to_string()];
+    let result = allowed_startup_parameters(&parameters, &allowed);
+    assert_eq!(result.len(), 2);
+    assert_eq!(result["search_path"], "app");
+    // The parameter of its own wins over options.
+    assert_eq!(result["timezone"], "Europe/Berlin");
+    assert!(allowed_startup_parameters(&parameters, &[]).is_empty());
+}
+
 // Tests for error_message function
 #[test]
 fn test_error_message_detailed() {
@@ -143,6 +212,24 @@ fn test_error_message_detailed() {
     assert!(message_str.contains("FATAL"));
 }
 
+// Tests for notice_message function
+#[test]
+fn test_notice_message() {
+    let result = notice_message("queued behind 42 clients");
+
+    // Check message type is 'N' (NoticeResponse) and the length covers the body
+    assert_eq!(result[0], b'N');
+    assert_eq!(
+        i32::from_be_bytes([result[1], result[2], result[3], result[4]]) as usize,
+        result.len() - 1
+    );
+
+    let notice = PgErrorMsg::parse(&result[5..]).unwrap();
+    assert_eq!(notice.severity, "NOTICE");
+    assert_eq!(notice.code, "00000");
+    assert_eq!(notice.message, "queued behind 42 clients");
+}
+
 // Tests for row_description function with columns
 #[test]
 fn test_row_description_with_columns() {
@@ -402,3 +489,305 @@ fn test_pg_error_msg_parsing() {
         err_fields
     );
 }
+
+#[test]
+fn test_acquires_advisory_lock() {
+    assert!(acquires_advisory_lock(&simple_query(
+        "SELECT pg_advisory_lock(id) FROM jobs"
+    )));
+    assert!(acquires_advisory_lock(&simple_query(
+        "SELECT PG_TRY_ADVISORY_LOCK_SHARED(2)"
+    )));
+    assert!(!acquires_advisory_lock(&simple_query(
+        "SELECT pg_advisory_xact_lock(3)"
+    )));
+    assert!(!acquires_advisory_lock(&simple_query(
+        "SELECT pg_advisory_unlock(1), pg_advisory_unlock_all()"
+    )));
+    assert!(!acquires_advisory_lock(&simple_query("SELECT 1")));
+}
+
+#[test]
+fn test_role_change() {
+    assert!(role_change(&simple_query("SET ROLE reporting")));
+    assert!(role_change(&simple_query("set  session\trole 'reporting'")));
+    assert!(role_change(&simple_query(
+        "SELECT 1; /* switch */ SET SESSION AUTHORIZATION app_admin"
+    )));
+    assert!(role_change(&simple_query(
+        "-- impersonate\nSET SESSION SESSION AUTHORIZATION DEFAULT"
+    )));
+    assert!(role_change(&simple_query(
+        "SELECT set_config( 'role', 'reporting', false)"
+    )));
+    // Transaction-scoped and unrelated statements.
+    assert!(!role_change(&simple_query("SET LOCAL ROLE reporting")));
+    assert!(!role_change(&simple_query(
+        "UPDATE users SET role = 'admin'"
+    )));
+    assert!(!role_change(&simple_query(
+        "SELECT set_config('search_path', 'app', false)"
+    )));
+    assert!(!role_change(&simple_query("RESET ROLE")));
+}
+
+#[test]
+fn test_client_encoding_changes() {
+    assert_eq!(
+        client_encoding_changes(&simple_query("SET client_encoding TO 'LATIN1'")),
+        vec!["latin1"]
+    );
+    assert_eq!(
+        client_encoding_changes(&simple_query("set session client_encoding=utf8")),
+        vec!["utf8"]
+    );
+    assert_eq!(
+        client_encoding_changes(&simple_query("SELECT 1; /* legacy */ SET NAMES 'win1251'")),
+        vec!["win1251"]
+    );
+    assert_eq!(
+        client_encoding_changes(&simple_query(
+            "SELECT set_config( 'client_encoding', 'SQL_ASCII', false)"
+        )),
+        vec!["sql_ascii"]
+    );
+    // Transaction-scoped, reset to the default and unrelated statements.
+    assert!(
+        client_encoding_changes(&simple_query("SET LOCAL client_encoding TO 'LATIN1'")).is_empty()
+    );
+    assert!(client_encoding_changes(&simple_query("SET client_encoding TO DEFAULT")).is_empty());
+    assert!(client_encoding_changes(&simple_query(
+        "SELECT set_config('client_encoding', 'LATIN1', true)"
+    ))
+    .is_empty());
+    assert!(client_encoding_changes(&simple_query("SET search_path TO app")).is_empty());
+    assert!(client_encoding_changes(&simple_query("UPDATE t SET names = 'a'")).is_empty());
+}
+
+#[test]
+fn test_query_route() {
+    assert_eq!(
+        query_route("SELECT * FROM users WHERE id = 1"),
+        Route::Replica
+    );
+    assert_eq!(query_route("  show search_path;"), Route::Replica);
+    assert_eq!(
+        query_route("BEGIN READ ONLY; SELECT 1; COMMIT"),
+        Route::Replica
+    );
+    assert_eq!(
+        query_route("/* pg_doorman:replica */ BEGIN; SELECT 1"),
+        Route::Replica
+    );
+    // Writes, locks and transactions that may write.
+    assert_eq!(query_route("UPDATE users SET name = 'x'"), Route::Primary);
+    assert_eq!(
+        query_route("SELECT * FROM jobs FOR UPDATE SKIP LOCKED"),
+        Route::Primary
+    );
+    assert_eq!(query_route("select nextval('ids')"), Route::Primary);
+    assert_eq!(query_route("SELECT 1; DELETE FROM users"), Route::Primary);
+    assert_eq!(query_route("BEGIN"), Route::Primary);
+    assert_eq!(
+        query_route("-- pg_doorman:primary\nSELECT audit_access()"),
+        Route::Primary
+    );
+    assert_eq!(query_route(""), Route::Primary);
+}
+
+#[test]
+fn test_routing_hint() {
+    assert_eq!(
+        routing_hint("/* doorman: replica */ SELECT 1"),
+        Some(RoutingHint::Replica)
+    );
+    assert_eq!(
+        routing_hint("/* pg_doorman:primary */ SELECT create_order($1)"),
+        Some(RoutingHint::Primary)
+    );
+    assert_eq!(
+        routing_hint("/* doorman: shard=7 */ SELECT * FROM orders"),
+        Some(RoutingHint::Partition("7".to_string()))
+    );
+    assert_eq!(
+        routing_hint("-- app: billing\n/* doorman: partition=batch */ BEGIN"),
+        Some(RoutingHint::Partition("batch".to_string()))
+    );
+    // Only leading comments count.
+    assert_eq!(routing_hint("SELECT 1 /* doorman: replica */"), None);
+    assert_eq!(routing_hint("/* doorman: somewhere */ SELECT 1"), None);
+    assert_eq!(routing_hint("/* doorman: shard= */ SELECT 1"), None);
+    assert_eq!(
+        query_route("/* doorman: replica */ UPDATE users SET name = 'x'"),
+        Route::Replica
+    );
+}
+
+#[test]
+fn test_two_phase_command() {
+    assert_eq!(
+        two_phase_command(&simple_query("PREPARE TRANSACTION 'tx-1'")),
+        Some(TwoPhaseCommand::Prepare("tx-1".to_string()))
+    );
+    assert_eq!(
+        two_phase_command(&simple_query("  commit\n prepared 'it''s'")),
+        Some(TwoPhaseCommand::CommitPrepared("it's".to_string()))
+    );
+    assert_eq!(
+        two_phase_command(&simple_query("ROLLBACK PREPARED 'tx-1';")),
+        Some(TwoPhaseCommand::RollbackPrepared("tx-1".to_string()))
+    );
+    assert_eq!(
+        two_phase_command(&simple_query("PREPARE q AS SELECT 1")),
+        None
+    );
+    assert_eq!(two_phase_command(&simple_query("COMMIT")), None);
+    assert_eq!(
+        two_phase_command(&simple_query("SELECT 'PREPARE TRANSACTION'")),
+        None
+    );
+
+    let mut parse = BytesMut::new();
+    let query = b"PREPARE TRANSACTION 'tx-2'\0";
+    parse.put_u8(b'P');
+    parse.put_i32(4 + 1 + query.len() as i32 + 2);
+    parse.put_u8(0); // unnamed statement
+    parse.put_slice(query);
+    parse.put_i16(0);
+    assert_eq!(
+        two_phase_command(&parse),
+        Some(TwoPhaseCommand::Prepare("tx-2".to_string()))
+    );
+}
+
+#[test]
+fn test_parse_data_rows() {
+    let mut response = row_description(&vec![
+        ("usename", DataType::Text),
+        ("passwd", DataType::Text),
+    ]);
+    response.put(data_row_nullable(&vec![
+        Some("alice".to_string()),
+        Some("md5abc".to_string()),
+    ]));
+    response.put(data_row_nullable(&vec![Some("bob".to_string()), None]));
+    response.put(command_complete("SELECT 2"));
+    response.put(ready_for_query(false));
+
+    assert_eq!(
+        parse_data_rows(&response).unwrap(),
+        vec![
+            vec![Some("alice".to_string()), Some("md5abc".to_string())],
+            vec![Some("bob".to_string()), None],
+        ]
+    );
+
+    let error = error_message("permission denied for table pg_shadow", "42501");
+    assert!(matches!(
+        parse_data_rows(&error),
+        Err(Error::QueryError(message)) if message.contains("42501")
+    ));
+
+    assert!(parse_data_rows(&response[..response.len() - 3]).is_err());
+}
+
+#[test]
+fn test_normalize_statement() {
+    use crate::messages::fingerprint::{normalize_statement, statement_fingerprint};
+
+    assert_eq!(
+        normalize_statement("SELECT * FROM Orders WHERE id = 42 AND note = 'it''s';"),
+        "select * from orders where id = ? and note = ?"
+    );
+    assert_eq!(
+        normalize_statement("select *\n  from orders -- by id\n where id=$1"),
+        "select * from orders where id = ?"
+    );
+    assert_eq!(
+        normalize_statement(
+            "SELECT /* hint */ \"Name\" FROM t WHERE id IN (1, 2, 3) AND x > -1.5e-3"
+        ),
+        "select \"Name\" from t where id in ( ? ) and x > - ?"
+    );
+    assert_eq!(
+        normalize_statement("SELECT $$a 'b'$$, $tag$c$tag$, E'\\'', x::text"),
+        "select ? , x :: text"
+    );
+    assert_eq!(
+        statement_fingerprint(&normalize_statement("SELECT 1")),
+        statement_fingerprint(&normalize_statement("select 2"))
+    );
+    assert_ne!(
+        statement_fingerprint(&normalize_statement("SELECT 1")),
+        statement_fingerprint(&normalize_statement("DELETE FROM t"))
+    );
+    assert_eq!(statement_fingerprint("select ?").len(), 16);
+}
+
+#[test]
+fn test_statement_text() {
+    use crate::messages::fingerprint::statement_text;
+
+    let query = b"SELECT 1";
+    let mut parse = BytesMut::new();
+    parse.put_u8(b'P');
+    parse.put_i32(4 + 3 + query.len() as i32 + 1 + 2);
+    parse.put_slice(b"s1\0");
+    parse.put_slice(query);
+    parse.put_u8(0);
+    parse.put_i16(0);
+    assert_eq!(statement_text(&parse), Some("SELECT 1"));
+
+    let mut sync = BytesMut::new();
+    sync.put_u8(b'S');
+    sync.put_i32(4);
+    assert_eq!(statement_text(&sync), None);
+}
+
+#[test]
+fn test_bind_unnamed_portal_parameters() {
+    use crate::messages::Bind;
+
+    let parameters = [0, 0, 0, 1, 0, 0, 0, 1, b'7', 0, 0];
+    let mut bind = BytesMut::new();
+    bind.put_u8(b'B');
+    bind.put_i32(4 + 1 + 3 + parameters.len() as i32);
+    bind.put_u8(0);
+    bind.put_slice(b"s1\0");
+    bind.put_slice(&parameters);
+    assert_eq!(
+        Bind::unnamed_portal_parameters(&bind),
+        Some(&parameters[..])
+    );
+
+    bind[5] = b'p';
+    assert_eq!(Bind::unnamed_portal_parameters(&bind), None);
+}
+
+#[test]
+fn test_bind_named_portal() {
+    use crate::messages::{Bind, Close};
+
+    let mut bind = BytesMut::new();
+    bind.put_u8(b'B');
+    bind.put_i32(4 + 4 + 3 + 6);
+    bind.put_slice(b"C_1\0");
+    bind.put_slice(b"s1\0");
+    bind.put_slice(&[0; 6]);
+    assert_eq!(Bind::get_portal(&bind).unwrap(), "C_1");
+    assert_eq!(Bind::get_name(&bind).unwrap(), "s1");
+
+    let renamed = Bind::rename(bind, "DOORMAN_1").unwrap();
+    assert_eq!(Bind::get_portal(&renamed).unwrap(), "C_1");
+    assert_eq!(Bind::get_name(&renamed).unwrap(), "DOORMAN_1");
+
+    let mut close = BytesMut::new();
+    close.put_u8(b'C');
+    close.put_i32(4 + 1 + 4);
+    close.put_u8(b'P');
+    close.put_slice(b"C_1\0");
+    let close: Close = (&close).try_into().unwrap();
+    assert!(close.is_portal());
+    assert!(!close.is_prepared_statement());
+    assert_eq!(close.name, "C_1");
+}
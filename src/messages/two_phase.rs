@@ -0,0 +1,90 @@
+// Detection of two-phase commit commands in client messages.
+//
+// Prepared transactions hold locks and the xmin horizon until they are committed
+// or rolled back, so the pooler keeps track of the ones created through it.
+
+// Standard library imports
+use std::mem;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum TwoPhaseCommand {
+    /// PREPARE TRANSACTION 'gid'
+    Prepare(String),
+    /// COMMIT PREPARED 'gid'
+    CommitPrepared(String),
+    /// ROLLBACK PREPARED 'gid'
+    RollbackPrepared(String),
+}
+
+impl TwoPhaseCommand {
+    /// Transaction identifier given by the client.
+    pub fn gid(&self) -> &str {
+        match self {
+            TwoPhaseCommand::Prepare(gid)
+            | TwoPhaseCommand::CommitPrepared(gid)
+            | TwoPhaseCommand::RollbackPrepared(gid) => gid,
+        }
+    }
+}
+
+/// Find a two-phase commit command at the start of a Query ('Q') or Parse ('P') message.
+pub fn two_phase_command(message: &[u8]) -> Option<TwoPhaseCommand> {
+    let header = mem::size_of::<u8>() + mem::size_of::<i32>();
+    if message.len() <= header {
+        return None;
+    }
+
+    let body = &message[header..];
+    let query = match message[0] as char {
+        'Q' => body,
+        // Skip the statement name.
+        'P' => &body[body.iter().position(|byte| *byte == 0)? + 1..],
+        _ => return None,
+    };
+    let query = &query[..query.iter().position(|byte| *byte == 0)?];
+    let query = std::str::from_utf8(query).ok()?;
+
+    if let Some(rest) = strip_keywords(query, &["PREPARE", "TRANSACTION"]) {
+        return parse_gid(rest).map(TwoPhaseCommand::Prepare);
+    }
+    if let Some(rest) = strip_keywords(query, &["COMMIT", "PREPARED"]) {
+        return parse_gid(rest).map(TwoPhaseCommand::CommitPrepared);
+    }
+    if let Some(rest) = strip_keywords(query, &["ROLLBACK", "PREPARED"]) {
+        return parse_gid(rest).map(TwoPhaseCommand::RollbackPrepared);
+    }
+    None
+}
+
+/// Strip whitespace separated keywords, case insensitive.
+fn strip_keywords<'a>(query: &'a str, keywords: &[&str]) -> Option<&'a str> {
+    let mut rest = query;
+    for keyword in keywords {
+        rest = rest.trim_start();
+        if !rest.get(..keyword.len())?.eq_ignore_ascii_case(keyword) {
+            return None;
+        }
+        rest = &rest[keyword.len()..];
+        if !rest.starts_with(|c: char| c.is_ascii_whitespace() || c == '\'') {
+            return None;
+        }
+    }
+    Some(rest)
+}
+
+/// Parse the quoted transaction identifier.
+fn parse_gid(rest: &str) -> Option<String> {
+    let mut chars = rest.trim_start().strip_prefix('\'')?.chars().peekable();
+    let mut gid = String::new();
+    while let Some(c) = chars.next() {
+        if c == '\'' {
+            if chars.peek() == Some(&'\'') {
+                chars.next();
+            } else {
+                return Some(gid);
+            }
+        }
+        gid.push(c);
+    }
+    None
+}
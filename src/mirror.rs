@@ -0,0 +1,428 @@
+// Mirroring of the traffic of a database to a shadow server.
+//
+// For pools with mirror_host the queries and extended protocol batches the
+// clients ran on their servers are replayed on a shadow server, e.g. to validate
+// a new PostgreSQL major version with the production traffic before the cutover.
+// The clients of a user share up to mirror_pool_size connections to the shadow,
+// a client takes one for a request and keeps it until its transaction ends.
+// Mirroring never holds the client up: the requests are queued without waiting,
+// dropped when the shadow falls behind or all the connections are taken, and
+// its responses are discarded. With mirror_log_diffs the
+// CommandComplete tags of the shadow are compared with the ones of the server
+// and the differences are logged.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::sync::Arc;
+
+// External crate imports
+use bytes::{BufMut, BytesMut};
+use log::{info, warn};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::sync::{mpsc, OwnedSemaphorePermit, Semaphore};
+use tokio::time::Instant;
+
+// Internal crate imports
+use crate::config::{get_config, Address, User};
+use crate::errors::Error;
+use crate::messages::fingerprint::statement_text;
+use crate::messages::{Parse, PgErrorMsg};
+use crate::pool::{ClientServerMap, ConnectionPool};
+use crate::server::Server;
+use crate::stats::ServerStats;
+
+/// Requests of a client waiting for the shadow server, the ones over it are dropped.
+const MIRROR_QUEUE_SIZE: usize = 128;
+
+/// A client request replayed on the shadow server.
+#[derive(Debug, Default)]
+struct MirrorRequest {
+    /// Query message or extended protocol messages up to Sync, as sent to the server.
+    messages: BytesMut,
+    /// Prepared statements the messages use, prepared on the shadow first.
+    statements: Vec<Arc<Parse>>,
+    /// CommandComplete tags of the server, with mirror_log_diffs.
+    command_tags: Option<Vec<String>>,
+}
+
+/// Connections of a user to the shadow server, shared by the clients of the user.
+struct MirrorPool {
+    address: Address,
+    user: User,
+    server_database: String,
+    application_name: String,
+    prepared_statement_cache_size: usize,
+    client_server_map: ClientServerMap,
+    /// Hash of the config of the pool, the mirror pool is replaced when it changes.
+    config_hash: u64,
+    /// A connection taken by a client holds a permit.
+    permits: Arc<Semaphore>,
+    /// Connections no client has taken.
+    idle: Mutex<Vec<Server>>,
+}
+
+/// A connection to the shadow server taken by a client.
+struct MirrorConnection {
+    server: Server,
+    _permit: OwnedSemaphorePermit,
+}
+
+/// Mirror pools by pool name and user name.
+static MIRROR_POOLS: Lazy<Mutex<HashMap<(String, String), Arc<MirrorPool>>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+impl MirrorPool {
+    /// The mirror pool of the user of the pool, created with the current config of the pool.
+    fn get_or_create(
+        pool: &ConnectionPool,
+        client_server_map: ClientServerMap,
+    ) -> Option<Arc<MirrorPool>> {
+        let config = get_config();
+        let pool_config = config.pool_config(&pool.address.pool_name)?;
+        // Validated with the config.
+        let (host, port) = pool_config.mirror_address().ok()??;
+
+        let key = (
+            pool.address.pool_name.clone(),
+            pool.settings.user.username.clone(),
+        );
+        let mut mirror_pools = MIRROR_POOLS.lock();
+        if let Some(mirror_pool) = mirror_pools.get(&key) {
+            if mirror_pool.config_hash == pool.config_hash {
+                return Some(mirror_pool.clone());
+            }
+        }
+        let mirror_pool = Arc::new(MirrorPool {
+            address: Address {
+                host,
+                port,
+                ..pool.address.clone()
+            },
+            user: pool.settings.user.clone(),
+            server_database: pool_config
+                .server_database
+                .clone()
+                .unwrap_or(pool.address.database.clone()),
+            application_name: pool_config
+                .application_name
+                .clone()
+                .unwrap_or_else(|| "pg_doorman".to_string()),
+            prepared_statement_cache_size: pool_config
+                .prepared_statements_cache_size(&pool.settings.user, &config.general),
+            client_server_map,
+            config_hash: pool.config_hash,
+            permits: Arc::new(Semaphore::new(pool_config.mirror_pool_size as usize)),
+            idle: Mutex::new(Vec::new()),
+        });
+        mirror_pools.insert(key, mirror_pool.clone());
+        Some(mirror_pool)
+    }
+
+    /// Take a connection, None if all of them are taken.
+    async fn get(&self) -> Result<Option<MirrorConnection>, Error> {
+        let permit = match self.permits.clone().try_acquire_owned() {
+            Ok(permit) => permit,
+            Err(_) => return Ok(None),
+        };
+        let idle = self.idle.lock().pop();
+        let server = match idle {
+            Some(server) => server,
+            None => {
+                Server::startup(
+                    &self.address,
+                    &self.user,
+                    &self.server_database,
+                    self.client_server_map.clone(),
+                    Arc::new(ServerStats::new(self.address.clone(), Instant::now())),
+                    true,
+                    false,
+                    self.prepared_statement_cache_size,
+                    self.application_name.clone(),
+                )
+                .await?
+            }
+        };
+        Ok(Some(MirrorConnection {
+            server,
+            _permit: permit,
+        }))
+    }
+
+    /// Give the connection back, unless it is broken.
+    fn put(&self, connection: MirrorConnection) {
+        if !connection.server.is_bad() {
+            self.idle.lock().push(connection.server);
+        }
+    }
+}
+
+/// Mirroring of the requests of a client.
+pub struct Mirror {
+    sender: mpsc::Sender<MirrorRequest>,
+    log_diffs: bool,
+    /// Extended protocol messages sent before Sync, e.g. batches ending with Flush.
+    pending: MirrorRequest,
+    /// A request was dropped, logged once per client.
+    lagging: bool,
+}
+
+impl Mirror {
+    /// Mirror the requests of the client of the pool if its database has mirror_host.
+    pub fn start(pool: &ConnectionPool, client_server_map: ClientServerMap) -> Option<Mirror> {
+        let mirror_pool = MirrorPool::get_or_create(pool, client_server_map)?;
+        let log_diffs = get_config()
+            .pool_config(&pool.address.pool_name)
+            .is_some_and(|pool_config| pool_config.mirror_log_diffs);
+
+        let (sender, receiver) = mpsc::channel(MIRROR_QUEUE_SIZE);
+        tokio::task::spawn(replay_requests(mirror_pool, receiver));
+
+        Some(Mirror {
+            sender,
+            log_diffs,
+            pending: MirrorRequest::default(),
+            lagging: false,
+        })
+    }
+
+    /// Whether the CommandComplete tags of the server should be collected for the diffs.
+    pub fn log_diffs(&self) -> bool {
+        self.log_diffs
+    }
+
+    /// Add the messages sent to the server and its CommandComplete tags. They are
+    /// queued for the shadow with `complete`, i.e. at Sync or for a Query.
+    pub fn add(
+        &mut self,
+        messages: &[u8],
+        statements: Vec<Arc<Parse>>,
+        command_tags: Vec<String>,
+        complete: bool,
+    ) {
+        self.pending.messages.put(messages);
+        self.pending.statements.extend(statements);
+        if self.log_diffs {
+            self.pending
+                .command_tags
+                .get_or_insert_with(Vec::new)
+                .extend(command_tags);
+        }
+        if !complete {
+            return;
+        }
+        let request = std::mem::take(&mut self.pending);
+        if let Err(mpsc::error::TrySendError::Full(_)) = self.sender.try_send(request) {
+            if !self.lagging {
+                warn!("Mirror falls behind, requests of the client are dropped");
+                self.lagging = true;
+            }
+        }
+    }
+
+    /// Forget the messages not sent yet, e.g. those of a COPY.
+    pub fn discard(&mut self) {
+        self.pending = MirrorRequest::default();
+    }
+}
+
+/// Replay the requests on the shadow server until the client disconnects. The
+/// requests coming while all the connections of the mirror pool are taken are dropped.
+async fn replay_requests(
+    mirror_pool: Arc<MirrorPool>,
+    mut receiver: mpsc::Receiver<MirrorRequest>,
+) {
+    // Kept while the transaction of the client is open on it.
+    let mut connection = None;
+    let mut saturated = false;
+    while let Some(request) = receiver.recv().await {
+        let mut connection_taken = match connection.take() {
+            Some(connection) => connection,
+            None => match mirror_pool.get().await {
+                Ok(Some(connection)) => connection,
+                Ok(None) => {
+                    if !saturated {
+                        warn!(
+                            "[pool: {}] Mirror pool of user {} is saturated, requests of the client are dropped",
+                            mirror_pool.address.pool_name, mirror_pool.user.username
+                        );
+                        saturated = true;
+                    }
+                    continue;
+                }
+                Err(err) => {
+                    warn!(
+                        "[pool: {}] Mirror connection to {}:{} failed: {err}",
+                        mirror_pool.address.pool_name,
+                        mirror_pool.address.host,
+                        mirror_pool.address.port
+                    );
+                    return;
+                }
+            },
+        };
+        let server = &mut connection_taken.server;
+        match replay(server, &request).await {
+            Ok((command_tags, error)) => match request.command_tags {
+                Some(ref expected) if *expected != command_tags => info!(
+                    "Mirror {} of user {} differs on {:?}: server [{}], mirror [{}]{}",
+                    server,
+                    mirror_pool.user.username,
+                    request_statement(&request).unwrap_or_default(),
+                    expected.join("; "),
+                    command_tags.join("; "),
+                    error
+                        .map(|err| format!(", error: {err}"))
+                        .unwrap_or_default()
+                ),
+                _ => (),
+            },
+            Err(err) => {
+                warn!("Mirror {server} failed, mirroring of the client stops: {err}");
+                return;
+            }
+        }
+        if connection_taken.server.in_transaction() {
+            connection = Some(connection_taken);
+        } else {
+            mirror_pool.put(connection_taken);
+        }
+    }
+}
+
+/// Send the request to the shadow server and read the responses, returns its
+/// CommandComplete tags and the first error.
+async fn replay(
+    server: &mut Server,
+    request: &MirrorRequest,
+) -> Result<(Vec<String>, Option<String>), Error> {
+    for parse in &request.statements {
+        match server.register_prepared_statement(parse, true).await {
+            Ok(()) | Err(Error::PreparedStatementError) => (),
+            Err(err) => return Err(err),
+        }
+    }
+    let messages = without_prepared_parses(&request.messages, &request.statements);
+
+    server.collect_command_tags();
+    server.send_and_flush(&messages).await?;
+    let mut error = None;
+    let mut noop = tokio::io::sink();
+    loop {
+        let response = server.recv(&mut noop, None).await?;
+        if error.is_none() {
+            error = first_error(&response);
+        }
+        if !server.is_data_available() {
+            break;
+        }
+    }
+    Ok((server.take_command_tags(), error))
+}
+
+/// The messages of the buffer, the code byte and length included.
+fn split_messages(buffer: &[u8]) -> Vec<&[u8]> {
+    let mut messages = Vec::new();
+    let mut rest = buffer;
+    while rest.len() >= 5 {
+        let len = i32::from_be_bytes([rest[1], rest[2], rest[3], rest[4]]) as usize + 1;
+        if len < 5 || len > rest.len() {
+            break;
+        }
+        messages.push(&rest[..len]);
+        rest = &rest[len..];
+    }
+    messages
+}
+
+/// The messages without the Parse messages of the prepared statements, those are
+/// prepared on the shadow with the prepared statement cache of its connection.
+fn without_prepared_parses(buffer: &[u8], statements: &[Arc<Parse>]) -> BytesMut {
+    let mut messages = BytesMut::with_capacity(buffer.len());
+    for message in split_messages(buffer) {
+        let prepared = message[0] == b'P'
+            && message[5..]
+                .iter()
+                .position(|byte| *byte == 0)
+                .and_then(|end| std::str::from_utf8(&message[5..5 + end]).ok())
+                .is_some_and(|name| {
+                    !name.is_empty() && statements.iter().any(|parse| parse.name == name)
+                });
+        if !prepared {
+            messages.put(message);
+        }
+    }
+    messages
+}
+
+/// Message of the first ErrorResponse of the responses.
+fn first_error(response: &[u8]) -> Option<String> {
+    split_messages(response)
+        .into_iter()
+        .find(|message| message[0] == b'E')
+        .and_then(|message| PgErrorMsg::parse(&message[5..]).ok())
+        .map(|error| format!("{}: {}", error.code, error.message))
+}
+
+/// Text of the first statement of the request, for the log.
+fn request_statement(request: &MirrorRequest) -> Option<String> {
+    split_messages(&request.messages)
+        .into_iter()
+        .find_map(statement_text)
+        .or_else(|| request.statements.first().map(|parse| parse.query()))
+        .map(str::to_string)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::messages::simple_query;
+
+    fn parse_message(name: &str, query: &str) -> BytesMut {
+        let mut message = BytesMut::new();
+        message.put_u8(b'P');
+        message.put_i32(4 + name.len() as i32 + 1 + query.len() as i32 + 1 + 2);
+        message.put_slice(name.as_bytes());
+        message.put_u8(0);
+        message.put_slice(query.as_bytes());
+        message.put_u8(0);
+        message.put_i16(0);
+        message
+    }
+
+    #[test]
+    fn test_without_prepared_parses() {
+        let prepared = parse_message("DOORMAN_1", "select 1");
+        let parse: Parse = (&prepared).try_into().unwrap();
+        let unnamed = parse_message("", "select 2");
+        let mut buffer = BytesMut::new();
+        buffer.put(&prepared[..]);
+        buffer.put(&unnamed[..]);
+        buffer.put(&simple_query("select 3")[..]);
+
+        assert_eq!(split_messages(&buffer).len(), 3);
+        let messages = without_prepared_parses(&buffer, &[Arc::new(parse)]);
+        let messages = split_messages(&messages);
+        assert_eq!(messages.len(), 2);
+        assert_eq!(statement_text(messages[0]), Some("select 2"));
+        assert_eq!(statement_text(messages[1]), Some("select 3"));
+    }
+
+    #[test]
+    fn test_first_error() {
+        let mut response = BytesMut::new();
+        response.put_u8(b'E');
+        let fields = b"SERROR\0VERROR\0C42P01\0Mrelation \"t\" does not exist\0\0";
+        response.put_i32(4 + fields.len() as i32);
+        response.put_slice(fields);
+        response.put_u8(b'Z');
+        response.put_i32(5);
+        response.put_u8(b'I');
+
+        assert_eq!(
+            first_error(&response),
+            Some("42P01: relation \"t\" does not exist".to_string())
+        );
+        assert_eq!(first_error(&response[5 + fields.len()..]), None);
+    }
+}
@@ -0,0 +1,73 @@
+// Forwarding of cancel requests between pg_doorman instances.
+//
+// Behind a load balancer the CancelRequest of a client lands on any of the
+// instances, often not the one running its query, which doesn't know the key and
+// drops it. With peer_id set, an instance puts its id in the high 16 bits of the
+// process ids it gives to its clients, their secret keys stay fully random. A
+// cancel request for a key it doesn't know is sent on to the instance of the
+// peers list with the id found in the process id.
+
+// Standard library imports
+use std::sync::atomic::AtomicUsize;
+
+// Internal crate imports
+use crate::config::{General, Peer};
+
+/// Cancel requests sent on to the peer owning their key.
+pub static CANCEL_FORWARDED_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Process id of a new client: random, with the peer id in the high 16 bits when peering is on.
+pub fn new_process_id(peer_id: u16) -> i32 {
+    let id: u32 = rand::random();
+    if peer_id == 0 {
+        return id as i32;
+    }
+    (((peer_id as u32) << 16) | (id & 0xffff)) as i32
+}
+
+/// Peer id found in a process id.
+pub fn process_peer_id(process_id: i32) -> u16 {
+    ((process_id as u32) >> 16) as u16
+}
+
+/// The peer a cancel request with an unknown key goes to, none if the key is ours
+/// or its peer isn't in the peers list.
+pub fn cancel_peer(general: &General, process_id: i32) -> Option<&Peer> {
+    if general.peer_id == 0 {
+        return None;
+    }
+    let peer_id = process_peer_id(process_id);
+    if peer_id == general.peer_id {
+        return None;
+    }
+    general.peers.iter().find(|peer| peer.peer_id == peer_id)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cancel_peer() {
+        let mut general = General::default();
+        let process_id = new_process_id(2);
+        assert_eq!(process_peer_id(process_id), 2);
+        // Peering is off.
+        assert_eq!(cancel_peer(&general, process_id), None);
+
+        general.peer_id = 1;
+        general.peers = (1..=3)
+            .map(|peer_id| Peer {
+                peer_id,
+                host: format!("10.0.0.{peer_id}"),
+                port: 6432,
+            })
+            .collect();
+        assert_eq!(cancel_peer(&general, process_id).unwrap().host, "10.0.0.2");
+        // The client is ours: nowhere to forward.
+        assert_eq!(cancel_peer(&general, new_process_id(1)), None);
+        assert_eq!(cancel_peer(&general, new_process_id(7)), None);
+        // Process ids of the highest peer id come out negative.
+        assert_eq!(process_peer_id(new_process_id(u16::MAX)), u16::MAX);
+    }
+}
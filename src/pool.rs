@@ -4,14 +4,18 @@ use log::{error, info, warn};
 use lru::LruCache;
 use once_cell::sync::Lazy;
 use parking_lot::Mutex;
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use std::fmt::{Display, Formatter};
 use std::num::NonZeroUsize;
-use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering};
 use std::sync::Arc;
 use std::time::Duration;
 
-use crate::config::{get_config, Address, General, PoolMode, User};
+use crate::balancer::HostBalancer;
+use crate::config::{
+    get_config, partition_pool_name, replica_pool_name, Address, Config, General, Pool, PoolMode,
+    User, PARTITION_SEPARATOR, WILDCARD_DATABASE,
+};
 use crate::errors::Error;
 use crate::messages::Parse;
 
@@ -31,9 +35,148 @@ pub type PoolMap = HashMap<PoolIdentifierVirtual, ConnectionPool>;
 /// This is atomic and safe and read-optimized.
 /// The pool is recreated dynamically when the config is reloaded.
 pub static POOLS: Lazy<ArcSwap<PoolMap>> = Lazy::new(|| ArcSwap::from_pointee(HashMap::default()));
+/// Databases whose pools were created from the `*` entry.
+static WILDCARD_DATABASES: Lazy<Mutex<HashSet<String>>> = Lazy::new(|| Mutex::new(HashSet::new()));
+/// Databases and users not listed in them whose pools were created for a login with auth_query.
+static AUTH_QUERY_USERS: Lazy<Mutex<HashSet<(String, String)>>> =
+    Lazy::new(|| Mutex::new(HashSet::new()));
+
 pub static CANCELED_PIDS: Lazy<Arc<Mutex<Vec<ProcessId>>>> =
     Lazy::new(|| Arc::new(Mutex::new(Vec::new())));
 
+/// Pools created for a client while it authenticates, added with add_pending_pools
+/// once it has: of a database served from the `*` entry (see ConnectionPool::wildcard_pools)
+/// or of a user not listed in the pool (see ConnectionPool::auth_query_user_pools).
+pub struct PendingPools {
+    database: String,
+    /// The user not listed in the pool, None for a database of the `*` entry.
+    auth_query_user: Option<String>,
+    pools: PoolMap,
+}
+
+impl PendingPools {
+    /// The pool of the user in the database.
+    pub fn pool(&self, username: &str) -> Option<ConnectionPool> {
+        self.pools
+            .get(&PoolIdentifierVirtual::new(&self.database, username, 0))
+            .cloned()
+    }
+}
+
+/// Who receives an injected error on the next checkout.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub enum ErrorInjectionTarget {
+    /// A single client, by its process id (client_id in SHOW CLIENTS).
+    Client(ProcessId),
+    /// The next client of the pool (database) that checks out a server.
+    Pool(String),
+}
+
+/// Errors (SQLSTATE codes) injected with the admin INJECT command.
+static INJECTED_ERRORS: Lazy<Mutex<HashMap<ErrorInjectionTarget, String>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Whether INJECTED_ERRORS has any, so checkouts don't take its lock without them.
+static ANY_INJECTED_ERROR: AtomicBool = AtomicBool::new(false);
+
+/// Passthrough mode of users switched with the admin PASSTHROUGH command, overriding the config.
+pub static PASSTHROUGH_OVERRIDES: Lazy<Mutex<HashMap<String, bool>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Whether new clients of the user run in passthrough mode.
+pub fn passthrough_enabled(username: &str, configured: bool) -> bool {
+    PASSTHROUGH_OVERRIDES
+        .lock()
+        .get(username)
+        .copied()
+        .unwrap_or(configured)
+}
+
+/// Databases paused with the admin PAUSE command.
+pub static PAUSED_DATABASES: Lazy<Mutex<HashSet<String>>> =
+    Lazy::new(|| Mutex::new(HashSet::new()));
+
+/// Wakes up the clients waiting for a paused database on RESUME.
+static RESUMED: Lazy<tokio::sync::Notify> = Lazy::new(tokio::sync::Notify::new);
+
+/// The configured database of a pool: `db` for `db`, its partitions `db/<partition>`
+/// and its replicas `db/replicaN`.
+pub fn pool_database(pool_name: &str) -> &str {
+    pool_name
+        .rsplit_once(PARTITION_SEPARATOR)
+        .map_or(pool_name, |(database, _)| database)
+}
+
+/// Whether the pool belongs to one of the databases.
+pub fn pool_of_databases(pool_name: &str, databases: &[String]) -> bool {
+    databases
+        .iter()
+        .any(|db| db == pool_name || db == pool_database(pool_name))
+}
+
+/// Whether new transactions of the pool are held back by PAUSE of its database.
+pub fn is_paused(pool_name: &str) -> bool {
+    let paused = PAUSED_DATABASES.lock();
+    !paused.is_empty() && (paused.contains(pool_name) || paused.contains(pool_database(pool_name)))
+}
+
+pub fn pause_databases(databases: &[String]) {
+    PAUSED_DATABASES.lock().extend(databases.iter().cloned());
+}
+
+/// Resume the database, or all paused databases.
+pub fn resume_databases(db: Option<&str>) {
+    match db {
+        Some(db) => {
+            PAUSED_DATABASES.lock().remove(db);
+        }
+        None => PAUSED_DATABASES.lock().clear(),
+    }
+    RESUMED.notify_waiters();
+}
+
+/// Wait until the database is resumed.
+pub async fn wait_while_paused(db: &str) {
+    loop {
+        // Registered before the check, so a RESUME in between is not missed.
+        let resumed = RESUMED.notified();
+        if !is_paused(db) {
+            return;
+        }
+        resumed.await;
+    }
+}
+
+/// Inject the error for the next checkout of the target.
+pub fn inject_error(target: ErrorInjectionTarget, code: String) {
+    let mut guard = INJECTED_ERRORS.lock();
+    guard.insert(target, code);
+    ANY_INJECTED_ERROR.store(true, Ordering::Release);
+}
+
+/// Forget all injected errors.
+pub fn clear_injected_errors() {
+    let mut guard = INJECTED_ERRORS.lock();
+    guard.clear();
+    ANY_INJECTED_ERROR.store(false, Ordering::Release);
+}
+
+/// Take the error injected for the client or its pool, if any.
+/// Each injected error is delivered only once.
+pub fn take_injected_error(process_id: ProcessId, pool_name: &str) -> Option<String> {
+    if !ANY_INJECTED_ERROR.load(Ordering::Acquire) {
+        return None;
+    }
+    let mut guard = INJECTED_ERRORS.lock();
+    let error = guard
+        .remove(&ErrorInjectionTarget::Client(process_id))
+        .or_else(|| guard.remove(&ErrorInjectionTarget::Pool(pool_name.to_string())));
+    if guard.is_empty() {
+        ANY_INJECTED_ERROR.store(false, Ordering::Release);
+    }
+    error
+}
+
 pub type PreparedStatementCacheType = Arc<Mutex<PreparedStatementCache>>;
 pub type ServerParametersType = Arc<tokio::sync::Mutex<ServerParameters>>;
 
@@ -155,8 +298,29 @@ pub struct PoolSettings {
     /// Синхронизируем серверные параметры установленные клиентом через SET. (False).
     pub sync_server_parameters: bool,
 
+    /// Transaction duration warning and limit (ms, 0 disables).
+    pub transaction_duration_warning_ms: u64,
+    pub transaction_duration_limit_ms: u64,
+
+    /// statement_timeout and idle_in_transaction_session_timeout set on the servers
+    /// (ms, 0 leaves the server default).
+    pub statement_timeout_ms: u64,
+    pub idle_in_transaction_session_timeout_ms: u64,
+
     idle_timeout_ms: u64,
     life_time_ms: u64,
+
+    /// Server connections opened over pool_size for the clients waiting longer than
+    /// reserve_pool_timeout (ms).
+    pub reserve_pool_size: u32,
+    reserve_pool_timeout_ms: u64,
+
+    /// Server connections kept open, the share of min_pool_size of the virtual pool.
+    min_size: usize,
+
+    /// Shares of pool_size and reserve_pool_size of the virtual pool.
+    max_size: usize,
+    reserve_size: usize,
 }
 
 impl Default for PoolSettings {
@@ -167,7 +331,16 @@ impl Default for PoolSettings {
             db: String::default(),
             idle_timeout_ms: General::default_idle_timeout(),
             life_time_ms: General::default_server_lifetime(),
+            reserve_pool_size: 0,
+            reserve_pool_timeout_ms: General::default_reserve_pool_timeout(),
+            min_size: 0,
+            max_size: 0,
+            reserve_size: 0,
             sync_server_parameters: General::default_sync_server_parameters(),
+            transaction_duration_warning_ms: 0,
+            transaction_duration_limit_ms: 0,
+            statement_timeout_ms: 0,
+            idle_in_transaction_session_timeout_ms: 0,
         }
     }
 }
@@ -181,6 +354,9 @@ pub struct ConnectionPool {
     /// The address (host, port)
     pub address: Address,
 
+    /// Hosts the server connections are opened to.
+    pub balancer: Arc<HostBalancer>,
+
     /// The server information has to be passed to the
     /// clients on startup.
     original_server_parameters: ServerParametersType,
@@ -202,141 +378,408 @@ impl ConnectionPool {
     pub async fn from_config(client_server_map: ClientServerMap) -> Result<(), Error> {
         let config = get_config();
 
+        // Held until the new pools are in, so no wildcard database is created meanwhile.
+        let mut wildcard_databases = WILDCARD_DATABASES.lock();
+        let wildcard = config.pools.get(WILDCARD_DATABASE);
+        if wildcard.is_none() {
+            wildcard_databases.clear();
+        }
+        wildcard_databases.retain(|database| !config.pools.contains_key(database));
+        // Users added to their pool or whose pool no longer has a template are dropped.
+        let mut auth_query_users = AUTH_QUERY_USERS.lock();
+        auth_query_users.retain(|(database, username)| {
+            config
+                .pools
+                .get(database)
+                .and_then(|pool_config| pool_config.auth_query_user(username))
+                .is_some()
+        });
+
         let mut new_pools = HashMap::new();
 
-        for (pool_name, pool_config) in &config.pools {
-            let new_pool_hash_value = pool_config.hash_value();
-
-            // There is one pool per database/user pair.
-            for user in pool_config.users.values() {
-                for virtual_pool_id in 0..config.general.virtual_pool_count {
-                    let old_pool_ref = get_pool(pool_name, &user.username, virtual_pool_id);
-                    let identifier =
-                        PoolIdentifierVirtual::new(pool_name, &user.username, virtual_pool_id);
-
-                    if let Some(pool) = old_pool_ref {
-                        // If the pool hasn't changed, get existing reference and insert it into the new_pools.
-                        // We replace all pools at the end, but if the reference is kept, the pool won't get re-created (bb8).
-                        if pool.config_hash == new_pool_hash_value {
-                            info!(
-                                "[pool: {}][user: {}] has not changed",
-                                pool_name, user.username
-                            );
-                            new_pools.insert(identifier.clone(), pool.clone());
-                            continue;
-                        }
-                    }
+        for (database, pool_config) in &config.pools {
+            if database == WILDCARD_DATABASE {
+                continue;
+            }
+            Self::database_pools(
+                &config,
+                database,
+                pool_config,
+                &pool_config.users.values().cloned().collect::<Vec<_>>(),
+                &client_server_map,
+                &mut new_pools,
+            )?;
+        }
+        if let Some(wildcard) = wildcard {
+            for database in wildcard_databases.iter() {
+                Self::database_pools(
+                    &config,
+                    database,
+                    &wildcard.tenant_pool(database)?,
+                    &wildcard.users.values().cloned().collect::<Vec<_>>(),
+                    &client_server_map,
+                    &mut new_pools,
+                )?;
+            }
+        }
+        for (database, username) in auth_query_users.iter() {
+            let pool_config = &config.pools[database];
+            if let Some(user) = pool_config.auth_query_user(username) {
+                Self::database_pools(
+                    &config,
+                    database,
+                    pool_config,
+                    &[user],
+                    &client_server_map,
+                    &mut new_pools,
+                )?;
+            }
+        }
 
-                    info!(
-                        "Creating new pool {}@{}-{}",
-                        user.username, pool_name, virtual_pool_id
-                    );
+        POOLS.store(Arc::new(new_pools));
+        Ok(())
+    }
 
-                    // real database name on postgresql server.
-                    let server_database = pool_config
-                        .server_database
-                        .clone()
-                        .unwrap_or(pool_name.clone().to_string());
-
-                    let address = Address {
-                        database: pool_name.clone(),
-                        host: pool_config.server_host.clone(),
-                        port: pool_config.server_port,
-                        virtual_pool_id,
-                        username: user.username.clone(),
-                        password: user.password.clone(),
-                        pool_name: pool_name.clone(),
-                        stats: Arc::new(AddressStats::default()),
-                        error_count: Arc::new(AtomicU64::new(0)),
-                    };
-
-                    let prepared_statements_cache_size = match config.general.prepared_statements {
-                        true => pool_config
-                            .prepared_statements_cache_size
-                            .unwrap_or(config.general.prepared_statements_cache_size),
-                        false => 0,
-                    };
-
-                    let application_name = pool_config
-                        .application_name
-                        .clone()
-                        .unwrap_or_else(|| "pg_doorman".to_string());
-
-                    let manager = ServerPool::new(
-                        address.clone(),
-                        user.clone(),
-                        server_database.as_str(),
-                        client_server_map.clone(),
-                        pool_config.cleanup_server_connections,
-                        pool_config.log_client_parameter_status_changes,
-                        prepared_statements_cache_size,
-                        application_name,
-                    );
+    /// Pools of a database that isn't configured, from the `*` entry, for a client of
+    /// one of the users of the entry. They serve the client while it authenticates and
+    /// are added to the pools with add_pending_pools once it has.
+    /// Returns None if there's no such entry, the user is not in it or the entry
+    /// serves max_wildcard_databases databases already.
+    pub fn wildcard_pools(
+        database: &str,
+        username: &str,
+        client_server_map: &ClientServerMap,
+    ) -> Result<Option<PendingPools>, Error> {
+        let config = get_config();
+        let wildcard = match config.wildcard_pool(database) {
+            Some(wildcard) => wildcard,
+            None => return Ok(None),
+        };
+        if !wildcard
+            .users
+            .values()
+            .any(|user| user.username == username)
+        {
+            return Ok(None);
+        }
+        let max = config.general.max_wildcard_databases;
+        if max > 0 && WILDCARD_DATABASES.lock().len() >= max {
+            warn!("Database {database} is not served from the {WILDCARD_DATABASE} entry, max_wildcard_databases ({max}) reached");
+            return Ok(None);
+        }
+        let mut pools = HashMap::new();
+        Self::database_pools(
+            &config,
+            database,
+            &wildcard.tenant_pool(database)?,
+            &wildcard.users.values().cloned().collect::<Vec<_>>(),
+            client_server_map,
+            &mut pools,
+        )?;
+        Ok(Some(PendingPools {
+            database: database.to_string(),
+            auth_query_user: None,
+            pools,
+        }))
+    }
 
-                    let queue_strategy = match config.general.server_round_robin {
-                        true => managed::QueueMode::Fifo,
-                        false => managed::QueueMode::Lifo,
-                    };
+    /// Pools of a user that isn't listed in the pool of the database, with the settings
+    /// of its auth_query_template_user, for a client authenticated with auth_query.
+    /// They are added to the pools with add_pending_pools once it has.
+    /// Returns None if the pool has no auth_query_template_user or lists the user.
+    pub fn auth_query_user_pools(
+        pool_name: &str,
+        username: &str,
+        client_server_map: &ClientServerMap,
+    ) -> Result<Option<PendingPools>, Error> {
+        let config = get_config();
+        let database = pool_database(pool_name);
+        let pool_config = match config.pools.get(database) {
+            Some(pool_config) => pool_config,
+            None => return Ok(None),
+        };
+        let user = match pool_config.auth_query_user(username) {
+            Some(user) => user,
+            None => return Ok(None),
+        };
+        let mut pools = HashMap::new();
+        Self::database_pools(
+            &config,
+            database,
+            pool_config,
+            &[user],
+            client_server_map,
+            &mut pools,
+        )?;
+        Ok(Some(PendingPools {
+            database: database.to_string(),
+            auth_query_user: Some(username.to_string()),
+            pools,
+        }))
+    }
 
-                    info!(
-                        "[pool: {}][user: {}][vpid: {}]",
-                        pool_name, user.username, virtual_pool_id
-                    );
+    /// Add the pools created for a client, after it authenticated.
+    pub fn add_pending_pools(pending_pools: PendingPools) {
+        if let Some(username) = pending_pools.auth_query_user {
+            let mut auth_query_users = AUTH_QUERY_USERS.lock();
+            let database = pending_pools.database;
+            // Added by another client meanwhile, or the config was reloaded.
+            if auth_query_users.contains(&(database.clone(), username.clone()))
+                || get_config()
+                    .pools
+                    .get(&database)
+                    .and_then(|pool_config| pool_config.auth_query_user(&username))
+                    .is_none()
+            {
+                return;
+            }
+            POOLS.rcu(|pools| {
+                let mut pools = HashMap::clone(pools);
+                pools.extend(pending_pools.pools.clone());
+                pools
+            });
+            info!("Created the pools of user {username} in database {database} from auth_query_template_user");
+            auth_query_users.insert((database, username));
+            return;
+        }
+        let mut wildcard_databases = WILDCARD_DATABASES.lock();
+        let database = pending_pools.database;
+        // Added by another client meanwhile, or the config was reloaded.
+        if wildcard_databases.contains(&database) || get_config().wildcard_pool(&database).is_none()
+        {
+            return;
+        }
+        let max = get_config().general.max_wildcard_databases;
+        if max > 0 && wildcard_databases.len() >= max {
+            return;
+        }
+        POOLS.rcu(|pools| {
+            let mut pools = HashMap::clone(pools);
+            pools.extend(pending_pools.pools.clone());
+            pools
+        });
+        match get_config()
+            .wildcard_pool(&database)
+            .and_then(|wildcard| wildcard.tenant_cluster(&database))
+        {
+            Some(cluster) => info!("Created the pools of database {database} from the {WILDCARD_DATABASE} entry on tenant cluster {cluster}"),
+            None => info!("Created the pools of database {database} from the {WILDCARD_DATABASE} entry"),
+        }
+        wildcard_databases.insert(database);
+    }
 
-                    let mut builder_config = managed::Pool::builder(manager);
-                    builder_config = builder_config.config(managed::PoolConfig {
-                        max_size: (user.pool_size / config.general.virtual_pool_count as u32)
-                            as usize,
-                        timeouts: managed::Timeouts {
-                            wait: Some(Duration::from_millis(config.general.query_wait_timeout)),
-                            create: Some(Duration::from_millis(config.general.connect_timeout)),
-                            recycle: None,
-                        },
-                        queue_mode: queue_strategy,
-                    });
-                    builder_config = builder_config.runtime(Runtime::Tokio1);
-
-                    let pool = match builder_config.build() {
-                        Ok(p) => p,
-                        Err(err) => {
-                            error!("error build pool: {err:?}");
-                            return Err(Error::BadConfig(format!("error build pool: {err:?}")));
-                        }
-                    };
-
-                    let pool = ConnectionPool {
-                        database: pool,
-                        address,
-                        config_hash: new_pool_hash_value,
-                        original_server_parameters: Arc::new(tokio::sync::Mutex::new(
-                            ServerParameters::new(),
-                        )),
-                        settings: PoolSettings {
-                            pool_mode: user.pool_mode.unwrap_or(pool_config.pool_mode),
-                            user: user.clone(),
-                            db: pool_name.clone(),
-                            idle_timeout_ms: config.general.idle_timeout,
-                            life_time_ms: config.general.server_lifetime,
-                            sync_server_parameters: config.general.sync_server_parameters,
-                        },
-                        prepared_statement_cache: match config.general.prepared_statements {
-                            false => None,
-                            true => Some(Arc::new(Mutex::new(PreparedStatementCache::new(
-                                config.general.prepared_statements_cache_size,
-                            )))),
-                        },
-                    };
-
-                    // There is one pool per database/user pair.
-                    new_pools.insert(
-                        PoolIdentifierVirtual::new(pool_name, &user.username, virtual_pool_id),
-                        pool,
-                    );
+    /// Add the pools of the database to `new_pools`: one per user, partition and
+    /// replica, the unchanged ones kept from the current pools.
+    fn database_pools(
+        config: &Config,
+        database: &str,
+        pool_config: &Pool,
+        users: &[User],
+        client_server_map: &ClientServerMap,
+        new_pools: &mut PoolMap,
+    ) -> Result<(), Error> {
+        let new_pool_hash_value = pool_config.hash_value(&config.general);
+
+        // There is one pool per database/user pair, and one more per partition
+        // and per replica of the database.
+        let primary = Arc::new(HostBalancer::new(
+            pool_config.server_addresses()?,
+            pool_config.load_balancing,
+            Duration::from_millis(pool_config.failover_cooldown),
+        ));
+        let mut pool_users: Vec<(String, User, Arc<HostBalancer>)> = users
+            .iter()
+            .map(|user| {
+                (
+                    database.to_string(),
+                    pool_config.user(user),
+                    primary.clone(),
+                )
+            })
+            .collect();
+        for (partition_name, partition) in &pool_config.partitions {
+            let pool_name = partition_pool_name(database, partition_name);
+            pool_users.extend(
+                users
+                    .iter()
+                    .map(|user| (pool_name.clone(), partition.user(user), primary.clone())),
+            );
+        }
+        for (index, (host, port)) in pool_config.replica_addresses()?.into_iter().enumerate() {
+            let pool_name = replica_pool_name(database, index + 1);
+            let replica = Arc::new(HostBalancer::single(host, port));
+            pool_users.extend(
+                users
+                    .iter()
+                    .map(|user| (pool_name.clone(), pool_config.user(user), replica.clone())),
+            );
+        }
+
+        for (pool_name, user, balancer) in &pool_users {
+            for virtual_pool_id in 0..config.general.virtual_pool_count {
+                let old_pool_ref = get_pool(pool_name, &user.username, virtual_pool_id);
+                let identifier =
+                    PoolIdentifierVirtual::new(pool_name, &user.username, virtual_pool_id);
+
+                if let Some(pool) = old_pool_ref {
+                    // If the pool hasn't changed, get existing reference and insert it into the new_pools.
+                    // We replace all pools at the end, but if the reference is kept, the pool won't get re-created (bb8).
+                    if pool.config_hash == new_pool_hash_value {
+                        info!(
+                            "[pool: {}][user: {}] has not changed",
+                            pool_name, user.username
+                        );
+                        new_pools.insert(identifier.clone(), pool.clone());
+                        continue;
+                    }
                 }
+
+                info!(
+                    "Creating new pool {}@{}-{}",
+                    user.username, pool_name, virtual_pool_id
+                );
+
+                // real database name on postgresql server.
+                let server_database = pool_config
+                    .server_database
+                    .clone()
+                    .unwrap_or_else(|| database.to_string());
+
+                // The address of the pool is the main host, connections are balanced across all hosts.
+                let (main_host, main_port) = balancer.main_host();
+                let address = Address {
+                    database: pool_name.clone(),
+                    host: main_host.to_string(),
+                    port: main_port,
+                    virtual_pool_id,
+                    username: user.username.clone(),
+                    password: user.password.clone(),
+                    pool_name: pool_name.clone(),
+                    stats: Arc::new(AddressStats::default()),
+                    error_count: Arc::new(AtomicU64::new(0)),
+                };
+
+                let prepared_statements_cache_size =
+                    pool_config.prepared_statements_cache_size(user, &config.general);
+
+                let (transaction_duration_warning_ms, transaction_duration_limit_ms) =
+                    pool_config.transaction_duration_thresholds(user);
+                let (statement_timeout_ms, idle_in_transaction_session_timeout_ms) =
+                    pool_config.session_timeouts(user);
+
+                let (reserve_pool_size, reserve_pool_timeout_ms) =
+                    pool_config.reserve_pool(&config.general);
+                let max_size = (user.pool_size / config.general.virtual_pool_count as u32) as usize;
+
+                let application_name = pool_config
+                    .application_name
+                    .clone()
+                    .unwrap_or_else(|| "pg_doorman".to_string());
+
+                let manager = ServerPool::new(
+                    address.clone(),
+                    balancer.clone(),
+                    user.clone(),
+                    server_database.as_str(),
+                    client_server_map.clone(),
+                    pool_config.cleanup_server_connections,
+                    pool_config.log_client_parameter_status_changes,
+                    prepared_statements_cache_size,
+                    application_name,
+                );
+
+                let queue_strategy = match config.general.server_round_robin {
+                    true => managed::QueueMode::Fifo,
+                    false => managed::QueueMode::Lifo,
+                };
+
+                info!(
+                    "[pool: {}][user: {}][vpid: {}]",
+                    pool_name, user.username, virtual_pool_id
+                );
+
+                let mut builder_config = managed::Pool::builder(manager);
+                builder_config = builder_config.config(managed::PoolConfig {
+                    max_size,
+                    timeouts: managed::Timeouts {
+                        wait: Some(Duration::from_millis(
+                            pool_config
+                                .query_wait_timeout
+                                .unwrap_or(config.general.query_wait_timeout),
+                        )),
+                        create: Some(Duration::from_millis(
+                            pool_config
+                                .connect_timeout
+                                .unwrap_or(config.general.connect_timeout),
+                        )),
+                        recycle: None,
+                    },
+                    queue_mode: queue_strategy,
+                });
+                builder_config = builder_config.runtime(Runtime::Tokio1);
+
+                let pool = match builder_config.build() {
+                    Ok(p) => p,
+                    Err(err) => {
+                        error!("error build pool: {err:?}");
+                        return Err(Error::BadConfig(format!("error build pool: {err:?}")));
+                    }
+                };
+
+                let pool = ConnectionPool {
+                    database: pool,
+                    address,
+                    balancer: balancer.clone(),
+                    config_hash: new_pool_hash_value,
+                    original_server_parameters: Arc::new(tokio::sync::Mutex::new(
+                        ServerParameters::new(),
+                    )),
+                    settings: PoolSettings {
+                        pool_mode: user.pool_mode.unwrap_or(pool_config.pool_mode),
+                        user: user.clone(),
+                        db: pool_name.clone(),
+                        idle_timeout_ms: pool_config
+                            .idle_timeout
+                            .unwrap_or(config.general.idle_timeout),
+                        life_time_ms: user
+                            .server_lifetime
+                            .or(pool_config.server_lifetime)
+                            .unwrap_or(config.general.server_lifetime),
+                        reserve_pool_size,
+                        reserve_pool_timeout_ms,
+                        min_size: virtual_pool_share(
+                            user.min_pool_size.unwrap_or(0).min(user.pool_size),
+                            config.general.virtual_pool_count,
+                            virtual_pool_id,
+                        )
+                        .min(max_size),
+                        max_size,
+                        reserve_size: virtual_pool_share(
+                            reserve_pool_size,
+                            config.general.virtual_pool_count,
+                            virtual_pool_id,
+                        ),
+                        sync_server_parameters: config.general.sync_server_parameters,
+                        transaction_duration_warning_ms,
+                        transaction_duration_limit_ms,
+                        statement_timeout_ms,
+                        idle_in_transaction_session_timeout_ms,
+                    },
+                    prepared_statement_cache: match config.general.prepared_statements {
+                        false => None,
+                        true => Some(Arc::new(Mutex::new(PreparedStatementCache::new(
+                            prepared_statements_cache_size,
+                        )))),
+                    },
+                };
+
+                // There is one pool per database/user pair.
+                new_pools.insert(
+                    PoolIdentifierVirtual::new(pool_name, &user.username, virtual_pool_id),
+                    pool,
+                );
             }
         }
-
-        POOLS.store(Arc::new(new_pools.clone()));
         Ok(())
     }
 
@@ -346,18 +789,39 @@ impl ConnectionPool {
         self.database.status()
     }
 
+    /// Server connections checked out by clients.
+    pub fn servers_in_use(&self) -> usize {
+        let status = self.database.status();
+        status.size.saturating_sub(status.available)
+    }
+
+    /// Close all idle server connections of the pool.
+    pub fn close_idle_connections(&self) {
+        self.database.retain(|_, _| false)
+    }
+
+    /// Close the idle server connections of the pool to a host.
+    pub fn close_idle_connections_to(&self, host: &str, port: u16) {
+        self.database
+            .retain(|server, _| !server.connected_to(host, port))
+    }
+
     pub fn retain_pool_connections(&self, count: Arc<AtomicUsize>, max: usize) {
-        self.database.retain(|_, metrics| {
+        let size = self.database.status().size;
+        self.database.retain(|server, metrics| {
             if count.load(Ordering::Relaxed) >= max {
                 return true;
             }
             if let Some(v) = metrics.recycled {
-                if (v.elapsed().as_millis() as u64) > self.settings.idle_timeout_ms {
+                // Idle connections are kept down to min_pool_size.
+                if (v.elapsed().as_millis() as u64) > self.settings.idle_timeout_ms
+                    && size - count.load(Ordering::Relaxed) > self.settings.min_size
+                {
                     count.fetch_add(1, Ordering::Relaxed);
                     return false;
                 }
             }
-            if (metrics.age().as_millis() as u64) > self.settings.life_time_ms {
+            if (metrics.age().as_millis() as u64) > server.lifetime(self.settings.life_time_ms) {
                 count.fetch_add(1, Ordering::Relaxed);
                 return false;
             }
@@ -365,6 +829,59 @@ impl ConnectionPool {
         })
     }
 
+    /// Get a server connection from the pool. A client waiting longer than
+    /// reserve_pool_timeout lets the pool grow by the reserve pool.
+    pub async fn checkout(&self) -> Result<managed::Object<ServerPool>, managed::PoolError<Error>> {
+        let checkout = self.database.get();
+        if self.settings.reserve_size == 0 || self.settings.reserve_pool_timeout_ms == 0 {
+            return checkout.await;
+        }
+        tokio::pin!(checkout);
+        tokio::select! {
+            result = &mut checkout => result,
+            _ = tokio::time::sleep(Duration::from_millis(self.settings.reserve_pool_timeout_ms)) => {
+                self.open_reserve_pool();
+                checkout.await
+            }
+        }
+    }
+
+    fn open_reserve_pool(&self) {
+        let max_size = self.settings.max_size + self.settings.reserve_size;
+        if self.database.status().max_size < max_size {
+            warn!(
+                "[pool: {}] Clients wait for a server longer than {}ms, using the reserve pool of {} connections",
+                self.address, self.settings.reserve_pool_timeout_ms, self.settings.reserve_size
+            );
+            self.database.resize(max_size);
+        }
+    }
+
+    /// Shrink the pool back to pool_size once no client waits for a server
+    /// and the connections in use fit into it. The idle reserve connections are closed.
+    pub fn close_reserve_pool(&self) {
+        let status = self.database.status();
+        if status.max_size > self.settings.max_size
+            && status.waiting == 0
+            && status.size - status.available <= self.settings.max_size
+        {
+            info!("[pool: {}] Closing the reserve pool", self.address);
+            self.database.resize(self.settings.max_size);
+        }
+    }
+
+    /// Open server connections until the pool has min_pool_size of them.
+    /// The idle connections are not taken away from the clients meanwhile,
+    /// and it stops when the clients use all of the pool.
+    pub async fn open_min_connections(&self) -> Result<(), managed::PoolError<Error>> {
+        while self.database.status().size < self.settings.min_size {
+            if !self.database.grow().await? {
+                break;
+            }
+        }
+        Ok(())
+    }
+
     /// Get the address information for a server.
     #[inline(always)]
     pub fn address(&self) -> &Address {
@@ -422,6 +939,9 @@ pub struct ServerPool {
     /// Server address.
     address: Address,
 
+    /// Hosts new server connections pick from.
+    balancer: Arc<HostBalancer>,
+
     /// Pool user.
     user: User,
 
@@ -450,6 +970,7 @@ impl ServerPool {
     #[allow(clippy::too_many_arguments)]
     pub fn new(
         address: Address,
+        balancer: Arc<HostBalancer>,
         user: User,
         database: &str,
         client_server_map: ClientServerMap,
@@ -460,6 +981,7 @@ impl ServerPool {
     ) -> ServerPool {
         ServerPool {
             address,
+            balancer,
             user: user.clone(),
             database: database.to_string(),
             client_server_map,
@@ -480,20 +1002,27 @@ impl managed::Manager for ServerPool {
     async fn create(&self) -> Result<Self::Type, Self::Error> {
         let mut guard = self.open_new_server.lock().await;
         *guard += 1;
+        let (host, port) = self.balancer.next_host();
+        let address = Address {
+            host: host.to_string(),
+            port,
+            ..self.address.clone()
+        };
         info!(
             "Creating a new server connection to {}[#{}]",
-            self.address, guard
+            address, guard
         );
         let stats = Arc::new(ServerStats::new(
-            self.address.clone(),
+            address.clone(),
             tokio::time::Instant::now(),
         ));
 
         stats.register(stats.clone());
 
         // Connect to the PostgreSQL server.
+        let connect_start = tokio::time::Instant::now();
         match Server::startup(
-            &self.address,
+            &address,
             &self.user,
             &self.database,
             self.client_server_map.clone(),
@@ -506,6 +1035,7 @@ impl managed::Manager for ServerPool {
         .await
         {
             Ok(conn) => {
+                stats.host().connect_succeeded(connect_start.elapsed());
                 // max rate limit 1 server connection per 10 ms.
                 tokio::time::sleep(Duration::from_millis(10)).await;
                 drop(guard);
@@ -513,6 +1043,8 @@ impl managed::Manager for ServerPool {
                 Ok(conn)
             }
             Err(err) => {
+                stats.host().connect_failed(&err);
+                self.balancer.mark_down(&address.host, address.port);
                 // if server feels bad sleep more.
                 tokio::time::sleep(Duration::from_millis(50)).await;
                 drop(guard);
@@ -534,6 +1066,18 @@ impl managed::Manager for ServerPool {
     }
 }
 
+/// Share of `total` connections of a virtual pool, the remainder of the division
+/// goes to the first virtual pools so none of the total is lost.
+fn virtual_pool_share(total: u32, virtual_pool_count: u16, virtual_pool_id: u16) -> usize {
+    let virtual_pool_count = virtual_pool_count.max(1) as u32;
+    let share = total / virtual_pool_count;
+    if (virtual_pool_id as u32) < total % virtual_pool_count {
+        share as usize + 1
+    } else {
+        share as usize
+    }
+}
+
 /// Get the connection pool
 pub fn get_pool(db: &str, user: &str, virtual_pool_id: u16) -> Option<ConnectionPool> {
     (*(*POOLS.load()))
@@ -546,14 +1090,108 @@ pub fn get_all_pools() -> HashMap<PoolIdentifierVirtual, ConnectionPool> {
     (*(*POOLS.load())).clone()
 }
 
+/// Open min_pool_size server connections in every pool, waiting at most `wait`.
+/// Returns the pools that didn't get all of them in time.
+pub async fn warm_up_pools(wait: Duration) -> Vec<String> {
+    let deadline = tokio::time::Instant::now() + wait;
+    let mut warmups = tokio::task::JoinSet::new();
+
+    for (identifier, pool) in get_all_pools() {
+        if pool.settings.min_size == 0 {
+            continue;
+        }
+        warmups.spawn(async move {
+            loop {
+                match tokio::time::timeout_at(deadline, pool.open_min_connections()).await {
+                    Ok(Ok(())) => break,
+                    Ok(Err(err)) => {
+                        warn!("[pool: {identifier}] Warm up connection error: {err:?}");
+                        if tokio::time::Instant::now() + Duration::from_millis(100) >= deadline {
+                            return Err(identifier);
+                        }
+                        tokio::time::sleep(Duration::from_millis(100)).await;
+                    }
+                    Err(_) => return Err(identifier),
+                }
+            }
+            info!(
+                "[pool: {identifier}] {} server connections are ready",
+                pool.settings.min_size
+            );
+            Ok(())
+        });
+    }
+
+    let mut not_ready = Vec::new();
+    while let Some(result) = warmups.join_next().await {
+        if let Ok(Err(identifier)) = result {
+            not_ready.push(identifier.to_string());
+        }
+    }
+    not_ready
+}
+
+/// Keep min_pool_size server connections open in every pool: open them at startup
+/// and after a reload, and open new ones when they are closed for their lifetime
+/// or an error, so that clients don't wait for the connect and the authentication.
+pub async fn maintain_min_connections() {
+    let mut interval = tokio::time::interval(tokio::time::Duration::from_secs(1));
+    loop {
+        interval.tick().await;
+        let mut fills = tokio::task::JoinSet::new();
+        for (identifier, pool) in get_all_pools() {
+            if pool.database.status().size >= pool.settings.min_size {
+                continue;
+            }
+            fills.spawn(async move {
+                if let Err(err) = pool.open_min_connections().await {
+                    warn!("[pool: {identifier}] Could not open min_pool_size server connections: {err:?}");
+                }
+            });
+        }
+        while fills.join_next().await.is_some() {}
+    }
+}
+
+/// Close the idle server connections past idle_timeout or their lifetime,
+/// at most one per pool a second so the reconnects are spread out,
+/// and the reserve pools that are not needed anymore.
 pub async fn retain_connections() {
-    let mut interval = tokio::time::interval(tokio::time::Duration::from_secs(60));
+    let mut interval = tokio::time::interval(tokio::time::Duration::from_secs(1));
     let count = Arc::new(AtomicUsize::new(0));
     loop {
         interval.tick().await;
         for (_, pool) in get_all_pools() {
+            pool.close_reserve_pool();
             pool.retain_pool_connections(count.clone(), 1);
+            count.store(0, Ordering::Relaxed);
         }
-        count.store(0, Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_virtual_pool_share() {
+        let shares: Vec<usize> = (0..4).map(|id| virtual_pool_share(6, 4, id)).collect();
+        assert_eq!(shares, vec![2, 2, 1, 1]);
+        let shares: Vec<usize> = (0..4).map(|id| virtual_pool_share(1, 4, id)).collect();
+        assert_eq!(shares, vec![1, 0, 0, 0]);
+        assert_eq!(virtual_pool_share(5, 1, 0), 5);
+        assert_eq!(virtual_pool_share(0, 4, 0), 0);
+    }
+
+    #[test]
+    fn test_pool_of_databases() {
+        let databases = vec!["app".to_string()];
+        assert!(pool_of_databases("app", &databases));
+        assert!(pool_of_databases("app/eu", &databases));
+        assert!(pool_of_databases("app/replica2", &databases));
+        assert!(!pool_of_databases("application", &databases));
+        assert!(!pool_of_databases("other/app", &databases));
+        assert_eq!(pool_database("app/replica2"), "app");
+        assert_eq!(pool_database("app"), "app");
     }
 }
@@ -0,0 +1,322 @@
+// Sampling profiler of the proxy hot path.
+//
+// Turned on and off at runtime with the admin PROFILE command, it times a sample
+// of the Parse and Bind messages processed, the pool checkouts and the TLS reads
+// and writes of the clients, with the size of the buffers they handle. SHOW
+// PROFILE breaks the samples down by section, so a regression can be narrowed
+// down in production without attaching an external profiler. While it's off
+// the only cost is the check of a flag.
+
+// Standard library imports
+use std::io;
+use std::pin::Pin;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::task::{Context, Poll};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use pin_project_lite::pin_project;
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+
+/// Histogram buckets, by power of two of nanoseconds.
+const BUCKETS: usize = 32;
+
+static PROFILER_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// One in this many events of each section is timed.
+static SAMPLE_EVERY: AtomicU64 = AtomicU64::new(1);
+
+/// Part of the hot path being profiled.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Section {
+    MessageParse,
+    PoolCheckout,
+    TlsRead,
+    TlsWrite,
+}
+
+impl Section {
+    pub const ALL: [Section; 4] = [
+        Section::MessageParse,
+        Section::PoolCheckout,
+        Section::TlsRead,
+        Section::TlsWrite,
+    ];
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Section::MessageParse => "message_parse",
+            Section::PoolCheckout => "pool_checkout",
+            Section::TlsRead => "tls_read",
+            Section::TlsWrite => "tls_write",
+        }
+    }
+}
+
+struct SectionStats {
+    /// Events seen while profiling, sampled or not.
+    events: AtomicU64,
+    samples: AtomicU64,
+    total_ns: AtomicU64,
+    max_ns: AtomicU64,
+    bytes: AtomicU64,
+    histogram: [AtomicU64; BUCKETS],
+}
+
+impl SectionStats {
+    const fn new() -> SectionStats {
+        SectionStats {
+            events: AtomicU64::new(0),
+            samples: AtomicU64::new(0),
+            total_ns: AtomicU64::new(0),
+            max_ns: AtomicU64::new(0),
+            bytes: AtomicU64::new(0),
+            histogram: [const { AtomicU64::new(0) }; BUCKETS],
+        }
+    }
+
+    fn clear(&self) {
+        self.events.store(0, Ordering::Relaxed);
+        self.samples.store(0, Ordering::Relaxed);
+        self.total_ns.store(0, Ordering::Relaxed);
+        self.max_ns.store(0, Ordering::Relaxed);
+        self.bytes.store(0, Ordering::Relaxed);
+        for bucket in &self.histogram {
+            bucket.store(0, Ordering::Relaxed);
+        }
+    }
+}
+
+static SECTIONS: [SectionStats; 4] = [const { SectionStats::new() }; 4];
+
+fn stats(section: Section) -> &'static SectionStats {
+    &SECTIONS[section as usize]
+}
+
+/// Start profiling from scratch, timing one in `sample_every` events.
+pub fn start_profiler(sample_every: u64) {
+    for section in &SECTIONS {
+        section.clear();
+    }
+    SAMPLE_EVERY.store(sample_every.max(1), Ordering::Relaxed);
+    PROFILER_ENABLED.store(true, Ordering::Relaxed);
+}
+
+/// Stop profiling, the samples are kept for SHOW PROFILE.
+pub fn stop_profiler() {
+    PROFILER_ENABLED.store(false, Ordering::Relaxed);
+}
+
+#[inline(always)]
+pub fn profiler_enabled() -> bool {
+    PROFILER_ENABLED.load(Ordering::Relaxed)
+}
+
+/// The event of the section is one of the sampled ones.
+fn sampled(section: Section) -> bool {
+    let event = stats(section).events.fetch_add(1, Ordering::Relaxed);
+    event % SAMPLE_EVERY.load(Ordering::Relaxed) == 0
+}
+
+fn add_sample(section: Section, elapsed: Duration, bytes: usize) {
+    let stats = stats(section);
+    let ns = elapsed.as_nanos().min(u64::MAX as u128) as u64;
+    let bucket = (u64::BITS - ns.leading_zeros()) as usize;
+    stats.samples.fetch_add(1, Ordering::Relaxed);
+    stats.total_ns.fetch_add(ns, Ordering::Relaxed);
+    stats.max_ns.fetch_max(ns, Ordering::Relaxed);
+    stats.bytes.fetch_add(bytes as u64, Ordering::Relaxed);
+    stats.histogram[bucket.min(BUCKETS - 1)].fetch_add(1, Ordering::Relaxed);
+}
+
+/// Record an event of the section that took `elapsed`, if it is sampled.
+#[inline(always)]
+pub fn record(section: Section, elapsed: Duration, bytes: usize) {
+    if profiler_enabled() && sampled(section) {
+        add_sample(section, elapsed, bytes);
+    }
+}
+
+/// An event being timed, recorded on drop.
+pub struct Sample {
+    section: Section,
+    bytes: usize,
+    started_at: Instant,
+}
+
+impl Drop for Sample {
+    fn drop(&mut self) {
+        add_sample(self.section, self.started_at.elapsed(), self.bytes);
+    }
+}
+
+/// Time an event of the section handling `bytes`, if the profiler is on and it is sampled.
+#[inline(always)]
+pub fn sample(section: Section, bytes: usize) -> Option<Sample> {
+    if !profiler_enabled() || !sampled(section) {
+        return None;
+    }
+    Some(Sample {
+        section,
+        bytes,
+        started_at: Instant::now(),
+    })
+}
+
+/// Breakdown of the samples of a section.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SectionProfile {
+    pub section: Section,
+    pub events: u64,
+    pub samples: u64,
+    pub avg_us: f64,
+    pub p50_us: f64,
+    pub p99_us: f64,
+    pub max_us: f64,
+    pub avg_bytes: u64,
+}
+
+/// Upper bound of the bucket the quantile of the samples falls in, in microseconds.
+fn quantile_us(histogram: &[u64; BUCKETS], samples: u64, quantile: f64) -> f64 {
+    if samples == 0 {
+        return 0.0;
+    }
+    let rank = ((samples as f64 * quantile).ceil() as u64).max(1);
+    let mut seen = 0;
+    for (bucket, count) in histogram.iter().enumerate() {
+        seen += count;
+        if seen >= rank {
+            return (1u64 << bucket) as f64 / 1000.0;
+        }
+    }
+    (1u64 << (BUCKETS - 1)) as f64 / 1000.0
+}
+
+/// Breakdown of the samples by section.
+pub fn profile() -> Vec<SectionProfile> {
+    Section::ALL
+        .iter()
+        .map(|&section| {
+            let stats = stats(section);
+            let samples = stats.samples.load(Ordering::Relaxed);
+            let histogram: [u64; BUCKETS] =
+                std::array::from_fn(|bucket| stats.histogram[bucket].load(Ordering::Relaxed));
+            let per_sample = |total: u64| if samples == 0 { 0 } else { total / samples };
+            SectionProfile {
+                section,
+                events: stats.events.load(Ordering::Relaxed),
+                samples,
+                avg_us: per_sample(stats.total_ns.load(Ordering::Relaxed)) as f64 / 1000.0,
+                p50_us: quantile_us(&histogram, samples, 0.5),
+                p99_us: quantile_us(&histogram, samples, 0.99),
+                max_us: stats.max_ns.load(Ordering::Relaxed) as f64 / 1000.0,
+                avg_bytes: per_sample(stats.bytes.load(Ordering::Relaxed)),
+            }
+        })
+        .collect()
+}
+
+pin_project! {
+    /// Client TLS stream timing the reads and writes, decryption and encryption included.
+    /// Only the work done in a poll is timed, not the wait for the socket.
+    #[derive(Debug)]
+    pub struct ProfiledStream<S> {
+        #[pin]
+        inner: S,
+    }
+}
+
+impl<S> ProfiledStream<S> {
+    pub fn new(inner: S) -> ProfiledStream<S> {
+        ProfiledStream { inner }
+    }
+}
+
+impl<S: AsyncRead> AsyncRead for ProfiledStream<S> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.project();
+        if !profiler_enabled() {
+            return this.inner.poll_read(cx, buf);
+        }
+        let filled = buf.filled().len();
+        let started_at = Instant::now();
+        let result = this.inner.poll_read(cx, buf);
+        if let Poll::Ready(Ok(())) = result {
+            record(
+                Section::TlsRead,
+                started_at.elapsed(),
+                buf.filled().len() - filled,
+            );
+        }
+        result
+    }
+}
+
+impl<S: AsyncWrite> AsyncWrite for ProfiledStream<S> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.project();
+        if !profiler_enabled() {
+            return this.inner.poll_write(cx, buf);
+        }
+        let started_at = Instant::now();
+        let result = this.inner.poll_write(cx, buf);
+        if let Poll::Ready(Ok(written)) = result {
+            record(Section::TlsWrite, started_at.elapsed(), written);
+        }
+        result
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        self.project().inner.poll_flush(cx)
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        self.project().inner.poll_shutdown(cx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_quantile_us() {
+        let mut histogram = [0u64; BUCKETS];
+        // 90 samples under 1.024us, 10 under 1.048576ms.
+        histogram[10] = 90;
+        histogram[20] = 10;
+        assert_eq!(quantile_us(&histogram, 100, 0.5), 1.024);
+        assert_eq!(quantile_us(&histogram, 100, 0.99), 1048.576);
+        assert_eq!(quantile_us(&histogram, 0, 0.99), 0.0);
+    }
+
+    #[test]
+    fn test_profiler() {
+        start_profiler(2);
+        for _ in 0..4 {
+            record(Section::PoolCheckout, Duration::from_micros(100), 0);
+            drop(sample(Section::MessageParse, 64));
+        }
+        stop_profiler();
+        // Nothing is recorded while the profiler is off.
+        record(Section::PoolCheckout, Duration::from_micros(100), 0);
+
+        let profile = profile();
+        let checkout = &profile[Section::PoolCheckout as usize];
+        assert_eq!((checkout.events, checkout.samples), (4, 2));
+        assert_eq!(checkout.avg_us, 100.0);
+        assert_eq!(checkout.max_us, 100.0);
+        assert_eq!(checkout.p50_us, 131.072);
+        let parse = &profile[Section::MessageParse as usize];
+        assert_eq!((parse.samples, parse.avg_bytes), (2, 64));
+        assert_eq!(profile[Section::TlsRead as usize].samples, 0);
+    }
+}
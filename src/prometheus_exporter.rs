@@ -1,21 +1,43 @@
-use crate::pool::StatsPoolIdentifier;
+use crate::admission::{backend_loads, THROTTLED_CHECKOUTS_COUNTER};
+use crate::audit::{AUDIT_RECORDS_DROPPED_COUNTER, AUDIT_RECORDS_WRITTEN_COUNTER};
+use crate::cancel_limit::{CANCEL_HANDLERS_COUNT, CANCEL_SHED_COUNTER, CANCEL_TIMEOUT_COUNTER};
+use crate::client::{
+    BATCH_MESSAGE_TIMEOUT_COUNTER, BATCH_TIMEOUT_COUNTER, SYNC_RESPONSE_TIMEOUT_COUNTER,
+};
+use crate::config::get_config;
+use crate::events::{EVENTS_DROPPED_COUNTER, EVENTS_WRITTEN_COUNTER};
+use crate::fd_limit::{ACCEPT_FD_EXHAUSTED_COUNTER, CONNECT_FD_EXHAUSTED_COUNTER};
+use crate::health_endpoint::health_http_response;
+use crate::login_limit::{AUTH_FAILURE_DELAYED_COUNTER, LOGIN_RATE_LIMITED_COUNTER};
+use crate::peering::CANCEL_FORWARDED_COUNTER;
+use crate::pool::{get_all_pools, StatsPoolIdentifier};
+use crate::startup_pacing::PACED_STARTUPS_COUNTER;
 /// Prometheus metrics exporter for pg_doorman
 #[cfg(target_os = "linux")]
 use crate::stats::get_socket_states_count;
 use crate::stats::pool::PoolStats;
+use crate::stats::prepared_transactions::get_prepared_transactions;
 use crate::stats::{
     get_server_stats, CANCEL_CONNECTION_COUNTER, PLAIN_CONNECTION_COUNTER, TLS_CONNECTION_COUNTER,
     TOTAL_CONNECTION_COUNTER,
 };
+use crate::tls::configured_certificates_expiry;
+use crate::transaction_limit::{
+    TRANSACTION_DURATION_LIMIT_COUNTER, TRANSACTION_DURATION_WARNING_COUNTER,
+};
 use flate2::write::GzEncoder;
 use flate2::Compression;
 use log::{error, info};
 use once_cell::sync::Lazy;
 use prometheus::{Encoder, Gauge, GaugeVec, Opts, Registry, TextEncoder};
+use std::collections::HashMap;
 use std::io::Write;
 use std::net::SocketAddr;
 use std::sync::atomic::Ordering;
-use tokio::net::TcpSocket;
+use std::time::Duration;
+use tokio::io::{BufReader, BufWriter};
+use tokio::net::tcp::{OwnedReadHalf, OwnedWriteHalf};
+use tokio::net::{TcpSocket, TcpStream};
 
 // Define the metrics we want to expose
 static REGISTRY: Lazy<Registry> = Lazy::new(Registry::new);
@@ -41,6 +63,169 @@ static SHOW_CONNECTIONS: Lazy<GaugeVec> = Lazy::new(|| {
     gauge
 });
 
+static CANCEL_REQUESTS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_cancel_requests",
+            "Cancel requests by status. Status values include: 'active' (being forwarded to the server right now), 'shed' (counter of requests dropped because max_cancel_connections were being handled) and 'timeout' (counter of requests not forwarded within cancel_timeout).",
+        ),
+        &["status"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static SERVER_RESET_TIMEOUTS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_server_reset_timeouts",
+            "Counter of server connections closed by user and database because the reset queries (ROLLBACK, RESET ALL, etc.) didn't complete within server_reset_timeout. A growing value points to wedged backends.",
+        ),
+        &["user", "database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static QUERY_WAIT_TIMEOUTS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_query_wait_timeouts",
+            "Counter of clients by user and database that got no server connection within query_wait_timeout because all servers of the pool were busy.",
+        ),
+        &["user", "database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static AUTH_FAILURES: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_auth_failures",
+            "Counter of clients refused by authentication (wrong password, rejected certificate or token, hba_file rules) by user and database.",
+        ),
+        &["user", "database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static BATCH_TIMEOUTS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_batch_timeouts",
+            "Counter of extended protocol batches aborted by timeout. Types include: 'sync_response' (no server response to Sync within sync_response_timeout), 'batch' (the batch took longer than batch_timeout) and 'message' (the client sent nothing of its unfinished batch within batch_message_timeout).",
+        ),
+        &["type"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static TRANSACTION_DURATION_LIMITS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_transaction_duration_limits",
+            "Counter of transactions running too long. Types include: 'warning' (the client was warned at transaction_duration_warning) and 'cancel' (the transaction was cancelled at transaction_duration_limit).",
+        ),
+        &["type"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static BACKEND_LOAD: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_backend_load",
+            "Last result of load_check_query of the database.",
+        ),
+        &["database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static CHECKOUTS_THROTTLED: Lazy<Gauge> = Lazy::new(|| {
+    let gauge = Gauge::new(
+        "pg_doorman_checkouts_throttled",
+        "Counter of server checkouts that waited because the server was overloaded (load_threshold).",
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static LOGINS_THROTTLED: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_logins_throttled",
+            "Counter of throttled client logins by reason. Reason values include: 'rate_limit' (connections closed over login_rate_limit or login_rate_limit_per_ip) and 'auth_failure' (logins delayed after auth failures of their address).",
+        ),
+        &["reason"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static STARTUPS_PACED: Lazy<Gauge> = Lazy::new(|| {
+    let gauge = Gauge::new(
+        "pg_doorman_startups_paced",
+        "Counter of client startups that waited behind identical startups from the same address (startup_burst_limit).",
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static FD_EXHAUSTED: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_fd_exhausted_count",
+            "Counter of operations that failed because pg_doorman or the system ran out of file descriptors (EMFILE/ENFILE). Operations include: 'accept' (new client connections) and 'connect' (new server connections).",
+        ),
+        &["operation"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static EVENTS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_events_count",
+            "Counter of events of the event_sink stream by status. Status include: 'written' (written to the sink) and 'dropped' (lost because the queue was full while the sink was slow or unavailable).",
+        ),
+        &["status"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static AUDIT_RECORDS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_audit_records_count",
+            "Counter of records of the audit_log by status. Status include: 'written' (written to the audit log) and 'dropped' (lost because the queue was full while the audit log was slow or unavailable).",
+        ),
+        &["status"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
 #[cfg(target_os = "linux")]
 static SHOW_SOCKETS: Lazy<GaugeVec> = Lazy::new(|| {
     let counter = GaugeVec::new(
@@ -211,6 +396,45 @@ static SHOW_SERVERS_PREPARED_MISSES: Lazy<GaugeVec> = Lazy::new(|| {
     gauge
 });
 
+static TLS_CERTIFICATE_EXPIRY: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_tls_certificate_expiry_timestamp",
+            "Expiry time (notAfter) of the configured TLS certificates as a unix timestamp, by certificate type and path. Types include: 'server' (tls_certificate) and 'ca' (tls_ca_cert). Helps alert before a certificate outage.",
+        ),
+        &["type", "path"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static PREPARED_TRANSACTIONS: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_prepared_transactions",
+            "Number of prepared transactions (two-phase commit) created through pg_doorman and not committed or rolled back yet, by database. Only pools with track_prepared_transactions are counted.",
+        ),
+        &["database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
+static PREPARED_TRANSACTIONS_MAX_AGE: Lazy<GaugeVec> = Lazy::new(|| {
+    let gauge = GaugeVec::new(
+        Opts::new(
+            "pg_doorman_prepared_transactions_max_age_seconds",
+            "Age in seconds of the oldest prepared transaction created through pg_doorman, by database. Forgotten prepared transactions hold locks and prevent vacuum from removing dead rows.",
+        ),
+        &["database"],
+    )
+    .unwrap();
+    REGISTRY.register(Box::new(gauge.clone())).unwrap();
+    gauge
+});
+
 /// Updates all metrics before they are exposed via the Prometheus endpoint.
 fn update_metrics() {
     update_memory_metrics();
@@ -221,6 +445,57 @@ fn update_metrics() {
 
     update_pool_metrics();
     update_server_metrics();
+    update_tls_metrics();
+    update_prepared_transactions_metrics();
+    update_pool_counter_metrics();
+}
+
+fn update_pool_counter_metrics() {
+    let mut counters: HashMap<(String, String), (u64, u64, u64)> = HashMap::new();
+    for (identifier, pool) in get_all_pools() {
+        let (reset_timeouts, auth_failures, query_wait_timeouts) = counters
+            .entry((identifier.user, identifier.db))
+            .or_default();
+        *reset_timeouts += pool.address.stats.reset_timeouts.load(Ordering::Relaxed);
+        *auth_failures += pool.address.stats.auth_failures.load(Ordering::Relaxed);
+        *query_wait_timeouts += pool
+            .address
+            .stats
+            .query_wait_timeouts
+            .load(Ordering::Relaxed);
+    }
+    for ((user, database), (reset_timeouts, auth_failures, query_wait_timeouts)) in counters {
+        SERVER_RESET_TIMEOUTS
+            .with_label_values(&[&user, &database])
+            .set(reset_timeouts as f64);
+        AUTH_FAILURES
+            .with_label_values(&[&user, &database])
+            .set(auth_failures as f64);
+        QUERY_WAIT_TIMEOUTS
+            .with_label_values(&[&user, &database])
+            .set(query_wait_timeouts as f64);
+    }
+}
+
+fn update_prepared_transactions_metrics() {
+    PREPARED_TRANSACTIONS.reset();
+    PREPARED_TRANSACTIONS_MAX_AGE.reset();
+    let now = chrono::Local::now();
+    for transaction in get_prepared_transactions() {
+        let database = transaction.database.as_str();
+        PREPARED_TRANSACTIONS.with_label_values(&[database]).inc();
+        let max_age = PREPARED_TRANSACTIONS_MAX_AGE.with_label_values(&[database]);
+        max_age.set(max_age.get().max(transaction.age(now) as f64));
+    }
+}
+
+fn update_tls_metrics() {
+    TLS_CERTIFICATE_EXPIRY.reset();
+    for cert in configured_certificates_expiry(&get_config()) {
+        TLS_CERTIFICATE_EXPIRY
+            .with_label_values(&[cert.kind, &cert.path])
+            .set(cert.not_after as f64);
+    }
 }
 
 fn update_memory_metrics() {
@@ -240,6 +515,87 @@ fn update_connection_metrics() {
             .with_label_values(&[conn_type])
             .set(counter.load(Ordering::Relaxed) as f64);
     }
+
+    let fd_exhausted = [
+        ("accept", &ACCEPT_FD_EXHAUSTED_COUNTER),
+        ("connect", &CONNECT_FD_EXHAUSTED_COUNTER),
+    ];
+    for (operation, counter) in &fd_exhausted {
+        FD_EXHAUSTED
+            .with_label_values(&[operation])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    let events = [
+        ("written", &EVENTS_WRITTEN_COUNTER),
+        ("dropped", &EVENTS_DROPPED_COUNTER),
+    ];
+    for (status, counter) in &events {
+        EVENTS
+            .with_label_values(&[status])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    let audit_records = [
+        ("written", &AUDIT_RECORDS_WRITTEN_COUNTER),
+        ("dropped", &AUDIT_RECORDS_DROPPED_COUNTER),
+    ];
+    for (status, counter) in &audit_records {
+        AUDIT_RECORDS
+            .with_label_values(&[status])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    let batch_timeouts = [
+        ("sync_response", &SYNC_RESPONSE_TIMEOUT_COUNTER),
+        ("batch", &BATCH_TIMEOUT_COUNTER),
+        ("message", &BATCH_MESSAGE_TIMEOUT_COUNTER),
+    ];
+    for (timeout_type, counter) in &batch_timeouts {
+        BATCH_TIMEOUTS
+            .with_label_values(&[timeout_type])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    let transaction_duration_limits = [
+        ("warning", &TRANSACTION_DURATION_WARNING_COUNTER),
+        ("cancel", &TRANSACTION_DURATION_LIMIT_COUNTER),
+    ];
+    for (limit_type, counter) in &transaction_duration_limits {
+        TRANSACTION_DURATION_LIMITS
+            .with_label_values(&[limit_type])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    BACKEND_LOAD.reset();
+    for (database, load) in backend_loads() {
+        BACKEND_LOAD.with_label_values(&[&database]).set(load);
+    }
+    CHECKOUTS_THROTTLED.set(THROTTLED_CHECKOUTS_COUNTER.load(Ordering::Relaxed) as f64);
+
+    STARTUPS_PACED.set(PACED_STARTUPS_COUNTER.load(Ordering::Relaxed) as f64);
+
+    let logins_throttled = [
+        ("rate_limit", &LOGIN_RATE_LIMITED_COUNTER),
+        ("auth_failure", &AUTH_FAILURE_DELAYED_COUNTER),
+    ];
+    for (reason, counter) in &logins_throttled {
+        LOGINS_THROTTLED
+            .with_label_values(&[reason])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
+
+    let cancel_requests = [
+        ("active", &CANCEL_HANDLERS_COUNT),
+        ("shed", &CANCEL_SHED_COUNTER),
+        ("timeout", &CANCEL_TIMEOUT_COUNTER),
+        ("forwarded", &CANCEL_FORWARDED_COUNTER),
+    ];
+    for (status, counter) in &cancel_requests {
+        CANCEL_REQUESTS
+            .with_label_values(&[status])
+            .set(counter.load(Ordering::Relaxed) as f64);
+    }
 }
 
 #[cfg(target_os = "linux")]
@@ -404,31 +760,107 @@ fn update_percentile_metrics(identifier: &StatsPoolIdentifier, stats: &PoolStats
     }
 }
 
+/// Paths answered by the health endpoints on the main listener.
+const HEALTH_PATHS: [&str; 4] = ["/health", "/healthz", "/livez", "/readyz"];
+
+/// Path of the metrics on the main listener, served when the exporter is enabled.
+const METRICS_PATH: &str = "/metrics";
+
+/// How long to wait for the first bytes of a connection on the main listener.
+const PROTOCOL_DETECT_TIMEOUT: Duration = Duration::from_secs(1);
+
 /// Handles HTTP requests for metrics
-async fn handle_metrics_request(stream: tokio::net::TcpStream) {
-    // Clone the stream for reading
+async fn handle_metrics_request(stream: TcpStream) {
+    let (read_half, write_half) = stream.into_split();
+    let mut stream_reader = BufReader::new(read_half);
+    let mut connection = BufWriter::new(write_half);
+
+    if let Some(headers) = read_http_request(&mut stream_reader).await {
+        write_metrics_response(&mut connection, &headers).await;
+    }
+}
+
+/// True if the connection on the main listener speaks HTTP rather than the PostgreSQL protocol.
+///
+/// Every PostgreSQL client starts with a big-endian message length (or an SSL/GSS/cancel
+/// request code) whose first byte is zero, while HTTP requests start with the method name.
+pub async fn is_http_connection(stream: &TcpStream) -> bool {
+    let mut first_byte = [0; 1];
+    match tokio::time::timeout(PROTOCOL_DETECT_TIMEOUT, stream.peek(&mut first_byte)).await {
+        Ok(Ok(1)) => first_byte[0].is_ascii_uppercase(),
+        _ => false,
+    }
+}
+
+/// Handles an HTTP request that arrived on the PostgreSQL listener (`http_on_main_port`):
+/// the health endpoints on their paths, the metrics on /metrics if the exporter is enabled,
+/// 404 on any other path.
+pub async fn handle_main_port_http_request(stream: TcpStream) {
     let (read_half, write_half) = stream.into_split();
-    let mut stream_reader = tokio::io::BufReader::new(read_half);
-    let mut connection = tokio::io::BufWriter::new(write_half);
+    let mut stream_reader = BufReader::new(read_half);
+    let mut connection = BufWriter::new(write_half);
+
+    let headers = match read_http_request(&mut stream_reader).await {
+        Some(headers) => headers,
+        None => return,
+    };
+
+    let path = http_request_path(&headers);
+    if path == METRICS_PATH && get_config().prometheus.enabled {
+        write_metrics_response(&mut connection, &headers).await;
+        return;
+    }
+
+    // Load balancers stop sending new clients while pg_doorman drains the existing ones.
+    let response = if HEALTH_PATHS.contains(&path) {
+        health_http_response(headers.lines().next().unwrap_or_default())
+    } else {
+        let body = "not found\n";
+        format!(
+            "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{body}",
+            body.len()
+        )
+    };
+    if let Err(e) = tokio::io::AsyncWriteExt::write_all(&mut connection, response.as_bytes()).await
+    {
+        error!("Failed to write HTTP response: {e}");
+        return;
+    }
+    if let Err(e) = tokio::io::AsyncWriteExt::flush(&mut connection).await {
+        error!("Failed to flush connection: {e}");
+    }
+}
+
+/// Path of the request line, e.g. "/metrics" for "GET /metrics?x=1 HTTP/1.1".
+fn http_request_path(headers: &str) -> &str {
+    let target = headers.split_whitespace().nth(1).unwrap_or("/");
+    target.split('?').next().unwrap_or(target)
+}
+
+/// Read the HTTP request headers.
+async fn read_http_request(stream_reader: &mut BufReader<OwnedReadHalf>) -> Option<String> {
     let mut headers = [0; 1024];
 
     // Read HTTP request headers
-    let n = match tokio::io::AsyncReadExt::read(&mut stream_reader, &mut headers).await {
+    let n = match tokio::io::AsyncReadExt::read(stream_reader, &mut headers).await {
         Ok(n) => n,
         Err(e) => {
             error!("Failed to read HTTP request: {e}");
-            return;
+            return None;
         }
     };
 
-    let headers_str = match std::str::from_utf8(&headers[..n]) {
-        Ok(s) => s,
+    match std::str::from_utf8(&headers[..n]) {
+        Ok(s) => Some(s.to_string()),
         Err(e) => {
             error!("Failed to parse HTTP headers: {e}");
-            return;
+            None
         }
-    };
+    }
+}
 
+/// Send the metrics, compressed if the client accepts gzip.
+async fn write_metrics_response(connection: &mut BufWriter<OwnedWriteHalf>, headers_str: &str) {
     // Check if client accepts gzip encoding
     let accepts_gzip =
         headers_str.contains("Accept-Encoding") && headers_str.to_lowercase().contains("gzip");
@@ -477,18 +909,17 @@ async fn handle_metrics_request(stream: tokio::net::TcpStream) {
     );
 
     // Send response
-    if let Err(e) = tokio::io::AsyncWriteExt::write_all(&mut connection, response.as_bytes()).await
-    {
+    if let Err(e) = tokio::io::AsyncWriteExt::write_all(connection, response.as_bytes()).await {
         error!("Failed to write HTTP response header: {e}");
         return;
     }
 
-    if let Err(e) = tokio::io::AsyncWriteExt::write_all(&mut connection, &response_body).await {
+    if let Err(e) = tokio::io::AsyncWriteExt::write_all(connection, &response_body).await {
         error!("Failed to write metrics data: {e}");
         return;
     }
 
-    if let Err(e) = tokio::io::AsyncWriteExt::flush(&mut connection).await {
+    if let Err(e) = tokio::io::AsyncWriteExt::flush(connection).await {
         error!("Failed to flush connection: {e}");
     }
 }
@@ -546,9 +977,7 @@ pub async fn start_prometheus_server(host: &str) {
             }
         }
         Err(e) => {
-            panic!(
-                "Failed to bind Prometheus metrics server to {addr}: {e}"
-            );
+            panic!("Failed to bind Prometheus metrics server to {addr}: {e}");
         }
     }
 }
@@ -600,3 +1029,21 @@ fn get_process_memory_usage() -> u64 {
         0
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_http_request_path() {
+        assert_eq!(
+            http_request_path("GET /health HTTP/1.1\r\nHost: x\r\n\r\n"),
+            "/health"
+        );
+        assert_eq!(
+            http_request_path("GET /metrics?name[]=x HTTP/1.1\r\n"),
+            "/metrics"
+        );
+        assert_eq!(http_request_path(""), "/");
+    }
+}
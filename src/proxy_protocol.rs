@@ -0,0 +1,189 @@
+// PROXY protocol header of the clients of load balancers.
+//
+// Behind HAProxy or a network load balancer every client connects from the
+// address of the balancer. On listeners with proxy_protocol the balancer sends a
+// PROXY header (version 1 or 2) with the address of the client before the
+// startup packet, and that address is used for the logs, SHOW CLIENTS and hba.
+
+// Standard library imports
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+
+// External crate imports
+use tokio::io::{AsyncRead, AsyncReadExt};
+
+// Internal crate imports
+use crate::errors::Error;
+
+/// Signature of the version 2 header.
+const V2_SIGNATURE: [u8; 12] = *b"\r\n\r\n\0\r\nQUIT\n";
+
+/// Longest version 1 header, "\r\n" included.
+const V1_MAX_LENGTH: usize = 107;
+
+fn bad_header(reason: &str) -> Error {
+    Error::ProtocolViolation(format!("bad PROXY protocol header: {reason}"))
+}
+
+/// Read the PROXY header at the start of the stream, nothing past it.
+/// The address of the client, None for the connections of the balancer itself
+/// (health checks): LOCAL in version 2, UNKNOWN in version 1.
+pub async fn read_proxy_header<S>(stream: &mut S) -> Result<Option<SocketAddr>, Error>
+where
+    S: AsyncRead + Unpin,
+{
+    // Both versions are longer than the signature of version 2.
+    let mut header = vec![0u8; V2_SIGNATURE.len()];
+    if let Err(err) = stream.read_exact(&mut header).await {
+        return Err(Error::SocketError(format!(
+            "Failed to read PROXY protocol header: {err}"
+        )));
+    }
+    if header == V2_SIGNATURE {
+        return read_v2(stream).await;
+    }
+    if !header.starts_with(b"PROXY ") {
+        return Err(bad_header("no PROXY signature"));
+    }
+    while !header.ends_with(b"\r\n") {
+        if header.len() == V1_MAX_LENGTH {
+            return Err(bad_header("line too long"));
+        }
+        match stream.read_u8().await {
+            Ok(byte) => header.push(byte),
+            Err(err) => {
+                return Err(Error::SocketError(format!(
+                    "Failed to read PROXY protocol header: {err}"
+                )))
+            }
+        }
+    }
+    parse_v1(&header[..header.len() - 2])
+}
+
+/// "PROXY TCP4 <source> <destination> <source port> <destination port>".
+fn parse_v1(line: &[u8]) -> Result<Option<SocketAddr>, Error> {
+    let line = std::str::from_utf8(line).map_err(|_| bad_header("not ASCII"))?;
+    let fields: Vec<&str> = line.split(' ').collect();
+    match fields.as_slice() {
+        ["PROXY", "UNKNOWN", ..] => Ok(None),
+        ["PROXY", protocol @ ("TCP4" | "TCP6"), source, _, source_port, _] => {
+            let ip: IpAddr = source.parse().map_err(|_| bad_header("bad address"))?;
+            if ip.is_ipv4() != (*protocol == "TCP4") {
+                return Err(bad_header("address doesn't match the protocol"));
+            }
+            let port: u16 = source_port.parse().map_err(|_| bad_header("bad port"))?;
+            Ok(Some(SocketAddr::new(ip, port)))
+        }
+        _ => Err(bad_header(line)),
+    }
+}
+
+/// The rest of a version 2 header, after the signature.
+async fn read_v2<S>(stream: &mut S) -> Result<Option<SocketAddr>, Error>
+where
+    S: AsyncRead + Unpin,
+{
+    let mut fixed = [0u8; 4];
+    if let Err(err) = stream.read_exact(&mut fixed).await {
+        return Err(Error::SocketError(format!(
+            "Failed to read PROXY protocol header: {err}"
+        )));
+    }
+    let length = u16::from_be_bytes([fixed[2], fixed[3]]) as usize;
+    // Addresses and TLVs, read whole to leave the stream at the startup packet.
+    let mut addresses = vec![0u8; length];
+    if let Err(err) = stream.read_exact(&mut addresses).await {
+        return Err(Error::SocketError(format!(
+            "Failed to read PROXY protocol header: {err}"
+        )));
+    }
+    parse_v2(fixed[0], fixed[1], &addresses)
+}
+
+fn parse_v2(
+    version_command: u8,
+    family: u8,
+    addresses: &[u8],
+) -> Result<Option<SocketAddr>, Error> {
+    if version_command >> 4 != 2 {
+        return Err(bad_header("unsupported version"));
+    }
+    match version_command & 0x0f {
+        // LOCAL
+        0 => return Ok(None),
+        // PROXY
+        1 => (),
+        _ => return Err(bad_header("unsupported command")),
+    }
+    match family {
+        // TCP over IPv4: source, destination, source port, destination port.
+        0x11 if addresses.len() >= 12 => {
+            let ip = Ipv4Addr::from(<[u8; 4]>::try_from(&addresses[0..4]).unwrap());
+            let port = u16::from_be_bytes([addresses[8], addresses[9]]);
+            Ok(Some(SocketAddr::new(IpAddr::V4(ip), port)))
+        }
+        // TCP over IPv6.
+        0x21 if addresses.len() >= 36 => {
+            let ip = Ipv6Addr::from(<[u8; 16]>::try_from(&addresses[0..16]).unwrap());
+            let port = u16::from_be_bytes([addresses[32], addresses[33]]);
+            Ok(Some(SocketAddr::new(IpAddr::V6(ip), port)))
+        }
+        0x11 | 0x21 => Err(bad_header("addresses too short")),
+        // UNSPEC, UDP and unix sockets: no address of a TCP client.
+        _ => Ok(None),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_read_proxy_header_v1() {
+        let mut stream: &[u8] = b"PROXY TCP4 192.168.0.1 10.0.0.5 56324 6432\r\nstartup";
+        let addr = read_proxy_header(&mut stream).await.unwrap();
+        assert_eq!(addr, Some("192.168.0.1:56324".parse().unwrap()));
+        assert_eq!(stream, b"startup");
+
+        let mut stream: &[u8] = b"PROXY TCP6 2001:db8::1 2001:db8::2 4000 6432\r\n";
+        let addr = read_proxy_header(&mut stream).await.unwrap();
+        assert_eq!(addr, Some("[2001:db8::1]:4000".parse().unwrap()));
+
+        let mut stream: &[u8] = b"PROXY UNKNOWN\r\n";
+        assert_eq!(read_proxy_header(&mut stream).await.unwrap(), None);
+
+        for header in [
+            &b"PROXY TCP4 2001:db8::1 10.0.0.5 1 2\r\n"[..],
+            b"PROXY TCP4 192.168.0.1 10.0.0.5 56324\r\n",
+            b"GET / HTTP/1.1\r\n\r\n",
+        ] {
+            let mut stream = header;
+            assert!(read_proxy_header(&mut stream).await.is_err());
+        }
+    }
+
+    #[tokio::test]
+    async fn test_read_proxy_header_v2() {
+        let mut header = V2_SIGNATURE.to_vec();
+        // PROXY over TCP/IPv4, with a 3 bytes TLV after the addresses.
+        header.extend_from_slice(&[0x21, 0x11, 0, 15]);
+        header.extend_from_slice(&[192, 168, 0, 1, 10, 0, 0, 5]);
+        header.extend_from_slice(&56324u16.to_be_bytes());
+        header.extend_from_slice(&6432u16.to_be_bytes());
+        header.extend_from_slice(&[0x04, 0, 0]);
+        header.extend_from_slice(b"startup");
+        let mut stream = header.as_slice();
+        let addr = read_proxy_header(&mut stream).await.unwrap();
+        assert_eq!(addr, Some("192.168.0.1:56324".parse().unwrap()));
+        assert_eq!(stream, b"startup");
+
+        // LOCAL: health check of the balancer.
+        let mut header = V2_SIGNATURE.to_vec();
+        header.extend_from_slice(&[0x20, 0x00, 0, 0]);
+        let mut stream = header.as_slice();
+        assert_eq!(read_proxy_header(&mut stream).await.unwrap(), None);
+
+        assert!(parse_v2(0x11, 0x11, &[0; 12]).is_err());
+        assert!(parse_v2(0x21, 0x21, &[0; 12]).is_err());
+    }
+}
@@ -0,0 +1,202 @@
+// Accounting of protocol violations per client address.
+//
+// A client that breaks the protocol gets the same error PostgreSQL would send
+// and is disconnected. Addresses that keep doing it can be blocked for a while,
+// so a broken or malicious client doesn't use up the pooler.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::warn;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+// Internal crate imports
+use crate::config::get_config;
+use crate::errors::Error;
+use crate::messages::DataType;
+
+#[derive(Debug, Clone)]
+/// Protocol violations of a single client address.
+pub struct Violations {
+    /// Violations since the address was first seen.
+    pub total: u64,
+    /// Violations in the current window.
+    count: u64,
+    window_start: Instant,
+    pub last_at: Instant,
+    pub last_error: String,
+    pub blocked_until: Option<Instant>,
+}
+
+impl Violations {
+    pub fn generate_show_protocol_violations_header() -> Vec<(&'static str, DataType)> {
+        vec![
+            ("addr", DataType::Text),
+            ("violations", DataType::Numeric),
+            ("last_violation_seconds_ago", DataType::Numeric),
+            ("last_error", DataType::Text),
+            ("blocked_seconds_left", DataType::Numeric),
+        ]
+    }
+
+    pub fn generate_show_protocol_violations_row(&self, addr: &IpAddr) -> Vec<String> {
+        let now = Instant::now();
+        let blocked_left = match self.blocked_until {
+            Some(until) => until.saturating_duration_since(now).as_secs(),
+            None => 0,
+        };
+        vec![
+            addr.to_string(),
+            self.total.to_string(),
+            now.saturating_duration_since(self.last_at)
+                .as_secs()
+                .to_string(),
+            self.last_error.clone(),
+            blocked_left.to_string(),
+        ]
+    }
+}
+
+#[derive(Debug, Default)]
+struct ViolationTracker {
+    addrs: HashMap<IpAddr, Violations>,
+}
+
+impl ViolationTracker {
+    /// Count a violation of `addr`. Returns true if the address got blocked.
+    fn record(
+        &mut self,
+        addr: IpAddr,
+        error: String,
+        now: Instant,
+        limit: u64,
+        window: Duration,
+    ) -> bool {
+        // Forget addresses that have been quiet for a whole window.
+        self.addrs.retain(|_, violations| {
+            now.saturating_duration_since(violations.last_at) < window
+                || violations.blocked_until.is_some_and(|until| until > now)
+        });
+
+        let violations = self.addrs.entry(addr).or_insert_with(|| Violations {
+            total: 0,
+            count: 0,
+            window_start: now,
+            last_at: now,
+            last_error: String::new(),
+            blocked_until: None,
+        });
+        if now.saturating_duration_since(violations.window_start) >= window {
+            violations.count = 0;
+            violations.window_start = now;
+        }
+        violations.total += 1;
+        violations.count += 1;
+        violations.last_at = now;
+        violations.last_error = error;
+
+        if limit == 0 || violations.count < limit {
+            return false;
+        }
+        violations.count = 0;
+        violations.window_start = now;
+        violations.blocked_until = Some(now + window);
+        true
+    }
+
+    fn is_blocked(&self, addr: &IpAddr, now: Instant) -> bool {
+        match self.addrs.get(addr) {
+            Some(violations) => violations.blocked_until.is_some_and(|until| until > now),
+            None => false,
+        }
+    }
+}
+
+static PROTOCOL_VIOLATIONS: Lazy<Mutex<ViolationTracker>> =
+    Lazy::new(|| Mutex::new(ViolationTracker::default()));
+
+/// Count the error a client disconnected with, if it is a protocol violation.
+pub fn record_protocol_violation(addr: IpAddr, err: &Error) {
+    if !matches!(err, Error::ProtocolViolation(_)) {
+        return;
+    }
+
+    let general = get_config().general;
+    let window = Duration::from_millis(general.protocol_violation_block_time);
+    let addr = addr.to_canonical();
+    let blocked = PROTOCOL_VIOLATIONS.lock().record(
+        addr,
+        err.to_string(),
+        Instant::now(),
+        general.protocol_violation_limit,
+        window,
+    );
+    if blocked {
+        warn!(
+            "Client address {addr} is blocked for {}ms after {} protocol violations",
+            general.protocol_violation_block_time, general.protocol_violation_limit
+        );
+    }
+}
+
+/// True if new connections from `addr` must be refused.
+pub fn is_quarantined(addr: IpAddr) -> bool {
+    PROTOCOL_VIOLATIONS
+        .lock()
+        .is_blocked(&addr.to_canonical(), Instant::now())
+}
+
+/// Addresses with recent protocol violations.
+pub fn get_protocol_violations() -> Vec<(IpAddr, Violations)> {
+    let mut violations: Vec<(IpAddr, Violations)> = PROTOCOL_VIOLATIONS
+        .lock()
+        .addrs
+        .iter()
+        .map(|(addr, violations)| (*addr, violations.clone()))
+        .collect();
+    violations.sort_by_key(|(addr, _)| *addr);
+    violations
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_violation_tracker_blocks_repeat_offenders() {
+        let addr: IpAddr = "10.0.0.1".parse().unwrap();
+        let other: IpAddr = "10.0.0.2".parse().unwrap();
+        let window = Duration::from_secs(60);
+        let start = Instant::now();
+        let mut tracker = ViolationTracker::default();
+
+        assert!(!tracker.record(addr, "a".to_string(), start, 3, window));
+        assert!(!tracker.record(other, "b".to_string(), start, 3, window));
+        assert!(!tracker.record(addr, "c".to_string(), start, 3, window));
+        assert!(!tracker.is_blocked(&addr, start));
+
+        assert!(tracker.record(addr, "d".to_string(), start, 3, window));
+        assert!(tracker.is_blocked(&addr, start + Duration::from_secs(59)));
+        assert!(!tracker.is_blocked(&other, start));
+        assert!(!tracker.is_blocked(&addr, start + window));
+        assert_eq!(tracker.addrs[&addr].total, 3);
+
+        // Violations spread over more than a window don't add up.
+        let later = start + window * 2;
+        assert!(!tracker.record(addr, "e".to_string(), later, 3, window));
+        assert!(!tracker.record(addr, "f".to_string(), later + window, 3, window));
+        assert!(!tracker.record(addr, "g".to_string(), later + window, 3, window));
+        assert!(!tracker.addrs.contains_key(&other));
+
+        // Blocking is disabled with a zero limit.
+        let mut tracker = ViolationTracker::default();
+        for _ in 0..10 {
+            assert!(!tracker.record(addr, "h".to_string(), start, 0, window));
+        }
+        assert!(!tracker.is_blocked(&addr, start));
+    }
+}
@@ -0,0 +1,141 @@
+// Routing of transactions by regular expressions on their first statement.
+//
+// A database can list query_routes: a pattern matched against the normalized
+// text of the first statement of a transaction (constants replaced with `?`,
+// identifiers lowercased, single spaces) and the pool of the database the
+// transaction runs in, e.g. reports reading the analytics_* tables on a
+// dedicated replica. The first matching rule wins; routing hints in comments
+// take precedence, the replica guess applies when no rule matches.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::sync::Arc;
+
+// External crate imports
+use once_cell::sync::Lazy;
+use parking_lot::RwLock;
+use regex::Regex;
+
+// Internal crate imports
+use crate::config::{partition_pool_name, Pool};
+use crate::errors::Error;
+use crate::messages::fingerprint::normalize_statement;
+
+/// Target of a rule running the transaction in the pool of the database itself.
+pub const PRIMARY_TARGET: &str = "primary";
+
+/// Compiled rules of a database: pattern and name of the target pool.
+type Routes = Vec<(Regex, String)>;
+
+static QUERY_ROUTES: Lazy<RwLock<HashMap<String, Arc<Routes>>>> =
+    Lazy::new(|| RwLock::new(HashMap::new()));
+
+/// Name of the pool of `database` a rule sends the transactions to.
+fn target_pool_name(database: &str, target: &str) -> String {
+    match target {
+        PRIMARY_TARGET => database.to_string(),
+        target => partition_pool_name(database, target),
+    }
+}
+
+/// Compile the query_routes of a database.
+fn compile_routes(database: &str, pool: &Pool) -> Result<Routes, Error> {
+    pool.query_routes
+        .iter()
+        .map(|route| match Regex::new(&route.pattern) {
+            Ok(regex) => Ok((regex, target_pool_name(database, &route.pool))),
+            Err(err) => Err(Error::BadConfig(format!(
+                "Error in pool {{ {database} }}. Invalid query_routes pattern {:?}: {err}",
+                route.pattern
+            ))),
+        })
+        .collect()
+}
+
+/// query_routes of the databases compiled with load_query_routes, routing once
+/// set with set_query_routes.
+pub struct QueryRoutes(HashMap<String, Arc<Routes>>);
+
+/// Compile the query_routes of the databases.
+pub fn load_query_routes(pools: &HashMap<String, Pool>) -> Result<QueryRoutes, Error> {
+    let mut routes = HashMap::new();
+    for (database, pool) in pools.iter() {
+        if !pool.query_routes.is_empty() {
+            routes.insert(database.clone(), Arc::new(compile_routes(database, pool)?));
+        }
+    }
+    Ok(QueryRoutes(routes))
+}
+
+/// Route with the compiled rules, replacing the current ones.
+pub fn set_query_routes(routes: QueryRoutes) {
+    *QUERY_ROUTES.write() = routes.0;
+}
+
+/// Whether the database has query_routes.
+pub fn has_query_routes(database: &str) -> bool {
+    QUERY_ROUTES.read().contains_key(database)
+}
+
+/// Name of the pool of the first rule matching the query.
+fn matching_route(routes: &Routes, query: &str) -> Option<String> {
+    let normalized = normalize_statement(query);
+    routes
+        .iter()
+        .find(|(regex, _)| regex.is_match(&normalized))
+        .map(|(_, pool_name)| pool_name.clone())
+}
+
+/// Name of the pool of the first rule of the database matching the query, if any.
+pub fn query_route_pool(database: &str, query: &str) -> Option<String> {
+    let routes = QUERY_ROUTES.read().get(database).cloned()?;
+    matching_route(&routes, query)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::QueryRoute;
+
+    #[test]
+    fn test_matching_route() {
+        let mut pool = Pool {
+            query_routes: vec![
+                QueryRoute {
+                    pattern: r"^select .* from analytics_\w+".to_string(),
+                    pool: "replica2".to_string(),
+                },
+                QueryRoute {
+                    pattern: r"^select .* for update$".to_string(),
+                    pool: PRIMARY_TARGET.to_string(),
+                },
+                QueryRoute {
+                    pattern: r"^insert into events ".to_string(),
+                    pool: "batch".to_string(),
+                },
+            ],
+            ..Default::default()
+        };
+        let routes = compile_routes("routes_db", &pool).unwrap();
+
+        assert_eq!(
+            matching_route(
+                &routes,
+                "SELECT day, count(*) FROM Analytics_Visits WHERE site = 42 GROUP BY day"
+            ),
+            Some("routes_db/replica2".to_string())
+        );
+        assert_eq!(
+            matching_route(&routes, "select * from accounts where id = $1 for update"),
+            Some("routes_db".to_string())
+        );
+        assert_eq!(
+            matching_route(&routes, "/* app */ INSERT INTO events (kind) VALUES ('a')"),
+            Some("routes_db/batch".to_string())
+        );
+        assert_eq!(matching_route(&routes, "SELECT * FROM accounts"), None);
+
+        pool.query_routes[0].pattern = "(".to_string();
+        assert!(compile_routes("routes_db", &pool).is_err());
+    }
+}
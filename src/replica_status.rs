@@ -0,0 +1,253 @@
+// Replay status of the replicas, for read-your-writes and lag-aware routing.
+//
+// For pools with read_your_writes or max_replica_lag the replay position of each
+// replica (pg_last_wal_replay_lsn()) and its lag are polled every
+// replica_poll_interval on a server connection of its pool.
+//
+// With read_your_writes a client that ran a transaction on the primary notes the
+// WAL position of the primary after it (pg_current_wal_lsn()), and its read-only
+// transactions only go to the replicas that replayed past it, the primary runs
+// them meanwhile. A client never reads older data than it wrote.
+//
+// With max_replica_lag a replica lagging more gets no reads until it catches up.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::time::Duration;
+
+// External crate imports
+use log::{info, warn};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::time::Instant;
+
+// Internal crate imports
+use crate::config::{get_config, replica_pool_name};
+use crate::errors::Error;
+use crate::pool::{get_all_pools, ConnectionPool};
+use crate::server::Server;
+
+/// Last poll of a replica.
+#[derive(Debug, Clone, PartialEq)]
+struct ReplicaStatus {
+    host: String,
+    port: u16,
+    replay_lsn: u64,
+    /// Time since the last replayed transaction while WAL is left to replay (ms),
+    /// None before the replica replayed one.
+    lag_ms: Option<u64>,
+}
+
+impl ReplicaStatus {
+    fn lags_behind(&self, max_lag: u64) -> bool {
+        max_lag > 0 && self.lag_ms.is_none_or(|lag| lag > max_lag)
+    }
+}
+
+/// Last poll of the replicas by the name of their pool.
+static REPLICA_STATUS: Lazy<Mutex<HashMap<String, ReplicaStatus>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Replay position and lag of a replica, 0 while it has replayed all the WAL it received.
+const REPLICA_STATUS_QUERY: &str = "select pg_last_wal_replay_lsn(), \
+    case when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0 \
+    else (extract(epoch from now() - pg_last_xact_replay_timestamp()) * 1000)::bigint end";
+
+/// WAL position of its text form, e.g. "16/B374D848".
+pub fn parse_lsn(value: &str) -> Option<u64> {
+    let (high, low) = value.trim().split_once('/')?;
+    let high = u32::from_str_radix(high, 16).ok()?;
+    let low = u32::from_str_radix(low, 16).ok()?;
+    Some(((high as u64) << 32) | low as u64)
+}
+
+/// WAL position of the text value, an error naming the query otherwise.
+fn lsn_value(query: &str, value: Option<String>) -> Result<u64, Error> {
+    match value {
+        Some(value) => parse_lsn(&value)
+            .ok_or_else(|| Error::QueryError(format!("{query} returned a non-LSN: {value}"))),
+        None => Err(Error::QueryError(format!("{query} returned no value"))),
+    }
+}
+
+/// WAL position of the primary the server is connected to.
+pub async fn current_lsn(server: &mut Server) -> Result<u64, Error> {
+    let query = "select pg_current_wal_lsn()";
+    let rows = server.simple_query_rows(query).await?;
+    lsn_value(
+        query,
+        rows.into_iter()
+            .next()
+            .and_then(|row| row.into_iter().next())
+            .flatten(),
+    )
+}
+
+/// The replica of the pool can take a read-only transaction of a client, as of
+/// its last poll: it lags at most `max_lag` ms (0 for any lag) and replayed the
+/// last write of the client at `written_lsn`. Unpolled replicas can't with either.
+pub fn replica_usable(pool_name: &str, max_lag: u64, written_lsn: Option<u64>) -> bool {
+    if max_lag == 0 && written_lsn.is_none() {
+        return true;
+    }
+    REPLICA_STATUS.lock().get(pool_name).is_some_and(|status| {
+        !status.lags_behind(max_lag) && written_lsn.is_none_or(|lsn| status.replay_lsn >= lsn)
+    })
+}
+
+/// Lag of the polled replicas by host and port (ms).
+pub fn replica_lags() -> HashMap<(String, u16), Option<u64>> {
+    REPLICA_STATUS
+        .lock()
+        .values()
+        .map(|status| ((status.host.clone(), status.port), status.lag_ms))
+        .collect()
+}
+
+/// Read the replay position and the lag of the replica on a server of its pool.
+async fn poll_replica(
+    pool: &ConnectionPool,
+    timeout: Duration,
+) -> Result<(u64, Option<u64>), Error> {
+    let poll = async {
+        let mut server = match pool.database.get().await {
+            Ok(server) => server,
+            Err(err) => {
+                return Err(Error::QueryError(format!(
+                    "no server connection to poll the replica: {err:?}"
+                )))
+            }
+        };
+        server.checkin_cleanup().await?;
+        let rows = server.simple_query_rows(REPLICA_STATUS_QUERY).await?;
+        let mut row = rows.into_iter().next().unwrap_or_default().into_iter();
+        let replay_lsn = lsn_value("pg_last_wal_replay_lsn()", row.next().flatten())?;
+        // Clocks of the primary and the replica a bit apart may make it negative.
+        let lag_ms = row
+            .next()
+            .flatten()
+            .and_then(|lag| lag.parse::<i64>().ok())
+            .map(|lag| lag.max(0) as u64);
+        Ok((replay_lsn, lag_ms))
+    };
+    match tokio::time::timeout(timeout, poll).await {
+        Ok(result) => result,
+        Err(_) => Err(Error::QueryError("replica poll timed out".to_string())),
+    }
+}
+
+/// Poll the replicas of the databases with read_your_writes or max_replica_lag at their intervals.
+pub async fn watch_replica_status() {
+    let mut next_polls: HashMap<String, Instant> = HashMap::new();
+    let mut interval = tokio::time::interval(Duration::from_millis(100));
+    loop {
+        interval.tick().await;
+        let config = get_config();
+        REPLICA_STATUS.lock().retain(|pool_name, _| {
+            config
+                .pool_config(pool_name)
+                .is_some_and(|pool| pool.polls_replicas())
+        });
+
+        let pools = get_all_pools();
+        for (database, pool_config) in &config.pools {
+            if !pool_config.polls_replicas() {
+                continue;
+            }
+            let now = Instant::now();
+            if next_polls.get(database).is_some_and(|next| *next > now) {
+                continue;
+            }
+            let poll_interval = Duration::from_millis(pool_config.replica_poll_interval);
+            next_polls.insert(database.clone(), now + poll_interval);
+
+            for index in 1..=pool_config.replica_hosts.len() {
+                let pool_name = replica_pool_name(database, index);
+                let pool = match pools
+                    .iter()
+                    .find(|(identifier, _)| identifier.db == pool_name)
+                {
+                    Some((_, pool)) => pool,
+                    None => continue,
+                };
+                let (host, port) = pool.balancer.main_host();
+                let max_lag = pool_config.max_replica_lag;
+                let status = match poll_replica(pool, poll_interval).await {
+                    Ok((replay_lsn, lag_ms)) => ReplicaStatus {
+                        host: host.to_string(),
+                        port,
+                        replay_lsn,
+                        lag_ms,
+                    },
+                    Err(err) => {
+                        // Unknown, the replica gets no reads after writes nor lag-checked reads until the next poll.
+                        if REPLICA_STATUS.lock().remove(&pool_name).is_some() {
+                            warn!("[pool: {pool_name}] Replica poll failed: {err}");
+                        }
+                        continue;
+                    }
+                };
+                let lags_behind = status.lags_behind(max_lag);
+                let lagged_behind = REPLICA_STATUS
+                    .lock()
+                    .insert(pool_name.clone(), status.clone())
+                    .is_some_and(|previous| previous.lags_behind(max_lag));
+                let lag = status
+                    .lag_ms
+                    .map_or("unknown".to_string(), |lag| format!("{lag}ms"));
+                if lags_behind && !lagged_behind {
+                    warn!("[pool: {pool_name}] Replica lag {lag} is over max_replica_lag {max_lag}ms, no reads until it catches up");
+                } else if !lags_behind && lagged_behind {
+                    info!("[pool: {pool_name}] Replica caught up, lag {lag}");
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_lsn() {
+        assert_eq!(parse_lsn("0/0"), Some(0));
+        assert_eq!(parse_lsn("16/B374D848"), Some(0x16_B374_D848));
+        assert_eq!(parse_lsn("FFFFFFFF/FFFFFFFF"), Some(u64::MAX));
+        assert_eq!(parse_lsn("16B374D848"), None);
+        assert_eq!(parse_lsn("1/G"), None);
+        assert_eq!(parse_lsn("100000000/0"), None);
+    }
+
+    #[test]
+    fn test_replica_usable() {
+        let pool_name = "replica_status_test/replica1";
+        assert!(replica_usable(pool_name, 0, None));
+        assert!(!replica_usable(pool_name, 0, Some(0)));
+        assert!(!replica_usable(pool_name, 1000, None));
+
+        let mut status = ReplicaStatus {
+            host: "replica_status_test".to_string(),
+            port: 5432,
+            replay_lsn: 100,
+            lag_ms: Some(500),
+        };
+        REPLICA_STATUS
+            .lock()
+            .insert(pool_name.to_string(), status.clone());
+        assert!(replica_usable(pool_name, 0, Some(100)));
+        assert!(!replica_usable(pool_name, 0, Some(101)));
+        assert!(replica_usable(pool_name, 1000, Some(100)));
+        assert!(!replica_usable(pool_name, 100, None));
+        assert_eq!(
+            replica_lags().get(&("replica_status_test".to_string(), 5432)),
+            Some(&Some(500))
+        );
+
+        // No transaction replayed yet, the lag is unknown.
+        status.lag_ms = None;
+        REPLICA_STATUS.lock().insert(pool_name.to_string(), status);
+        assert!(!replica_usable(pool_name, 1000, None));
+        assert!(replica_usable(pool_name, 0, Some(100)));
+    }
+}
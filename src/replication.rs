@@ -0,0 +1,110 @@
+// Logical replication connections passed through to the server.
+//
+// Clients connecting with replication=database, e.g. CDC tools like Debezium,
+// can't share the pooled server connections: each one gets a server connection
+// of its own, started in replication mode, and the bytes are relayed as they are
+// both ways (COPY BOTH included) until one side disconnects. They are capped by
+// max_replication_connections per database, 0 refuses them.
+
+// Standard library imports
+use std::collections::HashMap;
+
+// External crate imports
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+// Internal crate imports
+use crate::errors::Error;
+
+/// Replication connections open right now, by database.
+static REPLICATION_CONNECTIONS: Lazy<Mutex<HashMap<String, u32>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// The client asks for a logical replication connection. Physical replication
+/// (replication=true) isn't supported.
+pub fn replication_requested(parameters: &HashMap<String, String>) -> Result<bool, Error> {
+    let value = match parameters.get("replication") {
+        Some(value) => value.to_ascii_lowercase(),
+        None => return Ok(false),
+    };
+    match value.as_str() {
+        "database" => Ok(true),
+        "false" | "off" | "no" | "0" => Ok(false),
+        _ => Err(Error::ClientError(format!(
+            "replication={value} is not supported, only replication=database"
+        ))),
+    }
+}
+
+/// A replication connection of a database, released on drop.
+#[derive(Debug)]
+pub struct ReplicationPermit {
+    database: String,
+}
+
+impl Drop for ReplicationPermit {
+    fn drop(&mut self) {
+        let mut connections = REPLICATION_CONNECTIONS.lock();
+        if let Some(count) = connections.get_mut(&self.database) {
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                connections.remove(&self.database);
+            }
+        }
+    }
+}
+
+/// Take a replication connection of the database if fewer than `max` are open.
+pub fn try_acquire_replication_permit(database: &str, max: u32) -> Option<ReplicationPermit> {
+    let mut connections = REPLICATION_CONNECTIONS.lock();
+    let count = connections.entry(database.to_string()).or_insert(0);
+    if *count >= max {
+        if *count == 0 {
+            connections.remove(database);
+        }
+        return None;
+    }
+    *count += 1;
+    Some(ReplicationPermit {
+        database: database.to_string(),
+    })
+}
+
+/// Replication connections of the database open right now.
+pub fn replication_connections(database: &str) -> u32 {
+    REPLICATION_CONNECTIONS
+        .lock()
+        .get(database)
+        .copied()
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_replication_requested() {
+        let mut parameters = HashMap::new();
+        assert!(!replication_requested(&parameters).unwrap());
+        parameters.insert("replication".to_string(), "database".to_string());
+        assert!(replication_requested(&parameters).unwrap());
+        parameters.insert("replication".to_string(), "off".to_string());
+        assert!(!replication_requested(&parameters).unwrap());
+        parameters.insert("replication".to_string(), "true".to_string());
+        assert!(replication_requested(&parameters).is_err());
+    }
+
+    #[test]
+    fn test_replication_permits() {
+        assert!(try_acquire_replication_permit("replication_test", 0).is_none());
+        let first = try_acquire_replication_permit("replication_test", 2).unwrap();
+        let second = try_acquire_replication_permit("replication_test", 2).unwrap();
+        assert!(try_acquire_replication_permit("replication_test", 2).is_none());
+        assert_eq!(replication_connections("replication_test"), 2);
+        drop(first);
+        assert_eq!(replication_connections("replication_test"), 1);
+        drop(second);
+        assert_eq!(replication_connections("replication_test"), 0);
+    }
+}
@@ -0,0 +1,332 @@
+// Cache of the results of read-only queries.
+//
+// For pools with result_cache_pattern the results of the read-only statements
+// matching it are kept for result_cache_ttl, and a client running the same
+// statement with the same parameters gets them without a server, e.g.
+// dashboards refreshing the same panels. The pattern is matched against the
+// normalized statement. Only statements outside a transaction in transaction
+// mode are cached and only complete, successful results of up to
+// result_cache_max_result_size; the oldest results are evicted over
+// result_cache_size. Clients share results only with the same user and the
+// same session state: the parameters changing the results and the parameters
+// the session sets, e.g. search_path.
+
+// Standard library imports
+use std::collections::{HashMap, VecDeque};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use bytes::Bytes;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use regex::Regex;
+
+// Internal crate imports
+use crate::config::Pool;
+use crate::errors::Error;
+use crate::messages::fingerprint::normalize_statement;
+use crate::messages::{query_route, Route};
+
+/// A cached result: the responses sent to the client, up to ReadyForQuery.
+struct Entry {
+    response: Bytes,
+    expires_at: Instant,
+    /// Distinguishes the entry from an older one of the same key in the eviction queue.
+    generation: u64,
+}
+
+/// Results of the statements of a database.
+struct ResultCache {
+    pattern: Regex,
+    ttl: Duration,
+    size: usize,
+    max_result_size: usize,
+    entries: HashMap<Vec<u8>, Entry>,
+    /// Keys in the order they were stored, the oldest are evicted first.
+    queue: VecDeque<(Vec<u8>, u64)>,
+    used: usize,
+    generation: u64,
+}
+
+impl ResultCache {
+    fn new(database: &str, pool: &Pool, pattern: &str) -> Result<ResultCache, Error> {
+        let pattern = Regex::new(pattern).map_err(|err| {
+            Error::BadConfig(format!(
+                "Error in pool {{ {database} }}. Invalid result_cache_pattern: {err}"
+            ))
+        })?;
+        Ok(ResultCache {
+            pattern,
+            ttl: Duration::from_millis(pool.result_cache_ttl),
+            size: pool.result_cache_size as usize,
+            max_result_size: pool.result_cache_max_result_size as usize,
+            entries: HashMap::new(),
+            queue: VecDeque::new(),
+            used: 0,
+            generation: 0,
+        })
+    }
+
+    fn get(&mut self, key: &[u8]) -> Option<Bytes> {
+        let entry = self.entries.get(key)?;
+        if entry.expires_at > Instant::now() {
+            return Some(entry.response.clone());
+        }
+        self.remove(key);
+        None
+    }
+
+    fn remove(&mut self, key: &[u8]) {
+        if let Some(entry) = self.entries.remove(key) {
+            self.used -= entry.response.len();
+        }
+    }
+
+    fn insert(&mut self, key: Vec<u8>, response: Bytes) {
+        self.remove(&key);
+        self.generation += 1;
+        self.used += response.len();
+        self.queue.push_back((key.clone(), self.generation));
+        self.entries.insert(
+            key,
+            Entry {
+                response,
+                expires_at: Instant::now() + self.ttl,
+                generation: self.generation,
+            },
+        );
+        while self.used > self.size {
+            let (key, generation) = match self.queue.pop_front() {
+                Some(oldest) => oldest,
+                None => break,
+            };
+            if self
+                .entries
+                .get(&key)
+                .is_some_and(|entry| entry.generation == generation)
+            {
+                self.remove(&key);
+            }
+        }
+        // Keys replaced or expired since leave stale items behind.
+        if self.queue.len() > 2 * self.entries.len() + 16 {
+            let entries = &self.entries;
+            self.queue.retain(|(key, generation)| {
+                entries
+                    .get(key)
+                    .is_some_and(|entry| entry.generation == *generation)
+            });
+        }
+    }
+}
+
+static RESULT_CACHES: Lazy<Mutex<HashMap<String, ResultCache>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Result caches created with load_result_caches, used once set with set_result_caches.
+pub struct ResultCaches(HashMap<String, ResultCache>);
+
+/// Create the result caches of the databases with result_cache_pattern.
+pub fn load_result_caches(pools: &HashMap<String, Pool>) -> Result<ResultCaches, Error> {
+    let mut caches = HashMap::new();
+    for (database, pool) in pools.iter() {
+        if let Some(ref pattern) = pool.result_cache_pattern {
+            caches.insert(database.clone(), ResultCache::new(database, pool, pattern)?);
+        }
+    }
+    Ok(ResultCaches(caches))
+}
+
+/// Use the created result caches, the results cached so far are dropped.
+pub fn set_result_caches(caches: ResultCaches) {
+    *RESULT_CACHES.lock() = caches.0;
+}
+
+/// Whether the database caches results.
+pub fn has_result_cache(database: &str) -> bool {
+    RESULT_CACHES.lock().contains_key(database)
+}
+
+/// Key of a cacheable statement in the cache of its database.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ResultCacheKey {
+    database: String,
+    key: Vec<u8>,
+    /// Results over it aren't cached.
+    pub max_result_size: usize,
+}
+
+/// Server parameters changing the results of the statements.
+pub const RESULT_SERVER_PARAMETERS: [&str; 4] =
+    ["TimeZone", "DateStyle", "IntervalStyle", "client_encoding"];
+
+/// Session state of a client in result cache keys: the name and value of each parameter.
+pub fn session_key<'a>(parameters: impl IntoIterator<Item = (&'a str, &'a str)>) -> Vec<u8> {
+    let mut key = Vec::new();
+    for (name, value) in parameters {
+        key.extend_from_slice(name.as_bytes());
+        key.push(0);
+        key.extend_from_slice(value.as_bytes());
+        key.push(0);
+    }
+    key
+}
+
+/// Key of the statement of the user if it is read-only and matches result_cache_pattern.
+/// `session` is the session_key of the client, `messages` the codes of the messages
+/// of the request, `parameters` the values the statement runs with. Users don't
+/// share results, their privileges may differ.
+pub fn result_cache_key(
+    database: &str,
+    user: &str,
+    session: &[u8],
+    messages: &[u8],
+    query: &str,
+    parameters: &[u8],
+) -> Option<ResultCacheKey> {
+    let normalized = normalize_statement(query);
+    let max_result_size = {
+        let caches = RESULT_CACHES.lock();
+        let cache = caches.get(database)?;
+        if !cache.pattern.is_match(&normalized) {
+            return None;
+        }
+        cache.max_result_size
+    };
+    if query_route(query) != Route::Replica {
+        return None;
+    }
+    let mut key = Vec::with_capacity(
+        user.len() + session.len() + messages.len() + normalized.len() + parameters.len() + 3,
+    );
+    key.extend_from_slice(user.as_bytes());
+    key.push(0);
+    key.extend_from_slice(session);
+    key.extend_from_slice(messages);
+    key.push(0);
+    key.extend_from_slice(normalized.as_bytes());
+    key.push(0);
+    key.extend_from_slice(parameters);
+    Some(ResultCacheKey {
+        database: database.to_string(),
+        key,
+        max_result_size,
+    })
+}
+
+/// The cached result of the statement, if it hasn't expired.
+pub fn cached_result(key: &ResultCacheKey) -> Option<Bytes> {
+    RESULT_CACHES.lock().get_mut(&key.database)?.get(&key.key)
+}
+
+/// Whether the responses are a complete result: well-formed messages without
+/// errors ending with ReadyForQuery outside a transaction.
+fn complete_result(response: &[u8]) -> bool {
+    let mut rest = response;
+    let mut last = None;
+    while rest.len() >= 5 {
+        let len = i32::from_be_bytes([rest[1], rest[2], rest[3], rest[4]]) as usize + 1;
+        if len < 5 || len > rest.len() || rest[0] == b'E' {
+            return false;
+        }
+        last = Some(&rest[..len]);
+        rest = &rest[len..];
+    }
+    rest.is_empty() && last == Some(&[b'Z', 0, 0, 0, 5, b'I'][..])
+}
+
+/// Cache the responses to the statement if they are a complete result.
+pub fn store_result(key: ResultCacheKey, response: &[u8]) {
+    if response.len() > key.max_result_size || !complete_result(response) {
+        return;
+    }
+    if let Some(cache) = RESULT_CACHES.lock().get_mut(&key.database) {
+        cache.insert(key.key, Bytes::copy_from_slice(response));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn new_cache(size: usize) -> ResultCache {
+        let pool = Pool {
+            result_cache_ttl: 60_000,
+            result_cache_size: size as u64,
+            ..Default::default()
+        };
+        ResultCache::new("cache_db", &pool, "^select").unwrap()
+    }
+
+    #[test]
+    fn test_result_cache_eviction() {
+        let mut cache = new_cache(10);
+        cache.insert(b"a".to_vec(), Bytes::from_static(b"aaaa"));
+        cache.insert(b"b".to_vec(), Bytes::from_static(b"bbbb"));
+        assert_eq!(cache.get(b"a"), Some(Bytes::from_static(b"aaaa")));
+
+        // Over the size, the oldest goes.
+        cache.insert(b"c".to_vec(), Bytes::from_static(b"cccc"));
+        assert_eq!(cache.get(b"a"), None);
+        assert!(cache.get(b"b").is_some());
+        assert!(cache.get(b"c").is_some());
+        assert_eq!(cache.used, 8);
+
+        // A replaced entry keeps its place by the new store.
+        cache.insert(b"b".to_vec(), Bytes::from_static(b"BBBB"));
+        cache.insert(b"d".to_vec(), Bytes::from_static(b"dddd"));
+        assert_eq!(cache.get(b"c"), None);
+        assert_eq!(cache.get(b"b"), Some(Bytes::from_static(b"BBBB")));
+        assert_eq!(cache.used, 8);
+
+        let mut expired = new_cache(10);
+        expired.ttl = Duration::ZERO;
+        expired.insert(b"a".to_vec(), Bytes::from_static(b"aaaa"));
+        assert_eq!(expired.get(b"a"), None);
+        assert_eq!(expired.used, 0);
+    }
+
+    #[test]
+    fn test_complete_result() {
+        let ready = [b'Z', 0, 0, 0, 5, b'I'];
+        let mut response = b"C\0\0\0\x0dSELECT 1\0".to_vec();
+        response.extend_from_slice(&ready);
+        assert!(complete_result(&response));
+
+        // In a transaction.
+        let mut in_transaction = response.clone();
+        *in_transaction.last_mut().unwrap() = b'T';
+        assert!(!complete_result(&in_transaction));
+
+        // Cut off.
+        assert!(!complete_result(&response[..response.len() - 1]));
+
+        // An error.
+        let mut error = b"E\0\0\0\x0eC42P01\0M\0\0".to_vec();
+        error.extend_from_slice(&ready);
+        assert!(!complete_result(&error));
+    }
+
+    #[test]
+    fn test_session_key() {
+        assert!(session_key(Vec::new()).is_empty());
+        assert_eq!(
+            session_key([("TimeZone", "UTC"), ("search_path", "tenant")]),
+            b"TimeZone\0UTC\0search_path\0tenant\0".to_vec()
+        );
+        assert_ne!(
+            session_key([("search_path", "a")]),
+            session_key([("search_path", "b")])
+        );
+    }
+
+    #[test]
+    fn test_result_cache_new() {
+        let pool = Pool::default();
+        assert!(ResultCache::new("cache_db", &pool, "(").is_err());
+        assert_eq!(
+            new_cache(10).max_result_size,
+            pool.result_cache_max_result_size as usize
+        );
+    }
+}
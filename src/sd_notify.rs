@@ -0,0 +1,143 @@
+// systemd service notifications.
+//
+// Under a `Type=notify` unit systemd passes the NOTIFY_SOCKET datagram socket:
+// READY=1 is sent once the listeners accept clients, STATUS= keeps a summary
+// of the pools in `systemctl status` and STOPPING=1 marks the shutdown. With
+// WatchdogSec= set, WATCHDOG=1 is sent at half the watchdog interval from the
+// async runtime, so an instance whose runtime is stuck gets restarted. Without
+// NOTIFY_SOCKET nothing is sent.
+
+// Standard library imports
+use std::io;
+use std::os::unix::net::UnixDatagram;
+use std::time::Duration;
+
+// External crate imports
+use log::{debug, warn};
+
+// Internal crate imports
+use crate::health_endpoint::is_shutting_down;
+use crate::stats::pool::PoolStats;
+
+const NOTIFY_SOCKET_ENV: &str = "NOTIFY_SOCKET";
+
+/// How often STATUS= is updated.
+const STATUS_PERIOD: Duration = Duration::from_secs(10);
+
+fn send(socket_path: &str, state: &str) -> io::Result<()> {
+    let socket = UnixDatagram::unbound()?;
+    // A leading @ is a socket in the abstract namespace.
+    #[cfg(target_os = "linux")]
+    if let Some(name) = socket_path.strip_prefix('@') {
+        use std::os::linux::net::SocketAddrExt;
+        let addr = std::os::unix::net::SocketAddr::from_abstract_name(name)?;
+        socket.send_to_addr(state.as_bytes(), &addr)?;
+        return Ok(());
+    }
+    socket.send_to(state.as_bytes(), socket_path)?;
+    Ok(())
+}
+
+/// Send the state (`KEY=value` lines) to systemd if the service runs under it.
+pub fn sd_notify(state: &str) {
+    let socket_path = match std::env::var(NOTIFY_SOCKET_ENV) {
+        Ok(socket_path) if !socket_path.is_empty() => socket_path,
+        _ => return,
+    };
+    match send(&socket_path, state) {
+        Ok(()) => debug!("Notified systemd: {state:?}"),
+        Err(err) => warn!("Failed to notify systemd at {socket_path}: {err}"),
+    }
+}
+
+/// The listeners accept clients. MAINPID tells systemd to follow the process
+/// that took over after a binary upgrade (needs NotifyAccess=all).
+pub fn sd_notify_ready() {
+    sd_notify(&format!("READY=1\nMAINPID={}", std::process::id()));
+}
+
+pub fn sd_notify_stopping() {
+    sd_notify("STOPPING=1\nSTATUS=Shutting down");
+}
+
+/// Watchdog interval set by systemd for this process, if any.
+fn watchdog_interval() -> Option<Duration> {
+    if let Ok(pid) = std::env::var("WATCHDOG_PID") {
+        if pid != std::process::id().to_string() {
+            return None;
+        }
+    }
+    let usec: u64 = std::env::var("WATCHDOG_USEC").ok()?.parse().ok()?;
+    (usec > 0).then(|| Duration::from_micros(usec))
+}
+
+fn status_line(pools: usize, clients: u64, waiting: u64, servers: u64, active: u64) -> String {
+    format!(
+        "{pools} pools, {clients} clients ({waiting} waiting), {servers} servers ({active} active)"
+    )
+}
+
+fn pools_status() -> String {
+    let pool_lookup = PoolStats::construct_pool_lookup();
+    let (mut clients, mut waiting, mut servers, mut active) = (0, 0, 0, 0);
+    for pool_stats in pool_lookup.values() {
+        clients += pool_stats.cl_active + pool_stats.cl_idle + pool_stats.cl_waiting;
+        waiting += pool_stats.cl_waiting;
+        servers +=
+            pool_stats.sv_active + pool_stats.sv_idle + pool_stats.sv_used + pool_stats.sv_login;
+        active += pool_stats.sv_active;
+    }
+    status_line(pool_lookup.len(), clients, waiting, servers, active)
+}
+
+/// Ping the watchdog and update the status until a shutdown starts; after a
+/// binary upgrade the new process takes over.
+pub async fn run_sd_notify() {
+    if std::env::var_os(NOTIFY_SOCKET_ENV).is_none() {
+        return;
+    }
+    let watchdog = watchdog_interval();
+    let period = match watchdog {
+        Some(watchdog) => (watchdog / 2).min(STATUS_PERIOD),
+        None => STATUS_PERIOD,
+    };
+    let mut interval = tokio::time::interval(period);
+    loop {
+        interval.tick().await;
+        if is_shutting_down() {
+            return;
+        }
+        let status = format!("STATUS={}", pools_status());
+        if watchdog.is_some() {
+            sd_notify(&format!("WATCHDOG=1\n{status}"));
+        } else {
+            sd_notify(&status);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_status_line() {
+        assert_eq!(
+            status_line(2, 120, 5, 40, 30),
+            "2 pools, 120 clients (5 waiting), 40 servers (30 active)"
+        );
+    }
+
+    #[test]
+    fn test_send() {
+        let path =
+            std::env::temp_dir().join(format!("pg_doorman_notify_{}.sock", std::process::id()));
+        let _ = std::fs::remove_file(&path);
+        let receiver = UnixDatagram::bind(&path).unwrap();
+        send(path.to_str().unwrap(), "READY=1").unwrap();
+        let mut buf = [0; 64];
+        let n = receiver.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..n], b"READY=1");
+        let _ = std::fs::remove_file(&path);
+    }
+}
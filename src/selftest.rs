@@ -0,0 +1,692 @@
+// Startup-time self-test: checks that the configuration actually works
+// before the pooler is put into service.
+
+// Standard library imports
+use std::collections::HashMap;
+use std::fmt;
+use std::net::{SocketAddr, ToSocketAddrs};
+use std::path::Path;
+use std::sync::atomic::AtomicU64;
+use std::sync::Arc;
+use std::time::Duration;
+
+// External crate imports
+use parking_lot::Mutex;
+use tokio::net::{TcpListener, TcpSocket, TcpStream};
+use tokio::time::timeout;
+
+// Internal crate imports
+use crate::auth::auth_query::fetch_auth_query_password;
+use crate::config::{Address, Config, User, WILDCARD_DATABASE};
+use crate::pool::{ClientServerMap, ConnectionPool};
+use crate::server::Server;
+use crate::stats::{AddressStats, ServerStats};
+use crate::tls::{build_acceptor, TLSMode, TlsProtocols};
+
+/// Outcome of a single self-test check.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CheckStatus {
+    Ok,
+    Failed,
+    Skipped,
+}
+
+impl fmt::Display for CheckStatus {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            CheckStatus::Ok => write!(f, "  OK  "),
+            CheckStatus::Failed => write!(f, " FAIL "),
+            CheckStatus::Skipped => write!(f, " SKIP "),
+        }
+    }
+}
+
+/// A single line of the self-test report.
+#[derive(Debug, Clone)]
+pub struct CheckResult {
+    pub name: String,
+    pub status: CheckStatus,
+    pub details: String,
+}
+
+/// Report of all self-test checks.
+#[derive(Debug, Clone, Default)]
+pub struct SelftestReport {
+    pub checks: Vec<CheckResult>,
+}
+
+impl SelftestReport {
+    fn push(&mut self, name: String, status: CheckStatus, details: String) {
+        self.checks.push(CheckResult {
+            name,
+            status,
+            details,
+        });
+    }
+
+    fn push_result(&mut self, name: String, result: Result<String, String>) {
+        match result {
+            Ok(details) => self.push(name, CheckStatus::Ok, details),
+            Err(details) => self.push(name, CheckStatus::Failed, details),
+        }
+    }
+
+    /// True if none of the checks failed.
+    pub fn is_ok(&self) -> bool {
+        self.checks
+            .iter()
+            .all(|check| check.status != CheckStatus::Failed)
+    }
+}
+
+impl fmt::Display for SelftestReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for check in &self.checks {
+            writeln!(f, "[{}] {}: {}", check.status, check.name, check.details)?;
+        }
+        let failed = self
+            .checks
+            .iter()
+            .filter(|check| check.status == CheckStatus::Failed)
+            .count();
+        write!(
+            f,
+            "{} checks, {} failed: {}",
+            self.checks.len(),
+            failed,
+            if failed == 0 { "PASSED" } else { "FAILED" }
+        )
+    }
+}
+
+/// Run all self-test checks against the given configuration.
+pub async fn run_selftest(config: &Config) -> SelftestReport {
+    let mut report = SelftestReport::default();
+
+    report.push_result(
+        format!("listener {}:{}", config.general.host, config.general.port),
+        check_bind(&config.general.host, config.general.port),
+    );
+    for listener in &config.general.listeners {
+        report.push_result(
+            format!("listener {}:{}", listener.host, listener.port),
+            check_bind(&listener.host, listener.port),
+        );
+    }
+
+    if config.prometheus.enabled {
+        report.push_result(
+            format!(
+                "prometheus listener {}:{}",
+                config.prometheus.host, config.prometheus.port
+            ),
+            check_bind(&config.prometheus.host, config.prometheus.port),
+        );
+    }
+
+    check_tls(config, &mut report).await;
+
+    let client_server_map: ClientServerMap = Arc::new(Mutex::new(HashMap::new()));
+
+    let mut pool_names: Vec<&String> = config.pools.keys().collect();
+    pool_names.sort();
+    for pool_name in pool_names {
+        // Its databases are only known once clients ask for them.
+        if pool_name == WILDCARD_DATABASE {
+            continue;
+        }
+        let pool_config = &config.pools[pool_name];
+        // The primary hosts and the replicas, the users are checked on each.
+        let mut addresses: Vec<(String, u16)> = match pool_config.server_addresses() {
+            Ok(addresses) => addresses
+                .into_iter()
+                .map(|(host, port, _)| (host, port))
+                .collect(),
+            Err(err) => {
+                report.push(
+                    format!("pools.{pool_name}.server_hosts"),
+                    CheckStatus::Failed,
+                    err.to_string(),
+                );
+                continue;
+            }
+        };
+        match pool_config.replica_addresses() {
+            Ok(replicas) => addresses.extend(replicas),
+            Err(err) => report.push(
+                format!("pools.{pool_name}.replica_hosts"),
+                CheckStatus::Failed,
+                err.to_string(),
+            ),
+        }
+        for (host, port) in addresses {
+            for user in pool_config.users.values() {
+                check_backend(
+                    config,
+                    pool_name,
+                    user,
+                    &host,
+                    port,
+                    &client_server_map,
+                    &mut report,
+                )
+                .await;
+            }
+        }
+    }
+
+    check_auth_query(config, client_server_map, &mut report).await;
+
+    report
+}
+
+/// Connect to a backend host of the pool as the user and run the reset query on the connection.
+async fn check_backend(
+    config: &Config,
+    pool_name: &str,
+    user: &User,
+    host: &str,
+    port: u16,
+    client_server_map: &ClientServerMap,
+    report: &mut SelftestReport,
+) {
+    let pool_config = &config.pools[pool_name];
+    let address = Address {
+        database: pool_name.to_string(),
+        host: host.to_string(),
+        port,
+        virtual_pool_id: 0,
+        username: user.username.clone(),
+        password: user.password.clone(),
+        pool_name: pool_name.to_string(),
+        stats: Arc::new(AddressStats::default()),
+        error_count: Arc::new(AtomicU64::new(0)),
+    };
+    let server_database = pool_config
+        .server_database
+        .clone()
+        .unwrap_or_else(|| pool_name.to_string());
+    let application_name = pool_config
+        .application_name
+        .clone()
+        .unwrap_or_else(|| "pg_doorman".to_string());
+    let name = format!(
+        "backend {}:{} [pool: {}][user: {}]",
+        address.host, address.port, pool_name, user.username
+    );
+
+    let startup = Server::startup(
+        &address,
+        user,
+        &server_database,
+        client_server_map.clone(),
+        Arc::new(ServerStats::new(
+            address.clone(),
+            tokio::time::Instant::now(),
+        )),
+        true,
+        false,
+        0,
+        application_name,
+    );
+    let mut server = match timeout(
+        Duration::from_millis(
+            pool_config
+                .connect_timeout
+                .unwrap_or(config.general.connect_timeout),
+        ),
+        startup,
+    )
+    .await
+    {
+        Ok(Ok(server)) => {
+            report.push(
+                format!("{name} connect"),
+                CheckStatus::Ok,
+                "connected and authenticated".to_string(),
+            );
+            server
+        }
+        Ok(Err(err)) => {
+            report.push(
+                format!("{name} connect"),
+                CheckStatus::Failed,
+                err.to_string(),
+            );
+            return;
+        }
+        Err(_) => {
+            report.push(
+                format!("{name} connect"),
+                CheckStatus::Failed,
+                "connect timeout".to_string(),
+            );
+            return;
+        }
+    };
+
+    // Run the same reset query used when a dirty connection is returned to the pool.
+    server.mark_dirty();
+    report.push_result(
+        format!("{name} reset query"),
+        match server.checkin_cleanup().await {
+            Ok(_) => Ok("session state reset".to_string()),
+            Err(err) => Err(err.to_string()),
+        },
+    );
+}
+
+/// Run auth_query of each pool with auth_user for the auth_user itself, on a
+/// server connection of its pool like a login does.
+async fn check_auth_query(
+    config: &Config,
+    client_server_map: ClientServerMap,
+    report: &mut SelftestReport,
+) {
+    let mut auth_pools: Vec<(&String, &String)> = config
+        .pools
+        .iter()
+        .filter(|(pool_name, _)| *pool_name != WILDCARD_DATABASE)
+        .filter_map(|(pool_name, pool)| Some((pool_name, pool.auth_user.as_ref()?)))
+        .collect();
+    if auth_pools.is_empty() {
+        report.push(
+            "auth_query".to_string(),
+            CheckStatus::Skipped,
+            "auth_query is not configured".to_string(),
+        );
+        return;
+    }
+    if let Err(err) = ConnectionPool::from_config(client_server_map).await {
+        report.push(
+            "auth_query".to_string(),
+            CheckStatus::Failed,
+            format!("pools not created: {err}"),
+        );
+        return;
+    }
+
+    auth_pools.sort();
+    for (pool_name, auth_user) in auth_pools {
+        report.push_result(
+            format!("auth_query [pool: {pool_name}][user: {auth_user}]"),
+            match fetch_auth_query_password(pool_name, auth_user, None).await {
+                Ok(Some(_)) => Ok("returned the password of auth_user".to_string()),
+                Ok(None) => Ok("ran, auth_user has no password".to_string()),
+                Err(err) => Err(err.to_string()),
+            },
+        );
+    }
+}
+
+/// Check the configuration without connecting anywhere, for CI before a rollout:
+/// the files it refers to are readable, the backend hosts resolve and no two
+/// pools or users of a pool clash. The config is already parsed and validated.
+pub async fn run_config_check(config: &Config) -> SelftestReport {
+    let mut report = SelftestReport::default();
+    report.push(
+        format!("config {}", config.path),
+        CheckStatus::Ok,
+        "parsed and validated".to_string(),
+    );
+
+    for (option, path) in config_files(config) {
+        report.push_result(format!("{option} {path}"), check_readable(&path));
+    }
+
+    let mut pool_names: Vec<&String> = config.pools.keys().collect();
+    pool_names.sort();
+    for pool_name in pool_names {
+        let pool = &config.pools[pool_name];
+        let mut addresses: Vec<(String, u16)> = match pool.server_addresses() {
+            Ok(addresses) => addresses
+                .into_iter()
+                .map(|(host, port, _)| (host, port))
+                .collect(),
+            Err(err) => {
+                report.push(
+                    format!("pools.{pool_name}.server_hosts"),
+                    CheckStatus::Failed,
+                    err.to_string(),
+                );
+                continue;
+            }
+        };
+        match pool.replica_addresses() {
+            Ok(replicas) => addresses.extend(replicas),
+            Err(err) => report.push(
+                format!("pools.{pool_name}.replica_hosts"),
+                CheckStatus::Failed,
+                err.to_string(),
+            ),
+        }
+        for (host, port) in addresses {
+            // Unix socket directory.
+            if host.starts_with('/') {
+                continue;
+            }
+            report.push_result(
+                format!("pools.{pool_name} host {host}:{port}"),
+                check_resolve(&host, port).await,
+            );
+        }
+    }
+
+    for clash in name_clashes(config) {
+        report.push("names".to_string(), CheckStatus::Failed, clash);
+    }
+
+    report
+}
+
+/// The files of the config with the options naming them.
+fn config_files(config: &Config) -> Vec<(String, String)> {
+    let mut files = Vec::new();
+    let mut add = |option: String, path: &Option<String>| {
+        if let Some(path) = path {
+            files.push((option, path.clone()));
+        }
+    };
+    let general = &config.general;
+    add(
+        "general.tls_certificate".to_string(),
+        &general.tls_certificate,
+    );
+    add(
+        "general.tls_private_key".to_string(),
+        &general.tls_private_key,
+    );
+    add("general.tls_ca_cert".to_string(), &general.tls_ca_cert);
+    add(
+        "general.tls_cert_ident_file".to_string(),
+        &general.tls_cert_ident_file,
+    );
+    add("general.hba_file".to_string(), &general.hba_file);
+    for route in &general.tls_sni {
+        let name = &route.server_name;
+        add(
+            format!("general.tls_sni {name} tls_certificate"),
+            &route.tls_certificate,
+        );
+        add(
+            format!("general.tls_sni {name} tls_private_key"),
+            &route.tls_private_key,
+        );
+    }
+
+    let mut pool_names: Vec<&String> = config.pools.keys().collect();
+    pool_names.sort();
+    for pool_name in pool_names {
+        let pool = &config.pools[pool_name];
+        add(
+            format!("pools.{pool_name}.server_tls_ca_cert"),
+            &pool.server_tls_ca_cert,
+        );
+        add(
+            format!("pools.{pool_name}.server_tls_certificate"),
+            &pool.server_tls_certificate,
+        );
+        add(
+            format!("pools.{pool_name}.server_tls_private_key"),
+            &pool.server_tls_private_key,
+        );
+    }
+
+    let mut issuer_names: Vec<&String> = config.jwt_issuers.keys().collect();
+    issuer_names.sort();
+    for name in issuer_names {
+        let issuer = &config.jwt_issuers[name];
+        for key in &issuer.keys {
+            add(format!("jwt_issuers.{name}.keys"), &Some(key.clone()));
+        }
+        add(format!("jwt_issuers.{name}.jwks_file"), &issuer.jwks_file);
+    }
+
+    let mut server_names: Vec<&String> = config.ldap_servers.keys().collect();
+    server_names.sort();
+    for name in server_names {
+        add(
+            format!("ldap_servers.{name}.tls_ca_cert"),
+            &config.ldap_servers[name].tls_ca_cert,
+        );
+    }
+    files
+}
+
+fn check_readable(path: &str) -> Result<String, String> {
+    match std::fs::File::open(path).and_then(|file| file.metadata()) {
+        Ok(metadata) if metadata.is_file() => Ok(format!("readable, {} bytes", metadata.len())),
+        Ok(_) => Err("not a file".to_string()),
+        Err(err) => Err(format!("can't read: {err}")),
+    }
+}
+
+async fn check_resolve(host: &str, port: u16) -> Result<String, String> {
+    match timeout(
+        Duration::from_secs(5),
+        tokio::net::lookup_host((host, port)),
+    )
+    .await
+    {
+        Ok(Ok(mut addrs)) => match addrs.next() {
+            Some(addr) => Ok(format!("resolves to {}", addr.ip())),
+            None => Err(format!("{host} doesn't resolve to any address")),
+        },
+        Ok(Err(err)) => Err(format!("can't resolve {host}: {err}")),
+        Err(_) => Err(format!("resolving {host} timed out")),
+    }
+}
+
+/// Pools whose names differ only in case, users listed twice in a pool.
+fn name_clashes(config: &Config) -> Vec<String> {
+    let mut clashes = Vec::new();
+    let mut pool_names: Vec<&String> = config.pools.keys().collect();
+    pool_names.sort();
+    for (index, pool_name) in pool_names.iter().enumerate() {
+        for other in &pool_names[index + 1..] {
+            if pool_name.eq_ignore_ascii_case(other) {
+                clashes.push(format!(
+                    "pools.{pool_name} and pools.{other} differ only in case"
+                ));
+            }
+        }
+        let mut seen: HashMap<&str, &String> = HashMap::new();
+        for (key, user) in &config.pools[*pool_name].users {
+            if let Some(first) = seen.insert(&user.username, key) {
+                clashes.push(format!(
+                    "pools.{pool_name}.users.{first} and pools.{pool_name}.users.{key} are both user {}",
+                    user.username
+                ));
+            }
+        }
+    }
+    clashes
+}
+
+fn check_bind(host: &str, port: u16) -> Result<String, String> {
+    let addr = match (host, port).to_socket_addrs() {
+        Ok(mut addrs) => match addrs.next() {
+            Some(addr) => addr,
+            None => return Err(format!("{host} doesn't resolve to any address")),
+        },
+        Err(err) => return Err(format!("can't resolve {host}: {err}")),
+    };
+    let socket = if addr.is_ipv4() {
+        TcpSocket::new_v4()
+    } else {
+        TcpSocket::new_v6()
+    }
+    .map_err(|err| format!("can't create socket: {err}"))?;
+    // Same options as the real listener, so a running instance doesn't make the check fail.
+    socket
+        .set_reuseaddr(true)
+        .map_err(|err| format!("can't set reuseaddr: {err}"))?;
+    socket
+        .set_reuseport(true)
+        .map_err(|err| format!("can't set reuseport: {err}"))?;
+    socket
+        .bind(addr)
+        .map_err(|err| format!("can't bind {addr}: {err}"))?;
+    socket
+        .listen(1)
+        .map_err(|err| format!("can't listen on {addr}: {err}"))?;
+    Ok(format!("bound {addr}"))
+}
+
+async fn check_tls(config: &Config, report: &mut SelftestReport) {
+    let (cert, key) = match (
+        config.general.tls_certificate.as_ref(),
+        config.general.tls_private_key.as_ref(),
+    ) {
+        (Some(cert), Some(key)) => (cert, key),
+        _ => {
+            report.push(
+                "tls handshake".to_string(),
+                CheckStatus::Skipped,
+                "tls_certificate is not configured".to_string(),
+            );
+            return;
+        }
+    };
+
+    if let Some(ref mode) = config.general.tls_mode {
+        if matches!(TLSMode::from_string(mode), Ok(TLSMode::VerifyFull)) {
+            report.push(
+                "tls handshake".to_string(),
+                CheckStatus::Skipped,
+                "tls_mode verify-full requires a client certificate".to_string(),
+            );
+            return;
+        }
+    }
+
+    let acceptor = match build_acceptor(
+        Path::new(cert),
+        Path::new(key),
+        config.general.tls_ca_cert.clone(),
+        config.general.tls_mode.clone(),
+        &config.general.tls_sni,
+        &TlsProtocols::from_general(&config.general),
+    ) {
+        Ok(acceptor) => acceptor,
+        Err(err) => {
+            report.push(
+                "tls handshake".to_string(),
+                CheckStatus::Failed,
+                err.to_string(),
+            );
+            return;
+        }
+    };
+
+    report.push_result(
+        "tls handshake".to_string(),
+        tls_handshake_with_self(acceptor).await,
+    );
+}
+
+/// Accept a TLS connection on a loopback socket and connect to it.
+async fn tls_handshake_with_self(
+    acceptor: tokio_native_tls::TlsAcceptor,
+) -> Result<String, String> {
+    let listener = TcpListener::bind(SocketAddr::from(([127, 0, 0, 1], 0)))
+        .await
+        .map_err(|err| format!("can't bind loopback listener: {err}"))?;
+    let local_addr = listener
+        .local_addr()
+        .map_err(|err| format!("can't get loopback address: {err}"))?;
+
+    let server = tokio::spawn(async move {
+        let (stream, _) = listener.accept().await.map_err(|err| err.to_string())?;
+        acceptor
+            .accept(stream)
+            .await
+            .map(|_| ())
+            .map_err(|err| err.to_string())
+    });
+
+    // The certificate is issued for the real host name, not for the loopback address.
+    let connector = native_tls::TlsConnector::builder()
+        .danger_accept_invalid_certs(true)
+        .danger_accept_invalid_hostnames(true)
+        .build()
+        .map_err(|err| format!("can't build tls connector: {err}"))?;
+    let connector = tokio_native_tls::TlsConnector::from(connector);
+
+    let client = async {
+        let stream = TcpStream::connect(local_addr)
+            .await
+            .map_err(|err| format!("can't connect to loopback listener: {err}"))?;
+        connector
+            .connect("localhost", stream)
+            .await
+            .map(|_| ())
+            .map_err(|err| format!("client handshake failed: {err}"))
+    };
+
+    match timeout(Duration::from_secs(5), client).await {
+        Ok(Ok(())) => (),
+        Ok(Err(err)) => return Err(err),
+        Err(_) => return Err("handshake timeout".to_string()),
+    }
+
+    match server.await {
+        Ok(Ok(())) => Ok("handshake completed".to_string()),
+        Ok(Err(err)) => Err(format!("server handshake failed: {err}")),
+        Err(err) => Err(format!("server handshake task failed: {err}")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report_status() {
+        let mut report = SelftestReport::default();
+        report.push("a".to_string(), CheckStatus::Ok, "fine".to_string());
+        report.push("b".to_string(), CheckStatus::Skipped, "n/a".to_string());
+        assert!(report.is_ok());
+        assert!(report.to_string().ends_with("PASSED"));
+
+        report.push_result("c".to_string(), Err("broken".to_string()));
+        assert!(!report.is_ok());
+        assert!(report.to_string().contains("[ FAIL ] c: broken"));
+        assert!(report.to_string().ends_with("FAILED"));
+    }
+
+    #[test]
+    fn test_name_clashes() {
+        let mut config = Config::default();
+        let mut pool = crate::config::Pool::default();
+        for key in ["0", "1", "2"] {
+            let mut user = crate::config::User::default();
+            user.username = if key == "2" { "app" } else { "reader" }.to_string();
+            pool.users.insert(key.to_string(), user);
+        }
+        config.pools.insert("orders".to_string(), pool.clone());
+        pool.users.remove("1");
+        config.pools.insert("Orders".to_string(), pool);
+
+        assert_eq!(
+            name_clashes(&config),
+            vec![
+                "pools.Orders and pools.orders differ only in case".to_string(),
+                "pools.orders.users.0 and pools.orders.users.1 are both user reader".to_string(),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_check_readable() {
+        assert!(check_readable(env!("CARGO_MANIFEST_DIR")).is_err());
+        assert!(check_readable("/nonexistent/server.crt").is_err());
+        let manifest = format!("{}/Cargo.toml", env!("CARGO_MANIFEST_DIR"));
+        assert!(check_readable(&manifest).is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_check_bind_ephemeral_port() {
+        assert!(check_bind("127.0.0.1", 0).is_ok());
+    }
+}
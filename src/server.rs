@@ -1,40 +1,56 @@
 // Implementation of the PostgreSQL server (database) protocol.
 
 // Standard library imports
-use std::collections::{HashMap, HashSet, VecDeque};
+use std::collections::{BTreeMap, HashMap, HashSet, VecDeque};
 use std::mem;
+use std::net::{IpAddr, SocketAddr};
 use std::num::NonZeroUsize;
 use std::string::ToString;
+use std::sync::atomic::Ordering;
 use std::sync::Arc;
 use std::time::{Duration, SystemTime};
 
 // External crate imports
 use bytes::{Buf, BufMut, BytesMut};
-use log::{error, info, warn};
+use log::{debug, error, info, warn};
 use lru::LruCache;
 use once_cell::sync::Lazy;
 use pin_project_lite::pin_project;
-use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, BufStream};
-use tokio::net::{TcpStream, UnixStream};
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufStream};
+use tokio::net::{TcpSocket, TcpStream, UnixStream};
 use tokio::time::timeout;
 
 // Internal crate imports
 use crate::auth::jwt::{new_claims, sign_with_jwt_priv_key};
-use crate::config::{get_config, Address, User, VERSION};
+use crate::config::{get_config, Address, Config, Pool, ServerTlsMode, User, VERSION};
 use crate::constants::*;
+use crate::dns_cache::resolve_host;
 use crate::errors::Error::MaxMessageSize;
 use crate::errors::{Error, ServerIdentifier};
+use crate::fd_limit::{is_fd_exhausted, record_fd_exhaustion};
 use crate::messages::BytesMutReader;
 use crate::messages::*;
 use crate::pool::{ClientServerMap, CANCELED_PIDS};
 use crate::scram_client::ScramSha256;
 use crate::stats::ServerStats;
+use crate::tls::build_server_connector;
 
 const COMMAND_COMPLETE_BY_SET: &[u8; 4] = b"SET\0";
+const COMMAND_COMPLETE_BY_RESET: &[u8; 6] = b"RESET\0";
+const COMMAND_COMPLETE_BY_LISTEN: &[u8; 7] = b"LISTEN\0";
 const COMMAND_COMPLETE_BY_DECLARE: &[u8; 15] = b"DECLARE CURSOR\0";
 const COMMAND_COMPLETE_BY_DEALLOCATE_ALL: &[u8; 15] = b"DEALLOCATE ALL\0";
 const COMMAND_COMPLETE_BY_DISCARD_ALL: &[u8; 12] = b"DISCARD ALL\0";
 
+/// Tag recorded for an Execute with a row limit that stopped with PortalSuspended,
+/// its statement completes with a later Execute.
+const PORTAL_SUSPENDED_TAG: &str = "PORTAL SUSPENDED";
+
+/// Last response to a Parse, Bind, Close, Describe or Execute message, see set_flush_pending.
+/// An Execute starting a COPY is answered with CopyInResponse, CopyOutResponse or
+/// CopyBothResponse, the responses ending the COPY are read with the COPY messages.
+const FLUSH_RESPONSE_CODES: &[char] = &['1', '2', '3', 'T', 'n', 'C', 'I', 's', 'G', 'H', 'W'];
+
 pin_project! {
     #[project = SteamInnerProj]
     #[derive(Debug)]
@@ -43,6 +59,10 @@ pin_project! {
             #[pin]
             stream: TcpStream,
         },
+        TCPTls {
+            #[pin]
+            stream: tokio_native_tls::TlsStream<TcpStream>,
+        },
         UnixSocket {
             #[pin]
             stream: UnixStream,
@@ -59,6 +79,7 @@ impl AsyncWrite for StreamInner {
         let this = self.project();
         match this {
             SteamInnerProj::TCPPlain { stream } => stream.poll_write(cx, buf),
+            SteamInnerProj::TCPTls { stream } => stream.poll_write(cx, buf),
             SteamInnerProj::UnixSocket { stream } => stream.poll_write(cx, buf),
         }
     }
@@ -70,6 +91,7 @@ impl AsyncWrite for StreamInner {
         let this = self.project();
         match this {
             SteamInnerProj::TCPPlain { stream } => stream.poll_flush(cx),
+            SteamInnerProj::TCPTls { stream } => stream.poll_flush(cx),
             SteamInnerProj::UnixSocket { stream } => stream.poll_flush(cx),
         }
     }
@@ -81,6 +103,7 @@ impl AsyncWrite for StreamInner {
         let this = self.project();
         match this {
             SteamInnerProj::TCPPlain { stream } => stream.poll_shutdown(cx),
+            SteamInnerProj::TCPTls { stream } => stream.poll_shutdown(cx),
             SteamInnerProj::UnixSocket { stream } => stream.poll_shutdown(cx),
         }
     }
@@ -95,6 +118,7 @@ impl AsyncRead for StreamInner {
         let this = self.project();
         match this {
             SteamInnerProj::TCPPlain { stream } => stream.poll_read(cx, buf),
+            SteamInnerProj::TCPTls { stream } => stream.poll_read(cx, buf),
             SteamInnerProj::UnixSocket { stream } => stream.poll_read(cx, buf),
         }
     }
@@ -104,9 +128,78 @@ impl StreamInner {
     pub fn try_write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
         match self {
             StreamInner::TCPPlain { stream } => stream.try_write(buf),
+            // TLS records can't be written without the async context.
+            StreamInner::TCPTls { .. } => Err(std::io::Error::new(
+                std::io::ErrorKind::Unsupported,
+                "synchronous write over TLS",
+            )),
             StreamInner::UnixSocket { stream } => stream.try_write(buf),
         }
     }
+
+    pub fn is_tls(&self) -> bool {
+        matches!(self, StreamInner::TCPTls { .. })
+    }
+}
+
+/// Session timeouts set on the servers from the pool settings, see set_session_timeouts.
+const SESSION_TIMEOUTS: [&str; 2] = ["statement_timeout", "idle_in_transaction_session_timeout"];
+
+/// A session timeout left by the client, replayed with its session parameters.
+const CLIENT_TIMEOUT: u64 = u64::MAX;
+
+/// Whether the responses hold an ErrorResponse.
+fn has_error_response(response: &[u8]) -> bool {
+    let mut rest = response;
+    while rest.len() >= 5 {
+        if rest[0] == b'E' {
+            return true;
+        }
+        let len = i32::from_be_bytes([rest[1], rest[2], rest[3], rest[4]]) as usize + 1;
+        if len < 5 || len > rest.len() {
+            break;
+        }
+        rest = &rest[len..];
+    }
+    false
+}
+
+/// Queries bringing the session parameters set on a server (`current`) to the
+/// ones recorded for a client (`wanted`), empty if they are the same.
+fn session_parameters_query(
+    current: &BTreeMap<String, String>,
+    wanted: &BTreeMap<String, String>,
+) -> String {
+    let mut query = String::new();
+    for name in current.keys() {
+        if !wanted.contains_key(name) {
+            query.push_str(&format!("RESET {};", quote_identifier(name)));
+        }
+    }
+    let set_configs: Vec<String> = wanted
+        .iter()
+        .filter(|(name, value)| current.get(*name) != Some(*value))
+        .map(|(name, value)| {
+            // set_config() takes the setting of pg_settings as is, lists (search_path) included.
+            format!(
+                "pg_catalog.set_config('{}', '{}', false)",
+                name.replace('\'', "''"),
+                value.replace('\'', "''")
+            )
+        })
+        .collect();
+    if !set_configs.is_empty() {
+        query.push_str(&format!("SELECT {};", set_configs.join(", ")));
+    }
+    query
+}
+
+/// Quote every part of a dotted parameter name (custom parameters: myapp.tenant).
+fn quote_identifier(name: &str) -> String {
+    name.split('.')
+        .map(|part| format!("\"{}\"", part.replace('"', "\"\"")))
+        .collect::<Vec<_>>()
+        .join(".")
 }
 
 #[derive(Copy, Clone, Debug)]
@@ -119,6 +212,10 @@ struct CleanupState {
 
     /// If server connection requires CLOSE ALL before checkin because of declare statement
     needs_cleanup_declare: bool,
+
+    /// If server connection requires RESET SESSION AUTHORIZATION and RESET ROLE before checkin,
+    /// whatever cleanup_server_connections says: the next client must not get the role.
+    needs_cleanup_role: bool,
 }
 
 impl CleanupState {
@@ -127,6 +224,7 @@ impl CleanupState {
             needs_cleanup_set: false,
             needs_cleanup_prepare: false,
             needs_cleanup_declare: false,
+            needs_cleanup_role: false,
         }
     }
 
@@ -140,6 +238,7 @@ impl CleanupState {
         self.needs_cleanup_set = true;
         self.needs_cleanup_prepare = true;
         self.needs_cleanup_declare = true;
+        self.needs_cleanup_role = true;
     }
 
     #[inline(always)]
@@ -147,6 +246,7 @@ impl CleanupState {
         self.needs_cleanup_set = false;
         self.needs_cleanup_prepare = false;
         self.needs_cleanup_declare = false;
+        self.needs_cleanup_role = false;
     }
 }
 
@@ -154,8 +254,11 @@ impl std::fmt::Display for CleanupState {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         write!(
             f,
-            "SET: {}, PREPARE: {}, DECLARE: {}",
-            self.needs_cleanup_set, self.needs_cleanup_prepare, self.needs_cleanup_declare
+            "SET: {}, PREPARE: {}, DECLARE: {}, ROLE: {}",
+            self.needs_cleanup_set,
+            self.needs_cleanup_prepare,
+            self.needs_cleanup_declare,
+            self.needs_cleanup_role
         )
     }
 }
@@ -256,6 +359,10 @@ impl ServerParameters {
         diff
     }
 
+    pub fn get(&self, key: &str) -> Option<&String> {
+        self.parameters.get(key)
+    }
+
     pub fn get_application_name(&self) -> &String {
         // Can unwrap because we set it in the constructor
         self.parameters.get("application_name").unwrap()
@@ -276,6 +383,71 @@ impl ServerParameters {
     }
 }
 
+/// ParameterStatus values reported to the clients of a pool instead of the server ones.
+#[derive(Debug, Clone, Default)]
+pub struct ParameterStatusOverrides {
+    /// Replaced values by lowercase parameter name.
+    values: HashMap<String, String>,
+
+    /// Lowercase names of the parameters never reported.
+    suppressed: HashSet<String>,
+}
+
+impl ParameterStatusOverrides {
+    /// Overrides configured for a pool, None if it has none.
+    pub fn from_pool(pool: &Pool) -> Option<Self> {
+        if pool.parameter_status_overrides.is_empty() && pool.parameter_status_suppress.is_empty() {
+            return None;
+        }
+        Some(ParameterStatusOverrides {
+            values: pool
+                .parameter_status_overrides
+                .iter()
+                .map(|(key, value)| (key.to_ascii_lowercase(), value.clone()))
+                .collect(),
+            suppressed: pool
+                .parameter_status_suppress
+                .iter()
+                .map(|key| key.to_ascii_lowercase())
+                .collect(),
+        })
+    }
+
+    /// Parameter names are matched ignoring case, like PostgreSQL does.
+    pub fn applies_to(&self, key: &str) -> bool {
+        let key = key.to_ascii_lowercase();
+        self.suppressed.contains(&key) || self.values.contains_key(&key)
+    }
+
+    /// Value of the parameter reported to the client, None if it's not reported.
+    pub fn reported<'a>(&'a self, key: &str, value: &'a str) -> Option<&'a str> {
+        let key = key.to_ascii_lowercase();
+        if self.suppressed.contains(&key) {
+            return None;
+        }
+        Some(self.values.get(&key).map_or(value, String::as_str))
+    }
+}
+
+impl ServerParameters {
+    /// ParameterStatus messages sent to a client on startup.
+    pub fn client_messages(&self, overrides: Option<&ParameterStatusOverrides>) -> BytesMut {
+        let overrides = match overrides {
+            Some(overrides) => overrides,
+            None => return self.into(),
+        };
+        let mut bytes = BytesMut::new();
+
+        for (key, value) in &self.parameters {
+            if let Some(value) = overrides.reported(key, value) {
+                ServerParameters::add_parameter_message(key, value, &mut bytes);
+            }
+        }
+
+        bytes
+    }
+}
+
 impl From<&ServerParameters> for BytesMut {
     fn from(server_parameters: &ServerParameters) -> Self {
         let mut bytes = BytesMut::new();
@@ -319,7 +491,27 @@ pub struct Server {
     /// Is the server in copy-in or copy-out modes
     in_copy_mode: bool,
 
-    flush_wait_code: char,
+    /// A two-phase commit command (PREPARE TRANSACTION, COMMIT/ROLLBACK PREPARED)
+    /// completed since the client last checked.
+    two_phase_completed: bool,
+
+    /// Clients called functions taking session-level advisory locks since the
+    /// last pg_advisory_unlock_all() or DISCARD ALL, the server may hold some.
+    advisory_locks: bool,
+
+    /// A client ran LISTEN: notifications may arrive between queries until UNLISTEN * at checkin.
+    listening: bool,
+
+    /// Messages were sent with Flush and their Sync is yet to come: the responses
+    /// go to the client as they come and the server stays with it.
+    async_mode: bool,
+
+    /// Responses the messages sent with Flush still owe, the read ends with the last one.
+    flush_pending: usize,
+
+    /// A COPY started by an Execute sent with Flush: the read ending the COPY
+    /// ends with its CommandComplete or ErrorResponse if nothing else is owed.
+    flush_copy: bool,
 
     /// Is the server broken? We'll remote it from the pool if so.
     bad: bool,
@@ -333,6 +525,10 @@ pub struct Server {
     /// Server connected at.
     connected_at: chrono::naive::NaiveDateTime,
 
+    /// Percent (0-20) server_lifetime is shortened by for this connection, so the
+    /// connections opened together aren't closed together.
+    lifetime_jitter_percent: u64,
+
     /// Reports various metrics, e.g. data sent & received.
     pub stats: Arc<ServerStats>,
 
@@ -345,6 +541,33 @@ pub struct Server {
     /// Should clean up dirty connections?
     cleanup_connections: bool,
 
+    /// default_transaction_read_only was set for a client of a read_only listener.
+    read_only: bool,
+
+    /// Session timeouts (ms) set from the pool settings, in the order of SESSION_TIMEOUTS:
+    /// 0 for the server default, CLIENT_TIMEOUT for a value the client set.
+    session_timeouts: [u64; 2],
+
+    /// Close the connection if the reset queries take longer than this.
+    reset_timeout: Option<Duration>,
+
+    /// Query run instead of resetting the altered session state (server_reset_query).
+    reset_query: Option<String>,
+
+    /// The client doesn't wait for the reset queries (server_reset_in_background).
+    reset_in_background: bool,
+
+    /// Session parameters of the clients with track_session_parameters, as set on
+    /// this connection, and whether a SET or RESET may have changed them since.
+    session_parameters: BTreeMap<String, String>,
+    session_parameters_changed: bool,
+
+    /// CommandComplete tags received since collect_command_tags, for the audit log.
+    command_tags: Option<Vec<String>>,
+
+    /// ParameterStatus values reported to the clients instead of the server ones.
+    parameter_status_overrides: Option<ParameterStatusOverrides>,
+
     /// Log client parameter status changes
     log_client_parameter_status_changes: bool,
 
@@ -354,6 +577,10 @@ pub struct Server {
     /// Prepared statement being currently registered on the server.
     registering_prepared_statement: VecDeque<String>,
 
+    /// Open portals, the unnamed one included, and the prepared statements they were
+    /// bound to. They last until Close or the end of the transaction.
+    portals: HashMap<String, String>,
+
     /// Max message size
     max_message_size: i32,
 }
@@ -397,6 +624,27 @@ impl Server {
         Ok(())
     }
 
+    /// Execute a query with the simple query protocol and return the rows of its result as text.
+    /// Meant for small results, like a lookup in a catalog.
+    pub async fn simple_query_rows(
+        &mut self,
+        query: &str,
+    ) -> Result<Vec<Vec<Option<String>>>, Error> {
+        self.send_and_flush(&simple_query(query)).await?;
+
+        let mut response = BytesMut::new();
+        let mut noop = tokio::io::sink();
+        loop {
+            response.put(self.recv(&mut noop, None).await?);
+
+            if !self.data_available {
+                break;
+            }
+        }
+
+        parse_data_rows(&response)
+    }
+
     #[inline(always)]
     pub fn get_process_id(&self) -> i32 {
         self.process_id
@@ -509,10 +757,13 @@ impl Server {
             };
 
             // Buffer the message we'll forward to the client later.
+            let message_start = self.buffer.len();
             self.buffer.put(&message[..]);
 
             let code = message.get_u8() as char;
             let _len = message.get_i32();
+            let mut flush_response = self.flush_pending > 0 && FLUSH_RESPONSE_CODES.contains(&code);
+            let mut flush_copy_done = false;
 
             match code {
                 // ReadyForQuery
@@ -528,6 +779,7 @@ impl Server {
                         // Idle, transaction over.
                         'I' => {
                             self.in_transaction = false;
+                            self.portals.clear();
                         }
 
                         // Some error occurred, the transaction was rolled back.
@@ -571,6 +823,9 @@ impl Server {
 
                     // There is no more data available from the server.
                     self.data_available = false;
+                    self.async_mode = false;
+                    self.flush_pending = 0;
+                    self.flush_copy = false;
                     break;
                 }
 
@@ -619,12 +874,12 @@ impl Server {
                         self.cleanup_state.needs_cleanup_prepare = true;
                     }
 
-                    // Handle async mode errors
-                    if self.is_async() {
+                    // The server skips the flushed messages up to Sync, they owe nothing more.
+                    if self.flush_pending > 0 || self.flush_copy {
+                        self.flush_pending = 0;
+                        self.flush_copy = false;
                         self.data_available = false;
-                        self.set_flush_wait_code(code);
-                        self.cleanup_state.needs_cleanup();
-                        self.mark_bad("PostgreSQL error in asynchronous operation mode");
+                        break;
                     }
                 }
 
@@ -632,15 +887,45 @@ impl Server {
                 'C' => {
                     if self.in_copy_mode {
                         self.in_copy_mode = false;
+                        // The Execute of the COPY got its response when the COPY started.
+                        if self.flush_copy {
+                            self.flush_copy = false;
+                            flush_response = false;
+                            flush_copy_done = true;
+                        }
+                    }
+                    if let Some(command_tags) = self.command_tags.as_mut() {
+                        let tag = message.strip_suffix(b"\0").unwrap_or(&message[..]);
+                        command_tags.push(String::from_utf8_lossy(tag).into_owned());
                     }
                     // CommandComplete SET одинаковый для set local и set, чистим.
                     if message.len() == 4 && message.to_vec().eq(COMMAND_COMPLETE_BY_SET) {
                         self.cleanup_state.needs_cleanup_set = true;
+                        self.session_parameters_changed = true;
+                    }
+                    if message.len() == 6 && message.to_vec().eq(COMMAND_COMPLETE_BY_RESET) {
+                        self.session_parameters_changed = true;
                     }
                     if message.len() == 15 && message.to_vec().eq(COMMAND_COMPLETE_BY_DECLARE) {
                         self.cleanup_state.needs_cleanup_declare = true;
                     }
+                    if message.len() == 7 && message.to_vec().eq(COMMAND_COMPLETE_BY_LISTEN) {
+                        self.listening = true;
+                    }
+                    if message.starts_with(b"PREPARE TRANSACTION")
+                        || message.starts_with(b"COMMIT PREPARED")
+                        || message.starts_with(b"ROLLBACK PREPARED")
+                    {
+                        self.two_phase_completed = true;
+                    }
                     if message.len() == 12 && message.to_vec().eq(COMMAND_COMPLETE_BY_DISCARD_ALL) {
+                        // DISCARD ALL releases advisory locks and unlistens too.
+                        self.set_advisory_locks(false);
+                        self.listening = false;
+                        self.read_only = false;
+                        self.session_timeouts = [0; 2];
+                        self.session_parameters.clear();
+                        self.session_parameters_changed = true;
                         self.registering_prepared_statement.clear();
                         if self.prepared_statement_cache.is_some() {
                             warn!("Cleanup server {self} prepared statements cache (DISCARD ALL)");
@@ -658,16 +943,17 @@ impl Server {
                             self.prepared_statement_cache.as_mut().unwrap().clear();
                         }
                     }
-                    if self.flush_wait_code == 'C' {
-                        self.data_available = false;
-                        break;
-                    }
                 }
 
                 'S' => {
                     let key = message.read_string().unwrap();
                     let value = message.read_string().unwrap();
 
+                    // Reported on SET SESSION AUTHORIZATION, however it was issued.
+                    if key == "session_authorization" {
+                        self.cleanup_state.needs_cleanup_role = true;
+                    }
+
                     if let Some(client_server_parameters) = client_server_parameters.as_mut() {
                         client_server_parameters.set_param(key.clone(), value.clone(), false);
                         if self.log_client_parameter_status_changes {
@@ -675,6 +961,20 @@ impl Server {
                         }
                     }
 
+                    // Report the value of the pool to the client instead, or nothing.
+                    if let Some(ref overrides) = self.parameter_status_overrides {
+                        if overrides.applies_to(&key) {
+                            self.buffer.truncate(message_start);
+                            if let Some(reported) = overrides.reported(&key, &value) {
+                                ServerParameters::add_parameter_message(
+                                    &key,
+                                    reported,
+                                    &mut self.buffer,
+                                );
+                            }
+                        }
+                    }
+
                     self.server_parameters.set_param(key, value, false);
                 }
 
@@ -690,8 +990,13 @@ impl Server {
                 }
 
                 // CopyInResponse: copy is starting from client to server.
-                'G' => {
+                // CopyBothResponse: the same, with data from the server too.
+                'G' | 'W' => {
                     self.in_copy_mode = true;
+                    if flush_response {
+                        self.flush_pending -= 1;
+                        self.flush_copy = true;
+                    }
                     break;
                 }
 
@@ -699,6 +1004,10 @@ impl Server {
                 'H' => {
                     self.in_copy_mode = true;
                     self.data_available = true;
+                    if flush_response {
+                        self.flush_pending -= 1;
+                        self.flush_copy = true;
+                    }
                     break;
                 }
 
@@ -714,12 +1023,13 @@ impl Server {
                 // Buffer until ReadyForQuery shows up, so don't exit the loop yet.
                 'c' => (),
 
-                // NoData
-                // https://www.postgresql.org/docs/current/protocol-flow.html
-                'n' => {
-                    if self.is_async() {
-                        self.data_available = false;
-                        self.set_flush_wait_code(code);
+                // PortalSuspended
+                // An Execute with a row limit returned the rows, the portal keeps the rest
+                // for the next Execute until the transaction ends. The transaction (or the
+                // Flush of a pipeline) keeps the server with the client meanwhile.
+                's' => {
+                    if let Some(command_tags) = self.command_tags.as_mut() {
+                        command_tags.push(PORTAL_SUSPENDED_TAG.to_string());
                     }
                 }
 
@@ -728,7 +1038,11 @@ impl Server {
                 _ => (),
             };
 
-            if !self.data_available && code == self.flush_wait_code {
+            if flush_response {
+                self.flush_pending -= 1;
+            }
+            if (flush_response || flush_copy_done) && self.flush_pending == 0 {
+                self.data_available = false;
                 break;
             }
         }
@@ -792,7 +1106,7 @@ impl Server {
 
     #[inline(always)]
     pub fn is_async(&self) -> bool {
-        self.flush_wait_code != ' '
+        self.async_mode
     }
 
     pub async fn send_and_flush_timeout(
@@ -845,14 +1159,38 @@ impl Server {
         self.in_copy_mode
     }
 
+    /// Returns true once if a two-phase commit command completed since the last call.
+    pub fn take_two_phase_completed(&mut self) -> bool {
+        mem::take(&mut self.two_phase_completed)
+    }
+
+    /// Mark the server as maybe holding session-level advisory locks, or not once
+    /// they were all released. Only the pooler releases them, unlock calls of the
+    /// clients leave the mark.
+    pub fn set_advisory_locks(&mut self, locks: bool) {
+        self.advisory_locks = locks;
+        self.stats.advisory_locks.store(locks, Ordering::Relaxed);
+    }
+
     #[inline(always)]
     pub fn address_to_string(&self) -> String {
         self.address.to_string()
     }
 
+    /// The connection is to this host of the pool.
+    pub fn connected_to(&self, host: &str, port: u16) -> bool {
+        self.address.host == host && self.address.port == port
+    }
+
+    /// Lifetime of this connection (ms): server_lifetime shortened by its jitter.
+    pub fn lifetime(&self, server_lifetime: u64) -> u64 {
+        server_lifetime - server_lifetime / 100 * self.lifetime_jitter_percent
+    }
+
     /// Perform any necessary cleanup before putting the server
     /// connection back in the pool
     pub async fn checkin_cleanup(&mut self) -> Result<(), Error> {
+        self.command_tags = None;
         if self.in_copy_mode() {
             warn!("Server {self} returned while still in copy-mode");
             self.mark_bad("returned in copy-mode");
@@ -869,6 +1207,14 @@ impl Server {
                 self.address.host, self.address.database, self.address.username
             )));
         }
+        if self.is_async() {
+            warn!("Server {self} returned before the Sync of the flushed messages");
+            self.mark_bad("returned in async mode");
+            return Err(Error::ProtocolSyncError(format!(
+                "Protocol synchronization error: Server {} (database: {}, user: {}) was returned to the pool before the Sync of the messages sent with Flush. This may indicate a client disconnected in the middle of a pipeline.",
+                self.address.host, self.address.database, self.address.username
+            )));
+        }
         if !self.buffer.is_empty() {
             warn!("Server {self} returned while buffer is not empty");
             self.mark_bad("returned with not-empty buffer");
@@ -877,6 +1223,60 @@ impl Server {
                 self.address.host, self.address.database, self.address.username
             )));
         }
+        // Most checkins have nothing to reset, don't arm a timer for them.
+        let reset_timeout = match self.reset_timeout {
+            Some(reset_timeout) if self.needs_reset() => reset_timeout,
+            _ => return self.reset_session().await,
+        };
+        match timeout(reset_timeout, self.reset_session()).await {
+            Ok(result) => result,
+            Err(_) => {
+                // The backend is wedged, a fresh connection is better than a blocked checkout.
+                self.address.stats.reset_timeout();
+                self.mark_bad(&format!(
+                    "reset queries didn't complete in {}ms",
+                    reset_timeout.as_millis()
+                ));
+                Err(Error::ServerResetTimeout(format!(
+                    "server {} (database: {}, user: {}) didn't complete the reset queries in {}ms",
+                    self.address.host,
+                    self.address.database,
+                    self.address.username,
+                    reset_timeout.as_millis()
+                )))
+            }
+        }
+    }
+
+    /// Whether the client left anything for the reset queries.
+    #[inline(always)]
+    fn needs_reset(&self) -> bool {
+        self.in_transaction()
+            || self.advisory_locks
+            || self.listening
+            || self.cleanup_state.needs_cleanup_role
+            || (self.cleanup_state.needs_cleanup() && self.cleanup_connections)
+    }
+
+    /// Start collecting the CommandComplete tags of the responses.
+    pub fn collect_command_tags(&mut self) {
+        self.command_tags = Some(Vec::new());
+    }
+
+    /// The CommandComplete tags received since collect_command_tags, collecting stops.
+    pub fn take_command_tags(&mut self) -> Vec<String> {
+        self.command_tags.take().unwrap_or_default()
+    }
+
+    /// Whether the reset queries should run without the client waiting for them:
+    /// server_reset_in_background is set and there is something to reset.
+    #[inline(always)]
+    pub fn resets_in_background(&self) -> bool {
+        self.reset_in_background && self.needs_reset()
+    }
+
+    /// Roll back the transaction and discard the session state left by the client.
+    async fn reset_session(&mut self) -> Result<(), Error> {
         // Client disconnected with an open transaction on the server connection.
         // Pgbouncer behavior is to close the server connection but that can cause
         // server connection thrashing if clients repeatedly do this.
@@ -886,18 +1286,68 @@ impl Server {
             self.small_simple_query("ROLLBACK").await?;
         }
 
+        // Session-level advisory locks outlive the client, the next one must not inherit them.
+        if self.advisory_locks {
+            warn!(
+                "Server {} returned maybe holding advisory locks for application {}, releasing them",
+                self, self.application_name
+            );
+            self.small_simple_query("SELECT pg_advisory_unlock_all()")
+                .await?;
+            self.set_advisory_locks(false);
+        }
+
+        // The next client must not get the notifications of the channels of this one.
+        if self.listening {
+            self.small_simple_query("UNLISTEN *").await?;
+            self.listening = false;
+        }
+
+        // The client switched the role of the session: reset it even without
+        // cleanup_server_connections, or discard the server if that fails.
+        if self.cleanup_state.needs_cleanup_role {
+            info!(
+                "Server {} returned with the role changed, resetting it for application {}",
+                self, self.application_name
+            );
+            if let Err(err) = self
+                .small_simple_query("RESET SESSION AUTHORIZATION;RESET ROLE;")
+                .await
+            {
+                self.mark_bad("role reset failed");
+                return Err(err);
+            }
+            self.cleanup_state.needs_cleanup_role = false;
+        }
+
         // Client disconnected but it performed session-altering operations such as
         // SET statement_timeout to 1 or create a prepared statement. We clear that
         // to avoid leaking state between clients. For performance reasons we only
         // send `RESET ALL` if we think the session is altered instead of just sending
         // it before each checkin.
         if self.cleanup_state.needs_cleanup() && self.cleanup_connections {
+            if let Some(reset_query) = self.reset_query.clone() {
+                // DISCARD ALL and DEALLOCATE ALL flush the prepared statements cache in recv.
+                if !reset_query.is_empty() {
+                    info!("Server {} returned with session state altered ({}), running server_reset_query for application {}",
+                        self, self.cleanup_state, self.application_name);
+                    self.small_simple_query(&reset_query).await?;
+                }
+                // The query is expected to reset the parameters too.
+                self.session_timeouts = [0; 2];
+                self.session_parameters.clear();
+                self.cleanup_state.reset();
+                return Ok(());
+            }
             info!("Server {} returned with session state altered, discarding state ({}) for application {}",
                 self, self.cleanup_state, self.application_name);
             let mut reset_string = String::from("RESET ROLE;");
 
             if self.cleanup_state.needs_cleanup_set {
                 reset_string.push_str("RESET ALL;");
+                self.read_only = false;
+                self.session_timeouts = [0; 2];
+                self.session_parameters.clear();
             };
 
             if self.cleanup_state.needs_cleanup_prepare {
@@ -922,6 +1372,81 @@ impl Server {
         Ok(())
     }
 
+    /// A client ran LISTEN on the session.
+    #[inline(always)]
+    pub fn is_listening(&self) -> bool {
+        self.listening
+    }
+
+    /// Wait until the server sends something between queries, e.g. a notification.
+    /// Cancel safe: the data stays buffered for `recv_notification`.
+    pub async fn wait_readable(&mut self) -> Result<(), Error> {
+        match self.stream.fill_buf().await.map(|buf| buf.len()) {
+            Ok(len) if len > 0 => Ok(()),
+            Ok(_) => {
+                self.mark_bad("server closed the connection between queries");
+                Err(Error::SocketError(format!(
+                    "server {self} closed the connection between queries"
+                )))
+            }
+            Err(err) => {
+                self.mark_bad("failed to read between queries");
+                Err(Error::SocketError(format!(
+                    "error reading from server {self}: {err}"
+                )))
+            }
+        }
+    }
+
+    /// Read a message the server sent between queries to forward it to the client:
+    /// NotificationResponse, NoticeResponse or ParameterStatus. Anything else means
+    /// the session is over, e.g. a FATAL error of a terminated backend.
+    pub async fn recv_notification(&mut self) -> Result<BytesMut, Error> {
+        let (code, message_len) = read_message_header(&mut self.stream).await?;
+        if message_len > MAX_MESSAGE_SIZE {
+            self.mark_bad("message between queries is too big");
+            return Err(MaxMessageSize);
+        }
+        let message = read_message_data(&mut self.stream, code, message_len).await?;
+        self.stats.data_received(message.len());
+        self.last_activity = SystemTime::now();
+        match code {
+            b'A' | b'N' | b'S' => Ok(message),
+            _ => {
+                self.mark_bad(&format!(
+                    "unexpected message '{}' between queries",
+                    code as char
+                ));
+                Err(Error::ProtocolSyncError(format!(
+                    "server {self} sent message '{}' between queries",
+                    code as char
+                )))
+            }
+        }
+    }
+
+    /// Relay the bytes between the client and the server as they are, until either side
+    /// closes the connection. Used by replication connections, COPY BOTH included.
+    pub async fn relay<R, W>(
+        &mut self,
+        client_read: &mut R,
+        client_write: &mut W,
+    ) -> Result<(), Error>
+    where
+        R: tokio::io::AsyncRead + std::marker::Unpin,
+        W: tokio::io::AsyncWrite + std::marker::Unpin,
+    {
+        let result = {
+            let (mut server_read, mut server_write) = tokio::io::split(&mut self.stream);
+            tokio::select! {
+                result = relay_bytes(client_read, &mut server_write) => result,
+                result = relay_bytes(&mut server_read, client_write) => result,
+            }
+        };
+        self.last_activity = SystemTime::now();
+        result.map_err(|err| Error::SocketError(format!("replication relay of {self}: {err}")))
+    }
+
     /// We don't buffer all of server responses, e.g. COPY OUT produces too much data.
     /// The client is responsible to call `self.recv()` while this method returns true.
     #[inline(always)]
@@ -929,11 +1454,14 @@ impl Server {
         self.data_available
     }
 
-    /// Switch to async mode, flushing messages as soon
-    /// as we receive them without buffering or waiting for "ReadyForQuery".
+    /// Switch to async mode after the client sent messages with Flush instead of Sync
+    /// (pipeline mode of pgx v5, Npgsql): the next reads return the responses as they
+    /// come and end with the `pending` responses the messages owe, without waiting
+    /// for ReadyForQuery. The ReadyForQuery of the Sync ends async mode.
     #[inline(always)]
-    pub fn set_flush_wait_code(&mut self, wait: char) {
-        self.flush_wait_code = wait
+    pub fn set_flush_pending(&mut self, pending: usize) {
+        self.async_mode = true;
+        self.flush_pending = pending;
     }
 
     fn add_prepared_statement_to_cache(&mut self, name: &str) -> Option<String> {
@@ -944,6 +1472,20 @@ impl Server {
 
         self.stats.prepared_cache_add();
 
+        // Closing a prepared statement closes its portals, the statements of the open
+        // portals are kept and the next least recently used one goes instead.
+        if cache.len() == cache.cap().get() && cache.peek(name).is_none() {
+            for _ in 0..cache.len() {
+                match cache.peek_lru() {
+                    Some((lru, _)) if self.portals.values().any(|statement| statement == lru) => {
+                        let lru = lru.clone();
+                        cache.promote(&lru);
+                    }
+                    _ => break,
+                }
+            }
+        }
+
         // If we evict something, we need to close it on the server
         if let Some((evicted_name, _)) = cache.push(name.to_string(), ()) {
             if evicted_name != name {
@@ -974,10 +1516,12 @@ impl Server {
                 .push_back(parse.name.clone());
 
             let mut bytes = BytesMut::new();
+            let mut pending = 0;
 
             if should_send_parse_to_server {
                 let parse_bytes: BytesMut = parse.try_into()?;
                 bytes.extend_from_slice(&parse_bytes);
+                pending += 1;
             }
 
             // If we evict something, we need to close it on the server
@@ -986,22 +1530,46 @@ impl Server {
                 self.remove_prepared_statement_from_cache(&evicted_name);
                 let close_bytes: BytesMut = Close::new(&evicted_name).try_into()?;
                 bytes.extend_from_slice(&close_bytes);
+                pending += 1;
             };
 
             // If we have a parse or close we need to send to the server, send them and sync
             if !bytes.is_empty() {
-                bytes.extend_from_slice(&sync());
+                // In a pipeline sent with Flush a Sync would end its implicit transaction,
+                // and the portals bound in it, they are flushed instead.
+                let flushed = self.is_async();
+                if flushed {
+                    bytes.extend_from_slice(&flush());
+                    self.set_flush_pending(pending);
+                } else {
+                    bytes.extend_from_slice(&sync());
+                }
 
                 self.send_and_flush(&bytes).await?;
 
                 let mut noop = tokio::io::sink();
+                let mut failed = false;
                 loop {
-                    self.recv(&mut noop, None).await?;
+                    let response = self.recv(&mut noop, None).await?;
+                    failed |= has_error_response(&response);
 
                     if !self.is_data_available() {
                         break;
                     }
                 }
+
+                // The server skips the messages up to Sync after the error, the pipeline
+                // is over like with the Sync above.
+                if flushed && failed {
+                    self.send_and_flush(&sync()).await?;
+                    loop {
+                        self.recv(&mut noop, None).await?;
+
+                        if !self.is_data_available() {
+                            break;
+                        }
+                    }
+                }
             }
         };
 
@@ -1028,6 +1596,17 @@ impl Server {
         );
     }
 
+    /// The client bound the portal to the prepared statement, its statement isn't
+    /// evicted from the cache while the portal is open.
+    pub fn bind_portal(&mut self, portal: String, statement: String) {
+        self.portals.insert(portal, statement);
+    }
+
+    /// The client closed the portal.
+    pub fn close_portal(&mut self, portal: &str) {
+        self.portals.remove(portal);
+    }
+
     // Determines if the server already has a prepared statement with the given name
     // Increments the prepared statement cache hit counter
     pub fn has_prepared_statement(&mut self, name: &str) -> bool {
@@ -1057,6 +1636,8 @@ impl Server {
 
         for (key, value) in parameter_diff {
             query.push_str(&format!("SET {key} TO '{value}';"));
+            // Not what the client's session parameters say anymore, they are set again.
+            self.session_parameters.remove(&key.to_ascii_lowercase());
         }
 
         let res = self.small_simple_query(&query).await;
@@ -1066,6 +1647,143 @@ impl Server {
         res
     }
 
+    /// Make the transactions read-only for a client of a read_only listener,
+    /// or back to the default for the other clients.
+    pub async fn set_read_only(&mut self, read_only: bool) -> Result<(), Error> {
+        if self.read_only == read_only {
+            return Ok(());
+        }
+        let query = if read_only {
+            "SET default_transaction_read_only = on"
+        } else {
+            "RESET default_transaction_read_only"
+        };
+        // Kept until another client needs the other value, it's not a reason for RESET ALL.
+        let needs_cleanup_set = self.cleanup_state.needs_cleanup_set;
+        self.small_simple_query(query).await?;
+        self.cleanup_state.needs_cleanup_set = needs_cleanup_set;
+        self.read_only = read_only;
+        Ok(())
+    }
+
+    /// Set statement_timeout and idle_in_transaction_session_timeout (ms, 0 for the
+    /// server default) of the pool, except the ones the client set itself.
+    pub async fn set_session_timeouts(
+        &mut self,
+        statement_timeout: u64,
+        idle_in_transaction_session_timeout: u64,
+    ) -> Result<(), Error> {
+        let timeouts = [statement_timeout, idle_in_transaction_session_timeout];
+        let mut query = String::new();
+        for (index, name) in SESSION_TIMEOUTS.iter().enumerate() {
+            if self.session_timeouts[index] == timeouts[index]
+                || self.session_parameters.contains_key(*name)
+            {
+                continue;
+            }
+            match timeouts[index] {
+                0 => query.push_str(&format!("RESET {name};")),
+                timeout => query.push_str(&format!("SET {name} = {timeout};")),
+            }
+        }
+        if query.is_empty() {
+            return Ok(());
+        }
+        // Like read_only, kept until another pool needs other values.
+        let needs_cleanup_set = self.cleanup_state.needs_cleanup_set;
+        let session_parameters_changed = self.session_parameters_changed;
+        self.small_simple_query(&query).await?;
+        self.cleanup_state.needs_cleanup_set = needs_cleanup_set;
+        self.session_parameters_changed = session_parameters_changed;
+        for (index, name) in SESSION_TIMEOUTS.iter().enumerate() {
+            if !self.session_parameters.contains_key(*name) {
+                self.session_timeouts[index] = timeouts[index];
+            }
+        }
+        Ok(())
+    }
+
+    /// Bring the session parameters to the ones recorded for the client
+    /// (track_session_parameters): reset the parameters left by the previous
+    /// client and set the ones this client set on its previous servers.
+    pub async fn replay_session_parameters(
+        &mut self,
+        parameters: &BTreeMap<String, String>,
+    ) -> Result<(), Error> {
+        let query = session_parameters_query(&self.session_parameters, parameters);
+        if query.is_empty() {
+            return Ok(());
+        }
+        // Recorded parameters are not a reason for RESET ALL or another read.
+        let needs_cleanup_set = self.cleanup_state.needs_cleanup_set;
+        let session_parameters_changed = self.session_parameters_changed;
+        self.small_simple_query(&query).await?;
+        self.cleanup_state.needs_cleanup_set = needs_cleanup_set;
+        self.session_parameters_changed = session_parameters_changed;
+        for (index, name) in SESSION_TIMEOUTS.iter().enumerate() {
+            if self.session_parameters.get(*name) != parameters.get(*name) {
+                // Set to the value of the client or reset to the server default.
+                self.session_timeouts[index] = match parameters.contains_key(*name) {
+                    true => CLIENT_TIMEOUT,
+                    false => 0,
+                };
+            }
+        }
+        self.session_parameters = parameters.clone();
+        Ok(())
+    }
+
+    /// Session parameters the client left on the connection, read from the server
+    /// after a SET or RESET. From then on they are replayed on the next servers
+    /// of the client instead of being reset at checkin.
+    pub async fn session_parameters(&mut self) -> Result<BTreeMap<String, String>, Error> {
+        if !self.session_parameters_changed {
+            return Ok(self.session_parameters.clone());
+        }
+        let rows = self
+            .simple_query_rows(
+                "SELECT name, setting FROM pg_catalog.pg_settings WHERE source = 'session'",
+            )
+            .await?;
+        let mut read_only_changed = false;
+        self.session_parameters.clear();
+        for row in rows {
+            let (name, setting) = match (row.first(), row.get(1)) {
+                (Some(Some(name)), Some(Some(setting))) => (name, setting),
+                _ => continue,
+            };
+            match name.as_str() {
+                // Set for the clients of read_only listeners, RESET ALL puts it back.
+                "default_transaction_read_only" => {
+                    read_only_changed = (setting == "on") != self.read_only
+                }
+                // Reset at checkin whatever the client did.
+                "role" | "session_authorization" => (),
+                _ => {
+                    self.session_parameters
+                        .insert(name.clone(), setting.clone());
+                }
+            }
+        }
+        for (index, name) in SESSION_TIMEOUTS.iter().enumerate() {
+            match self.session_parameters.get(*name) {
+                // Set from the pool settings, not by the client.
+                Some(setting)
+                    if self.session_timeouts[index] != 0
+                        && *setting == self.session_timeouts[index].to_string() =>
+                {
+                    self.session_parameters.remove(*name);
+                }
+                Some(_) => self.session_timeouts[index] = CLIENT_TIMEOUT,
+                // Reset by the client.
+                None => self.session_timeouts[index] = 0,
+            }
+        }
+        self.session_parameters_changed = false;
+        self.cleanup_state.needs_cleanup_set = read_only_changed;
+        Ok(self.session_parameters.clone())
+    }
+
     /// Issue a query cancellation request to the server.
     /// Uses a separate connection that's not part of the connection pool.
     pub async fn cancel(
@@ -1077,7 +1795,7 @@ impl Server {
         let mut stream = if host.starts_with('/') {
             create_unix_stream_inner(host, port).await?
         } else {
-            create_tcp_stream_inner(host, port, false, false).await?
+            create_tcp_stream_inner(host, port, &TcpConnectOptions::default()).await?
         };
 
         warn!("Sending CancelRequest to [{process_id}] {host}:{port}");
@@ -1091,6 +1809,23 @@ impl Server {
         write_all_flush(&mut stream, &bytes).await
     }
 
+    /// Where to send a CancelRequest for the query running on the server,
+    /// as kept in the client/server map.
+    pub fn cancel_target(&self) -> (i32, i32, String, u16) {
+        (
+            self.process_id,
+            self.secret_key,
+            self.address.host.clone(),
+            self.address.port,
+        )
+    }
+
+    /// The client changed the role of the session, it's reset at checkin.
+    #[inline(always)]
+    pub fn mark_role_changed(&mut self) {
+        self.cleanup_state.needs_cleanup_role = true;
+    }
+
     // Marks a connection as needing cleanup at checkin
     pub fn mark_dirty(&mut self) {
         self.cleanup_state.set_true();
@@ -1109,8 +1844,72 @@ impl Server {
         log_client_parameter_status_changes: bool,
         prepared_statement_cache_size: usize,
         application_name: String,
+    ) -> Result<Server, Error> {
+        Server::connect(
+            address,
+            user,
+            database,
+            client_server_map,
+            stats,
+            cleanup_connections,
+            log_client_parameter_status_changes,
+            prepared_statement_cache_size,
+            application_name,
+            false,
+        )
+        .await
+    }
+
+    /// Connect to the server in logical replication mode (replication=database),
+    /// for a client the bytes are relayed to as they are.
+    pub async fn startup_replication(
+        address: &Address,
+        user: &User,
+        database: &str,
+        client_server_map: ClientServerMap,
+        stats: Arc<ServerStats>,
+        application_name: String,
+    ) -> Result<Server, Error> {
+        Server::connect(
+            address,
+            user,
+            database,
+            client_server_map,
+            stats,
+            false,
+            false,
+            0,
+            application_name,
+            true,
+        )
+        .await
+    }
+
+    #[allow(clippy::too_many_arguments)]
+    async fn connect(
+        address: &Address,
+        user: &User,
+        database: &str,
+        client_server_map: ClientServerMap,
+        stats: Arc<ServerStats>,
+        cleanup_connections: bool,
+        log_client_parameter_status_changes: bool,
+        prepared_statement_cache_size: usize,
+        application_name: String,
+        replication: bool,
     ) -> Result<Server, Error> {
         let config = get_config();
+        let pool_config = config.pool_config(&address.pool_name);
+        let reset_timeout = match pool_config
+            .and_then(|pool| pool.server_reset_timeout)
+            .unwrap_or(config.general.server_reset_timeout)
+        {
+            0 => None,
+            reset_timeout => Some(Duration::from_millis(reset_timeout)),
+        };
+        let reset_query = pool_config.and_then(|pool| pool.server_reset_query.clone());
+        let reset_in_background = pool_config.is_some_and(|pool| pool.server_reset_in_background);
+        let parameter_status_overrides = pool_config.and_then(ParameterStatusOverrides::from_pool);
 
         let mut stream = if address.host.starts_with('/') {
             create_unix_stream_inner(&address.host, address.port).await?
@@ -1118,8 +1917,7 @@ impl Server {
             create_tcp_stream_inner(
                 &address.host,
                 address.port,
-                config.general.server_tls,
-                config.general.verify_server_certificate,
+                &TcpConnectOptions::from_config(&config, &address.pool_name),
             )
             .await?
         };
@@ -1134,6 +1932,7 @@ impl Server {
             username.clone(),
             database,
             application_name.clone(),
+            replication,
         )
         .await?;
 
@@ -1338,7 +2137,7 @@ impl Server {
                                 password_response.put_i32(token.len() as i32 + 4 + 1);
                                 password_response.put_slice(token.as_bytes());
                                 password_response.put_u8(b'\0');
-                                match stream.try_write(&password_response) {
+                                match write_all_flush(&mut stream, &password_response).await {
                                     Ok(_) => (),
                                     Err(err) => {
                                         return Err(Error::ServerAuthError(
@@ -1394,7 +2193,7 @@ impl Server {
                                 password_response.put_u8(b'p');
                                 password_response.put_i32(password_hash.len() as i32 + 4);
                                 password_response.put_slice(&password_hash);
-                                match stream.try_write(&password_response) {
+                                match write_all_flush(&mut stream, &password_response).await {
                                     Ok(_) => (),
                                     Err(err) => {
                                         return Err(Error::ServerAuthError(
@@ -1569,16 +2368,31 @@ impl Server {
                         secret_key,
                         in_transaction: false,
                         in_copy_mode: false,
+                        two_phase_completed: false,
+                        advisory_locks: false,
+                        listening: false,
                         data_available: false,
                         bad: false,
-                        flush_wait_code: ' ',
+                        async_mode: false,
+                        flush_pending: 0,
+                        flush_copy: false,
                         cleanup_state: CleanupState::new(),
                         client_server_map,
                         connected_at: chrono::offset::Utc::now().naive_utc(),
+                        lifetime_jitter_percent: rand::random::<u64>() % 21,
                         stats,
                         application_name: application_name.clone(),
                         last_activity: SystemTime::now(),
                         cleanup_connections,
+                        read_only: false,
+                        session_timeouts: [0; 2],
+                        reset_timeout,
+                        reset_query,
+                        reset_in_background,
+                        session_parameters: BTreeMap::new(),
+                        session_parameters_changed: false,
+                        command_tags: None,
+                        parameter_status_overrides,
                         log_client_parameter_status_changes,
                         prepared_statement_cache: match prepared_statement_cache_size {
                             0 => None,
@@ -1587,9 +2401,11 @@ impl Server {
                             )),
                         },
                         registering_prepared_statement: VecDeque::new(),
+                        portals: HashMap::new(),
                         max_message_size: config.general.message_size_to_be_stream as i32,
                     };
                     server.stats.update_process_id(process_id);
+                    server.stats.host().opened();
 
                     return Ok(server);
                 }
@@ -1615,11 +2431,13 @@ impl Drop for Server {
     fn drop(&mut self) {
         // Update statistics
         self.stats.disconnect();
+        self.stats.host().closed();
         {
             let mut guard = CANCELED_PIDS.lock();
             guard.retain(|&pid| pid != self.process_id);
         }
-        if !self.is_bad() {
+        // Over TLS the connection is closed without Terminate, it can't be sent from drop.
+        if !self.is_bad() && !self.stream.get_ref().is_tls() {
             let mut bytes = BytesMut::with_capacity(5);
             bytes.put_u8(b'X');
             bytes.put_i32(4);
@@ -1652,6 +2470,12 @@ impl Drop for Server {
 async fn create_unix_stream_inner(host: &str, port: u16) -> Result<StreamInner, Error> {
     let stream = match UnixStream::connect(&format!("{host}/.s.PGSQL.{port}")).await {
         Ok(s) => s,
+        Err(err) if is_fd_exhausted(&err) => {
+            record_fd_exhaustion("connect", &err);
+            return Err(Error::SocketError(format!(
+                "Could not connect to server: {err}"
+            )));
+        }
         Err(err) => {
             error!("Could not connect to server: {err}");
             return Err(Error::SocketError(format!(
@@ -1665,14 +2489,141 @@ async fn create_unix_stream_inner(host: &str, port: u16) -> Result<StreamInner,
     Ok(StreamInner::UnixSocket { stream })
 }
 
+/// Copy the bytes from `read` to `write` until `read` is closed, flushing each chunk.
+async fn relay_bytes<R, W>(read: &mut R, write: &mut W) -> Result<(), std::io::Error>
+where
+    R: tokio::io::AsyncRead + std::marker::Unpin,
+    W: tokio::io::AsyncWrite + std::marker::Unpin,
+{
+    let mut buf = vec![0u8; 8192];
+    loop {
+        let read_bytes = read.read(&mut buf).await?;
+        if read_bytes == 0 {
+            return Ok(());
+        }
+        write.write_all(&buf[..read_bytes]).await?;
+        write.flush().await?;
+    }
+}
+
+/// Per-pool overrides used when opening a TCP connection to the server.
+#[derive(Debug, Clone)]
+pub struct TcpConnectOptions {
+    /// Local address to bind the socket to before connecting.
+    pub bind_address: Option<IpAddr>,
+    /// Host name to use for TLS instead of the server host.
+    pub tls_server_name: Option<String>,
+    /// Keepalive idle time (seconds), probe count and interval (seconds).
+    pub keepalive: Option<(u64, u32, u64)>,
+    /// TLS mode, CA bundle, client certificate and key.
+    pub tls_mode: ServerTlsMode,
+    pub tls_ca_cert: Option<String>,
+    pub tls_certificate: Option<String>,
+    pub tls_private_key: Option<String>,
+}
+
+impl Default for TcpConnectOptions {
+    fn default() -> TcpConnectOptions {
+        TcpConnectOptions {
+            bind_address: None,
+            tls_server_name: None,
+            keepalive: None,
+            tls_mode: ServerTlsMode::Disable,
+            tls_ca_cert: None,
+            tls_certificate: None,
+            tls_private_key: None,
+        }
+    }
+}
+
+impl TcpConnectOptions {
+    pub fn from_config(config: &Config, pool_name: &str) -> TcpConnectOptions {
+        let pool = match config.pool_config(pool_name) {
+            Some(pool) => pool,
+            None => {
+                return TcpConnectOptions {
+                    tls_mode: config.general.server_tls_mode(),
+                    ..TcpConnectOptions::default()
+                }
+            }
+        };
+        let keepalive = if pool.server_tcp_keepalives_idle.is_some()
+            || pool.server_tcp_keepalives_count.is_some()
+            || pool.server_tcp_keepalives_interval.is_some()
+        {
+            Some((
+                pool.server_tcp_keepalives_idle
+                    .unwrap_or(config.general.tcp_keepalives_idle),
+                pool.server_tcp_keepalives_count
+                    .unwrap_or(config.general.tcp_keepalives_count),
+                pool.server_tcp_keepalives_interval
+                    .unwrap_or(config.general.tcp_keepalives_interval),
+            ))
+        } else {
+            None
+        };
+        TcpConnectOptions {
+            bind_address: pool.server_bind_address,
+            tls_server_name: pool.server_tls_server_name.clone(),
+            keepalive,
+            tls_mode: pool.server_tls_mode(&config.general),
+            tls_ca_cert: pool.server_tls_ca_cert.clone(),
+            tls_certificate: pool.server_tls_certificate.clone(),
+            tls_private_key: pool.server_tls_private_key.clone(),
+        }
+    }
+}
+
+/// Connect to the first of the resolved server addresses that accepts,
+/// from the given local address if any.
+async fn connect_tcp(
+    host: &str,
+    addrs: &[SocketAddr],
+    bind_address: Option<IpAddr>,
+) -> Result<TcpStream, std::io::Error> {
+    let mut last_err = std::io::Error::new(
+        std::io::ErrorKind::AddrNotAvailable,
+        match bind_address {
+            Some(bind_address) => {
+                format!("no address of {host} matches the family of bind address {bind_address}")
+            }
+            None => format!("no address of {host}"),
+        },
+    );
+    for addr in addrs {
+        if bind_address.is_some_and(|bind_address| addr.is_ipv4() != bind_address.is_ipv4()) {
+            continue;
+        }
+        let socket = if addr.is_ipv4() {
+            TcpSocket::new_v4()?
+        } else {
+            TcpSocket::new_v6()?
+        };
+        if let Some(bind_address) = bind_address {
+            socket.bind(SocketAddr::new(bind_address, 0))?;
+        }
+        match socket.connect(*addr).await {
+            Ok(stream) => return Ok(stream),
+            Err(err) => last_err = err,
+        }
+    }
+    Err(last_err)
+}
+
 async fn create_tcp_stream_inner(
     host: &str,
     port: u16,
-    tls: bool,
-    _verify_server_certificate: bool,
+    options: &TcpConnectOptions,
 ) -> Result<StreamInner, Error> {
-    let mut stream = match TcpStream::connect(&format!("{host}:{port}")).await {
+    let addrs = resolve_host(host, port).await?;
+    let mut stream = match connect_tcp(host, &addrs, options.bind_address).await {
         Ok(stream) => stream,
+        Err(err) if is_fd_exhausted(&err) => {
+            record_fd_exhaustion("connect", &err);
+            return Err(Error::SocketError(format!(
+                "Could not connect to server: {err}"
+            )));
+        }
         Err(err) => {
             error!("Could not connect to server: {err}");
             return Err(Error::SocketError(format!(
@@ -1683,8 +2634,11 @@ async fn create_tcp_stream_inner(
 
     // TCP timeouts.
     configure_tcp_socket(&stream);
+    if let Some((idle, count, interval)) = options.keepalive {
+        configure_tcp_keepalive(&stream, idle, count, interval);
+    }
 
-    let stream = if tls {
+    let stream = if options.tls_mode != ServerTlsMode::Disable {
         // Request a TLS connection
         ssl_request(&mut stream).await?;
 
@@ -1700,12 +2654,34 @@ async fn create_tcp_stream_inner(
         match response {
             // Server supports TLS
             'S' => {
-                error!("Connection to server via tls is not supported");
-                return Err(Error::SocketError("Server TLS is unsupported".to_string()));
+                let server_name = options.tls_server_name.as_deref().unwrap_or(host);
+                debug!("Server {host}:{port} accepted TLS request (server name: {server_name})");
+                let connector = build_server_connector(
+                    options.tls_mode,
+                    options.tls_ca_cert.as_deref(),
+                    options.tls_certificate.as_deref(),
+                    options.tls_private_key.as_deref(),
+                )?;
+                match connector.connect(server_name, stream).await {
+                    Ok(stream) => StreamInner::TCPTls { stream },
+                    Err(err) => {
+                        error!("TLS handshake with server {host}:{port} failed: {err}");
+                        return Err(Error::SocketError(format!(
+                            "TLS handshake with server {host}:{port} failed ({}): {err}",
+                            options.tls_mode
+                        )));
+                    }
+                }
             }
 
             // Server does not support TLS
-            'N' => StreamInner::TCPPlain { stream },
+            'N' if options.tls_mode == ServerTlsMode::Prefer => StreamInner::TCPPlain { stream },
+            'N' => {
+                return Err(Error::SocketError(format!(
+                    "Server {host}:{port} does not support TLS, required by server_tls_mode {}",
+                    options.tls_mode
+                )));
+            }
 
             // Something else?
             m => {
@@ -1717,3 +2693,49 @@ async fn create_tcp_stream_inner(
     };
     Ok(stream)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_session_parameters_query() {
+        let parameters = |pairs: &[(&str, &str)]| -> BTreeMap<String, String> {
+            pairs
+                .iter()
+                .map(|(name, value)| (name.to_string(), value.to_string()))
+                .collect()
+        };
+        let current = parameters(&[("statement_timeout", "1000"), ("myapp.tenant", "a")]);
+        assert_eq!(session_parameters_query(&current, &current), "");
+        assert_eq!(
+            session_parameters_query(&current, &BTreeMap::new()),
+            "RESET \"myapp\".\"tenant\";RESET \"statement_timeout\";"
+        );
+        assert_eq!(
+            session_parameters_query(
+                &current,
+                &parameters(&[
+                    ("search_path", "\"$user\", public"),
+                    ("statement_timeout", "1000"),
+                    ("myapp.tenant", "o'brien"),
+                ])
+            ),
+            "SELECT pg_catalog.set_config('myapp.tenant', 'o''brien', false), \
+             pg_catalog.set_config('search_path', '\"$user\", public', false);"
+        );
+    }
+
+    #[test]
+    fn test_has_error_response() {
+        let mut response = parse_complete();
+        response.put(&close_complete()[..]);
+        assert!(!has_error_response(&response));
+
+        response.put_u8(b'E');
+        let fields = b"SERROR\0C42601\0Msyntax error\0\0";
+        response.put_i32(4 + fields.len() as i32);
+        response.put_slice(fields);
+        assert!(has_error_response(&response));
+    }
+}
@@ -0,0 +1,120 @@
+// Slow query log.
+//
+// Queries (a simple Query or an extended protocol batch up to its Sync) running
+// longer than slow_query_threshold are logged with their normalized text, pool,
+// user, duration and the time their client waited for a server, so latency
+// regressions show up at the pooler without statement logging on the servers.
+// At most slow_query_log_rate of them are logged per second, the others are
+// counted and summed up in one line with the next slow query of a later second.
+
+// Standard library imports
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::warn;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+
+// Internal crate imports
+use crate::messages::fingerprint::normalize_statement;
+
+/// Slow queries seen, logged or not.
+pub static SLOW_QUERY_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+#[derive(Debug)]
+struct SlowQueryWindow {
+    /// Start of the current second.
+    started_at: Instant,
+    logged: u32,
+    suppressed: u32,
+}
+
+impl SlowQueryWindow {
+    /// Count a slow query, false if it is over the rate (0 disables it).
+    /// Returns the number of queries suppressed in the previous second when it's over.
+    fn allow(&mut self, now: Instant, rate: u32) -> (bool, u32) {
+        let mut suppressed = 0;
+        if now.saturating_duration_since(self.started_at) >= Duration::from_secs(1) {
+            suppressed = self.suppressed;
+            self.started_at = now;
+            self.logged = 0;
+            self.suppressed = 0;
+        }
+        if rate != 0 && self.logged >= rate {
+            self.suppressed += 1;
+            return (false, suppressed);
+        }
+        self.logged += 1;
+        (true, suppressed)
+    }
+}
+
+static SLOW_QUERY_WINDOW: Lazy<Mutex<SlowQueryWindow>> = Lazy::new(|| {
+    Mutex::new(SlowQueryWindow {
+        started_at: Instant::now(),
+        logged: 0,
+        suppressed: 0,
+    })
+});
+
+/// Log the statements that ran for `duration` if it's over `threshold` (0 disables
+/// the log), at most `rate` per second.
+pub fn log_slow_query(
+    pool: &str,
+    user: &str,
+    statements: &[String],
+    duration: Duration,
+    wait: Duration,
+    threshold: Duration,
+    rate: u32,
+) {
+    if threshold.is_zero() || duration < threshold {
+        return;
+    }
+    SLOW_QUERY_COUNTER.fetch_add(1, Ordering::Relaxed);
+    let (allowed, suppressed) = SLOW_QUERY_WINDOW.lock().allow(Instant::now(), rate);
+    if suppressed > 0 {
+        warn!("{suppressed} slow queries were not logged, over slow_query_log_rate");
+    }
+    if !allowed {
+        return;
+    }
+    let normalized: Vec<String> = statements
+        .iter()
+        .map(|statement| normalize_statement(statement))
+        .collect();
+    warn!(
+        "Slow query {{ database: {pool:?}, user: {user:?} }} ran for {}ms, waited {}ms for a server: {}",
+        duration.as_millis(),
+        wait.as_millis(),
+        normalized.join("; ")
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_slow_query_window() {
+        let now = Instant::now();
+        let mut window = SlowQueryWindow {
+            started_at: now,
+            logged: 0,
+            suppressed: 0,
+        };
+        assert_eq!(window.allow(now, 2), (true, 0));
+        assert_eq!(window.allow(now, 2), (true, 0));
+        assert_eq!(window.allow(now, 2), (false, 0));
+        assert_eq!(window.allow(now, 2), (false, 0));
+        // The next second reports the suppressed ones.
+        let next = now + Duration::from_secs(1);
+        assert_eq!(window.allow(next, 2), (true, 2));
+        assert_eq!(window.allow(next, 2), (true, 0));
+        // No limit.
+        for _ in 0..10 {
+            assert_eq!(window.allow(next, 0), (true, 0));
+        }
+    }
+}
@@ -0,0 +1,139 @@
+// Pacing of reconnect storms.
+//
+// When an application restarts or loses its network, all its connections come
+// back at once with the very same startup packet. Authenticating thousands of
+// them in parallel burns the pooler's CPU (SCRAM) and hammers the auth path of
+// the backend (auth_query, LDAP, PAM). Identical startup packets from the same
+// address are let through startup_burst_limit at a time; the others queue and
+// continue one by one with a random delay of up to startup_pacing_jitter, so
+// they are spread out instead of arriving as another burst.
+
+// Standard library imports
+use std::collections::hash_map::DefaultHasher;
+use std::collections::HashMap;
+use std::hash::{Hash, Hasher};
+use std::net::IpAddr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+// External crate imports
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+/// Source address and hash of the startup packet.
+type StartupKey = (IpAddr, u64);
+
+/// Startups of each source and packet being authenticated, limited by the semaphore.
+static STARTUPS: Lazy<Mutex<HashMap<StartupKey, Arc<Semaphore>>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Startups that had to queue behind identical ones.
+pub static PACED_STARTUPS_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// A turn to authenticate, the next identical startup goes on drop.
+#[derive(Debug)]
+pub struct StartupSlot {
+    key: StartupKey,
+    semaphore: Arc<Semaphore>,
+    permit: Option<OwnedSemaphorePermit>,
+}
+
+impl Drop for StartupSlot {
+    fn drop(&mut self) {
+        let mut startups = STARTUPS.lock();
+        self.permit.take();
+        // Nobody else holds or waits for the semaphore: the map and this slot.
+        if Arc::strong_count(&self.semaphore) == 2 {
+            startups.remove(&self.key);
+        }
+    }
+}
+
+fn startup_key(addr: IpAddr, startup: &[u8]) -> StartupKey {
+    let mut hasher = DefaultHasher::new();
+    startup.hash(&mut hasher);
+    (addr, hasher.finish())
+}
+
+/// Wait for a turn to authenticate the startup packet from the address, while `limit`
+/// identical ones are being authenticated. A limit of 0 disables the pacing.
+pub async fn acquire_startup_slot(
+    addr: IpAddr,
+    startup: &[u8],
+    limit: usize,
+    jitter: Duration,
+) -> Option<StartupSlot> {
+    if limit == 0 {
+        return None;
+    }
+    let key = startup_key(addr, startup);
+    let semaphore = STARTUPS
+        .lock()
+        .entry(key)
+        .or_insert_with(|| Arc::new(Semaphore::new(limit)))
+        .clone();
+    // Created before waiting, so the entry is cleaned up if the client goes away.
+    let mut slot = StartupSlot {
+        key,
+        semaphore: semaphore.clone(),
+        permit: None,
+    };
+    match semaphore.clone().try_acquire_owned() {
+        Ok(permit) => slot.permit = Some(permit),
+        Err(_) => {
+            PACED_STARTUPS_COUNTER.fetch_add(1, Ordering::Relaxed);
+            // The semaphore is never closed.
+            slot.permit = semaphore.acquire_owned().await.ok();
+            if !jitter.is_zero() {
+                let delay = rand::random::<u64>() % (jitter.as_millis() as u64 + 1);
+                tokio::time::sleep(Duration::from_millis(delay)).await;
+            }
+        }
+    }
+    Some(slot)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_identical_startups_are_paced() {
+        let addr: IpAddr = "192.0.2.10".parse().unwrap();
+        let startup = b"user\0app\0database\0pacing_test\0\0";
+        let key = startup_key(addr, startup);
+
+        let first = acquire_startup_slot(addr, startup, 1, Duration::ZERO)
+            .await
+            .unwrap();
+        // Another packet or another address is not held back.
+        let other = acquire_startup_slot(addr, b"user\0other\0\0", 1, Duration::ZERO)
+            .await
+            .unwrap();
+        let elsewhere =
+            acquire_startup_slot("192.0.2.11".parse().unwrap(), startup, 1, Duration::ZERO)
+                .await
+                .unwrap();
+
+        let paced = PACED_STARTUPS_COUNTER.load(Ordering::Relaxed);
+        let second = tokio::spawn(async move {
+            acquire_startup_slot(addr, startup, 1, Duration::from_millis(5))
+                .await
+                .is_some()
+        });
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        assert!(!second.is_finished());
+        assert!(PACED_STARTUPS_COUNTER.load(Ordering::Relaxed) > paced);
+
+        drop(first);
+        assert!(second.await.unwrap());
+        assert!(!STARTUPS.lock().contains_key(&key));
+
+        drop((other, elsewhere));
+        assert!(acquire_startup_slot(addr, startup, 0, Duration::ZERO)
+            .await
+            .is_none());
+    }
+}
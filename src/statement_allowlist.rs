@@ -0,0 +1,239 @@
+// Statement allowlists of locked-down users.
+//
+// A user with `statement_allowlist` may only run statements whose fingerprint
+// (see messages::fingerprint) is listed in the file. In record mode every
+// statement runs and the fingerprints not listed yet are appended to the file,
+// so the allowlist is learned by running the application through the pooler
+// before switching the user to enforce mode. The fingerprints are recorded in
+// memory at once and appended to the file by a background task, so clients
+// never wait for the file. Each line of the file holds a
+// fingerprint followed by the normalized statement for the reader; `#` starts
+// a comment.
+
+// Standard library imports
+use std::collections::{HashMap, HashSet};
+
+// External crate imports
+use log::{error, info};
+use once_cell::sync::{Lazy, OnceCell};
+use parking_lot::RwLock;
+use tokio::fs::OpenOptions;
+use tokio::io::AsyncWriteExt;
+use tokio::sync::mpsc;
+
+// Internal crate imports
+use crate::config::StatementAllowlistMode;
+use crate::errors::Error;
+use crate::messages::fingerprint::{normalize_statement, statement_fingerprint, statement_text};
+
+/// Fingerprints by allowlist file.
+type Allowlists = HashMap<String, HashSet<String>>;
+
+static ALLOWLISTS: Lazy<RwLock<Allowlists>> = Lazy::new(|| RwLock::new(HashMap::new()));
+
+/// Recorded statements waiting to be appended to their allowlist files.
+const RECORD_QUEUE_SIZE: usize = 10_000;
+
+/// Allowlist file and line of the recorded statements, see run_statement_allowlist_writer.
+static RECORD_SENDER: OnceCell<mpsc::Sender<(String, String)>> = OnceCell::new();
+
+fn parse_allowlist(contents: &str) -> HashSet<String> {
+    contents
+        .lines()
+        .filter_map(|line| line.split('#').next()?.split_whitespace().next())
+        .map(|fingerprint| fingerprint.to_string())
+        .collect()
+}
+
+/// Allowlist files loaded with load_statement_allowlists, checked once set with
+/// set_statement_allowlists.
+pub struct StatementAllowlists(Allowlists);
+
+/// Load the allowlist files, a missing file is an empty allowlist in record mode.
+pub fn load_statement_allowlists(
+    allowlists: &[(String, StatementAllowlistMode)],
+) -> Result<StatementAllowlists, Error> {
+    Ok(StatementAllowlists(read_allowlists(allowlists)?))
+}
+
+/// Check the statements against the loaded allowlists, replacing the current ones.
+pub fn set_statement_allowlists(allowlists: StatementAllowlists) {
+    *ALLOWLISTS.write() = allowlists.0;
+}
+
+fn read_allowlists(allowlists: &[(String, StatementAllowlistMode)]) -> Result<Allowlists, Error> {
+    let mut loaded = Allowlists::new();
+    for (path, mode) in allowlists {
+        let fingerprints = match std::fs::read_to_string(path) {
+            Ok(contents) => parse_allowlist(&contents),
+            Err(err)
+                if err.kind() == std::io::ErrorKind::NotFound
+                    && *mode == StatementAllowlistMode::Record =>
+            {
+                HashSet::new()
+            }
+            Err(err) => {
+                return Err(Error::BadConfig(format!(
+                    "Failed to read statement_allowlist {path}: {err}"
+                )))
+            }
+        };
+        loaded.insert(path.clone(), fingerprints);
+    }
+    Ok(loaded)
+}
+
+/// Check the statement of a Query, Parse or FunctionCall message against the allowlist file.
+/// Returns the fingerprint of a statement rejected in enforce mode.
+pub fn check_statement(
+    path: &str,
+    mode: StatementAllowlistMode,
+    message: &[u8],
+) -> Result<(), String> {
+    if let Some(line) = check_statement_in(&ALLOWLISTS, path, mode, message)? {
+        let queued = RECORD_SENDER
+            .get()
+            .is_some_and(|sender| sender.try_send((path.to_string(), line)).is_ok());
+        if !queued {
+            error!("Failed to write statement_allowlist {path}: the write queue is full");
+        }
+    }
+    Ok(())
+}
+
+/// Check the statement, in record mode returns the line of the file of a
+/// statement it recorded.
+fn check_statement_in(
+    allowlists: &RwLock<Allowlists>,
+    path: &str,
+    mode: StatementAllowlistMode,
+    message: &[u8],
+) -> Result<Option<String>, String> {
+    let normalized = match message.first() {
+        // Fastpath FunctionCall, identified by the function OID.
+        Some(b'F') if message.len() >= 9 => format!(
+            "fastpath function {}",
+            i32::from_be_bytes([message[5], message[6], message[7], message[8]])
+        ),
+        _ => match statement_text(message) {
+            Some(query) => normalize_statement(query),
+            None => return Ok(None),
+        },
+    };
+    let fingerprint = statement_fingerprint(&normalized);
+    let known = allowlists
+        .read()
+        .get(path)
+        .is_some_and(|fingerprints| fingerprints.contains(&fingerprint));
+    if known {
+        return Ok(None);
+    }
+    match mode {
+        StatementAllowlistMode::Enforce => Err(fingerprint),
+        StatementAllowlistMode::Record => {
+            // Check again under the write lock, another client may have recorded it.
+            let mut allowlists = allowlists.write();
+            if !allowlists
+                .entry(path.to_string())
+                .or_default()
+                .insert(fingerprint.clone())
+            {
+                return Ok(None);
+            }
+            info!("Recorded statement {fingerprint} in {path}: {normalized}");
+            Ok(Some(format!("{fingerprint} {normalized}\n")))
+        }
+    }
+}
+
+/// Append the recorded statements to their allowlist files, runs for the lifetime of the process.
+pub async fn run_statement_allowlist_writer() {
+    let (sender, mut receiver) = mpsc::channel::<(String, String)>(RECORD_QUEUE_SIZE);
+    if RECORD_SENDER.set(sender).is_err() {
+        return;
+    }
+    while let Some((path, line)) = receiver.recv().await {
+        let written = match OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)
+            .await
+        {
+            Ok(mut file) => file.write_all(line.as_bytes()).await,
+            Err(err) => Err(err),
+        };
+        if let Err(err) = written {
+            error!("Failed to write statement_allowlist {path}: {err}");
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use bytes::{BufMut, BytesMut};
+
+    fn query(text: &str) -> BytesMut {
+        let mut message = BytesMut::new();
+        message.put_u8(b'Q');
+        message.put_i32(4 + text.len() as i32 + 1);
+        message.put_slice(text.as_bytes());
+        message.put_u8(0);
+        message
+    }
+
+    #[test]
+    fn test_parse_allowlist() {
+        let fingerprints = parse_allowlist(
+            "# orders API\n3f1c0e2a9b7d6c55 select * from orders where id = ?\n\n  # end\n",
+        );
+        assert_eq!(
+            fingerprints,
+            HashSet::from(["3f1c0e2a9b7d6c55".to_string()])
+        );
+    }
+
+    #[test]
+    fn test_record_and_enforce() {
+        let path =
+            std::env::temp_dir().join(format!("pg_doorman_allowlist_{}.txt", std::process::id()));
+        let path = path.to_str().unwrap().to_string();
+        let _ = std::fs::remove_file(&path);
+
+        let allowlists = RwLock::new(
+            read_allowlists(&[(path.clone(), StatementAllowlistMode::Record)]).unwrap(),
+        );
+        let select = query("SELECT * FROM orders WHERE id = 42");
+        let recorded =
+            check_statement_in(&allowlists, &path, StatementAllowlistMode::Record, &select)
+                .unwrap()
+                .unwrap();
+        assert!(recorded.ends_with(" select * from orders where id = ?\n"));
+        assert_eq!(
+            check_statement_in(&allowlists, &path, StatementAllowlistMode::Record, &select),
+            Ok(None)
+        );
+        std::fs::write(&path, &recorded).unwrap();
+
+        let allowlists = RwLock::new(
+            read_allowlists(&[(path.clone(), StatementAllowlistMode::Enforce)]).unwrap(),
+        );
+        assert!(check_statement_in(
+            &allowlists,
+            &path,
+            StatementAllowlistMode::Enforce,
+            &query("select *\n  from orders where id = 7;")
+        )
+        .is_ok());
+        assert!(check_statement_in(
+            &allowlists,
+            &path,
+            StatementAllowlistMode::Enforce,
+            &query("DELETE FROM orders")
+        )
+        .is_err());
+        std::fs::remove_file(&path).unwrap();
+
+        assert!(read_allowlists(&[(path, StatementAllowlistMode::Enforce)]).is_err());
+    }
+}
@@ -27,10 +27,16 @@ pub mod address;
 pub mod client;
 /// Connection counters (internal)
 mod connections;
+/// Rolling per-minute history of pool statistics
+pub mod history;
+/// Health and latency of the backend hosts
+pub mod hosts;
 /// Percentile calculation utilities (internal)
 mod percenitle;
 /// Statistics for connection pools
 pub mod pool;
+/// Prepared transactions created through the pooler
+pub mod prepared_transactions;
 /// Utilities for printing statistics (internal)
 pub mod print_all_stats;
 /// Statistics for server connections
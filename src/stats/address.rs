@@ -61,6 +61,15 @@ pub struct AddressStats {
 
     /// Recent query times in microseconds (most recent first)
     pub query_times_us: Arc<Mutex<VecDeque<u64>>>,
+
+    /// Server connections closed because the reset queries didn't complete in server_reset_timeout
+    pub reset_timeouts: Arc<AtomicU64>,
+
+    /// Clients of the pool refused by authentication
+    pub auth_failures: Arc<AtomicU64>,
+
+    /// Clients that got no server connection within query_wait_timeout
+    pub query_wait_timeouts: Arc<AtomicU64>,
 }
 
 /// Expected capacity for query and transaction time history queues
@@ -294,6 +303,24 @@ impl AddressStats {
         self.current.errors.fetch_add(1, Ordering::Relaxed);
     }
 
+    /// Counts a server connection closed because its reset queries timed out.
+    #[inline(always)]
+    pub fn reset_timeout(&self) {
+        self.reset_timeouts.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Counts a client of the pool refused by authentication.
+    #[inline(always)]
+    pub fn auth_failure(&self) {
+        self.auth_failures.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Counts a client that got no server connection within query_wait_timeout.
+    #[inline(always)]
+    pub fn query_wait_timeout(&self) {
+        self.query_wait_timeouts.fetch_add(1, Ordering::Relaxed);
+    }
+
     /// Updates the average statistics based on the current period's values.
     ///
     /// This method calculates per-second averages for all metrics and average times per transaction/query.
@@ -419,6 +446,24 @@ impl AddressStats {
         self.current.errors.store(0, Ordering::Relaxed);
     }
 
+    /// Resets the totals, the averages and the current period counters to zero,
+    /// along with the recent transaction and query times (RESET STATS).
+    pub fn reset(&self) {
+        for fields in [&self.total, &self.averages] {
+            fields.xact_count.store(0, Ordering::Relaxed);
+            fields.query_count.store(0, Ordering::Relaxed);
+            fields.bytes_received.store(0, Ordering::Relaxed);
+            fields.bytes_sent.store(0, Ordering::Relaxed);
+            fields.xact_time_microseconds.store(0, Ordering::Relaxed);
+            fields.query_time_microseconds.store(0, Ordering::Relaxed);
+            fields.wait_time.store(0, Ordering::Relaxed);
+            fields.errors.store(0, Ordering::Relaxed);
+        }
+        self.reset_current_counts();
+        self.xact_times_us.lock().clear();
+        self.query_times_us.lock().clear();
+    }
+
     /// Populates a row vector with string representations of all statistics.
     ///
     /// This method is used for generating reports or displaying statistics in a tabular format.
@@ -691,6 +736,35 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_reset() {
+        let stats = AddressStats::default();
+        stats.xact_count_add();
+        stats.xact_time_add(1000);
+        stats.query_count_add();
+        stats.query_time_add_microseconds(300);
+        stats.bytes_received_add(100);
+        stats.bytes_sent_add(200);
+        stats.wait_time_add(50);
+        stats.error();
+        stats.update_averages();
+        stats.query_count_add();
+
+        stats.reset();
+        for fields in [&stats.total, &stats.current, &stats.averages] {
+            assert_eq!(fields.xact_count.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.query_count.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.bytes_received.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.bytes_sent.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.xact_time_microseconds.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.query_time_microseconds.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.wait_time.load(Ordering::Relaxed), 0);
+            assert_eq!(fields.errors.load(Ordering::Relaxed), 0);
+        }
+        assert!(stats.xact_times_us.lock().is_empty());
+        assert!(stats.query_times_us.lock().is_empty());
+    }
+
     #[test]
     fn test_into_iterator() {
         let stats = AddressStats::default();
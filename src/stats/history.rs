@@ -0,0 +1,273 @@
+/// Rolling history of pool statistics.
+///
+/// Once a minute a snapshot of every pool is taken and kept in memory for
+/// `stats_history_minutes` minutes. Each snapshot holds the traffic of the pool
+/// during the last minute and the state of its clients and servers at the moment
+/// the snapshot was taken, so short-lived spikes can be found with SHOW STATS_HISTORY
+/// even without an external metrics system.
+use chrono::{DateTime, Local};
+use log::info;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use std::collections::{HashMap, VecDeque};
+use std::time::Duration;
+
+use crate::config::get_config;
+use crate::messages::DataType;
+use crate::pool::StatsPoolIdentifier;
+use crate::stats::pool::PoolStats;
+
+/// Interval between two snapshots.
+const SNAPSHOT_PERIOD: Duration = Duration::from_secs(60);
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+/// Cumulative counters of a pool, used to compute per-minute deltas.
+struct Totals {
+    xact_count: u64,
+    query_count: u64,
+    received: u64,
+    sent: u64,
+    xact_time: u64,
+    query_time: u64,
+    wait_time: u64,
+}
+
+impl Totals {
+    fn from_pool_stats(stats: &PoolStats) -> Self {
+        Totals {
+            xact_count: stats.total_xact_count,
+            query_count: stats.total_query_count,
+            received: stats.bytes_received,
+            sent: stats.bytes_sent,
+            xact_time: stats.total_xact_time_microseconds,
+            query_time: stats.total_query_time_microseconds,
+            wait_time: stats.wait_time,
+        }
+    }
+
+    /// Counters accumulated since `previous`. Counters reset by a pool
+    /// re-creation are taken as they are.
+    fn since(&self, previous: &Totals) -> Totals {
+        let delta = |current: u64, previous: u64| {
+            if current >= previous {
+                current - previous
+            } else {
+                current
+            }
+        };
+        Totals {
+            xact_count: delta(self.xact_count, previous.xact_count),
+            query_count: delta(self.query_count, previous.query_count),
+            received: delta(self.received, previous.received),
+            sent: delta(self.sent, previous.sent),
+            xact_time: delta(self.xact_time, previous.xact_time),
+            query_time: delta(self.query_time, previous.query_time),
+            wait_time: delta(self.wait_time, previous.wait_time),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+/// Statistics of a single pool for one minute.
+pub struct StatsSnapshot {
+    /// When the snapshot was taken
+    pub time: DateTime<Local>,
+
+    /// Pool database and user
+    pub database: String,
+    pub user: String,
+
+    /// Traffic since the previous snapshot
+    totals: Totals,
+
+    /// Client and server states at the time of the snapshot
+    pub cl_active: u64,
+    pub cl_waiting: u64,
+    pub sv_active: u64,
+    pub sv_idle: u64,
+
+    /// Maximum wait time of a client at the time of the snapshot (microseconds)
+    pub maxwait: u64,
+}
+
+impl StatsSnapshot {
+    pub fn generate_show_stats_history_header() -> Vec<(&'static str, DataType)> {
+        vec![
+            ("time", DataType::Text),
+            ("database", DataType::Text),
+            ("user", DataType::Text),
+            ("xact_count", DataType::Numeric),
+            ("query_count", DataType::Numeric),
+            ("received", DataType::Numeric),
+            ("sent", DataType::Numeric),
+            ("xact_time", DataType::Numeric),
+            ("query_time", DataType::Numeric),
+            ("wait_time", DataType::Numeric),
+            ("cl_active", DataType::Numeric),
+            ("cl_waiting", DataType::Numeric),
+            ("sv_active", DataType::Numeric),
+            ("sv_idle", DataType::Numeric),
+            ("maxwait_us", DataType::Numeric),
+        ]
+    }
+
+    pub fn generate_show_stats_history_row(&self) -> Vec<String> {
+        vec![
+            self.time.format("%Y-%m-%d %H:%M:%S").to_string(),
+            self.database.clone(),
+            self.user.clone(),
+            self.totals.xact_count.to_string(),
+            self.totals.query_count.to_string(),
+            self.totals.received.to_string(),
+            self.totals.sent.to_string(),
+            self.totals.xact_time.to_string(),
+            self.totals.query_time.to_string(),
+            self.totals.wait_time.to_string(),
+            self.cl_active.to_string(),
+            self.cl_waiting.to_string(),
+            self.sv_active.to_string(),
+            self.sv_idle.to_string(),
+            self.maxwait.to_string(),
+        ]
+    }
+}
+
+#[derive(Debug, Default)]
+/// Snapshots kept in memory, oldest first.
+struct StatsHistory {
+    snapshots: VecDeque<StatsSnapshot>,
+    last_totals: HashMap<StatsPoolIdentifier, Totals>,
+}
+
+impl StatsHistory {
+    /// Add a snapshot of every pool and drop the ones older than `retention`.
+    fn record(
+        &mut self,
+        time: DateTime<Local>,
+        pools: &HashMap<StatsPoolIdentifier, PoolStats>,
+        retention: chrono::Duration,
+    ) {
+        let mut last_totals = HashMap::with_capacity(pools.len());
+        for (identifier, stats) in pools {
+            let current = Totals::from_pool_stats(stats);
+            // The first snapshot of a pool only sets the baseline.
+            if let Some(previous) = self.last_totals.get(identifier) {
+                self.snapshots.push_back(StatsSnapshot {
+                    time,
+                    database: identifier.db.clone(),
+                    user: identifier.user.clone(),
+                    totals: current.since(previous),
+                    cl_active: stats.cl_active,
+                    cl_waiting: stats.cl_waiting,
+                    sv_active: stats.sv_active,
+                    sv_idle: stats.sv_idle,
+                    maxwait: stats.maxwait,
+                });
+            }
+            last_totals.insert(identifier.clone(), current);
+        }
+        self.last_totals = last_totals;
+
+        while let Some(oldest) = self.snapshots.front() {
+            if time - oldest.time <= retention {
+                break;
+            }
+            self.snapshots.pop_front();
+        }
+    }
+}
+
+static STATS_HISTORY: Lazy<Mutex<StatsHistory>> = Lazy::new(|| Mutex::new(StatsHistory::default()));
+
+/// Takes a snapshot of the pool statistics every minute.
+///
+/// Runs forever; does nothing while `stats_history_minutes` is zero.
+pub async fn collect_stats_history() {
+    info!("Stats history collector started");
+
+    let mut interval = tokio::time::interval(SNAPSHOT_PERIOD);
+    loop {
+        interval.tick().await;
+
+        let minutes = get_config().general.stats_history_minutes;
+        if minutes == 0 {
+            *STATS_HISTORY.lock() = StatsHistory::default();
+            continue;
+        }
+
+        let pools = PoolStats::construct_pool_lookup();
+        STATS_HISTORY.lock().record(
+            Local::now(),
+            &pools,
+            chrono::Duration::minutes(minutes as i64),
+        );
+    }
+}
+
+/// Snapshots taken during the last `minutes` minutes (all of them if None), oldest first.
+pub fn get_stats_history(minutes: Option<u64>) -> Vec<StatsSnapshot> {
+    let history = STATS_HISTORY.lock();
+    match minutes {
+        Some(minutes) => {
+            let since = Local::now() - chrono::Duration::minutes(minutes as i64);
+            history
+                .snapshots
+                .iter()
+                .filter(|snapshot| snapshot.time >= since)
+                .cloned()
+                .collect()
+        }
+        None => history.snapshots.iter().cloned().collect(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::PoolMode;
+    use crate::pool::PoolIdentifierVirtual;
+
+    fn pool_stats(xact_count: u64) -> PoolStats {
+        let mut stats = PoolStats::new(
+            PoolIdentifierVirtual {
+                db: "db".to_string(),
+                user: "user".to_string(),
+                virtual_pool_id: 0,
+            },
+            PoolMode::Transaction,
+            Vec::new(),
+            Vec::new(),
+        );
+        stats.total_xact_count = xact_count;
+        stats
+    }
+
+    #[test]
+    fn test_stats_history_record() {
+        let identifier = StatsPoolIdentifier {
+            db: "db".to_string(),
+            user: "user".to_string(),
+        };
+        let retention = chrono::Duration::seconds(90);
+        let start = Local::now();
+        let mut history = StatsHistory::default();
+
+        // The first snapshot only sets the baseline.
+        let pools = HashMap::from([(identifier.clone(), pool_stats(100))]);
+        history.record(start, &pools, retention);
+        assert!(history.snapshots.is_empty());
+
+        for (minute, xact_count) in [(1, 150), (2, 170), (3, 200)] {
+            let pools = HashMap::from([(identifier.clone(), pool_stats(xact_count))]);
+            history.record(start + chrono::Duration::minutes(minute), &pools, retention);
+        }
+
+        // The snapshot of the first minute is older than the retention.
+        let xact_counts: Vec<u64> = history
+            .snapshots
+            .iter()
+            .map(|snapshot| snapshot.totals.xact_count)
+            .collect();
+        assert_eq!(xact_counts, vec![20, 30]);
+    }
+}
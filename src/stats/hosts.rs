@@ -0,0 +1,202 @@
+/// Health and latency of the backend hosts.
+///
+/// Pools connecting to the same PostgreSQL host:port share one entry, so SHOW HOSTS
+/// can tell a host that refuses connections or answers slowly apart from a pool
+/// that is just busy. Server connects record their time or their error, queries
+/// feed an exponentially weighted moving average of the query time.
+use chrono::{DateTime, Local};
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use crate::errors::Error;
+
+/// Weight of a new sample in the moving averages.
+const EWMA_ALPHA: f64 = 0.2;
+
+/// Blend a sample into an average, the first sample is taken as is.
+fn ewma(average: Option<f64>, sample: f64) -> f64 {
+    match average {
+        Some(average) => average + EWMA_ALPHA * (sample - average),
+        None => sample,
+    }
+}
+
+#[derive(Debug, Default, Clone)]
+/// Outcome of the connects to a host.
+struct ConnectHealth {
+    /// Moving average of the connect and login time, in microseconds
+    connect_ewma_us: Option<f64>,
+    /// Connects that succeeded and failed since start
+    connects: u64,
+    connect_errors: u64,
+    /// Failed connects since the last successful one
+    consecutive_failures: u64,
+    last_error: Option<(DateTime<Local>, String)>,
+}
+
+#[derive(Debug, Default)]
+/// Health and latency of one backend host.
+pub struct HostStats {
+    connect: Mutex<ConnectHealth>,
+    /// Moving average of the query time in microseconds as f64 bits, 0 without queries
+    query_ewma_us: AtomicU64,
+    /// Server connections open to the host, of all pools
+    connections: AtomicU64,
+}
+
+impl HostStats {
+    /// Record a successful connect which took `elapsed`.
+    pub fn connect_succeeded(&self, elapsed: Duration) {
+        let mut connect = self.connect.lock();
+        connect.connect_ewma_us = Some(ewma(connect.connect_ewma_us, elapsed.as_micros() as f64));
+        connect.connects += 1;
+        connect.consecutive_failures = 0;
+    }
+
+    /// Record a failed connect.
+    pub fn connect_failed(&self, err: &Error) {
+        let mut connect = self.connect.lock();
+        connect.connect_errors += 1;
+        connect.consecutive_failures += 1;
+        connect.last_error = Some((Local::now(), err.to_string()));
+    }
+
+    /// A server connection to the host is open.
+    pub fn opened(&self) {
+        self.connections.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// A server connection to the host is closed.
+    pub fn closed(&self) {
+        self.connections.fetch_sub(1, Ordering::Relaxed);
+    }
+
+    /// Server connections open to the host.
+    pub fn connections(&self) -> u64 {
+        self.connections.load(Ordering::Relaxed)
+    }
+
+    /// Record a query which took `microseconds`.
+    #[inline(always)]
+    pub fn query(&self, microseconds: u64) {
+        let _ = self
+            .query_ewma_us
+            .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |bits| {
+                let average = match bits {
+                    0 => None,
+                    bits => Some(f64::from_bits(bits)),
+                };
+                Some(ewma(average, microseconds as f64).to_bits())
+            });
+    }
+
+    /// up: the last connect succeeded, down: it failed, unknown: no connect yet.
+    pub fn state(&self) -> &'static str {
+        let connect = self.connect.lock();
+        if connect.consecutive_failures > 0 {
+            "down"
+        } else if connect.connects > 0 {
+            "up"
+        } else {
+            "unknown"
+        }
+    }
+
+    pub fn generate_show_hosts_columns(&self, now: DateTime<Local>) -> Vec<String> {
+        let connect = self.connect.lock().clone();
+        let query_ewma_us = f64::from_bits(self.query_ewma_us.load(Ordering::Relaxed));
+        let (last_error, last_error_age) = match connect.last_error {
+            Some((time, error)) => (error, (now - time).num_seconds().max(0).to_string()),
+            None => (String::new(), String::new()),
+        };
+        vec![
+            self.state().to_string(),
+            format!("{:.3}", connect.connect_ewma_us.unwrap_or(0.0) / 1000.0),
+            format!("{:.3}", query_ewma_us / 1000.0),
+            connect.connects.to_string(),
+            connect.connect_errors.to_string(),
+            connect.consecutive_failures.to_string(),
+            last_error,
+            last_error_age,
+        ]
+    }
+}
+
+/// Hosts by host:port.
+static HOSTS: Lazy<Mutex<HashMap<(String, u16), Arc<HostStats>>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// Stats of the host, created on first use.
+pub fn host_stats(host: &str, port: u16) -> Arc<HostStats> {
+    HOSTS
+        .lock()
+        .entry((host.to_string(), port))
+        .or_default()
+        .clone()
+}
+
+/// All hosts the pooler connected to, sorted by host and port.
+pub fn get_host_stats() -> Vec<((String, u16), Arc<HostStats>)> {
+    let mut hosts: Vec<_> = HOSTS
+        .lock()
+        .iter()
+        .map(|(host, stats)| (host.clone(), stats.clone()))
+        .collect();
+    hosts.sort_by(|a, b| a.0.cmp(&b.0));
+    hosts
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_ewma() {
+        assert_eq!(ewma(None, 100.0), 100.0);
+        assert_eq!(ewma(Some(100.0), 200.0), 120.0);
+        assert_eq!(ewma(Some(120.0), 120.0), 120.0);
+    }
+
+    #[test]
+    fn test_host_state() {
+        let host = HostStats::default();
+        assert_eq!(host.state(), "unknown");
+
+        host.connect_succeeded(Duration::from_millis(4));
+        host.connect_succeeded(Duration::from_millis(9));
+        assert_eq!(host.state(), "up");
+
+        host.connect_failed(&Error::SocketError("connection refused".to_string()));
+        host.connect_failed(&Error::SocketError("timeout".to_string()));
+        assert_eq!(host.state(), "down");
+
+        host.query(1000);
+        host.query(2000);
+        let columns = host.generate_show_hosts_columns(Local::now());
+        assert_eq!(columns[0], "down");
+        assert_eq!(columns[1], "5.000");
+        assert_eq!(columns[2], "1.200");
+        assert_eq!(&columns[3..6], ["2", "2", "2"]);
+        assert!(columns[6].contains("timeout"));
+        assert_eq!(columns[7], "0");
+
+        host.connect_succeeded(Duration::from_millis(5));
+        assert_eq!(host.state(), "up");
+        assert_eq!(host.generate_show_hosts_columns(Local::now())[5], "0");
+    }
+
+    #[test]
+    fn test_host_stats_shared() {
+        let first = host_stats("hosts-test.example.com", 5432);
+        let second = host_stats("hosts-test.example.com", 5432);
+        assert!(Arc::ptr_eq(&first, &second));
+        assert!(!Arc::ptr_eq(
+            &first,
+            &host_stats("hosts-test.example.com", 5433)
+        ));
+    }
+}
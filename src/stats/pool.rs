@@ -466,6 +466,54 @@ impl PoolStats {
         ]
     }
 
+    pub fn generate_show_stats_totals_header() -> Vec<(&'static str, DataType)> {
+        vec![
+            ("database", DataType::Text),
+            ("user", DataType::Text),
+            ("xact_count", DataType::Numeric),
+            ("query_count", DataType::Numeric),
+            ("bytes_received", DataType::Numeric),
+            ("bytes_sent", DataType::Numeric),
+            ("xact_time", DataType::Numeric),
+            ("query_time", DataType::Numeric),
+            ("wait_time", DataType::Numeric),
+        ]
+    }
+
+    pub fn generate_show_stats_totals_row(&self) -> Vec<String> {
+        vec![
+            self.identifier.db.clone(),
+            self.identifier.user.clone(),
+            self.total_xact_count.to_string(),
+            self.total_query_count.to_string(),
+            self.total_received.to_string(),
+            self.total_sent.to_string(),
+            self.total_xact_time_microseconds.to_string(),
+            self.total_query_time_microseconds.to_string(),
+            self.wait_time.to_string(),
+        ]
+    }
+
+    /// Same columns as SHOW STATS_TOTALS: counts and bytes per second, times per
+    /// transaction or query (microseconds).
+    pub fn generate_show_stats_averages_header() -> Vec<(&'static str, DataType)> {
+        Self::generate_show_stats_totals_header()
+    }
+
+    pub fn generate_show_stats_averages_row(&self) -> Vec<String> {
+        vec![
+            self.identifier.db.clone(),
+            self.identifier.user.clone(),
+            self.avg_xact_count.to_string(),
+            self.avg_query_count.to_string(),
+            self.avg_recv.to_string(),
+            self.avg_sent.to_string(),
+            self.avg_xact_time_microsecons.to_string(),
+            self.avg_query_time_microseconds.to_string(),
+            self.avg_wait_time.to_string(),
+        ]
+    }
+
     /// Initializes statistics for each virtual pool by collecting data from address stats.
     ///
     /// This helper method creates a PoolStats instance for each virtual pool and populates
@@ -0,0 +1,224 @@
+/// Prepared transactions created through the pooler.
+///
+/// A prepared transaction (two-phase commit) outlives the client and the server
+/// connection that created it, holding its locks and the xmin horizon until someone
+/// runs COMMIT PREPARED or ROLLBACK PREPARED. For pools with `track_prepared_transactions`
+/// the pooler remembers the ones prepared through it, shows them with
+/// SHOW PREPARED_TRANSACTIONS and warns about those left behind for too long.
+/// Transactions prepared or finished bypassing the pooler are not seen.
+use chrono::{DateTime, Local};
+use log::warn;
+use once_cell::sync::Lazy;
+use parking_lot::Mutex;
+use std::collections::HashMap;
+use std::time::Duration;
+
+use crate::config::get_config;
+use crate::messages::{DataType, TwoPhaseCommand};
+
+/// Interval between two checks of the prepared transaction ages.
+const CHECK_PERIOD: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Clone)]
+/// A transaction prepared through the pooler and not finished yet.
+pub struct PreparedTransaction {
+    /// Pool database and the user who prepared the transaction
+    pub database: String,
+    pub user: String,
+
+    /// Transaction identifier
+    pub gid: String,
+
+    /// When PREPARE TRANSACTION completed
+    pub prepared_at: DateTime<Local>,
+
+    /// The age warning was already logged
+    warned: bool,
+}
+
+impl PreparedTransaction {
+    /// Age of the transaction in seconds.
+    pub fn age(&self, now: DateTime<Local>) -> i64 {
+        (now - self.prepared_at).num_seconds().max(0)
+    }
+
+    pub fn generate_show_prepared_transactions_header() -> Vec<(&'static str, DataType)> {
+        vec![
+            ("database", DataType::Text),
+            ("user", DataType::Text),
+            ("gid", DataType::Text),
+            ("prepared_at", DataType::Text),
+            ("age_seconds", DataType::Numeric),
+        ]
+    }
+
+    pub fn generate_show_prepared_transactions_row(&self) -> Vec<String> {
+        vec![
+            self.database.clone(),
+            self.user.clone(),
+            self.gid.clone(),
+            self.prepared_at.format("%Y-%m-%d %H:%M:%S").to_string(),
+            self.age(Local::now()).to_string(),
+        ]
+    }
+}
+
+#[derive(Debug, Default)]
+/// Unfinished prepared transactions by database and gid.
+struct PreparedTransactions {
+    transactions: HashMap<(String, String), PreparedTransaction>,
+}
+
+impl PreparedTransactions {
+    /// Apply a completed two-phase commit command.
+    fn track(
+        &mut self,
+        database: &str,
+        user: &str,
+        command: &TwoPhaseCommand,
+        now: DateTime<Local>,
+    ) {
+        let key = (database.to_string(), command.gid().to_string());
+        match command {
+            TwoPhaseCommand::Prepare(gid) => {
+                self.transactions.insert(
+                    key,
+                    PreparedTransaction {
+                        database: database.to_string(),
+                        user: user.to_string(),
+                        gid: gid.clone(),
+                        prepared_at: now,
+                        warned: false,
+                    },
+                );
+            }
+            TwoPhaseCommand::CommitPrepared(_) | TwoPhaseCommand::RollbackPrepared(_) => {
+                self.transactions.remove(&key);
+            }
+        }
+    }
+
+    /// Transactions older than the warning age of their database (0 disables it),
+    /// each returned only once.
+    fn overdue<F>(&mut self, now: DateTime<Local>, warning_age: F) -> Vec<PreparedTransaction>
+    where
+        F: Fn(&str) -> u64,
+    {
+        let mut overdue = Vec::new();
+        for transaction in self.transactions.values_mut() {
+            let threshold = warning_age(&transaction.database);
+            if transaction.warned || threshold == 0 {
+                continue;
+            }
+            if (now - transaction.prepared_at).num_milliseconds() >= threshold as i64 {
+                transaction.warned = true;
+                overdue.push(transaction.clone());
+            }
+        }
+        overdue
+    }
+}
+
+static PREPARED_TRANSACTIONS: Lazy<Mutex<PreparedTransactions>> =
+    Lazy::new(|| Mutex::new(PreparedTransactions::default()));
+
+/// Record a two-phase commit command the server completed for a client of `database`.
+pub fn track_two_phase_command(database: &str, user: &str, command: &TwoPhaseCommand) {
+    PREPARED_TRANSACTIONS
+        .lock()
+        .track(database, user, command, Local::now());
+}
+
+/// Warns about prepared transactions older than `prepared_transaction_age_warning`.
+///
+/// Runs forever; transactions of pools that no longer track them are forgotten.
+pub async fn watch_prepared_transactions() {
+    let mut interval = tokio::time::interval(CHECK_PERIOD);
+    loop {
+        interval.tick().await;
+
+        let config = get_config();
+        let overdue = {
+            let mut prepared = PREPARED_TRANSACTIONS.lock();
+            prepared.transactions.retain(|(database, _), _| {
+                config
+                    .pool_config(database)
+                    .is_some_and(|pool| pool.track_prepared_transactions)
+            });
+            prepared.overdue(Local::now(), |database| {
+                config
+                    .pool_config(database)
+                    .map_or(0, |pool| pool.prepared_transaction_age_warning)
+            })
+        };
+
+        for transaction in overdue {
+            warn!(
+                "Prepared transaction {:?} {{ database: {:?}, user: {:?} }} is not committed or rolled back for {}s, it holds locks and the xmin horizon",
+                transaction.gid,
+                transaction.database,
+                transaction.user,
+                transaction.age(Local::now())
+            );
+        }
+    }
+}
+
+/// Unfinished prepared transactions, oldest first.
+pub fn get_prepared_transactions() -> Vec<PreparedTransaction> {
+    let mut transactions: Vec<PreparedTransaction> = PREPARED_TRANSACTIONS
+        .lock()
+        .transactions
+        .values()
+        .cloned()
+        .collect();
+    transactions.sort_by_key(|transaction| transaction.prepared_at);
+    transactions
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_prepared_transactions_track() {
+        let start = Local::now();
+        let mut prepared = PreparedTransactions::default();
+
+        let gid = |gid: &str| gid.to_string();
+        prepared.track("db", "alice", &TwoPhaseCommand::Prepare(gid("a")), start);
+        prepared.track("db", "alice", &TwoPhaseCommand::Prepare(gid("b")), start);
+        prepared.track("other", "bob", &TwoPhaseCommand::Prepare(gid("a")), start);
+        assert_eq!(prepared.transactions.len(), 3);
+
+        // Finished by another user, the gid is unique per database.
+        prepared.track(
+            "db",
+            "bob",
+            &TwoPhaseCommand::CommitPrepared(gid("a")),
+            start,
+        );
+        prepared.track(
+            "db",
+            "bob",
+            &TwoPhaseCommand::RollbackPrepared(gid("c")),
+            start,
+        );
+        assert_eq!(prepared.transactions.len(), 2);
+        assert!(!prepared.transactions.contains_key(&(gid("db"), gid("a"))));
+
+        let warning_age = |database: &str| if database == "db" { 60_000 } else { 0 };
+        assert!(prepared
+            .overdue(start + chrono::Duration::seconds(59), warning_age)
+            .is_empty());
+        let overdue = prepared.overdue(start + chrono::Duration::seconds(60), warning_age);
+        assert_eq!(overdue.len(), 1);
+        assert_eq!(overdue[0].gid, "b");
+        assert_eq!(overdue[0].user, "alice");
+
+        // Warned only once.
+        assert!(prepared
+            .overdue(start + chrono::Duration::seconds(120), warning_age)
+            .is_empty());
+    }
+}
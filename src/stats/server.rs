@@ -1,3 +1,4 @@
+use super::hosts::{host_stats, HostStats};
 use super::AddressStats;
 use super::{get_reporter, Reporter};
 use crate::config::Address;
@@ -47,6 +48,8 @@ pub struct ServerStats {
     /// ------------------------------------------------------------------------------------------
     /// Address configuration for this server connection
     address: Address,
+    /// Health and latency of the backend host, shared with the other connections to it
+    host: Arc<HostStats>,
     /// Timestamp when the server connection was established
     connect_time: Instant,
 
@@ -86,6 +89,9 @@ pub struct ServerStats {
     pub prepared_miss_count: Arc<AtomicU64>,
     /// Current size of the prepared statement cache
     pub prepared_cache_size: Arc<AtomicU64>,
+
+    /// Session-level advisory locks were taken through the pooler and may be held
+    pub advisory_locks: Arc<AtomicBool>,
 }
 
 /// Default implementation for ServerStats.
@@ -106,6 +112,7 @@ impl Default for ServerStats {
             process_id: Arc::new(AtomicI32::new(0)),
             application_name: Arc::new(RwLock::new(String::new())),
             address: Address::default(),
+            host: Arc::new(HostStats::default()),
             connect_time: Instant::now(),
             state: Arc::new(AtomicU8::new(SERVER_STATE_LOGIN)),
             wait: Arc::new(AtomicU8::new(SERVER_WAIT_IDLE)),
@@ -118,6 +125,7 @@ impl Default for ServerStats {
             prepared_hit_count: Arc::new(AtomicU64::new(0)),
             prepared_miss_count: Arc::new(AtomicU64::new(0)),
             prepared_cache_size: Arc::new(AtomicU64::new(0)),
+            advisory_locks: Arc::new(AtomicBool::new(false)),
         }
     }
 }
@@ -135,6 +143,7 @@ impl ServerStats {
     /// * `connect_time` - Timestamp when the server connection was established
     pub fn new(address: Address, connect_time: Instant) -> Self {
         Self {
+            host: host_stats(&address.host, address.port),
             address,
             connect_time,
             server_id: rand::random::<i32>(),
@@ -390,6 +399,7 @@ impl ServerStats {
         self.set_application(application_name.to_string());
         self.address.stats.query_count_add();
         self.address.stats.query_time_add_microseconds(microseconds);
+        self.host.query(microseconds);
         self.query_count.fetch_add(1, Ordering::Relaxed);
     }
 
@@ -488,6 +498,16 @@ impl ServerStats {
         self.address.name()
     }
 
+    /// Returns the host and port of the backend.
+    pub fn host_port(&self) -> (String, u16) {
+        (self.address.host.clone(), self.address.port)
+    }
+
+    /// Returns the health and latency stats of the backend host.
+    pub fn host(&self) -> &Arc<HostStats> {
+        &self.host
+    }
+
     /// Returns the server connection timestamp.
     pub fn connect_time(&self) -> Instant {
         self.connect_time
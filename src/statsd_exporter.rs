@@ -0,0 +1,253 @@
+/// StatsD metrics exporter for pg_doorman.
+///
+/// Pushes the pool, client and server counters of the Prometheus exporter over UDP
+/// every `statsd.interval`. DogStatsD gets the pools as tags, plain StatsD gets
+/// them in the metric names (`pg_doorman.<database>.<user>.clients.active`).
+use crate::config::{get_config, Statsd};
+use crate::format_host_port;
+use crate::stats::pool::PoolStats;
+use crate::stats::{
+    CANCEL_CONNECTION_COUNTER, PLAIN_CONNECTION_COUNTER, TLS_CONNECTION_COUNTER,
+    TOTAL_CONNECTION_COUNTER,
+};
+use log::{error, info, warn};
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use tokio::net::UdpSocket;
+
+/// Datagrams are kept under the usual Ethernet MTU to avoid fragmentation.
+const MAX_PACKET_SIZE: usize = 1432;
+
+/// A gauge of the current value of a counter or state.
+#[derive(Debug, Clone, PartialEq)]
+struct Metric {
+    name: &'static str,
+    value: f64,
+    /// Pool of the metric: database and user.
+    pool: Option<(String, String)>,
+    /// Variant of the metric, e.g. ("state", "idle").
+    kind: Option<(&'static str, &'static str)>,
+}
+
+impl Metric {
+    fn new(name: &'static str, value: f64) -> Metric {
+        Metric {
+            name,
+            value,
+            pool: None,
+            kind: None,
+        }
+    }
+
+    fn pool(mut self, database: &str, user: &str) -> Metric {
+        self.pool = Some((database.to_string(), user.to_string()));
+        self
+    }
+
+    fn kind(mut self, key: &'static str, value: &'static str) -> Metric {
+        self.kind = Some((key, value));
+        self
+    }
+
+    fn format(&self, prefix: &str, tags: &[String], dogstatsd: bool) -> String {
+        let mut name = String::new();
+        if !prefix.is_empty() {
+            name.push_str(prefix);
+            name.push('.');
+        }
+        if dogstatsd {
+            name.push_str(self.name);
+            let mut all_tags: Vec<String> = Vec::new();
+            if let Some((database, user)) = &self.pool {
+                all_tags.push(format!("database:{}", sanitize(database)));
+                all_tags.push(format!("user:{}", sanitize(user)));
+            }
+            if let Some((key, value)) = self.kind {
+                all_tags.push(format!("{key}:{value}"));
+            }
+            all_tags.extend(tags.iter().cloned());
+            if all_tags.is_empty() {
+                format!("{name}:{}|g", self.value)
+            } else {
+                format!("{name}:{}|g|#{}", self.value, all_tags.join(","))
+            }
+        } else {
+            if let Some((database, user)) = &self.pool {
+                name.push_str(&format!("{}.{}.", sanitize(database), sanitize(user)));
+            }
+            name.push_str(self.name);
+            if let Some((_, value)) = self.kind {
+                name.push('.');
+                name.push_str(value);
+            }
+            format!("{name}:{}|g", self.value)
+        }
+    }
+}
+
+/// Replace the characters with a meaning in the StatsD line format.
+fn sanitize(value: &str) -> String {
+    value
+        .chars()
+        .map(|c| match c {
+            '.' | ':' | '|' | '#' | ',' | '@' => '_',
+            c if c.is_whitespace() => '_',
+            c => c,
+        })
+        .collect()
+}
+
+fn collect_metrics() -> Vec<Metric> {
+    let mut metrics = Vec::new();
+    let connections = [
+        ("plain", &*PLAIN_CONNECTION_COUNTER),
+        ("tls", &*TLS_CONNECTION_COUNTER),
+        ("cancel", &*CANCEL_CONNECTION_COUNTER),
+        ("total", &*TOTAL_CONNECTION_COUNTER),
+    ];
+    for (kind, counter) in connections {
+        metrics.push(
+            Metric::new("connections", counter.load(Ordering::Relaxed) as f64).kind("type", kind),
+        );
+    }
+
+    for (identifier, stats) in PoolStats::construct_pool_lookup() {
+        let (database, user) = (identifier.db.as_str(), identifier.user.as_str());
+        let pool_metrics = [
+            Metric::new("clients", stats.cl_idle as f64).kind("state", "idle"),
+            Metric::new("clients", stats.cl_active as f64).kind("state", "active"),
+            Metric::new("clients", stats.cl_waiting as f64).kind("state", "waiting"),
+            Metric::new("servers", stats.sv_idle as f64).kind("state", "idle"),
+            Metric::new("servers", stats.sv_active as f64).kind("state", "active"),
+            Metric::new("servers", stats.sv_login as f64).kind("state", "login"),
+            Metric::new("transactions", stats.total_xact_count as f64),
+            Metric::new("queries", stats.total_query_count as f64),
+            Metric::new("bytes", stats.bytes_received as f64).kind("direction", "received"),
+            Metric::new("bytes", stats.bytes_sent as f64).kind("direction", "sent"),
+            Metric::new("avg_wait_time_ms", stats.avg_wait_time as f64 / 1_000f64),
+            Metric::new("cancel_requests", stats.cl_cancel_req as f64),
+            Metric::new("errors", stats.errors as f64),
+        ];
+        metrics.extend(
+            pool_metrics
+                .into_iter()
+                .map(|metric| metric.pool(database, user)),
+        );
+    }
+    metrics
+}
+
+/// Pack the lines into datagrams of at most `max_size` bytes, a longer line gets one of its own.
+fn pack_lines(lines: Vec<String>, max_size: usize) -> Vec<String> {
+    let mut packets: Vec<String> = Vec::new();
+    let mut packet = String::new();
+    for line in lines {
+        if !packet.is_empty() && packet.len() + 1 + line.len() > max_size {
+            packets.push(std::mem::take(&mut packet));
+        }
+        if !packet.is_empty() {
+            packet.push('\n');
+        }
+        packet.push_str(&line);
+    }
+    if !packet.is_empty() {
+        packets.push(packet);
+    }
+    packets
+}
+
+async fn push_metrics(socket: &UdpSocket, config: &Statsd) {
+    let lines = collect_metrics()
+        .iter()
+        .map(|metric| metric.format(&config.prefix, &config.tags, config.dogstatsd))
+        .collect();
+    for packet in pack_lines(lines, MAX_PACKET_SIZE) {
+        if let Err(err) = socket.send(packet.as_bytes()).await {
+            warn!("Failed to send metrics to StatsD: {err}");
+            return;
+        }
+    }
+}
+
+pub async fn start_statsd_exporter() {
+    let config = get_config().statsd;
+    let address = format_host_port(&config.host, config.port);
+    let target = match tokio::net::lookup_host(&address)
+        .await
+        .map(|mut addrs| addrs.next())
+    {
+        Ok(Some(target)) => target,
+        Ok(None) => {
+            error!("Failed to resolve StatsD address {address}");
+            return;
+        }
+        Err(err) => {
+            error!("Failed to resolve StatsD address {address}: {err}");
+            return;
+        }
+    };
+    let bind = if target.is_ipv6() {
+        "[::]:0"
+    } else {
+        "0.0.0.0:0"
+    };
+    let socket = match UdpSocket::bind(bind).await {
+        Ok(socket) => socket,
+        Err(err) => {
+            error!("Failed to create StatsD socket: {err}");
+            return;
+        }
+    };
+    if let Err(err) = socket.connect(target).await {
+        error!("Failed to connect StatsD socket to {address}: {err}");
+        return;
+    }
+    info!(
+        "Pushing metrics to StatsD at {address} every {}ms",
+        config.interval
+    );
+
+    let mut interval = tokio::time::interval(Duration::from_millis(config.interval));
+    loop {
+        interval.tick().await;
+        push_metrics(&socket, &config).await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_format_metric() {
+        let metric = Metric::new("clients", 3.0)
+            .kind("state", "waiting")
+            .pool("app.db", "app_user");
+        let tags = vec!["env:prod".to_string()];
+        assert_eq!(
+            metric.format("pg_doorman", &tags, true),
+            "pg_doorman.clients:3|g|#database:app_db,user:app_user,state:waiting,env:prod"
+        );
+        assert_eq!(
+            metric.format("pg_doorman", &tags, false),
+            "pg_doorman.app_db.app_user.clients.waiting:3|g"
+        );
+        assert_eq!(
+            Metric::new("queries", 0.5).format("", &[], true),
+            "queries:0.5|g"
+        );
+    }
+
+    #[test]
+    fn test_pack_lines() {
+        let lines = vec![
+            "a:1|g".to_string(),
+            "b:2|g".to_string(),
+            "c:3|g".to_string(),
+        ];
+        assert_eq!(pack_lines(lines.clone(), 1432), vec!["a:1|g\nb:2|g\nc:3|g"]);
+        assert_eq!(pack_lines(lines.clone(), 11), vec!["a:1|g\nb:2|g", "c:3|g"]);
+        assert_eq!(pack_lines(lines, 3), vec!["a:1|g", "b:2|g", "c:3|g"]);
+        assert!(pack_lines(Vec::new(), 1432).is_empty());
+    }
+}
@@ -1,10 +1,20 @@
 // TLS functionality for secure connections
+use std::collections::HashMap;
 use std::io::{self, Read};
 use std::path::Path;
+use std::sync::Arc;
+use std::time::SystemTime;
 
+use crate::config::{get_config, Config, General, ServerTlsMode, TlsSniRoute, TlsVersion};
 use crate::errors::Error;
+use arc_swap::ArcSwapOption;
+use log::{error, info, warn};
 use native_tls::TlsClientCertificateVerification::{DoNotRequestCertificate, RequireCertificate};
 use native_tls::{Certificate, Identity, Protocol, TlsClientCertificateVerification};
+use once_cell::sync::Lazy;
+use openssl::asn1::Asn1Time;
+use openssl::x509::X509;
+use parking_lot::Mutex;
 
 /// Helper function to read a file into a byte vector
 fn read_file(path: impl AsRef<Path>) -> io::Result<Vec<u8>> {
@@ -91,6 +101,85 @@ fn load_certificate(path: &Path) -> Result<Certificate, Error> {
     })
 }
 
+/// Load all certificates of a PEM bundle
+fn load_certificate_bundle(path: &Path) -> Result<Vec<Certificate>, Error> {
+    let bundle_data = read_file(path).map_err(|err| {
+        Error::BadConfig(format!(
+            "Failed to read certificate file {}: {}",
+            path.display(),
+            err
+        ))
+    })?;
+    let bad_bundle = |err: openssl::error::ErrorStack| {
+        Error::BadConfig(format!(
+            "Failed to parse certificate bundle {}: {}",
+            path.display(),
+            err
+        ))
+    };
+    let mut certs = Vec::new();
+    for cert in X509::stack_from_pem(&bundle_data).map_err(bad_bundle)? {
+        let der = cert.to_der().map_err(bad_bundle)?;
+        certs.push(Certificate::from_der(&der).map_err(|err| {
+            Error::BadConfig(format!(
+                "Failed to parse certificate bundle {}: {}",
+                path.display(),
+                err
+            ))
+        })?);
+    }
+    if certs.is_empty() {
+        return Err(Error::BadConfig(format!(
+            "No certificates in {}",
+            path.display()
+        )));
+    }
+    Ok(certs)
+}
+
+/// Protocol versions and ciphers of the client TLS connections.
+#[derive(Debug, Clone, PartialEq)]
+pub struct TlsProtocols {
+    pub min_version: TlsVersion,
+    pub max_version: Option<TlsVersion>,
+    pub ciphers: Option<String>,
+    pub ciphersuites: Option<String>,
+    pub curves: Option<String>,
+}
+
+impl Default for TlsProtocols {
+    fn default() -> Self {
+        TlsProtocols {
+            min_version: General::default_tls_min_version(),
+            max_version: None,
+            ciphers: None,
+            ciphersuites: None,
+            curves: None,
+        }
+    }
+}
+
+impl TlsProtocols {
+    pub fn from_general(general: &General) -> Self {
+        TlsProtocols {
+            min_version: general.tls_min_version,
+            max_version: general.tls_max_version,
+            ciphers: general.tls_ciphers.clone(),
+            ciphersuites: general.tls_ciphersuites.clone(),
+            curves: general.tls_curves.clone(),
+        }
+    }
+}
+
+fn protocol(version: TlsVersion) -> Protocol {
+    match version {
+        TlsVersion::V1_0 => Protocol::Tlsv10,
+        TlsVersion::V1_1 => Protocol::Tlsv11,
+        TlsVersion::V1_2 => Protocol::Tlsv12,
+        TlsVersion::V1_3 => Protocol::Tlsv13,
+    }
+}
+
 /// Build a TLS acceptor from certificate, key, and optional CA certificate
 #[allow(unused_variables)]
 pub fn build_acceptor(
@@ -98,6 +187,8 @@ pub fn build_acceptor(
     key: &Path,
     ca_path: Option<impl AsRef<Path>>,
     mode: Option<String>,
+    sni: &[TlsSniRoute],
+    protocols: &TlsProtocols,
 ) -> Result<tokio_native_tls::TlsAcceptor, Error> {
     // Load identity from certificate and key
     let identity = load_identity(cert, key).map_err(|err| {
@@ -121,9 +212,15 @@ pub fn build_acceptor(
     // Build TLS acceptor
     let mut builder = native_tls::TlsAcceptor::builder(identity);
 
-    // Set protocol versions
-    builder.min_protocol_version(Some(Protocol::Tlsv12)); // Upgraded from Tlsv10 for better security
-    builder.max_protocol_version(None);
+    // Set protocol versions and ciphers
+    builder.min_protocol_version(Some(protocol(protocols.min_version)));
+    builder.max_protocol_version(protocols.max_version.map(protocol));
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    {
+        builder.cipher_list(protocols.ciphers.as_deref());
+        builder.ciphersuites(protocols.ciphersuites.as_deref());
+        builder.groups_list(protocols.curves.as_deref());
+    }
 
     // Configure client certificate verification
     #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
@@ -137,6 +234,23 @@ pub fn build_acceptor(
         builder.client_cert_verification(verification);
     }
 
+    // Certificates of the server names with one of their own
+    #[cfg(not(any(target_os = "macos", target_os = "windows", target_os = "ios")))]
+    for route in sni {
+        if let (Some(certificate), Some(private_key)) =
+            (&route.tls_certificate, &route.tls_private_key)
+        {
+            let identity = load_identity(Path::new(certificate), Path::new(private_key))
+                .map_err(|err| {
+                    Error::BadConfig(format!(
+                        "Failed to load TLS identity of server name {} from cert {certificate} and key {private_key}: {err}",
+                        route.server_name
+                    ))
+                })?;
+            builder.sni_identity(&route.server_name, identity);
+        }
+    }
+
     // Build and convert to tokio acceptor
     builder
         .build()
@@ -144,6 +258,328 @@ pub fn build_acceptor(
         .map_err(|err| Error::BadConfig(format!("Failed to create TLS acceptor: {err}")))
 }
 
+/// Build the TLS connector of the server connections of a pool.
+pub fn build_server_connector(
+    mode: ServerTlsMode,
+    ca_cert: Option<&str>,
+    certificate: Option<&str>,
+    private_key: Option<&str>,
+) -> Result<tokio_native_tls::TlsConnector, Error> {
+    let mut builder = native_tls::TlsConnector::builder();
+    builder.min_protocol_version(Some(Protocol::Tlsv12));
+
+    match mode {
+        ServerTlsMode::VerifyFull => (),
+        ServerTlsMode::VerifyCa => {
+            builder.danger_accept_invalid_hostnames(true);
+        }
+        _ => {
+            builder.danger_accept_invalid_certs(true);
+            builder.danger_accept_invalid_hostnames(true);
+        }
+    }
+    if let Some(ca_cert) = ca_cert {
+        for cert in load_certificate_bundle(Path::new(ca_cert))? {
+            builder.add_root_certificate(cert);
+        }
+        builder.disable_built_in_roots(true);
+    }
+    if let (Some(certificate), Some(private_key)) = (certificate, private_key) {
+        let identity = load_identity(Path::new(certificate), Path::new(private_key)).map_err(
+            |err| {
+                Error::BadConfig(format!(
+                    "Failed to load server TLS identity from cert {certificate} and key {private_key}: {err}"
+                ))
+            },
+        )?;
+        builder.identity(identity);
+    }
+
+    builder
+        .build()
+        .map(tokio_native_tls::TlsConnector::from)
+        .map_err(|err| Error::BadConfig(format!("Failed to create server TLS connector: {err}")))
+}
+
+/// Expiry information about a configured TLS certificate.
+#[derive(Debug, Clone)]
+pub struct CertificateExpiry {
+    /// Which certificate it is: "server" (tls_certificate), "ca" (tls_ca_cert), "sni"
+    /// (tls_sni), "backend" (server_tls_certificate) or "backend_ca" (server_tls_ca_cert).
+    pub kind: &'static str,
+    pub path: String,
+    pub subject: String,
+    /// The end of the validity period (notAfter) as a unix timestamp.
+    pub not_after: i64,
+}
+
+impl CertificateExpiry {
+    /// Seconds until the certificate expires, negative if it has already expired.
+    pub fn seconds_left(&self) -> i64 {
+        self.not_after - chrono::Utc::now().timestamp()
+    }
+}
+
+/// Read the expiry of the first certificate in a PEM file.
+pub fn load_certificate_expiry(
+    kind: &'static str,
+    path: &Path,
+) -> Result<CertificateExpiry, Error> {
+    let cert_data = read_file(path).map_err(|err| {
+        Error::BadConfig(format!(
+            "Failed to read certificate file {}: {}",
+            path.display(),
+            err
+        ))
+    })?;
+    let cert = X509::from_pem(&cert_data).map_err(|err| {
+        Error::BadConfig(format!(
+            "Failed to parse certificate {}: {}",
+            path.display(),
+            err
+        ))
+    })?;
+
+    let epoch = Asn1Time::from_unix(0)
+        .map_err(|err| Error::BadConfig(format!("Failed to create time: {err}")))?;
+    let diff = epoch.diff(cert.not_after()).map_err(|err| {
+        Error::BadConfig(format!(
+            "Failed to read expiry of certificate {}: {}",
+            path.display(),
+            err
+        ))
+    })?;
+
+    let subject = cert
+        .subject_name()
+        .entries()
+        .map(|entry| {
+            format!(
+                "{}={}",
+                entry.object().nid().short_name().unwrap_or("?"),
+                entry
+                    .data()
+                    .as_utf8()
+                    .map(|data| data.to_string())
+                    .unwrap_or_default()
+            )
+        })
+        .collect::<Vec<String>>()
+        .join(", ");
+
+    Ok(CertificateExpiry {
+        kind,
+        path: path.display().to_string(),
+        subject,
+        not_after: diff.days as i64 * 86400 + diff.secs as i64,
+    })
+}
+
+/// A certificate expiry read from a file, or why it couldn't be, with the
+/// modification time and size of the file at that time.
+type CachedExpiry = (Option<(SystemTime, u64)>, Result<CertificateExpiry, String>);
+
+/// Expiries by certificate type and path, read again when the file changes.
+static CERTIFICATE_EXPIRIES: Lazy<Mutex<HashMap<(&'static str, String), CachedExpiry>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+/// The certificate files of the config by type: the client-facing "server" and "ca"
+/// (tls_certificate, tls_ca_cert), "sni" (tls_certificate of tls_sni), and "backend"
+/// and "backend_ca" (server_tls_certificate, server_tls_ca_cert of the pools).
+fn configured_certificates(config: &Config) -> Vec<(&'static str, String)> {
+    let general = &config.general;
+    let mut certificates: Vec<(&'static str, String)> = Vec::new();
+    let mut add = |kind: &'static str, path: &Option<String>| {
+        if let Some(path) = path {
+            if !certificates.contains(&(kind, path.clone())) {
+                certificates.push((kind, path.clone()));
+            }
+        }
+    };
+    add("server", &general.tls_certificate);
+    add("ca", &general.tls_ca_cert);
+    for route in general.tls_sni.iter() {
+        add("sni", &route.tls_certificate);
+    }
+    for pool in config.pools.values() {
+        add("backend", &pool.server_tls_certificate);
+        add("backend_ca", &pool.server_tls_ca_cert);
+    }
+    certificates
+}
+
+/// Expiry of all certificates of the config. A file is read again only when it
+/// changes; one that can't be read is logged once and skipped.
+pub fn configured_certificates_expiry(config: &Config) -> Vec<CertificateExpiry> {
+    let certificates = configured_certificates(config);
+    let mut cache = CERTIFICATE_EXPIRIES.lock();
+    cache.retain(|key, _| certificates.contains(key));
+    let mut result = Vec::new();
+    for (kind, path) in certificates {
+        let version = std::fs::metadata(&path)
+            .ok()
+            .and_then(|metadata| Some((metadata.modified().ok()?, metadata.len())));
+        let key = (kind, path);
+        let changed = cache
+            .get(&key)
+            .is_none_or(|(cached_version, _)| *cached_version != version);
+        if changed {
+            let expiry =
+                load_certificate_expiry(kind, Path::new(&key.1)).map_err(|err| err.to_string());
+            if let Err(ref err) = expiry {
+                warn!("Can't check expiry of {kind} certificate: {err}");
+            }
+            cache.insert(key.clone(), (version, expiry));
+        }
+        if let Some((_, Ok(expiry))) = cache.get(&key) {
+            result.push(expiry.clone());
+        }
+    }
+    result
+}
+
+/// Periodically log warnings about certificates that are about to expire.
+pub async fn monitor_certificate_expiry() {
+    let mut interval = tokio::time::interval(tokio::time::Duration::from_secs(3600));
+    loop {
+        interval.tick().await;
+        let config = get_config();
+        let warning_days = config.general.tls_certificate_expiry_warning_days;
+        if warning_days == 0 {
+            continue;
+        }
+        for cert in configured_certificates_expiry(&config) {
+            let seconds_left = cert.seconds_left();
+            if seconds_left < 0 {
+                error!(
+                    "TLS {} certificate {} ({}) has expired",
+                    cert.kind, cert.path, cert.subject
+                );
+            } else if seconds_left < warning_days as i64 * 86400 {
+                warn!(
+                    "TLS {} certificate {} ({}) expires in {} days",
+                    cert.kind,
+                    cert.path,
+                    cert.subject,
+                    seconds_left / 86400
+                );
+            }
+        }
+    }
+}
+
+/// Acceptor of the client TLS connections. A new one is swapped in when the
+/// certificate files change, the handshakes in flight finish with the old one.
+static TLS_ACCEPTOR: Lazy<ArcSwapOption<tokio_native_tls::TlsAcceptor>> =
+    Lazy::new(|| ArcSwapOption::from(None));
+
+/// What the acceptor was built from: the settings, and the modification time
+/// and size of the files.
+#[derive(Debug, PartialEq)]
+struct AcceptorVersion {
+    paths: Vec<Option<String>>,
+    tls_mode: Option<String>,
+    tls_sni: Vec<TlsSniRoute>,
+    protocols: TlsProtocols,
+    files: Vec<Option<(SystemTime, u64)>>,
+}
+
+static TLS_ACCEPTOR_VERSION: Lazy<Mutex<Option<AcceptorVersion>>> = Lazy::new(|| Mutex::new(None));
+
+/// The acceptor for new client TLS connections, none without tls_certificate.
+pub fn tls_acceptor() -> Option<tokio_native_tls::TlsAcceptor> {
+    TLS_ACCEPTOR
+        .load_full()
+        .map(|acceptor| acceptor.as_ref().clone())
+}
+
+fn tls_acceptor_version(general: &General) -> AcceptorVersion {
+    let paths = vec![
+        general.tls_certificate.clone(),
+        general.tls_private_key.clone(),
+        general.tls_ca_cert.clone(),
+    ];
+    let files = paths
+        .iter()
+        .chain(
+            general
+                .tls_sni
+                .iter()
+                .flat_map(|route| [&route.tls_certificate, &route.tls_private_key]),
+        )
+        .map(|path| {
+            let metadata = std::fs::metadata(path.as_ref()?).ok()?;
+            Some((metadata.modified().ok()?, metadata.len()))
+        })
+        .collect();
+    AcceptorVersion {
+        paths,
+        tls_mode: general.tls_mode.clone(),
+        tls_sni: general.tls_sni.clone(),
+        protocols: TlsProtocols::from_general(general),
+        files,
+    }
+}
+
+/// Build the client TLS acceptor again if the certificate, key or CA files or the
+/// TLS settings changed since the last time. Returns true if a new acceptor was swapped in.
+/// On error the current acceptor stays.
+pub fn reload_tls_acceptor(general: &General) -> Result<bool, Error> {
+    let (certificate, private_key) = match (&general.tls_certificate, &general.tls_private_key) {
+        (Some(certificate), Some(private_key)) => (certificate, private_key),
+        _ => {
+            TLS_ACCEPTOR.store(None);
+            *TLS_ACCEPTOR_VERSION.lock() = None;
+            return Ok(false);
+        }
+    };
+    let version = tls_acceptor_version(general);
+    if TLS_ACCEPTOR.load().is_some() && TLS_ACCEPTOR_VERSION.lock().as_ref() == Some(&version) {
+        return Ok(false);
+    }
+    let acceptor = build_acceptor(
+        Path::new(certificate),
+        Path::new(private_key),
+        general.tls_ca_cert.as_ref(),
+        general.tls_mode.clone(),
+        &general.tls_sni,
+        &version.protocols,
+    )?;
+    TLS_ACCEPTOR.store(Some(Arc::new(acceptor)));
+    *TLS_ACCEPTOR_VERSION.lock() = Some(version);
+    Ok(true)
+}
+
+/// The database of the clients sending this server name, none if they go to the one they ask for.
+pub fn sni_database<'a>(general: &'a General, server_name: &str) -> Option<&'a String> {
+    general
+        .tls_sni
+        .iter()
+        .find(|route| route.server_name.eq_ignore_ascii_case(server_name))
+        .and_then(|route| route.database.as_ref())
+}
+
+/// Check the client TLS files every tls_certificate_check_interval and load them
+/// again once they change, e.g. after a renewal by cert-manager or an ACME client.
+pub async fn watch_tls_certificates() {
+    let mut interval = tokio::time::interval(tokio::time::Duration::from_millis(1000));
+    let mut next_check = tokio::time::Instant::now();
+    loop {
+        interval.tick().await;
+        let general = get_config().general;
+        if general.tls_certificate_check_interval == 0 || tokio::time::Instant::now() < next_check {
+            continue;
+        }
+        next_check = tokio::time::Instant::now()
+            + tokio::time::Duration::from_millis(general.tls_certificate_check_interval);
+        match reload_tls_acceptor(&general) {
+            Ok(true) => info!("TLS certificate reloaded"),
+            Ok(false) => (),
+            Err(err) => error!("Can't reload the TLS certificate, keeping the current one: {err}"),
+        }
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -244,6 +680,8 @@ mod tests {
                 &key_path,
                 Some(&ca_path),
                 Some("require".to_string()),
+                &[],
+                &TlsProtocols::default(),
             );
             assert!(
                 result.is_ok(),
@@ -257,6 +695,8 @@ mod tests {
                 &key_path,
                 None::<&Path>,
                 Some("require".to_string()),
+                &[],
+                &TlsProtocols::default(),
             );
             assert!(
                 result.is_ok(),
@@ -265,7 +705,14 @@ mod tests {
             );
 
             // Test without mode
-            let result = build_acceptor(&cert_path, &key_path, Some(&ca_path), None);
+            let result = build_acceptor(
+                &cert_path,
+                &key_path,
+                Some(&ca_path),
+                None,
+                &[],
+                &TlsProtocols::default(),
+            );
             assert!(
                 result.is_ok(),
                 "Failed to build acceptor without mode: {:?}",
@@ -273,4 +720,127 @@ mod tests {
             );
         }
     }
+
+    #[test]
+    fn test_sni_database() {
+        let mut general = General::default();
+        general.tls_sni = vec![
+            TlsSniRoute {
+                server_name: "Tenant1.db.example.com".to_string(),
+                database: Some("tenant1".to_string()),
+                tls_certificate: None,
+                tls_private_key: None,
+            },
+            TlsSniRoute {
+                server_name: "shared.db.example.com".to_string(),
+                database: None,
+                tls_certificate: None,
+                tls_private_key: None,
+            },
+        ];
+        assert_eq!(
+            sni_database(&general, "tenant1.db.example.com").unwrap(),
+            "tenant1"
+        );
+        assert_eq!(sni_database(&general, "shared.db.example.com"), None);
+        assert_eq!(sni_database(&general, "other.db.example.com"), None);
+
+        let cert_path = PathBuf::from("tests/data/ssl/server.crt");
+        let key_path = PathBuf::from("tests/data/ssl/server.key");
+        if cert_path.exists() && key_path.exists() {
+            general.tls_sni[0].tls_certificate = Some(cert_path.display().to_string());
+            general.tls_sni[0].tls_private_key = Some(key_path.display().to_string());
+            let result = build_acceptor(
+                &cert_path,
+                &key_path,
+                None::<&Path>,
+                None,
+                &general.tls_sni,
+                &TlsProtocols::default(),
+            );
+            assert!(
+                result.is_ok(),
+                "Failed to build acceptor with server names: {:?}",
+                result.err()
+            );
+        }
+    }
+
+    #[test]
+    fn test_build_acceptor_protocols() {
+        let cert_path = PathBuf::from("tests/data/ssl/server.crt");
+        let key_path = PathBuf::from("tests/data/ssl/server.key");
+
+        if cert_path.exists() && key_path.exists() {
+            let protocols = TlsProtocols {
+                min_version: TlsVersion::V1_2,
+                max_version: Some(TlsVersion::V1_3),
+                ciphers: Some("ECDHE+AESGCM:ECDHE+CHACHA20".to_string()),
+                ciphersuites: Some("TLS_AES_256_GCM_SHA384".to_string()),
+                curves: Some("X25519:P-256".to_string()),
+            };
+            let result =
+                build_acceptor(&cert_path, &key_path, None::<&Path>, None, &[], &protocols);
+            assert!(
+                result.is_ok(),
+                "Failed to build acceptor with protocols: {:?}",
+                result.err()
+            );
+
+            let protocols = TlsProtocols {
+                ciphers: Some("NO-SUCH-CIPHER".to_string()),
+                ..TlsProtocols::default()
+            };
+            assert!(
+                build_acceptor(&cert_path, &key_path, None::<&Path>, None, &[], &protocols)
+                    .is_err()
+            );
+        }
+    }
+
+    #[test]
+    fn test_load_certificate_expiry() {
+        let cert_path = PathBuf::from("tests/data/ssl/server.crt");
+
+        if cert_path.exists() {
+            let result = load_certificate_expiry("server", &cert_path);
+            assert!(
+                result.is_ok(),
+                "Failed to load certificate expiry: {:?}",
+                result.err()
+            );
+            let expiry = result.unwrap();
+            assert!(expiry.not_after > 0);
+            assert!(!expiry.subject.is_empty());
+        }
+
+        assert!(load_certificate_expiry("server", Path::new("/nonexistent/file")).is_err());
+    }
+
+    #[test]
+    fn test_configured_certificates() {
+        let mut config = Config::default();
+        config.general.tls_certificate = Some("tests/data/ssl/server.crt".to_string());
+        config.general.tls_sni.push(TlsSniRoute {
+            server_name: "tenant.example.com".to_string(),
+            database: None,
+            tls_certificate: Some("tests/data/ssl/server.crt".to_string()),
+            tls_private_key: Some("tests/data/ssl/server.key".to_string()),
+        });
+        for database in ["billing", "orders"] {
+            let pool = crate::config::Pool {
+                server_tls_certificate: Some("tests/data/ssl/client.crt".to_string()),
+                ..Default::default()
+            };
+            config.pools.insert(database.to_string(), pool);
+        }
+        assert_eq!(
+            configured_certificates(&config),
+            vec![
+                ("server", "tests/data/ssl/server.crt".to_string()),
+                ("sni", "tests/data/ssl/server.crt".to_string()),
+                ("backend", "tests/data/ssl/client.crt".to_string()),
+            ]
+        );
+    }
 }
@@ -0,0 +1,146 @@
+// Transaction duration limits.
+//
+// A transaction running longer than transaction_duration_warning gets a
+// NoticeResponse with its next message, one longer than
+// transaction_duration_limit is cancelled on the server and its client is
+// terminated, so long transactions get a grace period instead of a blunt kill.
+
+// Standard library imports
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+// External crate imports
+use log::warn;
+
+// Internal crate imports
+use crate::server::Server;
+
+/// Transactions warned about their duration.
+pub static TRANSACTION_DURATION_WARNING_COUNTER: AtomicUsize = AtomicUsize::new(0);
+/// Transactions cancelled on the server for exceeding the limit.
+pub static TRANSACTION_DURATION_LIMIT_COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+/// Duration thresholds of the transactions running on a checked out server.
+/// The scheduled cancel is aborted when the transaction ends or the limit is dropped.
+#[derive(Debug)]
+pub struct TransactionLimit {
+    warning: Duration,
+    limit: Duration,
+    started_at: Option<Instant>,
+    warned: bool,
+    cancel: Option<tokio::task::AbortHandle>,
+}
+
+impl TransactionLimit {
+    /// Thresholds in milliseconds, 0 disables.
+    pub fn new(warning_ms: u64, limit_ms: u64) -> TransactionLimit {
+        TransactionLimit {
+            warning: Duration::from_millis(warning_ms),
+            limit: Duration::from_millis(limit_ms),
+            started_at: None,
+            warned: false,
+            cancel: None,
+        }
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        !self.warning.is_zero() || !self.limit.is_zero()
+    }
+
+    /// A transaction starts on the server, its query is cancelled at the limit.
+    pub fn start(&mut self, server: &Server) {
+        if !self.is_enabled() {
+            return;
+        }
+        self.finish();
+        let now = Instant::now();
+        self.started_at = Some(now);
+        if !self.limit.is_zero() {
+            let (process_id, secret_key, host, port) = server.cancel_target();
+            let deadline = tokio::time::Instant::from_std(now + self.limit);
+            let task = tokio::task::spawn(async move {
+                tokio::time::sleep_until(deadline).await;
+                TRANSACTION_DURATION_LIMIT_COUNTER.fetch_add(1, Ordering::Relaxed);
+                warn!("Transaction on [{process_id}] {host}:{port} exceeded transaction_duration_limit, cancelling");
+                if let Err(err) = Server::cancel(&host, port, process_id, secret_key).await {
+                    warn!("Failed to cancel transaction on [{process_id}] {host}:{port}: {err}");
+                }
+            });
+            self.cancel = Some(task.abort_handle());
+        }
+    }
+
+    /// The transaction is over.
+    pub fn finish(&mut self) {
+        if let Some(cancel) = self.cancel.take() {
+            cancel.abort();
+        }
+        self.started_at = None;
+        self.warned = false;
+    }
+
+    /// The warning for the client once the transaction runs longer than the warning threshold.
+    pub fn take_warning(&mut self) -> Option<String> {
+        let elapsed = self.started_at?.elapsed();
+        if self.warned || self.warning.is_zero() || elapsed < self.warning {
+            return None;
+        }
+        self.warned = true;
+        TRANSACTION_DURATION_WARNING_COUNTER.fetch_add(1, Ordering::Relaxed);
+        let message = if self.limit.is_zero() {
+            format!(
+                "transaction is running for {:.1}s, longer than transaction_duration_warning",
+                elapsed.as_secs_f64()
+            )
+        } else {
+            format!(
+                "transaction is running for {:.1}s, it will be cancelled after {:.1}s (transaction_duration_limit)",
+                elapsed.as_secs_f64(),
+                self.limit.as_secs_f64()
+            )
+        };
+        Some(message)
+    }
+
+    /// Time left until the limit, if there is one.
+    pub fn remaining(&self) -> Option<Duration> {
+        if self.limit.is_zero() {
+            return None;
+        }
+        let started_at = self.started_at?;
+        Some(self.limit.saturating_sub(started_at.elapsed()))
+    }
+}
+
+impl Drop for TransactionLimit {
+    fn drop(&mut self) {
+        self.finish();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_transaction_limit_thresholds() {
+        let mut limit = TransactionLimit::new(0, 0);
+        assert!(!limit.is_enabled());
+        assert_eq!(limit.remaining(), None);
+
+        limit = TransactionLimit::new(10, 0);
+        limit.started_at = Some(Instant::now() - Duration::from_millis(20));
+        assert_eq!(limit.remaining(), None);
+        assert!(limit.take_warning().is_some());
+        // Only once per transaction.
+        assert!(limit.take_warning().is_none());
+        limit.finish();
+        assert!(limit.take_warning().is_none());
+
+        limit = TransactionLimit::new(1000, 2000);
+        limit.started_at = Some(Instant::now() - Duration::from_millis(500));
+        assert!(limit.take_warning().is_none());
+        let remaining = limit.remaining().unwrap();
+        assert!(remaining <= Duration::from_millis(1500) && remaining > Duration::ZERO);
+    }
+}
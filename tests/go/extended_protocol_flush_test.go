@@ -0,0 +1,96 @@
+package doorman_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func messageCodes(messages []*message) string {
+	codes := ""
+	for _, m := range messages {
+		codes += string(m.code)
+	}
+	return codes
+}
+
+func sendFlushQuery(t *testing.T, conn net.Conn, query string) {
+	sendParseQuery(t, conn, query)
+	sendBindMessage(t, conn)
+	sendDescribe(t, conn, "P")
+	sendExecute(t, conn)
+}
+
+// Pipeline mode of pgx v5 and Npgsql: the responses to the messages sent with
+// Flush come without waiting for Sync, the server stays with the client until it.
+func Test_FlushPipeline(t *testing.T) {
+	conn, errConn := net.Dial("tcp", poolerAddr)
+	if errConn != nil {
+		t.Fatal(errConn)
+	}
+	defer conn.Close()
+	login(t, conn, "example_user_1", "example_db", "test")
+
+	sendFlushQuery(t, conn, "select 1")
+	sendFlushQuery(t, conn, "select 2")
+	sendFlushMessage(t, conn)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	assert.Equal(t, "12TDC12TDC", messageCodes(readServerMessagesCount(t, conn, 10)))
+
+	sendFlushQuery(t, conn, "select 3")
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "12TDCZ", messageCodes(readServerMessages(t, conn)))
+
+	// After an error the server skips the messages up to Sync.
+	sendFlushQuery(t, conn, "select 1")
+	sendFlushQuery(t, conn, "select sasasa")
+	sendFlushMessage(t, conn)
+	assert.Equal(t, "12TDCE", messageCodes(readServerMessagesCount(t, conn, 6)))
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "Z", messageCodes(readServerMessages(t, conn)))
+
+	sendFlushQuery(t, conn, "select 4")
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "12TDCZ", messageCodes(readServerMessages(t, conn)))
+	byeBye(t, conn)
+}
+
+// A COPY run by an Execute sent with Flush: the Execute is answered with the
+// COPY response and the COPY ends with its CommandComplete before the Sync.
+func Test_FlushCopy(t *testing.T) {
+	conn, errConn := net.Dial("tcp", poolerAddr)
+	if errConn != nil {
+		t.Fatal(errConn)
+	}
+	defer conn.Close()
+	login(t, conn, "example_user_1", "example_db", "test")
+
+	sendSimpleQuery(t, conn, "drop table if exists test_flush_copy; create table test_flush_copy (id int)")
+	readServerMessages(t, conn)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	sendParseQuery(t, conn, "copy test_flush_copy from stdin")
+	sendBindMessage(t, conn)
+	sendExecute(t, conn)
+	sendFlushMessage(t, conn)
+	assert.Equal(t, "12G", messageCodes(readServerMessagesCount(t, conn, 3)))
+	sendCopyData(t, conn, "1\n")
+	sendCopyDone(t, conn)
+	assert.Equal(t, "C", messageCodes(readServerMessagesCount(t, conn, 1)))
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "Z", messageCodes(readServerMessages(t, conn)))
+
+	sendParseQuery(t, conn, "copy test_flush_copy to stdout")
+	sendBindMessage(t, conn)
+	sendExecute(t, conn)
+	sendFlushMessage(t, conn)
+	assert.Equal(t, "12HdcC", messageCodes(readServerMessagesCount(t, conn, 6)))
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "Z", messageCodes(readServerMessages(t, conn)))
+
+	sendSimpleQuery(t, conn, "drop table test_flush_copy")
+	readServerMessages(t, conn)
+	byeBye(t, conn)
+}
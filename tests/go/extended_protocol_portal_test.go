@@ -0,0 +1,90 @@
+package doorman_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Execute with a row limit (JDBC setFetchSize, pgx row-limited reads): the portal
+// is suspended and the next Executes read the rest on the same server.
+func Test_PortalSuspended(t *testing.T) {
+	conn, errConn := net.Dial("tcp", poolerAddr)
+	if errConn != nil {
+		t.Fatal(errConn)
+	}
+	defer conn.Close()
+	login(t, conn, "example_user_1", "example_db", "test")
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// In a transaction.
+	sendSimpleQuery(t, conn, "begin")
+	assert.Equal(t, "CZ", messageCodes(readServerMessages(t, conn)))
+	sendParseQuery(t, conn, "select generate_series(1, 5)")
+	sendBindMessage(t, conn)
+	sendExecuteMaxRows(t, conn, 2)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "12DDsZ", messageCodes(readServerMessages(t, conn)))
+	sendExecuteMaxRows(t, conn, 2)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "DDsZ", messageCodes(readServerMessages(t, conn)))
+	sendExecute(t, conn)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "DCZ", messageCodes(readServerMessages(t, conn)))
+	sendSimpleQuery(t, conn, "commit")
+	assert.Equal(t, "CZ", messageCodes(readServerMessages(t, conn)))
+
+	// In a pipeline sent with Flush, up to its Sync.
+	sendParseQuery(t, conn, "select generate_series(1, 5)")
+	sendBindMessage(t, conn)
+	sendExecuteMaxRows(t, conn, 2)
+	sendFlushMessage(t, conn)
+	assert.Equal(t, "12DDs", messageCodes(readServerMessagesCount(t, conn, 5)))
+	sendExecuteMaxRows(t, conn, 2)
+	sendFlushMessage(t, conn)
+	assert.Equal(t, "DDs", messageCodes(readServerMessagesCount(t, conn, 3)))
+	sendExecute(t, conn)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "DCZ", messageCodes(readServerMessages(t, conn)))
+	byeBye(t, conn)
+}
+
+// Named portals: Bind, Describe and Execute by name, then Close.
+func Test_NamedPortal(t *testing.T) {
+	conn, errConn := net.Dial("tcp", poolerAddr)
+	if errConn != nil {
+		t.Fatal(errConn)
+	}
+	defer conn.Close()
+	login(t, conn, "example_user_1", "example_db", "test")
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	sendSimpleQuery(t, conn, "begin")
+	assert.Equal(t, "CZ", messageCodes(readServerMessages(t, conn)))
+	sendParseQuery(t, conn, "select generate_series(1, 3)")
+	sendBindPortal(t, conn, "C_1")
+	sendDescribeName(t, conn, "P", "C_1")
+	sendExecutePortal(t, conn, "C_1", 2)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "12TDDsZ", messageCodes(readServerMessages(t, conn)))
+
+	// Another statement runs while the portal is open.
+	sendParseQuery(t, conn, "select 1")
+	sendBindMessage(t, conn)
+	sendExecute(t, conn)
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "12DCZ", messageCodes(readServerMessages(t, conn)))
+
+	sendExecutePortal(t, conn, "C_1", 2)
+	sendClosePortal(t, conn, "C_1")
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "DC3Z", messageCodes(readServerMessages(t, conn)))
+	sendDescribeName(t, conn, "P", "C_1")
+	sendSyncMessage(t, conn)
+	assert.Equal(t, "EZ", messageCodes(readServerMessages(t, conn)))
+	sendSimpleQuery(t, conn, "rollback")
+	assert.Equal(t, "CZ", messageCodes(readServerMessages(t, conn)))
+	byeBye(t, conn)
+}
@@ -43,6 +43,19 @@ func readServerMessages(t *testing.T, conn net.Conn) []*message {
 	}
 }
 
+func readServerMessagesCount(t *testing.T, conn net.Conn, count int) []*message {
+	var messages []*message
+	for len(messages) < count {
+		response := make([]byte, 5)
+		readAll(t, conn, response)
+		code, length := response[0], bytesToI32(response[1:5])
+		bb := make([]byte, length-4)
+		readAll(t, conn, bb)
+		messages = append(messages, &message{code: rune(code), length: length, bytes: bb})
+	}
+	return messages
+}
+
 func readAll(t *testing.T, conn net.Conn, buf []byte) {
 	from := 0
 	for {
@@ -30,18 +30,79 @@ func sendSyncMessage(t *testing.T, conn net.Conn) {
 	t.Log("successfully send sync")
 }
 
+func sendFlushMessage(t *testing.T, conn net.Conn) {
+	message := make([]byte, 1)
+	utf8.EncodeRune(message, 'H')
+	message = append(message, i32ToBytes(4)...)
+	if count, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	} else if count != len(message) {
+		t.Fatal("expected to write", len(message), "but got", count)
+	}
+	t.Log("successfully send flush")
+}
+
+func sendCopyData(t *testing.T, conn net.Conn, data string) {
+	message := make([]byte, 1)
+	utf8.EncodeRune(message, 'd')
+	message = append(message, i32ToBytes(int32(len(data)+4))...)
+	message = append(message, stringToBytes(data)...)
+	if count, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	} else if count != len(message) {
+		t.Fatal("expected to write", len(message), "but got", count)
+	}
+	t.Log("successfully send copy data")
+}
+
+func sendCopyDone(t *testing.T, conn net.Conn) {
+	message := make([]byte, 1)
+	utf8.EncodeRune(message, 'c')
+	message = append(message, i32ToBytes(4)...)
+	if count, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	} else if count != len(message) {
+		t.Fatal("expected to write", len(message), "but got", count)
+	}
+	t.Log("successfully send copy done")
+}
+
 func sendExecute(t *testing.T, conn net.Conn) {
+	sendExecuteMaxRows(t, conn, 0)
+}
+
+func sendExecuteMaxRows(t *testing.T, conn net.Conn, maxRows int32) {
+	sendExecutePortal(t, conn, "", maxRows)
+}
+
+func sendExecutePortal(t *testing.T, conn net.Conn, portal string, maxRows int32) {
 	message := make([]byte, 1)
 	utf8.EncodeRune(message, 'E')
-	message = append(message, i32ToBytes(9)...)
-	message = append(message, "\000"...) // unnamed statement
-	message = append(message, i32ToBytes(0)...)
+	message = append(message, i32ToBytes(int32(4+len(portal)+1+4))...)
+	message = append(message, stringToBytes(portal)...)
+	message = append(message, "\000"...)
+	message = append(message, i32ToBytes(maxRows)...)
+	if count, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	} else if count != len(message) {
+		t.Fatal("expected to write", len(message), "but got", count)
+	}
+	t.Logf("successfully send execute, portal: %q, max rows: %d", portal, maxRows)
+}
+
+func sendClosePortal(t *testing.T, conn net.Conn, portal string) {
+	message := make([]byte, 1)
+	utf8.EncodeRune(message, 'C')
+	message = append(message, i32ToBytes(int32(4+1+len(portal)+1))...)
+	message = append(message, "P"...)
+	message = append(message, stringToBytes(portal)...)
+	message = append(message, "\000"...)
 	if count, err := conn.Write(message); err != nil {
 		t.Fatal(err)
 	} else if count != len(message) {
 		t.Fatal("expected to write", len(message), "but got", count)
 	}
-	t.Log("successfully send execute")
+	t.Logf("successfully close portal: %q", portal)
 }
 
 func sendSimpleQuery(t *testing.T, conn net.Conn, query string) {
@@ -77,24 +138,34 @@ func sendParseQuery(t *testing.T, conn net.Conn, query string) {
 }
 
 func sendDescribe(t *testing.T, conn net.Conn, mode string) {
+	sendDescribeName(t, conn, mode, "")
+}
+
+func sendDescribeName(t *testing.T, conn net.Conn, mode, name string) {
 	message := make([]byte, 1)
 	utf8.EncodeRune(message, 'D')
-	message = append(message, i32ToBytes(6)...)
+	message = append(message, i32ToBytes(int32(4+1+len(name)+1))...)
 	message = append(message, stringToBytes(mode)...)
-	message = append(message, "\000"...) // unnamed statement
+	message = append(message, stringToBytes(name)...)
+	message = append(message, "\000"...)
 	if count, err := conn.Write(message); err != nil {
 		t.Fatal(err)
 	} else if count != len(message) {
 		t.Fatal("expected to write", len(message), "but got", count)
 	}
-	t.Logf("successfully describe: %s\n", mode)
+	t.Logf("successfully describe: %s %q\n", mode, name)
 }
 
 func sendBindMessage(t *testing.T, conn net.Conn) {
+	sendBindPortal(t, conn, "")
+}
+
+func sendBindPortal(t *testing.T, conn net.Conn, portal string) {
 	message := make([]byte, 1)
 	utf8.EncodeRune(message, 'B')
-	message = append(message, i32ToBytes(12)...)
-	message = append(message, "\000"...) // unnamed statement
+	message = append(message, i32ToBytes(int32(12+len(portal)))...)
+	message = append(message, stringToBytes(portal)...)
+	message = append(message, "\000"...)
 	message = append(message, "\000"...) // unnamed statement
 	message = append(message, "\000\000\000\000\000\000"...)
 	if count, err := conn.Write(message); err != nil {
@@ -102,5 +173,5 @@ func sendBindMessage(t *testing.T, conn net.Conn) {
 	} else if count != len(message) {
 		t.Fatal("expected to write", len(message), "but got", count)
 	}
-	t.Logf("successfully bind\n")
+	t.Logf("successfully bind: %q\n", portal)
 }
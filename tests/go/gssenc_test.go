@@ -0,0 +1,29 @@
+package doorman_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// libpq with Kerberos credentials sends GSSENCRequest first (gssencmode=prefer),
+// the pooler must decline it and go on with the regular startup on the same connection.
+func TestGSSEncRequestDeclined(t *testing.T) {
+	conn, err := net.Dial("tcp", poolerAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	gssencRequest := append(i32ToBytes(8), i32ToBytes(80877104)...)
+	_, err = conn.Write(gssencRequest)
+	require.NoError(t, err)
+
+	response := make([]byte, 1)
+	_, err = conn.Read(response)
+	require.NoError(t, err)
+	require.Equal(t, "N", string(response), "GSSENCRequest must be declined")
+
+	login(t, conn, "example_user_1", "example_db", "test")
+}
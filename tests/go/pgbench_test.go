@@ -0,0 +1,94 @@
+package doorman_test
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pgbench compatibility validation: the standard TPC-B-like and select-only scripts
+// run through the pooler in every pool mode must not fail more often than on a direct
+// connection, and the throughput must not drop by more than PGBENCH_MAX_OVERHEAD.
+//
+// PGBENCH_DURATION (seconds, default 5), PGBENCH_CLIENTS (default 8) and
+// PGBENCH_MAX_OVERHEAD (fraction of the direct tps, default 0.5) tune the runs.
+
+var (
+	pgbenchTPS    = regexp.MustCompile(`tps = ([0-9.]+) \(without initial connection time\)`)
+	pgbenchFailed = regexp.MustCompile(`number of failed transactions: ([0-9]+)`)
+)
+
+type pgbenchResult struct {
+	tps    float64
+	failed int
+}
+
+func envOrDefault(name string, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+func runPgbench(t *testing.T, url string, args ...string) pgbenchResult {
+	args = append(args, url)
+	output, err := exec.Command("pgbench", args...).CombinedOutput()
+	require.NoError(t, err, "pgbench %v:\n%s", args, output)
+
+	var result pgbenchResult
+	match := pgbenchTPS.FindSubmatch(output)
+	require.NotNil(t, match, "no tps in pgbench output:\n%s", output)
+	result.tps, err = strconv.ParseFloat(string(match[1]), 64)
+	require.NoError(t, err)
+	// Older pgbench versions don't report failed transactions, they stop on errors.
+	if match := pgbenchFailed.FindSubmatch(output); match != nil {
+		result.failed, err = strconv.Atoi(string(match[1]))
+		require.NoError(t, err)
+	}
+	return result
+}
+
+func TestPgbenchCompatibility(t *testing.T) {
+	if _, err := exec.LookPath("pgbench"); err != nil {
+		t.Skip("pgbench is not installed")
+	}
+	direct := os.Getenv("DATABASE_URL_DIRECT")
+	require.NotEmpty(t, direct, "DATABASE_URL_DIRECT is not set")
+	pools := map[string]string{
+		"transaction": os.Getenv("DATABASE_URL"),
+		"session":     os.Getenv("DATABASE_URL_SESSION"),
+	}
+	duration := envOrDefault("PGBENCH_DURATION", "5")
+	clients := envOrDefault("PGBENCH_CLIENTS", "8")
+	maxOverhead, err := strconv.ParseFloat(envOrDefault("PGBENCH_MAX_OVERHEAD", "0.5"), 64)
+	require.NoError(t, err)
+
+	output, err := exec.Command("pgbench", "-i", "-q", "-s", "1", direct).CombinedOutput()
+	require.NoError(t, err, "pgbench -i:\n%s", output)
+
+	for _, script := range []string{"tpcb-like", "select-only"} {
+		for _, protocol := range []string{"simple", "extended", "prepared"} {
+			args := []string{"-n", "-b", script, "-M", protocol, "-c", clients, "-j", "2", "-T", duration}
+			baseline := runPgbench(t, direct, args...)
+			t.Logf("%s/%s direct: %.0f tps, %d failed", script, protocol, baseline.tps, baseline.failed)
+
+			for mode, url := range pools {
+				require.NotEmpty(t, url, "no url for %s pool mode", mode)
+				t.Run(script+"/"+protocol+"/"+mode, func(t *testing.T) {
+					result := runPgbench(t, url, args...)
+					t.Logf("%.0f tps (%.0f%% of direct), %d failed",
+						result.tps, 100*result.tps/baseline.tps, result.failed)
+					assert.LessOrEqual(t, result.failed, baseline.failed,
+						"more failed transactions than on a direct connection")
+					assert.GreaterOrEqual(t, result.tps, baseline.tps*(1-maxOverhead),
+						"throughput overhead is above %.0f%%", 100*maxOverhead)
+				})
+			}
+		}
+	}
+}